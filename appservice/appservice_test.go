@@ -0,0 +1,150 @@
+package appservice_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/appservice/query"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func newTestAppservice(t *testing.T, srvURL string) config.ApplicationService {
+	t.Helper()
+	as := config.ApplicationService{
+		ID:              "someID",
+		URL:             srvURL,
+		ASToken:         "as_token",
+		HSToken:         "hs_token",
+		SenderLocalpart: "bot",
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"users": {
+				{
+					Exclusive:    true,
+					Regex:        "@as-.*:test",
+					RegexpObject: regexp.MustCompile("@as-.*:test"),
+				},
+			},
+			"aliases": {
+				{
+					Exclusive:    true,
+					Regex:        "#asroom-.*:test",
+					RegexpObject: regexp.MustCompile("#asroom-.*:test"),
+				},
+			},
+		},
+	}
+	as.CreateHTTPClient(true)
+	return as
+}
+
+func TestAppserviceInternalAPI(t *testing.T) {
+	// Set expected results
+	wantLocationResponse := "#asroom-known:test"
+	wantUserResponse := "@as-known:test"
+
+	var gotAuthHeaders []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuthHeaders = append(gotAuthHeaders, r.Header.Get("Authorization"))
+		switch {
+		case strings.HasPrefix(r.URL.Path, api.ASRoomAliasExistsPath):
+			if strings.TrimPrefix(r.URL.Path, api.ASRoomAliasExistsPath) == wantLocationResponse {
+				_, _ = w.Write([]byte("{}"))
+				return
+			}
+		case strings.HasPrefix(r.URL.Path, api.ASUserExistsPath):
+			if strings.TrimPrefix(r.URL.Path, api.ASUserExistsPath) == wantUserResponse {
+				_, _ = w.Write([]byte("{}"))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	cfg := &config.AppServiceAPI{
+		Derived: &config.Derived{
+			ApplicationServices: []config.ApplicationService{newTestAppservice(t, srv.URL)},
+		},
+	}
+	asAPI := &query.AppServiceQueryAPI{Cfg: cfg}
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		alias string
+		want  bool
+	}{
+		{name: "known alias", alias: wantLocationResponse, want: true},
+		{name: "unknown alias", alias: "#asroom-unknown:test"},
+		{name: "alias outside namespace", alias: "#other:test"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := &api.RoomAliasExistsResponse{}
+			if err := asAPI.RoomAliasExists(ctx, &api.RoomAliasExistsRequest{Alias: tc.alias}, res); err != nil {
+				t.Fatal(err)
+			}
+			if res.AliasExists != tc.want {
+				t.Fatalf("expected alias exists %v, got %v", tc.want, res.AliasExists)
+			}
+		})
+	}
+
+	userTests := []struct {
+		name   string
+		userID string
+		want   bool
+	}{
+		{name: "known user", userID: wantUserResponse, want: true},
+		{name: "unknown user", userID: "@as-unknown:test"},
+		{name: "user outside namespace", userID: "@alice:test"},
+	}
+	for _, tc := range userTests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := &api.UserIDExistsResponse{}
+			if err := asAPI.UserIDExists(ctx, &api.UserIDExistsRequest{UserID: tc.userID}, res); err != nil {
+				t.Fatal(err)
+			}
+			if res.UserIDExists != tc.want {
+				t.Fatalf("expected user exists %v, got %v", tc.want, res.UserIDExists)
+			}
+		})
+	}
+
+	for _, header := range gotAuthHeaders {
+		if header != "Bearer hs_token" {
+			t.Fatalf("expected hs_token to be sent as bearer token, got %q", header)
+		}
+	}
+}
+
+func TestRoomAliasExistsSkipsBrokenAppservice(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	brokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	brokenSrv.Close()
+
+	broken := newTestAppservice(t, brokenSrv.URL)
+	broken.ID = "broken"
+	cfg := &config.AppServiceAPI{
+		Derived: &config.Derived{
+			ApplicationServices: []config.ApplicationService{broken, newTestAppservice(t, srv.URL)},
+		},
+	}
+	asAPI := &query.AppServiceQueryAPI{Cfg: cfg}
+
+	res := &api.RoomAliasExistsResponse{}
+	if err := asAPI.RoomAliasExists(context.Background(), &api.RoomAliasExistsRequest{Alias: "#asroom-known:test"}, res); err != nil {
+		t.Fatalf("expected the broken application service to be skipped, got %s", err)
+	}
+	if !res.AliasExists {
+		t.Fatalf("expected the alias to exist")
+	}
+}
@@ -0,0 +1,140 @@
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+)
+
+type fakeRoomserverAPI struct {
+	api.AppserviceRoomserverAPI
+	aliases []string
+}
+
+func (f *fakeRoomserverAPI) QueryUserIDForSender(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	return senderID.ToUserID(), nil
+}
+
+func (f *fakeRoomserverAPI) GetAliasesForRoomID(ctx context.Context, req *api.GetAliasesForRoomIDRequest, res *api.GetAliasesForRoomIDResponse) error {
+	res.Aliases = f.aliases
+	return nil
+}
+
+func (f *fakeRoomserverAPI) QueryMembershipsForRoom(ctx context.Context, req *api.QueryMembershipsForRoomRequest, res *api.QueryMembershipsForRoomResponse) error {
+	return nil
+}
+
+func newTestConsumer(t *testing.T, srvURL string, rsAPI api.AppserviceRoomserverAPI) (*OutputRoomEventConsumer, *appserviceState) {
+	t.Helper()
+	as := &config.ApplicationService{
+		ID:              "someID",
+		URL:             srvURL,
+		ASToken:         "as_token",
+		HSToken:         "hs_token",
+		SenderLocalpart: "bot",
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"users": {{
+				Exclusive:    true,
+				Regex:        "@as-.*:test",
+				RegexpObject: regexp.MustCompile("@as-.*:test"),
+			}},
+			"aliases": {{
+				Exclusive:    true,
+				Regex:        "#asroom-.*:test",
+				RegexpObject: regexp.MustCompile("#asroom-.*:test"),
+			}},
+		},
+	}
+	as.CreateHTTPClient(true)
+	cfg := &config.AppServiceAPI{
+		Derived: &config.Derived{
+			ApplicationServices: []config.ApplicationService{*as},
+		},
+	}
+	return &OutputRoomEventConsumer{
+		ctx:   context.Background(),
+		cfg:   cfg,
+		rsAPI: rsAPI,
+	}, &appserviceState{ApplicationService: as}
+}
+
+func TestAppserviceIsInterestedInEvent(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	ev := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+	member := room.CreateAndInsert(t, alice, spec.MRoomMember, map[string]interface{}{"membership": spec.Invite}, test.WithStateKey("@as-bridged:test"))
+
+	tests := []struct {
+		name    string
+		event   *types.HeaderedEvent
+		aliases []string
+		want    bool
+	}{
+		{name: "event not in any namespace", event: ev},
+		{name: "room alias in namespace", event: ev, aliases: []string{"#asroom-abc:test"}, want: true},
+		{name: "membership for namespaced user", event: member, want: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			consumer, state := newTestConsumer(t, "http://localhost", &fakeRoomserverAPI{aliases: tc.aliases})
+			if got := consumer.appserviceIsInterestedInEvent(context.Background(), tc.event, state.ApplicationService); got != tc.want {
+				t.Fatalf("expected interested %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSendEvents(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	ev := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+
+	var gotPath, gotAuth string
+	var gotTxn ApplicationServiceTransaction
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &gotTxn)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	consumer, state := newTestConsumer(t, srv.URL, &fakeRoomserverAPI{})
+	if err := consumer.sendEvents(context.Background(), state, []*types.HeaderedEvent{ev}, "1234"); err != nil {
+		t.Fatalf("failed to send events: %s", err)
+	}
+	if gotPath != "/_matrix/app/v1/transactions/1234" {
+		t.Fatalf("unexpected transaction path %q", gotPath)
+	}
+	if gotAuth != "Bearer hs_token" {
+		t.Fatalf("unexpected authorization header %q", gotAuth)
+	}
+	if len(gotTxn.Events) != 1 || gotTxn.Events[0].EventID != ev.EventID() {
+		t.Fatalf("unexpected transaction contents: %+v", gotTxn)
+	}
+
+	// A failing appservice should report an error and back off
+	status = http.StatusInternalServerError
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // don't actually wait for the backoff to expire
+	if err := consumer.sendEvents(ctx, state, []*types.HeaderedEvent{ev}, "1235"); err == nil {
+		t.Fatalf("expected an error from a failing appservice")
+	}
+	if state.backoff != 1 {
+		t.Fatalf("expected backoff to be 1, got %d", state.backoff)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2018 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package query handles requests from other internal dendrite components when
+// they interact with the AppServiceQueryAPI.
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// AppServiceQueryAPI is an implementation of api.AppServiceQueryAPI
+type AppServiceQueryAPI struct {
+	Cfg *config.AppServiceAPI
+}
+
+// RoomAliasExists performs a request to '/rooms/{roomAlias}' on all known
+// handling application services until one admits to owning the room
+func (a *AppServiceQueryAPI) RoomAliasExists(
+	ctx context.Context,
+	request *api.RoomAliasExistsRequest,
+	response *api.RoomAliasExistsResponse,
+) error {
+	trace, ctx := internal.StartRegion(ctx, "ApplicationServiceRoomAlias")
+	defer trace.EndRegion()
+
+	path := api.ASRoomAliasExistsPath
+	if a.Cfg.LegacyPaths {
+		path = api.ASRoomAliasExistsLegacyPath
+	}
+
+	// Determine which application service should handle this request
+	for i := range a.Cfg.Derived.ApplicationServices {
+		appservice := &a.Cfg.Derived.ApplicationServices[i]
+		if appservice.URL == "" || !appservice.IsInterestedInRoomAlias(request.Alias) {
+			continue
+		}
+		// Send a request to each application service. If one responds that it has
+		// created the room, immediately return.
+		exists, err := a.queryAppservice(ctx, appservice, path, request.Alias)
+		if err != nil {
+			// Keep trying other application services in case they own the alias
+			log.WithError(err).Errorf("Issue querying room alias on application service %s", appservice.ID)
+			continue
+		}
+		if exists {
+			response.AliasExists = true
+			return nil
+		}
+	}
+
+	response.AliasExists = false
+	return nil
+}
+
+// UserIDExists performs a request to '/users/{userID}' on all known
+// handling application services until one admits to owning the user ID
+func (a *AppServiceQueryAPI) UserIDExists(
+	ctx context.Context,
+	request *api.UserIDExistsRequest,
+	response *api.UserIDExistsResponse,
+) error {
+	trace, ctx := internal.StartRegion(ctx, "ApplicationServiceUserID")
+	defer trace.EndRegion()
+
+	path := api.ASUserExistsPath
+	if a.Cfg.LegacyPaths {
+		path = api.ASUserExistsLegacyPath
+	}
+
+	// Determine which application service should handle this request
+	for i := range a.Cfg.Derived.ApplicationServices {
+		appservice := &a.Cfg.Derived.ApplicationServices[i]
+		if appservice.URL == "" || !appservice.IsInterestedInUserID(request.UserID) {
+			continue
+		}
+		// Send a request to each application service. If one responds that it has
+		// created the user, immediately return.
+		exists, err := a.queryAppservice(ctx, appservice, path, request.UserID)
+		if err != nil {
+			// Keep trying other application services in case they own the user
+			log.WithError(err).Errorf("Issue querying user ID on application service %s", appservice.ID)
+			continue
+		}
+		if exists {
+			response.UserIDExists = true
+			return nil
+		}
+	}
+
+	response.UserIDExists = false
+	return nil
+}
+
+// queryAppservice performs a GET request for the given entity against the
+// given application service, returning true if the application service
+// responded with 200 OK.
+func (a *AppServiceQueryAPI) queryAppservice(
+	ctx context.Context,
+	appservice *config.ApplicationService,
+	path, entity string,
+) (bool, error) {
+	apiURL, err := url.Parse(appservice.RequestUrl() + path)
+	if err != nil {
+		return false, err
+	}
+	apiURL.Path += entity
+	if a.Cfg.LegacyAuth {
+		q := apiURL.Query()
+		q.Set("access_token", appservice.HSToken)
+		apiURL.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", appservice.HSToken))
+
+	resp, err := appservice.HTTPClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			log.WithFields(log.Fields{
+				"appservice_id": appservice.ID,
+				"status_code":   resp.StatusCode,
+			}).WithError(err).Error("Unable to close application service response body")
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// OK received from appservice, the entity exists
+		return true, nil
+	case http.StatusNotFound:
+		// The entity does not exist
+	default:
+		// Application service reported an error. Warn
+		log.WithFields(log.Fields{
+			"appservice_id": appservice.ID,
+			"status_code":   resp.StatusCode,
+		}).Warn("Application service responded with non-OK status code")
+	}
+	return false, nil
+}
@@ -81,6 +81,16 @@ func VerifyUserFromRequest(
 			}
 		}
 	}
+	if res.Expired {
+		// https://spec.matrix.org/v1.9/client-server-api/#soft-logout
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: softLogoutError{
+				MatrixError: spec.UnknownToken("Access token has expired"),
+				SoftLogout:  true,
+			},
+		}
+	}
 	if res.Device == nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusUnauthorized,
@@ -90,6 +100,13 @@ func VerifyUserFromRequest(
 	return res.Device, nil
 }
 
+// softLogoutError is an M_UNKNOWN_TOKEN error which tells the client that it can
+// get a new access token without logging in again.
+type softLogoutError struct {
+	spec.MatrixError
+	SoftLogout bool `json:"soft_logout"`
+}
+
 // GenerateAccessToken creates a new access token. Returns an error if failed to generate
 // random bytes.
 func GenerateAccessToken() (string, error) {
@@ -11,4 +11,6 @@ const (
 	LoginTypeRecaptcha          = "m.login.recaptcha"
 	LoginTypeApplicationService = "m.login.application_service"
 	LoginTypeToken              = "m.login.token"
+	LoginTypeEmailIdentity      = "m.login.email.identity"
+	LoginTypeSSO                = "m.login.sso"
 )
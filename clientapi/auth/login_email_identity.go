@@ -0,0 +1,114 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+type GetLocalpartForThreePID func(ctx context.Context, req *uapi.QueryLocalpartForThreePIDRequest, res *uapi.QueryLocalpartForThreePIDResponse) error
+
+// EmailIdentityRequest is the auth dict of the m.login.email.identity stage.
+type EmailIdentityRequest struct {
+	ThreePIDCreds threepid.Credentials `json:"threepid_creds"`
+}
+
+// LoginTypeEmailIdentity implements https://spec.matrix.org/v1.9/client-server-api/#email-based-identity--homeserver
+// The email address must have been validated through a session created by this server,
+// and must be associated with an account. The login is for the owner of the address.
+type LoginTypeEmailIdentity struct {
+	Sessions                *threepid.ValidationSessions
+	GetLocalpartForThreePID GetLocalpartForThreePID
+	Config                  *config.ClientAPI
+}
+
+func (t *LoginTypeEmailIdentity) Name() string {
+	return authtypes.LoginTypeEmailIdentity
+}
+
+// LoginFromJSON implements Type. The cleanup function deletes the validation
+// session on success, so that it can't be used twice.
+func (t *LoginTypeEmailIdentity) LoginFromJSON(ctx context.Context, reqBytes []byte) (*Login, LoginCleanupFunc, *util.JSONResponse) {
+	var r EmailIdentityRequest
+	if err := httputil.UnmarshalJSON(reqBytes, &r); err != nil {
+		return nil, nil, err
+	}
+	return t.Login(ctx, &r)
+}
+
+// Login returns the login for the owner of the validated email address.
+func (t *LoginTypeEmailIdentity) Login(ctx context.Context, r *EmailIdentityRequest) (*Login, LoginCleanupFunc, *util.JSONResponse) {
+	creds := r.ThreePIDCreds
+	if creds.SID == "" || creds.Secret == "" {
+		return nil, nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("'threepid_creds' must contain a 'sid' and a 'client_secret'"),
+		}
+	}
+
+	session, ok := t.Sessions.Validated(creds.SID, creds.Secret)
+	if !ok {
+		return nil, nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: spec.MatrixError{
+				ErrCode: spec.ErrorThreePIDAuthFailed,
+				Err:     "The email address hasn't been validated",
+			},
+		}
+	}
+
+	var res uapi.QueryLocalpartForThreePIDResponse
+	if err := t.GetLocalpartForThreePID(ctx, &uapi.QueryLocalpartForThreePIDRequest{
+		ThreePID: session.Address,
+		Medium:   session.Medium,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("GetLocalpartForThreePID failed")
+		return nil, nil, &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if res.Localpart == "" || !t.Config.Matrix.IsLocalServerName(res.ServerName) {
+		return nil, nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: spec.MatrixError{
+				ErrCode: spec.ErrorThreePIDAuthFailed,
+				Err:     "The email address isn't associated with an account",
+			},
+		}
+	}
+
+	login := &Login{
+		Identifier: LoginIdentifier{
+			Type: "m.id.user",
+			User: userutil.MakeUserID(res.Localpart, res.ServerName),
+		},
+	}
+	return login, func(ctx context.Context, authRes *util.JSONResponse) {
+		if authRes == nil || authRes.Code == http.StatusOK {
+			t.Sessions.Delete(creds.SID)
+		}
+	}, nil
+}
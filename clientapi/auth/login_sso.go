@@ -0,0 +1,40 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// LoginTypeSSO implements the m.login.sso stage of user-interactive authentication.
+// The stage can only be completed through the fallback web page, which sends the
+// user to the identity provider, see UserInteractive.CompleteFallbackStage.
+type LoginTypeSSO struct{}
+
+func (t *LoginTypeSSO) Name() string {
+	return authtypes.LoginTypeSSO
+}
+
+func (t *LoginTypeSSO) LoginFromJSON(ctx context.Context, reqBytes []byte) (*Login, LoginCleanupFunc, *util.JSONResponse) {
+	return nil, nil, &util.JSONResponse{
+		Code: http.StatusUnauthorized,
+		JSON: spec.Forbidden("Single sign-on must be completed through the fallback web page"),
+	}
+}
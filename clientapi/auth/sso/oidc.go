@@ -0,0 +1,276 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+)
+
+const (
+	// discoveryCacheLifetime is how long we use the discovered configuration of an
+	// identity provider before fetching it again
+	discoveryCacheLifetime = time.Hour
+	// maxResponseSize limits how much we read from identity providers
+	maxResponseSize = 1 << 20
+)
+
+// oidcDiscovery is the part of the OpenID Provider Metadata we use.
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+}
+
+type oidcProvider struct {
+	cfg    *config.IdentityProvider
+	client *fclient.Client
+
+	mu           sync.Mutex
+	discovery    *oidcDiscovery
+	discoveredAt time.Time
+}
+
+func newOIDCProvider(cfg *config.IdentityProvider, client *fclient.Client) *oidcProvider {
+	return &oidcProvider{cfg: cfg, client: client}
+}
+
+func (p *oidcProvider) authorizationURL(ctx context.Context, callbackURL, state, nonce string) (string, error) {
+	disc, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(disc.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint %q: %w", disc.AuthorizationEndpoint, err)
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.cfg.ClientID)
+	query.Set("redirect_uri", callbackURL)
+	query.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func (p *oidcProvider) processCallback(ctx context.Context, callbackURL, nonce string, query url.Values) (*Identity, error) {
+	if errCode := query.Get("error"); errCode != "" {
+		return nil, fmt.Errorf("the identity provider returned an error: %s %s", errCode, query.Get("error_description"))
+	}
+	code := query.Get("code")
+	if code == "" {
+		return nil, fmt.Errorf("the identity provider didn't return an authorization code")
+	}
+	disc, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := p.exchangeCode(ctx, disc, callbackURL, code)
+	if err != nil {
+		return nil, err
+	}
+	// The ID token was received directly from the token endpoint over TLS, so
+	// we don't need to verify its signature, but we still check its claims.
+	// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+	claims, err := parseIDToken(token.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.verifyIDTokenClaims(disc, claims, nonce); err != nil {
+		return nil, err
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("the ID token doesn't contain a subject")
+	}
+
+	// The ID token may only contain the subject, so ask for the other claims too.
+	if disc.UserinfoEndpoint != "" && token.AccessToken != "" {
+		userinfo, err := p.userinfo(ctx, disc, token.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		if sub, _ := userinfo["sub"].(string); sub != subject {
+			return nil, fmt.Errorf("the userinfo subject %q doesn't match the ID token subject %q", sub, subject)
+		}
+		for k, v := range userinfo {
+			if _, ok := claims[k]; !ok {
+				claims[k] = v
+			}
+		}
+	}
+
+	localpart, _ := claims[p.cfg.LocalpartClaim].(string)
+	displayName, _ := claims[p.cfg.DisplayNameClaim].(string)
+	return &Identity{
+		IDPID:              p.cfg.ID,
+		Subject:            subject,
+		SuggestedLocalpart: localpart,
+		DisplayName:        displayName,
+	}, nil
+}
+
+// discover returns the configuration of the identity provider, fetching it if it
+// isn't cached.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil && time.Since(p.discoveredAt) < discoveryCacheLifetime {
+		return p.discovery, nil
+	}
+
+	discoveryURL := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	var disc oidcDiscovery
+	if err = p.doJSON(req, &disc); err != nil {
+		return nil, fmt.Errorf("failed to discover the OpenID configuration of %s: %w", p.cfg.ID, err)
+	}
+	if disc.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("the discovered issuer %q doesn't match the configured issuer %q", disc.Issuer, p.cfg.Issuer)
+	}
+	if disc.AuthorizationEndpoint == "" || disc.TokenEndpoint == "" {
+		return nil, fmt.Errorf("the OpenID configuration of %s doesn't contain the authorization and token endpoints", p.cfg.ID)
+	}
+	p.discovery = &disc
+	p.discoveredAt = time.Now()
+	return p.discovery, nil
+}
+
+func (p *oidcProvider) exchangeCode(ctx context.Context, disc *oidcDiscovery, callbackURL, code string) (*oidcTokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", callbackURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, disc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// client_secret_basic, see https://www.rfc-editor.org/rfc/rfc6749#section-2.3.1
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	var token oidcTokenResponse
+	if err = p.doJSON(req, &token); err != nil {
+		return nil, fmt.Errorf("failed to exchange the authorization code: %w", err)
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("the identity provider didn't return an ID token")
+	}
+	return &token, nil
+}
+
+func (p *oidcProvider) userinfo(ctx context.Context, disc *oidcDiscovery, accessToken string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, disc.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	var claims map[string]interface{}
+	if err = p.doJSON(req, &claims); err != nil {
+		return nil, fmt.Errorf("failed to get the userinfo: %w", err)
+	}
+	return claims, nil
+}
+
+func (p *oidcProvider) verifyIDTokenClaims(disc *oidcDiscovery, claims map[string]interface{}, nonce string) error {
+	if iss, _ := claims["iss"].(string); iss != disc.Issuer {
+		return fmt.Errorf("the ID token was issued by %q, not %q", iss, disc.Issuer)
+	}
+	var audiences []interface{}
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = []interface{}{aud}
+	case []interface{}:
+		audiences = aud
+	}
+	found := false
+	for _, aud := range audiences {
+		if aud == p.cfg.ClientID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("the ID token isn't intended for this client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("the ID token has expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return fmt.Errorf("the ID token nonce doesn't match")
+	}
+	return nil
+}
+
+// doJSON sends the request and decodes the JSON response into res.
+func (p *oidcProvider) doJSON(req *http.Request, res interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.DoHTTPRequest(req.Context(), req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned HTTP %d: %s", req.Method, req.URL.Redacted(), resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, res)
+}
+
+// parseIDToken returns the claims of a JWT, without verifying its signature.
+func parseIDToken(idToken string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("the ID token isn't a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the ID token: %w", err)
+	}
+	var claims map[string]interface{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to decode the ID token: %w", err)
+	}
+	return claims, nil
+}
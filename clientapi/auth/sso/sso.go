@@ -0,0 +1,80 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sso implements single sign-on with OpenID Connect identity providers.
+// It only talks to the identity providers; mapping identities to accounts and
+// logging users in is up to the caller.
+package sso
+
+import (
+	"context"
+	"errors"
+	"net/url"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+)
+
+// ErrUnknownProvider is returned if there is no identity provider with the given ID.
+var ErrUnknownProvider = errors.New("unknown identity provider")
+
+// Identity is a user as asserted by an identity provider.
+type Identity struct {
+	// The ID of the identity provider
+	IDPID string
+	// The identifier of the user at the identity provider, which never changes
+	Subject string
+	// The localpart the user would like to have, may be empty
+	SuggestedLocalpart string
+	// The display name of the user, may be empty
+	DisplayName string
+}
+
+// Authenticator signs users in with the identity providers configured in client_api.sso.
+type Authenticator struct {
+	providers map[string]*oidcProvider
+}
+
+func NewAuthenticator(cfg *config.SSO, client *fclient.Client) *Authenticator {
+	a := &Authenticator{
+		providers: make(map[string]*oidcProvider, len(cfg.Providers)),
+	}
+	for i := range cfg.Providers {
+		p := &cfg.Providers[i]
+		a.providers[p.ID] = newOIDCProvider(p, client)
+	}
+	return a
+}
+
+// AuthorizationURL returns the URL of the identity provider to send the user to.
+// The identity provider redirects the user to callbackURL afterwards, with the
+// given state. The nonce is included in the ID token, to prevent replay attacks.
+func (a *Authenticator) AuthorizationURL(ctx context.Context, idpID, callbackURL, state, nonce string) (string, error) {
+	p, ok := a.providers[idpID]
+	if !ok {
+		return "", ErrUnknownProvider
+	}
+	return p.authorizationURL(ctx, callbackURL, state, nonce)
+}
+
+// ProcessCallback exchanges the authorization code in the query parameters of the
+// callback for the identity of the user. The callbackURL and nonce must be the same
+// as the ones passed to AuthorizationURL.
+func (a *Authenticator) ProcessCallback(ctx context.Context, idpID, callbackURL, nonce string, query url.Values) (*Identity, error) {
+	p, ok := a.providers[idpID]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return p.processCallback(ctx, callbackURL, nonce, query)
+}
@@ -17,11 +17,14 @@ package auth
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"sync"
 
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
@@ -71,6 +74,9 @@ type Login struct {
 	// Thus a pointer is needed to differentiate between the two
 	InitialDisplayName *string `json:"initial_device_display_name"`
 	DeviceID           *string `json:"device_id"`
+
+	// Whether the client supports refreshing its access token.
+	RefreshToken bool `json:"refresh_token"`
 }
 
 // Username returns the user localpart/user_id in this request, if it exists.
@@ -109,14 +115,34 @@ type UserInteractive struct {
 	Types map[string]Type
 	// Map of session ID to completed login types, will need to be extended in future
 	Sessions map[string][]string
+	// Map of session ID to the login of a stage completed through the fallback web page
+	fallbackLogins map[string]fallbackLogin
+	// Map of session ID to the user who started the session, if any
+	sessionUsers map[string]string
+}
+
+var (
+	// ErrUnknownSession is returned when completing a stage of a session which doesn't exist.
+	ErrUnknownSession = errors.New("unknown user-interactive auth session")
+	// ErrSessionUserMismatch is returned when a stage is completed by a different user than
+	// the one who started the session.
+	ErrSessionUserMismatch = errors.New("user-interactive auth session was started by a different user")
+)
+
+type fallbackLogin struct {
+	authType string
+	login    *Login
 }
 
-func NewUserInteractive(userAccountAPI api.UserLoginAPI, cfg *config.ClientAPI) *UserInteractive {
+// NewUserInteractive returns a UserInteractive which accepts the m.login.password stage.
+// If threePIDSessions is not nil, the m.login.email.identity stage is accepted too, and
+// the m.login.sso stage is accepted if single sign-on is enabled.
+func NewUserInteractive(userAccountAPI api.UserLoginAPI, cfg *config.ClientAPI, threePIDSessions *threepid.ValidationSessions) *UserInteractive {
 	typePassword := &LoginTypePassword{
 		GetAccountByPassword: userAccountAPI.QueryAccountByPassword,
 		Config:               cfg,
 	}
-	return &UserInteractive{
+	u := &UserInteractive{
 		Flows: []userInteractiveFlow{
 			{
 				Stages: []string{typePassword.Name()},
@@ -125,8 +151,25 @@ func NewUserInteractive(userAccountAPI api.UserLoginAPI, cfg *config.ClientAPI)
 		Types: map[string]Type{
 			typePassword.Name(): typePassword,
 		},
-		Sessions: make(map[string][]string),
+		Sessions:       make(map[string][]string),
+		fallbackLogins: make(map[string]fallbackLogin),
+		sessionUsers:   make(map[string]string),
 	}
+	if threePIDSessions != nil {
+		typeEmailIdentity := &LoginTypeEmailIdentity{
+			Sessions:                threePIDSessions,
+			GetLocalpartForThreePID: userAccountAPI.QueryLocalpartForThreePID,
+			Config:                  cfg,
+		}
+		u.Flows = append(u.Flows, userInteractiveFlow{Stages: []string{typeEmailIdentity.Name()}})
+		u.Types[typeEmailIdentity.Name()] = typeEmailIdentity
+	}
+	if cfg.SSO.Enabled {
+		typeSSO := &LoginTypeSSO{}
+		u.Flows = append(u.Flows, userInteractiveFlow{Stages: []string{typeSSO.Name()}})
+		u.Types[typeSSO.Name()] = typeSSO
+	}
+	return u
 }
 
 func (u *UserInteractive) IsSingleStageFlow(authType string) bool {
@@ -144,9 +187,39 @@ func (u *UserInteractive) AddCompletedStage(sessionID, authType string) {
 	u.Lock()
 	// TODO: Handle multi-stage flows
 	delete(u.Sessions, sessionID)
+	delete(u.fallbackLogins, sessionID)
+	delete(u.sessionUsers, sessionID)
 	u.Unlock()
 }
 
+// CompleteFallbackStage records that a stage was completed through the fallback web
+// page, so that the client can submit the session ID without the stage's parameters.
+// Returns ErrUnknownSession if the session doesn't exist, and ErrSessionUserMismatch
+// if the login is for a different user than the one who started the session.
+func (u *UserInteractive) CompleteFallbackStage(sessionID, authType string, login *Login) error {
+	u.Lock()
+	defer u.Unlock()
+	if _, ok := u.Sessions[sessionID]; !ok {
+		return ErrUnknownSession
+	}
+	if userID := u.sessionUsers[sessionID]; userID != "" && !loginIsForUser(login, userID) {
+		return ErrSessionUserMismatch
+	}
+	u.fallbackLogins[sessionID] = fallbackLogin{authType: authType, login: login}
+	return nil
+}
+
+// loginIsForUser returns true if the login is for the given user. Logins may
+// identify the user by their localpart only.
+func loginIsForUser(login *Login, userID string) bool {
+	username := login.Username()
+	if username == userID {
+		return true
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	return err == nil && username == localpart
+}
+
 type Challenge struct {
 	Completed []string              `json:"completed"`
 	Flows     []userInteractiveFlow `json:"flows"`
@@ -173,8 +246,9 @@ func (u *UserInteractive) challenge(sessionID string) *util.JSONResponse {
 	}
 }
 
-// NewSession returns a challenge with a new session ID and remembers the session ID
-func (u *UserInteractive) NewSession() *util.JSONResponse {
+// NewSession returns a challenge with a new session ID and remembers the session ID,
+// along with the user who started it if the device is not nil.
+func (u *UserInteractive) NewSession(device *api.Device) *util.JSONResponse {
 	sessionID, err := GenerateAccessToken()
 	if err != nil {
 		logrus.WithError(err).Error("failed to generate session ID")
@@ -185,6 +259,9 @@ func (u *UserInteractive) NewSession() *util.JSONResponse {
 	}
 	u.Lock()
 	u.Sessions[sessionID] = []string{}
+	if device != nil && device.UserID != "" {
+		u.sessionUsers[sessionID] = device.UserID
+	}
 	u.Unlock()
 	return u.challenge(sessionID)
 }
@@ -227,12 +304,38 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 	// https://matrix.org/docs/spec/client_server/r0.6.1#user-interactive-api-in-the-rest-api
 	hasResponse := gjson.GetBytes(bodyBytes, "auth").Exists()
 	if !hasResponse {
-		return nil, u.NewSession()
+		return nil, u.NewSession(device)
 	}
 
 	// extract the type so we know which login type to use
 	authType := gjson.GetBytes(bodyBytes, "auth.type").Str
 
+	// retrieve the session
+	sessionID := gjson.GetBytes(bodyBytes, "auth.session").Str
+
+	// sessions started by a user can only be completed by the same user
+	u.RLock()
+	sessionUser := u.sessionUsers[sessionID]
+	u.RUnlock()
+	if sessionUser != "" && (device == nil || device.UserID != sessionUser) {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("The auth.session was started by a different user."),
+		}
+	}
+
+	// stages completed through the fallback web page may be submitted with just the session ID
+	u.RLock()
+	fallback, ok := u.fallbackLogins[sessionID]
+	u.RUnlock()
+	if ok && (authType == "" || authType == fallback.authType) {
+		if errRes := u.checkLoginForDevice(fallback.login, device); errRes != nil {
+			return nil, errRes
+		}
+		u.AddCompletedStage(sessionID, fallback.authType)
+		return fallback.login, nil
+	}
+
 	u.RLock()
 	loginType, ok := u.Types[authType]
 	u.RUnlock()
@@ -244,9 +347,6 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 		}
 	}
 
-	// retrieve the session
-	sessionID := gjson.GetBytes(bodyBytes, "auth.session").Str
-
 	u.RLock()
 	_, ok = u.Sessions[sessionID]
 	u.RUnlock()
@@ -265,9 +365,25 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 	if resErr != nil {
 		return nil, u.ResponseWithChallenge(sessionID, resErr.JSON)
 	}
+	if errRes := u.checkLoginForDevice(login, device); errRes != nil {
+		cleanup(ctx, errRes)
+		return nil, errRes
+	}
 
 	u.AddCompletedStage(sessionID, authType)
 	cleanup(ctx, nil)
 	// TODO: Check if there's more stages to go and return an error
 	return login, nil
 }
+
+// checkLoginForDevice returns an error response if the user authenticated as someone
+// else than the user of the device, e.g. by validating another user's email address.
+func (u *UserInteractive) checkLoginForDevice(login *Login, device *api.Device) *util.JSONResponse {
+	if device == nil || device.UserID == "" || loginIsForUser(login, device.UserID) {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: spec.Forbidden("The authenticated user doesn't match the user of the access token."),
+	}
+}
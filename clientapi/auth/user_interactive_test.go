@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
@@ -23,6 +24,9 @@ var (
 		DisplayName: "My Device",
 		ID:          "device_id_goes_here",
 	}
+	// email address -> localpart
+	threePIDLookup     = make(map[string]string)
+	validationSessions = threepid.NewValidationSessions()
 )
 
 type fakeAccountDatabase struct{}
@@ -45,6 +49,14 @@ func (d *fakeAccountDatabase) QueryAccountByPassword(ctx context.Context, req *a
 	return nil
 }
 
+func (d *fakeAccountDatabase) QueryLocalpartForThreePID(ctx context.Context, req *api.QueryLocalpartForThreePIDRequest, res *api.QueryLocalpartForThreePIDResponse) error {
+	if localpart, ok := threePIDLookup[req.ThreePID]; ok {
+		res.Localpart = localpart
+		res.ServerName = serverName
+	}
+	return nil
+}
+
 func setup() *UserInteractive {
 	cfg := &config.ClientAPI{
 		Matrix: &config.Global{
@@ -53,7 +65,7 @@ func setup() *UserInteractive {
 			},
 		},
 	}
-	return NewUserInteractive(&fakeAccountDatabase{}, cfg)
+	return NewUserInteractive(&fakeAccountDatabase{}, cfg, validationSessions)
 }
 
 func TestUserInteractiveChallenge(t *testing.T) {
@@ -191,6 +203,111 @@ func TestUserInteractivePasswordBadLogin(t *testing.T) {
 	}
 }
 
+func TestUserInteractiveEmailIdentity(t *testing.T) {
+	uia := setup()
+	threePIDLookup["charlie@example.com"] = "charlie"
+
+	authBody := func(sid, secret string) []byte {
+		return []byte(fmt.Sprintf(`{
+			"auth": {
+				"type": "m.login.email.identity",
+				"threepid_creds": {"sid": %q, "client_secret": %q}
+			}
+		}`, sid, secret))
+	}
+
+	// the session must be validated first
+	session, _ := validationSessions.Create("secret", "email", "charlie@example.com", 1)
+	if _, errRes := uia.Verify(ctx, authBody(session.SID, "secret"), device); errRes == nil || errRes.Code != 401 {
+		t.Fatalf("expected HTTP 401 for an unvalidated session, got %+v", errRes)
+	}
+	if validationSessions.Validate(session.SID, "secret", "wrong token") {
+		t.Fatalf("expected validation with the wrong token to fail")
+	}
+	if !validationSessions.Validate(session.SID, "secret", session.Token) {
+		t.Fatalf("expected validation to succeed")
+	}
+	if _, errRes := uia.Verify(ctx, authBody(session.SID, "wrong secret"), device); errRes == nil || errRes.Code != 401 {
+		t.Fatalf("expected HTTP 401 for the wrong client secret, got %+v", errRes)
+	}
+	login, errRes := uia.Verify(ctx, authBody(session.SID, "secret"), device)
+	if errRes != nil {
+		t.Fatalf("Verify failed but expected success: %+v", errRes)
+	}
+	if want := fmt.Sprintf("@charlie:%s", serverName); login.Username() != want {
+		t.Errorf("expected login for %s, got %s", want, login.Username())
+	}
+	// the session can only be used once
+	if _, errRes = uia.Verify(ctx, authBody(session.SID, "secret"), device); errRes == nil {
+		t.Errorf("expected the session to be deleted after use")
+	}
+
+	// the email address must belong to an account
+	session, _ = validationSessions.Create("secret", "email", "nobody@example.com", 1)
+	validationSessions.Validate(session.SID, "secret", session.Token)
+	if _, errRes = uia.Verify(ctx, authBody(session.SID, "secret"), device); errRes == nil || errRes.Code != 401 {
+		t.Errorf("expected HTTP 401 for an unknown email address, got %+v", errRes)
+	}
+}
+
+func TestUserInteractiveSessionUser(t *testing.T) {
+	uia := setup()
+	threePIDLookup["dave@example.com"] = "dave"
+	alice := &api.Device{UserID: fmt.Sprintf("@alice:%s", serverName)}
+	mallory := &api.Device{UserID: fmt.Sprintf("@mallory:%s", serverName)}
+
+	newSession := func(device *api.Device) string {
+		t.Helper()
+		_, challenge := uia.Verify(ctx, []byte(`{}`), device)
+		return challenge.JSON.(Challenge).Session
+	}
+	loginFor := func(userID string) *Login {
+		return &Login{Identifier: LoginIdentifier{Type: "m.id.user", User: userID}}
+	}
+
+	t.Run("fallback stages must be completed by the user who started the session", func(t *testing.T) {
+		sessionID := newSession(mallory)
+		if err := uia.CompleteFallbackStage(sessionID, "m.login.sso", loginFor(alice.UserID)); err != ErrSessionUserMismatch {
+			t.Fatalf("expected ErrSessionUserMismatch, got %v", err)
+		}
+		if err := uia.CompleteFallbackStage("unknown", "m.login.sso", loginFor(mallory.UserID)); err != ErrUnknownSession {
+			t.Fatalf("expected ErrUnknownSession, got %v", err)
+		}
+		if err := uia.CompleteFallbackStage(sessionID, "m.login.sso", loginFor(mallory.UserID)); err != nil {
+			t.Fatalf("expected the stage to be completed, got %v", err)
+		}
+	})
+
+	t.Run("sessions can't be submitted by other users", func(t *testing.T) {
+		sessionID := newSession(alice)
+		if err := uia.CompleteFallbackStage(sessionID, "m.login.sso", loginFor(alice.UserID)); err != nil {
+			t.Fatalf("expected the stage to be completed, got %v", err)
+		}
+		body := []byte(`{"auth":{"session":"` + sessionID + `"}}`)
+		if _, errRes := uia.Verify(ctx, body, mallory); errRes == nil || errRes.Code != 403 {
+			t.Fatalf("expected HTTP 403, got %+v", errRes)
+		}
+		if _, errRes := uia.Verify(ctx, body, alice); errRes != nil {
+			t.Fatalf("expected the session to be completed, got %+v", errRes)
+		}
+	})
+
+	t.Run("email addresses of other users are rejected", func(t *testing.T) {
+		session, _ := validationSessions.Create("secret", "email", "dave@example.com", 1)
+		validationSessions.Validate(session.SID, "secret", session.Token)
+		body := []byte(fmt.Sprintf(`{
+			"auth": {
+				"type": "m.login.email.identity",
+				"session": %q,
+				"threepid_creds": {"sid": %q, "client_secret": "secret"}
+			}
+		}`, newSession(mallory), session.SID))
+		if _, errRes := uia.Verify(ctx, body, mallory); errRes == nil || errRes.Code != 403 {
+			t.Fatalf("expected HTTP 403, got %+v", errRes)
+		}
+	})
+}
+
 func TestUserInteractive_AddCompletedStage(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -20,6 +20,7 @@ import (
 	"github.com/matrix-org/dendrite/setup/process"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/sirupsen/logrus"
 
 	"github.com/matrix-org/dendrite/clientapi/api"
 	"github.com/matrix-org/dendrite/clientapi/producers"
@@ -37,6 +38,7 @@ func AddPublicRoutes(
 	cfg *config.Dendrite,
 	natsInstance *jetstream.NATSInstance,
 	federation fclient.FederationClient,
+	client *fclient.Client,
 	rsAPI roomserverAPI.ClientRoomserverAPI,
 	transactionsCache *transactions.Cache,
 	fsAPI federationAPI.ClientFederationAPI,
@@ -57,11 +59,19 @@ func AddPublicRoutes(
 		ServerName:             cfg.Global.ServerName,
 	}
 
+	rateLimitStore, err := httputil.NewRateLimitStore(
+		cfg.ClientAPI.RateLimiting.Enabled, cfg.ClientAPI.RateLimiting.Backend, js, cfg.Global.JetStream.Prefixed(jetstream.RateLimits),
+	)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to set up rate limiting")
+	}
+	rateLimits := httputil.NewRateLimits(&cfg.ClientAPI.RateLimiting, rateLimitStore, userAPI)
+
 	routing.Setup(
 		routers,
 		cfg, rsAPI,
-		userAPI, userDirectoryProvider, federation,
+		userAPI, userDirectoryProvider, federation, client,
 		syncProducer, transactionsCache, fsAPI,
-		extRoomsProvider, natsClient, enableMetrics,
+		extRoomsProvider, rateLimits, natsClient, enableMetrics,
 	)
 }
@@ -266,6 +266,113 @@ func AdminUpdateRegistrationToken(req *http.Request, cfg *config.ClientAPI, user
 	}
 }
 
+func AdminGetRateLimitOverride(req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	userID := vars["userID"]
+	if _, _, err = cfg.Matrix.SplitLocalID('@', userID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	override, err := userAPI.QueryRateLimitOverride(req.Context(), userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryRateLimitOverride failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if override == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("no rate limit override for %s", userID)),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: override,
+	}
+}
+
+func AdminSetRateLimitOverride(req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, rateLimits *httputil.RateLimits) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	userID := vars["userID"]
+	if _, _, err = cfg.Matrix.SplitLocalID('@', userID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	request := struct {
+		Threshold int64 `json:"threshold"`
+		CooloffMS int64 `json:"cooloff_ms"`
+	}{}
+	if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(fmt.Sprintf("Failed to decode request body: %s", err)),
+		}
+	}
+	// A threshold of zero exempts the user from rate limiting, in which case
+	// the cooloff doesn't matter.
+	if request.Threshold < 0 || (request.Threshold > 0 && request.CooloffMS <= 0) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("threshold must not be negative and cooloff_ms must be positive"),
+		}
+	}
+	override := &userapi.RateLimitOverride{
+		UserID:    userID,
+		Threshold: request.Threshold,
+		CooloffMS: request.CooloffMS,
+	}
+	if err = userAPI.PerformAdminSetRateLimitOverride(req.Context(), override); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformAdminSetRateLimitOverride failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	rateLimits.InvalidateOverride(userID)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: override,
+	}
+}
+
+func AdminDeleteRateLimitOverride(req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, rateLimits *httputil.RateLimits) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	userID := vars["userID"]
+	if _, _, err = cfg.Matrix.SplitLocalID('@', userID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	if err = userAPI.PerformAdminDeleteRateLimitOverride(req.Context(), userID); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformAdminDeleteRateLimitOverride failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	rateLimits.InvalidateOverride(userID)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
 func AdminEvacuateRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
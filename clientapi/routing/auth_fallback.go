@@ -20,6 +20,7 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/sso"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/util"
 )
@@ -100,9 +101,19 @@ func serveTemplate(w http.ResponseWriter, templateHTML string, data map[string]s
 // AuthFallback implements GET and POST /auth/{authType}/fallback/web?session={sessionID}
 func AuthFallback(
 	w http.ResponseWriter, req *http.Request, authType string,
-	cfg *config.ClientAPI,
+	cfg *config.ClientAPI, ssoAuthenticator *sso.Authenticator,
 ) {
-	// We currently only support "m.login.recaptcha", so fail early if that's not requested
+	if authType == authtypes.LoginTypeSSO {
+		sessionID := req.URL.Query().Get("session")
+		if sessionID == "" {
+			writeHTTPMessage(w, req, "Session ID not provided", http.StatusBadRequest)
+			return
+		}
+		ssoFallback(w, req, sessionID, cfg, ssoAuthenticator)
+		return
+	}
+
+	// Otherwise we only support "m.login.recaptcha", so fail early if that's not requested
 	if authType == authtypes.LoginTypeRecaptcha {
 		if !cfg.RecaptchaEnabled {
 			writeHTTPMessage(w, req,
@@ -33,7 +33,7 @@ func Deactivate(
 		return *errRes
 	}
 
-	localpart, serverName, err := gomatrixserverlib.SplitID('@', login.Username())
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', deviceAPI.UserID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return util.JSONResponse{
@@ -42,6 +42,15 @@ func Deactivate(
 		}
 	}
 
+	// make sure that the access token being used matches the login creds used for user interactive auth, else
+	// a user could be tricked into authenticating on someone else's session to deactivate their own account.
+	if login.Username() != localpart && login.Username() != deviceAPI.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("Cannot deactivate another user's account"),
+		}
+	}
+
 	var res api.PerformAccountDeactivationResponse
 	err = accountAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
 		Localpart:  localpart,
@@ -27,8 +27,9 @@ import (
 )
 
 type uploadKeysRequest struct {
-	DeviceKeys  json.RawMessage            `json:"device_keys"`
-	OneTimeKeys map[string]json.RawMessage `json:"one_time_keys"`
+	DeviceKeys   json.RawMessage            `json:"device_keys"`
+	OneTimeKeys  map[string]json.RawMessage `json:"one_time_keys"`
+	FallbackKeys map[string]json.RawMessage `json:"fallback_keys"`
 }
 
 func UploadKeys(req *http.Request, keyAPI api.ClientKeyAPI, device *api.Device) util.JSONResponse {
@@ -60,6 +61,15 @@ func UploadKeys(req *http.Request, keyAPI api.ClientKeyAPI, device *api.Device)
 			},
 		}
 	}
+	if r.FallbackKeys != nil {
+		uploadReq.FallbackKeys = []api.OneTimeKeys{
+			{
+				DeviceID: device.ID,
+				UserID:   device.UserID,
+				KeyJSON:  r.FallbackKeys,
+			},
+		}
+	}
 
 	var uploadRes api.PerformUploadKeysResponse
 	if err := keyAPI.PerformUploadKeys(req.Context(), uploadReq, &uploadRes); err != nil {
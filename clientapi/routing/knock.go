@@ -0,0 +1,110 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+type knockRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// KnockRoomByIDOrAlias implements POST /knock/{roomIdOrAlias}
+func KnockRoomByIDOrAlias(
+	req *http.Request,
+	device *api.Device,
+	rsAPI roomserverAPI.ClientRoomserverAPI,
+	roomIDOrAlias string,
+) util.JSONResponse {
+	userID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Device UserID is invalid"),
+		}
+	}
+
+	var body knockRequest
+	if req.ContentLength != 0 {
+		if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+			return *resErr
+		}
+	}
+
+	knockReq := roomserverAPI.PerformKnockRequest{
+		RoomIDOrAlias: roomIDOrAlias,
+		UserID:        *userID,
+		Reason:        body.Reason,
+	}
+
+	// Check to see if any ?server_name= or ?via= query parameters were
+	// given in the request.
+	query := req.URL.Query()
+	for _, param := range []string{"server_name", "via"} {
+		for _, serverName := range query[param] {
+			knockReq.ServerNames = append(knockReq.ServerNames, spec.ServerName(serverName))
+		}
+	}
+
+	roomID, err := rsAPI.PerformKnock(req.Context(), &knockReq)
+	var httpErr *gomatrix.HTTPError
+	switch e := err.(type) {
+	case nil:
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				RoomID string `json:"room_id"`
+			}{roomID},
+		}
+	case roomserverAPI.ErrInvalidID:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown(e.Error()),
+		}
+	case roomserverAPI.ErrNotAllowed:
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden(e.Error()),
+		}
+	case roomserverAPI.ErrRoomUnknownOrNotAllowed, eventutil.ErrRoomNoExists:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(e.Error()),
+		}
+	default:
+		// this ensures we proxy responses over federation to the client
+		if errors.As(err, &httpErr) {
+			return util.JSONResponse{
+				Code: httpErr.Code,
+				JSON: json.RawMessage(httpErr.Message),
+			}
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformKnock failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+}
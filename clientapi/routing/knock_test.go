@@ -0,0 +1,160 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestKnockRoomByIDOrAlias(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil) // creates the rs.Inputer etc
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+
+		for _, u := range []*test.User{alice, bob} {
+			localpart, serverName, _ := gomatrixserverlib.SplitID('@', u.ID)
+			userRes := &uapi.PerformAccountCreationResponse{}
+			if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+				AccountType: u.AccountType,
+				Localpart:   localpart,
+				ServerName:  serverName,
+				Password:    "someRandomPassword",
+			}, userRes); err != nil {
+				t.Errorf("failed to create account: %s", err)
+			}
+		}
+
+		aliceDev := &uapi.Device{UserID: alice.ID}
+		bobDev := &uapi.Device{UserID: bob.ID}
+
+		// A room which can be knocked on, and one which can't.
+		resp := createRoom(ctx, createRoomRequest{
+			Name:          "knock",
+			Preset:        spec.PresetPrivateChat,
+			RoomAliasName: "knock",
+			RoomVersion:   gomatrixserverlib.RoomVersionV10,
+			InitialState: []gomatrixserverlib.FledglingEvent{
+				{
+					Type:    spec.MRoomJoinRules,
+					Content: map[string]interface{}{"join_rule": spec.Knock},
+				},
+			},
+		}, aliceDev, &cfg.ClientAPI, userAPI, rsAPI, time.Now())
+		knockRoom, ok := resp.JSON.(createRoomResponse)
+		if !ok {
+			t.Fatalf("response is not a createRoomResponse: %+v", resp)
+		}
+		resp = createRoom(ctx, createRoomRequest{
+			Name:        "invite",
+			Preset:      spec.PresetPrivateChat,
+			RoomVersion: gomatrixserverlib.RoomVersionV10,
+		}, aliceDev, &cfg.ClientAPI, userAPI, rsAPI, time.Now())
+		inviteRoom, ok := resp.JSON.(createRoomResponse)
+		if !ok {
+			t.Fatalf("response is not a createRoomResponse: %+v", resp)
+		}
+
+		membership := func(t *testing.T, roomID string) string {
+			t.Helper()
+			userID, err := spec.NewUserID(bob.ID, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := &roomserverAPI.QueryMembershipForUserResponse{}
+			if err = rsAPI.QueryMembershipForUser(ctx, &roomserverAPI.QueryMembershipForUserRequest{
+				RoomID: roomID,
+				UserID: *userID,
+			}, res); err != nil {
+				t.Fatal(err)
+			}
+			return res.Membership
+		}
+
+		testCases := []struct {
+			name     string
+			roomID   string
+			wantCode int
+		}{
+			{
+				name:     "invalid room ID",
+				roomID:   "invalidRoomID",
+				wantCode: http.StatusBadRequest,
+			},
+			{
+				name:     "room does not exist",
+				roomID:   "!doesnotexist:test",
+				wantCode: http.StatusNotFound,
+			},
+			{
+				name:     "room alias does not exist",
+				roomID:   "#doesnotexist:test",
+				wantCode: http.StatusNotFound,
+			},
+			{
+				name:     "join rules don't allow knocking",
+				roomID:   inviteRoom.RoomID,
+				wantCode: http.StatusForbidden,
+			},
+			{
+				name:     "knock by alias",
+				roomID:   knockRoom.RoomAlias,
+				wantCode: http.StatusOK,
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				req := test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/knock/"+tc.roomID, test.WithJSONBody(t, map[string]interface{}{
+					"reason": "let me in",
+				}))
+				res := KnockRoomByIDOrAlias(req, bobDev, rsAPI, tc.roomID)
+				if res.Code != tc.wantCode {
+					t.Fatalf("expected HTTP %d, got %d: %+v", tc.wantCode, res.Code, res.JSON)
+				}
+			})
+		}
+
+		if got := membership(t, knockRoom.RoomID); got != spec.Knock {
+			t.Fatalf("expected bob to be knocking, got %q", got)
+		}
+		if got := membership(t, inviteRoom.RoomID); got == spec.Knock {
+			t.Fatalf("expected bob not to be knocking on the invite only room")
+		}
+
+		// Rescinding the knock leaves the room again.
+		bobUserID, _ := spec.NewUserID(bob.ID, true)
+		if err := rsAPI.PerformLeave(ctx, &roomserverAPI.PerformLeaveRequest{
+			RoomID: knockRoom.RoomID,
+			Leaver: *bobUserID,
+		}, &roomserverAPI.PerformLeaveResponse{}); err != nil {
+			t.Fatalf("failed to rescind knock: %s", err)
+		}
+		if got := membership(t, knockRoom.RoomID); got != spec.Leave {
+			t.Fatalf("expected bob to have left, got %q", got)
+		}
+	})
+}
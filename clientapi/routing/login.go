@@ -28,9 +28,11 @@ import (
 )
 
 type loginResponse struct {
-	UserID      string `json:"user_id"`
-	AccessToken string `json:"access_token"`
-	DeviceID    string `json:"device_id"`
+	UserID       string `json:"user_id"`
+	AccessToken  string `json:"access_token"`
+	DeviceID     string `json:"device_id"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 type flows struct {
@@ -38,7 +40,8 @@ type flows struct {
 }
 
 type flow struct {
-	Type string `json:"type"`
+	Type              string             `json:"type"`
+	IdentityProviders []identityProvider `json:"identity_providers,omitempty"`
 }
 
 // Login implements GET and POST /login
@@ -51,6 +54,13 @@ func Login(
 		if len(cfg.Derived.ApplicationServices) > 0 {
 			loginFlows = append(loginFlows, flow{Type: authtypes.LoginTypeApplicationService})
 		}
+		if cfg.SSO.Enabled {
+			// Single sign-on ends with the client logging in with a login token.
+			loginFlows = append(loginFlows,
+				flow{Type: authtypes.LoginTypeSSO, IdentityProviders: ssoIdentityProviders(cfg)},
+				flow{Type: authtypes.LoginTypeToken},
+			)
+		}
 		// TODO: support other forms of login, depending on config options
 		return util.JSONResponse{
 			Code: http.StatusOK,
@@ -87,6 +97,17 @@ func completeAuth(
 		}
 	}
 
+	var refreshToken string
+	if login.RefreshToken {
+		if refreshToken, err = auth.GenerateAccessToken(); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("auth.GenerateAccessToken failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
+
 	localpart, serverName, err := userutil.ParseUsernameParam(login.Username(), cfg)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("auth.ParseUsernameParam failed")
@@ -101,6 +122,7 @@ func completeAuth(
 		DeviceDisplayName: login.InitialDisplayName,
 		DeviceID:          login.DeviceID,
 		AccessToken:       token,
+		RefreshToken:      refreshToken,
 		Localpart:         localpart,
 		ServerName:        serverName,
 		IPAddr:            ipAddr,
@@ -116,9 +138,11 @@ func completeAuth(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: loginResponse{
-			UserID:      performRes.Device.UserID,
-			AccessToken: performRes.Device.AccessToken,
-			DeviceID:    performRes.Device.ID,
+			UserID:       performRes.Device.UserID,
+			AccessToken:  performRes.Device.AccessToken,
+			DeviceID:     performRes.Device.ID,
+			RefreshToken: refreshToken,
+			ExpiresInMS:  expiresInMS(performRes.Device),
 		},
 	}
 }
@@ -52,7 +52,8 @@ func TestLogin(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
 
 		// We mostly need the userAPI for this test, so nil for other APIs/caches etc.
-		Setup(routers, cfg, nil, userAPI, nil, nil, nil, nil, nil, nil, nil, caching.DisableMetrics)
+		rateLimits := httputil.NewRateLimits(&cfg.ClientAPI.RateLimiting, httputil.NewMemoryRateLimitStore(), userAPI)
+		Setup(routers, cfg, nil, userAPI, nil, nil, nil, nil, nil, nil, nil, rateLimits, nil, caching.DisableMetrics)
 
 		// Create password
 		password := util.RandomString(8)
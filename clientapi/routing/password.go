@@ -6,6 +6,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
@@ -25,22 +26,29 @@ type newPasswordAuth struct {
 	Type    string `json:"type"`
 	Session string `json:"session"`
 	auth.PasswordRequest
+	auth.EmailIdentityRequest
 }
 
+// Password implements POST /account/password
+// The device is nil if the request wasn't authenticated, in which case the user
+// must prove that they own an email address associated with the account instead.
 func Password(
 	req *http.Request,
 	userAPI api.ClientUserAPI,
 	device *api.Device,
 	cfg *config.ClientAPI,
+	validationSessions *threepid.ValidationSessions,
 ) util.JSONResponse {
 	// Check that the existing password is right.
 	var r newPasswordRequest
 	r.LogoutDevices = true
 
-	logrus.WithFields(logrus.Fields{
-		"sessionId": device.SessionID,
-		"userId":    device.UserID,
-	}).Debug("Changing password")
+	if device != nil {
+		logrus.WithFields(logrus.Fields{
+			"sessionId": device.SessionID,
+			"userId":    device.UserID,
+		}).Debug("Changing password")
+	}
 
 	// Unmarshal the request.
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
@@ -55,31 +63,59 @@ func Password(
 		sessionID = util.RandomString(sessionIDLength)
 	}
 
-	// Require password auth to change the password.
-	if r.Auth.Type != authtypes.LoginTypePassword {
+	// Require password auth to change the password, or email auth to reset it.
+	flows := []authtypes.Flow{
+		{
+			Stages: []authtypes.LoginType{authtypes.LoginTypeEmailIdentity},
+		},
+	}
+	if device != nil {
+		flows = append([]authtypes.Flow{
+			{
+				Stages: []authtypes.LoginType{authtypes.LoginTypePassword},
+			},
+		}, flows...)
+	}
+
+	var userID string
+	var cleanup auth.LoginCleanupFunc
+	switch {
+	case r.Auth.Type == authtypes.LoginTypePassword && device != nil:
+		// Check if the existing password is correct.
+		typePassword := auth.LoginTypePassword{
+			GetAccountByPassword: userAPI.QueryAccountByPassword,
+			Config:               cfg,
+		}
+		if _, authErr := typePassword.Login(req.Context(), &r.Auth.PasswordRequest); authErr != nil {
+			return *authErr
+		}
+		userID = device.UserID
+	case r.Auth.Type == authtypes.LoginTypeEmailIdentity:
+		// Check that the email address was validated, which tells us whose password to reset.
+		typeEmailIdentity := auth.LoginTypeEmailIdentity{
+			Sessions:                validationSessions,
+			GetLocalpartForThreePID: userAPI.QueryLocalpartForThreePID,
+			Config:                  cfg,
+		}
+		login, loginCleanup, authErr := typeEmailIdentity.Login(req.Context(), &r.Auth.EmailIdentityRequest)
+		if authErr != nil {
+			return *authErr
+		}
+		userID = login.Username()
+		if device != nil && userID != device.UserID {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden("The email address belongs to a different user"),
+			}
+		}
+		cleanup = loginCleanup
+	default:
 		return util.JSONResponse{
 			Code: http.StatusUnauthorized,
-			JSON: newUserInteractiveResponse(
-				sessionID,
-				[]authtypes.Flow{
-					{
-						Stages: []authtypes.LoginType{authtypes.LoginTypePassword},
-					},
-				},
-				nil,
-			),
+			JSON: newUserInteractiveResponse(sessionID, flows, nil),
 		}
 	}
-
-	// Check if the existing password is correct.
-	typePassword := auth.LoginTypePassword{
-		GetAccountByPassword: userAPI.QueryAccountByPassword,
-		Config:               cfg,
-	}
-	if _, authErr := typePassword.Login(req.Context(), &r.Auth.PasswordRequest); authErr != nil {
-		return *authErr
-	}
-	sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypePassword)
+	sessions.addCompletedSessionStage(sessionID, authtypes.LoginType(r.Auth.Type))
 
 	// Check the new password strength.
 	if err := internal.ValidatePassword(r.NewPassword); err != nil {
@@ -87,7 +123,7 @@ func Password(
 	}
 
 	// Get the local part.
-	localpart, domain, err := gomatrixserverlib.SplitID('@', device.UserID)
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return util.JSONResponse{
@@ -118,13 +154,25 @@ func Password(
 		}
 	}
 
+	// The validation session can't be used to reset the password again.
+	if cleanup != nil {
+		cleanup(req.Context(), nil)
+	}
+
 	// If the request asks us to log out all other devices then
-	// ask the user API to do that.
+	// ask the user API to do that. If the password was reset without
+	// an access token, all devices are logged out.
 	if r.LogoutDevices {
+		var exceptDeviceID string
+		var exceptSessionID int64
+		if device != nil {
+			exceptDeviceID = device.ID
+			exceptSessionID = device.SessionID
+		}
 		logoutReq := &api.PerformDeviceDeletionRequest{
-			UserID:         device.UserID,
+			UserID:         userID,
 			DeviceIDs:      nil,
-			ExceptDeviceID: device.ID,
+			ExceptDeviceID: exceptDeviceID,
 		}
 		logoutRes := &api.PerformDeviceDeletionResponse{}
 		if err := userAPI.PerformDeviceDeletion(req.Context(), logoutReq, logoutRes); err != nil {
@@ -138,7 +186,7 @@ func Password(
 		pushersReq := &api.PerformPusherDeletionRequest{
 			Localpart:  localpart,
 			ServerName: domain,
-			SessionID:  device.SessionID,
+			SessionID:  exceptSessionID,
 		}
 		if err := userAPI.PerformPusherDeletion(req.Context(), pushersReq, &struct{}{}); err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("PerformPusherDeletion failed")
@@ -0,0 +1,167 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// passwordResetSubmitTokenPath is the path of the link we send to validate an email
+// address before resetting a password.
+const passwordResetSubmitTokenPath = "/_matrix/client/v3/account/password/email/submitToken"
+
+// clientSecretRegex is the format of client secrets, as defined by the spec.
+var clientSecretRegex = regexp.MustCompile(`^[0-9a-zA-Z.=_\-]{1,255}$`)
+
+// passwordResetTemplate is an HTML template presented to the user after following
+// the link in a password reset email
+const passwordResetTemplate = `
+<html>
+<head>
+<title>Reset password</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+    <div>
+        <p>{{.message}}</p>
+    </div>
+</body>
+</html>
+`
+
+// RequestPasswordEmailToken implements POST /account/password/email/requestToken
+// The email address must be associated with an account on this server. We send an
+// email with a link to validate the address, after which the validation session
+// can be used with the m.login.email.identity stage of POST /account/password.
+func RequestPasswordEmailToken(
+	req *http.Request, userAPI api.ClientUserAPI, cfg *config.ClientAPI,
+	validationSessions *threepid.ValidationSessions,
+) util.JSONResponse {
+	var body threepid.EmailAssociationRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if body.Email == "" || body.Secret == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("'email' and 'client_secret' must be supplied"),
+		}
+	}
+	if !clientSecretRegex.MatchString(body.Secret) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("'client_secret' contains invalid characters"),
+		}
+	}
+
+	var res api.QueryLocalpartForThreePIDResponse
+	err := userAPI.QueryLocalpartForThreePID(req.Context(), &api.QueryLocalpartForThreePIDRequest{
+		ThreePID: body.Email,
+		Medium:   "email",
+	}, &res)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryLocalpartForThreePID failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if res.Localpart == "" || !cfg.Matrix.IsLocalServerName(res.ServerName) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MatrixError{
+				ErrCode: "M_THREEPID_NOT_FOUND",
+				Err:     "This email address isn't associated with an account on this server",
+			},
+		}
+	}
+
+	session, resend := validationSessions.Create(body.Secret, "email", body.Email, body.SendAttempt)
+	if !resend {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: reqTokenResponse{SID: session.SID},
+		}
+	}
+
+	err = userAPI.PerformSendEmail(req.Context(), &api.PerformSendEmailRequest{
+		To:       body.Email,
+		Template: api.EmailTemplatePasswordReset,
+		Data: map[string]string{
+			"Link": validationLink(cfg, passwordResetSubmitTokenPath, session),
+		},
+	})
+	if err != nil {
+		validationSessions.Delete(session.SID)
+		if errors.Is(err, api.ErrEmailDisabled) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.MatrixError{
+					ErrCode: "M_THREEPID_MEDIUM_NOT_SUPPORTED",
+					Err:     "Resetting the password by email isn't supported on this server",
+				},
+			}
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformSendEmail failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: reqTokenResponse{SID: session.SID},
+	}
+}
+
+// SubmitPasswordEmailToken implements GET /account/password/email/submitToken
+// This is the link sent by RequestPasswordEmailToken, which is followed in a browser.
+func SubmitPasswordEmailToken(
+	w http.ResponseWriter, req *http.Request,
+	validationSessions *threepid.ValidationSessions,
+) {
+	query := req.URL.Query()
+	if !validationSessions.Validate(query.Get("sid"), query.Get("client_secret"), query.Get("token")) {
+		w.WriteHeader(http.StatusBadRequest)
+		serveTemplate(w, passwordResetTemplate, map[string]string{
+			"message": "This link is invalid or has expired. Please request a new one.",
+		})
+		return
+	}
+	serveTemplate(w, passwordResetTemplate, map[string]string{
+		"message": "Your email address has been validated. Please return to your client to choose a new password.",
+	})
+}
+
+// validationLink returns the link to validate the session with at the given path.
+func validationLink(cfg *config.ClientAPI, path string, session threepid.ValidationSession) string {
+	query := url.Values{}
+	query.Set("sid", session.SID)
+	query.Set("client_secret", session.ClientSecret)
+	query.Set("token", session.Token)
+	return cfg.Matrix.ClientAPIBaseURL() + path + "?" + query.Encode()
+}
@@ -0,0 +1,188 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// emailCapturingUserAPI records the emails which would have been sent.
+type emailCapturingUserAPI struct {
+	uapi.ClientUserAPI
+	emails []*uapi.PerformSendEmailRequest
+}
+
+func (a *emailCapturingUserAPI) PerformSendEmail(ctx context.Context, req *uapi.PerformSendEmailRequest) error {
+	a.emails = append(a.emails, req)
+	return nil
+}
+
+func TestPasswordReset(t *testing.T) {
+	alice := test.NewUser(t)
+	const email = "alice@example.com"
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		natsInstance := jetstream.NATSInstance{}
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		internalAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		userAPI := &emailCapturingUserAPI{ClientUserAPI: internalAPI}
+		validationSessions := threepid.NewValidationSessions()
+
+		localpart, serverName, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+			AccountType: uapi.AccountTypeUser,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			Password:    "forgotten password",
+		}, &uapi.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+		if err := userAPI.PerformSaveThreePIDAssociation(ctx, &uapi.PerformSaveThreePIDAssociationRequest{
+			ThreePID:   email,
+			Localpart:  localpart,
+			ServerName: serverName,
+			Medium:     "email",
+		}, &struct{}{}); err != nil {
+			t.Fatalf("failed to save 3pid: %s", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := userAPI.PerformDeviceCreation(ctx, &uapi.PerformDeviceCreationRequest{
+				Localpart:   localpart,
+				ServerName:  serverName,
+				AccessToken: util.RandomString(8),
+			}, &uapi.PerformDeviceCreationResponse{}); err != nil {
+				t.Fatalf("failed to create device: %s", err)
+			}
+		}
+
+		requestToken := func(email string, sendAttempt int) (int, interface{}) {
+			res := RequestPasswordEmailToken(test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/account/password/email/requestToken", test.WithJSONBody(t, map[string]interface{}{
+				"client_secret": "secret",
+				"email":         email,
+				"send_attempt":  sendAttempt,
+			})), userAPI, &cfg.ClientAPI, validationSessions)
+			return res.Code, res.JSON
+		}
+		resetPassword := func(sid string) int {
+			res := Password(test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/account/password", test.WithJSONBody(t, map[string]interface{}{
+				"new_password": "a new password",
+				"auth": map[string]interface{}{
+					"type":           authtypes.LoginTypeEmailIdentity,
+					"threepid_creds": map[string]interface{}{"sid": sid, "client_secret": "secret"},
+				},
+			})), userAPI, nil, &cfg.ClientAPI, validationSessions)
+			return res.Code
+		}
+
+		if code, res := requestToken("unknown@example.com", 1); code != http.StatusBadRequest {
+			t.Fatalf("expected HTTP 400 for an unknown email address, got %d: %+v", code, res)
+		} else if merr, ok := res.(spec.MatrixError); !ok || merr.ErrCode != "M_THREEPID_NOT_FOUND" {
+			t.Fatalf("expected M_THREEPID_NOT_FOUND, got %+v", res)
+		}
+
+		code, res := requestToken(email, 1)
+		if code != http.StatusOK {
+			t.Fatalf("failed to request token: %+v", res)
+		}
+		sid := res.(reqTokenResponse).SID
+		if len(userAPI.emails) != 1 || userAPI.emails[0].To != email || userAPI.emails[0].Template != uapi.EmailTemplatePasswordReset {
+			t.Fatalf("expected a password reset email to be sent, got %+v", userAPI.emails)
+		}
+		// Retrying with the same send attempt doesn't send another email
+		if code, res = requestToken(email, 1); code != http.StatusOK || res.(reqTokenResponse).SID != sid {
+			t.Fatalf("expected the same session to be returned, got %d: %+v", code, res)
+		}
+		if len(userAPI.emails) != 1 {
+			t.Fatalf("expected no more emails to be sent, got %d", len(userAPI.emails))
+		}
+
+		t.Run("unauthenticated requests are offered the email flow", func(t *testing.T) {
+			res := Password(test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/account/password", test.WithJSONBody(t, map[string]interface{}{
+				"new_password": "a new password",
+			})), userAPI, nil, &cfg.ClientAPI, validationSessions)
+			if res.Code != http.StatusUnauthorized {
+				t.Fatalf("expected HTTP 401, got %d: %+v", res.Code, res.JSON)
+			}
+			flows := res.JSON.(userInteractiveResponse).Flows
+			if len(flows) != 1 || len(flows[0].Stages) != 1 || flows[0].Stages[0] != authtypes.LoginTypeEmailIdentity {
+				t.Fatalf("expected only the email identity flow, got %+v", flows)
+			}
+		})
+
+		if code := resetPassword(sid); code != http.StatusUnauthorized {
+			t.Fatalf("expected HTTP 401 before the email address is validated, got %d", code)
+		}
+
+		link, err := url.Parse(userAPI.emails[0].Data["Link"])
+		if err != nil {
+			t.Fatalf("failed to parse link: %s", err)
+		}
+		if link.Path != passwordResetSubmitTokenPath {
+			t.Fatalf("unexpected link: %s", link)
+		}
+		invalid := *link
+		invalid.RawQuery = strings.Replace(link.RawQuery, "token=", "token=x", 1)
+		for _, tc := range []struct {
+			link     *url.URL
+			wantCode int
+		}{
+			{link: &invalid, wantCode: http.StatusBadRequest},
+			{link: link, wantCode: http.StatusOK},
+		} {
+			rec := httptest.NewRecorder()
+			SubmitPasswordEmailToken(rec, test.NewRequest(t, http.MethodGet, tc.link.RequestURI()), validationSessions)
+			if rec.Code != tc.wantCode {
+				t.Fatalf("expected HTTP %d for %s, got %d: %s", tc.wantCode, tc.link, rec.Code, rec.Body.String())
+			}
+		}
+
+		if code := resetPassword(sid); code != http.StatusOK {
+			t.Fatalf("failed to reset password: HTTP %d", code)
+		}
+		var accRes uapi.QueryAccountByPasswordResponse
+		if err = userAPI.QueryAccountByPassword(ctx, &uapi.QueryAccountByPasswordRequest{
+			Localpart:         localpart,
+			ServerName:        serverName,
+			PlaintextPassword: "a new password",
+		}, &accRes); err != nil || !accRes.Exists {
+			t.Fatalf("expected the password to be changed (err: %v)", err)
+		}
+		var devRes uapi.QueryDevicesResponse
+		if err = userAPI.QueryDevices(ctx, &uapi.QueryDevicesRequest{UserID: alice.ID}, &devRes); err != nil {
+			t.Fatalf("failed to query devices: %s", err)
+		}
+		if len(devRes.Devices) != 0 {
+			t.Fatalf("expected all devices to be logged out, got %d", len(devRes.Devices))
+		}
+
+		// The session can only be used once
+		if code := resetPassword(sid); code != http.StatusUnauthorized {
+			t.Fatalf("expected HTTP 401 when reusing the session, got %d", code)
+		}
+	})
+}
@@ -17,6 +17,7 @@ package routing
 import (
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -102,6 +103,29 @@ func SetPusher(
 		}
 
 	}
+	if body.Kind == userapi.EmailKind {
+		// Email pushers may only send to addresses which were validated for the account.
+		var threePIDs userapi.QueryThreePIDsForLocalpartResponse
+		if err = userAPI.QueryThreePIDsForLocalpart(req.Context(), &userapi.QueryThreePIDsForLocalpartRequest{
+			Localpart:  localpart,
+			ServerName: domain,
+		}, &threePIDs); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("QueryThreePIDsForLocalpart failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		associated := false
+		for _, threePID := range threePIDs.ThreePIDs {
+			if threePID.Medium == "email" && strings.EqualFold(threePID.Address, body.PushKey) {
+				associated = true
+			}
+		}
+		if !associated {
+			return invalidParam("pushkey must be an email address associated with the account")
+		}
+	}
 	body.Localpart = localpart
 	body.ServerName = domain
 	body.SessionID = device.SessionID
@@ -120,6 +144,72 @@ func SetPusher(
 	}
 }
 
+// emailUnsubscribeTemplate is an HTML template presented to the user after following
+// the unsubscribe link in a notification digest
+const emailUnsubscribeTemplate = `
+<html>
+<head>
+<title>Unsubscribe</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+    <div>
+        <p>{{.message}}</p>
+        {{if .token}}
+        <form method="post">
+            <input type="hidden" name="token" value="{{.token}}">
+            <input type="submit" value="Unsubscribe">
+        </form>
+        {{end}}
+    </div>
+</body>
+</html>
+`
+
+// EmailUnsubscribe removes the email pusher an unsubscribe link in a notification
+// digest was sent to. The link is confirmed with a form first, as some email clients
+// follow links in emails on their own.
+func EmailUnsubscribe(w http.ResponseWriter, req *http.Request, userAPI userapi.ClientUserAPI) {
+	token := req.FormValue("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		serveTemplate(w, emailUnsubscribeTemplate, map[string]string{
+			"message": "This link is invalid.",
+		})
+		return
+	}
+	if req.Method == http.MethodGet {
+		serveTemplate(w, emailUnsubscribeTemplate, map[string]string{
+			"message": "Do you want to stop receiving notifications by email?",
+			"token":   token,
+		})
+		return
+	}
+
+	var res userapi.PerformEmailUnsubscribeResponse
+	if err := userAPI.PerformEmailUnsubscribe(req.Context(), &userapi.PerformEmailUnsubscribeRequest{
+		Token: token,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("PerformEmailUnsubscribe failed")
+		w.WriteHeader(http.StatusInternalServerError)
+		serveTemplate(w, emailUnsubscribeTemplate, map[string]string{
+			"message": "Something went wrong. Please try again later.",
+		})
+		return
+	}
+	if res.UserID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		serveTemplate(w, emailUnsubscribeTemplate, map[string]string{
+			"message": "This link is invalid.",
+		})
+		return
+	}
+	serveTemplate(w, emailUnsubscribeTemplate, map[string]string{
+		"message": "You won't receive notifications for " + res.UserID + " at " + res.Email + " anymore.",
+	})
+}
+
 func invalidParam(msg string) util.JSONResponse {
 	return util.JSONResponse{
 		Code: http.StatusBadRequest,
@@ -0,0 +1,118 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+func TestRefreshToken(t *testing.T) {
+	alice := test.NewUser(t)
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		natsInstance := jetstream.NATSInstance{}
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+
+		localpart, serverName, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+			AccountType: uapi.AccountTypeUser,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			Password:    "password",
+		}, &uapi.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+
+		// verify returns the JSON error if the access token isn't accepted
+		verify := func(accessToken string) map[string]interface{} {
+			req := test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/account/whoami")
+			req.Header.Set("Authorization", "Bearer "+accessToken)
+			_, errRes := auth.VerifyUserFromRequest(req, userAPI)
+			if errRes == nil {
+				return nil
+			}
+			if errRes.Code != http.StatusUnauthorized {
+				t.Fatalf("expected HTTP 401, got %d: %+v", errRes.Code, errRes.JSON)
+			}
+			var res map[string]interface{}
+			b, _ := json.Marshal(errRes.JSON)
+			_ = json.Unmarshal(b, &res)
+			return res
+		}
+		refresh := func(refreshToken string) (int, interface{}) {
+			res := Refresh(test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/refresh", test.WithJSONBody(t, map[string]interface{}{
+				"refresh_token": refreshToken,
+			})), userAPI)
+			return res.Code, res.JSON
+		}
+
+		res := Login(test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/login", test.WithJSONBody(t, map[string]interface{}{
+			"type":          "m.login.password",
+			"identifier":    map[string]interface{}{"type": "m.id.user", "user": alice.ID},
+			"password":      "password",
+			"refresh_token": true,
+		})), userAPI, &cfg.ClientAPI)
+		if res.Code != http.StatusOK {
+			t.Fatalf("failed to log in: %+v", res.JSON)
+		}
+		login := res.JSON.(loginResponse)
+		if login.RefreshToken == "" || login.ExpiresInMS <= 0 || login.ExpiresInMS > cfg.UserAPI.AccessTokenLifetimeMS {
+			t.Fatalf("expected a refresh token and an expiring access token, got %+v", login)
+		}
+		if errRes := verify(login.AccessToken); errRes != nil {
+			t.Fatalf("expected the access token to be valid, got %+v", errRes)
+		}
+
+		code, refreshRes := refresh(login.RefreshToken)
+		if code != http.StatusOK {
+			t.Fatalf("failed to refresh: %+v", refreshRes)
+		}
+		refreshed := refreshRes.(refreshResponse)
+		if refreshed.RefreshToken == login.RefreshToken || refreshed.AccessToken == login.AccessToken || refreshed.ExpiresInMS <= 0 {
+			t.Fatalf("expected new tokens, got %+v", refreshed)
+		}
+		if errRes := verify(login.AccessToken); errRes == nil || errRes["soft_logout"] == true {
+			t.Fatalf("expected the old access token to be revoked, got %+v", errRes)
+		}
+		if errRes := verify(refreshed.AccessToken); errRes != nil {
+			t.Fatalf("expected the new access token to be valid, got %+v", errRes)
+		}
+
+		// Expired access tokens result in a soft logout
+		cfg.UserAPI.AccessTokenLifetimeMS = -1000
+		code, refreshRes = refresh(refreshed.RefreshToken)
+		if code != http.StatusOK {
+			t.Fatalf("failed to refresh: %+v", refreshRes)
+		}
+		errRes := verify(refreshRes.(refreshResponse).AccessToken)
+		if errRes == nil || errRes["errcode"] != string(spec.ErrorUnknownToken) || errRes["soft_logout"] != true {
+			t.Fatalf("expected a soft logout, got %+v", errRes)
+		}
+
+		if code, refreshRes = refresh("unknown"); code != http.StatusUnauthorized {
+			t.Fatalf("expected HTTP 401 for an unknown refresh token, got %d: %+v", code, refreshRes)
+		}
+	})
+}
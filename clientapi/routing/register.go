@@ -221,6 +221,9 @@ type registerRequest struct {
 	// Prevent this user from logging in
 	InhibitLogin eventutil.WeakBoolean `json:"inhibit_login"`
 
+	// Whether the client supports refreshing its access token
+	RefreshToken bool `json:"refresh_token"`
+
 	// Application Services place Type in the root of their registration
 	// request, whereas clients place it in the authDict struct.
 	Type authtypes.LoginType `json:"type"`
@@ -258,9 +261,11 @@ func newUserInteractiveResponse(
 
 // https://spec.matrix.org/v1.7/client-server-api/#post_matrixclientv3register
 type registerResponse struct {
-	UserID      string `json:"user_id"`
-	AccessToken string `json:"access_token,omitempty"`
-	DeviceID    string `json:"device_id,omitempty"`
+	UserID       string `json:"user_id"`
+	AccessToken  string `json:"access_token,omitempty"`
+	DeviceID     string `json:"device_id,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 // recaptchaResponse represents the HTTP response from a Google Recaptcha server
@@ -795,7 +800,7 @@ func handleApplicationServiceRegistration(
 	// application service registration is entirely separate.
 	return completeRegistration(
 		req.Context(), userAPI, r.Username, r.ServerName, "", "", appserviceID, req.RemoteAddr,
-		req.UserAgent(), r.Auth.Session, r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+		req.UserAgent(), r.Auth.Session, r.InhibitLogin, r.RefreshToken, r.InitialDisplayName, r.DeviceID,
 		userapi.AccountTypeAppService,
 	)
 }
@@ -815,7 +820,7 @@ func checkAndCompleteFlow(
 		// This flow was completed, registration can continue
 		return completeRegistration(
 			req.Context(), userAPI, r.Username, r.ServerName, "", r.Password, "", req.RemoteAddr,
-			req.UserAgent(), sessionID, r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+			req.UserAgent(), sessionID, r.InhibitLogin, r.RefreshToken, r.InitialDisplayName, r.DeviceID,
 			userapi.AccountTypeUser,
 		)
 	}
@@ -840,7 +845,7 @@ func completeRegistration(
 	userAPI userapi.ClientUserAPI,
 	username string, serverName spec.ServerName, displayName string,
 	password, appserviceID, ipAddr, userAgent, sessionID string,
-	inhibitLogin eventutil.WeakBoolean,
+	inhibitLogin eventutil.WeakBoolean, refreshable bool,
 	deviceDisplayName, deviceID *string,
 	accType userapi.AccountType,
 ) util.JSONResponse {
@@ -901,6 +906,16 @@ func completeRegistration(
 		}
 	}
 
+	var refreshToken string
+	if refreshable {
+		if refreshToken, err = auth.GenerateAccessToken(); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.Unknown("Failed to generate refresh token"),
+			}
+		}
+	}
+
 	if displayName != "" {
 		_, _, err = userAPI.SetDisplayName(ctx, username, serverName, displayName)
 		if err != nil {
@@ -916,6 +931,7 @@ func completeRegistration(
 		Localpart:         username,
 		ServerName:        serverName,
 		AccessToken:       token,
+		RefreshToken:      refreshToken,
 		DeviceDisplayName: deviceDisplayName,
 		DeviceID:          deviceID,
 		IPAddr:            ipAddr,
@@ -930,9 +946,11 @@ func completeRegistration(
 	}
 
 	result := registerResponse{
-		UserID:      devRes.Device.UserID,
-		AccessToken: devRes.Device.AccessToken,
-		DeviceID:    devRes.Device.ID,
+		UserID:       devRes.Device.UserID,
+		AccessToken:  devRes.Device.AccessToken,
+		DeviceID:     devRes.Device.ID,
+		RefreshToken: refreshToken,
+		ExpiresInMS:  expiresInMS(devRes.Device),
 	}
 	sessions.addCompletedRegistration(sessionID, result)
 
@@ -1102,5 +1120,5 @@ func handleSharedSecretRegistration(cfg *config.ClientAPI, userAPI userapi.Clien
 	if ssrr.Admin {
 		accType = userapi.AccountTypeAdmin
 	}
-	return completeRegistration(req.Context(), userAPI, ssrr.User, cfg.Matrix.ServerName, ssrr.DisplayName, ssrr.Password, "", req.RemoteAddr, req.UserAgent(), "", false, &ssrr.User, &deviceID, accType)
+	return completeRegistration(req.Context(), userAPI, ssrr.User, cfg.Matrix.ServerName, ssrr.DisplayName, ssrr.Password, "", req.RemoteAddr, req.UserAgent(), "", false, false, &ssrr.User, &deviceID, accType)
 }
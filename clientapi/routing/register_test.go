@@ -615,6 +615,7 @@ func TestRegisterUserWithDisplayName(t *testing.T) {
 			"user agent",
 			"session",
 			false,
+			false,
 			&deviceName,
 			&deviceID,
 			api.AccountTypeAdmin,
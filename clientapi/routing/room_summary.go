@@ -0,0 +1,137 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// unstableRoomSummary is a room summary using the prefixed keys of the unstable
+// endpoint, which clients implemented before MSC3266 was stabilised.
+type unstableRoomSummary struct {
+	roomserverAPI.RoomSummary
+	UnstableEncryption  string                        `json:"im.nheko.summary.encryption,omitempty"`
+	UnstableRoomVersion gomatrixserverlib.RoomVersion `json:"im.nheko.summary.room_version,omitempty"`
+}
+
+// QueryRoomSummary returns the summary of a room, so that it can be previewed
+// before joining.
+//
+// Implements /_matrix/client/v1/rooms/{roomIdOrAlias}/summary, and
+// /_matrix/client/unstable/im.nheko.summary/rooms/{roomIdOrAlias}/summary if unstable is true.
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/3266
+func QueryRoomSummary(
+	req *http.Request, device *userapi.Device, roomIDOrAlias string,
+	cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI,
+	federation fclient.FederationClient, unstable bool,
+) util.JSONResponse {
+	vias := req.URL.Query()["via"]
+
+	roomIDStr := roomIDOrAlias
+	if len(roomIDOrAlias) > 0 && roomIDOrAlias[0] == '#' {
+		_, domain, err := gomatrixserverlib.SplitID('#', roomIDOrAlias)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("Room alias must be in the form '#localpart:domain'"),
+			}
+		}
+		queryRes := &roomserverAPI.GetRoomIDForAliasResponse{}
+		if err = rsAPI.GetRoomIDForAlias(req.Context(), &roomserverAPI.GetRoomIDForAliasRequest{
+			Alias:              roomIDOrAlias,
+			IncludeAppservices: true,
+		}, queryRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.GetRoomIDForAlias failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		roomIDStr = queryRes.RoomID
+		// If we don't know the alias locally, ask the server of the alias,
+		// which also tells us servers to fetch the summary from.
+		if roomIDStr == "" && !cfg.Matrix.IsLocalServerName(domain) {
+			fedRes, fedErr := federation.LookupRoomAlias(req.Context(), cfg.Matrix.ServerName, domain, roomIDOrAlias)
+			if fedErr != nil {
+				util.GetLogger(req.Context()).WithError(fedErr).Debug("federation.LookupRoomAlias failed")
+			} else {
+				roomIDStr = fedRes.RoomID
+				for _, server := range fedRes.Servers {
+					vias = append(vias, string(server))
+				}
+			}
+		}
+		if roomIDStr == "" {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound("Room alias " + roomIDOrAlias + " not found"),
+			}
+		}
+	}
+
+	roomID, err := spec.NewRoomID(roomIDStr)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid room ID or alias"),
+		}
+	}
+
+	summary, err := rsAPI.QueryRoomSummary(req.Context(), types.NewDeviceNotServerName(*device), *roomID, vias)
+	if err != nil {
+		switch err.(type) {
+		case roomserverAPI.ErrRoomUnknownOrNotAllowed:
+			util.GetLogger(req.Context()).WithError(err).Debugln("room unknown/forbidden when handling room summary request")
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound("room is unknown/forbidden"),
+			}
+		default:
+			log.WithError(err).Errorf("failed to fetch room summary")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
+
+	if unstable {
+		res := unstableRoomSummary{
+			RoomSummary:         *summary,
+			UnstableEncryption:  summary.Encryption,
+			UnstableRoomVersion: summary.RoomVersion,
+		}
+		res.Encryption, res.RoomVersion = "", ""
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: summary,
+	}
+}
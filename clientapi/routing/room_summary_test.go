@@ -0,0 +1,114 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestQueryRoomSummary(t *testing.T) {
+	alice := test.NewUser(t)
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil) // creates the rs.Inputer etc
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+
+		localpart, serverName, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+			AccountType: alice.AccountType,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			Password:    "someRandomPassword",
+		}, &uapi.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+
+		aliceDev := &uapi.Device{UserID: alice.ID}
+		resp := createRoom(ctx, createRoomRequest{
+			Name:        "summary",
+			Preset:      spec.PresetPrivateChat,
+			RoomVersion: gomatrixserverlib.RoomVersionV10,
+			InitialState: []gomatrixserverlib.FledglingEvent{
+				{
+					Type:    spec.MRoomEncryption,
+					Content: map[string]interface{}{"algorithm": "m.megolm.v1.aes-sha2"},
+				},
+			},
+		}, aliceDev, &cfg.ClientAPI, userAPI, rsAPI, time.Now())
+		room, ok := resp.JSON.(createRoomResponse)
+		if !ok {
+			t.Fatalf("response is not a createRoomResponse: %+v", resp)
+		}
+
+		testCases := []struct {
+			name     string
+			unstable bool
+			wantKeys []string
+			noKeys   []string
+		}{
+			{
+				name:     "stable",
+				wantKeys: []string{"encryption", "room_version"},
+				noKeys:   []string{"im.nheko.summary.encryption", "im.nheko.summary.room_version"},
+			},
+			{
+				name:     "unstable",
+				unstable: true,
+				wantKeys: []string{"im.nheko.summary.encryption", "im.nheko.summary.room_version"},
+				noKeys:   []string{"encryption", "room_version"},
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				req := test.NewRequest(t, http.MethodGet, "/_matrix/client/v1/rooms/"+room.RoomID+"/summary")
+				res := QueryRoomSummary(req, aliceDev, room.RoomID, &cfg.ClientAPI, rsAPI, nil, tc.unstable)
+				if res.Code != http.StatusOK {
+					t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+				}
+				body, err := json.Marshal(res.JSON)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var summary map[string]interface{}
+				if err = json.Unmarshal(body, &summary); err != nil {
+					t.Fatal(err)
+				}
+				if summary["room_id"] != room.RoomID || summary["membership"] != spec.Join {
+					t.Fatalf("unexpected summary: %s", body)
+				}
+				for _, key := range tc.wantKeys {
+					if _, ok := summary[key]; !ok {
+						t.Errorf("expected key %q in %s", key, body)
+					}
+				}
+				for _, key := range tc.noKeys {
+					if _, ok := summary[key]; ok {
+						t.Errorf("unexpected key %q in %s", key, body)
+					}
+				}
+			})
+		}
+	})
+}
@@ -32,8 +32,10 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/api"
 	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/sso"
 	clientutil "github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/internal/transactions"
@@ -68,10 +70,12 @@ func Setup(
 	userAPI userapi.ClientUserAPI,
 	userDirectoryProvider userapi.QuerySearchProfilesAPI,
 	federation fclient.FederationClient,
+	client *fclient.Client,
 	syncProducer *producers.SyncAPIProducer,
 	transactionsCache *transactions.Cache,
 	federationSender federationAPI.ClientFederationAPI,
 	extRoomsProvider api.ExtraPublicRoomsProvider,
+	rateLimits *httputil.RateLimits,
 	natsClient *nats.Conn, enableMetrics bool,
 ) {
 	cfg := &dendriteCfg.ClientAPI
@@ -84,12 +88,19 @@ func Setup(
 		prometheus.MustRegister(amtRegUsers, sendEventDuration)
 	}
 
-	rateLimits := httputil.NewRateLimits(&cfg.RateLimiting)
-	userInteractiveAuth := auth.NewUserInteractive(userAPI, cfg)
+	threePIDValidationSessions := threepid.NewValidationSessions()
+	userInteractiveAuth := auth.NewUserInteractive(userAPI, cfg, threePIDValidationSessions)
+	var ssoAuthenticator *sso.Authenticator
+	if cfg.SSO.Enabled {
+		ssoAuthenticator = sso.NewAuthenticator(&cfg.SSO, client)
+	}
 
 	unstableFeatures := map[string]bool{
 		"org.matrix.e2e_cross_signing": true,
 		"org.matrix.msc2285.stable":    true,
+		// Native sliding sync is served by the sync API
+		"org.matrix.simplified_msc3575": true,
+		"im.nheko.summary":              true,
 	}
 
 	// singleflight protects /join endpoints from being invoked
@@ -201,6 +212,25 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/rateLimitOverride/{userID}",
+		httputil.MakeAdminAPI("admin_rate_limit_override", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			switch req.Method {
+			case http.MethodGet:
+				return AdminGetRateLimitOverride(req, cfg, userAPI)
+			case http.MethodPut:
+				return AdminSetRateLimitOverride(req, cfg, userAPI, rateLimits)
+			case http.MethodDelete:
+				return AdminDeleteRateLimitOverride(req, cfg, userAPI, rateLimits)
+			default:
+				return util.MatrixErrorResponse(
+					404,
+					string(spec.ErrorNotFound),
+					"unknown method",
+				)
+			}
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+
 	dendriteAdminRouter.Handle("/admin/evacuateRoom/{roomID}",
 		httputil.MakeAdminAPI("admin_evacuate_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return AdminEvacuateRoom(req, rsAPI)
@@ -307,7 +337,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/join/{roomIDOrAlias}",
 		httputil.MakeAuthAPI(spec.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req, device); r != nil {
+			if r := rateLimits.LimitClass(req, device, httputil.RateLimitJoin); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -328,6 +358,19 @@ func Setup(
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	v3mux.Handle("/knock/{roomIDOrAlias}",
+		httputil.MakeAuthAPI(spec.Knock, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.LimitClass(req, device, httputil.RateLimitJoin); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return KnockRoomByIDOrAlias(req, device, rsAPI, vars["roomIDOrAlias"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	v3mux.Handle("/joined_rooms",
 		httputil.MakeAuthAPI("joined_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetJoinedRooms(req, device, rsAPI)
@@ -335,7 +378,7 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/join",
 		httputil.MakeAuthAPI(spec.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req, device); r != nil {
+			if r := rateLimits.LimitClass(req, device, httputil.RateLimitJoin); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -380,7 +423,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/invite",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req, device); r != nil {
+			if r := rateLimits.LimitClass(req, device, httputil.RateLimitInvite); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -410,6 +453,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/send/{eventType}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.LimitClass(req, device, httputil.RateLimitMessage); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -419,6 +465,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.LimitClass(req, device, httputil.RateLimitMessage); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -501,8 +550,41 @@ func Setup(
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	unstableMux.Handle("/im.nheko.summary/rooms/{roomIDOrAlias}/summary",
+		httputil.MakeAuthAPI("room_summary", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return QueryRoomSummary(req, device, vars["roomIDOrAlias"], cfg, rsAPI, federation, true)
+		}, httputil.WithAllowGuests()),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v1mux.Handle("/rooms/{roomIDOrAlias}/summary",
+		httputil.MakeAuthAPI("room_summary", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return QueryRoomSummary(req, device, vars["roomIDOrAlias"], cfg, rsAPI, federation, false)
+		}, httputil.WithAllowGuests()),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v1mux.Handle("/rooms/{roomID}/timestamp_to_event",
+		httputil.MakeAuthAPI("timestamp_to_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return TimestampToEvent(
+				req, device, vars["roomID"], rsAPI, federationSender, natsClient,
+				cfg.Matrix.JetStream.Prefixed(jetstream.RequestTimestampToEvent),
+			)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	v3mux.Handle("/register", httputil.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
-		if r := rateLimits.Limit(req, nil); r != nil {
+		if r := rateLimits.LimitClass(req, nil, httputil.RateLimitRegistration); r != nil {
 			return *r
 		}
 		return Register(req, userAPI, cfg)
@@ -669,14 +751,44 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	v3mux.Handle("/account/password",
-		httputil.MakeAuthAPI("password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeExternalAPI("password", func(req *http.Request) util.JSONResponse {
+			// The access token is optional, as a forgotten password can be reset
+			// by validating an email address instead.
+			var device *userapi.Device
+			if _, err := auth.ExtractAccessToken(req); err == nil {
+				var resErr *util.JSONResponse
+				if device, resErr = auth.VerifyUserFromRequest(req, userAPI); resErr != nil {
+					return *resErr
+				}
+				if device.AccountType == userapi.AccountTypeGuest {
+					return util.JSONResponse{
+						Code: http.StatusForbidden,
+						JSON: spec.GuestAccessForbidden("Guest access not allowed"),
+					}
+				}
+			}
 			if r := rateLimits.Limit(req, device); r != nil {
 				return *r
 			}
-			return Password(req, userAPI, device, cfg)
+			return Password(req, userAPI, device, cfg, threePIDValidationSessions)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	v3mux.Handle("/account/password/email/requestToken",
+		httputil.MakeExternalAPI("account_password_request_email", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return *r
+			}
+			return RequestPasswordEmailToken(req, userAPI, cfg, threePIDValidationSessions)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	v3mux.Handle("/account/password/email/submitToken",
+		httputil.MakeHTMLAPI("account_password_submit_email", enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+			SubmitPasswordEmailToken(w, req, threePIDValidationSessions)
+		}),
+	).Methods(http.MethodGet)
+
 	v3mux.Handle("/account/deactivate",
 		httputil.MakeAuthAPI("deactivate", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			if r := rateLimits.Limit(req, device); r != nil {
@@ -686,24 +798,118 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	v3mux.Handle("/account/3pid",
+		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetAssociated3PIDs(req, userAPI, device)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v3mux.Handle("/account/3pid",
+		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			return CheckAndSave3PIDAssociation(req, userAPI, device, cfg, client)
+		}),
+	).Methods(http.MethodPost)
+
+	v3mux.Handle("/account/3pid/add",
+		httputil.MakeAuthAPI("account_3pid_add", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			return Add3PID(req, userInteractiveAuth, userAPI, device, threePIDValidationSessions)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	v3mux.Handle("/account/3pid/bind",
+		httputil.MakeAuthAPI("account_3pid_bind", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			return Bind3PID(req, device, cfg, client)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	v3mux.Handle("/account/3pid/unbind",
+		httputil.MakeAuthAPI("account_3pid_unbind", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			return Unbind3PID(req, device, cfg, client)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	v3mux.Handle("/account/3pid/delete",
+		httputil.MakeAuthAPI("account_3pid_delete", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			return Delete3PID(req, userInteractiveAuth, userAPI, device, cfg, client)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	v3mux.Handle("/account/3pid/email/requestToken",
+		httputil.MakeExternalAPI("account_3pid_request_token", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return *r
+			}
+			return RequestEmailToken(req, userAPI, cfg, threePIDValidationSessions)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	v3mux.Handle("/account/3pid/email/submitToken",
+		httputil.MakeHTMLAPI("account_3pid_submit_token", enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+			SubmitEmailToken(w, req, threePIDValidationSessions)
+		}),
+	).Methods(http.MethodGet)
+
 	// Stub endpoints required by Element
 
 	v3mux.Handle("/login",
 		httputil.MakeExternalAPI("login", func(req *http.Request) util.JSONResponse {
-			if r := rateLimits.Limit(req, nil); r != nil {
+			if r := rateLimits.LimitClass(req, nil, httputil.RateLimitLogin); r != nil {
 				return *r
 			}
 			return Login(req, userAPI, cfg)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	v3mux.Handle("/refresh",
+		httputil.MakeExternalAPI("refresh", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return *r
+			}
+			return Refresh(req, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	v3mux.Handle("/auth/{authType}/fallback/web",
 		httputil.MakeHTMLAPI("auth_fallback", enableMetrics, func(w http.ResponseWriter, req *http.Request) {
 			vars := mux.Vars(req)
-			AuthFallback(w, req, vars["authType"], cfg)
+			AuthFallback(w, req, vars["authType"], cfg, ssoAuthenticator)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	v3mux.Handle("/login/sso/redirect",
+		httputil.MakeHTMLAPI("login_sso_redirect", enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+			SSORedirect(w, req, "", cfg, ssoAuthenticator)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v3mux.Handle("/login/sso/redirect/{idpId}",
+		httputil.MakeHTMLAPI("login_sso_redirect_idp", enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+			vars := mux.Vars(req)
+			SSORedirect(w, req, vars["idpId"], cfg, ssoAuthenticator)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v3mux.Handle("/login/sso/callback",
+		httputil.MakeHTMLAPI("login_sso_callback", enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+			SSOCallback(w, req, cfg, userAPI, ssoAuthenticator, userInteractiveAuth)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	// Push rules
 
 	v3mux.Handle("/pushrules",
@@ -1108,6 +1314,14 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	// Opened from the link in notification emails, so it can't be authenticated
+	// with an access token. The link carries a signed token instead.
+	unstableMux.Handle("/pushers/email/unsubscribe",
+		httputil.MakeHTMLAPI("email_unsubscribe", enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+			EmailUnsubscribe(w, req, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodPost)
+
 	// Stub implementations for sytest
 	v3mux.Handle("/events",
 		httputil.MakeAuthAPI("events", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -0,0 +1,411 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/sso"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// ssoCallbackPath is the path identity providers redirect users back to.
+	ssoCallbackPath = "/_matrix/client/v3/login/sso/callback"
+	// ssoStateCookie binds the state of a sign-in to the browser it was started in.
+	ssoStateCookie = "dendrite_sso_state"
+	// ssoStateTimeout is how long users have to sign in at the identity provider.
+	ssoStateTimeout = 10 * time.Minute
+	ssoStateLength  = 32
+)
+
+// ssoErrorTemplate is an HTML template presented to the user if signing in fails
+const ssoErrorTemplate = `
+<html>
+<head>
+<title>Single sign-on failed</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+    <div>
+        <p>{{.message}}</p>
+    </div>
+</body>
+</html>
+`
+
+// ssoState is a sign-in which is in progress at an identity provider.
+type ssoState struct {
+	idpID string
+	nonce string
+	// The client URL to redirect to with a login token, when logging in
+	redirectURL string
+	// The user-interactive auth session to complete, when re-authenticating
+	uiaSessionID string
+}
+
+// ssoStatesDict keeps track of the sign-ins in progress, by their state parameter.
+// It shouldn't be passed by value because it contains a mutex.
+type ssoStatesDict struct {
+	sync.Mutex
+	states map[string]ssoState
+	timer  map[string]*time.Timer
+}
+
+func newSSOStatesDict() *ssoStatesDict {
+	return &ssoStatesDict{
+		states: make(map[string]ssoState),
+		timer:  make(map[string]*time.Timer),
+	}
+}
+
+// add stores a sign-in and returns its state parameter.
+func (d *ssoStatesDict) add(s ssoState) string {
+	d.Lock()
+	defer d.Unlock()
+	state := util.RandomString(ssoStateLength)
+	d.states[state] = s
+	d.timer[state] = time.AfterFunc(ssoStateTimeout, func() {
+		d.pop(state)
+	})
+	return state
+}
+
+// pop returns and deletes a sign-in, so that the state parameter can only be used once.
+func (d *ssoStatesDict) pop(state string) (ssoState, bool) {
+	d.Lock()
+	defer d.Unlock()
+	s, ok := d.states[state]
+	delete(d.states, state)
+	if t, ok := d.timer[state]; ok {
+		t.Stop()
+		delete(d.timer, state)
+	}
+	return s, ok
+}
+
+var ssoStates = newSSOStatesDict()
+
+// identityProvider is an identity provider as advertised by GET /login.
+type identityProvider struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Icon  string `json:"icon,omitempty"`
+	Brand string `json:"brand,omitempty"`
+}
+
+// SSORedirect implements GET /login/sso/redirect and /login/sso/redirect/{idpId}
+// The user is sent to the identity provider, and comes back to SSOCallback.
+func SSORedirect(
+	w http.ResponseWriter, req *http.Request, idpID string,
+	cfg *config.ClientAPI, authenticator *sso.Authenticator,
+) {
+	if authenticator == nil {
+		writeHTTPMessage(w, req, "Single sign-on is disabled on this homeserver", http.StatusNotFound)
+		return
+	}
+	redirectURL, err := url.Parse(req.URL.Query().Get("redirectUrl"))
+	if err != nil || !redirectURL.IsAbs() {
+		writeHTTPMessage(w, req, "A valid redirectUrl must be supplied", http.StatusBadRequest)
+		return
+	}
+	// The login token is appended to the redirect URL, so only send it to clients
+	// the server admin trusts, or anyone could phish for login tokens.
+	if !cfg.SSO.IsAllowedRedirectURL(redirectURL) {
+		writeHTTPMessage(w, req, fmt.Sprintf("Redirecting to %q after signing in isn't allowed", redirectURL.Host), http.StatusBadRequest)
+		return
+	}
+	if idpID == "" {
+		idpID = cfg.SSO.DefaultProviderID
+	}
+	startSSO(w, req, cfg, authenticator, ssoState{
+		idpID:       idpID,
+		redirectURL: redirectURL.String(),
+	})
+}
+
+// ssoFallback implements GET /auth/m.login.sso/fallback/web?session={sessionID}
+// The user re-authenticates at the default identity provider.
+func ssoFallback(
+	w http.ResponseWriter, req *http.Request, sessionID string,
+	cfg *config.ClientAPI, authenticator *sso.Authenticator,
+) {
+	if authenticator == nil {
+		writeHTTPMessage(w, req, "Single sign-on is disabled on this homeserver", http.StatusBadRequest)
+		return
+	}
+	startSSO(w, req, cfg, authenticator, ssoState{
+		idpID:        cfg.SSO.DefaultProviderID,
+		uiaSessionID: sessionID,
+	})
+}
+
+func startSSO(
+	w http.ResponseWriter, req *http.Request,
+	cfg *config.ClientAPI, authenticator *sso.Authenticator, s ssoState,
+) {
+	s.nonce = util.RandomString(ssoStateLength)
+	state := ssoStates.add(s)
+	callbackURL := ssoCallbackURL(cfg)
+	authURL, err := authenticator.AuthorizationURL(req.Context(), s.idpID, callbackURL, state, s.nonce)
+	if err != nil {
+		ssoStates.pop(state)
+		if errors.Is(err, sso.ErrUnknownProvider) {
+			writeHTTPMessage(w, req, fmt.Sprintf("Unknown identity provider %q", s.idpID), http.StatusNotFound)
+			return
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("authenticator.AuthorizationURL failed")
+		writeHTTPMessage(w, req, "Failed to contact the identity provider", http.StatusBadGateway)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    state,
+		Path:     "/_matrix/client/",
+		MaxAge:   int(ssoStateTimeout.Seconds()),
+		Secure:   strings.HasPrefix(callbackURL, "https://"),
+		HttpOnly: true,
+		// The identity provider redirects back with a top-level navigation, which
+		// includes the cookie with SameSite=Lax.
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, authURL, http.StatusFound)
+}
+
+// SSOCallback implements GET /login/sso/callback
+// The identity provider redirects the user here after they signed in. When logging
+// in, the account is created on first login and the user is redirected to the client
+// with a login token. When re-authenticating, the user-interactive auth stage is completed.
+func SSOCallback(
+	w http.ResponseWriter, req *http.Request,
+	cfg *config.ClientAPI, userAPI userapi.ClientUserAPI,
+	authenticator *sso.Authenticator, userInteractiveAuth *auth.UserInteractive,
+) {
+	serveError := func(code int, message string) {
+		w.WriteHeader(code)
+		serveTemplate(w, ssoErrorTemplate, map[string]string{"message": message})
+	}
+	if authenticator == nil {
+		serveError(http.StatusNotFound, "Single sign-on is disabled on this homeserver.")
+		return
+	}
+
+	query := req.URL.Query()
+	s, ok := ssoStates.pop(query.Get("state"))
+	if !ok {
+		serveError(http.StatusBadRequest, "The sign-in has expired. Please try again.")
+		return
+	}
+	// Make sure the sign-in was started in this browser, so that nobody can trick
+	// a user into finishing a sign-in for someone else.
+	if cookie, err := req.Cookie(ssoStateCookie); err != nil || cookie.Value != query.Get("state") {
+		serveError(http.StatusBadRequest, "The sign-in was started in a different browser. Please try again.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: ssoStateCookie, Path: "/_matrix/client/", MaxAge: -1})
+
+	identity, err := authenticator.ProcessCallback(req.Context(), s.idpID, ssoCallbackURL(cfg), s.nonce, query)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("idp_id", s.idpID).Warn("Single sign-on failed")
+		serveError(http.StatusUnauthorized, "Signing in with the identity provider failed. Please try again.")
+		return
+	}
+
+	if s.uiaSessionID != "" {
+		userID, err := ssoExistingUser(req.Context(), userAPI, identity)
+		if err != nil {
+			serveError(http.StatusInternalServerError, "Internal server error.")
+			return
+		}
+		if userID == "" {
+			serveError(http.StatusForbidden, "Your account at the identity provider isn't associated with an account on this homeserver.")
+			return
+		}
+		login := &auth.Login{Identifier: auth.LoginIdentifier{Type: "m.id.user", User: userID}}
+		if err = userInteractiveAuth.CompleteFallbackStage(s.uiaSessionID, authtypes.LoginTypeSSO, login); err != nil {
+			if errors.Is(err, auth.ErrSessionUserMismatch) {
+				serveError(http.StatusForbidden, "You signed in as a different user than the one who started the authentication.")
+				return
+			}
+			serveError(http.StatusBadRequest, "The authentication session has expired. Please try again.")
+			return
+		}
+		serveTemplate(w, successTemplate, map[string]string{})
+		return
+	}
+
+	userID, errMsg := ssoUser(req.Context(), userAPI, cfg, identity)
+	if errMsg != "" {
+		serveError(http.StatusForbidden, errMsg)
+		return
+	}
+	var tokenRes userapi.PerformLoginTokenCreationResponse
+	if err = userAPI.PerformLoginTokenCreation(req.Context(), &userapi.PerformLoginTokenCreationRequest{
+		Data: userapi.LoginTokenData{UserID: userID},
+	}, &tokenRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformLoginTokenCreation failed")
+		serveError(http.StatusInternalServerError, "Internal server error.")
+		return
+	}
+	redirectURL, _ := url.Parse(s.redirectURL)
+	redirectQuery := redirectURL.Query()
+	redirectQuery.Set("loginToken", tokenRes.Metadata.Token)
+	redirectURL.RawQuery = redirectQuery.Encode()
+	http.Redirect(w, req, redirectURL.String(), http.StatusFound)
+}
+
+// ssoExistingUser returns the user the identity belongs to, or an empty string if
+// it doesn't belong to anyone.
+func ssoExistingUser(ctx context.Context, userAPI userapi.ClientUserAPI, identity *sso.Identity) (string, error) {
+	var res userapi.QueryLocalpartForSSOResponse
+	if err := userAPI.QueryLocalpartForSSO(ctx, &userapi.QueryLocalpartForSSORequest{
+		IDPID:   identity.IDPID,
+		Subject: identity.Subject,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryLocalpartForSSO failed")
+		return "", err
+	}
+	if res.Localpart == "" {
+		return "", nil
+	}
+	return userutil.MakeUserID(res.Localpart, res.ServerName), nil
+}
+
+// ssoUser returns the user the identity belongs to, creating an account for it when
+// the user signs in for the first time. Returns a message to show to the user if the
+// identity can't be associated with an account.
+func ssoUser(ctx context.Context, userAPI userapi.ClientUserAPI, cfg *config.ClientAPI, identity *sso.Identity) (userID, errMsg string) {
+	userID, err := ssoExistingUser(ctx, userAPI, identity)
+	if err != nil {
+		return "", "Internal server error."
+	}
+	if userID != "" {
+		return userID, ""
+	}
+	logger := util.GetLogger(ctx).WithField("idp_id", identity.IDPID)
+	serverName := cfg.Matrix.ServerName
+
+	localpart := ssoLocalpart(identity.SuggestedLocalpart)
+	if localpart == "" {
+		var res userapi.QueryNumericLocalpartResponse
+		if err := userAPI.QueryNumericLocalpart(ctx, &userapi.QueryNumericLocalpartRequest{ServerName: serverName}, &res); err != nil {
+			logger.WithError(err).Error("userAPI.QueryNumericLocalpart failed")
+			return "", "Internal server error."
+		}
+		localpart = strconv.FormatInt(res.ID, 10)
+	}
+	if err := internal.ValidateUsername(localpart, serverName); err != nil {
+		return "", fmt.Sprintf("The username %q provided by the identity provider isn't valid.", localpart)
+	}
+
+	var availability userapi.QueryAccountAvailabilityResponse
+	if err := userAPI.QueryAccountAvailability(ctx, &userapi.QueryAccountAvailabilityRequest{
+		Localpart:  localpart,
+		ServerName: serverName,
+	}, &availability); err != nil {
+		logger.WithError(err).Error("userAPI.QueryAccountAvailability failed")
+		return "", "Internal server error."
+	}
+	if availability.Available {
+		if err := userAPI.PerformAccountCreation(ctx, &userapi.PerformAccountCreationRequest{
+			AccountType: userapi.AccountTypeUser,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			OnConflict:  userapi.ConflictAbort,
+		}, &userapi.PerformAccountCreationResponse{}); err != nil {
+			logger.WithError(err).Error("userAPI.PerformAccountCreation failed")
+			return "", "Internal server error."
+		}
+		if identity.DisplayName != "" {
+			if _, _, err := userAPI.SetDisplayName(ctx, localpart, serverName, identity.DisplayName); err != nil {
+				logger.WithError(err).Warn("userAPI.SetDisplayName failed")
+			}
+		}
+	} else if !ssoAllowExistingUsers(cfg, identity.IDPID) {
+		return "", fmt.Sprintf("The username %q is already taken. Please contact the administrator of this homeserver.", localpart)
+	}
+
+	if err := userAPI.PerformSaveSSOAssociation(ctx, &userapi.PerformSaveSSOAssociationRequest{
+		IDPID:      identity.IDPID,
+		Subject:    identity.Subject,
+		Localpart:  localpart,
+		ServerName: serverName,
+	}, &struct{}{}); err != nil {
+		logger.WithError(err).Error("userAPI.PerformSaveSSOAssociation failed")
+		return "", "Internal server error."
+	}
+	logger.WithField("localpart", localpart).Info("Associated single sign-on identity with user")
+	return userutil.MakeUserID(localpart, serverName), ""
+}
+
+// ssoLocalpart turns a username suggested by an identity provider into a localpart,
+// by lower-casing it and replacing characters which aren't allowed.
+func ssoLocalpart(suggested string) string {
+	localpart := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', strings.ContainsRune("._=-/", r):
+			return r
+		default:
+			return '_'
+		}
+	}, strings.ToLower(suggested))
+	return strings.Trim(localpart, "_")
+}
+
+func ssoAllowExistingUsers(cfg *config.ClientAPI, idpID string) bool {
+	for _, p := range cfg.SSO.Providers {
+		if p.ID == idpID {
+			return p.AllowExistingUsers
+		}
+	}
+	return false
+}
+
+// ssoIdentityProviders returns the identity providers to advertise in GET /login.
+func ssoIdentityProviders(cfg *config.ClientAPI) []identityProvider {
+	idps := make([]identityProvider, 0, len(cfg.SSO.Providers))
+	for _, p := range cfg.SSO.Providers {
+		idps = append(idps, identityProvider{
+			ID:    p.ID,
+			Name:  p.Name,
+			Icon:  p.Icon,
+			Brand: p.Brand,
+		})
+	}
+	return idps
+}
+
+// ssoCallbackURL returns the URL identity providers redirect users back to.
+func ssoCallbackURL(cfg *config.ClientAPI) string {
+	if cfg.SSO.CallbackURL != "" {
+		return cfg.SSO.CallbackURL
+	}
+	return cfg.Matrix.ClientAPIBaseURL() + ssoCallbackPath
+}
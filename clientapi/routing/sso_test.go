@@ -0,0 +1,325 @@
+package routing
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/sso"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/util"
+)
+
+// mockIdP is an OpenID Connect identity provider which signs in whichever user it
+// was told to sign in next.
+type mockIdP struct {
+	*httptest.Server
+	mu     sync.Mutex
+	user   map[string]interface{}
+	codes  map[string]map[string]interface{} // code -> ID token claims
+	tokens map[string]map[string]interface{} // access token -> userinfo
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	idp := &mockIdP{
+		codes:  make(map[string]map[string]interface{}),
+		tokens: make(map[string]map[string]interface{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"userinfo_endpoint":      idp.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		if query.Get("client_id") != "dendrite" || query.Get("response_type") != "code" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		idp.mu.Lock()
+		code := util.RandomString(16)
+		idp.codes[code] = map[string]interface{}{
+			"iss":   idp.URL,
+			"aud":   "dendrite",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": query.Get("nonce"),
+			"sub":   idp.user["sub"],
+		}
+		accessToken := util.RandomString(16)
+		idp.tokens[accessToken] = idp.user
+		idp.codes[code]["access_token"] = accessToken
+		idp.mu.Unlock()
+
+		callback, _ := url.Parse(query.Get("redirect_uri"))
+		callbackQuery := callback.Query()
+		callbackQuery.Set("code", code)
+		callbackQuery.Set("state", query.Get("state"))
+		callback.RawQuery = callbackQuery.Encode()
+		http.Redirect(w, req, callback.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		if clientID, secret, ok := req.BasicAuth(); !ok || clientID != "dendrite" || secret != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		idp.mu.Lock()
+		claims, ok := idp.codes[req.FormValue("code")]
+		delete(idp.codes, req.FormValue("code"))
+		idp.mu.Unlock()
+		if !ok {
+			http.Error(w, "invalid code", http.StatusBadRequest)
+			return
+		}
+		accessToken := claims["access_token"]
+		delete(claims, "access_token")
+		payload, _ := json.Marshal(claims)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": accessToken,
+			"token_type":   "Bearer",
+			"id_token":     "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".",
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		idp.mu.Lock()
+		userinfo, ok := idp.tokens[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")]
+		idp.mu.Unlock()
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(userinfo)
+	})
+	idp.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func TestSSOLogin(t *testing.T) {
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		natsInstance := jetstream.NATSInstance{}
+
+		idp := newMockIdP(t)
+		cfg.ClientAPI.SSO = config.SSO{
+			Enabled:           true,
+			DefaultProviderID: "mock",
+			Providers: []config.IdentityProvider{{
+				ID:               "mock",
+				Name:             "Mock IdP",
+				Issuer:           idp.URL,
+				ClientID:         "dendrite",
+				ClientSecret:     "secret",
+				Scopes:           []string{"openid", "profile"},
+				LocalpartClaim:   "preferred_username",
+				DisplayNameClaim: "name",
+			}},
+			ClientRedirectURLs: []string{"https://client.example.com/"},
+		}
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		authenticator := sso.NewAuthenticator(&cfg.ClientAPI.SSO, fclient.NewClient(fclient.WithTransport(idp.Client().Transport)))
+		userInteractiveAuth := auth.NewUserInteractive(userAPI, &cfg.ClientAPI, nil)
+
+		// signIn starts signing in at the given redirect endpoint, lets the identity
+		// provider sign in the user and returns the response of the callback.
+		signIn := func(t *testing.T, start func(w http.ResponseWriter), user map[string]interface{}, withCookie bool) *httptest.ResponseRecorder {
+			t.Helper()
+			rec := httptest.NewRecorder()
+			start(rec)
+			if rec.Code != http.StatusFound {
+				t.Fatalf("expected a redirect to the identity provider, got HTTP %d: %s", rec.Code, rec.Body.String())
+			}
+			cookies := rec.Result().Cookies()
+
+			idp.mu.Lock()
+			idp.user = user
+			idp.mu.Unlock()
+			client := idp.Client()
+			client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+			res, err := client.Get(rec.Header().Get("Location"))
+			if err != nil {
+				t.Fatalf("failed to sign in at the identity provider: %s", err)
+			}
+			_ = res.Body.Close()
+			callback, err := url.Parse(res.Header.Get("Location"))
+			if err != nil || res.StatusCode != http.StatusFound || callback.Path != ssoCallbackPath {
+				t.Fatalf("expected a redirect to the callback, got HTTP %d: %s", res.StatusCode, callback)
+			}
+
+			req := test.NewRequest(t, http.MethodGet, callback.RequestURI())
+			if withCookie {
+				for _, c := range cookies {
+					req.AddCookie(c)
+				}
+			}
+			rec = httptest.NewRecorder()
+			SSOCallback(rec, req, &cfg.ClientAPI, userAPI, authenticator, userInteractiveAuth)
+			return rec
+		}
+		login := func(t *testing.T, user map[string]interface{}) *httptest.ResponseRecorder {
+			return signIn(t, func(w http.ResponseWriter) {
+				req := test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/login/sso/redirect/mock?redirectUrl="+url.QueryEscape("https://client.example.com/?app=1"))
+				SSORedirect(w, req, "mock", &cfg.ClientAPI, authenticator)
+			}, user, true)
+		}
+		// userForLoginToken returns the user the client would be logged in as.
+		userForLoginToken := func(t *testing.T, rec *httptest.ResponseRecorder) string {
+			t.Helper()
+			if rec.Code != http.StatusFound {
+				t.Fatalf("expected a redirect to the client, got HTTP %d: %s", rec.Code, rec.Body.String())
+			}
+			redirect, err := url.Parse(rec.Header().Get("Location"))
+			if err != nil || redirect.Host != "client.example.com" || redirect.Query().Get("app") != "1" {
+				t.Fatalf("unexpected redirect to the client: %s", rec.Header().Get("Location"))
+			}
+			var res uapi.QueryLoginTokenResponse
+			if err = userAPI.QueryLoginToken(ctx, &uapi.QueryLoginTokenRequest{Token: redirect.Query().Get("loginToken")}, &res); err != nil || res.Data == nil {
+				t.Fatalf("expected a valid login token (err: %v)", err)
+			}
+			return res.Data.UserID
+		}
+
+		alice := map[string]interface{}{"sub": "alice-subject", "preferred_username": "Alice", "name": "Alice Liddell"}
+		aliceID := "@alice:" + string(cfg.Global.ServerName)
+
+		t.Run("login advertises the identity providers", func(t *testing.T) {
+			res := Login(test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/login"), userAPI, &cfg.ClientAPI)
+			var found bool
+			for _, f := range res.JSON.(flows).Flows {
+				if f.Type == authtypes.LoginTypeSSO {
+					found = len(f.IdentityProviders) == 1 && f.IdentityProviders[0].ID == "mock"
+				}
+			}
+			if !found {
+				t.Fatalf("expected an m.login.sso flow with the mock identity provider, got %+v", res.JSON)
+			}
+		})
+
+		t.Run("redirect requires a redirectUrl", func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			SSORedirect(rec, test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/login/sso/redirect"), "", &cfg.ClientAPI, authenticator)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected HTTP 400, got %d", rec.Code)
+			}
+		})
+
+		t.Run("redirect rejects unknown identity providers", func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			SSORedirect(rec, test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/login/sso/redirect/unknown?redirectUrl=https://client.example.com"), "unknown", &cfg.ClientAPI, authenticator)
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("expected HTTP 404, got %d", rec.Code)
+			}
+		})
+
+		t.Run("redirect rejects foreign clients", func(t *testing.T) {
+			for _, redirectURL := range []string{
+				"https://evil.example.com/",
+				"https://client.example.com.evil.example.com/",
+				"http://client.example.com/",
+			} {
+				rec := httptest.NewRecorder()
+				SSORedirect(rec, test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/login/sso/redirect/mock?redirectUrl="+url.QueryEscape(redirectURL)), "mock", &cfg.ClientAPI, authenticator)
+				if rec.Code != http.StatusBadRequest {
+					t.Fatalf("expected HTTP 400 for %s, got %d", redirectURL, rec.Code)
+				}
+			}
+		})
+
+		// The first login creates the account, later logins map to the same account
+		for i := 0; i < 2; i++ {
+			if userID := userForLoginToken(t, login(t, alice)); userID != aliceID {
+				t.Fatalf("expected to be logged in as %s, got %s", aliceID, userID)
+			}
+		}
+		profile, err := userAPI.QueryProfile(ctx, aliceID)
+		if err != nil || profile.DisplayName != "Alice Liddell" {
+			t.Fatalf("expected the display name to be set from the identity provider, got %+v (err: %v)", profile, err)
+		}
+
+		t.Run("existing users are not taken over", func(t *testing.T) {
+			rec := login(t, map[string]interface{}{"sub": "mallory-subject", "preferred_username": "alice"})
+			if rec.Code != http.StatusForbidden {
+				t.Fatalf("expected HTTP 403, got %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+
+		t.Run("callback requires the state cookie", func(t *testing.T) {
+			rec := signIn(t, func(w http.ResponseWriter) {
+				req := test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/login/sso/redirect?redirectUrl=https://client.example.com")
+				SSORedirect(w, req, "", &cfg.ClientAPI, authenticator)
+			}, alice, false)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected HTTP 400, got %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+
+		t.Run("user-interactive auth", func(t *testing.T) {
+			device := &uapi.Device{UserID: aliceID}
+			_, challenge := userInteractiveAuth.Verify(ctx, []byte(`{}`), device)
+			sessionID := challenge.JSON.(auth.Challenge).Session
+			body := []byte(`{"auth":{"type":"m.login.sso","session":"` + sessionID + `"}}`)
+
+			if _, errRes := userInteractiveAuth.Verify(ctx, body, device); errRes == nil || errRes.Code != http.StatusUnauthorized {
+				t.Fatalf("expected HTTP 401 before signing in at the identity provider, got %+v", errRes)
+			}
+			rec := signIn(t, func(w http.ResponseWriter) {
+				req := test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/auth/m.login.sso/fallback/web?session="+sessionID)
+				AuthFallback(w, req, authtypes.LoginTypeSSO, &cfg.ClientAPI, authenticator)
+			}, alice, true)
+			if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "onAuthDone") {
+				t.Fatalf("expected the success page, got HTTP %d: %s", rec.Code, rec.Body.String())
+			}
+			login, errRes := userInteractiveAuth.Verify(ctx, body, device)
+			if errRes != nil {
+				t.Fatalf("expected the stage to be completed, got %+v", errRes)
+			}
+			if login.Username() != aliceID {
+				t.Fatalf("expected the login to be for %s, got %s", aliceID, login.Username())
+			}
+			// The session can only be used once
+			if _, errRes = userInteractiveAuth.Verify(ctx, body, device); errRes == nil {
+				t.Fatalf("expected the session to be used up")
+			}
+
+			// Signing in as alice doesn't complete a session started by someone else
+			_, challenge = userInteractiveAuth.Verify(ctx, []byte(`{}`), &uapi.Device{UserID: "@mallory:" + string(cfg.Global.ServerName)})
+			sessionID = challenge.JSON.(auth.Challenge).Session
+			rec = signIn(t, func(w http.ResponseWriter) {
+				req := test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/auth/m.login.sso/fallback/web?session="+sessionID)
+				AuthFallback(w, req, authtypes.LoginTypeSSO, &cfg.ClientAPI, authenticator)
+			}, alice, true)
+			if rec.Code != http.StatusForbidden {
+				t.Fatalf("expected HTTP 403, got %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+	})
+}
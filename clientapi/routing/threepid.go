@@ -0,0 +1,557 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+const (
+	unbindResultSuccess   = "success"
+	unbindResultNoSupport = "no-support"
+)
+
+// add3PIDSubmitTokenPath is the path of the link we send to validate an email
+// address before adding it to an account.
+const add3PIDSubmitTokenPath = "/_matrix/client/v3/account/3pid/email/submitToken"
+
+// add3PIDTemplate is an HTML template presented to the user after following
+// the link in a validation email
+const add3PIDTemplate = `
+<html>
+<head>
+<title>Validate email address</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+    <div>
+        <p>{{.message}}</p>
+    </div>
+</body>
+</html>
+`
+
+type reqTokenResponse struct {
+	SID string `json:"sid"`
+}
+
+type threePIDsResponse struct {
+	ThreePIDs []authtypes.ThreePID `json:"threepids"`
+}
+
+type add3PIDRequest struct {
+	Secret string `json:"client_secret"`
+	SID    string `json:"sid"`
+}
+
+type bind3PIDRequest struct {
+	Secret   string `json:"client_secret"`
+	SID      string `json:"sid"`
+	IDServer string `json:"id_server"`
+}
+
+type unbind3PIDRequest struct {
+	Address  string `json:"address"`
+	Medium   string `json:"medium"`
+	IDServer string `json:"id_server"`
+}
+
+type unbind3PIDResponse struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// RequestEmailToken implements POST /account/3pid/email/requestToken
+// We send an email with a link to validate the address, after which the validation
+// session can be used with POST /account/3pid/add.
+func RequestEmailToken(
+	req *http.Request, threePIDAPI api.ClientUserAPI, cfg *config.ClientAPI,
+	validationSessions *threepid.ValidationSessions,
+) util.JSONResponse {
+	var body threepid.EmailAssociationRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if body.Email == "" || body.Secret == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("'email' and 'client_secret' must be supplied"),
+		}
+	}
+	if !clientSecretRegex.MatchString(body.Secret) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("'client_secret' contains invalid characters"),
+		}
+	}
+
+	var res api.QueryLocalpartForThreePIDResponse
+	err := threePIDAPI.QueryLocalpartForThreePID(req.Context(), &api.QueryLocalpartForThreePIDRequest{
+		ThreePID: body.Email,
+		Medium:   "email",
+	}, &res)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threePIDAPI.QueryLocalpartForThreePID failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	if len(res.Localpart) > 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MatrixError{
+				ErrCode: spec.ErrorThreePIDInUse,
+				Err:     "This email address is already in use",
+			},
+		}
+	}
+
+	session, resend := validationSessions.Create(body.Secret, "email", body.Email, body.SendAttempt)
+	if !resend {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: reqTokenResponse{SID: session.SID},
+		}
+	}
+
+	err = threePIDAPI.PerformSendEmail(req.Context(), &api.PerformSendEmailRequest{
+		To:       body.Email,
+		Template: api.EmailTemplateRegistrationValidation,
+		Data: map[string]string{
+			"Link": validationLink(cfg, add3PIDSubmitTokenPath, session),
+		},
+	})
+	if err != nil {
+		validationSessions.Delete(session.SID)
+		if errors.Is(err, api.ErrEmailDisabled) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.MatrixError{
+					ErrCode: "M_THREEPID_MEDIUM_NOT_SUPPORTED",
+					Err:     "Adding email addresses isn't supported on this server",
+				},
+			}
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("threePIDAPI.PerformSendEmail failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: reqTokenResponse{SID: session.SID},
+	}
+}
+
+// SubmitEmailToken implements GET /account/3pid/email/submitToken
+// This is the link sent by RequestEmailToken, which is followed in a browser.
+func SubmitEmailToken(
+	w http.ResponseWriter, req *http.Request,
+	validationSessions *threepid.ValidationSessions,
+) {
+	query := req.URL.Query()
+	if !validationSessions.Validate(query.Get("sid"), query.Get("client_secret"), query.Get("token")) {
+		w.WriteHeader(http.StatusBadRequest)
+		serveTemplate(w, add3PIDTemplate, map[string]string{
+			"message": "This link is invalid or has expired. Please request a new one.",
+		})
+		return
+	}
+	serveTemplate(w, add3PIDTemplate, map[string]string{
+		"message": "Your email address has been validated. Please return to your client to finish adding it to your account.",
+	})
+}
+
+// CheckAndSave3PIDAssociation implements POST /account/3pid
+func CheckAndSave3PIDAssociation(
+	req *http.Request, threePIDAPI api.ClientUserAPI, device *api.Device,
+	cfg *config.ClientAPI, client *fclient.Client,
+) util.JSONResponse {
+	var body threepid.EmailAssociationCheckRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+
+	// Check if the association has been validated on the identity server
+	verified, address, medium, err := threepid.CheckAssociation(req.Context(), body.Creds, cfg, client)
+	if resErr := threePIDErrorResponse(req, err, body.Creds.IDServer, "threepid.CheckAssociation failed"); resErr != nil {
+		return *resErr
+	}
+	if !verified {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MatrixError{
+				ErrCode: spec.ErrorThreePIDAuthFailed,
+				Err:     "Failed to auth 3pid",
+			},
+		}
+	}
+	if resErr := save3PIDAssociation(req, threePIDAPI, device, medium, address); resErr != nil {
+		return *resErr
+	}
+
+	if body.Bind {
+		// Publish the association on the identity server if requested
+		err := threepid.PublishAssociation(req.Context(), body.Creds, device.UserID, cfg, client)
+		if resErr := threePIDErrorResponse(req, err, body.Creds.IDServer, "threepid.PublishAssociation failed"); resErr != nil {
+			return *resErr
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// Add3PID implements POST /account/3pid/add
+// The third-party identifier must have been validated through a session created
+// by /account/3pid/email/requestToken.
+func Add3PID(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive, threePIDAPI api.ClientUserAPI,
+	device *api.Device, validationSessions *threepid.ValidationSessions,
+) util.JSONResponse {
+	bodyBytes, resErr := verify3PIDUserInteractiveAuth(req, userInteractiveAuth, device)
+	if resErr != nil {
+		return *resErr
+	}
+
+	var body add3PIDRequest
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	session, ok := validationSessions.Validated(body.SID, body.Secret)
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MatrixError{
+				ErrCode: spec.ErrorThreePIDAuthFailed,
+				Err:     "The validation session is unknown or hasn't been validated",
+			},
+		}
+	}
+
+	if resErr = save3PIDAssociation(req, threePIDAPI, device, session.Medium, session.Address); resErr != nil {
+		return *resErr
+	}
+	validationSessions.Delete(body.SID)
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// Bind3PID implements POST /account/3pid/bind
+// The association is published on the identity server which validated it.
+func Bind3PID(req *http.Request, device *api.Device, cfg *config.ClientAPI, client *fclient.Client) util.JSONResponse {
+	var body bind3PIDRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if body.SID == "" || body.Secret == "" || body.IDServer == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("'sid', 'client_secret' and 'id_server' must be supplied"),
+		}
+	}
+
+	creds := threepid.Credentials{
+		SID:      body.SID,
+		IDServer: body.IDServer,
+		Secret:   body.Secret,
+	}
+	err := threepid.PublishAssociation(req.Context(), creds, device.UserID, cfg, client)
+	if resErr := threePIDErrorResponse(req, err, body.IDServer, "threepid.PublishAssociation failed"); resErr != nil {
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// Unbind3PID implements POST /account/3pid/unbind
+// The association is removed from the identity server, but the third-party
+// identifier stays associated with the account.
+func Unbind3PID(req *http.Request, device *api.Device, cfg *config.ClientAPI, client *fclient.Client) util.JSONResponse {
+	var body unbind3PIDRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if body.Address == "" || body.Medium == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("'address' and 'medium' must be supplied"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: unbind3PIDResponse{
+			IDServerUnbindResult: unbind3PID(req, device, cfg, client, body),
+		},
+	}
+}
+
+// Delete3PID implements POST /account/3pid/delete
+// The third-party identifier is removed from the account, and from the identity
+// server if one is given.
+func Delete3PID(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive, threePIDAPI api.ClientUserAPI,
+	device *api.Device, cfg *config.ClientAPI, client *fclient.Client,
+) util.JSONResponse {
+	bodyBytes, resErr := verify3PIDUserInteractiveAuth(req, userInteractiveAuth, device)
+	if resErr != nil {
+		return *resErr
+	}
+
+	var body unbind3PIDRequest
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	if body.Address == "" || body.Medium == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("'address' and 'medium' must be supplied"),
+		}
+	}
+
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	// Make sure the third-party identifier belongs to the user, so that users
+	// can't remove the identifiers of other users.
+	var res api.QueryLocalpartForThreePIDResponse
+	err = threePIDAPI.QueryLocalpartForThreePID(req.Context(), &api.QueryLocalpartForThreePIDRequest{
+		ThreePID: body.Address,
+		Medium:   body.Medium,
+	}, &res)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threePIDAPI.QueryLocalpartForThreePID failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if res.Localpart != localpart || res.ServerName != serverName {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("The third-party identifier is not associated with this account"),
+		}
+	}
+
+	if err = threePIDAPI.PerformForgetThreePID(req.Context(), &api.PerformForgetThreePIDRequest{
+		ThreePID: body.Address,
+		Medium:   body.Medium,
+	}, &struct{}{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threePIDAPI.PerformForgetThreePID failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: unbind3PIDResponse{
+			IDServerUnbindResult: unbind3PID(req, device, cfg, client, body),
+		},
+	}
+}
+
+// GetAssociated3PIDs implements GET /account/3pid
+func GetAssociated3PIDs(
+	req *http.Request, threepidAPI api.ClientUserAPI, device *api.Device,
+) util.JSONResponse {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	res := &api.QueryThreePIDsForLocalpartResponse{}
+	err = threepidAPI.QueryThreePIDsForLocalpart(req.Context(), &api.QueryThreePIDsForLocalpartRequest{
+		Localpart:  localpart,
+		ServerName: domain,
+	}, res)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threepidAPI.QueryThreePIDsForLocalpart failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if res.ThreePIDs == nil {
+		res.ThreePIDs = []authtypes.ThreePID{}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: threePIDsResponse{ThreePIDs: res.ThreePIDs},
+	}
+}
+
+// verify3PIDUserInteractiveAuth makes the user authenticate again before changing the
+// third-party identifiers of their account. Returns the request body on success.
+func verify3PIDUserInteractiveAuth(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive, device *api.Device,
+) ([]byte, *util.JSONResponse) {
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+
+	login, errRes := userInteractiveAuth.Verify(req.Context(), bodyBytes, device)
+	if errRes != nil {
+		return nil, errRes
+	}
+
+	// make sure that the access token being used matches the login creds used for user interactive auth
+	if login.Username() != device.UserID {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("unable to change third-party identifiers for other user"),
+		}
+	}
+	return bodyBytes, nil
+}
+
+// save3PIDAssociation associates a validated third-party identifier with the account,
+// unless it is already associated with an account.
+func save3PIDAssociation(
+	req *http.Request, threePIDAPI api.ClientUserAPI, device *api.Device, medium, address string,
+) *util.JSONResponse {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	var res api.QueryLocalpartForThreePIDResponse
+	err = threePIDAPI.QueryLocalpartForThreePID(req.Context(), &api.QueryLocalpartForThreePIDRequest{
+		ThreePID: address,
+		Medium:   medium,
+	}, &res)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threePIDAPI.QueryLocalpartForThreePID failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if len(res.Localpart) > 0 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MatrixError{
+				ErrCode: spec.ErrorThreePIDInUse,
+				Err:     "This third-party identifier is already in use",
+			},
+		}
+	}
+
+	if err = threePIDAPI.PerformSaveThreePIDAssociation(req.Context(), &api.PerformSaveThreePIDAssociationRequest{
+		ThreePID:   address,
+		Localpart:  localpart,
+		ServerName: domain,
+		Medium:     medium,
+	}, &struct{}{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threePIDAPI.PerformSaveThreePIDAssociation failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return nil
+}
+
+// unbind3PID removes the association from the identity server given in the request.
+// Returns the id_server_unbind_result for the response: we don't know which identity
+// server an identifier was bound to, so it is "no-support" if the client doesn't tell us.
+func unbind3PID(
+	req *http.Request, device *api.Device, cfg *config.ClientAPI, client *fclient.Client, body unbind3PIDRequest,
+) string {
+	if body.IDServer == "" {
+		return unbindResultNoSupport
+	}
+	if err := threepid.UnbindAssociation(
+		req.Context(), body.IDServer, body.Medium, body.Address, device.UserID, cfg, client,
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("id_server", body.IDServer).Warn("Failed to unbind third-party identifier")
+		return unbindResultNoSupport
+	}
+	return unbindResultSuccess
+}
+
+// threePIDErrorResponse returns the response for an error returned by the threepid
+// package, or nil if there was no error.
+func threePIDErrorResponse(req *http.Request, err error, idServer, msg string) *util.JSONResponse {
+	if err == nil {
+		return nil
+	}
+	util.GetLogger(req.Context()).WithError(err).Error(msg)
+	if errors.Is(err, threepid.ErrNotTrusted{}) {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.NotTrusted(idServer),
+		}
+	}
+	return &util.JSONResponse{
+		Code: http.StatusInternalServerError,
+		JSON: spec.InternalServerError{},
+	}
+}
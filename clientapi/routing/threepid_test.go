@@ -0,0 +1,230 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+func TestThreePIDs(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	const email = "alice@example.com"
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		// A fake identity server, which the email address is unbound from.
+		idServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/_matrix/identity/api/v1/3pid/unbind":
+				_, _ = w.Write([]byte(`{}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer idServer.Close()
+		client := fclient.NewClient(fclient.WithTransport(idServer.Client().Transport))
+
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		cfg.Global.TrustedIDServers = []string{idServer.Listener.Addr().String()}
+		natsInstance := jetstream.NATSInstance{}
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		internalAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		userAPI := &emailCapturingUserAPI{ClientUserAPI: internalAPI}
+		validationSessions := threepid.NewValidationSessions()
+		userInteractiveAuth := auth.NewUserInteractive(userAPI, &cfg.ClientAPI, nil)
+
+		password := util.RandomString(8)
+		for _, u := range []*test.User{alice, bob} {
+			localpart, serverName, _ := gomatrixserverlib.SplitID('@', u.ID)
+			if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+				AccountType: uapi.AccountTypeUser,
+				Localpart:   localpart,
+				ServerName:  serverName,
+				Password:    password,
+			}, &uapi.PerformAccountCreationResponse{}); err != nil {
+				t.Fatalf("failed to create account: %s", err)
+			}
+		}
+		aliceDevice := &uapi.Device{UserID: alice.ID}
+		bobDevice := &uapi.Device{UserID: bob.ID}
+		passwordAuth := func(u *test.User) map[string]interface{} {
+			return map[string]interface{}{
+				"type":       authtypes.LoginTypePassword,
+				"identifier": map[string]interface{}{"type": "m.id.user", "user": u.ID},
+				"password":   password,
+			}
+		}
+		threePIDs := func(device *uapi.Device) []authtypes.ThreePID {
+			res := GetAssociated3PIDs(test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/account/3pid"), userAPI, device)
+			if res.Code != http.StatusOK {
+				t.Fatalf("failed to get 3pids: %+v", res.JSON)
+			}
+			return res.JSON.(threePIDsResponse).ThreePIDs
+		}
+
+		requestToken := func(sendAttempt int) util.JSONResponse {
+			return RequestEmailToken(test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/account/3pid/email/requestToken", test.WithJSONBody(t, map[string]interface{}{
+				"client_secret": "secret",
+				"email":         email,
+				"send_attempt":  sendAttempt,
+			})), userAPI, &cfg.ClientAPI, validationSessions)
+		}
+		add := func(body map[string]interface{}) util.JSONResponse {
+			return Add3PID(test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/account/3pid/add", test.WithJSONBody(t, body)),
+				userInteractiveAuth, userAPI, aliceDevice, validationSessions)
+		}
+
+		res := requestToken(1)
+		if res.Code != http.StatusOK {
+			t.Fatalf("failed to request token: %+v", res.JSON)
+		}
+		sid := res.JSON.(reqTokenResponse).SID
+		if len(userAPI.emails) != 1 || userAPI.emails[0].To != email || userAPI.emails[0].Template != uapi.EmailTemplateRegistrationValidation {
+			t.Fatalf("expected a validation email to be sent, got %+v", userAPI.emails)
+		}
+		link, err := url.Parse(userAPI.emails[0].Data["Link"])
+		if err != nil || link.Path != add3PIDSubmitTokenPath || link.Query().Get("sid") != sid {
+			t.Fatalf("unexpected validation link: %s", userAPI.emails[0].Data["Link"])
+		}
+
+		t.Run("retrying doesn't send another email", func(t *testing.T) {
+			if res := requestToken(1); res.Code != http.StatusOK || res.JSON.(reqTokenResponse).SID != sid {
+				t.Fatalf("expected the same session, got %d: %+v", res.Code, res.JSON)
+			}
+			if len(userAPI.emails) != 1 {
+				t.Fatalf("expected no email to be sent, got %d", len(userAPI.emails))
+			}
+		})
+
+		t.Run("adding requires user interactive auth", func(t *testing.T) {
+			res := add(map[string]interface{}{
+				"client_secret": "secret",
+				"sid":           sid,
+			})
+			if res.Code != http.StatusUnauthorized {
+				t.Fatalf("expected HTTP 401, got %d: %+v", res.Code, res.JSON)
+			}
+		})
+
+		t.Run("sessions must be validated first", func(t *testing.T) {
+			res := add(map[string]interface{}{
+				"auth":          passwordAuth(alice),
+				"client_secret": "secret",
+				"sid":           sid,
+			})
+			if res.Code != http.StatusBadRequest {
+				t.Fatalf("expected HTTP 400, got %d: %+v", res.Code, res.JSON)
+			}
+		})
+
+		t.Run("wrong tokens don't validate the session", func(t *testing.T) {
+			query := link.Query()
+			query.Set("token", "wrong")
+			rec := httptest.NewRecorder()
+			SubmitEmailToken(rec, test.NewRequest(t, http.MethodGet, link.Path+"?"+query.Encode()), validationSessions)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected HTTP 400, got %d", rec.Code)
+			}
+		})
+
+		rec := httptest.NewRecorder()
+		SubmitEmailToken(rec, test.NewRequest(t, http.MethodGet, link.RequestURI()), validationSessions)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("failed to validate the session, got HTTP %d: %s", rec.Code, rec.Body.String())
+		}
+
+		t.Run("unknown sessions can't be added", func(t *testing.T) {
+			res := add(map[string]interface{}{
+				"auth":          passwordAuth(alice),
+				"client_secret": "wrong",
+				"sid":           sid,
+			})
+			if res.Code != http.StatusBadRequest {
+				t.Fatalf("expected HTTP 400, got %d: %+v", res.Code, res.JSON)
+			}
+		})
+
+		res = add(map[string]interface{}{
+			"auth":          passwordAuth(alice),
+			"client_secret": "secret",
+			"sid":           sid,
+		})
+		if res.Code != http.StatusOK {
+			t.Fatalf("failed to add 3pid: %+v", res.JSON)
+		}
+		if got := threePIDs(aliceDevice); len(got) != 1 || got[0].Address != email || got[0].Medium != "email" {
+			t.Fatalf("unexpected 3pids: %+v", got)
+		}
+
+		t.Run("email addresses in use can't be requested again", func(t *testing.T) {
+			res := requestToken(2)
+			if res.Code != http.StatusBadRequest || res.JSON.(spec.MatrixError).ErrCode != spec.ErrorThreePIDInUse {
+				t.Fatalf("expected M_THREEPID_IN_USE, got %d: %+v", res.Code, res.JSON)
+			}
+		})
+
+		deleteBody := func(u *test.User) map[string]interface{} {
+			return map[string]interface{}{
+				"auth":      passwordAuth(u),
+				"address":   email,
+				"medium":    "email",
+				"id_server": idServer.Listener.Addr().String(),
+			}
+		}
+
+		t.Run("other users can't delete the email address", func(t *testing.T) {
+			res := Delete3PID(test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/account/3pid/delete", test.WithJSONBody(t, deleteBody(bob))),
+				userInteractiveAuth, userAPI, bobDevice, &cfg.ClientAPI, client)
+			if res.Code != http.StatusNotFound {
+				t.Fatalf("expected HTTP 404, got %d: %+v", res.Code, res.JSON)
+			}
+		})
+
+		t.Run("the access token must match the user interactive auth", func(t *testing.T) {
+			res := Delete3PID(test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/account/3pid/delete", test.WithJSONBody(t, deleteBody(bob))),
+				userInteractiveAuth, userAPI, aliceDevice, &cfg.ClientAPI, client)
+			if res.Code != http.StatusForbidden {
+				t.Fatalf("expected HTTP 403, got %d: %+v", res.Code, res.JSON)
+			}
+		})
+
+		res = Delete3PID(test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/account/3pid/delete", test.WithJSONBody(t, deleteBody(alice))),
+			userInteractiveAuth, userAPI, aliceDevice, &cfg.ClientAPI, client)
+		if res.Code != http.StatusOK {
+			t.Fatalf("failed to delete 3pid: %+v", res.JSON)
+		}
+		body, _ := json.Marshal(res.JSON)
+		if string(body) != `{"id_server_unbind_result":"success"}` {
+			t.Fatalf("unexpected response: %s", body)
+		}
+		if got := threePIDs(aliceDevice); len(got) != 0 {
+			t.Fatalf("expected no 3pids, got %+v", got)
+		}
+	})
+}
@@ -0,0 +1,186 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/nats-io/nats.go"
+
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// TimestampToEvent implements GET /_matrix/client/v1/rooms/{roomID}/timestamp_to_event
+// https://spec.matrix.org/v1.10/client-server-api/#get_matrixclientv1roomsroomidtimestamp_to_event
+func TimestampToEvent(
+	req *http.Request,
+	device *userapi.Device,
+	roomID string,
+	rsAPI roomserverAPI.ClientRoomserverAPI,
+	fsAPI federationAPI.ClientFederationAPI,
+	natsClient *nats.Conn,
+	topic string,
+) util.JSONResponse {
+	if _, err := spec.NewRoomID(roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("invalid room ID"),
+		}
+	}
+
+	ts, err := strconv.ParseUint(req.URL.Query().Get("ts"), 10, 64)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("ts must be a timestamp in milliseconds"),
+		}
+	}
+	dir := req.URL.Query().Get("dir")
+	if dir != "f" && dir != "b" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("dir must be either 'f' or 'b'"),
+		}
+	}
+
+	deviceUserID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("device.UserID invalid")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	queryReq := roomserverAPI.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: *deviceUserID,
+	}
+	var queryRes roomserverAPI.QueryMembershipForUserResponse
+	if err = rsAPI.QueryMembershipForUser(req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if !queryRes.IsInRoom && !queryRes.HasBeenInRoom {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("You aren't a member of this room."),
+		}
+	}
+
+	// The sync API only returns events which the user is allowed to see.
+	local, gap, err := localEventAtTimestamp(natsClient, topic, device.UserID, roomID, ts, dir)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("unable to query event at timestamp")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	// If we might be missing events around the timestamp, ask the other servers in
+	// the room instead. The first server to answer wins, but we only use its answer
+	// if it is closer to the timestamp than the event we already know about.
+	result := local
+	if gap {
+		joinedReq := federationAPI.QueryJoinedHostServerNamesInRoomRequest{
+			RoomID:             roomID,
+			ExcludeSelf:        true,
+			ExcludeBlacklisted: true,
+		}
+		var joinedRes federationAPI.QueryJoinedHostServerNamesInRoomResponse
+		if err = fsAPI.QueryJoinedHostServerNamesInRoom(req.Context(), &joinedReq, &joinedRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("fsAPI.QueryJoinedHostServerNamesInRoom failed")
+		}
+		for _, serverName := range joinedRes.ServerNames {
+			remote, err := fsAPI.TimestampToEvent(req.Context(), device.UserDomain(), serverName, roomID, spec.Timestamp(ts), dir)
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Warnf("failed to query %s for event at timestamp", serverName)
+				continue
+			}
+			if closerToTimestamp(remote, result, ts, dir) {
+				result = &remote
+			}
+			break
+		}
+	}
+
+	if result == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("Unable to find event from %d in direction %s", ts, dir)),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: result,
+	}
+}
+
+// localEventAtTimestamp asks the sync API for the closest event it knows about. Returns
+// a nil response if there is no such event, or if the user isn't allowed to see it. gap
+// is true if there may be closer events which this server doesn't have.
+func localEventAtTimestamp(
+	natsClient *nats.Conn, topic, userID, roomID string, ts uint64, dir string,
+) (res *federationAPI.TimestampToEventResponse, gap bool, err error) {
+	msg := nats.NewMsg(topic)
+	msg.Header.Set(jetstream.UserID, userID)
+	msg.Header.Set(jetstream.RoomID, roomID)
+	msg.Header.Set("ts", strconv.FormatUint(ts, 10))
+	msg.Header.Set("dir", dir)
+	reply, err := natsClient.RequestMsg(msg, time.Second*10)
+	if err != nil {
+		return nil, false, err
+	}
+	if e := reply.Header.Get("error"); e != "" {
+		return nil, false, fmt.Errorf("received error msg from nats: %s", e)
+	}
+	gap = reply.Header.Get("gap") == "true"
+	eventID := reply.Header.Get(jetstream.EventID)
+	if eventID == "" {
+		return nil, gap, nil
+	}
+	originServerTS, err := strconv.ParseUint(reply.Header.Get("origin_server_ts"), 10, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	return &federationAPI.TimestampToEventResponse{
+		EventID:        eventID,
+		OriginServerTS: spec.Timestamp(originServerTS),
+	}, gap, nil
+}
+
+// closerToTimestamp returns true if the remote event is in the requested direction
+// from the timestamp and closer to it than the current event, if any.
+func closerToTimestamp(remote federationAPI.TimestampToEventResponse, current *federationAPI.TimestampToEventResponse, ts uint64, dir string) bool {
+	if remote.EventID == "" {
+		return false
+	}
+	remoteTS := uint64(remote.OriginServerTS)
+	if dir == "b" {
+		return remoteTS <= ts && (current == nil || remote.OriginServerTS > current.OriginServerTS)
+	}
+	return remoteTS >= ts && (current == nil || remote.OriginServerTS < current.OriginServerTS)
+}
@@ -15,6 +15,7 @@
 package threepid
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -178,6 +179,56 @@ func PublishAssociation(ctx context.Context, creds Credentials, userID string, c
 	return nil
 }
 
+// UnbindAssociation asks an identity server to remove the association between
+// a third-party identifier and a Matrix ID.
+// Returns an error if there was a problem sending the request, or if the identity
+// server responded with a non-OK status.
+func UnbindAssociation(
+	ctx context.Context, idServer, medium, address, userID string, cfg *config.ClientAPI, client *fclient.Client,
+) error {
+	if err := isTrusted(idServer, cfg); err != nil {
+		return err
+	}
+
+	postURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/3pid/unbind", idServer)
+
+	data, err := json.Marshal(unbindRequest{
+		MXID:     userID,
+		ThreePID: unbindThreePID{Medium: medium, Address: address},
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, postURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.DoHTTPRequest(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	// Error if the status isn't OK
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not remove the association on the server %s", idServer)
+	}
+
+	return nil
+}
+
+type unbindRequest struct {
+	MXID     string         `json:"mxid"`
+	ThreePID unbindThreePID `json:"threepid"`
+}
+
+type unbindThreePID struct {
+	Medium  string `json:"medium"`
+	Address string `json:"address"`
+}
+
 // isTrusted checks if a given identity server is part of the list of trusted
 // identity servers in the configuration file.
 // Returns an error if the server isn't trusted.
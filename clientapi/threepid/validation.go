@@ -0,0 +1,146 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"crypto/subtle"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+const (
+	// ValidationSessionTimeout is how long the token sent to a third-party identifier
+	// can be used for, and how long a validated session can be used afterwards.
+	ValidationSessionTimeout = time.Hour
+	validationSIDLength      = 24
+	validationTokenLength    = 32
+)
+
+// ValidationSession is a session for validating that the user owns a third-party
+// identifier, by sending a token to it which the user submits back to us.
+type ValidationSession struct {
+	SID          string
+	ClientSecret string
+	Token        string
+	Medium       string
+	Address      string
+	SendAttempt  int
+	Validated    bool
+}
+
+// ValidationSessions keeps track of the validation sessions this server created,
+// as opposed to the ones created on identity servers. Sessions are kept in memory
+// and expire after ValidationSessionTimeout.
+// It shouldn't be passed by value because it contains a mutex.
+type ValidationSessions struct {
+	sync.Mutex
+	sessions map[string]*ValidationSession
+	timer    map[string]*time.Timer
+}
+
+func NewValidationSessions() *ValidationSessions {
+	return &ValidationSessions{
+		sessions: make(map[string]*ValidationSession),
+		timer:    make(map[string]*time.Timer),
+	}
+}
+
+// Create returns a new validation session for the given third-party identifier.
+// If the client retries the request with the same client secret and send attempt,
+// the existing session is returned and resend is false, as the spec requires that
+// a token is only sent again if the send attempt is incremented.
+func (s *ValidationSessions) Create(clientSecret, medium, address string, sendAttempt int) (session ValidationSession, resend bool) {
+	s.Lock()
+	defer s.Unlock()
+	for _, existing := range s.sessions {
+		if existing.ClientSecret != clientSecret || existing.Medium != medium || existing.Address != address {
+			continue
+		}
+		if sendAttempt <= existing.SendAttempt {
+			return *existing, false
+		}
+		existing.SendAttempt = sendAttempt
+		return *existing, true
+	}
+
+	session = ValidationSession{
+		SID:          util.RandomString(validationSIDLength),
+		ClientSecret: clientSecret,
+		Token:        util.RandomString(validationTokenLength),
+		Medium:       medium,
+		Address:      address,
+		SendAttempt:  sendAttempt,
+	}
+	s.sessions[session.SID] = &session
+	s.startTimer(session.SID)
+	return session, true
+}
+
+// Validate marks the session as validated if the token matches the one we sent.
+// Returns false if the session doesn't exist, has expired or the token is wrong.
+func (s *ValidationSessions) Validate(sid, clientSecret, token string) bool {
+	s.Lock()
+	defer s.Unlock()
+	session, ok := s.sessions[sid]
+	if !ok || session.ClientSecret != clientSecret {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(session.Token), []byte(token)) != 1 {
+		return false
+	}
+	if !session.Validated {
+		session.Validated = true
+		// Give the user time to finish whatever they validated the session for.
+		s.startTimer(sid)
+	}
+	return true
+}
+
+// Validated returns the session if it exists and has been validated.
+func (s *ValidationSessions) Validated(sid, clientSecret string) (ValidationSession, bool) {
+	s.Lock()
+	defer s.Unlock()
+	session, ok := s.sessions[sid]
+	if !ok || session.ClientSecret != clientSecret || !session.Validated {
+		return ValidationSession{}, false
+	}
+	return *session, true
+}
+
+// Delete removes a session, e.g. once it has been used.
+func (s *ValidationSessions) Delete(sid string) {
+	s.Lock()
+	defer s.Unlock()
+	s.delete(sid)
+}
+
+func (s *ValidationSessions) delete(sid string) {
+	delete(s.sessions, sid)
+	if t, ok := s.timer[sid]; ok {
+		t.Stop()
+		delete(s.timer, sid)
+	}
+}
+
+func (s *ValidationSessions) startTimer(sid string) {
+	if t, ok := s.timer[sid]; ok {
+		t.Stop()
+	}
+	s.timer[sid] = time.AfterFunc(ValidationSessionTimeout, func() {
+		s.Delete(sid)
+	})
+}
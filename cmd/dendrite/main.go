@@ -29,7 +29,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
+	"github.com/matrix-org/dendrite/appservice"
 	"github.com/matrix-org/dendrite/federationapi"
+	"github.com/matrix-org/dendrite/relayapi"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/setup"
 	basepkg "github.com/matrix-org/dendrite/setup/base"
@@ -163,6 +165,14 @@ func main() {
 	userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, federationClient, caching.EnableMetrics, fsAPI.IsBlacklistedOrBackingOff)
 	rsAPI.SetUserAPI(userAPI)
 
+	asAPI := appservice.NewInternalAPI(processCtx, cfg, &natsInstance, userAPI, rsAPI)
+	rsAPI.SetAppserviceAPI(asAPI)
+	userAPI.SetAppserviceAPI(asAPI)
+
+	relayAPI := relayapi.NewRelayInternalAPI(
+		processCtx, cfg, cm, &natsInstance, federationClient, rsAPI, userAPI, keyRing, caches,
+	)
+
 	monolith := setup.Monolith{
 		Config:    cfg,
 		Client:    httpClient,
@@ -174,6 +184,7 @@ func main() {
 		FederationAPI: fsAPI,
 		RoomserverAPI: rsAPI,
 		UserAPI:       userAPI,
+		RelayAPI:      relayAPI,
 	}
 	monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics)
 
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// This is a utility for copying media files and thumbnails between the media
+// storage backends, e.g. when moving from the local filesystem to an S3-compatible
+// object store. Both backends are configured in the media_api.storage section of
+// the config file. Objects which already exist in the destination with the same
+// size are skipped, so it is safe to run again if it was interrupted.
+//
+// Usage: ./migrate-media --config=dendrite.yaml --from=local --to=s3
+
+var fromBackend = flag.String("from", config.MediaStorageLocal, "the media storage backend to copy from (local or s3)")
+var toBackend = flag.String("to", config.MediaStorageS3, "the media storage backend to copy to (local or s3)")
+var verbose = flag.Bool("verbose", false, "whether to print every object as it is copied")
+
+func main() {
+	ctx := context.Background()
+	cfg := setup.ParseFlags(true)
+
+	if *fromBackend == *toBackend {
+		fmt.Println("The source and destination backends must be different")
+		os.Exit(1)
+	}
+
+	from, err := mediastore.NewMediaStore(&cfg.MediaAPI, *fromBackend)
+	if err != nil {
+		fmt.Println("Failed to set up source media storage:", err)
+		os.Exit(1)
+	}
+	to, err := mediastore.NewMediaStore(&cfg.MediaAPI, *toBackend)
+	if err != nil {
+		fmt.Println("Failed to set up destination media storage:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Copying media from %q to %q\n", *fromBackend, *toBackend)
+	seen := 0
+	copied, err := mediastore.Copy(ctx, from, to, func(key string, copied bool) {
+		seen++
+		if *verbose {
+			if copied {
+				fmt.Println("Copied", key)
+			} else {
+				fmt.Println("Skipped", key)
+			}
+		} else if seen%1000 == 0 {
+			fmt.Println("Processed", seen, "objects")
+		}
+	})
+	if err != nil {
+		fmt.Println("Failed to copy media:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Copied %d objects, skipped %d which already existed\n", copied, seen-copied)
+}
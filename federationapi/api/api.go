@@ -22,6 +22,7 @@ type FederationInternalAPI interface {
 	gomatrixserverlib.KeyDatabase
 	ClientFederationAPI
 	RoomserverFederationAPI
+	P2PFederationAPI
 
 	QueryServerKeys(ctx context.Context, request *QueryServerKeysRequest, response *QueryServerKeysResponse) error
 	LookupServerKeys(ctx context.Context, s spec.ServerName, keyRequests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp) ([]gomatrixserverlib.ServerKeys, error)
@@ -40,12 +41,39 @@ type FederationInternalAPI interface {
 	) error
 }
 
+// P2PFederationAPI manages the relay servers which store and forward
+// transactions for destinations that are assumed to be offline.
+type P2PFederationAPI interface {
+	// Get the relay servers associated for the given server.
+	P2PQueryRelayServers(
+		ctx context.Context,
+		request *P2PQueryRelayServersRequest,
+		response *P2PQueryRelayServersResponse,
+	) error
+
+	// Add relay server associations to the given server.
+	P2PAddRelayServers(
+		ctx context.Context,
+		request *P2PAddRelayServersRequest,
+		response *P2PAddRelayServersResponse,
+	) error
+
+	// Remove relay server associations from the given server.
+	P2PRemoveRelayServers(
+		ctx context.Context,
+		request *P2PRemoveRelayServersRequest,
+		response *P2PRemoveRelayServersResponse,
+	) error
+}
+
 type ClientFederationAPI interface {
 	// Query the server names of the joined hosts in a room.
 	// Unlike QueryJoinedHostsInRoom, this function returns a de-duplicated slice
 	// containing only the server names (without information for membership events).
 	// The response will include this server if they are joined to the room.
 	QueryJoinedHostServerNamesInRoom(ctx context.Context, request *QueryJoinedHostServerNamesInRoomRequest, response *QueryJoinedHostServerNamesInRoomResponse) error
+	// Ask a remote server for the event closest to the given timestamp in a room, in the direction "f" or "b".
+	TimestampToEvent(ctx context.Context, origin, s spec.ServerName, roomID string, ts spec.Timestamp, dir string) (res TimestampToEventResponse, err error)
 }
 
 type RoomserverFederationAPI interface {
@@ -59,6 +87,8 @@ type RoomserverFederationAPI interface {
 	PerformJoin(ctx context.Context, request *PerformJoinRequest, response *PerformJoinResponse)
 	// Handle an instruction to make_leave & send_leave with a remote server.
 	PerformLeave(ctx context.Context, request *PerformLeaveRequest, response *PerformLeaveResponse) error
+	// Handle an instruction to make_knock & send_knock with a remote server.
+	PerformKnock(ctx context.Context, request *PerformKnockRequest, response *PerformKnockResponse) error
 	// Handle sending an invite to a remote server.
 	SendInvite(ctx context.Context, event gomatrixserverlib.PDU, strippedState []gomatrixserverlib.InviteStrippedState) (gomatrixserverlib.PDU, error)
 	// Handle sending an invite to a remote server.
@@ -154,6 +184,23 @@ type PerformLeaveRequest struct {
 }
 
 type PerformLeaveResponse struct {
+	// The leave event that was sent to the remote server.
+	Event *rstypes.HeaderedEvent `json:"event"`
+}
+
+type PerformKnockRequest struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	// The sorted list of servers to try. Servers will be tried sequentially, after de-duplication.
+	ServerNames types.ServerNames      `json:"server_names"`
+	Content     map[string]interface{} `json:"content"`
+}
+
+type PerformKnockResponse struct {
+	// The knock event, with the stripped state returned by the remote
+	// server in the "knock_room_state" unsigned key.
+	Event      *rstypes.HeaderedEvent `json:"event"`
+	KnockedVia spec.ServerName        `json:"knocked_via"`
 }
 
 type PerformInviteRequest struct {
@@ -178,6 +225,13 @@ type QueryJoinedHostServerNamesInRoomResponse struct {
 	ServerNames []spec.ServerName `json:"server_names"`
 }
 
+// TimestampToEventResponse is the response to a /timestamp_to_event request,
+// used by both the client and federation APIs.
+type TimestampToEventResponse struct {
+	EventID        string         `json:"event_id"`
+	OriginServerTS spec.Timestamp `json:"origin_server_ts"`
+}
+
 type PerformBroadcastEDURequest struct {
 }
 
@@ -191,6 +245,30 @@ type PerformWakeupServersRequest struct {
 type PerformWakeupServersResponse struct {
 }
 
+type P2PQueryRelayServersRequest struct {
+	Server spec.ServerName
+}
+
+type P2PQueryRelayServersResponse struct {
+	RelayServers []spec.ServerName
+}
+
+type P2PAddRelayServersRequest struct {
+	Server       spec.ServerName
+	RelayServers []spec.ServerName
+}
+
+type P2PAddRelayServersResponse struct {
+}
+
+type P2PRemoveRelayServersRequest struct {
+	Server       spec.ServerName
+	RelayServers []spec.ServerName
+}
+
+type P2PRemoveRelayServersResponse struct {
+}
+
 type InputPublicKeysRequest struct {
 	Keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult `json:"keys"`
 }
@@ -55,7 +55,7 @@ func AddPublicRoutes(
 	enableMetrics bool,
 ) {
 	cfg := &dendriteConfig.FederationAPI
-	js, _ := natsInstance.Prepare(processContext, &cfg.Matrix.JetStream)
+	js, natsClient := natsInstance.Prepare(processContext, &cfg.Matrix.JetStream)
 	producer := &producers.SyncAPIProducer{
 		JetStream:              js,
 		TopicReceiptEvent:      cfg.Matrix.JetStream.Prefixed(jetstream.OutputReceiptEvent),
@@ -79,12 +79,20 @@ func AddPublicRoutes(
 			"FederationInternalAPI. This is a programming error.")
 	}
 
+	rateLimitStore, err := httputil.NewRateLimitStore(
+		cfg.RateLimiting.Enabled, cfg.RateLimiting.Backend, js, cfg.Matrix.JetStream.Prefixed(jetstream.RateLimits),
+	)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to set up rate limiting")
+	}
+	rateLimits := httputil.NewOriginRateLimits(&cfg.RateLimiting, rateLimitStore)
+
 	routing.Setup(
 		routers,
 		dendriteConfig,
 		rsAPI, f, keyRing,
 		federation, userAPI,
-		producer, enableMetrics,
+		producer, rateLimits, natsClient, enableMetrics,
 	)
 }
 
@@ -110,9 +118,20 @@ func NewInternalAPI(
 
 	if resetBlacklist {
 		_ = federationDB.RemoveAllServersFromBlacklist()
+		_ = federationDB.RemoveAllServersAssumedOffline(processContext.Context())
 	}
 
-	stats := statistics.NewStatistics(federationDB, cfg.FederationMaxRetries+1)
+	stats := statistics.NewStatistics(
+		federationDB,
+		cfg.FederationMaxRetries+1,
+		cfg.P2PFederationRetriesUntilAssumedOffline+1,
+		cfg.EnableRelays,
+	)
+	if cfg.EnableRelays {
+		for _, destination := range cfg.DestinationRelays {
+			stats.ForServer(destination.ServerName).SetRelayServers(destination.RelayServers)
+		}
+	}
 
 	js, nats := natsInstance.Prepare(processContext, &cfg.Matrix.JetStream)
 
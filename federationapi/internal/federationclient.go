@@ -2,11 +2,15 @@ package internal
 
 import (
 	"context"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/federationapi/api"
 )
 
 const defaultTimeout = time.Second * 30
@@ -207,3 +211,38 @@ func (a *FederationInternalAPI) RoomHierarchies(
 	}
 	return ires.(fclient.RoomHierarchyResponse), nil
 }
+
+// TimestampToEvent asks a remote server for the event closest to the given timestamp
+// in the room. gomatrixserverlib doesn't implement this request, so it is built and
+// signed here instead.
+func (a *FederationInternalAPI) TimestampToEvent(
+	ctx context.Context, origin, s spec.ServerName, roomID string, ts spec.Timestamp, dir string,
+) (res api.TimestampToEventResponse, err error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	identity, err := a.cfg.Matrix.SigningIdentityFor(origin)
+	if err != nil {
+		return res, err
+	}
+	query := url.Values{}
+	query.Set("ts", strconv.FormatUint(uint64(ts), 10))
+	query.Set("dir", dir)
+	path := "/_matrix/federation/v1/timestamp_to_event/" + url.PathEscape(roomID) + "?" + query.Encode()
+	ires, err := a.doRequestIfNotBlacklisted(s, func() (interface{}, error) {
+		req := fclient.NewFederationRequest("GET", origin, s, path)
+		if err := req.Sign(identity.ServerName, identity.KeyID, identity.PrivateKey); err != nil {
+			return nil, err
+		}
+		httpReq, err := req.HTTPRequest()
+		if err != nil {
+			return nil, err
+		}
+		var ires api.TimestampToEventResponse
+		err = a.federation.DoRequestAndParseResponse(ctx, httpReq, &ires)
+		return ires, err
+	})
+	if err != nil {
+		return res, err
+	}
+	return ires.(api.TimestampToEventResponse), nil
+}
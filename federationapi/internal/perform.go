@@ -331,6 +331,7 @@ func (r *FederationInternalAPI) PerformLeave(
 		}
 
 		r.statistics.ForServer(serverName).Success(statistics.SendDirect)
+		response.Event = &types.HeaderedEvent{PDU: event}
 		return nil
 	}
 
@@ -341,6 +342,167 @@ func (r *FederationInternalAPI) PerformLeave(
 	)
 }
 
+// knockRoomVersions are the room versions that support knocking, which we
+// advertise to the remote server when performing a make_knock.
+var knockRoomVersions = []gomatrixserverlib.RoomVersion{
+	gomatrixserverlib.RoomVersionV7,
+	gomatrixserverlib.RoomVersionV8,
+	gomatrixserverlib.RoomVersionV9,
+	gomatrixserverlib.RoomVersionV10,
+	gomatrixserverlib.RoomVersionV11,
+}
+
+// PerformKnock implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformKnock(
+	ctx context.Context,
+	request *api.PerformKnockRequest,
+	response *api.PerformKnockResponse,
+) error {
+	userID, err := spec.NewUserID(request.UserID, true)
+	if err != nil {
+		return err
+	}
+	if _, err = spec.NewRoomID(request.RoomID); err != nil {
+		return err
+	}
+
+	// Deduplicate the server names we were provided.
+	util.SortAndUnique(request.ServerNames)
+
+	// Try each server that we were provided until we land on one that
+	// successfully completes the make-knock send-knock dance.
+	var lastErr error
+	for _, serverName := range request.ServerNames {
+		if r.cfg.Matrix.IsLocalServerName(serverName) {
+			continue
+		}
+		event, knockErr := r.performKnockUsingServer(ctx, request, *userID, serverName)
+		if knockErr != nil {
+			logrus.WithError(knockErr).WithFields(logrus.Fields{
+				"server_name": serverName,
+				"room_id":     request.RoomID,
+			}).Warn("Failed to knock on room")
+			lastErr = knockErr
+			continue
+		}
+		response.Event = event
+		response.KnockedVia = serverName
+		return nil
+	}
+
+	// If we reach here then we didn't complete a knock for some reason.
+	if lastErr != nil {
+		return fmt.Errorf(
+			"failed to knock on room %q through %d server(s): %w",
+			request.RoomID, len(request.ServerNames), lastErr,
+		)
+	}
+	return fmt.Errorf(
+		"failed to knock on room %q through %d server(s)",
+		request.RoomID, len(request.ServerNames),
+	)
+}
+
+func (r *FederationInternalAPI) performKnockUsingServer(
+	ctx context.Context,
+	request *api.PerformKnockRequest,
+	userID spec.UserID,
+	serverName spec.ServerName,
+) (*types.HeaderedEvent, error) {
+	// Try to perform a make_knock using the information supplied in the
+	// request.
+	respMakeKnock, err := r.federation.MakeKnock(
+		ctx,
+		userID.Domain(),
+		serverName,
+		request.RoomID,
+		request.UserID,
+		knockRoomVersions,
+	)
+	if err != nil {
+		r.statistics.ForServer(serverName).Failure()
+		return nil, fmt.Errorf("r.federation.MakeKnock: %w", err)
+	}
+
+	// Work out if we support the room version that has been supplied in
+	// the make_knock response.
+	verImpl, err := gomatrixserverlib.GetRoomVersion(respMakeKnock.RoomVersion)
+	if err != nil {
+		return nil, err
+	}
+	if respMakeKnock.RoomVersion == gomatrixserverlib.RoomVersionPseudoIDs {
+		// Knocking would require the remote server to know our pseudo ID
+		// mapping before we have joined, which isn't supported yet.
+		return nil, fmt.Errorf("knocking is not supported in room version %q", respMakeKnock.RoomVersion)
+	}
+
+	// Set all the fields to be what they should be, this should be a no-op
+	// but it's possible that the remote server returned us something "odd"
+	senderIDString := userID.String()
+	respMakeKnock.KnockEvent.Type = spec.MRoomMember
+	respMakeKnock.KnockEvent.SenderID = senderIDString
+	respMakeKnock.KnockEvent.StateKey = &senderIDString
+	respMakeKnock.KnockEvent.RoomID = request.RoomID
+	respMakeKnock.KnockEvent.Redacts = ""
+	knockEB := verImpl.NewEventBuilderFromProtoEvent(&respMakeKnock.KnockEvent)
+
+	// It is possible for the request to include some "content" for the
+	// event, e.g. a "reason". We'll always overwrite the "membership" key.
+	content := map[string]interface{}{}
+	for k, v := range request.Content {
+		content[k] = v
+	}
+	content["membership"] = spec.Knock
+	if err = knockEB.SetContent(content); err != nil {
+		return nil, fmt.Errorf("knockEB.SetContent: %w", err)
+	}
+	if err = knockEB.SetUnsigned(struct{}{}); err != nil {
+		return nil, fmt.Errorf("knockEB.SetUnsigned: %w", err)
+	}
+
+	// Build the knock event.
+	identity, err := r.cfg.Matrix.SigningIdentityFor(userID.Domain())
+	if err != nil {
+		return nil, err
+	}
+	event, err := knockEB.Build(
+		time.Now(),
+		identity.ServerName,
+		identity.KeyID,
+		identity.PrivateKey,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("knockEB.Build: %w", err)
+	}
+
+	// Try to perform a send_knock using the newly built event.
+	respSendKnock, err := r.federation.SendKnock(
+		ctx,
+		userID.Domain(),
+		serverName,
+		event,
+	)
+	if err != nil {
+		r.statistics.ForServer(serverName).Failure()
+		return nil, fmt.Errorf("r.federation.SendKnock: %w", err)
+	}
+	r.statistics.ForServer(serverName).Success(statistics.SendDirect)
+
+	// Keep hold of the stripped state that the remote server sent us, so
+	// that the knocking user can identify the room they knocked on.
+	knockRoomState := respSendKnock.KnockRoomState
+	if knockRoomState == nil {
+		knockRoomState = []gomatrixserverlib.InviteStrippedState{}
+	}
+	event, err = event.SetUnsigned(map[string]interface{}{
+		"knock_room_state": knockRoomState,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("event.SetUnsigned: %w", err)
+	}
+	return &types.HeaderedEvent{PDU: event}, nil
+}
+
 // SendInvite implements api.FederationInternalAPI
 func (r *FederationInternalAPI) SendInvite(
 	ctx context.Context,
@@ -481,6 +643,26 @@ func (r *FederationInternalAPI) MarkServersAlive(destinations []spec.ServerName)
 	}
 }
 
+// P2PAddRelayServers implements api.FederationInternalAPI
+func (r *FederationInternalAPI) P2PAddRelayServers(
+	ctx context.Context,
+	request *api.P2PAddRelayServersRequest,
+	response *api.P2PAddRelayServersResponse,
+) error {
+	r.statistics.ForServer(request.Server).AddRelayServers(request.RelayServers)
+	return nil
+}
+
+// P2PRemoveRelayServers implements api.FederationInternalAPI
+func (r *FederationInternalAPI) P2PRemoveRelayServers(
+	ctx context.Context,
+	request *api.P2PRemoveRelayServersRequest,
+	response *api.P2PRemoveRelayServersResponse,
+) error {
+	r.statistics.ForServer(request.Server).RemoveRelayServers(request.RelayServers)
+	return nil
+}
+
 func checkEventsContainCreateEvent(events []gomatrixserverlib.PDU) error {
 	// sanity check we have a create event and it has a known room version
 	for _, ev := range events {
@@ -25,6 +25,7 @@ import (
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/stretchr/testify/assert"
@@ -35,12 +36,31 @@ type testFedClient struct {
 	queryKeysCalled bool
 	claimKeysCalled bool
 	shouldFail      bool
+	sentKnock       gomatrixserverlib.PDU
 }
 
 func (t *testFedClient) LookupRoomAlias(ctx context.Context, origin, s spec.ServerName, roomAlias string) (res fclient.RespDirectory, err error) {
 	return fclient.RespDirectory{}, nil
 }
 
+func (t *testFedClient) MakeKnock(ctx context.Context, origin, s spec.ServerName, roomID, userID string, roomVersions []gomatrixserverlib.RoomVersion) (res fclient.RespMakeKnock, err error) {
+	return fclient.RespMakeKnock{
+		KnockEvent: gomatrixserverlib.ProtoEvent{
+			PrevEvents: []string{"$prev"},
+			AuthEvents: []string{"$create"},
+			Depth:      2,
+		},
+		RoomVersion: gomatrixserverlib.RoomVersionV10,
+	}, nil
+}
+
+func (t *testFedClient) SendKnock(ctx context.Context, origin, s spec.ServerName, event gomatrixserverlib.PDU) (res fclient.RespSendKnock, err error) {
+	t.sentKnock = event
+	return fclient.RespSendKnock{
+		KnockRoomState: []gomatrixserverlib.InviteStrippedState{},
+	}, nil
+}
+
 func TestPerformWakeupServers(t *testing.T) {
 	testDB := test.NewInMemoryFederationDatabase()
 
@@ -62,7 +82,7 @@ func TestPerformWakeupServers(t *testing.T) {
 		},
 	}
 	fedClient := &testFedClient{}
-	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist)
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
 	queues := queue.NewOutgoingQueues(
 		testDB, process.NewProcessContext(),
 		false,
@@ -100,7 +120,7 @@ func TestPerformDirectoryLookup(t *testing.T) {
 		},
 	}
 	fedClient := &testFedClient{}
-	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist)
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
 	queues := queue.NewOutgoingQueues(
 		testDB, process.NewProcessContext(),
 		false,
@@ -119,3 +139,50 @@ func TestPerformDirectoryLookup(t *testing.T) {
 	err = fedAPI.PerformDirectoryLookup(context.Background(), &req, &res)
 	assert.NoError(t, err)
 }
+
+func TestPerformKnock(t *testing.T) {
+	testDB := test.NewInMemoryFederationDatabase()
+
+	_, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	cfg := config.FederationAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{
+				ServerName: "local",
+				KeyID:      "ed25519:1",
+				PrivateKey: key,
+			},
+		},
+	}
+	fedClient := &testFedClient{}
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
+	queues := queue.NewOutgoingQueues(
+		testDB, process.NewProcessContext(),
+		false,
+		cfg.Matrix.ServerName, fedClient, &stats,
+		nil,
+	)
+	fedAPI := NewFederationInternalAPI(
+		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+	)
+
+	req := api.PerformKnockRequest{
+		RoomID:      "!room:remote",
+		UserID:      "@alice:local",
+		ServerNames: []spec.ServerName{"local", "remote"},
+		Content:     map[string]interface{}{"reason": "let me in", "membership": "join"},
+	}
+	res := api.PerformKnockResponse{}
+	err = fedAPI.PerformKnock(context.Background(), &req, &res)
+	assert.NoError(t, err)
+	assert.Equal(t, spec.ServerName("remote"), res.KnockedVia)
+	assert.NotNil(t, fedClient.sentKnock)
+	assert.NotNil(t, res.Event)
+
+	membership, err := res.Event.Membership()
+	assert.NoError(t, err)
+	assert.Equal(t, spec.Knock, membership)
+	assert.Equal(t, "@alice:local", *res.Event.StateKey())
+	assert.Equal(t, fedClient.sentKnock.EventID(), res.Event.EventID())
+	assert.JSONEq(t, `{"knock_room_state":[]}`, string(res.Event.Unsigned()))
+}
@@ -413,9 +413,19 @@ func (oq *destinationQueue) nextTransaction(
 	ctx, cancel := context.WithTimeout(oq.process.Context(), time.Minute*5)
 	defer cancel()
 
+	// Always try sending directly to the destination first, in case it
+	// has come back online in the meantime.
 	sendMethod = statistics.SendDirect
 	_, err = oq.client.SendTransaction(ctx, t)
 
+	// If that failed and the destination is assumed to be offline, fall back
+	// to handing the transaction to its relay servers instead.
+	relayServers := oq.statistics.KnownRelayServers()
+	if err != nil && oq.statistics.AssumedOffline() && len(relayServers) > 0 {
+		sendMethod = statistics.SendViaRelay
+		err = oq.sendTransactionToRelays(ctx, t, relayServers)
+	}
+
 	switch errResponse := err.(type) {
 	case nil:
 		// Clean up the transaction in the database.
@@ -455,6 +465,37 @@ func (oq *destinationQueue) nextTransaction(
 	}
 }
 
+// sendTransactionToRelays sends the transaction to each of the given relay
+// servers, which store it until the destination retrieves it. The send is
+// considered successful if at least one of the relay servers accepted it.
+func (oq *destinationQueue) sendTransactionToRelays(
+	ctx context.Context,
+	t gomatrixserverlib.Transaction,
+	relayServers []spec.ServerName,
+) error {
+	// The relay stores transactions per destination, so any user ID on the
+	// destination will do.
+	userID, err := spec.NewUserID("@user:"+string(oq.destination), false)
+	if err != nil {
+		return err
+	}
+
+	logrus.WithField("server_name", oq.destination).Debugf("Sending transaction %q to relay servers %v", t.TransactionID, relayServers)
+	relaySuccess := false
+	for _, relayServer := range relayServers {
+		if _, relayErr := oq.client.P2PSendTransactionToRelay(ctx, *userID, t, relayServer); relayErr != nil {
+			logrus.WithError(relayErr).Debugf("Failed to send transaction %q to relay server %q", t.TransactionID, relayServer)
+			err = relayErr
+			continue
+		}
+		relaySuccess = true
+	}
+	if relaySuccess {
+		return nil
+	}
+	return err
+}
+
 // createTransaction generates a gomatrixserverlib.Transaction from the provided pdus and edus.
 // It also returns the associated event receipts so they can be cleaned from the database in
 // the case of a successful transaction.
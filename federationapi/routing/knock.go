@@ -0,0 +1,360 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// MakeKnock implements the /make_knock API
+func MakeKnock(
+	httpReq *http.Request,
+	request *fclient.FederationRequest,
+	cfg *config.FederationAPI,
+	rsAPI api.FederationRoomserverAPI,
+	roomID spec.RoomID, userID spec.UserID,
+	remoteVersions []gomatrixserverlib.RoomVersion,
+) util.JSONResponse {
+	if userID.Domain() != request.Origin() {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden(fmt.Sprintf("The knock must be sent by the server of the user. Origin %s != %s", request.Origin(), userID.Domain())),
+		}
+	}
+
+	roomVersion, err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), roomID.String())
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("failed obtaining room version")
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Room does not exist"),
+		}
+	}
+
+	// Check that the room that the remote side is trying to knock on is
+	// actually one of the room versions that they listed in their ?ver=.
+	versionSupported := false
+	for _, v := range remoteVersions {
+		if v == roomVersion {
+			versionSupported = true
+			break
+		}
+	}
+	if !versionSupported {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.IncompatibleRoomVersion(string(roomVersion)),
+		}
+	}
+
+	req := api.QueryServerJoinedToRoomRequest{
+		ServerName: request.Destination(),
+		RoomID:     roomID.String(),
+	}
+	res := api.QueryServerJoinedToRoomResponse{}
+	if err = rsAPI.QueryServerJoinedToRoom(httpReq.Context(), &req, &res); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryServerJoinedToRoom failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if !res.RoomExists || !res.IsInRoom {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("Local server not currently joined to room: %s", roomID.String())),
+		}
+	}
+
+	identity, err := cfg.Matrix.SigningIdentityFor(request.Destination())
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Errorf("obtaining signing identity for %s failed", request.Destination())
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("Server name %q does not exist", request.Destination())),
+		}
+	}
+
+	// Try building an event for the server
+	senderID := userID.String()
+	proto := gomatrixserverlib.ProtoEvent{
+		SenderID: senderID,
+		RoomID:   roomID.String(),
+		Type:     spec.MRoomMember,
+		StateKey: &senderID,
+	}
+	if err = proto.SetContent(gomatrixserverlib.MemberContent{Membership: spec.Knock}); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("proto.SetContent failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	queryRes := api.QueryLatestEventsAndStateResponse{
+		RoomVersion: roomVersion,
+	}
+	event, err := eventutil.QueryAndBuildEvent(httpReq.Context(), &proto, identity, time.Now(), rsAPI, &queryRes)
+	switch e := err.(type) {
+	case nil:
+	case eventutil.ErrRoomNoExists:
+		util.GetLogger(httpReq.Context()).WithError(err).Error("eventutil.BuildEvent failed")
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Room does not exist"),
+		}
+	case gomatrixserverlib.BadJSONError:
+		util.GetLogger(httpReq.Context()).WithError(err).Error("eventutil.BuildEvent failed")
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(e.Error()),
+		}
+	default:
+		util.GetLogger(httpReq.Context()).WithError(err).Error("eventutil.BuildEvent failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	// Check that the knock would be allowed by the current room state,
+	// i.e. that the join rules permit knocking and the user isn't already
+	// joined, invited or banned.
+	stateEvents := make([]gomatrixserverlib.PDU, len(queryRes.StateEvents))
+	for i, stateEvent := range queryRes.StateEvents {
+		stateEvents[i] = stateEvent.PDU
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = gomatrixserverlib.Allowed(event.PDU, &provider, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		return rsAPI.QueryUserIDForSender(httpReq.Context(), roomID, senderID)
+	}); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden(err.Error()),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"event":        proto,
+			"room_version": roomVersion,
+		},
+	}
+}
+
+// SendKnock implements the /send_knock API
+// nolint:gocyclo
+func SendKnock(
+	httpReq *http.Request,
+	request *fclient.FederationRequest,
+	cfg *config.FederationAPI,
+	rsAPI api.FederationRoomserverAPI,
+	keys gomatrixserverlib.JSONVerifier,
+	roomID, eventID string,
+) util.JSONResponse {
+	roomVersion, err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), roomID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Room does not exist"),
+		}
+	}
+
+	verImpl, err := gomatrixserverlib.GetRoomVersion(roomVersion)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.UnsupportedRoomVersion(
+				fmt.Sprintf("QueryRoomVersionForRoom returned unknown version: %s", roomVersion),
+			),
+		}
+	}
+
+	// Decode the event JSON from the request.
+	event, err := verImpl.NewEventFromUntrustedJSON(request.Content())
+	switch err.(type) {
+	case gomatrixserverlib.BadJSONError:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(err.Error()),
+		}
+	case nil:
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	// Check that the room ID is correct.
+	if event.RoomID().String() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The room ID in the request path must match the room ID in the knock event JSON"),
+		}
+	}
+
+	// Check that the event ID is correct.
+	if event.EventID() != eventID {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The event ID in the request path must match the event ID in the knock event JSON"),
+		}
+	}
+
+	if event.StateKey() == nil || event.StateKeyEquals("") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("No state key was provided in the knock event."),
+		}
+	}
+	if !event.StateKeyEquals(string(event.SenderID())) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("Event state key must match the event sender."),
+		}
+	}
+
+	// Check that the sender belongs to the server that is sending us
+	// the request. By this point we've already asserted that the sender
+	// and the state key are equal so we don't need to check both.
+	sender, err := rsAPI.QueryUserIDForSender(httpReq.Context(), event.RoomID(), event.SenderID())
+	if err != nil || sender == nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("The sender of the knock is invalid"),
+		}
+	} else if sender.Domain() != request.Origin() {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("The sender does not match the server that originated the request"),
+		}
+	}
+
+	// check membership is set to knock
+	mem, err := event.Membership()
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("event.Membership failed")
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("missing content.membership key"),
+		}
+	}
+	if mem != spec.Knock {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The membership in the event content must be set to knock"),
+		}
+	}
+
+	// Check that the event is signed by the server sending the request.
+	redacted, err := verImpl.RedactEventJSON(event.JSON())
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("verImpl.RedactEventJSON failed")
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The event JSON could not be redacted"),
+		}
+	}
+	verifyRequests := []gomatrixserverlib.VerifyJSONRequest{{
+		ServerName:           sender.Domain(),
+		Message:              redacted,
+		AtTS:                 event.OriginServerTS(),
+		ValidityCheckingFunc: gomatrixserverlib.StrictValiditySignatureCheck,
+	}}
+	verifyResults, err := keys.VerifyJSONs(httpReq.Context(), verifyRequests)
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("keys.VerifyJSONs failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if verifyResults[0].Error != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("The knock must be signed by the server it originated on"),
+		}
+	}
+
+	// Send the event to the room server. The roomserver will run the event
+	// auth checks, which will reject the knock if the join rules don't
+	// allow it. We are responsible for notifying other servers that the
+	// user has knocked, so set SendAsServer to cfg.Matrix.ServerName
+	var response api.InputRoomEventsResponse
+	rsAPI.InputRoomEvents(httpReq.Context(), &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{
+			{
+				Kind:          api.KindNew,
+				Event:         &types.HeaderedEvent{PDU: event},
+				SendAsServer:  string(cfg.Matrix.ServerName),
+				TransactionID: nil,
+			},
+		},
+	}, &response)
+
+	if response.ErrMsg != "" {
+		util.GetLogger(httpReq.Context()).WithField(logrus.ErrorKey, response.ErrMsg).WithField("not_allowed", response.NotAllowed).Error("producer.SendEvents failed")
+		if response.NotAllowed {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden(response.ErrMsg),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	// Send back some stripped state so that the knocking user can
+	// identify the room that they knocked on.
+	stateReq := &api.QueryLatestEventsAndStateRequest{
+		RoomID:       roomID,
+		StateToFetch: eventutil.StrippedStateTuples(),
+	}
+	stateRes := &api.QueryLatestEventsAndStateResponse{}
+	if err = rsAPI.QueryLatestEventsAndState(httpReq.Context(), stateReq, stateRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryLatestEventsAndState failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	knockRoomState := make([]gomatrixserverlib.InviteStrippedState, 0, len(stateRes.StateEvents)+1)
+	for _, ev := range stateRes.StateEvents {
+		knockRoomState = append(knockRoomState, gomatrixserverlib.NewInviteStrippedState(ev.PDU))
+	}
+	knockRoomState = append(knockRoomState, gomatrixserverlib.NewInviteStrippedState(event))
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: fclient.RespSendKnock{
+			KnockRoomState: knockRoomState,
+		},
+	}
+}
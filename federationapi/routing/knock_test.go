@@ -0,0 +1,193 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+)
+
+func TestKnock(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		testKnock(t, dbType)
+	})
+}
+
+func testKnock(t *testing.T, dbType test.DBType) {
+	ctx := context.Background()
+	cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+	defer close()
+
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+	natsInstance := jetstream.NATSInstance{}
+	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+	rsAPI.SetFederationAPI(nil, nil)
+
+	remote := spec.ServerName("remote")
+	remoteKeyID := gomatrixserverlib.KeyID("ed25519:remote")
+	alice := test.NewUser(t)
+	bob := test.NewUser(t, test.WithSigningServer(remote, remoteKeyID, test.PrivateKeyB))
+	bobID, err := spec.NewUserID(bob.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	knockRoom := test.NewRoom(t, alice, test.RoomVersion(gomatrixserverlib.RoomVersionV10), test.RoomPreset(test.PresetPrivateChat))
+	knockRoom.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{
+		"join_rule": spec.Knock,
+	}, test.WithStateKey(""))
+	inviteRoom := test.NewRoom(t, alice, test.RoomVersion(gomatrixserverlib.RoomVersionV10), test.RoomPreset(test.PresetPrivateChat))
+	for _, room := range []*test.Room{knockRoom, inviteRoom} {
+		if err = api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %s", err)
+		}
+	}
+
+	makeKnock := func(origin spec.ServerName, room *test.Room, versions []gomatrixserverlib.RoomVersion) (int, interface{}) {
+		roomID, err := spec.NewRoomID(room.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := fclient.NewFederationRequest(http.MethodGet, origin, cfg.Global.ServerName, "/_matrix/federation/v1/make_knock/"+room.ID+"/"+bob.ID)
+		httpReq := test.NewRequest(t, http.MethodGet, "/_matrix/federation/v1/make_knock/"+room.ID+"/"+bob.ID)
+		res := MakeKnock(httpReq, &request, &cfg.FederationAPI, rsAPI, *roomID, *bobID, versions)
+		return res.Code, res.JSON
+	}
+
+	t.Run("make_knock", func(t *testing.T) {
+		testCases := []struct {
+			name     string
+			origin   spec.ServerName
+			room     *test.Room
+			versions []gomatrixserverlib.RoomVersion
+			wantCode int
+		}{
+			{
+				name:     "origin must match the user",
+				origin:   "evil",
+				room:     knockRoom,
+				versions: []gomatrixserverlib.RoomVersion{gomatrixserverlib.RoomVersionV10},
+				wantCode: http.StatusForbidden,
+			},
+			{
+				name:     "room version must be supported",
+				origin:   remote,
+				room:     knockRoom,
+				versions: []gomatrixserverlib.RoomVersion{gomatrixserverlib.RoomVersionV6},
+				wantCode: http.StatusBadRequest,
+			},
+			{
+				name:     "join rules must allow knocking",
+				origin:   remote,
+				room:     inviteRoom,
+				versions: []gomatrixserverlib.RoomVersion{gomatrixserverlib.RoomVersionV10},
+				wantCode: http.StatusForbidden,
+			},
+			{
+				name:     "knock is allowed",
+				origin:   remote,
+				room:     knockRoom,
+				versions: []gomatrixserverlib.RoomVersion{gomatrixserverlib.RoomVersionV10},
+				wantCode: http.StatusOK,
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				code, res := makeKnock(tc.origin, tc.room, tc.versions)
+				if code != tc.wantCode {
+					t.Fatalf("expected HTTP %d, got %d: %+v", tc.wantCode, code, res)
+				}
+			})
+		}
+	})
+
+	// Build the knock event from the make_knock template, like the remote server would.
+	code, res := makeKnock(remote, knockRoom, []gomatrixserverlib.RoomVersion{gomatrixserverlib.RoomVersionV10})
+	if code != http.StatusOK {
+		t.Fatalf("make_knock failed: %+v", res)
+	}
+	proto := res.(map[string]interface{})["event"].(gomatrixserverlib.ProtoEvent)
+	knockEvent, err := gomatrixserverlib.MustGetRoomVersion(gomatrixserverlib.RoomVersionV10).NewEventBuilderFromProtoEvent(&proto).Build(time.Now(), remote, remoteKeyID, test.PrivateKeyB)
+	if err != nil {
+		t.Fatalf("failed to build knock event: %s", err)
+	}
+
+	sendKnock := func(origin spec.ServerName, eventID string, event gomatrixserverlib.PDU) (int, interface{}) {
+		request := fclient.NewFederationRequest(http.MethodPut, origin, cfg.Global.ServerName, "/_matrix/federation/v1/send_knock/"+knockRoom.ID+"/"+eventID)
+		if err := request.SetContent(json.RawMessage(event.JSON())); err != nil {
+			t.Fatal(err)
+		}
+		httpReq := test.NewRequest(t, http.MethodPut, "/_matrix/federation/v1/send_knock/"+knockRoom.ID+"/"+eventID)
+		res := SendKnock(httpReq, &request, &cfg.FederationAPI, rsAPI, &test.NopJSONVerifier{}, knockRoom.ID, eventID)
+		return res.Code, res.JSON
+	}
+
+	t.Run("send_knock", func(t *testing.T) {
+		t.Run("event ID must match", func(t *testing.T) {
+			if code, res := sendKnock(remote, "$wrong", knockEvent); code != http.StatusBadRequest {
+				t.Fatalf("expected HTTP 400, got %d: %+v", code, res)
+			}
+		})
+		t.Run("origin must match the sender", func(t *testing.T) {
+			if code, res := sendKnock("evil", knockEvent.EventID(), knockEvent); code != http.StatusForbidden {
+				t.Fatalf("expected HTTP 403, got %d: %+v", code, res)
+			}
+		})
+		t.Run("membership must be knock", func(t *testing.T) {
+			joinProto := proto
+			if err := joinProto.SetContent(gomatrixserverlib.MemberContent{Membership: spec.Join}); err != nil {
+				t.Fatal(err)
+			}
+			joinEvent, err := gomatrixserverlib.MustGetRoomVersion(gomatrixserverlib.RoomVersionV10).NewEventBuilderFromProtoEvent(&joinProto).Build(time.Now(), remote, remoteKeyID, test.PrivateKeyB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code, res := sendKnock(remote, joinEvent.EventID(), joinEvent); code != http.StatusBadRequest {
+				t.Fatalf("expected HTTP 400, got %d: %+v", code, res)
+			}
+		})
+
+		code, res := sendKnock(remote, knockEvent.EventID(), knockEvent)
+		if code != http.StatusOK {
+			t.Fatalf("send_knock failed with HTTP %d: %+v", code, res)
+		}
+		knockRoomState := res.(fclient.RespSendKnock).KnockRoomState
+		var sawJoinRules, sawKnock bool
+		for _, ev := range knockRoomState {
+			switch ev.Type() {
+			case spec.MRoomJoinRules:
+				sawJoinRules = true
+			case spec.MRoomMember:
+				sawKnock = sawKnock || (ev.StateKey() != nil && *ev.StateKey() == bob.ID)
+			}
+		}
+		if !sawJoinRules || !sawKnock {
+			t.Fatalf("expected the join rules and the knock in the stripped state, got %+v", knockRoomState)
+		}
+
+		memberRes := &api.QueryMembershipForUserResponse{}
+		if err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+			RoomID: knockRoom.ID,
+			UserID: *bobID,
+		}, memberRes); err != nil {
+			t.Fatal(err)
+		}
+		if memberRes.Membership != spec.Knock {
+			t.Fatalf("expected bob to be knocking, got %q", memberRes.Membership)
+		}
+	})
+}
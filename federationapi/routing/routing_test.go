@@ -0,0 +1,69 @@
+package routing
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+)
+
+func TestMakeFedAPIRateLimits(t *testing.T) {
+	_, privKey, _ := ed25519.GenerateKey(nil)
+	isLocal := func(serverName spec.ServerName) bool { return serverName == "test" }
+	wakeup := &FederationWakeups{}
+	wakeup.origins.Store(spec.ServerName("remote"), time.Now())
+
+	cfg := &config.FederationRateLimiting{}
+	cfg.Defaults()
+	cfg.Threshold = 1
+	cfg.CooloffMS = 60000
+	rateLimits := httputil.NewOriginRateLimits(cfg, httputil.NewMemoryRateLimitStore())
+
+	ok := func(*http.Request, *fclient.FederationRequest, map[string]string) util.JSONResponse {
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	}
+	request := func(t *testing.T, h http.Handler) int {
+		t.Helper()
+		fedReq := fclient.NewFederationRequest(http.MethodGet, "remote", "test", "/_matrix/federation/v1/version")
+		if err := fedReq.Sign("remote", "ed25519:auto", privKey); err != nil {
+			t.Fatal(err)
+		}
+		req, err := fedReq.HTTPRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Body = http.NoBody // as for incoming requests
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("rate limited", func(t *testing.T) {
+		h := MakeFedAPI("limited", "test", isLocal, &test.NopJSONVerifier{}, wakeup, rateLimits, ok)
+		if code := request(t, h); code != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d", code)
+		}
+		if code := request(t, h); code != http.StatusTooManyRequests {
+			t.Fatalf("expected HTTP 429, got %d", code)
+		}
+	})
+
+	// Like /send, which is registered without rate limits
+	t.Run("not rate limited", func(t *testing.T) {
+		h := MakeFedAPI("unlimited", "test", isLocal, &test.NopJSONVerifier{}, wakeup, nil, ok)
+		for i := 0; i < 3; i++ {
+			if code := request(t, h); code != http.StatusOK {
+				t.Fatalf("expected HTTP 200 for request %d, got %d", i, code)
+			}
+		}
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/nats-io/nats.go"
+
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+)
+
+// TimestampToEvent implements GET /_matrix/federation/v1/timestamp_to_event/{roomID}
+// https://spec.matrix.org/v1.10/server-server-api/#get_matrixfederationv1timestamp_to_eventroomid
+func TimestampToEvent(
+	httpReq *http.Request,
+	request *fclient.FederationRequest,
+	rsAPI api.FederationRoomserverAPI,
+	natsClient *nats.Conn,
+	topic string,
+	roomID string,
+) util.JSONResponse {
+	if _, err := spec.NewRoomID(roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("invalid room ID"),
+		}
+	}
+
+	ts, err := strconv.ParseUint(httpReq.URL.Query().Get("ts"), 10, 64)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("ts must be a timestamp in milliseconds"),
+		}
+	}
+	dir := httpReq.URL.Query().Get("dir")
+	if dir != "f" && dir != "b" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("dir must be either 'f' or 'b'"),
+		}
+	}
+
+	// If we don't think we belong to this room then don't waste the effort
+	// responding to requests for it.
+	if errRes := ErrorIfLocalServerNotInRoom(httpReq.Context(), rsAPI, roomID); errRes != nil {
+		return *errRes
+	}
+
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: spec.NotFound(fmt.Sprintf("Unable to find event from %d in direction %s", ts, dir)),
+	}
+
+	msg := nats.NewMsg(topic)
+	msg.Header.Set(jetstream.RoomID, roomID)
+	msg.Header.Set("ts", strconv.FormatUint(ts, 10))
+	msg.Header.Set("dir", dir)
+	reply, err := natsClient.RequestMsg(msg, time.Second*10)
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("unable to query event at timestamp")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if e := reply.Header.Get("error"); e != "" {
+		util.GetLogger(httpReq.Context()).Errorf("received error msg from nats: %s", e)
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	eventID := reply.Header.Get(jetstream.EventID)
+	if eventID == "" {
+		return notFound
+	}
+	originServerTS, err := strconv.ParseUint(reply.Header.Get("origin_server_ts"), 10, 64)
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("invalid origin_server_ts received from nats")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	// Don't reveal events which the requesting server isn't allowed to see.
+	allowed, err := rsAPI.QueryServerAllowedToSeeEvent(httpReq.Context(), request.Origin(), eventID, roomID)
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryServerAllowedToSeeEvent failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if !allowed {
+		return notFound
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: federationAPI.TimestampToEventResponse{
+			EventID:        eventID,
+			OriginServerTS: spec.Timestamp(originServerTS),
+		},
+	}
+}
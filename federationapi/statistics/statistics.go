@@ -1,6 +1,7 @@
 package statistics
 
 import (
+	"context"
 	"math"
 	"math/rand"
 	"sync"
@@ -28,17 +29,28 @@ type Statistics struct {
 	// just blacklist the host altogether? The backoff is exponential,
 	// so the max time here to attempt is 2**failures seconds.
 	FailuresUntilBlacklist uint32
+
+	// How many times should we tolerate consecutive failures before we
+	// mark the destination as offline. At this point we should attempt
+	// to send messages to the destination's relay servers if we know them.
+	FailuresUntilAssumedOffline uint32
+
+	enableRelays bool
 }
 
 func NewStatistics(
 	db storage.Database,
 	failuresUntilBlacklist uint32,
+	failuresUntilAssumedOffline uint32,
+	enableRelays bool,
 ) Statistics {
 	return Statistics{
-		DB:                     db,
-		FailuresUntilBlacklist: failuresUntilBlacklist,
-		backoffTimers:          make(map[spec.ServerName]*time.Timer),
-		servers:                make(map[spec.ServerName]*ServerStatistics),
+		DB:                          db,
+		FailuresUntilBlacklist:      failuresUntilBlacklist,
+		FailuresUntilAssumedOffline: failuresUntilAssumedOffline,
+		backoffTimers:               make(map[spec.ServerName]*time.Timer),
+		servers:                     make(map[spec.ServerName]*ServerStatistics),
+		enableRelays:                enableRelays,
 	}
 }
 
@@ -53,8 +65,9 @@ func (s *Statistics) ForServer(serverName spec.ServerName) *ServerStatistics {
 	if !found {
 		s.mutex.Lock()
 		server = &ServerStatistics{
-			statistics: s,
-			serverName: serverName,
+			statistics:        s,
+			serverName:        serverName,
+			knownRelayServers: []spec.ServerName{},
 		}
 		s.servers[serverName] = server
 		s.mutex.Unlock()
@@ -64,6 +77,28 @@ func (s *Statistics) ForServer(serverName spec.ServerName) *ServerStatistics {
 		} else {
 			server.blacklisted.Store(blacklisted)
 		}
+
+		// Don't bother hitting the database 2 additional times
+		// if we don't want to use relays.
+		if !s.enableRelays {
+			return server
+		}
+
+		assumedOffline, err := s.DB.IsServerAssumedOffline(context.Background(), serverName)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to get assumed offline entry %q", serverName)
+		} else {
+			server.assumedOffline.Store(assumedOffline)
+		}
+
+		knownRelayServers, err := s.DB.P2PGetRelayServersForServer(context.Background(), serverName)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to get relay server list for %q", serverName)
+		} else {
+			server.relayMutex.Lock()
+			server.knownRelayServers = knownRelayServers
+			server.relayMutex.Unlock()
+		}
 	}
 	return server
 }
@@ -72,6 +107,7 @@ type SendMethod uint8
 
 const (
 	SendDirect SendMethod = iota
+	SendViaRelay
 )
 
 // ServerStatistics contains information about our interactions with a
@@ -79,15 +115,18 @@ const (
 // many times we failed etc. It also manages the backoff time and black-
 // listing a remote host if it remains uncooperative.
 type ServerStatistics struct {
-	statistics      *Statistics     //
-	serverName      spec.ServerName //
-	blacklisted     atomic.Bool     // is the node blacklisted
-	backoffStarted  atomic.Bool     // is the backoff started
-	backoffUntil    atomic.Value    // time.Time until this backoff interval ends
-	backoffCount    atomic.Uint32   // number of times BackoffDuration has been called
-	successCounter  atomic.Uint32   // how many times have we succeeded?
-	backoffNotifier func()          // notifies destination queue when backoff completes
-	notifierMutex   sync.Mutex
+	statistics        *Statistics     //
+	serverName        spec.ServerName //
+	blacklisted       atomic.Bool     // is the node blacklisted
+	assumedOffline    atomic.Bool     // is the node assumed to be offline
+	backoffStarted    atomic.Bool     // is the backoff started
+	backoffUntil      atomic.Value    // time.Time until this backoff interval ends
+	backoffCount      atomic.Uint32   // number of times BackoffDuration has been called
+	successCounter    atomic.Uint32   // how many times have we succeeded?
+	backoffNotifier   func()          // notifies destination queue when backoff completes
+	notifierMutex     sync.Mutex
+	knownRelayServers []spec.ServerName // relay servers which store and forward transactions for the node
+	relayMutex        sync.Mutex
 }
 
 const maxJitterMultiplier = 1.4
@@ -136,6 +175,7 @@ func (s *ServerStatistics) Success(method SendMethod) {
 				logrus.WithError(err).Errorf("Failed to remove %q from blacklist", s.serverName)
 			}
 		}
+		s.removeAssumedOffline()
 	}
 }
 
@@ -156,15 +196,29 @@ func (s *ServerStatistics) Failure() (time.Time, bool) {
 	if s.backoffStarted.CompareAndSwap(false, true) {
 		backoffCount := s.backoffCount.Add(1)
 
+		if s.statistics.enableRelays && backoffCount >= s.statistics.FailuresUntilAssumedOffline {
+			if s.assumedOffline.CompareAndSwap(false, true) && s.statistics.DB != nil {
+				if err := s.statistics.DB.SetServerAssumedOffline(context.Background(), s.serverName); err != nil {
+					logrus.WithError(err).Errorf("Failed to set %q as assumed offline", s.serverName)
+				}
+			}
+		}
+
 		if backoffCount >= s.statistics.FailuresUntilBlacklist {
-			s.blacklisted.Store(true)
-			if s.statistics.DB != nil {
-				if err := s.statistics.DB.AddServerToBlacklist(s.serverName); err != nil {
-					logrus.WithError(err).Errorf("Failed to add %q to blacklist", s.serverName)
+			if !s.hasRelayServers() {
+				s.blacklisted.Store(true)
+				if s.statistics.DB != nil {
+					if err := s.statistics.DB.AddServerToBlacklist(s.serverName); err != nil {
+						logrus.WithError(err).Errorf("Failed to add %q to blacklist", s.serverName)
+					}
 				}
+				s.ClearBackoff()
+				return time.Time{}, true
 			}
-			s.ClearBackoff()
-			return time.Time{}, true
+			// Transactions can still reach the destination through its
+			// relay servers, so keep retrying at the longest interval
+			// instead of blacklisting it.
+			s.backoffCount.Store(s.statistics.FailuresUntilBlacklist)
 		}
 
 		// We're starting a new back off so work out what the next interval
@@ -184,6 +238,7 @@ func (s *ServerStatistics) Failure() (time.Time, bool) {
 // MarkServerAlive removes the assumed offline and blacklisted statuses from this server.
 // Returns whether the server was blacklisted before this point.
 func (s *ServerStatistics) MarkServerAlive() bool {
+	s.removeAssumedOffline()
 	wasBlacklisted := s.removeBlacklist()
 	return wasBlacklisted
 }
@@ -230,6 +285,21 @@ func (s *ServerStatistics) Blacklisted() bool {
 	return s.blacklisted.Load()
 }
 
+// AssumedOffline returns true if the server is assumed offline and false
+// otherwise.
+func (s *ServerStatistics) AssumedOffline() bool {
+	return s.assumedOffline.Load()
+}
+
+// removeAssumedOffline removes the assumed offline status from the server.
+func (s *ServerStatistics) removeAssumedOffline() {
+	if s.assumedOffline.CompareAndSwap(true, false) && s.statistics.DB != nil {
+		if err := s.statistics.DB.RemoveServerAssumedOffline(context.Background(), s.serverName); err != nil {
+			logrus.WithError(err).Errorf("Failed to remove %q from assumed offline", s.serverName)
+		}
+	}
+}
+
 // removeBlacklist removes the blacklisted status from the server.
 // Returns whether the server was blacklisted.
 func (s *ServerStatistics) removeBlacklist() bool {
@@ -250,3 +320,104 @@ func (s *ServerStatistics) removeBlacklist() bool {
 func (s *ServerStatistics) SuccessCount() uint32 {
 	return s.successCounter.Load()
 }
+
+// KnownRelayServers returns the list of relay servers associated with this
+// server.
+func (s *ServerStatistics) KnownRelayServers() []spec.ServerName {
+	s.relayMutex.Lock()
+	defer s.relayMutex.Unlock()
+	relayServers := make([]spec.ServerName, len(s.knownRelayServers))
+	copy(relayServers, s.knownRelayServers)
+	return relayServers
+}
+
+// hasRelayServers returns whether transactions for this server can be sent
+// to relay servers.
+func (s *ServerStatistics) hasRelayServers() bool {
+	if !s.statistics.enableRelays {
+		return false
+	}
+	s.relayMutex.Lock()
+	defer s.relayMutex.Unlock()
+	return len(s.knownRelayServers) > 0
+}
+
+// SetRelayServers replaces the relay servers for this server, both in memory
+// and in the database. Servers with relay servers are never blacklisted, so
+// this also removes the server from the blacklist.
+func (s *ServerStatistics) SetRelayServers(relayServers []spec.ServerName) {
+	keep := make(map[spec.ServerName]struct{}, len(relayServers))
+	for _, relayServer := range relayServers {
+		keep[relayServer] = struct{}{}
+	}
+	remove := []spec.ServerName{}
+	for _, relayServer := range s.KnownRelayServers() {
+		if _, ok := keep[relayServer]; !ok {
+			remove = append(remove, relayServer)
+		}
+	}
+	if len(remove) > 0 {
+		s.RemoveRelayServers(remove)
+	}
+	s.AddRelayServers(relayServers)
+	if s.hasRelayServers() {
+		s.removeBlacklist()
+	}
+}
+
+// AddRelayServers stores the given relay servers for this server, both in
+// memory and in the database. Duplicate relay servers are ignored.
+func (s *ServerStatistics) AddRelayServers(relayServers []spec.ServerName) {
+	s.relayMutex.Lock()
+	defer s.relayMutex.Unlock()
+
+	known := make(map[spec.ServerName]struct{}, len(s.knownRelayServers))
+	for _, relayServer := range s.knownRelayServers {
+		known[relayServer] = struct{}{}
+	}
+	newRelayServers := []spec.ServerName{}
+	for _, relayServer := range relayServers {
+		if _, ok := known[relayServer]; ok {
+			continue
+		}
+		known[relayServer] = struct{}{}
+		newRelayServers = append(newRelayServers, relayServer)
+	}
+	if len(newRelayServers) == 0 {
+		return
+	}
+
+	if s.statistics.DB != nil {
+		if err := s.statistics.DB.P2PAddRelayServersForServer(context.Background(), s.serverName, newRelayServers); err != nil {
+			logrus.WithError(err).Errorf("Failed to add relay servers for %q. Servers: %v", s.serverName, newRelayServers)
+			return
+		}
+	}
+	s.knownRelayServers = append(s.knownRelayServers, newRelayServers...)
+}
+
+// RemoveRelayServers removes the given relay servers for this server, both
+// from memory and from the database.
+func (s *ServerStatistics) RemoveRelayServers(relayServers []spec.ServerName) {
+	s.relayMutex.Lock()
+	defer s.relayMutex.Unlock()
+
+	if s.statistics.DB != nil {
+		if err := s.statistics.DB.P2PRemoveRelayServersForServer(context.Background(), s.serverName, relayServers); err != nil {
+			logrus.WithError(err).Errorf("Failed to remove relay servers for %q. Servers: %v", s.serverName, relayServers)
+			return
+		}
+	}
+
+	remove := make(map[spec.ServerName]struct{}, len(relayServers))
+	for _, relayServer := range relayServers {
+		remove[relayServer] = struct{}{}
+	}
+	remaining := []spec.ServerName{}
+	for _, relayServer := range s.knownRelayServers {
+		if _, ok := remove[relayServer]; !ok {
+			remaining = append(remaining, relayServer)
+		}
+	}
+	s.knownRelayServers = remaining
+}
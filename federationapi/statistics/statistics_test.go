@@ -1,9 +1,14 @@
 package statistics
 
 import (
+	"context"
 	"math"
 	"testing"
 	"time"
+
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
 )
 
 const (
@@ -12,7 +17,7 @@ const (
 )
 
 func TestBackoff(t *testing.T) {
-	stats := NewStatistics(nil, FailuresUntilBlacklist)
+	stats := NewStatistics(nil, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
 	server := ServerStatistics{
 		statistics: &stats,
 		serverName: "test.com",
@@ -78,3 +83,104 @@ func TestBackoff(t *testing.T) {
 		}
 	}
 }
+
+func TestAssumedOffline(t *testing.T) {
+	db := test.NewInMemoryFederationDatabase()
+	stats := NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline, true)
+	server := stats.ForServer("test.com")
+
+	for i := uint32(1); i < FailuresUntilAssumedOffline; i++ {
+		server.Failure()
+		server.cancel()
+		if server.AssumedOffline() {
+			t.Fatalf("Failure %d should not have resulted in the server being assumed offline", i)
+		}
+	}
+	server.Failure()
+	server.cancel()
+	assert.True(t, server.AssumedOffline())
+	offline, err := db.IsServerAssumedOffline(context.Background(), "test.com")
+	assert.NoError(t, err)
+	assert.True(t, offline)
+
+	// Successfully sending via a relay doesn't mean the server is back online.
+	server.Success(SendViaRelay)
+	assert.True(t, server.AssumedOffline())
+
+	server.Success(SendDirect)
+	assert.False(t, server.AssumedOffline())
+	offline, err = db.IsServerAssumedOffline(context.Background(), "test.com")
+	assert.NoError(t, err)
+	assert.False(t, offline)
+}
+
+func TestAssumedOfflineRequiresRelays(t *testing.T) {
+	db := test.NewInMemoryFederationDatabase()
+	stats := NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
+	server := stats.ForServer("test.com")
+
+	for i := uint32(0); i < FailuresUntilAssumedOffline; i++ {
+		server.Failure()
+		server.cancel()
+	}
+	assert.False(t, server.AssumedOffline())
+}
+
+func TestRelayServers(t *testing.T) {
+	db := test.NewInMemoryFederationDatabase()
+	stats := NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline, true)
+	server := stats.ForServer("test.com")
+	assert.Empty(t, server.KnownRelayServers())
+
+	server.AddRelayServers([]spec.ServerName{"relay1", "relay2", "relay1"})
+	assert.Equal(t, []spec.ServerName{"relay1", "relay2"}, server.KnownRelayServers())
+	server.AddRelayServers([]spec.ServerName{"relay2", "relay3"})
+	assert.Equal(t, []spec.ServerName{"relay1", "relay2", "relay3"}, server.KnownRelayServers())
+
+	server.RemoveRelayServers([]spec.ServerName{"relay2"})
+	assert.Equal(t, []spec.ServerName{"relay1", "relay3"}, server.KnownRelayServers())
+
+	// A fresh set of statistics should load the relay servers from the database.
+	stats = NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline, true)
+	assert.Equal(t, []spec.ServerName{"relay1", "relay3"}, stats.ForServer("test.com").KnownRelayServers())
+}
+
+func TestRelayServersPreventBlacklist(t *testing.T) {
+	db := test.NewInMemoryFederationDatabase()
+	stats := NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline, true)
+	server := stats.ForServer("test.com")
+	server.AddRelayServers([]spec.ServerName{"relay1"})
+
+	for i := uint32(1); i <= FailuresUntilBlacklist+2; i++ {
+		until, blacklisted := server.Failure()
+		server.cancel()
+		assert.False(t, blacklisted, "failure %d blacklisted a server with relay servers", i)
+		assert.False(t, server.Blacklisted())
+		maxDuration := time.Duration(math.Exp2(FailuresUntilBlacklist) * maxJitterMultiplier * float64(time.Second))
+		assert.LessOrEqual(t, time.Until(until), maxDuration)
+	}
+	blacklisted, err := db.IsServerBlacklisted("test.com")
+	assert.NoError(t, err)
+	assert.False(t, blacklisted)
+}
+
+func TestSetRelayServers(t *testing.T) {
+	db := test.NewInMemoryFederationDatabase()
+	stats := NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline, true)
+	server := stats.ForServer("test.com")
+	server.AddRelayServers([]spec.ServerName{"relay1"})
+	assert.NoError(t, db.AddServerToBlacklist("test.com"))
+
+	// A fresh set of statistics should load the blacklist and relay servers from the database.
+	stats = NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline, true)
+	server = stats.ForServer("test.com")
+	assert.True(t, server.Blacklisted())
+	server.SetRelayServers([]spec.ServerName{"relay2", "relay3"})
+	assert.Equal(t, []spec.ServerName{"relay2", "relay3"}, server.KnownRelayServers())
+	assert.False(t, server.Blacklisted())
+
+	stats = NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline, true)
+	server = stats.ForServer("test.com")
+	assert.Equal(t, []spec.ServerName{"relay2", "relay3"}, server.KnownRelayServers())
+	assert.False(t, server.Blacklisted())
+}
@@ -0,0 +1,165 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const serverSigningKeysSchema = `
+-- A cache of signing keys downloaded from remote servers.
+CREATE TABLE IF NOT EXISTS keydb_server_keys (
+	-- The name of the matrix server the key is for.
+	server_name string NOT NULL,
+	-- The ID of the server key.
+	server_key_id string NOT NULL,
+	-- Combined server name and key ID separated by the ASCII unit separator
+	-- to make it easier to run bulk queries.
+	server_name_and_key_id string NOT NULL,
+	-- When the key is valid until as a millisecond timestamp.
+	-- 0 if this is an expired key (in which case expired_ts will be non-zero)
+	valid_until_ts int64 NOT NULL,
+	-- When the key expired as a millisecond timestamp.
+	-- 0 if this is an active key (in which case valid_until_ts will be non-zero)
+	expired_ts int64 NOT NULL,
+	-- The base64-encoded public key.
+	server_key string NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS keydb_server_keys_unique ON keydb_server_keys (server_name, server_key_id);
+
+CREATE INDEX IF NOT EXISTS keydb_server_name_and_key_id ON keydb_server_keys (server_name_and_key_id);
+`
+
+const bulkSelectServerSigningKeysSQL = "" +
+	"SELECT server_name, server_key_id, valid_until_ts, expired_ts, " +
+	"   server_key FROM keydb_server_keys" +
+	" WHERE server_name_and_key_id IN ($1)"
+
+const insertServerSigningKeysSQL = "" +
+	"INSERT INTO keydb_server_keys (server_name, server_key_id," +
+	" server_name_and_key_id, valid_until_ts, expired_ts, server_key)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const updateServerSigningKeysSQL = "" +
+	"UPDATE keydb_server_keys SET valid_until_ts = $3, expired_ts = $4, server_key = $5" +
+	" WHERE server_name = $1 AND server_key_id = $2"
+
+type serverSigningKeyStatements struct {
+	db                   *sql.DB
+	insertServerKeysStmt *sql.Stmt
+	updateServerKeysStmt *sql.Stmt
+}
+
+func NewQLServerSigningKeysTable(db *sql.DB) (s *serverSigningKeyStatements, err error) {
+	s = &serverSigningKeyStatements{
+		db: db,
+	}
+	_, err = db.Exec(serverSigningKeysSchema)
+	if err != nil {
+		return
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertServerKeysStmt, insertServerSigningKeysSQL},
+		{&s.updateServerKeysStmt, updateServerSigningKeysSQL},
+	}.Prepare(db)
+}
+
+func (s *serverSigningKeyStatements) BulkSelectServerKeys(
+	ctx context.Context, txn *sql.Tx,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	nameAndKeyIDs := make([]interface{}, 0, len(requests))
+	for request := range requests {
+		nameAndKeyIDs = append(nameAndKeyIDs, nameAndKeyID(request))
+	}
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(requests))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectServerSigningKeysSQL, s.db, nameAndKeyIDs, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var serverName string
+			var keyID string
+			var key string
+			var validUntilTS int64
+			var expiredTS int64
+			var vk gomatrixserverlib.VerifyKey
+			for rows.Next() {
+				if err := rows.Scan(&serverName, &keyID, &validUntilTS, &expiredTS, &key); err != nil {
+					return err
+				}
+				r := gomatrixserverlib.PublicKeyLookupRequest{
+					ServerName: spec.ServerName(serverName),
+					KeyID:      gomatrixserverlib.KeyID(keyID),
+				}
+				if err := vk.Key.Decode(key); err != nil {
+					return err
+				}
+				results[r] = gomatrixserverlib.PublicKeyLookupResult{
+					VerifyKey:    vk,
+					ValidUntilTS: spec.Timestamp(validUntilTS),
+					ExpiredTS:    spec.Timestamp(expiredTS),
+				}
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *serverSigningKeyStatements) UpsertServerKeys(
+	ctx context.Context, txn *sql.Tx,
+	request gomatrixserverlib.PublicKeyLookupRequest,
+	key gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateServerKeysStmt)
+	res, err := stmt.ExecContext(
+		ctx,
+		string(request.ServerName),
+		string(request.KeyID),
+		key.ValidUntilTS,
+		key.ExpiredTS,
+		key.Key.Encode(),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	stmt = sqlutil.TxStmt(txn, s.insertServerKeysStmt)
+	_, err = stmt.ExecContext(
+		ctx,
+		string(request.ServerName),
+		string(request.KeyID),
+		nameAndKeyID(request),
+		key.ValidUntilTS,
+		key.ExpiredTS,
+		key.Key.Encode(),
+	)
+	return err
+}
+
+func nameAndKeyID(request gomatrixserverlib.PublicKeyLookupRequest) string {
+	return string(request.ServerName) + "\x1F" + string(request.KeyID)
+}
@@ -39,6 +39,8 @@ type Database struct {
 	FederationQueueJSON      tables.FederationQueueJSON
 	FederationJoinedHosts    tables.FederationJoinedHosts
 	FederationBlacklist      tables.FederationBlacklist
+	FederationAssumedOffline tables.FederationAssumedOffline
+	FederationRelayServers   tables.FederationRelayServers
 	NotaryServerKeysJSON     tables.FederationNotaryServerKeysJSON
 	NotaryServerKeysMetadata tables.FederationNotaryServerKeysMetadata
 	ServerSigningKeys        tables.FederationServerSigningKeys
@@ -172,6 +174,80 @@ func (d *Database) IsServerBlacklisted(
 	return d.FederationBlacklist.SelectBlacklist(context.TODO(), nil, serverName)
 }
 
+func (d *Database) SetServerAssumedOffline(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationAssumedOffline.InsertAssumedOffline(ctx, txn, serverName)
+	})
+}
+
+func (d *Database) RemoveServerAssumedOffline(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationAssumedOffline.DeleteAssumedOffline(ctx, txn, serverName)
+	})
+}
+
+func (d *Database) RemoveAllServersAssumedOffline(
+	ctx context.Context,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationAssumedOffline.DeleteAllAssumedOffline(ctx, txn)
+	})
+}
+
+func (d *Database) IsServerAssumedOffline(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (bool, error) {
+	return d.FederationAssumedOffline.SelectAssumedOffline(ctx, nil, serverName)
+}
+
+// P2PAddRelayServersForServer stores the given relay servers as being able
+// to store and forward transactions for the destination.
+func (d *Database) P2PAddRelayServersForServer(
+	ctx context.Context,
+	serverName spec.ServerName,
+	relayServers []spec.ServerName,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationRelayServers.InsertRelayServers(ctx, txn, serverName, relayServers)
+	})
+}
+
+// P2PGetRelayServersForServer returns the known relay servers for the destination.
+func (d *Database) P2PGetRelayServersForServer(
+	ctx context.Context,
+	serverName spec.ServerName,
+) ([]spec.ServerName, error) {
+	return d.FederationRelayServers.SelectRelayServers(ctx, nil, serverName)
+}
+
+// P2PRemoveRelayServersForServer removes the given relay servers for the destination.
+func (d *Database) P2PRemoveRelayServersForServer(
+	ctx context.Context,
+	serverName spec.ServerName,
+	relayServers []spec.ServerName,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationRelayServers.DeleteRelayServers(ctx, txn, serverName, relayServers)
+	})
+}
+
+// P2PRemoveAllRelayServersForServer removes all known relay servers for the destination.
+func (d *Database) P2PRemoveAllRelayServersForServer(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationRelayServers.DeleteAllRelayServers(ctx, txn, serverName)
+	})
+}
+
 func (d *Database) UpdateNotaryKeys(
 	ctx context.Context,
 	serverName spec.ServerName,
@@ -0,0 +1,69 @@
+package tables_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/federationapi/storage/postgres"
+	"github.com/matrix-org/dendrite/federationapi/storage/ql"
+	"github.com/matrix-org/dendrite/federationapi/storage/tables"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCreateAssumedOfflineTable(t *testing.T, dbType test.DBType) (tables.FederationAssumedOffline, func()) {
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewDummyWriter())
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	var tab tables.FederationAssumedOffline
+	switch dbType {
+	case test.DBTypeQL:
+		tab, err = ql.NewQLAssumedOfflineTable(db)
+	case test.DBTypePostgres:
+		tab, err = postgres.NewPostgresAssumedOfflineTable(db)
+	}
+	if err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	return tab, close
+}
+
+func TestAssumedOfflineTable(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		ctx := context.Background()
+		tab, close := mustCreateAssumedOfflineTable(t, dbType)
+		defer close()
+
+		offline, err := tab.SelectAssumedOffline(ctx, nil, server1)
+		assert.NoError(t, err)
+		assert.False(t, offline)
+
+		// Inserting the same server twice is a no-op
+		assert.NoError(t, tab.InsertAssumedOffline(ctx, nil, server1))
+		assert.NoError(t, tab.InsertAssumedOffline(ctx, nil, server1))
+		assert.NoError(t, tab.InsertAssumedOffline(ctx, nil, server2))
+
+		offline, err = tab.SelectAssumedOffline(ctx, nil, server1)
+		assert.NoError(t, err)
+		assert.True(t, offline)
+
+		assert.NoError(t, tab.DeleteAssumedOffline(ctx, nil, server1))
+		offline, err = tab.SelectAssumedOffline(ctx, nil, server1)
+		assert.NoError(t, err)
+		assert.False(t, offline)
+		offline, err = tab.SelectAssumedOffline(ctx, nil, server2)
+		assert.NoError(t, err)
+		assert.True(t, offline)
+
+		assert.NoError(t, tab.DeleteAllAssumedOffline(ctx, nil))
+		offline, err = tab.SelectAssumedOffline(ctx, nil, server2)
+		assert.NoError(t, err)
+		assert.False(t, offline)
+	})
+}
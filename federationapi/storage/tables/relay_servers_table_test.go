@@ -0,0 +1,80 @@
+package tables_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/federationapi/storage/postgres"
+	"github.com/matrix-org/dendrite/federationapi/storage/ql"
+	"github.com/matrix-org/dendrite/federationapi/storage/tables"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	server1 = "server1"
+	server2 = "server2"
+	server3 = "server3"
+	server4 = "server4"
+)
+
+func mustCreateRelayServersTable(t *testing.T, dbType test.DBType) (tables.FederationRelayServers, func()) {
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewDummyWriter())
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	var tab tables.FederationRelayServers
+	switch dbType {
+	case test.DBTypeQL:
+		tab, err = ql.NewQLRelayServersTable(db)
+	case test.DBTypePostgres:
+		tab, err = postgres.NewPostgresRelayServersTable(db)
+	}
+	if err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	return tab, close
+}
+
+func TestRelayServersTable(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		ctx := context.Background()
+		tab, close := mustCreateRelayServersTable(t, dbType)
+		defer close()
+
+		// Inserting the same relay server twice is a no-op
+		err := tab.InsertRelayServers(ctx, nil, server1, []spec.ServerName{server2, server3, server2})
+		assert.NoError(t, err)
+		err = tab.InsertRelayServers(ctx, nil, server4, []spec.ServerName{server2})
+		assert.NoError(t, err)
+
+		relayServers, err := tab.SelectRelayServers(ctx, nil, server1)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []spec.ServerName{server2, server3}, relayServers)
+
+		// Only the given relay servers for the given destination are removed
+		err = tab.DeleteRelayServers(ctx, nil, server1, []spec.ServerName{server2})
+		assert.NoError(t, err)
+		relayServers, err = tab.SelectRelayServers(ctx, nil, server1)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []spec.ServerName{server3}, relayServers)
+		relayServers, err = tab.SelectRelayServers(ctx, nil, server4)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []spec.ServerName{server2}, relayServers)
+
+		err = tab.DeleteAllRelayServers(ctx, nil, server1)
+		assert.NoError(t, err)
+		relayServers, err = tab.SelectRelayServers(ctx, nil, server1)
+		assert.NoError(t, err)
+		assert.Empty(t, relayServers)
+		relayServers, err = tab.SelectRelayServers(ctx, nil, server4)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []spec.ServerName{server2}, relayServers)
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/federationapi/storage/postgres"
+	"github.com/matrix-org/dendrite/federationapi/storage/ql"
 	"github.com/matrix-org/dendrite/federationapi/storage/tables"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -16,7 +17,7 @@ import (
 )
 
 func mustCreateServerKeyDB(t *testing.T, dbType test.DBType) (tables.FederationServerSigningKeys, func()) {
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
 	}, sqlutil.NewDummyWriter())
@@ -25,6 +26,8 @@ func mustCreateServerKeyDB(t *testing.T, dbType test.DBType) (tables.FederationS
 	}
 	var tab tables.FederationServerSigningKeys
 	switch dbType {
+	case test.DBTypeQL:
+		tab, err = ql.NewQLServerSigningKeysTable(db)
 	case test.DBTypePostgres:
 		tab, err = postgres.NewPostgresServerSigningKeysTable(db)
 	}
@@ -192,3 +192,18 @@ func RedactEvent(ctx context.Context, redactionEvent, redactedEvent gomatrixserv
 	}
 	return nil
 }
+
+// StrippedStateTuples returns the state events which should be shared, in
+// stripped form, with users who are invited to or have knocked on a room.
+// https://spec.matrix.org/v1.9/client-server-api/#stripped-state
+func StrippedStateTuples() []gomatrixserverlib.StateKeyTuple {
+	return []gomatrixserverlib.StateKeyTuple{
+		{EventType: spec.MRoomCreate, StateKey: ""},
+		{EventType: spec.MRoomName, StateKey: ""},
+		{EventType: spec.MRoomAvatar, StateKey: ""},
+		{EventType: spec.MRoomTopic, StateKey: ""},
+		{EventType: spec.MRoomCanonicalAlias, StateKey: ""},
+		{EventType: spec.MRoomEncryption, StateKey: ""},
+		{EventType: spec.MRoomJoinRules, StateKey: ""},
+	}
+}
@@ -49,6 +49,18 @@ type NotificationData struct {
 	// UnreadNotificationCount is the total number of unread
 	// notifications.
 	UnreadNotificationCount int `json:"unread_notification_count"`
+
+	// UnreadThreadNotifications contains the unread counts for each
+	// thread in the room, keyed by thread root event ID. These are
+	// included in the room-wide counts above.
+	UnreadThreadNotifications map[string]ThreadNotificationData `json:"unread_thread_notifications,omitempty"`
+}
+
+// ThreadNotificationData contains statistics about notifications in a
+// single thread.
+type ThreadNotificationData struct {
+	UnreadHighlightCount    int `json:"unread_highlight_count"`
+	UnreadNotificationCount int `json:"unread_notification_count"`
 }
 
 // UserProfile is a struct containing all known user profile data
@@ -18,12 +18,15 @@
 package fulltext
 
 import (
+	"os"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/blevesearch/bleve/v2"
 	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
 
 	// side effect imports to allow all possible languages
 	_ "github.com/blevesearch/bleve/v2/analysis/lang/ar"
@@ -52,16 +55,28 @@ import (
 	"github.com/matrix-org/dendrite/setup/config"
 )
 
+// indexVersion is the version of the index mapping. It has to be increased
+// whenever fields are added to the mapping, so that existing indexes are
+// rebuilt.
+const indexVersion = "2"
+
+var indexVersionKey = []byte("dendrite_index_version")
+
 // Search contains all existing bleve.Index
 type Search struct {
 	FulltextIndex bleve.Index
+	needsReindex  bool
 }
 
+// Indexer is implemented by the fulltext backends, see Search and Postgres.
 type Indexer interface {
 	Index(elements ...IndexElement) error
 	Delete(eventID string) error
-	Search(term string, roomIDs, keys []string, limit, from int, orderByStreamPos bool) (*bleve.SearchResult, error)
+	Search(term string, roomIDs, keys []string, filter SearchFilter, limit, from int, orderByStreamPos bool) (*bleve.SearchResult, error)
 	GetHighlights(result *bleve.SearchResult) []string
+	// NeedsReindex returns whether all events have to be indexed again, e.g.
+	// because the index was rebuilt.
+	NeedsReindex() bool
 	Close() error
 }
 
@@ -69,9 +84,22 @@ type Indexer interface {
 type IndexElement struct {
 	EventID        string
 	RoomID         string
+	Sender         string
 	Content        string
 	ContentType    string
 	StreamPosition int64
+	OriginServerTS int64
+}
+
+// SearchFilter restricts the results of a search further.
+type SearchFilter struct {
+	// Senders and NotSenders match the Sender of the indexed elements.
+	Senders    []string
+	NotSenders []string
+	// FromTS and ToTS restrict the OriginServerTS of the results, both
+	// inclusive. Zero values are ignored.
+	FromTS int64
+	ToTS   int64
 }
 
 // SetContentType sets i.ContentType given an identifier
@@ -89,7 +117,7 @@ func (i *IndexElement) SetContentType(v string) {
 // New opens a new/existing fulltext index
 func New(processCtx *process.ProcessContext, cfg config.Fulltext) (fts *Search, err error) {
 	fts = &Search{}
-	fts.FulltextIndex, err = openIndex(cfg)
+	fts.FulltextIndex, fts.needsReindex, err = openIndex(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -108,6 +136,11 @@ func (f *Search) Close() error {
 	return f.FulltextIndex.Close()
 }
 
+// NeedsReindex returns whether an outdated index was replaced by an empty one.
+func (f *Search) NeedsReindex() bool {
+	return f.needsReindex
+}
+
 // Index indexes the given elements
 func (f *Search) Index(elements ...IndexElement) error {
 	batch := f.FulltextIndex.NewBatch()
@@ -130,6 +163,12 @@ var highlightMatcher = regexp.MustCompile("<mark>(.*?)</mark>")
 
 // GetHighlights extracts the highlights from a SearchResult.
 func (f *Search) GetHighlights(result *bleve.SearchResult) []string {
+	return GetHighlights(result)
+}
+
+// GetHighlights returns the highlighted words of the fragments of a
+// SearchResult.
+func GetHighlights(result *bleve.SearchResult) []string {
 	if result == nil {
 		return []string{}
 	}
@@ -164,11 +203,12 @@ func (f *Search) GetHighlights(result *bleve.SearchResult) []string {
 	for m := range seenMatches {
 		res = append(res, m)
 	}
+	sort.Strings(res)
 	return res
 }
 
-// Search searches the index given a search term, roomIDs and keys.
-func (f *Search) Search(term string, roomIDs, keys []string, limit, from int, orderByStreamPos bool) (*bleve.SearchResult, error) {
+// Search searches the index given a search term, roomIDs, keys and filter.
+func (f *Search) Search(term string, roomIDs, keys []string, filter SearchFilter, limit, from int, orderByStreamPos bool) (*bleve.SearchResult, error) {
 	qry := bleve.NewConjunctionQuery()
 	termQuery := bleve.NewBooleanQuery()
 
@@ -198,6 +238,35 @@ func (f *Search) Search(term string, roomIDs, keys []string, limit, from int, or
 	if len(keys) > 0 {
 		qry.AddQuery(keyQuery)
 	}
+	senderQuery := bleve.NewBooleanQuery()
+	for _, sender := range filter.Senders {
+		senderSearch := bleve.NewMatchQuery(sender)
+		senderSearch.SetField("Sender")
+		senderQuery.AddShould(senderSearch)
+	}
+	for _, sender := range filter.NotSenders {
+		senderSearch := bleve.NewMatchQuery(sender)
+		senderSearch.SetField("Sender")
+		senderQuery.AddMustNot(senderSearch)
+	}
+	if len(filter.Senders) > 0 || len(filter.NotSenders) > 0 {
+		qry.AddQuery(senderQuery)
+	}
+	if filter.FromTS > 0 || filter.ToTS > 0 {
+		var min, max *float64
+		inclusive := true
+		if filter.FromTS > 0 {
+			fromTS := float64(filter.FromTS)
+			min = &fromTS
+		}
+		if filter.ToTS > 0 {
+			toTS := float64(filter.ToTS)
+			max = &toTS
+		}
+		tsQuery := bleve.NewNumericRangeInclusiveQuery(min, max, &inclusive, &inclusive)
+		tsQuery.SetField("OriginServerTS")
+		qry.AddQuery(tsQuery)
+	}
 
 	s := bleve.NewSearchRequestOptions(qry, limit, from, false)
 	s.Fields = []string{"*"}
@@ -213,20 +282,56 @@ func (f *Search) Search(term string, roomIDs, keys []string, limit, from int, or
 	return f.FulltextIndex.Search(s)
 }
 
-func openIndex(cfg config.Fulltext) (bleve.Index, error) {
+// openIndex opens the index, creating it if needed. Returns true if an
+// existing index was outdated and has been replaced by an empty one.
+func openIndex(cfg config.Fulltext) (bleve.Index, bool, error) {
 	m := getMapping(cfg)
 	if cfg.InMemory {
-		return bleve.NewMemOnly(m)
+		index, err := bleve.NewMemOnly(m)
+		return index, false, err
 	}
+	var replaced bool
 	if index, err := bleve.Open(string(cfg.IndexPath)); err == nil {
-		return index, nil
+		version, err := index.GetInternal(indexVersionKey)
+		if err == nil && string(version) == indexVersion && indexLanguage(index) == cfg.Language {
+			return index, false, nil
+		}
+		// The mapping of an existing index can't be changed, so start over.
+		logrus.Warnf("Fulltext index at %s is outdated or uses a different language, rebuilding it", cfg.IndexPath)
+		if err = index.Close(); err != nil {
+			return nil, false, err
+		}
+		if err = os.RemoveAll(string(cfg.IndexPath)); err != nil {
+			return nil, false, err
+		}
+		replaced = true
 	}
 
 	index, err := bleve.New(string(cfg.IndexPath), m)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	if err = index.SetInternal(indexVersionKey, []byte(indexVersion)); err != nil {
+		return nil, false, err
+	}
+	return index, replaced, nil
+}
+
+// indexLanguage returns the analyzer used for the content of an index.
+func indexLanguage(index bleve.Index) string {
+	m, ok := index.Mapping().(*mapping.IndexMappingImpl)
+	if !ok {
+		return ""
+	}
+	eventMapping, ok := m.TypeMapping["Event"]
+	if !ok {
+		return ""
+	}
+	contentMapping, ok := eventMapping.Properties["Content"]
+	if !ok || len(contentMapping.Fields) == 0 {
+		return ""
 	}
-	return index, nil
+	return contentMapping.Fields[0].Analyzer
 }
 
 func getMapping(cfg config.Fulltext) *mapping.IndexMappingImpl {
@@ -236,12 +341,14 @@ func getMapping(cfg config.Fulltext) *mapping.IndexMappingImpl {
 	eventMapping := bleve.NewDocumentMapping()
 	eventMapping.AddFieldMappingsAt("Content", enFieldMapping)
 	eventMapping.AddFieldMappingsAt("StreamPosition", bleve.NewNumericFieldMapping())
+	eventMapping.AddFieldMappingsAt("OriginServerTS", bleve.NewNumericFieldMapping())
 
 	// Index entries as is
 	idFieldMapping := bleve.NewKeywordFieldMapping()
 	eventMapping.AddFieldMappingsAt("ContentType", idFieldMapping)
 	eventMapping.AddFieldMappingsAt("RoomID", idFieldMapping)
 	eventMapping.AddFieldMappingsAt("EventID", idFieldMapping)
+	eventMapping.AddFieldMappingsAt("Sender", idFieldMapping)
 
 	indexMapping := bleve.NewIndexMapping()
 	indexMapping.AddDocumentMapping("Event", eventMapping)
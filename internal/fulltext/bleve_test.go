@@ -23,9 +23,20 @@ import (
 	"github.com/matrix-org/util"
 
 	"github.com/matrix-org/dendrite/internal/fulltext"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/test"
 )
 
+// backends opens an empty index of each backend.
+var backends = map[string]func(t *testing.T) (fulltext.Indexer, *process.ProcessContext){
+	"bleve": func(t *testing.T) (fulltext.Indexer, *process.ProcessContext) {
+		return mustOpenIndex(t, "")
+	},
+	"postgres": mustOpenPostgresIndex,
+}
+
 func mustOpenIndex(t *testing.T, tempDir string) (*fulltext.Search, *process.ProcessContext) {
 	t.Helper()
 	cfg := config.Fulltext{
@@ -45,7 +56,24 @@ func mustOpenIndex(t *testing.T, tempDir string) (*fulltext.Search, *process.Pro
 	return fts, ctx
 }
 
-func mustAddTestData(t *testing.T, fts *fulltext.Search, firstStreamPos int64) (eventIDs, roomIDs []string) {
+func mustOpenPostgresIndex(t *testing.T) (fulltext.Indexer, *process.ProcessContext) {
+	t.Helper()
+	connStr, closeDB := test.PrepareDBConnectionString(t, test.DBTypePostgres)
+	t.Cleanup(closeDB)
+	ctx := process.NewProcessContext()
+	cm := sqlutil.NewConnectionManager(ctx, config.DatabaseOptions{})
+	fts, err := storage.NewFulltextIndex(ctx, cm, &config.DatabaseOptions{ConnectionString: config.DataSource(connStr)}, config.Fulltext{
+		Enabled:  true,
+		Backend:  config.FulltextBackendPostgres,
+		Language: "en",
+	})
+	if err != nil {
+		t.Fatal("failed to open fulltext index:", err)
+	}
+	return fts, ctx
+}
+
+func mustAddTestData(t *testing.T, fts fulltext.Indexer, firstStreamPos int64) (eventIDs, roomIDs []string) {
 	t.Helper()
 	// create some more random data
 	var batchItems []fulltext.IndexElement
@@ -60,11 +88,17 @@ func mustAddTestData(t *testing.T, fts *fulltext.Search, firstStreamPos int64) (
 		if i > 15 {
 			wantRoomID = util.RandomString(16)
 		}
+		sender := "@alice:test"
+		if i%2 == 1 {
+			sender = "@bob:test"
+		}
 		e := fulltext.IndexElement{
 			EventID:        eventID,
 			RoomID:         wantRoomID,
+			Sender:         sender,
 			Content:        "lorem ipsum",
 			StreamPosition: streamPos,
+			OriginServerTS: streamPos * 1000,
 		}
 		e.SetContentType("m.room.message")
 		batchItems = append(batchItems, e)
@@ -103,6 +137,108 @@ func TestOpen(t *testing.T) {
 	ctx.ShutdownDendrite()
 }
 
+func TestOpenPostgresLanguages(t *testing.T) {
+	connStr, closeDB := test.PrepareDBConnectionString(t, test.DBTypePostgres)
+	t.Cleanup(closeDB)
+	ctx := process.NewProcessContext()
+	defer ctx.ShutdownDendrite()
+	cm := sqlutil.NewConnectionManager(ctx, config.DatabaseOptions{})
+	for language, wantErr := range map[string]bool{
+		"de":      false, // mapped to a text search configuration
+		"english": false, // the name of a text search configuration
+		"xx":      true,
+	} {
+		_, err := storage.NewFulltextIndex(ctx, cm, &config.DatabaseOptions{ConnectionString: config.DataSource(connStr)}, config.Fulltext{
+			Enabled:  true,
+			Backend:  config.FulltextBackendPostgres,
+			Language: language,
+		})
+		if gotErr := err != nil; gotErr != wantErr {
+			t.Fatalf("language %q: expected error %v, got %v", language, wantErr, err)
+		}
+	}
+}
+
+func TestOpenPostgresLanguageChanged(t *testing.T) {
+	connStr, closeDB := test.PrepareDBConnectionString(t, test.DBTypePostgres)
+	t.Cleanup(closeDB)
+	ctx := process.NewProcessContext()
+	defer ctx.ShutdownDendrite()
+	cm := sqlutil.NewConnectionManager(ctx, config.DatabaseOptions{})
+	open := func(language string) fulltext.Indexer {
+		t.Helper()
+		fts, err := storage.NewFulltextIndex(ctx, cm, &config.DatabaseOptions{ConnectionString: config.DataSource(connStr)}, config.Fulltext{
+			Enabled:  true,
+			Backend:  config.FulltextBackendPostgres,
+			Language: language,
+		})
+		if err != nil {
+			t.Fatal("failed to open fulltext index:", err)
+		}
+		return fts
+	}
+
+	if !open("en").NeedsReindex() {
+		t.Fatal("expected an empty index to need a reindex")
+	}
+	mustAddTestData(t, open("en"), 0)
+	if open("en").NeedsReindex() {
+		t.Fatal("expected an index with the same language not to need a reindex")
+	}
+	if !open("de").NeedsReindex() {
+		t.Fatal("expected an index with a different language to need a reindex")
+	}
+}
+
+func TestOpenOutdated(t *testing.T) {
+	dataDir := t.TempDir()
+	fts, ctx := mustOpenIndex(t, dataDir)
+	if fts.NeedsReindex() {
+		t.Fatal("expected a new index not to need a reindex")
+	}
+	mustAddTestData(t, fts, 0)
+	// pretend the index was created by an older version
+	if err := fts.FulltextIndex.SetInternal([]byte("dendrite_index_version"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	ctx.ShutdownDendrite()
+
+	fts, ctx = mustOpenIndex(t, dataDir)
+	defer ctx.ShutdownDendrite()
+	if !fts.NeedsReindex() {
+		t.Fatal("expected an outdated index to need a reindex")
+	}
+	count, err := fts.FulltextIndex.DocCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("expected the outdated index to be replaced, got %d documents", count)
+	}
+}
+
+func TestOpenLanguageChanged(t *testing.T) {
+	dataDir := t.TempDir()
+	fts, ctx := mustOpenIndex(t, dataDir)
+	mustAddTestData(t, fts, 0)
+	ctx.ShutdownDendrite()
+
+	cfg := config.Fulltext{
+		Enabled:   true,
+		IndexPath: config.Path(dataDir),
+		Language:  "de",
+	}
+	ctx = process.NewProcessContext()
+	defer ctx.ShutdownDendrite()
+	fts, err := fulltext.New(ctx, cfg)
+	if err != nil {
+		t.Fatal("failed to open fulltext index:", err)
+	}
+	if !fts.NeedsReindex() {
+		t.Fatal("expected an index with a different language to need a reindex")
+	}
+}
+
 func TestIndex(t *testing.T) {
 	fts, ctx := mustOpenIndex(t, "")
 	defer ctx.ShutdownDendrite()
@@ -128,10 +264,18 @@ func TestIndex(t *testing.T) {
 }
 
 func TestDelete(t *testing.T) {
-	fts, ctx := mustOpenIndex(t, "")
-	defer ctx.ShutdownDendrite()
+	for backend, open := range backends {
+		t.Run(backend, func(t *testing.T) {
+			fts, ctx := open(t)
+			defer ctx.ShutdownDendrite()
+			testDelete(t, fts)
+		})
+	}
+}
+
+func testDelete(t *testing.T, fts fulltext.Indexer) {
 	eventIDs, roomIDs := mustAddTestData(t, fts, 0)
-	res1, err := fts.Search("lorem", roomIDs[:1], nil, 50, 0, false)
+	res1, err := fts.Search("lorem", roomIDs[:1], nil, fulltext.SearchFilter{}, 50, 0, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -140,7 +284,7 @@ func TestDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	res2, err := fts.Search("lorem", roomIDs[:1], nil, 50, 0, false)
+	res2, err := fts.Search("lorem", roomIDs[:1], nil, fulltext.SearchFilter{}, 50, 0, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -158,6 +302,7 @@ func TestSearch(t *testing.T) {
 		from             int
 		orderByStreamPos bool
 		roomIndex        []int
+		filter           fulltext.SearchFilter
 	}
 	tests := []struct {
 		name           string
@@ -206,6 +351,36 @@ func TestSearch(t *testing.T) {
 				orderByStreamPos: true,
 			},
 		},
+		{
+			name:           "Can search for results of a sender",
+			wantCount:      15,
+			wantHighlights: []string{"lorem"},
+			args: args{
+				term:   "lorem",
+				limit:  30,
+				filter: fulltext.SearchFilter{Senders: []string{"@bob:test"}},
+			},
+		},
+		{
+			name:           "Can exclude results of a sender",
+			wantCount:      15,
+			wantHighlights: []string{"lorem"},
+			args: args{
+				term:   "lorem",
+				limit:  30,
+				filter: fulltext.SearchFilter{NotSenders: []string{"@bob:test"}},
+			},
+		},
+		{
+			name:           "Can search for results in a time range",
+			wantCount:      10,
+			wantHighlights: []string{"lorem"},
+			args: args{
+				term:   "lorem",
+				limit:  30,
+				filter: fulltext.SearchFilter{FromTS: 11000, ToTS: 20000},
+			},
+		},
 		{
 			name:           "Can search for specific search room name",
 			wantCount:      1,
@@ -231,35 +406,37 @@ func TestSearch(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			f, ctx := mustOpenIndex(t, "")
-			defer ctx.ShutdownDendrite()
-			eventIDs, roomIDs := mustAddTestData(t, f, 0)
-			var searchRooms []string
-			for _, x := range tt.args.roomIndex {
-				searchRooms = append(searchRooms, roomIDs[x])
-			}
-			t.Logf("searching in rooms: %v - %v\n", searchRooms, tt.args.keys)
-
-			got, err := f.Search(tt.args.term, searchRooms, tt.args.keys, tt.args.limit, tt.args.from, tt.args.orderByStreamPos)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("Search() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-
-			highlights := f.GetHighlights(got)
-			if !reflect.DeepEqual(highlights, tt.wantHighlights) {
-				t.Errorf("Search() got highligts = %v, want %v", highlights, tt.wantHighlights)
-			}
-
-			if !reflect.DeepEqual(len(got.Hits), tt.wantCount) {
-				t.Errorf("Search() got = %v, want %v", len(got.Hits), tt.wantCount)
-			}
-			if tt.args.orderByStreamPos {
-				if got.Hits[0].ID != eventIDs[29] {
-					t.Fatalf("expected ID %s, got %s", eventIDs[29], got.Hits[0].ID)
+		for backend, open := range backends {
+			t.Run(tt.name+"/"+backend, func(t *testing.T) {
+				f, ctx := open(t)
+				defer ctx.ShutdownDendrite()
+				eventIDs, roomIDs := mustAddTestData(t, f, 0)
+				var searchRooms []string
+				for _, x := range tt.args.roomIndex {
+					searchRooms = append(searchRooms, roomIDs[x])
 				}
-			}
-		})
+				t.Logf("searching in rooms: %v - %v\n", searchRooms, tt.args.keys)
+
+				got, err := f.Search(tt.args.term, searchRooms, tt.args.keys, tt.args.filter, tt.args.limit, tt.args.from, tt.args.orderByStreamPos)
+				if (err != nil) != tt.wantErr {
+					t.Errorf("Search() error = %v, wantErr %v", err, tt.wantErr)
+					return
+				}
+
+				highlights := f.GetHighlights(got)
+				if !reflect.DeepEqual(highlights, tt.wantHighlights) {
+					t.Errorf("Search() got highligts = %v, want %v", highlights, tt.wantHighlights)
+				}
+
+				if !reflect.DeepEqual(len(got.Hits), tt.wantCount) {
+					t.Errorf("Search() got = %v, want %v", len(got.Hits), tt.wantCount)
+				}
+				if tt.args.orderByStreamPos {
+					if got.Hits[0].ID != eventIDs[29] {
+						t.Fatalf("expected ID %s, got %s", eventIDs[29], got.Hits[0].ID)
+					}
+				}
+			})
+		}
 	}
 }
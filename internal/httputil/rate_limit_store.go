@@ -0,0 +1,215 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// RateLimitStore keeps track of the requests made by callers.
+type RateLimitStore interface {
+	// Take counts a request against the given key, allowing bursts of up to
+	// threshold requests which are freed again after the cooloff. If the
+	// request isn't allowed, returns how long the caller has to wait.
+	Take(ctx context.Context, key string, threshold int64, cooloff time.Duration) (time.Duration, error)
+}
+
+// leak works out whether a request is allowed by a leaky bucket which is full
+// at the given time. Each request fills the bucket by cooloff/threshold, so
+// that threshold requests can be made at once. Returns the time the bucket
+// will be empty after the request, or how long to wait if it would overflow.
+func leak(now, full time.Time, threshold int64, cooloff time.Duration) (time.Time, time.Duration) {
+	if threshold <= 0 {
+		return full, 0
+	}
+	if full.Before(now) {
+		full = now
+	}
+	full = full.Add(cooloff / time.Duration(threshold))
+	if wait := full.Sub(now) - cooloff; wait > 0 {
+		return time.Time{}, wait
+	}
+	return full, 0
+}
+
+// MemoryRateLimitStore keeps rate limiting state in memory, so it is not
+// shared with other processes.
+type MemoryRateLimitStore struct {
+	buckets map[string]time.Time
+	mutex   sync.Mutex
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	s := &MemoryRateLimitStore{
+		buckets: map[string]time.Time{},
+	}
+	go s.clean()
+	return s
+}
+
+func (s *MemoryRateLimitStore) clean() {
+	for {
+		// On a 30 second interval, we'll take an exclusive lock of the
+		// entire map and remove any buckets which have emptied, freeing
+		// up memory.
+		time.Sleep(time.Second * 30)
+		now := time.Now()
+		s.mutex.Lock()
+		for k, full := range s.buckets {
+			if full.Before(now) {
+				delete(s.buckets, k)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, threshold int64, cooloff time.Duration) (time.Duration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	full, wait := leak(time.Now(), s.buckets[key], threshold, cooloff)
+	if wait > 0 {
+		return wait, nil
+	}
+	s.buckets[key] = full
+	return 0, nil
+}
+
+// How often to retry when another process updated the same key at once.
+const natsRateLimitStoreAttempts = 10
+
+// NATSRateLimitStore keeps rate limiting state in a NATS key-value bucket, so
+// that it is shared between all processes using the same NATS server.
+type NATSRateLimitStore struct {
+	kv nats.KeyValue
+}
+
+// NewNATSRateLimitStore uses the key-value bucket with the given name, creating
+// it if needed. Each key holds the time at which its bucket is empty, after
+// which the key is removed.
+func NewNATSRateLimitStore(js nats.JetStreamContext, bucket string) (*NATSRateLimitStore, error) {
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  bucket,
+			History: 1,
+			Storage: nats.MemoryStorage,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rate limiting bucket %q: %w", bucket, err)
+	}
+	s := &NATSRateLimitStore{kv: kv}
+	go s.clean()
+	return s, nil
+}
+
+func (s *NATSRateLimitStore) clean() {
+	for {
+		// On a 30 second interval, we'll remove any buckets which have
+		// emptied. Other processes may do the same at the same time.
+		time.Sleep(time.Second * 30)
+		if err := s.removeExpired(time.Now()); err != nil {
+			logrus.WithError(err).Warn("Failed to remove expired rate limits")
+		}
+	}
+}
+
+// removeExpired removes the keys of buckets which are empty at the given time.
+// Keys which were updated in the meantime are kept.
+func (s *NATSRateLimitStore) removeExpired(now time.Time) error {
+	keys, err := s.kv.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("s.kv.Keys: %w", err)
+	}
+	for _, key := range keys {
+		entry, err := s.kv.Get(key)
+		if err != nil {
+			continue
+		}
+		if full, ok := decodeRateLimitFull(entry.Value()); ok && full.After(now) {
+			continue
+		}
+		if err = s.kv.Delete(key, nats.LastRevision(entry.Revision())); err != nil {
+			var apiErr *nats.APIError
+			if errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence {
+				continue // someone else updated the key in the meantime
+			}
+			return fmt.Errorf("s.kv.Delete: %w", err)
+		}
+	}
+	// Also drop the delete markers left behind, so that they don't pile up.
+	if err = s.kv.PurgeDeletes(); err != nil {
+		return fmt.Errorf("s.kv.PurgeDeletes: %w", err)
+	}
+	return nil
+}
+
+func decodeRateLimitFull(value []byte) (time.Time, bool) {
+	if len(value) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(value))), true
+}
+
+func (s *NATSRateLimitStore) Take(ctx context.Context, key string, threshold int64, cooloff time.Duration) (time.Duration, error) {
+	// Keys may only contain a limited set of characters.
+	key = base64.RawURLEncoding.EncodeToString([]byte(key))
+	for attempt := 0; attempt < natsRateLimitStoreAttempts; attempt++ {
+		var full time.Time
+		var revision uint64
+		entry, err := s.kv.Get(key)
+		switch {
+		case errors.Is(err, nats.ErrKeyNotFound):
+		case err != nil:
+			return 0, fmt.Errorf("s.kv.Get: %w", err)
+		default:
+			full, _ = decodeRateLimitFull(entry.Value())
+			revision = entry.Revision()
+		}
+
+		full, wait := leak(time.Now(), full, threshold, cooloff)
+		if wait > 0 {
+			return wait, nil
+		}
+		value := binary.BigEndian.AppendUint64(nil, uint64(full.UnixNano()))
+		if revision == 0 {
+			_, err = s.kv.Create(key, value)
+		} else {
+			_, err = s.kv.Update(key, value, revision)
+		}
+		switch {
+		case err == nil:
+			return 0, nil
+		case errors.Is(err, nats.ErrKeyExists):
+			// Someone else updated the key in the meantime, try again.
+		default:
+			return 0, fmt.Errorf("s.kv.Update: %w", err)
+		}
+	}
+	return 0, fmt.Errorf("too many conflicting updates to rate limiting key")
+}
@@ -1,7 +1,9 @@
 package httputil
 
 import (
+	"context"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -9,67 +11,113 @@ import (
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
+	"github.com/nats-io/nats.go"
 )
 
+// Classes of rate-limited endpoints. Apart from the default class, they match
+// the keys of the buckets in the rate limiting config.
+const (
+	RateLimitDefault      = ""
+	RateLimitLogin        = "login"
+	RateLimitRegistration = "registration"
+	RateLimitMessage      = "message"
+	RateLimitJoin         = "join"
+	RateLimitInvite       = "invite"
+	RateLimitMediaUpload  = "media_upload"
+	RateLimitFederation   = "federation"
+)
+
+// How long per-user overrides are cached for. Changes made through the admin
+// API are picked up by other processes after this time.
+const rateLimitOverrideCacheTime = time.Minute
+
 type RateLimits struct {
-	limits           map[string]chan struct{}
-	limitsMutex      sync.RWMutex
-	cleanMutex       sync.RWMutex
-	enabled          bool
-	requestThreshold int64
-	cooloffDuration  time.Duration
-	exemptUserIDs    map[string]struct{}
+	store         RateLimitStore
+	overrides     userapi.RateLimitOverrideAPI
+	enabled       bool
+	defaultBucket rateLimitBucket
+	buckets       map[string]rateLimitBucket
+	exemptUserIDs map[string]struct{}
+
+	overrideCache      map[string]cachedRateLimitOverride
+	overrideCacheMutex sync.Mutex
+}
+
+type rateLimitBucket struct {
+	threshold int64
+	cooloff   time.Duration
 }
 
-func NewRateLimits(cfg *config.RateLimiting) *RateLimits {
+type cachedRateLimitOverride struct {
+	override *userapi.RateLimitOverride
+	expires  time.Time
+}
+
+// NewRateLimits creates rate limits using the given store to keep track of
+// requests. The overrides API is used to look up per-user limits and may be
+// nil if the endpoints are not used by users.
+func NewRateLimits(cfg *config.RateLimiting, store RateLimitStore, overrides userapi.RateLimitOverrideAPI) *RateLimits {
 	l := &RateLimits{
-		limits:           make(map[string]chan struct{}),
-		enabled:          cfg.Enabled,
-		requestThreshold: cfg.Threshold,
-		cooloffDuration:  time.Duration(cfg.CooloffMS) * time.Millisecond,
-		exemptUserIDs:    map[string]struct{}{},
+		store:     store,
+		overrides: overrides,
+		enabled:   cfg.Enabled,
+		defaultBucket: rateLimitBucket{
+			threshold: cfg.Threshold,
+			cooloff:   time.Duration(cfg.CooloffMS) * time.Millisecond,
+		},
+		buckets:       map[string]rateLimitBucket{},
+		exemptUserIDs: map[string]struct{}{},
+		overrideCache: map[string]cachedRateLimitOverride{},
+	}
+	for class, bucket := range cfg.Buckets() {
+		b := l.defaultBucket
+		if bucket.Threshold > 0 {
+			b.threshold = bucket.Threshold
+		}
+		if bucket.CooloffMS > 0 {
+			b.cooloff = time.Duration(bucket.CooloffMS) * time.Millisecond
+		}
+		l.buckets[class] = b
 	}
 	for _, userID := range cfg.ExemptUserIDs {
 		l.exemptUserIDs[userID] = struct{}{}
 	}
-	if l.enabled {
-		go l.clean()
-	}
 	return l
 }
 
-func (l *RateLimits) clean() {
-	for {
-		// On a 30 second interval, we'll take an exclusive write
-		// lock of the entire map and see if any of the channels are
-		// empty. If they are then we will close and delete them,
-		// freeing up memory.
-		time.Sleep(time.Second * 30)
-		l.cleanMutex.Lock()
-		l.limitsMutex.Lock()
-		for k, c := range l.limits {
-			if len(c) == 0 {
-				close(c)
-				delete(l.limits, k)
-			}
-		}
-		l.limitsMutex.Unlock()
-		l.cleanMutex.Unlock()
+// NewOriginRateLimits creates rate limits for inbound federation requests, which
+// are counted per origin server.
+func NewOriginRateLimits(cfg *config.FederationRateLimiting, store RateLimitStore) *RateLimits {
+	return &RateLimits{
+		store:   store,
+		enabled: cfg.Enabled,
+		buckets: map[string]rateLimitBucket{
+			RateLimitFederation: {
+				threshold: cfg.Threshold,
+				cooloff:   time.Duration(cfg.CooloffMS) * time.Millisecond,
+			},
+		},
 	}
 }
 
+// Limit rate limits requests to endpoints of the default class.
 func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSONResponse {
+	return l.LimitClass(req, device, RateLimitDefault)
+}
+
+// LimitClass rate limits requests to endpoints of the given class. Requests
+// are counted per device, or per host if the request isn't authenticated.
+// Returns a response to send to the client if the request was rate limited.
+func (l *RateLimits) LimitClass(req *http.Request, device *userapi.Device, class string) *util.JSONResponse {
 	// If rate limiting is disabled then do nothing.
 	if !l.enabled {
 		return nil
 	}
 
-	// Take a read lock out on the cleaner mutex. The cleaner expects to
-	// be able to take a write lock, which isn't possible while there are
-	// readers, so this has the effect of blocking the cleaner goroutine
-	// from doing its work until there are no requests in flight.
-	l.cleanMutex.RLock()
-	defer l.cleanMutex.RUnlock()
+	bucket, ok := l.buckets[class]
+	if !ok {
+		bucket = l.defaultBucket
+	}
 
 	// First of all, work out if X-Forwarded-For was sent to us. If not
 	// then we'll just use the IP address of the caller.
@@ -85,6 +133,15 @@ func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSON
 				// If the user is exempt from rate limiting then do nothing.
 				return nil
 			}
+			if override := l.override(req.Context(), device.UserID); override != nil {
+				if override.Threshold == 0 {
+					return nil // the user is exempt from rate limiting
+				}
+				bucket = rateLimitBucket{
+					threshold: override.Threshold,
+					cooloff:   time.Duration(override.CooloffMS) * time.Millisecond,
+				}
+			}
 			caller = device.UserID + device.ID
 		}
 	} else {
@@ -94,39 +151,90 @@ func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSON
 			caller = req.RemoteAddr
 		}
 	}
+	return l.take(req.Context(), class, caller, bucket)
+}
 
-	// Look up the caller's channel, if they have one.
-	l.limitsMutex.RLock()
-	rateLimit, ok := l.limits[caller]
-	l.limitsMutex.RUnlock()
+// LimitOrigin rate limits inbound federation requests from the given server.
+// The rate limits must have been created with NewOriginRateLimits.
+func (l *RateLimits) LimitOrigin(ctx context.Context, origin spec.ServerName) *util.JSONResponse {
+	if !l.enabled {
+		return nil
+	}
+	return l.take(ctx, RateLimitFederation, string(origin), l.buckets[RateLimitFederation])
+}
 
-	// If the caller doesn't have a channel, create one and write it
-	// back to the map.
-	if !ok {
-		rateLimit = make(chan struct{}, l.requestThreshold)
-
-		l.limitsMutex.Lock()
-		l.limits[caller] = rateLimit
-		l.limitsMutex.Unlock()
-	}
-
-	// Check if the user has got free resource slots for this request.
-	// If they don't then we'll return an error.
-	select {
-	case rateLimit <- struct{}{}:
-	default:
-		// We hit the rate limit. Tell the client to back off.
-		return &util.JSONResponse{
-			Code: http.StatusTooManyRequests,
-			JSON: spec.LimitExceeded("You are sending too many requests too quickly!", l.cooloffDuration.Milliseconds()),
+// InvalidateOverride forgets the cached override for the given user, so that
+// changes take effect immediately.
+func (l *RateLimits) InvalidateOverride(userID string) {
+	l.overrideCacheMutex.Lock()
+	defer l.overrideCacheMutex.Unlock()
+	delete(l.overrideCache, userID)
+}
+
+func (l *RateLimits) take(ctx context.Context, class, caller string, bucket rateLimitBucket) *util.JSONResponse {
+	retryAfter, err := l.store.Take(ctx, class+"|"+caller, bucket.threshold, bucket.cooloff)
+	if err != nil {
+		// Don't turn requests away just because the store is unavailable.
+		util.GetLogger(ctx).WithError(err).Error("Failed to check rate limits")
+		return nil
+	}
+	if retryAfter <= 0 {
+		return nil
+	}
+
+	// We hit the rate limit. Tell the client to back off.
+	retryAfterMS := retryAfter.Milliseconds()
+	if retryAfter%time.Millisecond != 0 {
+		retryAfterMS++
+	}
+	return &util.JSONResponse{
+		Code: http.StatusTooManyRequests,
+		JSON: spec.LimitExceeded("You are sending too many requests too quickly!", retryAfterMS),
+		Headers: map[string]string{
+			// Retry-After only allows whole seconds, so round up.
+			"Retry-After": strconv.FormatInt((retryAfterMS+999)/1000, 10),
+		},
+	}
+}
+
+// override returns the rate limit override for the given user, if there is
+// one. Overrides are cached, so that we don't need to ask the user API for
+// every request.
+func (l *RateLimits) override(ctx context.Context, userID string) *userapi.RateLimitOverride {
+	if l.overrides == nil {
+		return nil
+	}
+	l.overrideCacheMutex.Lock()
+	cached, ok := l.overrideCache[userID]
+	l.overrideCacheMutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.override
+	}
+
+	override, err := l.overrides.QueryRateLimitOverride(ctx, userID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to query rate limit override")
+		return nil
+	}
+	l.overrideCacheMutex.Lock()
+	defer l.overrideCacheMutex.Unlock()
+	for id, c := range l.overrideCache {
+		if time.Now().After(c.expires) {
+			delete(l.overrideCache, id)
 		}
 	}
+	l.overrideCache[userID] = cachedRateLimitOverride{
+		override: override,
+		expires:  time.Now().Add(rateLimitOverrideCacheTime),
+	}
+	return override
+}
 
-	// After the time interval, drain a resource from the rate limiting
-	// channel. This will free up space in the channel for new requests.
-	go func() {
-		<-time.After(l.cooloffDuration)
-		<-rateLimit
-	}()
-	return nil
+// NewRateLimitStore creates the store configured as the rate limiting backend.
+// The NATS backend keeps its state in the given key-value bucket.
+func NewRateLimitStore(enabled bool, backend string, js nats.JetStreamContext, bucket string) (RateLimitStore, error) {
+	if !enabled || backend != config.RateLimitingNATS {
+		return NewMemoryRateLimitStore(), nil
+	}
+	return NewNATSRateLimitStore(js, bucket)
 }
@@ -0,0 +1,223 @@
+package httputil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/nats-io/nats.go"
+)
+
+type rateLimitOverrideAPI struct {
+	overrides map[string]*userapi.RateLimitOverride
+}
+
+func (a *rateLimitOverrideAPI) QueryRateLimitOverride(ctx context.Context, userID string) (*userapi.RateLimitOverride, error) {
+	return a.overrides[userID], nil
+}
+
+// mustPrepareJetStream starts an in-memory NATS server, which is all the NATS
+// rate limit store needs.
+func mustPrepareJetStream(t *testing.T) nats.JetStreamContext {
+	t.Helper()
+	cfg := &config.Dendrite{}
+	cfg.Defaults(config.DefaultOpts{
+		Generate:       true,
+		SingleDatabase: true,
+	})
+	cfg.Global.JetStream.InMemory = true
+	processCtx := process.NewProcessContext()
+	t.Cleanup(func() {
+		processCtx.ShutdownDendrite()
+		processCtx.WaitForShutdown()
+	})
+	natsInstance := jetstream.NATSInstance{}
+	js, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+	return js
+}
+
+func TestRateLimitStores(t *testing.T) {
+	js := mustPrepareJetStream(t)
+	natsStore, err := NewNATSRateLimitStore(js, "RateLimitsTest")
+	if err != nil {
+		t.Fatalf("failed to create NATS store: %s", err)
+	}
+	// A second store using the same bucket, like another process would
+	otherNATSStore, err := NewNATSRateLimitStore(js, "RateLimitsTest")
+	if err != nil {
+		t.Fatalf("failed to create NATS store: %s", err)
+	}
+
+	memoryStore := NewMemoryRateLimitStore()
+	for name, stores := range map[string][]RateLimitStore{
+		"memory": {memoryStore, memoryStore},
+		"nats":   {natsStore, otherNATSStore},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cooloff := 500 * time.Millisecond
+			for i := 0; i < 4; i++ {
+				wait, err := stores[i%2].Take(ctx, "alice", 4, cooloff)
+				if err != nil {
+					t.Fatalf("failed to take request %d: %s", i, err)
+				}
+				if wait != 0 {
+					t.Fatalf("expected request %d to be allowed, got wait %s", i, wait)
+				}
+			}
+			wait, err := stores[0].Take(ctx, "alice", 4, cooloff)
+			if err != nil {
+				t.Fatalf("failed to take request: %s", err)
+			}
+			if wait <= 0 || wait > cooloff/4 {
+				t.Fatalf("expected to wait up to %s, got %s", cooloff/4, wait)
+			}
+
+			// Other callers have their own bucket
+			if wait, err = stores[1].Take(ctx, "bob", 4, cooloff); err != nil || wait != 0 {
+				t.Fatalf("expected bob's request to be allowed, got wait %s, err %v", wait, err)
+			}
+
+			time.Sleep(cooloff / 4)
+			if wait, err = stores[1].Take(ctx, "alice", 4, cooloff); err != nil || wait != 0 {
+				t.Fatalf("expected request after waiting to be allowed, got wait %s, err %v", wait, err)
+			}
+		})
+	}
+}
+
+func TestNATSRateLimitStoreExpiry(t *testing.T) {
+	js := mustPrepareJetStream(t)
+	store, err := NewNATSRateLimitStore(js, "RateLimitsExpiryTest")
+	if err != nil {
+		t.Fatalf("failed to create NATS store: %s", err)
+	}
+
+	// A long cooloff, e.g. from a per-user override, is kept until the bucket is empty.
+	ctx := context.Background()
+	cooloff := time.Hour
+	if wait, err := store.Take(ctx, "alice", 1, cooloff); err != nil || wait != 0 {
+		t.Fatalf("expected the request to be allowed, got wait %s, err %v", wait, err)
+	}
+	if err = store.removeExpired(time.Now().Add(cooloff / 2)); err != nil {
+		t.Fatalf("failed to remove expired keys: %s", err)
+	}
+	if wait, err := store.Take(ctx, "alice", 1, cooloff); err != nil || wait <= 0 {
+		t.Fatalf("expected the request to be limited, got wait %s, err %v", wait, err)
+	}
+
+	// Once the bucket is empty, the key is removed.
+	if err = store.removeExpired(time.Now().Add(2 * cooloff)); err != nil {
+		t.Fatalf("failed to remove expired keys: %s", err)
+	}
+	if keys, err := store.kv.Keys(); err == nil {
+		t.Fatalf("expected no keys to be left, got %v", keys)
+	}
+	if wait, err := store.Take(ctx, "alice", 1, cooloff); err != nil || wait != 0 {
+		t.Fatalf("expected the request to be allowed, got wait %s, err %v", wait, err)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	cfg := &config.RateLimiting{}
+	cfg.Defaults()
+	cfg.Threshold = 1
+	cfg.CooloffMS = 60000
+	cfg.Login = config.RateLimitBucket{Threshold: 2}
+	cfg.ExemptUserIDs = []string{"@exempt:test"}
+	overrides := &rateLimitOverrideAPI{overrides: map[string]*userapi.RateLimitOverride{
+		"@overridden:test": {UserID: "@overridden:test", Threshold: 3, CooloffMS: 60000},
+		"@unlimited:test":  {UserID: "@unlimited:test"},
+	}}
+	l := NewRateLimits(cfg, NewMemoryRateLimitStore(), overrides)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	device := func(userID string, accountType userapi.AccountType) *userapi.Device {
+		return &userapi.Device{UserID: userID, ID: "DEVICE", AccountType: accountType}
+	}
+	// allowed returns how many requests are allowed before being rate limited.
+	allowed := func(t *testing.T, device *userapi.Device, class, wantRetryAfter string) int {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			res := l.LimitClass(req, device, class)
+			if res == nil {
+				continue
+			}
+			if res.Code != http.StatusTooManyRequests {
+				t.Fatalf("expected HTTP 429, got %d", res.Code)
+			}
+			if res.Headers["Retry-After"] != wantRetryAfter {
+				t.Fatalf("expected Retry-After of %s seconds, got %q", wantRetryAfter, res.Headers["Retry-After"])
+			}
+			return i
+		}
+		return 10
+	}
+
+	testCases := []struct {
+		name           string
+		device         *userapi.Device
+		class          string
+		want           int
+		wantRetryAfter string
+	}{
+		{name: "default class", device: device("@alice:test", userapi.AccountTypeUser), want: 1, wantRetryAfter: "60"},
+		{name: "other class", device: device("@alice:test", userapi.AccountTypeUser), class: RateLimitJoin, want: 1, wantRetryAfter: "60"},
+		{name: "configured class", device: device("@alice:test", userapi.AccountTypeUser), class: RateLimitLogin, want: 2, wantRetryAfter: "30"},
+		{name: "unauthenticated", class: RateLimitLogin, want: 2, wantRetryAfter: "30"},
+		{name: "admin", device: device("@admin:test", userapi.AccountTypeAdmin), want: 10},
+		{name: "appservice", device: device("@bot:test", userapi.AccountTypeAppService), want: 10},
+		{name: "exempt user", device: device("@exempt:test", userapi.AccountTypeUser), want: 10},
+		{name: "overridden user", device: device("@overridden:test", userapi.AccountTypeUser), class: RateLimitLogin, want: 3, wantRetryAfter: "20"},
+		{name: "unlimited user", device: device("@unlimited:test", userapi.AccountTypeUser), want: 10},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := allowed(t, tc.device, tc.class, tc.wantRetryAfter); got != tc.want {
+				t.Fatalf("expected %d requests to be allowed, got %d", tc.want, got)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg.Enabled = false
+		l := NewRateLimits(cfg, NewMemoryRateLimitStore(), nil)
+		for i := 0; i < 10; i++ {
+			if res := l.Limit(req, nil); res != nil {
+				t.Fatalf("expected request %d to be allowed", i)
+			}
+		}
+	})
+}
+
+func TestOriginRateLimits(t *testing.T) {
+	cfg := &config.FederationRateLimiting{}
+	cfg.Defaults()
+	l := NewOriginRateLimits(cfg, NewMemoryRateLimitStore())
+	for i := int64(0); i < cfg.Threshold; i++ {
+		if res := l.LimitOrigin(context.Background(), "remote"); res != nil {
+			t.Fatalf("expected request %d to be allowed", i)
+		}
+	}
+	if res := l.LimitOrigin(context.Background(), "remote"); res == nil {
+		t.Fatalf("expected the request to be rate limited")
+	}
+	// Other servers have their own limits
+	if res := l.LimitOrigin(context.Background(), "other"); res != nil {
+		t.Fatalf("expected the request of another server to be allowed")
+	}
+
+	cfg.Enabled = false
+	l = NewOriginRateLimits(cfg, NewMemoryRateLimitStore())
+	for i := int64(0); i <= cfg.Threshold; i++ {
+		if res := l.LimitOrigin(context.Background(), "remote"); res != nil {
+			t.Fatalf("expected request %d to be allowed", i)
+		}
+	}
+}
@@ -8,7 +8,9 @@ type Condition struct {
 	Kind ConditionKind `json:"kind"`
 
 	// Key indicates the dot-separated path of Event fields to
-	// match. Required for EventMatchCondition and
+	// match. Dots and backslashes which are part of a field name are
+	// escaped with a backslash. Required for EventMatchCondition,
+	// EventPropertyIsCondition, EventPropertyContainsCondition and
 	// SenderNotificationPermissionCondition.
 	Key string `json:"key,omitempty"`
 
@@ -19,6 +21,12 @@ type Condition struct {
 	// Is indicates the condition that must be fulfilled. Required for
 	// RoomMemberCountCondition.
 	Is string `json:"is,omitempty"`
+
+	// Value is the string, integer, boolean or null value to compare
+	// against. Required for EventPropertyIsCondition and
+	// EventPropertyContainsCondition. A null value is omitted when
+	// encoding, so a missing value compares as null.
+	Value interface{} `json:"value,omitempty"`
 }
 
 // ConditionKind represents a kind of condition.
@@ -46,4 +54,22 @@ const (
 	// SenderNotificationPermissionCondition compares power level for
 	// the sender in the event's room.
 	SenderNotificationPermissionCondition ConditionKind = "sender_notification_permission"
+
+	// EventPropertyIsCondition indicates the condition looks for a
+	// key path and compares its value exactly.
+	EventPropertyIsCondition ConditionKind = "event_property_is"
+
+	// EventPropertyContainsCondition indicates the condition looks
+	// for a key path of an array and checks whether it contains the
+	// value exactly.
+	EventPropertyContainsCondition ConditionKind = "event_property_contains"
+
+	// CallStartedCondition matches state events which start a call,
+	// i.e. have content which doesn't mark the call as terminated.
+	// See MSC3914.
+	CallStartedCondition ConditionKind = "call_started"
+
+	// MSC3914CallStartedCondition is the unstable identifier of
+	// CallStartedCondition.
+	MSC3914CallStartedCondition ConditionKind = "org.matrix.msc3914.call_started"
 )
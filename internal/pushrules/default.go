@@ -19,3 +19,50 @@ func DefaultGlobalRuleSet(localpart string, serverName spec.ServerName) *RuleSet
 		Underride: defaultUnderrideRules,
 	}
 }
+
+// AddMissingDefaultRules adds the server-default rules which were
+// introduced after the rule set of the given user was stored. Missing
+// rules are inserted next to the default rule preceding them, so the
+// default rules keep their order.
+func (rs *RuleSet) AddMissingDefaultRules(localpart string, serverName spec.ServerName) {
+	defaults := DefaultGlobalRuleSet(localpart, serverName)
+	for _, r := range []struct {
+		rules    *[]*Rule
+		defaults []*Rule
+	}{
+		{&rs.Override, defaults.Override},
+		{&rs.Content, defaults.Content},
+		{&rs.Room, defaults.Room},
+		{&rs.Sender, defaults.Sender},
+		{&rs.Underride, defaults.Underride},
+	} {
+		for i, def := range r.defaults {
+			if ruleIndexByID(*r.rules, def.RuleID) >= 0 {
+				continue
+			}
+			pos := len(*r.rules)
+			if i > 0 {
+				if prev := ruleIndexByID(*r.rules, r.defaults[i-1].RuleID); prev >= 0 {
+					pos = prev + 1
+				}
+			} else {
+				for j, rule := range *r.rules {
+					if rule.Default {
+						pos = j
+						break
+					}
+				}
+			}
+			*r.rules = append((*r.rules)[:pos], append([]*Rule{def}, (*r.rules)[pos:]...)...)
+		}
+	}
+}
+
+func ruleIndexByID(rules []*Rule, id string) int {
+	for i, rule := range rules {
+		if rule.RuleID == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -6,7 +6,9 @@ func defaultOverrideRules(userID string) []*Rule {
 		&mRuleSuppressNoticesDefinition,
 		mRuleInviteForMeDefinition(userID),
 		&mRuleMemberEventDefinition,
+		mRuleIsUserMentionDefinition(userID),
 		&mRuleContainsDisplayNameDefinition,
+		&mRuleIsRoomMentionDefinition,
 		&mRuleRoomNotifDefinition,
 		&mRuleTombstoneDefinition,
 		&mRuleReactionDefinition,
@@ -19,7 +21,9 @@ const (
 	MRuleSuppressNotices     = ".m.rule.suppress_notices"
 	MRuleInviteForMe         = ".m.rule.invite_for_me"
 	MRuleMemberEvent         = ".m.rule.member_event"
+	MRuleIsUserMention       = ".m.rule.is_user_mention"
 	MRuleContainsDisplayName = ".m.rule.contains_display_name"
+	MRuleIsRoomMention       = ".m.rule.is_room_mention"
 	MRuleTombstone           = ".m.rule.tombstone"
 	MRuleRoomNotif           = ".m.rule.roomnotif"
 	MRuleReaction            = ".m.rule.reaction"
@@ -77,6 +81,29 @@ var (
 			},
 		},
 	}
+	mRuleIsRoomMentionDefinition = Rule{
+		RuleID:  MRuleIsRoomMention,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:  EventPropertyIsCondition,
+				Key:   `content.m\.mentions.room`,
+				Value: true,
+			},
+			{
+				Kind: SenderNotificationPermissionCondition,
+				Key:  "room",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+			},
+		},
+	}
 	mRuleTombstoneDefinition = Rule{
 		RuleID:  MRuleTombstone,
 		Default: true,
@@ -189,3 +216,30 @@ func mRuleInviteForMeDefinition(userID string) *Rule {
 		},
 	}
 }
+
+func mRuleIsUserMentionDefinition(userID string) *Rule {
+	return &Rule{
+		RuleID:  MRuleIsUserMention,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:  EventPropertyContainsCondition,
+				Key:   `content.m\.mentions.user_ids`,
+				Value: userID,
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+			},
+		},
+	}
+}
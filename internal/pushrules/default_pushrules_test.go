@@ -39,11 +39,21 @@ func TestDefaultRules(t *testing.T) {
 			inputBytes: []byte(`{"rule_id":".m.rule.member_event","default":true,"enabled":true,"conditions":[{"kind":"event_match","key":"type","pattern":"m.room.member"}],"actions":[]}`),
 			want:       mRuleMemberEventDefinition,
 		},
+		{
+			name:       ".m.rule.is_user_mention",
+			inputBytes: []byte(`{"rule_id":".m.rule.is_user_mention","default":true,"enabled":true,"conditions":[{"kind":"event_property_contains","key":"content.m\\.mentions.user_ids","value":"@test:localhost"}],"actions":["notify",{"set_tweak":"sound","value":"default"},{"set_tweak":"highlight"}]}`),
+			want:       *mRuleIsUserMentionDefinition("@test:localhost"),
+		},
 		{
 			name:       ".m.rule.contains_display_name",
 			inputBytes: []byte(`{"rule_id":".m.rule.contains_display_name","default":true,"enabled":true,"conditions":[{"kind":"contains_display_name"}],"actions":["notify",{"set_tweak":"sound","value":"default"},{"set_tweak":"highlight"}]}`),
 			want:       mRuleContainsDisplayNameDefinition,
 		},
+		{
+			name:       ".m.rule.is_room_mention",
+			inputBytes: []byte(`{"rule_id":".m.rule.is_room_mention","default":true,"enabled":true,"conditions":[{"kind":"event_property_is","key":"content.m\\.mentions.room","value":true},{"kind":"sender_notification_permission","key":"room"}],"actions":["notify",{"set_tweak":"highlight"}]}`),
+			want:       mRuleIsRoomMentionDefinition,
+		},
 		{
 			name:       ".m.rule.tombstone",
 			inputBytes: []byte(`{"rule_id":".m.rule.tombstone","default":true,"enabled":true,"conditions":[{"kind":"event_match","key":"type","pattern":"m.room.tombstone"},{"kind":"event_match","key":"state_key","pattern":""}],"actions":["notify",{"set_tweak":"highlight"}]}`),
@@ -71,6 +81,11 @@ func TestDefaultRules(t *testing.T) {
 			inputBytes: []byte(`{"rule_id":".m.rule.call","default":true,"enabled":true,"conditions":[{"kind":"event_match","key":"type","pattern":"m.call.invite"}],"actions":["notify",{"set_tweak":"sound","value":"ring"}]}`),
 			want:       mRuleCallDefinition,
 		},
+		{
+			name:       ".org.matrix.msc3914.rule.room.call",
+			inputBytes: []byte(`{"rule_id":".org.matrix.msc3914.rule.room.call","default":true,"enabled":true,"conditions":[{"kind":"event_match","key":"type","pattern":"org.matrix.msc3401.call"},{"kind":"org.matrix.msc3914.call_started"}],"actions":["notify",{"set_tweak":"sound","value":"ring"}]}`),
+			want:       mSC3914RuleRoomCallDefinition,
+		},
 		{
 			name:       ".m.rule.encrypted_room_one_to_one",
 			inputBytes: []byte(`{"rule_id":".m.rule.encrypted_room_one_to_one","default":true,"enabled":true,"conditions":[{"kind":"room_member_count","is":"2"},{"kind":"event_match","key":"type","pattern":"m.room.encrypted"}],"actions":["notify",{"set_tweak":"sound","value":"default"}]}`),
@@ -109,3 +124,27 @@ func TestDefaultRules(t *testing.T) {
 
 	}
 }
+
+func TestAddMissingDefaultRules(t *testing.T) {
+	userRule := &Rule{RuleID: "user.rule", Enabled: true, Conditions: []*Condition{}, Actions: []*Action{}}
+	// A rule set stored before intentional mentions and MSC3914 calls were added
+	ruleSet := DefaultGlobalRuleSet("test", "localhost")
+	var override []*Rule
+	for _, rule := range ruleSet.Override {
+		if rule.RuleID != MRuleIsUserMention && rule.RuleID != MRuleIsRoomMention {
+			override = append(override, rule)
+		}
+	}
+	ruleSet.Override = append([]*Rule{userRule}, override...)
+	ruleSet.Underride = append(ruleSet.Underride[:1:1], ruleSet.Underride[2:]...)
+
+	ruleSet.AddMissingDefaultRules("test", "localhost")
+
+	want := DefaultGlobalRuleSet("test", "localhost")
+	want.Override = append([]*Rule{userRule}, want.Override...)
+	assert.Equal(t, want, ruleSet)
+
+	// Nothing is added twice
+	ruleSet.AddMissingDefaultRules("test", "localhost")
+	assert.Equal(t, want, ruleSet)
+}
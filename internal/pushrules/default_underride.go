@@ -2,6 +2,7 @@ package pushrules
 
 const (
 	MRuleCall                  = ".m.rule.call"
+	MSC3914RuleRoomCall        = ".org.matrix.msc3914.rule.room.call"
 	MRuleEncryptedRoomOneToOne = ".m.rule.encrypted_room_one_to_one"
 	MRuleRoomOneToOne          = ".m.rule.room_one_to_one"
 	MRuleMessage               = ".m.rule.message"
@@ -10,6 +11,7 @@ const (
 
 var defaultUnderrideRules = []*Rule{
 	&mRuleCallDefinition,
+	&mSC3914RuleRoomCallDefinition,
 	&mRuleRoomOneToOneDefinition,
 	&mRuleEncryptedRoomOneToOneDefinition,
 	&mRuleMessageDefinition,
@@ -37,6 +39,27 @@ var (
 			},
 		},
 	}
+	mSC3914RuleRoomCallDefinition = Rule{
+		RuleID:  MSC3914RuleRoomCall,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:    EventMatchCondition,
+				Key:     "type",
+				Pattern: pointer("org.matrix.msc3401.call"),
+			},
+			{Kind: MSC3914CallStartedCondition},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "ring",
+			},
+		},
+	}
 	mRuleEncryptedRoomOneToOneDefinition = Rule{
 		RuleID:  MRuleEncryptedRoomOneToOne,
 		Default: true,
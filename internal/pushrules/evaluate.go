@@ -3,10 +3,10 @@ package pushrules
 import (
 	"encoding/json"
 	"fmt"
-	"strings"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
 )
 
 // A RuleSetEvaluator encapsulates context to evaluate an event
@@ -89,6 +89,13 @@ func ruleMatches(rule *Rule, kind Kind, event gomatrixserverlib.PDU, ec Evaluati
 		return false, nil
 	}
 
+	// The legacy mention rules are superseded by intentional mentions:
+	// they don't apply to events which use them, even if no-one is
+	// mentioned.
+	if rule.Default && isLegacyMentionRule(rule.RuleID) && gjson.GetBytes(event.Content(), `m\.mentions`).Exists() {
+		return false, nil
+	}
+
 	switch kind {
 	case OverrideKind, UnderrideKind:
 		for _, cond := range rule.Conditions {
@@ -151,6 +158,39 @@ func conditionMatches(cond *Condition, event gomatrixserverlib.PDU, ec Evaluatio
 	case SenderNotificationPermissionCondition:
 		return ec.HasPowerLevel(event.SenderID(), cond.Key)
 
+	case EventPropertyIsCondition:
+		v, ok, err := lookupEventProperty(cond.Key, event)
+		if err != nil || !ok {
+			return false, err
+		}
+		return propertyValueEquals(v, cond.Value), nil
+
+	case EventPropertyContainsCondition:
+		v, ok, err := lookupEventProperty(cond.Key, event)
+		if err != nil || !ok {
+			return false, err
+		}
+		// A non-array never matches.
+		values, _ := v.([]interface{})
+		for _, value := range values {
+			if propertyValueEquals(value, cond.Value) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case CallStartedCondition, MSC3914CallStartedCondition:
+		if event.StateKey() == nil {
+			return false, nil
+		}
+		var content map[string]interface{}
+		if err := json.Unmarshal(event.Content(), &content); err != nil {
+			return false, fmt.Errorf("parsing event content: %w", err)
+		}
+		// Empty content or "m.terminated" ends the call.
+		_, terminated := content["m.terminated"]
+		return len(content) > 0 && !terminated, nil
+
 	default:
 		return false, nil
 	}
@@ -167,19 +207,13 @@ func patternMatches(key, pattern string, event gomatrixserverlib.PDU) (bool, err
 		return false, err
 	}
 
-	var eventMap map[string]interface{}
-	if err = json.Unmarshal(event.JSON(), &eventMap); err != nil {
-		return false, fmt.Errorf("parsing event: %w", err)
-	}
 	// From the spec:
 	// "If the property specified by key is completely absent from
 	// the event, or does not have a string value, then the condition
 	// will not match, even if pattern is *."
-	v, err := lookupMapPath(strings.Split(key, "."), eventMap)
-	if err != nil {
-		// An unknown path is a benign error that shouldn't stop rule
-		// processing. It's just a non-match.
-		return false, nil
+	v, ok, err := lookupEventProperty(key, event)
+	if err != nil || !ok {
+		return false, err
 	}
 	if _, ok := v.(string); !ok {
 		// A non-string never matches.
@@ -188,3 +222,46 @@ func patternMatches(key, pattern string, event gomatrixserverlib.PDU) (bool, err
 
 	return re.MatchString(fmt.Sprint(v)), nil
 }
+
+// lookupEventProperty returns the value at the key path in the
+// event. Returns false if the path doesn't exist.
+func lookupEventProperty(key string, event gomatrixserverlib.PDU) (interface{}, bool, error) {
+	var eventMap map[string]interface{}
+	if err := json.Unmarshal(event.JSON(), &eventMap); err != nil {
+		return nil, false, fmt.Errorf("parsing event: %w", err)
+	}
+	v, err := lookupMapPath(splitKeyPath(key), eventMap)
+	if err != nil {
+		// An unknown path is a benign error that shouldn't stop rule
+		// processing. It's just a non-match.
+		return nil, false, nil
+	}
+	return v, true, nil
+}
+
+// propertyValueEquals returns whether an event property, as produced
+// by json.Unmarshal, is exactly the given condition value. Only
+// strings, integers, booleans and null can match.
+func propertyValueEquals(v, want interface{}) bool {
+	switch w := want.(type) {
+	case nil, string, bool, float64:
+		return v == want
+	case int:
+		return v == float64(w)
+	case int64:
+		return v == float64(w)
+	default:
+		return false
+	}
+}
+
+// isLegacyMentionRule returns whether the rule ID belongs to one of the
+// predefined rules which look for mentions in the body.
+func isLegacyMentionRule(ruleID string) bool {
+	switch ruleID {
+	case MRuleContainsDisplayName, MRuleContainsUserName, MRuleRoomNotif:
+		return true
+	default:
+		return false
+	}
+}
@@ -46,6 +46,12 @@ func TestRuleSetEvaluatorMatchEvent(t *testing.T) {
 		{"overrideUnderride", RuleSet{Override: []*Rule{userEnabled}, Underride: []*Rule{userEnabled2}}, userEnabled, ev},
 		{"reactions don't notify", *defaultRuleset, &mRuleReactionDefinition, mustEventFromJSON(t, `{"room_id":"!room:a","type":"m.reaction"}`)},
 		{"receipts don't notify", *defaultRuleset, nil, mustEventFromJSON(t, `{"room_id":"!room:a","type":"m.receipt"}`)},
+		{"user mention", *defaultRuleset, mRuleIsUserMentionDefinition("@test:test"), mustEventFromJSON(t, `{"room_id":"!room:a","type":"m.room.message","content":{"body":"hi","m.mentions":{"user_ids":["@test:test"]}}}`)},
+		{"room mention", *defaultRuleset, &mRuleIsRoomMentionDefinition, mustEventFromJSON(t, `{"room_id":"!room:a","type":"m.room.message","sender":"@poweruser:example.com","content":{"body":"hi","m.mentions":{"room":true}}}`)},
+		{"room mention without permission", *defaultRuleset, &mRuleMessageDefinition, mustEventFromJSON(t, `{"room_id":"!room:a","type":"m.room.message","sender":"@nobody:example.com","content":{"body":"hi","m.mentions":{"room":true}}}`)},
+		{"legacy display name mention", *defaultRuleset, &mRuleContainsDisplayNameDefinition, mustEventFromJSON(t, `{"room_id":"!room:a","type":"m.room.message","content":{"body":"hello Dear User"}}`)},
+		{"legacy display name mention with m.mentions", *defaultRuleset, &mRuleMessageDefinition, mustEventFromJSON(t, `{"room_id":"!room:a","type":"m.room.message","content":{"body":"hello Dear User","m.mentions":{}}}`)},
+		{"legacy room mention with m.mentions", *defaultRuleset, &mRuleMessageDefinition, mustEventFromJSON(t, `{"room_id":"!room:a","type":"m.room.message","sender":"@poweruser:example.com","content":{"body":"@room","m.mentions":{}}}`)},
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
@@ -139,6 +145,28 @@ func TestConditionMatches(t *testing.T) {
 
 		{Name: "senderNotificationPermissionMatch", Cond: Condition{Kind: SenderNotificationPermissionCondition, Key: "powerlevel"}, EventJSON: `{"room_id":"!room:example.com","sender":"@poweruser:example.com"}`, WantMatch: true, WantErr: false},
 		{Name: "senderNotificationPermissionNoMatch", Cond: Condition{Kind: SenderNotificationPermissionCondition, Key: "powerlevel"}, EventJSON: `{"room_id":"!room:example.com","sender":"@nobody:example.com"}`, WantMatch: false, WantErr: false},
+
+		{Name: "propertyIsMatch", Cond: Condition{Kind: EventPropertyIsCondition, Key: `content.m\.mentions.room`, Value: true}, EventJSON: `{"room_id":"!room:example.com","content":{"m.mentions":{"room":true}}}`, WantMatch: true},
+		{Name: "propertyIsNoMatch", Cond: Condition{Kind: EventPropertyIsCondition, Key: `content.m\.mentions.room`, Value: true}, EventJSON: `{"room_id":"!room:example.com","content":{"m.mentions":{"room":false}}}`, WantMatch: false},
+		{Name: "propertyIsUnescapedNoMatch", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.m.mentions.room", Value: true}, EventJSON: `{"room_id":"!room:example.com","content":{"m.mentions":{"room":true}}}`, WantMatch: false},
+		{Name: "propertyIsString", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.body", Value: "hello"}, EventJSON: `{"room_id":"!room:example.com","content":{"body":"hello"}}`, WantMatch: true},
+		{Name: "propertyIsNoGlob", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.body", Value: "hell*"}, EventJSON: `{"room_id":"!room:example.com","content":{"body":"hello"}}`, WantMatch: false},
+		{Name: "propertyIsInteger", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.count", Value: 3}, EventJSON: `{"room_id":"!room:example.com","content":{"count":3}}`, WantMatch: true},
+		{Name: "propertyIsIntegerNotString", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.count", Value: "3"}, EventJSON: `{"room_id":"!room:example.com","content":{"count":3}}`, WantMatch: false},
+		{Name: "propertyIsNull", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.reason"}, EventJSON: `{"room_id":"!room:example.com","content":{"reason":null}}`, WantMatch: true},
+		{Name: "propertyIsNullMissing", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.reason"}, EventJSON: `{"room_id":"!room:example.com","content":{}}`, WantMatch: false},
+		{Name: "propertyIsObject", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content", Value: "{}"}, EventJSON: `{"room_id":"!room:example.com","content":{}}`, WantMatch: false},
+
+		{Name: "propertyContainsMatch", Cond: Condition{Kind: EventPropertyContainsCondition, Key: `content.m\.mentions.user_ids`, Value: "@alice:example.com"}, EventJSON: `{"room_id":"!room:example.com","content":{"m.mentions":{"user_ids":["@bob:example.com","@alice:example.com"]}}}`, WantMatch: true},
+		{Name: "propertyContainsNoMatch", Cond: Condition{Kind: EventPropertyContainsCondition, Key: `content.m\.mentions.user_ids`, Value: "@alice:example.com"}, EventJSON: `{"room_id":"!room:example.com","content":{"m.mentions":{"user_ids":["@bob:example.com"]}}}`, WantMatch: false},
+		{Name: "propertyContainsNotArray", Cond: Condition{Kind: EventPropertyContainsCondition, Key: `content.m\.mentions.user_ids`, Value: "@alice:example.com"}, EventJSON: `{"room_id":"!room:example.com","content":{"m.mentions":{"user_ids":"@alice:example.com"}}}`, WantMatch: false},
+		{Name: "propertyContainsNested", Cond: Condition{Kind: EventPropertyContainsCondition, Key: "content.tags", Value: "a"}, EventJSON: `{"room_id":"!room:example.com","content":{"tags":["ab",["a"]]}}`, WantMatch: false},
+
+		{Name: "callStartedMatch", Cond: Condition{Kind: MSC3914CallStartedCondition}, EventJSON: `{"room_id":"!room:example.com","type":"org.matrix.msc3401.call","state_key":"1","content":{"m.intent":"m.room"}}`, WantMatch: true},
+		{Name: "callStartedStableMatch", Cond: Condition{Kind: CallStartedCondition}, EventJSON: `{"room_id":"!room:example.com","type":"org.matrix.msc3401.call","state_key":"1","content":{"m.intent":"m.room"}}`, WantMatch: true},
+		{Name: "callStartedTerminated", Cond: Condition{Kind: MSC3914CallStartedCondition}, EventJSON: `{"room_id":"!room:example.com","type":"org.matrix.msc3401.call","state_key":"1","content":{"m.intent":"m.room","m.terminated":"call_ended"}}`, WantMatch: false},
+		{Name: "callStartedEmpty", Cond: Condition{Kind: MSC3914CallStartedCondition}, EventJSON: `{"room_id":"!room:example.com","type":"org.matrix.msc3401.call","state_key":"1","content":{}}`, WantMatch: false},
+		{Name: "callStartedNotState", Cond: Condition{Kind: MSC3914CallStartedCondition}, EventJSON: `{"room_id":"!room:example.com","type":"org.matrix.msc3401.call","content":{"m.intent":"m.room"}}`, WantMatch: false},
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
@@ -158,7 +186,7 @@ type fakeEvaluationContext struct{ memberCount int }
 func (fakeEvaluationContext) UserDisplayName() string         { return "Dear User" }
 func (f fakeEvaluationContext) RoomMemberCount() (int, error) { return f.memberCount, nil }
 func (fakeEvaluationContext) HasPowerLevel(senderID spec.SenderID, levelKey string) (bool, error) {
-	return senderID == "@poweruser:example.com" && levelKey == "powerlevel", nil
+	return senderID == "@poweruser:example.com" && (levelKey == "powerlevel" || levelKey == "room"), nil
 }
 
 func TestPatternMatches(t *testing.T) {
@@ -70,6 +70,28 @@ func globToRegexp(pattern string) (*regexp.Regexp, error) {
 // meta-characters (i.e. may need escaping).
 var globNonMetaRegexp = regexp.MustCompile("[^*?]+")
 
+// splitKeyPath splits a dot-separated key path into field names. A
+// backslash escapes a following dot or backslash, so that field names
+// like "m.mentions" can be referenced as `content.m\.mentions`. Other
+// backslashes are kept as-is.
+func splitKeyPath(key string) []string {
+	var path []string
+	var field strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; {
+		case c == '\\' && i+1 < len(key) && (key[i+1] == '.' || key[i+1] == '\\'):
+			field.WriteByte(key[i+1])
+			i++
+		case c == '.':
+			path = append(path, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(c)
+		}
+	}
+	return append(path, field.String())
+}
+
 // lookupMapPath traverses a hierarchical map structure, like the one
 // produced by json.Unmarshal, to return the leaf value. Traversing
 // arrays/slices is not supported, only objects/maps.
@@ -116,6 +116,27 @@ func TestLookupMapPath(t *testing.T) {
 	}
 }
 
+func TestSplitKeyPath(t *testing.T) {
+	tsts := []struct {
+		Key  string
+		Want []string
+	}{
+		{"", []string{""}},
+		{"content.body", []string{"content", "body"}},
+		{`content.m\.mentions.room`, []string{"content", "m.mentions", "room"}},
+		{`content.a\\.b`, []string{"content", `a\`, "b"}},
+		{`content.a\b`, []string{"content", `a\b`}},
+		{`content.a\`, []string{"content", `a\`}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Key, func(t *testing.T) {
+			if diff := cmp.Diff(tst.Want, splitKeyPath(tst.Key)); diff != "" {
+				t.Errorf("+got -want:\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestLookupMapPathInvalid(t *testing.T) {
 	tsts := []struct {
 		Path []string
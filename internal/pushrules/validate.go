@@ -81,9 +81,25 @@ func validateCondition(cond *Condition) []error {
 	var errs []error
 
 	switch cond.Kind {
-	case EventMatchCondition, ContainsDisplayNameCondition, RoomMemberCountCondition, SenderNotificationPermissionCondition:
+	case EventMatchCondition, ContainsDisplayNameCondition, RoomMemberCountCondition, SenderNotificationPermissionCondition,
+		CallStartedCondition, MSC3914CallStartedCondition:
 		// Do nothing.
 
+	case EventPropertyIsCondition, EventPropertyContainsCondition:
+		if cond.Key == "" {
+			errs = append(errs, fmt.Errorf("missing condition key"))
+		}
+		switch v := cond.Value.(type) {
+		case nil, string, bool:
+			// Do nothing.
+		case float64:
+			if v != float64(int64(v)) {
+				errs = append(errs, fmt.Errorf("condition value must be an integer: %v", v))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("invalid condition value type: %T", cond.Value))
+		}
+
 	default:
 		errs = append(errs, fmt.Errorf("invalid rule condition kind: %s", cond.Kind))
 	}
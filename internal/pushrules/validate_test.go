@@ -124,6 +124,9 @@ func TestValidateConditionNegatives(t *testing.T) {
 	}{
 		{"emptyKind", Condition{}, "invalid rule condition kind"},
 		{"invalidKind", Condition{Kind: ConditionKind("something else")}, "invalid rule condition kind"},
+		{"propertyIsNoKey", Condition{Kind: EventPropertyIsCondition, Value: true}, "missing condition key"},
+		{"propertyIsObjectValue", Condition{Kind: EventPropertyIsCondition, Key: "content", Value: map[string]interface{}{}}, "invalid condition value type"},
+		{"propertyContainsFloatValue", Condition{Kind: EventPropertyContainsCondition, Key: "content.a", Value: 1.5}, "condition value must be an integer"},
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
@@ -149,6 +152,9 @@ func TestValidateConditionPositives(t *testing.T) {
 		WantNoErrString string
 	}{
 		{"invalidKind", Condition{Kind: EventMatchCondition}, "invalid rule condition kind"},
+		{"propertyIsNull", Condition{Kind: EventPropertyIsCondition, Key: "content.a"}, "condition value"},
+		{"propertyIsInteger", Condition{Kind: EventPropertyIsCondition, Key: "content.a", Value: float64(42)}, "condition value"},
+		{"callStarted", Condition{Kind: MSC3914CallStartedCondition}, "invalid rule condition kind"},
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
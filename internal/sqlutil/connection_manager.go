@@ -53,6 +53,9 @@ func (c *Connections) Connection(dbProperties *config.DatabaseOptions) (*sql.DB,
 	}
 
 	writer := NewDummyWriter()
+	if dbProperties.ConnectionString.IsFile() {
+		writer = NewExclusiveWriter()
+	}
 
 	existing, loaded := c.existingConnections.LoadOrStore(dbProperties.ConnectionString, &con{})
 	if loaded {
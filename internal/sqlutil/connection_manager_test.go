@@ -14,7 +14,7 @@ func TestConnectionManager(t *testing.T) {
 
 	t.Run("component defined connection string", func(t *testing.T) {
 		test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
-			conStr, close := test.PrepareDBConnectionString(t)
+			conStr, close := test.PrepareDBConnectionString(t, dbType)
 			t.Cleanup(close)
 			cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
 
@@ -25,6 +25,11 @@ func TestConnectionManager(t *testing.T) {
 			}
 
 			switch dbType {
+			case test.DBTypeQL:
+				_, ok := writer.(*sqlutil.ExclusiveWriter)
+				if !ok {
+					t.Fatalf("expected exclusive writer")
+				}
 			case test.DBTypePostgres:
 				_, ok := writer.(*sqlutil.DummyWriter)
 				if !ok {
@@ -64,7 +69,7 @@ func TestConnectionManager(t *testing.T) {
 
 	t.Run("global connection pool", func(t *testing.T) {
 		test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
-			conStr, close := test.PrepareDBConnectionString(t)
+			conStr, close := test.PrepareDBConnectionString(t, dbType)
 			t.Cleanup(close)
 			cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{ConnectionString: config.DataSource(conStr)})
 
@@ -75,6 +80,11 @@ func TestConnectionManager(t *testing.T) {
 			}
 
 			switch dbType {
+			case test.DBTypeQL:
+				_, ok := writer.(*sqlutil.ExclusiveWriter)
+				if !ok {
+					t.Fatalf("expected exclusive writer")
+				}
 			case test.DBTypePostgres:
 				_, ok := writer.(*sqlutil.DummyWriter)
 				if !ok {
@@ -98,7 +108,7 @@ func TestConnectionManager(t *testing.T) {
 
 	t.Run("shutdown", func(t *testing.T) {
 		test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
-			conStr, close := test.PrepareDBConnectionString(t)
+			conStr, close := test.PrepareDBConnectionString(t, dbType)
 			t.Cleanup(close)
 
 			processCtx := process.NewProcessContext()
@@ -33,10 +33,22 @@ const createDBMigrationsSQL = "" +
 	" dendrite_version TEXT NOT NULL" +
 	");"
 
+const createDBMigrationsQLSQL = "" +
+	"CREATE TABLE IF NOT EXISTS db_migrations (" +
+	" version string NOT NULL," +
+	" migration_time string NOT NULL," +
+	" dendrite_version string NOT NULL" +
+	");" +
+	"CREATE UNIQUE INDEX IF NOT EXISTS db_migrations_version_idx ON db_migrations (version);"
+
 const insertVersionSQL = "" +
 	"INSERT INTO db_migrations (version, time, dendrite_version)" +
 	" VALUES ($1, $2, $3)"
 
+const insertVersionQLSQL = "" +
+	"INSERT INTO db_migrations (version, migration_time, dendrite_version)" +
+	" VALUES ($1, $2, $3)"
+
 const selectDBMigrationsSQL = "SELECT version FROM db_migrations"
 
 // Migration defines a migration to be run.
@@ -114,10 +126,14 @@ func (m *Migrator) insertMigration(ctx context.Context, txn *sql.Tx, migrationNa
 	if m.insertStmt == nil {
 		var stmt *sql.Stmt
 		var err error
+		insertSQL := insertVersionSQL
+		if IsQL(m.db) {
+			insertSQL = insertVersionQLSQL
+		}
 		if txn == nil {
-			stmt, err = m.db.PrepareContext(ctx, insertVersionSQL)
+			stmt, err = m.db.PrepareContext(ctx, insertSQL)
 		} else {
-			stmt, err = txn.PrepareContext(ctx, insertVersionSQL)
+			stmt, err = txn.PrepareContext(ctx, insertSQL)
 		}
 		if err != nil {
 			return fmt.Errorf("unable to prepare insert statement: %w", err)
@@ -137,7 +153,11 @@ func (m *Migrator) insertMigration(ctx context.Context, txn *sql.Tx, migrationNa
 // migrations table, if it doesn't exist.
 func (m *Migrator) ExecutedMigrations(ctx context.Context) (map[string]struct{}, error) {
 	result := make(map[string]struct{})
-	_, err := m.db.ExecContext(ctx, createDBMigrationsSQL)
+	createSQL := createDBMigrationsSQL
+	if IsQL(m.db) {
+		createSQL = createDBMigrationsQLSQL
+	}
+	_, err := m.db.ExecContext(ctx, createSQL)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create db_migrations: %w", err)
 	}
@@ -11,39 +11,45 @@ import (
 	"github.com/matrix-org/dendrite/test"
 )
 
-var dummyMigrations = []sqlutil.Migration{
-	{
-		Version: "init",
-		Up: func(ctx context.Context, txn *sql.Tx) error {
-			_, err := txn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS dummy ( test TEXT );")
-			return err
+func dummyMigrations(dbType test.DBType) []sqlutil.Migration {
+	textType := "TEXT"
+	if dbType == test.DBTypeQL {
+		textType = "string"
+	}
+	return []sqlutil.Migration{
+		{
+			Version: "init",
+			Up: func(ctx context.Context, txn *sql.Tx) error {
+				_, err := txn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS dummy ( test "+textType+" );")
+				return err
+			},
 		},
-	},
-	{
-		Version: "v2",
-		Up: func(ctx context.Context, txn *sql.Tx) error {
-			_, err := txn.ExecContext(ctx, "ALTER TABLE dummy ADD COLUMN test2 TEXT;")
-			return err
+		{
+			Version: "v2",
+			Up: func(ctx context.Context, txn *sql.Tx) error {
+				_, err := txn.ExecContext(ctx, "ALTER TABLE dummy ADD test2 "+textType+";")
+				return err
+			},
 		},
-	},
-	{
-		Version: "v2", // duplicate, this migration will be skipped
-		Up: func(ctx context.Context, txn *sql.Tx) error {
-			_, err := txn.ExecContext(ctx, "ALTER TABLE dummy ADD COLUMN test2 TEXT;")
-			return err
+		{
+			Version: "v2", // duplicate, this migration will be skipped
+			Up: func(ctx context.Context, txn *sql.Tx) error {
+				_, err := txn.ExecContext(ctx, "ALTER TABLE dummy ADD test2 "+textType+";")
+				return err
+			},
 		},
-	},
-	{
-		Version: "multiple execs",
-		Up: func(ctx context.Context, txn *sql.Tx) error {
-			_, err := txn.ExecContext(ctx, "ALTER TABLE dummy ADD COLUMN test3 TEXT;")
-			if err != nil {
+		{
+			Version: "multiple execs",
+			Up: func(ctx context.Context, txn *sql.Tx) error {
+				_, err := txn.ExecContext(ctx, "ALTER TABLE dummy ADD test3 "+textType+";")
+				if err != nil {
+					return err
+				}
+				_, err = txn.ExecContext(ctx, "ALTER TABLE dummy ADD test4 "+textType+";")
 				return err
-			}
-			_, err = txn.ExecContext(ctx, "ALTER TABLE dummy ADD COLUMN test4 TEXT;")
-			return err
+			},
 		},
-	},
+	}
 }
 
 var failMigration = sqlutil.Migration{
@@ -55,38 +61,41 @@ var failMigration = sqlutil.Migration{
 }
 
 func Test_migrations_Up(t *testing.T) {
-	withFail := append(dummyMigrations, failMigration)
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		withFail := append(dummyMigrations(dbType), failMigration)
 
-	tests := []struct {
-		name       string
-		migrations []sqlutil.Migration
-		wantResult map[string]struct{}
-		wantErr    bool
-	}{
-		{
-			name:       "dummy migration",
-			migrations: dummyMigrations,
-			wantResult: map[string]struct{}{
-				"init":           {},
-				"v2":             {},
-				"multiple execs": {},
+		tests := []struct {
+			name       string
+			migrations []sqlutil.Migration
+			wantResult map[string]struct{}
+			wantErr    bool
+		}{
+			{
+				name:       "dummy migration",
+				migrations: dummyMigrations(dbType),
+				wantResult: map[string]struct{}{
+					"init":           {},
+					"v2":             {},
+					"multiple execs": {},
+				},
 			},
-		},
-		{
-			name:       "with fail",
-			migrations: withFail,
-			wantErr:    true,
-		},
-	}
+			{
+				name:       "with fail",
+				migrations: withFail,
+				wantErr:    true,
+			},
+		}
 
-	ctx := context.Background()
-	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
-		conStr, close := test.PrepareDBConnectionString(t)
+		conStr, close := test.PrepareDBConnectionString(t, dbType)
 		defer close()
 
 		for _, tt := range tests {
 			t.Run(tt.name, func(t *testing.T) {
-				driverName := "postgres"
+				driverName := sqlutil.QLDriverName
+				if dbType == test.DBTypePostgres {
+					driverName = "postgres"
+				}
 				db, err := sql.Open(driverName, conStr)
 				if err != nil {
 					t.Errorf("unable to open database: %v", err)
@@ -110,10 +119,13 @@ func Test_migrations_Up(t *testing.T) {
 
 func Test_insertMigration(t *testing.T) {
 	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
-		conStr, close := test.PrepareDBConnectionString(t)
+		conStr, close := test.PrepareDBConnectionString(t, dbType)
 		defer close()
 
-		driverName := "postgres"
+		driverName := sqlutil.QLDriverName
+		if dbType == test.DBTypePostgres {
+			driverName = "postgres"
+		}
 		db, err := sql.Open(driverName, conStr)
 		if err != nil {
 			t.Errorf("unable to open database: %v", err)
@@ -0,0 +1,325 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+
+	"modernc.org/ql"
+)
+
+// QLDriverName is the name of the database/sql driver used for file:
+// connection strings. It stores the database in a single file using the
+// embedded, pure Go QL database engine.
+const QLDriverName = "dendrite-ql"
+
+func init() {
+	ql.RegisterDriver()
+	// QL doesn't export its driver, so fetch it from database/sql. Opening
+	// the database doesn't connect to anything until it is used.
+	db, err := sql.Open("ql", "")
+	if err != nil {
+		panic(err)
+	}
+	sql.Register(QLDriverName, &qlDriver{Driver: db.Driver(), dbs: map[string]*qlDatabase{}})
+	_ = db.Close()
+}
+
+// IsQL returns true if the database uses the embedded QL database engine,
+// which uses a different SQL dialect to PostgreSQL.
+func IsQL(db *sql.DB) bool {
+	_, ok := db.Driver().(*qlDriver)
+	return ok
+}
+
+// IsQLUniqueConstraintViolation returns true if the error was caused by
+// inserting a row which conflicts with a unique index in a QL database.
+func IsQLUniqueConstraintViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "duplicate value(s)")
+}
+
+// qlDriver wraps the QL driver to work around the differences between QL
+// and the other databases that Dendrite supports:
+//   - QL refuses to update the database outside of a transaction, so
+//     statements executed outside of one run in their own transaction.
+//   - QL has no read-only transactions. Instead, statements in them run
+//     outside of a transaction, where they only wait for committed writes.
+//   - QL locks the whole database for the lifetime of a transaction, so
+//     transactions only begin when they first update the database. Until
+//     then, reads made through other connections don't have to wait for it.
+//   - Queries made outside of a transaction while one is updating the
+//     database would wait for it to finish, even when they are made by the
+//     code which is updating the database. They run in that transaction
+//     instead, where they can see its changes before they are committed.
+//   - QL holds its locks while rows are being read, so rows are read as soon
+//     as the query runs. This stops a query from deadlocking with other
+//     queries made while iterating over its rows.
+type qlDriver struct {
+	driver.Driver
+	mu  sync.Mutex
+	dbs map[string]*qlDatabase
+}
+
+// qlDatabase tracks the connection, if any, which is updating a database.
+// The mutex serialises the statements which run in that connection's
+// transaction.
+type qlDatabase struct {
+	mu     sync.Mutex
+	writer *qlConn
+}
+
+func (d *qlDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.dbs[name]
+	if !ok {
+		db = &qlDatabase{}
+		d.dbs[name] = db
+	}
+	return &qlConn{conn: conn, db: db}, nil
+}
+
+// qlConn is a connection to a QL database. The connection returned by the
+// QL driver implements all of the interfaces used here.
+type qlConn struct {
+	conn driver.Conn
+	db   *qlDatabase
+	tx   *qlTx
+}
+
+func (c *qlConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *qlConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &qlStmt{stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *qlConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *qlConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *qlConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if opts.ReadOnly {
+		return qlReadOnlyTx{}, nil
+	}
+	// QL transactions are serializable, so the isolation level is ignored.
+	c.tx = &qlTx{conn: c}
+	return c.tx, nil
+}
+
+func (c *qlConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.autocommit(ctx, func() (driver.Result, error) {
+		return c.conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	})
+}
+
+func (c *qlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.query(ctx, query, args, func() (driver.Rows, error) {
+		return c.conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	})
+}
+
+// autocommit runs the function in the connection's transaction, beginning
+// it if needed, or in a new transaction if the connection isn't in one.
+func (c *qlConn) autocommit(ctx context.Context, f func() (driver.Result, error)) (driver.Result, error) {
+	if c.tx != nil {
+		if err := c.tx.begin(ctx); err != nil {
+			return nil, err
+		}
+		c.db.mu.Lock()
+		defer c.db.mu.Unlock()
+		return f()
+	}
+	tx, err := c.BeginTx(ctx, driver.TxOptions{})
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.autocommit(ctx, f)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// query runs the function, or runs the query in the transaction which is
+// updating the database if there is one.
+func (c *qlConn) query(ctx context.Context, query string, args []driver.NamedValue, f func() (driver.Rows, error)) (driver.Rows, error) {
+	c.db.mu.Lock()
+	switch writer := c.db.writer; writer {
+	case nil:
+		c.db.mu.Unlock()
+		return readQLRows(f())
+	case c:
+		defer c.db.mu.Unlock()
+		return readQLRows(f())
+	default:
+		defer c.db.mu.Unlock()
+		return readQLRows(writer.conn.(driver.QueryerContext).QueryContext(ctx, query, args))
+	}
+}
+
+// qlTx is a transaction which only begins in QL when it first updates the
+// database.
+type qlTx struct {
+	tx   driver.Tx
+	conn *qlConn
+}
+
+func (t *qlTx) begin(ctx context.Context) (err error) {
+	if t.tx != nil {
+		return nil
+	}
+	if t.tx, err = t.conn.conn.(driver.ConnBeginTx).BeginTx(ctx, driver.TxOptions{}); err != nil {
+		return err
+	}
+	t.conn.db.mu.Lock()
+	t.conn.db.writer = t.conn
+	t.conn.db.mu.Unlock()
+	return nil
+}
+
+func (t *qlTx) Commit() error {
+	return t.end(driver.Tx.Commit)
+}
+
+func (t *qlTx) Rollback() error {
+	return t.end(driver.Tx.Rollback)
+}
+
+func (t *qlTx) end(f func(driver.Tx) error) error {
+	t.conn.tx = nil
+	if t.tx == nil {
+		return nil
+	}
+	t.conn.db.mu.Lock()
+	defer t.conn.db.mu.Unlock()
+	t.conn.db.writer = nil
+	return f(t.tx)
+}
+
+type qlReadOnlyTx struct{}
+
+func (qlReadOnlyTx) Commit() error   { return nil }
+func (qlReadOnlyTx) Rollback() error { return nil }
+
+type qlStmt struct {
+	stmt  driver.Stmt
+	conn  *qlConn
+	query string
+}
+
+func (s *qlStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *qlStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *qlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *qlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *qlStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.autocommit(ctx, func() (driver.Result, error) {
+		return s.stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+	})
+}
+
+func (s *qlStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.query(ctx, s.query, args, func() (driver.Rows, error) {
+		return s.stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	})
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+// qlRows holds the rows returned by a query, which have all been read.
+type qlRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func readQLRows(rows driver.Rows, err error) (driver.Rows, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	r := &qlRows{columns: rows.Columns()}
+	for {
+		values := make([]driver.Value, len(r.columns))
+		if err = rows.Next(values); err == io.EOF {
+			return r, nil
+		} else if err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = append([]byte(nil), b...)
+			}
+		}
+		r.values = append(r.values, values)
+	}
+}
+
+func (r *qlRows) Columns() []string {
+	return r.columns
+}
+
+func (r *qlRows) Close() error {
+	r.values = nil
+	return nil
+}
+
+func (r *qlRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
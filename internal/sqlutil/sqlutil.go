@@ -18,6 +18,12 @@ func Open(dbProperties *config.DatabaseOptions, writer Writer) (*sql.DB, error)
 	var err error
 	var driverName, dsn string
 	switch {
+	case dbProperties.ConnectionString.IsFile():
+		driverName = QLDriverName
+		dsn, err = ParseFileURI(dbProperties.ConnectionString)
+		if err != nil {
+			return nil, fmt.Errorf("ParseFileURI: %w", err)
+		}
 	case dbProperties.ConnectionString.IsPostgres():
 		driverName = "postgres"
 		dsn = string(dbProperties.ConnectionString)
@@ -29,6 +35,12 @@ func Open(dbProperties *config.DatabaseOptions, writer Writer) (*sql.DB, error)
 		return nil, err
 	}
 
+	// All connections to a file share the same embedded database, so there
+	// is nothing to limit.
+	if driverName == QLDriverName {
+		return db, nil
+	}
+
 	logger := logrus.WithFields(logrus.Fields{
 		"max_open_conns":    dbProperties.MaxOpenConns(),
 		"max_idle_conns":    dbProperties.MaxIdleConns(),
@@ -19,82 +19,55 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
-	"strings"
 
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
 
-// GetPathFromBase64Hash evaluates the path to a media file from its Base64Hash
-// 3 subdirectories are created for more manageable browsing and use the remainder as the file name.
-// For example, if Base64Hash is 'qwerty', the path will be 'q/w/erty/file'.
-func GetPathFromBase64Hash(base64Hash types.Base64Hash, absBasePath config.Path) (string, error) {
-	if len(base64Hash) < 3 {
-		return "", fmt.Errorf("invalid filePath (Base64Hash too short - min 3 characters): %q", base64Hash)
-	}
-	if len(base64Hash) > 255 {
-		return "", fmt.Errorf("invalid filePath (Base64Hash too long - max 255 characters): %q", base64Hash)
-	}
-
-	filePath, err := filepath.Abs(filepath.Join(
-		string(absBasePath),
-		string(base64Hash[0:1]),
-		string(base64Hash[1:2]),
-		string(base64Hash[2:]),
-		"file",
-	))
-	if err != nil {
-		return "", fmt.Errorf("unable to construct filePath: %w", err)
-	}
-
-	// check if the absolute absBasePath is a prefix of the absolute filePath
-	// if so, no directory escape has occurred and the filePath is valid
-	// Note: absBasePath is already absolute
-	if !strings.HasPrefix(filePath, string(absBasePath)) {
-		return "", fmt.Errorf("invalid filePath (not within absBasePath %v): %v", absBasePath, filePath)
-	}
-
-	return filePath, nil
-}
-
-// MoveFileWithHashCheck checks for hash collisions when moving a temporary file to its final path based on metadata
-// The final path is based on the hash of the file.
-// If the final path exists and the file size matches, the file does not need to be moved.
-// In error cases where the file is not a duplicate, the caller may decide to remove the final path.
-// Returns the final path of the file, whether it is a duplicate and an error.
-func MoveFileWithHashCheck(tmpDir types.Path, mediaMetadata *types.MediaMetadata, absBasePath config.Path, logger *log.Entry) (types.Path, bool, error) {
+// MoveFileWithHashCheck checks for hash collisions when moving a temporary file into the media store
+// The key of the file in the store is based on the hash of the file.
+// If a file with that key exists and the file size matches, the file does not need to be stored again.
+// In error cases where the file is not a duplicate, the caller may decide to remove the file from the store.
+// Returns whether the file is a duplicate and an error.
+func MoveFileWithHashCheck(ctx context.Context, tmpDir types.Path, mediaMetadata *types.MediaMetadata, store mediastore.MediaStore, logger *log.Entry) (bool, error) {
 	// Note: in all error and success cases, we need to remove the temporary directory
 	defer RemoveDir(tmpDir, logger)
 	duplicate := false
-	finalPath, err := GetPathFromBase64Hash(mediaMetadata.Base64Hash, absBasePath)
+	key, err := mediastore.MediaKey(mediaMetadata.Base64Hash)
 	if err != nil {
-		return "", duplicate, fmt.Errorf("failed to get file path from metadata: %w", err)
+		return duplicate, fmt.Errorf("failed to get file path from metadata: %w", err)
 	}
 
-	var stat os.FileInfo
-	// Note: The double-negative is intentional as os.IsExist(err) != !os.IsNotExist(err).
-	// The functions are error checkers to be used in different cases.
-	if stat, err = os.Stat(finalPath); !os.IsNotExist(err) {
+	size, err := store.Stat(ctx, key)
+	switch {
+	case err == nil:
 		duplicate = true
-		if stat.Size() == int64(mediaMetadata.FileSizeBytes) {
-			return types.Path(finalPath), duplicate, nil
+		if size == int64(mediaMetadata.FileSizeBytes) {
+			return duplicate, nil
 		}
-		return "", duplicate, fmt.Errorf("downloaded file with hash collision but different file size (%v)", finalPath)
+		return duplicate, fmt.Errorf("downloaded file with hash collision but different file size (%v)", key)
+	case !errors.Is(err, fs.ErrNotExist):
+		return duplicate, fmt.Errorf("failed to check for existing file (%v): %w", key, err)
 	}
-	err = moveFile(
-		types.Path(filepath.Join(string(tmpDir), "content")),
-		types.Path(finalPath),
-	)
+
+	file, err := os.Open(filepath.Join(string(tmpDir), "content"))
 	if err != nil {
-		return "", duplicate, fmt.Errorf("failed to move file to final destination (%v): %w", finalPath, err)
+		return duplicate, fmt.Errorf("failed to open temporary file: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+	if err = store.Put(ctx, key, file, int64(mediaMetadata.FileSizeBytes)); err != nil {
+		return duplicate, fmt.Errorf("failed to move file to final destination (%v): %w", key, err)
 	}
-	return types.Path(finalPath), duplicate, nil
+	return duplicate, nil
 }
 
 // RemoveDir removes a directory and logs a warning in case of errors
@@ -146,21 +119,6 @@ func WriteTempFile(
 	return
 }
 
-// moveFile attempts to move the file src to dst
-func moveFile(src types.Path, dst types.Path) error {
-	dstDir := filepath.Dir(string(dst))
-
-	err := os.MkdirAll(dstDir, 0770)
-	if err != nil {
-		return fmt.Errorf("failed to make directory: %w", err)
-	}
-	err = os.Rename(string(src), string(dst))
-	if err != nil {
-		return fmt.Errorf("failed to move directory: %w", err)
-	}
-	return nil
-}
-
 func createTempFileWriter(absBasePath config.Path) (*bufio.Writer, *os.File, types.Path, error) {
 	tmpDir, err := createTempDir(absBasePath)
 	if err != nil {
@@ -15,11 +15,16 @@
 package mediaapi
 
 import (
-	"github.com/gorilla/mux"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/sirupsen/logrus"
@@ -27,8 +32,10 @@ import (
 
 // AddPublicRoutes sets up and registers HTTP handlers for the MediaAPI component.
 func AddPublicRoutes(
-	mediaRouter *mux.Router,
+	processContext *process.ProcessContext,
+	routers httputil.Routers,
 	cm *sqlutil.Connections,
+	natsInstance *jetstream.NATSInstance,
 	cfg *config.Dendrite,
 	userAPI userapi.MediaUserAPI,
 	client *fclient.Client,
@@ -38,7 +45,46 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to connect to media db")
 	}
 
+	mediaStore, err := mediastore.NewMediaStore(&cfg.MediaAPI, cfg.MediaAPI.Storage.Backend)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to set up media storage")
+	}
+
+	js, _ := natsInstance.Prepare(processContext, &cfg.Global.JetStream)
+	rateLimitStore, err := httputil.NewRateLimitStore(
+		cfg.ClientAPI.RateLimiting.Enabled, cfg.ClientAPI.RateLimiting.Backend, js, cfg.Global.JetStream.Prefixed(jetstream.RateLimits),
+	)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to set up rate limiting")
+	}
+	rateLimits := httputil.NewRateLimits(&cfg.ClientAPI.RateLimiting, rateLimitStore, userAPI)
+
 	routing.Setup(
-		mediaRouter, cfg, mediaDB, userAPI, client,
+		routers.Media, routers.DendriteAdmin, cfg, mediaDB, mediaStore, userAPI, client, rateLimits,
 	)
+
+	if cfg.MediaAPI.Retention.Enabled() {
+		startPurgeExpiredMedia(processContext, &cfg.MediaAPI, mediaDB, mediaStore)
+	}
+}
+
+// startPurgeExpiredMedia periodically purges media which is older than the
+// configured retention lifetimes.
+func startPurgeExpiredMedia(
+	processContext *process.ProcessContext, cfg *config.MediaAPI, db storage.Database, store mediastore.MediaStore,
+) {
+	var purgeExpiredMedia func()
+	purgeExpiredMedia = func() {
+		if processContext.Context().Err() != nil {
+			return
+		}
+		deleted, err := routing.PurgeExpiredMedia(processContext.Context(), cfg, db, store)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to purge expired media")
+		} else if deleted > 0 {
+			logrus.WithField("deleted", deleted).Info("Purged expired media")
+		}
+		time.AfterFunc(cfg.Retention.PurgeInterval, purgeExpiredMedia)
+	}
+	time.AfterFunc(time.Minute, purgeExpiredMedia)
 }
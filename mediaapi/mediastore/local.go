@@ -0,0 +1,164 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mediastore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// tmpDirName is the directory under the base path used for temporary files
+// while they are being uploaded, which isn't part of the store.
+const tmpDirName = "tmp"
+
+// LocalStore stores media in the filesystem under the base path.
+type LocalStore struct {
+	absBasePath string
+}
+
+// NewLocalStore creates a media store which keeps files under the given absolute path.
+func NewLocalStore(absBasePath config.Path) *LocalStore {
+	return &LocalStore{
+		absBasePath: filepath.Clean(string(absBasePath)),
+	}
+}
+
+// path returns the absolute path of the file for a key.
+func (s *LocalStore) path(key string) (string, error) {
+	filePath := filepath.Join(s.absBasePath, filepath.FromSlash(key))
+	// check if the base path is a prefix of the file path, if so, no
+	// directory escape has occurred and the file path is valid
+	if !strings.HasPrefix(filePath, s.absBasePath+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid key (not within base path %v): %v", s.absBasePath, key)
+	}
+	return filePath, nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(filePath)
+	if err = os.MkdirAll(dir, 0770); err != nil {
+		return fmt.Errorf("failed to make directory: %w", err)
+	}
+
+	// Write to a temporary file first and then move it into place, so that
+	// partially written files are never visible.
+	tmpFile, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name()) // nolint: errcheck
+
+	written, err := io.Copy(tmpFile, r)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("wrote %d bytes but expected %d", written, size)
+	}
+	if err = os.Rename(tmpFile.Name(), filePath); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return nil, 0, err
+	}
+	return file, stat.Size(), nil
+}
+
+func (s *LocalStore) Stat(ctx context.Context, key string) (int64, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Tidy up any directories which are now empty. Removing a directory which
+	// isn't empty fails, in which case we're done.
+	for dir := filepath.Dir(filePath); dir != s.absBasePath; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *LocalStore) Walk(ctx context.Context, fn func(key string, size int64) error) error {
+	return filepath.WalkDir(s.absBasePath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(s.absBasePath, filePath)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == tmpDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), info.Size())
+	})
+}
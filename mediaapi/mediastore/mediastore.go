@@ -0,0 +1,144 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mediastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// MediaStore is where the content of media files and thumbnails is kept. Objects
+// are addressed by keys, which are built from the hash of the media file using
+// MediaKey and ThumbnailKey.
+type MediaStore interface {
+	// Put stores size bytes read from r under the given key, replacing any existing object.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get returns the content and the size of an object. The caller must close the
+	// returned reader. Returns an error wrapping fs.ErrNotExist if there is no such object.
+	Get(ctx context.Context, key string) (io.ReadCloser, int64, error)
+	// Stat returns the size of an object. Returns an error wrapping fs.ErrNotExist if
+	// there is no such object.
+	Stat(ctx context.Context, key string) (int64, error)
+	// Delete removes an object. Deleting an object which doesn't exist is not an error.
+	Delete(ctx context.Context, key string) error
+	// Walk calls fn for every object in the store, stopping at the first error.
+	Walk(ctx context.Context, fn func(key string, size int64) error) error
+}
+
+// NewMediaStore creates the media store for the given backend, which is usually
+// the configured media_api.storage.backend.
+func NewMediaStore(cfg *config.MediaAPI, backend string) (MediaStore, error) {
+	switch backend {
+	case config.MediaStorageLocal:
+		return NewLocalStore(cfg.AbsBasePath), nil
+	case config.MediaStorageS3:
+		return NewS3Store(&cfg.Storage.S3)
+	default:
+		return nil, fmt.Errorf("unknown media storage backend %q", backend)
+	}
+}
+
+// thumbnailTemplate is the name template for thumbnails
+const thumbnailTemplate = "thumbnail-%vx%v-%v"
+
+// base64HashRegex matches the characters which are allowed in a Base64Hash. Keys are
+// only built from valid hashes so that they can't escape the base path or prefix.
+var base64HashRegex = regexp.MustCompile("^[A-Za-z0-9_=-]+$")
+
+// mediaDir returns the key prefix under which a media file and its thumbnails are stored.
+// 3 levels are used for more manageable browsing, e.g. the Base64Hash 'qwerty' is stored
+// under 'q/w/erty'.
+func mediaDir(base64Hash types.Base64Hash) (string, error) {
+	if len(base64Hash) < 3 {
+		return "", fmt.Errorf("invalid Base64Hash (too short - min 3 characters): %q", base64Hash)
+	}
+	if len(base64Hash) > 255 {
+		return "", fmt.Errorf("invalid Base64Hash (too long - max 255 characters): %q", base64Hash)
+	}
+	if !base64HashRegex.MatchString(string(base64Hash)) {
+		return "", fmt.Errorf("invalid Base64Hash (invalid characters): %q", base64Hash)
+	}
+	return path.Join(
+		string(base64Hash[0:1]),
+		string(base64Hash[1:2]),
+		string(base64Hash[2:]),
+	), nil
+}
+
+// MediaKey returns the key of a media file from its Base64Hash.
+// For example, if Base64Hash is 'qwerty', the key will be 'q/w/erty/file'.
+func MediaKey(base64Hash types.Base64Hash) (string, error) {
+	dir, err := mediaDir(base64Hash)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, "file"), nil
+}
+
+// ThumbnailKey returns the key of a thumbnail of a media file, which is stored
+// alongside the media file, e.g. 'q/w/erty/thumbnail-32x32-crop'.
+func ThumbnailKey(base64Hash types.Base64Hash, size types.ThumbnailSize) (string, error) {
+	dir, err := mediaDir(base64Hash)
+	if err != nil {
+		return "", err
+	}
+	if size.ResizeMethod != types.Crop && size.ResizeMethod != types.Scale {
+		return "", fmt.Errorf("invalid thumbnail resize method: %q", size.ResizeMethod)
+	}
+	return path.Join(dir, fmt.Sprintf(thumbnailTemplate, size.Width, size.Height, size.ResizeMethod)), nil
+}
+
+// Copy copies every object from one media store to another. Objects which already
+// exist in the destination with the same size are skipped. If progress is not nil,
+// it is called for every object after it has been copied or skipped.
+// Returns the number of objects copied.
+func Copy(ctx context.Context, from, to MediaStore, progress func(key string, copied bool)) (int, error) {
+	copied := 0
+	err := from.Walk(ctx, func(key string, size int64) error {
+		existingSize, err := to.Stat(ctx, key)
+		switch {
+		case err == nil && existingSize == size:
+			if progress != nil {
+				progress(key, false)
+			}
+			return nil
+		case err != nil && !errors.Is(err, fs.ErrNotExist):
+			return fmt.Errorf("failed to stat %q in destination: %w", key, err)
+		}
+
+		r, size, err := from.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %w", key, err)
+		}
+		defer r.Close() // nolint: errcheck
+		if err = to.Put(ctx, key, r, size); err != nil {
+			return fmt.Errorf("failed to write %q: %w", key, err)
+		}
+		copied++
+		if progress != nil {
+			progress(key, true)
+		}
+		return nil
+	})
+	return copied, err
+}
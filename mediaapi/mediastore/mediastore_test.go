@@ -0,0 +1,333 @@
+package mediastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// fakeS3 is a minimal in-memory stand-in for an S3-compatible object store,
+// supporting path-style requests to a single bucket.
+type fakeS3 struct {
+	mu       sync.Mutex
+	bucket   string
+	objects  map[string][]byte
+	pageSize int
+}
+
+// fakeS3Credential is the start of the credential every request must be signed with.
+const fakeS3Credential = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, fakeS3Credential) || !strings.Contains(auth, "/us-east-1/s3/aws4_request") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	bucketPrefix := "/" + f.bucket
+	if !strings.HasPrefix(req.URL.Path, bucketPrefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, bucketPrefix), "/")
+
+	switch {
+	case key == "" && req.Method == http.MethodGet:
+		f.list(w, req)
+	case req.Method == http.MethodPut:
+		data, err := readFakeS3Body(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+		w.Header().Set("ETag", `"etag"`)
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case req.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// readFakeS3Body reads an uploaded object, decoding it if it was sent with
+// chunked signatures.
+func readFakeS3Body(req *http.Request) ([]byte, error) {
+	if req.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return io.ReadAll(req.Body)
+	}
+	var data []byte
+	r := bufio.NewReader(req.Body)
+	for {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		chunk := make([]byte, size+2) // including the trailing CRLF
+		if _, err = io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			break
+		}
+		data = append(data, chunk[:size]...)
+	}
+	if decoded := req.Header.Get("X-Amz-Decoded-Content-Length"); decoded != strconv.Itoa(len(data)) {
+		return nil, fmt.Errorf("expected %s bytes, got %d", decoded, len(data))
+	}
+	return data, nil
+}
+
+type fakeListObject struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+}
+
+type fakeListResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Contents              []fakeListObject `xml:"Contents"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	NextContinuationToken string           `xml:"NextContinuationToken"`
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("list-type") != "2" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	prefix := req.URL.Query().Get("prefix")
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start := 0
+	if token := req.URL.Query().Get("continuation-token"); token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	var result fakeListResult
+	for i := start; i < len(keys) && i < start+f.pageSize; i++ {
+		result.Contents = append(result.Contents, fakeListObject{
+			Key:          keys[i],
+			Size:         int64(len(f.objects[keys[i]])),
+			LastModified: time.Now().UTC(),
+			ETag:         `"etag"`,
+		})
+	}
+	if start+f.pageSize < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + f.pageSize)
+	}
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func newFakeS3(t *testing.T, prefix string) (*S3Store, *fakeS3) {
+	cfg := config.S3MediaStorage{
+		Region:          "us-east-1",
+		Bucket:          "media",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Prefix:          prefix,
+		ForcePathStyle:  true,
+	}
+	fake := &fakeS3{
+		bucket:   cfg.Bucket,
+		objects:  map[string][]byte{},
+		pageSize: 2,
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	cfg.Endpoint = srv.URL
+	store, err := NewS3Store(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, fake
+}
+
+func testMediaStore(t *testing.T, store MediaStore) {
+	ctx := context.Background()
+	mediaKey, err := MediaKey("qwerty=_-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbKey, err := ThumbnailKey("qwerty=_-", types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: types.Crop})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = store.Stat(ctx, mediaKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist for missing object, got %v", err)
+	}
+	if _, _, err = store.Get(ctx, mediaKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist for missing object, got %v", err)
+	}
+
+	for key, content := range map[string]string{mediaKey: "hello world", thumbKey: "thumb"} {
+		if err = store.Put(ctx, key, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatalf("failed to put %q: %v", key, err)
+		}
+	}
+	size, err := store.Stat(ctx, mediaKey)
+	if err != nil || size != 11 {
+		t.Fatalf("expected size 11, got %d (err %v)", size, err)
+	}
+	r, size, err := store.Get(ctx, mediaKey)
+	if err != nil {
+		t.Fatalf("failed to get object: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil || string(data) != "hello world" || size != 11 {
+		t.Fatalf("unexpected object content %q (size %d, err %v)", data, size, err)
+	}
+
+	walked := map[string]int64{}
+	if err = store.Walk(ctx, func(key string, size int64) error {
+		walked[key] = size
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to walk store: %v", err)
+	}
+	want := map[string]int64{mediaKey: 11, thumbKey: 5}
+	if len(walked) != len(want) || walked[mediaKey] != 11 || walked[thumbKey] != 5 {
+		t.Fatalf("expected to walk %v, got %v", want, walked)
+	}
+
+	if err = store.Delete(ctx, mediaKey); err != nil {
+		t.Fatalf("failed to delete object: %v", err)
+	}
+	if _, err = store.Stat(ctx, mediaKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist for deleted object, got %v", err)
+	}
+	if err = store.Delete(ctx, mediaKey); err != nil {
+		t.Fatalf("deleting a missing object should not fail: %v", err)
+	}
+	if _, err = store.Stat(ctx, thumbKey); err != nil {
+		t.Fatalf("thumbnail should not have been deleted: %v", err)
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	basePath := t.TempDir()
+	testMediaStore(t, NewLocalStore(config.Path(basePath)))
+
+	// Keys must not be able to escape the base path.
+	store := NewLocalStore(config.Path(basePath))
+	if err := store.Put(context.Background(), "../escape", strings.NewReader("x"), 1); err == nil {
+		t.Fatalf("expected error writing outside of the base path")
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	for _, prefix := range []string{"", "dendrite/media"} {
+		t.Run("prefix="+prefix, func(t *testing.T) {
+			store, fake := newFakeS3(t, prefix)
+			testMediaStore(t, store)
+			for key := range fake.objects {
+				if !strings.HasPrefix(key, prefix) {
+					t.Fatalf("object %q was stored without the prefix %q", key, prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	from := NewLocalStore(config.Path(t.TempDir()))
+	to, fake := newFakeS3(t, "")
+
+	objects := map[string]string{}
+	for _, hash := range []types.Base64Hash{"abcdef", "ghijkl", "mnopqr"} {
+		key, err := MediaKey(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects[key] = string(hash) + " content"
+		if err = from.Put(ctx, key, strings.NewReader(objects[key]), int64(len(objects[key]))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Temporary uploads aren't part of the store and must not be copied.
+	if err := from.Put(ctx, "tmp/1234/content", strings.NewReader("tmp"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := Copy(ctx, from, to, nil)
+	if err != nil {
+		t.Fatalf("failed to copy: %v", err)
+	}
+	if copied != len(objects) {
+		t.Fatalf("expected %d objects to be copied, got %d", len(objects), copied)
+	}
+	for key, content := range objects {
+		if string(fake.objects[key]) != content {
+			t.Fatalf("object %q: expected %q, got %q", key, content, fake.objects[key])
+		}
+	}
+
+	// Copying again should skip everything.
+	copied, err = Copy(ctx, from, to, nil)
+	if err != nil {
+		t.Fatalf("failed to copy: %v", err)
+	}
+	if copied != 0 {
+		t.Fatalf("expected no objects to be copied, got %d", copied)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	for _, hash := range []types.Base64Hash{"ab", "../../etc", "a/b/c"} {
+		if _, err := MediaKey(hash); err == nil {
+			t.Fatalf("expected error for invalid hash %q", hash)
+		}
+	}
+	if _, err := ThumbnailKey("abcdef", types.ThumbnailSize{Width: 1, Height: 1, ResizeMethod: "../x"}); err == nil {
+		t.Fatalf("expected error for invalid resize method")
+	}
+	key, err := ThumbnailKey("qwerty", types.ThumbnailSize{Width: 640, Height: 480, ResizeMethod: types.Scale})
+	if err != nil || key != "q/w/erty/thumbnail-640x480-scale" {
+		t.Fatalf("unexpected thumbnail key %q (err %v)", key, err)
+	}
+}
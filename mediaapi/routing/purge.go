@@ -0,0 +1,194 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// purgeBatchSize is the number of media purged for each database query
+const purgeBatchSize = 100
+
+type purgeMediaResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// AdminPurgeRemoteMedia implements POST /_dendrite/admin/purgeRemoteMedia?before_ts=<ms>
+// Deletes all media from remote servers which was fetched before the given timestamp.
+// The media will be fetched again if it is requested.
+func AdminPurgeRemoteMedia(req *http.Request, cfg *config.MediaAPI, db storage.Database, store mediastore.MediaStore) util.JSONResponse {
+	beforeTS, err := strconv.ParseUint(req.URL.Query().Get("before_ts"), 10, 64)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("before_ts must be a timestamp in milliseconds"),
+		}
+	}
+	deleted, err := purgeRemoteMediaBefore(req.Context(), cfg, db, store, spec.Timestamp(beforeTS))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to purge remote media")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: purgeMediaResponse{Deleted: deleted},
+	}
+}
+
+// AdminPurgeMedia implements POST /_dendrite/admin/purgeMedia/{serverName}/{mediaID}
+// Deletes a single media file, which may be local or remote, and its thumbnails.
+func AdminPurgeMedia(req *http.Request, cfg *config.MediaAPI, db storage.Database, store mediastore.MediaStore) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	mediaMetadata, err := db.GetMediaMetadata(req.Context(), types.MediaID(vars["mediaID"]), spec.ServerName(vars["serverName"]))
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetMediaMetadata failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if mediaMetadata == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Media not found"),
+		}
+	}
+	if err = purgeMedia(req.Context(), cfg, db, store, mediaMetadata); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to purge media")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: purgeMediaResponse{Deleted: 1},
+	}
+}
+
+// PurgeExpiredMedia deletes media which is older than the configured retention
+// lifetimes. Returns the number of media deleted.
+func PurgeExpiredMedia(ctx context.Context, cfg *config.MediaAPI, db storage.Database, store mediastore.MediaStore) (int, error) {
+	now := time.Now()
+	deleted := 0
+	if cfg.Retention.RemoteMediaLifetime > 0 {
+		before := spec.AsTimestamp(now.Add(-cfg.Retention.RemoteMediaLifetime))
+		n, err := purgeRemoteMediaBefore(ctx, cfg, db, store, before)
+		deleted += n
+		if err != nil {
+			return deleted, fmt.Errorf("failed to purge remote media: %w", err)
+		}
+	}
+	if cfg.Retention.LocalMediaLifetime > 0 {
+		before := spec.AsTimestamp(now.Add(-cfg.Retention.LocalMediaLifetime))
+		n, err := purgeMediaBatches(ctx, cfg, db, store, func() ([]*types.MediaMetadata, error) {
+			return db.GetLocalMediaLastAccessedBefore(ctx, cfg.Matrix.ServerName, before, purgeBatchSize)
+		})
+		deleted += n
+		if err != nil {
+			return deleted, fmt.Errorf("failed to purge local media: %w", err)
+		}
+	}
+	return deleted, nil
+}
+
+func purgeRemoteMediaBefore(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, store mediastore.MediaStore, before spec.Timestamp,
+) (int, error) {
+	return purgeMediaBatches(ctx, cfg, db, store, func() ([]*types.MediaMetadata, error) {
+		return db.GetRemoteMediaBefore(ctx, cfg.Matrix.ServerName, before, purgeBatchSize)
+	})
+}
+
+// purgeMediaBatches purges the media returned by nextBatch until there is none left.
+// Purged media is deleted from the database, so nextBatch returns different media each time.
+func purgeMediaBatches(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, store mediastore.MediaStore,
+	nextBatch func() ([]*types.MediaMetadata, error),
+) (int, error) {
+	deleted := 0
+	for {
+		batch, err := nextBatch()
+		if err != nil {
+			return deleted, err
+		}
+		for _, mediaMetadata := range batch {
+			if err = purgeMedia(ctx, cfg, db, store, mediaMetadata); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+		if len(batch) < purgeBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// purgeMedia deletes the metadata of the media and its thumbnails from the database, and then
+// removes the file and thumbnails from the media store if no other media uses the same file.
+func purgeMedia(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, store mediastore.MediaStore, mediaMetadata *types.MediaMetadata,
+) error {
+	logger := util.GetLogger(ctx).WithField("media_id", mediaMetadata.MediaID).WithField("origin", mediaMetadata.Origin)
+	thumbnails, fileUnused, err := db.DeleteMedia(ctx, mediaMetadata.MediaID, mediaMetadata.Origin)
+	if err != nil {
+		return fmt.Errorf("db.DeleteMedia: %w", err)
+	}
+	logger.Debug("Purged media")
+	if !fileUnused {
+		return nil
+	}
+
+	// Thumbnails are stored alongside the file, so they may have been generated for
+	// other media with the same file which was purged before. Remove the pre-generated
+	// sizes as well as the thumbnails we know about for this media.
+	sizes := map[types.ThumbnailSize]struct{}{}
+	for _, thumbnail := range thumbnails {
+		sizes[thumbnail.ThumbnailSize] = struct{}{}
+	}
+	for _, size := range cfg.ThumbnailSizes {
+		sizes[types.ThumbnailSize(size)] = struct{}{}
+	}
+	for size := range sizes {
+		key, err := mediastore.ThumbnailKey(mediaMetadata.Base64Hash, size)
+		if err != nil {
+			continue
+		}
+		if err = store.Delete(ctx, key); err != nil {
+			logger.WithError(err).Warn("Failed to remove thumbnail from the media store")
+		}
+	}
+	removeMediaFile(ctx, store, mediaMetadata.Base64Hash, logger)
+	return nil
+}
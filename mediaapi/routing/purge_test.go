@@ -0,0 +1,158 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+func TestPurgeMedia(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+		db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("failed to open database: %s", err)
+		}
+
+		basePath := config.Path(t.TempDir())
+		store := mediastore.NewLocalStore(basePath)
+		cfg := &config.MediaAPI{
+			Matrix:         &config.Global{},
+			BasePath:       basePath,
+			AbsBasePath:    basePath,
+			ThumbnailSizes: []config.ThumbnailSize{{Width: 32, Height: 32, ResizeMethod: types.Crop}},
+		}
+		cfg.Matrix.ServerName = "test"
+		ctx := context.Background()
+
+		// storeMedia stores the metadata of the media, and a file and thumbnail for its hash
+		storeMedia := func(t *testing.T, m *types.MediaMetadata) {
+			t.Helper()
+			if err := db.StoreMediaMetadata(ctx, m); err != nil {
+				t.Fatalf("failed to store media metadata: %s", err)
+			}
+			key, err := mediastore.MediaKey(m.Base64Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = store.Put(ctx, key, bytes.NewReader([]byte("file")), 4); err != nil {
+				t.Fatal(err)
+			}
+			key, err = mediastore.ThumbnailKey(m.Base64Hash, types.ThumbnailSize(cfg.ThumbnailSizes[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = store.Put(ctx, key, bytes.NewReader([]byte("thumb")), 5); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fileExists := func(t *testing.T, hash types.Base64Hash) bool {
+			t.Helper()
+			key, err := mediastore.MediaKey(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.Stat(ctx, key)
+			if errors.Is(err, fs.ErrNotExist) {
+				return false
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			return true
+		}
+
+		// The creation time is always set when media is stored, so local media is expired
+		// by its last access time and remote media by a very short lifetime.
+		old := spec.AsTimestamp(time.Now().Add(-time.Hour * 48))
+		storeMedia(t, &types.MediaMetadata{MediaID: "oldremote", Origin: "remote", Base64Hash: "b2xkcmVtb3Rl"})
+		storeMedia(t, &types.MediaMetadata{MediaID: "oldlocal", Origin: "test", Base64Hash: "b2xkbG9jYWw="})
+		// shares its file with oldlocal, but was downloaded recently
+		storeMedia(t, &types.MediaMetadata{MediaID: "newlocal", Origin: "test", Base64Hash: "b2xkbG9jYWw="})
+		if err = db.UpdateMediaLastAccess(ctx, "oldlocal", "test", old); err != nil {
+			t.Fatalf("failed to update last access: %s", err)
+		}
+		time.Sleep(time.Millisecond * 2)
+
+		t.Run("purges expired media", func(t *testing.T) {
+			cfg.Retention.RemoteMediaLifetime = time.Millisecond
+			cfg.Retention.LocalMediaLifetime = time.Hour * 24
+			deleted, err := PurgeExpiredMedia(ctx, cfg, db, store)
+			if err != nil {
+				t.Fatalf("failed to purge media: %s", err)
+			}
+			if deleted != 2 {
+				t.Fatalf("expected 2 media to be purged, got %d", deleted)
+			}
+			if fileExists(t, "b2xkcmVtb3Rl") {
+				t.Fatalf("expected file of oldremote to be removed")
+			}
+			key, _ := mediastore.ThumbnailKey("b2xkcmVtb3Rl", types.ThumbnailSize(cfg.ThumbnailSizes[0]))
+			if _, err = store.Stat(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("expected thumbnail of oldremote to be removed, got %v", err)
+			}
+			if !fileExists(t, "b2xkbG9jYWw=") {
+				t.Fatalf("expected file of oldlocal to be kept, as it is used by newlocal")
+			}
+		})
+
+		t.Run("purges remote media with the admin endpoint", func(t *testing.T) {
+			storeMedia(t, &types.MediaMetadata{MediaID: "newremote", Origin: "remote", Base64Hash: "bmV3cmVtb3Rl"})
+			req := httptest.NewRequest(http.MethodPost, "/admin/purgeRemoteMedia", nil)
+			if res := AdminPurgeRemoteMedia(req, cfg, db, store); res.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400 without before_ts, got %d", res.Code)
+			}
+			beforeTS := spec.AsTimestamp(time.Now().Add(time.Hour))
+			req = httptest.NewRequest(http.MethodPost, fmt.Sprintf("/admin/purgeRemoteMedia?before_ts=%d", beforeTS), nil)
+			res := AdminPurgeRemoteMedia(req, cfg, db, store)
+			if res.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", res.Code)
+			}
+			if deleted := res.JSON.(purgeMediaResponse).Deleted; deleted != 1 {
+				t.Fatalf("expected 1 media to be purged, got %d", deleted)
+			}
+			if fileExists(t, "bmV3cmVtb3Rl") {
+				t.Fatalf("expected file of newremote to be removed")
+			}
+			if !fileExists(t, "b2xkbG9jYWw=") {
+				t.Fatalf("expected local media to be kept")
+			}
+		})
+
+		t.Run("purges single media with the admin endpoint", func(t *testing.T) {
+			purge := func(mediaID string) int {
+				req := httptest.NewRequest(http.MethodPost, "/admin/purgeMedia/test/"+mediaID, nil)
+				req = mux.SetURLVars(req, map[string]string{"serverName": "test", "mediaID": mediaID})
+				return AdminPurgeMedia(req, cfg, db, store).Code
+			}
+			if code := purge("unknown"); code != http.StatusNotFound {
+				t.Fatalf("expected 404, got %d", code)
+			}
+			if code := purge("newlocal"); code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", code)
+			}
+			if fileExists(t, "b2xkbG9jYWw=") {
+				t.Fatalf("expected file of newlocal to be removed")
+			}
+		})
+	})
+}
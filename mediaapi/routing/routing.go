@@ -21,6 +21,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -46,13 +47,14 @@ type configResponse struct {
 // nolint: gocyclo
 func Setup(
 	publicAPIMux *mux.Router,
+	dendriteAdminRouter *mux.Router,
 	cfg *config.Dendrite,
 	db storage.Database,
+	store mediastore.MediaStore,
 	userAPI userapi.MediaUserAPI,
 	client *fclient.Client,
+	rateLimits *httputil.RateLimits,
 ) {
-	rateLimits := httputil.NewRateLimits(&cfg.ClientAPI.RateLimiting)
-
 	v3mux := publicAPIMux.PathPrefix("/{apiversion:(?:r0|v1|v3)}/").Subrouter()
 
 	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
@@ -62,10 +64,10 @@ func Setup(
 	uploadHandler := httputil.MakeAuthAPI(
 		"upload", userAPI,
 		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
-			if r := rateLimits.Limit(req, dev); r != nil {
+			if r := rateLimits.LimitClass(req, dev, httputil.RateLimitMediaUpload); r != nil {
 				return *r
 			}
-			return Upload(req, &cfg.MediaAPI, dev, db, activeThumbnailGeneration)
+			return Upload(req, &cfg.MediaAPI, dev, db, store, activeThumbnailGeneration)
 		},
 	)
 
@@ -86,17 +88,40 @@ func Setup(
 	v3mux.Handle("/upload", uploadHandler).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/config", configHandler).Methods(http.MethodGet, http.MethodOptions)
 
+	if cfg.MediaAPI.URLPreview.Enabled {
+		previewClient := NewURLPreviewClient(&cfg.MediaAPI.URLPreview)
+		previewHandler := httputil.MakeAuthAPI("preview_url", userAPI, func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, dev); r != nil {
+				return *r
+			}
+			return PreviewURL(req, &cfg.MediaAPI, dev, db, store, previewClient, activeThumbnailGeneration)
+		})
+		v3mux.Handle("/preview_url", previewHandler).Methods(http.MethodGet, http.MethodOptions)
+	}
+
 	activeRemoteRequests := &types.ActiveRemoteRequests{
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
 
-	downloadHandler := makeDownloadAPI("download", &cfg.MediaAPI, rateLimits, db, client, activeRemoteRequests, activeThumbnailGeneration)
+	downloadHandler := makeDownloadAPI("download", &cfg.MediaAPI, rateLimits, db, store, client, activeRemoteRequests, activeThumbnailGeneration)
 	v3mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 	v3mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 
 	v3mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		makeDownloadAPI("thumbnail", &cfg.MediaAPI, rateLimits, db, client, activeRemoteRequests, activeThumbnailGeneration),
+		makeDownloadAPI("thumbnail", &cfg.MediaAPI, rateLimits, db, store, client, activeRemoteRequests, activeThumbnailGeneration),
 	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/purgeRemoteMedia",
+		httputil.MakeAdminAPI("admin_purge_remote_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPurgeRemoteMedia(req, &cfg.MediaAPI, db, store)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/purgeMedia/{serverName}/{mediaID}",
+		httputil.MakeAdminAPI("admin_purge_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPurgeMedia(req, &cfg.MediaAPI, db, store)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
 }
 
 func makeDownloadAPI(
@@ -104,6 +129,7 @@ func makeDownloadAPI(
 	cfg *config.MediaAPI,
 	rateLimits *httputil.RateLimits,
 	db storage.Database,
+	store mediastore.MediaStore,
 	client *fclient.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -163,6 +189,7 @@ func makeDownloadAPI(
 			types.MediaID(vars["mediaId"]),
 			cfg,
 			db,
+			store,
 			client,
 			activeRemoteRequests,
 			activeThumbnailGeneration,
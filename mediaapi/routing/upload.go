@@ -22,11 +22,10 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"path"
 	"strings"
 
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/thumbnailer"
 	"github.com/matrix-org/dendrite/mediaapi/types"
@@ -57,13 +56,13 @@ type uploadResponse struct {
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
+func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, store mediastore.MediaStore, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
 	r, resErr := parseAndValidateRequest(req, cfg, dev)
 	if resErr != nil {
 		return *resErr
 	}
 
-	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
+	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, store, activeThumbnailGeneration); resErr != nil {
 		return *resErr
 	}
 
@@ -129,6 +128,7 @@ func (r *uploadRequest) doUpload(
 	reqReader io.Reader,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.MediaStore,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) *util.JSONResponse {
 	r.Logger.WithFields(log.Fields{
@@ -237,7 +237,7 @@ func (r *uploadRequest) doUpload(
 	}).Info("File uploaded")
 
 	return r.storeFileAndMetadata(
-		ctx, tmpDir, cfg.AbsBasePath, db, cfg.ThumbnailSizes,
+		ctx, tmpDir, db, store, cfg.ThumbnailSizes,
 		activeThumbnailGeneration, cfg.MaxThumbnailGenerators,
 	)
 }
@@ -277,21 +277,21 @@ func (r *uploadRequest) Validate(maxFileSizeBytes config.FileSizeBytes) *util.JS
 	return nil
 }
 
-// storeFileAndMetadata moves the temporary file to its final path based on metadata and stores the metadata in the database
-// See getPathFromMediaMetadata in fileutils for details of the final path.
+// storeFileAndMetadata moves the temporary file into the media store and stores the metadata in the database
+// See MediaKey in mediastore for details of where the file is stored.
 // The order of operations is important as it avoids metadata entering the database before the file
 // is ready, and if we fail to move the file, it never gets added to the database.
 // Returns a util.JSONResponse error and cleans up directories in case of error.
 func (r *uploadRequest) storeFileAndMetadata(
 	ctx context.Context,
 	tmpDir types.Path,
-	absBasePath config.Path,
 	db storage.Database,
+	store mediastore.MediaStore,
 	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) *util.JSONResponse {
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	duplicate, err := fileutils.MoveFileWithHashCheck(ctx, tmpDir, r.MediaMetadata, store, r.Logger)
 	if err != nil {
 		r.Logger.WithError(err).Error("Failed to move file.")
 		return &util.JSONResponse{
@@ -300,7 +300,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 		}
 	}
 	if duplicate {
-		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
+		r.Logger.WithField("Base64Hash", r.MediaMetadata.Base64Hash).Info("File was stored previously - discarding duplicate")
 	}
 
 	if err = db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
@@ -309,7 +309,7 @@ func (r *uploadRequest) storeFileAndMetadata(
 		// there is valid metadata in the database for that file. As such we only
 		// remove the file if it is not a duplicate.
 		if !duplicate {
-			fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
+			removeMediaFile(ctx, store, r.MediaMetadata.Base64Hash, r.Logger)
 		}
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -318,7 +318,12 @@ func (r *uploadRequest) storeFileAndMetadata(
 	}
 
 	go func() {
-		file, err := os.Open(string(finalPath))
+		key, err := mediastore.MediaKey(r.MediaMetadata.Base64Hash)
+		if err != nil {
+			r.Logger.WithError(err).Error("unable to get file key")
+			return
+		}
+		file, _, err := store.Get(context.Background(), key)
 		if err != nil {
 			r.Logger.WithError(err).Error("unable to open file")
 			return
@@ -326,20 +331,20 @@ func (r *uploadRequest) storeFileAndMetadata(
 		defer file.Close() // nolint: errcheck
 		// http.DetectContentType only needs 512 bytes
 		buf := make([]byte, 512)
-		_, err = file.Read(buf)
-		if err != nil {
+		n, err := io.ReadFull(file, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
 			r.Logger.WithError(err).Error("unable to read file")
 			return
 		}
 		// Check if we need to generate thumbnails
-		fileType := http.DetectContentType(buf)
+		fileType := http.DetectContentType(buf[:n])
 		if !strings.HasPrefix(fileType, "image") {
 			r.Logger.WithField("contentType", fileType).Debugf("uploaded file is not an image or can not be thumbnailed, not generating thumbnails")
 			return
 		}
 
 		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
+			context.Background(), store, thumbnailSizes, r.MediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 		)
 		if err != nil {
@@ -352,3 +357,14 @@ func (r *uploadRequest) storeFileAndMetadata(
 
 	return nil
 }
+
+// removeMediaFile removes a media file from the media store and logs a warning in case of errors
+func removeMediaFile(ctx context.Context, store mediastore.MediaStore, hash types.Base64Hash, logger *log.Entry) {
+	key, err := mediastore.MediaKey(hash)
+	if err == nil {
+		err = store.Delete(ctx, key)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Failed to remove file from the media store")
+	}
+}
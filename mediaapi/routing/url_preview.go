@@ -0,0 +1,391 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // register the GIF decoder for image.DecodeConfig
+	_ "image/jpeg" // register the JPEG decoder for image.DecodeConfig
+	_ "image/png"  // register the PNG decoder for image.DecodeConfig
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+)
+
+// maxURLPreviewRedirects is the number of redirects which are followed when fetching a page
+const maxURLPreviewRedirects = 10
+
+var errURLPreviewTooLarge = errors.New("content exceeds the maximum size")
+
+// NewURLPreviewClient creates an HTTP client for fetching pages to preview. The client
+// refuses to connect to any address in the configured IP range blacklist. The check is
+// done when dialling, after DNS resolution, so that hostnames which resolve to
+// blacklisted addresses (including after a redirect) are also rejected.
+func NewURLPreviewClient(cfg *config.URLPreview) *http.Client {
+	blacklist := cfg.IPRangeBlacklistNetworks()
+	dialer := &net.Dialer{
+		Timeout: cfg.Timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("unable to parse IP address %q", host)
+			}
+			for _, network := range blacklist {
+				if network.Contains(ip) {
+					return fmt.Errorf("IP address %s is blacklisted", ip)
+				}
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			// Don't use a proxy, as the blacklist would then only apply to the proxy address.
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   cfg.Timeout,
+			ResponseHeaderTimeout: cfg.Timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxURLPreviewRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxURLPreviewRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("unsupported redirect scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// PreviewURL implements GET /preview_url
+// https://spec.matrix.org/v1.10/client-server-api/#get_matrixmediav3preview_url
+// Previews are cached in the database, so that the same URL is only fetched once
+// per cache lifetime. Images referenced by the page are stored in the media
+// repository in the same way as uploads, and returned as mxc:// URIs.
+func PreviewURL(
+	req *http.Request,
+	cfg *config.MediaAPI,
+	dev *userapi.Device,
+	db storage.Database,
+	store mediastore.MediaStore,
+	client *http.Client,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) util.JSONResponse {
+	pageURL, err := url.Parse(req.URL.Query().Get("url"))
+	if err != nil || !pageURL.IsAbs() || (pageURL.Scheme != "http" && pageURL.Scheme != "https") || pageURL.Host == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("url must be an absolute http or https URL"),
+		}
+	}
+	// Fragments never reach the remote server, so don't cache them separately.
+	pageURL.Fragment = ""
+
+	ts := spec.AsTimestamp(time.Now())
+	if tsStr := req.URL.Query().Get("ts"); tsStr != "" {
+		var reqTS uint64
+		reqTS, err = strconv.ParseUint(tsStr, 10, 64)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("ts must be a timestamp in milliseconds"),
+			}
+		}
+		ts = spec.Timestamp(reqTS)
+	}
+
+	logger := util.GetLogger(req.Context()).WithField("url", pageURL.String())
+
+	cached, err := db.GetURLPreview(req.Context(), pageURL.String(), ts)
+	if err != nil {
+		logger.WithError(err).Error("db.GetURLPreview failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if cached != nil {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: cached.OpenGraph,
+		}
+	}
+
+	p := &urlPreviewer{
+		cfg:                       cfg,
+		dev:                       dev,
+		db:                        db,
+		store:                     store,
+		client:                    client,
+		activeThumbnailGeneration: activeThumbnailGeneration,
+		logger:                    logger,
+	}
+	og, err := p.preview(req.Context(), pageURL)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to generate URL preview")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: spec.Unknown("Failed to generate a preview for the URL"),
+		}
+	}
+
+	now := time.Now()
+	preview := &types.URLPreview{
+		URL:              pageURL.String(),
+		Timestamp:        spec.AsTimestamp(now),
+		ExpiresTimestamp: spec.AsTimestamp(now.Add(cfg.URLPreview.CacheLifetime)),
+		OpenGraph:        og,
+	}
+	if err = db.StoreURLPreview(req.Context(), preview); err != nil {
+		// We've still got a preview to return, so don't fail the request.
+		logger.WithError(err).Error("db.StoreURLPreview failed")
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: og,
+	}
+}
+
+// urlPreviewer contains everything needed to generate a single URL preview.
+type urlPreviewer struct {
+	cfg                       *config.MediaAPI
+	dev                       *userapi.Device
+	db                        storage.Database
+	store                     mediastore.MediaStore
+	client                    *http.Client
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration
+	logger                    *log.Entry
+}
+
+// preview fetches the URL and returns the OpenGraph properties for it. If the URL
+// points to an image, the image itself is used as the preview.
+func (p *urlPreviewer) preview(ctx context.Context, pageURL *url.URL) (map[string]interface{}, error) {
+	data, contentType, finalURL, err := p.fetch(ctx, pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	og := map[string]interface{}{}
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		if err = p.storeImage(ctx, data, contentType, finalURL, og); err != nil {
+			return nil, err
+		}
+	case contentType == "text/html" || contentType == "application/xhtml+xml":
+		og = parseOpenGraph(bytes.NewReader(data), finalURL)
+		imageURL, ok := og["og:image"].(string)
+		// The remote image URL (and any metadata about it) is never returned to the
+		// client, as clients are expected to fetch media through the media repository.
+		for key := range og {
+			if key == "og:image" || strings.HasPrefix(key, "og:image:") {
+				delete(og, key)
+			}
+		}
+		if !ok {
+			break
+		}
+		if err = p.previewImage(ctx, imageURL, og); err != nil {
+			p.logger.WithError(err).WithField("image_url", imageURL).Warn("Failed to fetch image for URL preview")
+		}
+	}
+	return og, nil
+}
+
+// previewImage fetches the image at imageURL and stores it, adding it to the preview.
+func (p *urlPreviewer) previewImage(ctx context.Context, imageURL string, og map[string]interface{}) error {
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported image scheme %q", u.Scheme)
+	}
+	data, contentType, finalURL, err := p.fetch(ctx, u)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return fmt.Errorf("image has unexpected content type %q", contentType)
+	}
+	return p.storeImage(ctx, data, contentType, finalURL, og)
+}
+
+// fetch downloads the given URL, returning the body, the media type of the body
+// and the URL after following any redirects. Returns an error if the body is
+// larger than the configured maximum page size.
+func (p *urlPreviewer) fetch(ctx context.Context, u *url.URL) ([]byte, string, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	req.Header.Set("User-Agent", p.cfg.URLPreview.UserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,image/*;q=0.9,*/*;q=0.8")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, "", nil, fmt.Errorf("received HTTP status %d", resp.StatusCode)
+	}
+
+	maxSize := int64(p.cfg.URLPreview.MaxPageSizeBytes)
+	if resp.ContentLength > maxSize {
+		return nil, "", nil, errURLPreviewTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, "", nil, errURLPreviewTooLarge
+	}
+
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		contentType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+	return data, contentType, resp.Request.URL, nil
+}
+
+// storeImage stores the image in the media repository, in the same way as an upload
+// from the requesting user, and adds it to the preview.
+func (p *urlPreviewer) storeImage(
+	ctx context.Context, data []byte, contentType string, imageURL *url.URL, og map[string]interface{},
+) error {
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:        p.cfg.Matrix.ServerName,
+			FileSizeBytes: types.FileSizeBytes(len(data)),
+			ContentType:   types.ContentType(contentType),
+			UploadName:    types.Filename(url.PathEscape(path.Base(imageURL.Path))),
+			UserID:        types.MatrixUserID(p.dev.UserID),
+		},
+		Logger: p.logger,
+	}
+	if resErr := r.Validate(p.cfg.MaxFileSizeBytes); resErr != nil {
+		return fmt.Errorf("image is not valid: %+v", resErr.JSON)
+	}
+	if resErr := r.doUpload(ctx, bytes.NewReader(data), p.cfg, p.db, p.store, p.activeThumbnailGeneration); resErr != nil {
+		return fmt.Errorf("failed to store image: %+v", resErr.JSON)
+	}
+
+	og["og:image"] = fmt.Sprintf("mxc://%s/%s", p.cfg.Matrix.ServerName, r.MediaMetadata.MediaID)
+	og["og:image:type"] = contentType
+	og["matrix:image:size"] = len(data)
+	if imgCfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		og["og:image:width"] = imgCfg.Width
+		og["og:image:height"] = imgCfg.Height
+	}
+	return nil
+}
+
+// parseOpenGraph extracts the OpenGraph properties from an HTML document. If the
+// document has no og:title or og:description, the <title> element and the description
+// meta tag are used instead. Relative og:image URLs are resolved against pageURL.
+func parseOpenGraph(r io.Reader, pageURL *url.URL) map[string]interface{} {
+	og := map[string]interface{}{}
+	var title, description string
+	inTitle := false
+
+	tokenizer := html.NewTokenizer(r)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			// Either EOF or malformed HTML, return what we have so far.
+			if _, ok := og["og:title"]; !ok && title != "" {
+				og["og:title"] = title
+			}
+			if _, ok := og["og:description"]; !ok && description != "" {
+				og["og:description"] = description
+			}
+			if imageURL, ok := og["og:image"].(string); ok && pageURL != nil {
+				if u, err := pageURL.Parse(imageURL); err == nil {
+					og["og:image"] = u.String()
+				}
+			}
+			return og
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "meta":
+				var property, name, content string
+				for _, attr := range token.Attr {
+					switch strings.ToLower(attr.Key) {
+					case "property":
+						property = attr.Val
+					case "name":
+						name = attr.Val
+					case "content":
+						content = attr.Val
+					}
+				}
+				// Some sites incorrectly use name instead of property for OpenGraph tags.
+				if property == "" && strings.HasPrefix(name, "og:") {
+					property = name
+				}
+				switch {
+				case strings.HasPrefix(property, "og:"):
+					// Only the first value of a property is used.
+					if _, ok := og[property]; !ok {
+						og[property] = content
+					}
+				case strings.EqualFold(name, "description"):
+					description = strings.TrimSpace(content)
+				}
+			case "title":
+				inTitle = title == ""
+			}
+		case html.TextToken:
+			if inTitle {
+				title = strings.TrimSpace(string(tokenizer.Text()))
+			}
+		case html.EndTagToken:
+			inTitle = false
+		}
+	}
+}
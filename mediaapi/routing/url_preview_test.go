@@ -0,0 +1,201 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/mediastore"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func Test_parseOpenGraph(t *testing.T) {
+	pageURL, _ := url.Parse("https://example.com/blog/post.html")
+	tests := []struct {
+		name string
+		html string
+		want map[string]interface{}
+	}{
+		{
+			name: "OpenGraph tags",
+			html: `<html><head>
+				<meta property="og:title" content="Hello">
+				<meta property="og:title" content="Ignored">
+				<meta property="og:description" content="A post">
+				<meta property="og:image" content="/images/cover.png" />
+				<title>Fallback</title>
+			</head></html>`,
+			want: map[string]interface{}{
+				"og:title":       "Hello",
+				"og:description": "A post",
+				"og:image":       "https://example.com/images/cover.png",
+			},
+		},
+		{
+			name: "fallback to title and description",
+			html: `<html><head>
+				<title> Page title </title>
+				<meta name="description" content="Described">
+				<meta name="og:url" content="https://example.com/">
+			</head><body><p>Text</p></body></html>`,
+			want: map[string]interface{}{
+				"og:title":       "Page title",
+				"og:description": "Described",
+				"og:url":         "https://example.com/",
+			},
+		},
+		{
+			name: "no metadata",
+			html: `<p>Nothing here`,
+			want: map[string]interface{}{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseOpenGraph(strings.NewReader(tt.html), pageURL)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPreviewURL(t *testing.T) {
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 2))); err != nil {
+		t.Fatal(err)
+	}
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		pageRequests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/page":
+				pageRequests++
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				_, _ = w.Write([]byte(`<html><head><title>Test page</title><meta property="og:image" content="/image.png"></head></html>`))
+			case "/image.png":
+				w.Header().Set("Content-Type", "image/png")
+				_, _ = w.Write(img.Bytes())
+			case "/large":
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = w.Write(bytes.Repeat([]byte("a"), 2048))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer srv.Close()
+
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+		db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("failed to open database: %s", err)
+		}
+
+		basePath := config.Path(t.TempDir())
+		cfg := &config.MediaAPI{
+			Matrix:                 &config.Global{},
+			BasePath:               basePath,
+			AbsBasePath:            basePath,
+			MaxFileSizeBytes:       config.DefaultMaxFileSizeBytes,
+			MaxThumbnailGenerators: 10,
+		}
+		cfg.Matrix.ServerName = "test"
+		cfg.URLPreview.Defaults()
+		cfg.URLPreview.Enabled = true
+		cfg.URLPreview.MaxPageSizeBytes = 1024
+		activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		}
+		dev := &userapi.Device{UserID: "@alice:test"}
+
+		preview := func(t *testing.T, client *http.Client, target string) (int, map[string]interface{}) {
+			t.Helper()
+			req := httptest.NewRequest(http.MethodGet, "/_matrix/media/v3/preview_url?url="+url.QueryEscape(target), nil)
+			res := PreviewURL(req, cfg, dev, db, mediastore.NewLocalStore(basePath), client, activeThumbnailGeneration)
+			var og map[string]interface{}
+			if res.Code == http.StatusOK {
+				b, err := json.Marshal(res.JSON)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = json.Unmarshal(b, &og); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return res.Code, og
+		}
+
+		t.Run("blacklisted addresses are not contacted", func(t *testing.T) {
+			// The test server is listening on 127.0.0.1, which is blacklisted by default.
+			code, _ := preview(t, NewURLPreviewClient(&cfg.URLPreview), srv.URL+"/page")
+			if code != http.StatusBadGateway {
+				t.Fatalf("expected HTTP %d, got %d", http.StatusBadGateway, code)
+			}
+		})
+
+		previewCfg := cfg.URLPreview
+		previewCfg.IPRangeBlacklist = nil
+		client := NewURLPreviewClient(&previewCfg)
+
+		t.Run("invalid URL is rejected", func(t *testing.T) {
+			code, _ := preview(t, client, "ftp://example.com")
+			if code != http.StatusBadRequest {
+				t.Fatalf("expected HTTP %d, got %d", http.StatusBadRequest, code)
+			}
+		})
+
+		t.Run("page larger than the maximum size is rejected", func(t *testing.T) {
+			code, _ := preview(t, client, srv.URL+"/large")
+			if code != http.StatusBadGateway {
+				t.Fatalf("expected HTTP %d, got %d", http.StatusBadGateway, code)
+			}
+		})
+
+		t.Run("page is previewed and cached", func(t *testing.T) {
+			code, og := preview(t, client, srv.URL+"/page")
+			if code != http.StatusOK {
+				t.Fatalf("expected HTTP %d, got %d", http.StatusOK, code)
+			}
+			if og["og:title"] != "Test page" {
+				t.Fatalf("unexpected og:title: %v", og["og:title"])
+			}
+			mxc, _ := og["og:image"].(string)
+			if !strings.HasPrefix(mxc, "mxc://test/") {
+				t.Fatalf("expected og:image to be a local mxc URI, got %v", og["og:image"])
+			}
+			if og["og:image:width"] != float64(4) || og["og:image:height"] != float64(2) {
+				t.Fatalf("unexpected image dimensions: %v x %v", og["og:image:width"], og["og:image:height"])
+			}
+			metadata, err := db.GetMediaMetadata(context.Background(), types.MediaID(strings.TrimPrefix(mxc, "mxc://test/")), "test")
+			if err != nil || metadata == nil {
+				t.Fatalf("expected image to be stored in the media repository: %v", err)
+			}
+
+			// The second request should be served from the cache.
+			_, cached := preview(t, client, srv.URL+"/page")
+			if !reflect.DeepEqual(og, cached) {
+				t.Fatalf("expected cached preview %+v, got %+v", og, cached)
+			}
+			if pageRequests != 1 {
+				t.Fatalf("expected the page to be fetched once, got %d", pageRequests)
+			}
+		})
+	})
+}
@@ -24,12 +24,17 @@ import (
 type Database interface {
 	MediaRepository
 	Thumbnails
+	URLPreviews
 }
 
 type MediaRepository interface {
 	StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error
 	GetMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (*types.MediaMetadata, error)
 	GetMediaMetadataByHash(ctx context.Context, mediaHash types.Base64Hash, mediaOrigin spec.ServerName) (*types.MediaMetadata, error)
+	UpdateMediaLastAccess(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, ts spec.Timestamp) error
+	GetRemoteMediaBefore(ctx context.Context, localServerName spec.ServerName, before spec.Timestamp, limit int) ([]*types.MediaMetadata, error)
+	GetLocalMediaLastAccessedBefore(ctx context.Context, localServerName spec.ServerName, before spec.Timestamp, limit int) ([]*types.MediaMetadata, error)
+	DeleteMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (thumbnails []*types.ThumbnailMetadata, fileUnused bool, err error)
 }
 
 type Thumbnails interface {
@@ -37,3 +42,8 @@ type Thumbnails interface {
 	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error)
 	GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) ([]*types.ThumbnailMetadata, error)
 }
+
+type URLPreviews interface {
+	StoreURLPreview(ctx context.Context, preview *types.URLPreview) error
+	GetURLPreview(ctx context.Context, url string, ts spec.Timestamp) (*types.URLPreview, error)
+}
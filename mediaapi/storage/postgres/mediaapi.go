@@ -37,9 +37,14 @@ func NewDatabase(conMan *sqlutil.Connections, dbProperties *config.DatabaseOptio
 	if err != nil {
 		return nil, err
 	}
+	urlPreviews, err := NewPostgresURLPreviewsTable(db)
+	if err != nil {
+		return nil, err
+	}
 	return &shared.Database{
 		MediaRepository: mediaRepo,
 		Thumbnails:      thumbnails,
+		URLPreviews:     urlPreviews,
 		DB:              db,
 		Writer:          writer,
 	}, nil
@@ -0,0 +1,111 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/storage/tables"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const urlPreviewsSchema = `
+-- The mediaapi_url_previews table caches OpenGraph previews of URLs requested by clients.
+CREATE TABLE IF NOT EXISTS mediaapi_url_previews (
+    -- The URL which was previewed.
+    url string NOT NULL,
+    -- When the preview was generated in UNIX epoch ms.
+    preview_ts int64 NOT NULL,
+    -- When the preview expires in UNIX epoch ms.
+    expires_ts int64 NOT NULL,
+    -- The OpenGraph properties of the page, as JSON.
+    og_json string NOT NULL
+);
+CREATE INDEX IF NOT EXISTS mediaapi_url_previews_url_idx ON mediaapi_url_previews (url, preview_ts);
+`
+
+const insertURLPreviewSQL = `
+INSERT INTO mediaapi_url_previews (url, preview_ts, expires_ts, og_json)
+    VALUES ($1, $2, $3, $4)
+`
+
+// Selects the most recent preview which was valid at the given timestamp
+const selectURLPreviewSQL = `
+SELECT preview_ts, expires_ts, og_json FROM mediaapi_url_previews
+    WHERE url = $1 AND preview_ts <= $2 AND expires_ts > $2
+    ORDER BY preview_ts DESC LIMIT 1
+`
+
+type urlPreviewsStatements struct {
+	insertURLPreviewStmt *sql.Stmt
+	selectURLPreviewStmt *sql.Stmt
+}
+
+func NewQLURLPreviewsTable(db *sql.DB) (tables.URLPreviews, error) {
+	s := &urlPreviewsStatements{}
+	_, err := db.Exec(urlPreviewsSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertURLPreviewStmt, insertURLPreviewSQL},
+		{&s.selectURLPreviewStmt, selectURLPreviewSQL},
+	}.Prepare(db)
+}
+
+func (s *urlPreviewsStatements) InsertURLPreview(
+	ctx context.Context, txn *sql.Tx, preview *types.URLPreview,
+) error {
+	ogJSON, err := json.Marshal(preview.OpenGraph)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmtContext(ctx, txn, s.insertURLPreviewStmt).ExecContext(
+		ctx,
+		preview.URL,
+		preview.Timestamp,
+		preview.ExpiresTimestamp,
+		string(ogJSON),
+	)
+	return err
+}
+
+func (s *urlPreviewsStatements) SelectURLPreview(
+	ctx context.Context, txn *sql.Tx, url string, ts spec.Timestamp,
+) (*types.URLPreview, error) {
+	preview := types.URLPreview{
+		URL: url,
+	}
+	var ogJSON string
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectURLPreviewStmt).QueryRowContext(
+		ctx, url, ts,
+	).Scan(
+		&preview.Timestamp,
+		&preview.ExpiresTimestamp,
+		&ogJSON,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(ogJSON), &preview.OpenGraph); err != nil {
+		return nil, err
+	}
+	return &preview, nil
+}
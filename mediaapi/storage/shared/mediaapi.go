@@ -30,6 +30,7 @@ type Database struct {
 	Writer          sqlutil.Writer
 	MediaRepository tables.MediaRepository
 	Thumbnails      tables.Thumbnails
+	URLPreviews     tables.URLPreviews
 }
 
 // StoreMediaMetadata inserts the metadata about the uploaded media into the database.
@@ -62,6 +63,53 @@ func (d *Database) GetMediaMetadataByHash(ctx context.Context, mediaHash types.B
 	return mediaMetadata, err
 }
 
+// UpdateMediaLastAccess records when the media was last downloaded.
+func (d *Database) UpdateMediaLastAccess(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, ts spec.Timestamp) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.MediaRepository.UpdateMediaLastAccess(ctx, txn, mediaID, mediaOrigin, ts)
+	})
+}
+
+// GetRemoteMediaBefore returns up to limit media fetched from other servers before the given time, oldest first.
+func (d *Database) GetRemoteMediaBefore(ctx context.Context, localServerName spec.ServerName, before spec.Timestamp, limit int) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectRemoteMediaBefore(ctx, nil, localServerName, before, limit)
+}
+
+// GetLocalMediaLastAccessedBefore returns up to limit media uploaded to this server which was
+// last downloaded before the given time, least recently downloaded first.
+func (d *Database) GetLocalMediaLastAccessedBefore(ctx context.Context, localServerName spec.ServerName, before spec.Timestamp, limit int) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectLocalMediaLastAccessedBefore(ctx, nil, localServerName, before, limit)
+}
+
+// DeleteMedia deletes the metadata of the media and its thumbnails. Files are stored by hash, so the
+// same file can be used by more than one media ID. Returns the deleted thumbnails, and whether the file
+// is no longer used by any media and can be removed from the media store.
+func (d *Database) DeleteMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (thumbnails []*types.ThumbnailMetadata, fileUnused bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		mediaMetadata, err := d.MediaRepository.SelectMedia(ctx, txn, mediaID, mediaOrigin)
+		if err != nil {
+			return err
+		}
+		thumbnails, err = d.Thumbnails.SelectThumbnails(ctx, txn, mediaID, mediaOrigin)
+		if err != nil {
+			return err
+		}
+		if err = d.Thumbnails.DeleteThumbnails(ctx, txn, mediaID, mediaOrigin); err != nil {
+			return err
+		}
+		if err = d.MediaRepository.DeleteMedia(ctx, txn, mediaID, mediaOrigin); err != nil {
+			return err
+		}
+		count, err := d.MediaRepository.SelectMediaCountByHash(ctx, txn, mediaMetadata.Base64Hash)
+		if err != nil {
+			return err
+		}
+		fileUnused = count == 0
+		return nil
+	})
+	return
+}
+
 // StoreThumbnail inserts the metadata about the thumbnail into the database.
 // Returns an error if the combination of MediaID and Origin are not unique in the table.
 func (d *Database) StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error {
@@ -91,3 +139,20 @@ func (d *Database) GetThumbnails(ctx context.Context, mediaID types.MediaID, med
 	}
 	return metadatas, err
 }
+
+// StoreURLPreview caches a generated preview of a URL.
+func (d *Database) StoreURLPreview(ctx context.Context, preview *types.URLPreview) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.URLPreviews.InsertURLPreview(ctx, txn, preview)
+	})
+}
+
+// GetURLPreview returns the most recent cached preview of a URL which was valid at the given timestamp.
+// Returns nil if there is no such preview.
+func (d *Database) GetURLPreview(ctx context.Context, url string, ts spec.Timestamp) (*types.URLPreview, error) {
+	preview, err := d.URLPreviews.SelectURLPreview(ctx, nil, url, ts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return preview, err
+}
@@ -10,10 +10,11 @@ import (
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 func mustCreateDatabase(t *testing.T, dbType test.DBType) (storage.Database, func()) {
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
 	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
@@ -143,3 +144,152 @@ func TestThumbnailsStorage(t *testing.T) {
 		})
 	})
 }
+
+func TestURLPreviewsStorage(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		t.Run("can insert previews & query by timestamp", func(t *testing.T) {
+			previews := []*types.URLPreview{
+				{
+					URL:              "https://example.com",
+					Timestamp:        1000,
+					ExpiresTimestamp: 2000,
+					OpenGraph:        map[string]interface{}{"og:title": "first"},
+				},
+				{
+					URL:              "https://example.com",
+					Timestamp:        3000,
+					ExpiresTimestamp: 4000,
+					OpenGraph:        map[string]interface{}{"og:title": "second"},
+				},
+			}
+			for i := range previews {
+				if err := db.StoreURLPreview(ctx, previews[i]); err != nil {
+					t.Fatalf("unable to store url preview: %v", err)
+				}
+			}
+			for ts, want := range map[spec.Timestamp]*types.URLPreview{
+				500:  nil,
+				1000: previews[0],
+				1999: previews[0],
+				2500: nil,
+				3500: previews[1],
+				4000: nil,
+			} {
+				got, err := db.GetURLPreview(ctx, "https://example.com", ts)
+				if err != nil {
+					t.Fatalf("unable to query url preview: %v", err)
+				}
+				if !reflect.DeepEqual(want, got) {
+					t.Fatalf("ts %d: expected preview %+v, got %+v", ts, want, got)
+				}
+			}
+		})
+	})
+}
+
+func TestPurgeMedia(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		media := []*types.MediaMetadata{
+			{MediaID: "local1", Origin: "localhost", Base64Hash: "aGFzaDE="},
+			{MediaID: "local2", Origin: "localhost", Base64Hash: "aGFzaDI="},
+			{MediaID: "remote1", Origin: "remote", Base64Hash: "aGFzaDE="},
+		}
+		for _, m := range media {
+			if err := db.StoreMediaMetadata(ctx, m); err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+		}
+
+		t.Run("selects remote media by creation time", func(t *testing.T) {
+			got, err := db.GetRemoteMediaBefore(ctx, "localhost", media[2].CreationTimestamp, 10)
+			if err != nil {
+				t.Fatalf("unable to query remote media: %v", err)
+			}
+			if len(got) != 0 {
+				t.Fatalf("expected no remote media, got %+v", got)
+			}
+			got, err = db.GetRemoteMediaBefore(ctx, "localhost", media[2].CreationTimestamp+1, 10)
+			if err != nil {
+				t.Fatalf("unable to query remote media: %v", err)
+			}
+			if len(got) != 1 || got[0].MediaID != "remote1" {
+				t.Fatalf("expected only remote1, got %+v", got)
+			}
+		})
+
+		t.Run("selects local media by last access time", func(t *testing.T) {
+			now := media[2].CreationTimestamp + 1000
+			if err := db.UpdateMediaLastAccess(ctx, "local1", "localhost", now); err != nil {
+				t.Fatalf("unable to update last access: %v", err)
+			}
+			got, err := db.GetLocalMediaLastAccessedBefore(ctx, "localhost", now, 10)
+			if err != nil {
+				t.Fatalf("unable to query local media: %v", err)
+			}
+			if len(got) != 1 || got[0].MediaID != "local2" {
+				t.Fatalf("expected only local2, got %+v", got)
+			}
+			gotMetadata, err := db.GetMediaMetadata(ctx, "local1", "localhost")
+			if err != nil {
+				t.Fatalf("unable to query media metadata: %v", err)
+			}
+			if gotMetadata.LastAccessTimestamp != now {
+				t.Fatalf("expected last access %d, got %d", now, gotMetadata.LastAccessTimestamp)
+			}
+		})
+
+		t.Run("deletes media and thumbnails", func(t *testing.T) {
+			thumbnail := &types.ThumbnailMetadata{
+				MediaMetadata: &types.MediaMetadata{
+					MediaID:       "remote1",
+					Origin:        "remote",
+					ContentType:   "image/jpeg",
+					FileSizeBytes: 6,
+				},
+				ThumbnailSize: types.ThumbnailSize{Width: 5, Height: 5, ResizeMethod: types.Crop},
+			}
+			if err := db.StoreThumbnail(ctx, thumbnail); err != nil {
+				t.Fatalf("unable to store thumbnail: %v", err)
+			}
+			thumbnails, fileUnused, err := db.DeleteMedia(ctx, "remote1", "remote")
+			if err != nil {
+				t.Fatalf("unable to delete media: %v", err)
+			}
+			if len(thumbnails) != 1 {
+				t.Fatalf("expected 1 deleted thumbnail, got %d", len(thumbnails))
+			}
+			// local1 has the same hash, so the file is still in use
+			if fileUnused {
+				t.Fatalf("expected file to still be used")
+			}
+			gotMetadata, err := db.GetMediaMetadata(ctx, "remote1", "remote")
+			if err != nil {
+				t.Fatalf("unable to query media metadata: %v", err)
+			}
+			if gotMetadata != nil {
+				t.Fatalf("expected media to be deleted, got %+v", gotMetadata)
+			}
+			gotThumbnails, err := db.GetThumbnails(ctx, "remote1", "remote")
+			if err != nil {
+				t.Fatalf("unable to query thumbnails: %v", err)
+			}
+			if len(gotThumbnails) != 0 {
+				t.Fatalf("expected thumbnails to be deleted, got %d", len(gotThumbnails))
+			}
+
+			_, fileUnused, err = db.DeleteMedia(ctx, "local1", "localhost")
+			if err != nil {
+				t.Fatalf("unable to delete media: %v", err)
+			}
+			if !fileUnused {
+				t.Fatalf("expected file to be unused")
+			}
+		})
+	})
+}
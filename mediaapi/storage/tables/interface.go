@@ -34,6 +34,7 @@ type Thumbnails interface {
 		ctx context.Context, txn *sql.Tx, mediaID types.MediaID,
 		mediaOrigin spec.ServerName,
 	) ([]*types.ThumbnailMetadata, error)
+	DeleteThumbnails(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
 }
 
 type MediaRepository interface {
@@ -43,4 +44,17 @@ type MediaRepository interface {
 		ctx context.Context, txn *sql.Tx,
 		mediaHash types.Base64Hash, mediaOrigin spec.ServerName,
 	) (*types.MediaMetadata, error)
+	UpdateMediaLastAccess(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName, ts spec.Timestamp) error
+	// SelectRemoteMediaBefore returns media from origins other than localServerName which was stored before the given time, oldest first.
+	SelectRemoteMediaBefore(ctx context.Context, txn *sql.Tx, localServerName spec.ServerName, before spec.Timestamp, limit int) ([]*types.MediaMetadata, error)
+	// SelectLocalMediaLastAccessedBefore returns media from localServerName which was last accessed before the given time, least recently accessed first.
+	SelectLocalMediaLastAccessedBefore(ctx context.Context, txn *sql.Tx, localServerName spec.ServerName, before spec.Timestamp, limit int) ([]*types.MediaMetadata, error)
+	DeleteMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
+	// SelectMediaCountByHash returns the number of media from any origin with the given hash.
+	SelectMediaCountByHash(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (int, error)
+}
+
+type URLPreviews interface {
+	InsertURLPreview(ctx context.Context, txn *sql.Tx, preview *types.URLPreview) error
+	SelectURLPreview(ctx context.Context, txn *sql.Tx, url string, ts spec.Timestamp) (*types.URLPreview, error)
 }
@@ -55,6 +55,8 @@ type MediaMetadata struct {
 	UploadName        Filename
 	Base64Hash        Base64Hash
 	UserID            MatrixUserID
+	// When the media was last downloaded, used to expire unused media
+	LastAccessTimestamp spec.Timestamp
 }
 
 // RemoteRequestResult is used for broadcasting the result of a request for a remote file to routines waiting on the condition
@@ -100,6 +102,17 @@ type ActiveThumbnailGeneration struct {
 	PathToResult map[string]*ThumbnailGenerationResult
 }
 
+// URLPreview is a cached OpenGraph preview of a URL
+type URLPreview struct {
+	URL string
+	// When the preview was generated in UNIX epoch ms
+	Timestamp spec.Timestamp
+	// When the preview should no longer be served from the cache in UNIX epoch ms
+	ExpiresTimestamp spec.Timestamp
+	// The OpenGraph properties of the page, e.g. og:title
+	OpenGraph map[string]interface{}
+}
+
 // Crop indicates we should crop the thumbnail on resize
 const Crop = "crop"
 
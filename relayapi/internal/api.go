@@ -0,0 +1,79 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+
+	"github.com/matrix-org/dendrite/federationapi/producers"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/relayapi/storage"
+	rsAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userAPI "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// RelayInternalAPI is an implementation of api.RelayInternalAPI
+type RelayInternalAPI struct {
+	db                     storage.Database
+	fedClient              fclient.FederationClient
+	rsAPI                  rsAPI.FederationRoomserverAPI
+	keyRing                gomatrixserverlib.JSONVerifier
+	producer               *producers.SyncAPIProducer
+	presenceEnabledInbound bool
+	serverName             spec.ServerName
+	relayingEnabledMutex   sync.Mutex
+	relayingEnabled        bool
+	destinations           map[spec.ServerName]struct{}
+	maxTransactions        int64
+	userAPI                userAPI.FederationUserAPI
+	roomsMu                *internal.MutexByRoom
+}
+
+// NewRelayInternalAPI creates a new relay internal API.
+func NewRelayInternalAPI(
+	db storage.Database,
+	fedClient fclient.FederationClient,
+	rsAPI rsAPI.FederationRoomserverAPI,
+	keyRing gomatrixserverlib.JSONVerifier,
+	producer *producers.SyncAPIProducer,
+	presenceEnabledInbound bool,
+	serverName spec.ServerName,
+	relayingEnabled bool,
+	destinations []spec.ServerName,
+	maxTransactions int64,
+	userAPI userAPI.FederationUserAPI,
+) *RelayInternalAPI {
+	destinationSet := make(map[spec.ServerName]struct{}, len(destinations))
+	for _, destination := range destinations {
+		destinationSet[destination] = struct{}{}
+	}
+	return &RelayInternalAPI{
+		db:                     db,
+		fedClient:              fedClient,
+		rsAPI:                  rsAPI,
+		keyRing:                keyRing,
+		producer:               producer,
+		presenceEnabledInbound: presenceEnabledInbound,
+		serverName:             serverName,
+		relayingEnabled:        relayingEnabled,
+		destinations:           destinationSet,
+		maxTransactions:        maxTransactions,
+		userAPI:                userAPI,
+		roomsMu:                internal.NewMutexByRoom(),
+	}
+}
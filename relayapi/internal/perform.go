@@ -0,0 +1,154 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/federationapi/storage/shared/receipt"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/relayapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+// SetRelayingEnabled sets whether the relay server should act as a relay for external servers.
+func (r *RelayInternalAPI) SetRelayingEnabled(enabled bool) {
+	r.relayingEnabledMutex.Lock()
+	defer r.relayingEnabledMutex.Unlock()
+	r.relayingEnabled = enabled
+}
+
+// RelayingEnabled returns whether the relay server is acting as a relay for external servers.
+func (r *RelayInternalAPI) RelayingEnabled() bool {
+	r.relayingEnabledMutex.Lock()
+	defer r.relayingEnabledMutex.Unlock()
+	return r.relayingEnabled
+}
+
+// PerformRelayServerSync implements api.RelayInternalAPI
+func (r *RelayInternalAPI) PerformRelayServerSync(
+	ctx context.Context,
+	userID spec.UserID,
+	relayServer spec.ServerName,
+) error {
+	// Providing a default RelayEntry (EntryID = 0) is done to ask the relay if there are any
+	// transactions available for this node. Each following request acknowledges the previous
+	// entry, which allows the relay to remove it from its queue.
+	prevEntry := fclient.RelayEntry{}
+	for {
+		asyncResponse, err := r.fedClient.P2PGetTransactionFromRelay(ctx, userID, prevEntry, relayServer)
+		if err != nil {
+			logrus.WithError(err).Errorf("P2PGetTransactionFromRelay failed for %s", relayServer)
+			return err
+		}
+		if !asyncResponse.EntriesQueued {
+			// There are no more entries available for this node from the relay.
+			return nil
+		}
+		r.processTransaction(ctx, &asyncResponse.Transaction)
+		prevEntry = fclient.RelayEntry{EntryID: asyncResponse.EntryID}
+	}
+}
+
+// PerformStoreTransaction implements api.RelayInternalAPI
+func (r *RelayInternalAPI) PerformStoreTransaction(
+	ctx context.Context,
+	transaction gomatrixserverlib.Transaction,
+	userID spec.UserID,
+) error {
+	if _, ok := r.destinations[userID.Domain()]; !ok {
+		return api.ErrDestinationNotAllowed
+	}
+	count, err := r.db.GetTransactionCount(ctx, userID)
+	if err != nil {
+		logrus.Errorf("db.GetTransactionCount: %s", err.Error())
+		return err
+	}
+	if count >= r.maxTransactions {
+		return api.ErrQueueFull
+	}
+
+	logrus.Debugf("Storing transaction for %v", userID)
+	dbReceipt, err := r.db.StoreTransaction(ctx, transaction)
+	if err != nil {
+		logrus.Errorf("db.StoreTransaction: %s", err.Error())
+		return err
+	}
+	err = r.db.AssociateTransactionWithDestinations(
+		ctx,
+		map[spec.UserID]struct{}{
+			userID: {},
+		},
+		transaction.TransactionID,
+		dbReceipt)
+
+	return err
+}
+
+// QueryTransactions implements api.RelayInternalAPI
+func (r *RelayInternalAPI) QueryTransactions(
+	ctx context.Context,
+	userID spec.UserID,
+	previousEntry fclient.RelayEntry,
+) (api.QueryRelayTransactionsResponse, error) {
+	if previousEntry.EntryID > 0 {
+		prevReceipt := receipt.NewReceipt(previousEntry.EntryID)
+		err := r.db.CleanTransactions(ctx, userID, []*receipt.Receipt{&prevReceipt})
+		if err != nil {
+			logrus.Errorf("db.CleanTransactions: %s", err.Error())
+			return api.QueryRelayTransactionsResponse{}, err
+		}
+	}
+
+	transaction, dbReceipt, err := r.db.GetTransaction(ctx, userID)
+	if err != nil {
+		logrus.Errorf("db.GetTransaction: %s", err.Error())
+		return api.QueryRelayTransactionsResponse{}, err
+	}
+
+	// An EntryID of 0 with no entries queued signals to the caller that
+	// there is nothing left for them on this relay.
+	response := api.QueryRelayTransactionsResponse{}
+	if transaction != nil && dbReceipt != nil {
+		response.Transaction = *transaction
+		response.EntryID = dbReceipt.GetNID()
+		response.EntriesQueued = true
+	}
+
+	return response, nil
+}
+
+func (r *RelayInternalAPI) processTransaction(ctx context.Context, txn *gomatrixserverlib.Transaction) {
+	t := internal.NewTxnReq(
+		r.rsAPI,
+		r.userAPI,
+		r.serverName,
+		r.keyRing,
+		r.roomsMu,
+		r.producer,
+		r.presenceEnabledInbound,
+		txn.PDUs,
+		txn.EDUs,
+		txn.Origin,
+		txn.TransactionID,
+		r.serverName)
+
+	if _, jsonErr := t.ProcessTransaction(ctx); jsonErr != nil {
+		logrus.WithField("jsonErr", jsonErr).Errorf("Failed to process transaction %q from relay", txn.TransactionID)
+	}
+}
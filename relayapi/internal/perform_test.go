@@ -0,0 +1,225 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/relayapi/api"
+	"github.com/matrix-org/dendrite/relayapi/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+type testFedClient struct {
+	fclient.FederationClient
+	shouldFail     bool
+	queueDepth     int
+	requestedPrevs []int64
+}
+
+func (f *testFedClient) P2PGetTransactionFromRelay(
+	ctx context.Context,
+	u spec.UserID,
+	prev fclient.RelayEntry,
+	relayServer spec.ServerName,
+) (res fclient.RespGetRelayTransaction, err error) {
+	f.requestedPrevs = append(f.requestedPrevs, prev.EntryID)
+	if f.shouldFail {
+		return res, fmt.Errorf("Error")
+	}
+
+	if f.queueDepth > 0 {
+		f.queueDepth--
+		res.EntryID = int64(len(f.requestedPrevs))
+		res.EntriesQueued = true
+		res.Transaction = gomatrixserverlib.Transaction{
+			Origin:        "remote",
+			Destination:   u.Domain(),
+			TransactionID: gomatrixserverlib.TransactionID(fmt.Sprintf("txn%d", res.EntryID)),
+		}
+	}
+	return
+}
+
+func mustCreateRelayDatabase(t *testing.T, dbType test.DBType) (storage.Database, func()) {
+	caches := caching.NewRistrettoCache(8*1024*1024, time.Hour, false)
+	connStr, dbClose := test.PrepareDBConnectionString(t, dbType)
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewDatabase(cm, &config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, caches, func(server spec.ServerName) bool { return server == "relay" })
+	if err != nil {
+		t.Fatalf("NewDatabase returned %s", err)
+	}
+	return db, dbClose
+}
+
+func TestPerformRelayServerSync(t *testing.T) {
+	userID, err := spec.NewUserID("@local:domain", false)
+	assert.NoError(t, err)
+
+	fedClient := &testFedClient{queueDepth: 2}
+	relayAPI := NewRelayInternalAPI(
+		nil, fedClient, nil, nil, nil, false, "domain", false, nil, 0, nil,
+	)
+
+	err = relayAPI.PerformRelayServerSync(context.Background(), *userID, "relay")
+	assert.NoError(t, err)
+	// Each request acknowledges the entry received by the request before it.
+	assert.Equal(t, []int64{0, 1, 2}, fedClient.requestedPrevs)
+}
+
+func TestPerformRelayServerSyncFedError(t *testing.T) {
+	userID, err := spec.NewUserID("@local:domain", false)
+	assert.NoError(t, err)
+
+	fedClient := &testFedClient{shouldFail: true}
+	relayAPI := NewRelayInternalAPI(
+		nil, fedClient, nil, nil, nil, false, "domain", false, nil, 0, nil,
+	)
+
+	err = relayAPI.PerformRelayServerSync(context.Background(), *userID, "relay")
+	assert.Error(t, err)
+}
+
+func TestRelayingEnabled(t *testing.T) {
+	relayAPI := NewRelayInternalAPI(
+		nil, nil, nil, nil, nil, false, "relay", false, nil, 0, nil,
+	)
+	assert.False(t, relayAPI.RelayingEnabled())
+	relayAPI.SetRelayingEnabled(true)
+	assert.True(t, relayAPI.RelayingEnabled())
+}
+
+func TestStoreAndQueryTransactions(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		ctx := context.Background()
+		db, close := mustCreateRelayDatabase(t, dbType)
+		defer close()
+
+		relayAPI := NewRelayInternalAPI(
+			db, nil, nil, nil, nil, false, "relay", true, []spec.ServerName{"domain"}, 10, nil,
+		)
+
+		userID, err := spec.NewUserID("@local:domain", false)
+		assert.NoError(t, err)
+		otherUserID, err := spec.NewUserID("@other:otherdomain", false)
+		assert.NoError(t, err)
+
+		for _, origin := range []spec.ServerName{"remote1", "remote2"} {
+			err = relayAPI.PerformStoreTransaction(ctx, gomatrixserverlib.Transaction{
+				TransactionID: "txn",
+				Origin:        origin,
+				Destination:   userID.Domain(),
+			}, *userID)
+			assert.NoError(t, err)
+		}
+
+		// Nothing is stored for the other destination.
+		res, err := relayAPI.QueryTransactions(ctx, *otherUserID, fclient.RelayEntry{})
+		assert.NoError(t, err)
+		assert.False(t, res.EntriesQueued)
+		assert.Equal(t, int64(0), res.EntryID)
+
+		// Transactions are returned oldest first, until each one is acknowledged.
+		res, err = relayAPI.QueryTransactions(ctx, *userID, fclient.RelayEntry{})
+		assert.NoError(t, err)
+		assert.True(t, res.EntriesQueued)
+		assert.Equal(t, spec.ServerName("remote1"), res.Transaction.Origin)
+		res, err = relayAPI.QueryTransactions(ctx, *userID, fclient.RelayEntry{})
+		assert.NoError(t, err)
+		assert.Equal(t, spec.ServerName("remote1"), res.Transaction.Origin)
+
+		res, err = relayAPI.QueryTransactions(ctx, *userID, fclient.RelayEntry{EntryID: res.EntryID})
+		assert.NoError(t, err)
+		assert.True(t, res.EntriesQueued)
+		assert.Equal(t, spec.ServerName("remote2"), res.Transaction.Origin)
+
+		res, err = relayAPI.QueryTransactions(ctx, *userID, fclient.RelayEntry{EntryID: res.EntryID})
+		assert.NoError(t, err)
+		assert.False(t, res.EntriesQueued)
+
+		count, err := db.GetTransactionCount(ctx, *userID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+	})
+}
+
+func TestStoreTransactionLimits(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		ctx := context.Background()
+		db, close := mustCreateRelayDatabase(t, dbType)
+		defer close()
+
+		relayAPI := NewRelayInternalAPI(
+			db, nil, nil, nil, nil, false, "relay", true, []spec.ServerName{"domain"}, 2, nil,
+		)
+
+		userID, err := spec.NewUserID("@local:domain", false)
+		assert.NoError(t, err)
+		otherUserID, err := spec.NewUserID("@other:otherdomain", false)
+		assert.NoError(t, err)
+
+		// Only configured destinations are relayed for.
+		err = relayAPI.PerformStoreTransaction(ctx, gomatrixserverlib.Transaction{
+			TransactionID: "txn",
+			Origin:        "remote",
+			Destination:   otherUserID.Domain(),
+		}, *otherUserID)
+		assert.ErrorIs(t, err, api.ErrDestinationNotAllowed)
+		count, err := db.GetTransactionCount(ctx, *otherUserID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+
+		// Transactions are rejected once the destination's queue is full.
+		for _, txnID := range []gomatrixserverlib.TransactionID{"txn1", "txn2"} {
+			err = relayAPI.PerformStoreTransaction(ctx, gomatrixserverlib.Transaction{
+				TransactionID: txnID,
+				Origin:        "remote",
+				Destination:   userID.Domain(),
+			}, *userID)
+			assert.NoError(t, err)
+		}
+		err = relayAPI.PerformStoreTransaction(ctx, gomatrixserverlib.Transaction{
+			TransactionID: "txn3",
+			Origin:        "remote",
+			Destination:   userID.Domain(),
+		}, *userID)
+		assert.ErrorIs(t, err, api.ErrQueueFull)
+		count, err = db.GetTransactionCount(ctx, *userID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), count)
+
+		// Expired transactions are removed, which makes room for new ones.
+		err = db.DeleteExpiredTransactions(ctx, spec.AsTimestamp(time.Now().Add(time.Minute)))
+		assert.NoError(t, err)
+		count, err = db.GetTransactionCount(ctx, *userID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+		txn, _, err := db.GetTransaction(ctx, *userID)
+		assert.NoError(t, err)
+		assert.Nil(t, txn)
+	})
+}
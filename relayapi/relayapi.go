@@ -0,0 +1,167 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package relayapi
+
+import (
+	"time"
+
+	"github.com/matrix-org/dendrite/federationapi/producers"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/relayapi/api"
+	"github.com/matrix-org/dendrite/relayapi/internal"
+	"github.com/matrix-org/dendrite/relayapi/routing"
+	"github.com/matrix-org/dendrite/relayapi/storage"
+	rsAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+// AddPublicRoutes sets up and registers HTTP handlers on the base API muxes for the RelayAPI component.
+func AddPublicRoutes(
+	routers httputil.Routers,
+	dendriteCfg *config.Dendrite,
+	keyRing gomatrixserverlib.JSONVerifier,
+	relayAPI api.RelayInternalAPI,
+) {
+	relay, ok := relayAPI.(*internal.RelayInternalAPI)
+	if !ok {
+		panic("relayapi.AddPublicRoutes called with a RelayInternalAPI impl which was not " +
+			"RelayInternalAPI. This is a programming error.")
+	}
+
+	routing.Setup(
+		routers.Federation,
+		&dendriteCfg.FederationAPI,
+		relay,
+		keyRing,
+	)
+}
+
+// NewRelayInternalAPI returns a concrete implementation of the relay API. If any
+// relay servers are configured, they will be polled periodically for transactions
+// which have been stored for us while we were offline. If relaying is enabled,
+// transactions stored for other servers are discarded once they expire.
+func NewRelayInternalAPI(
+	processContext *process.ProcessContext,
+	dendriteCfg *config.Dendrite,
+	cm *sqlutil.Connections,
+	natsInstance *jetstream.NATSInstance,
+	fedClient fclient.FederationClient,
+	rsAPI rsAPI.FederationRoomserverAPI,
+	userAPI userapi.FederationUserAPI,
+	keyRing gomatrixserverlib.JSONVerifier,
+	caches caching.FederationCache,
+) *internal.RelayInternalAPI {
+	cfg := &dendriteCfg.RelayAPI
+
+	relayDB, err := storage.NewDatabase(cm, &cfg.Database, caches, dendriteCfg.Global.IsLocalServerName)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to connect to relay db")
+	}
+
+	js, _ := natsInstance.Prepare(processContext, &cfg.Matrix.JetStream)
+	producer := &producers.SyncAPIProducer{
+		JetStream:              js,
+		TopicReceiptEvent:      cfg.Matrix.JetStream.Prefixed(jetstream.OutputReceiptEvent),
+		TopicSendToDeviceEvent: cfg.Matrix.JetStream.Prefixed(jetstream.OutputSendToDeviceEvent),
+		TopicTypingEvent:       cfg.Matrix.JetStream.Prefixed(jetstream.OutputTypingEvent),
+		TopicPresenceEvent:     cfg.Matrix.JetStream.Prefixed(jetstream.OutputPresenceEvent),
+		TopicDeviceListUpdate:  cfg.Matrix.JetStream.Prefixed(jetstream.InputDeviceListUpdate),
+		TopicSigningKeyUpdate:  cfg.Matrix.JetStream.Prefixed(jetstream.InputSigningKeyUpdate),
+		Config:                 &dendriteCfg.FederationAPI,
+		UserAPI:                userAPI,
+	}
+
+	relayAPI := internal.NewRelayInternalAPI(
+		relayDB,
+		fedClient,
+		rsAPI,
+		keyRing,
+		producer,
+		cfg.Matrix.Presence.EnableInbound,
+		cfg.Matrix.ServerName,
+		cfg.EnableRelaying,
+		cfg.Destinations,
+		cfg.MaxTransactionsPerDestination,
+		userAPI,
+	)
+
+	if len(cfg.RelayServers) > 0 {
+		go syncWithRelayServers(processContext, relayAPI, cfg)
+	}
+	if cfg.EnableRelaying {
+		go expireRelayedTransactions(processContext, relayDB, cfg.TransactionLifetime)
+	}
+
+	return relayAPI
+}
+
+// syncWithRelayServers periodically retrieves any transactions which the
+// configured relay servers have been holding for us.
+func syncWithRelayServers(
+	processContext *process.ProcessContext,
+	relayAPI api.RelayInternalAPI,
+	cfg *config.RelayAPI,
+) {
+	userID, err := spec.NewUserID("@user:"+string(cfg.Matrix.ServerName), false)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create user ID for relay syncing")
+		return
+	}
+	ticker := time.NewTicker(cfg.SyncInterval)
+	defer ticker.Stop()
+	for {
+		for _, relayServer := range cfg.RelayServers {
+			if err = relayAPI.PerformRelayServerSync(processContext.Context(), *userID, relayServer); err != nil {
+				logrus.WithError(err).Warnf("Failed to sync with relay server %s", relayServer)
+			}
+		}
+		select {
+		case <-processContext.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireRelayedTransactions periodically removes transactions which have been
+// stored for longer than the configured lifetime without being retrieved.
+func expireRelayedTransactions(
+	processContext *process.ProcessContext,
+	relayDB storage.Database,
+	lifetime time.Duration,
+) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		before := spec.AsTimestamp(time.Now().Add(-lifetime))
+		if err := relayDB.DeleteExpiredTransactions(processContext.Context(), before); err != nil {
+			logrus.WithError(err).Warn("Failed to remove expired relay transactions")
+		}
+		select {
+		case <-processContext.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/relayapi/api"
+	"github.com/matrix-org/dendrite/relayapi/routing"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+type testRelayAPI struct {
+	api.RelayInternalAPI
+	relayingEnabled bool
+	storeErr        error
+	stored          []gomatrixserverlib.Transaction
+}
+
+func (r *testRelayAPI) RelayingEnabled() bool {
+	return r.relayingEnabled
+}
+
+func (r *testRelayAPI) PerformStoreTransaction(ctx context.Context, txn gomatrixserverlib.Transaction, userID spec.UserID) error {
+	if r.storeErr != nil {
+		return r.storeErr
+	}
+	r.stored = append(r.stored, txn)
+	return nil
+}
+
+func (r *testRelayAPI) QueryTransactions(ctx context.Context, userID spec.UserID, previousEntry fclient.RelayEntry) (api.QueryRelayTransactionsResponse, error) {
+	return api.QueryRelayTransactionsResponse{}, nil
+}
+
+func createFederationRequest(
+	t *testing.T,
+	method string,
+	origin spec.ServerName,
+	content interface{},
+) *fclient.FederationRequest {
+	req := fclient.NewFederationRequest(method, origin, "relay", "/")
+	if err := req.SetContent(content); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	return &req
+}
+
+func TestGetTransactionFromRelay(t *testing.T) {
+	userID, err := spec.NewUserID("@local:domain", false)
+	assert.NoError(t, err)
+	relayAPI := &testRelayAPI{}
+	httpReq := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// Only the destination itself may retrieve its transactions.
+	req := createFederationRequest(t, http.MethodGet, "otherdomain", fclient.RelayEntry{})
+	res := routing.GetTransactionFromRelay(httpReq, req, relayAPI, *userID)
+	assert.Equal(t, http.StatusForbidden, res.Code)
+
+	req = createFederationRequest(t, http.MethodGet, "domain", fclient.RelayEntry{EntryID: -1})
+	res = routing.GetTransactionFromRelay(httpReq, req, relayAPI, *userID)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	req = createFederationRequest(t, http.MethodGet, "domain", fclient.RelayEntry{})
+	res = routing.GetTransactionFromRelay(httpReq, req, relayAPI, *userID)
+	assert.Equal(t, http.StatusOK, res.Code)
+}
+
+func TestSendTransactionToRelay(t *testing.T) {
+	userID, err := spec.NewUserID("@local:domain", false)
+	assert.NoError(t, err)
+	relayAPI := &testRelayAPI{}
+	httpReq := httptest.NewRequest(http.MethodPut, "/", nil)
+	txn := gomatrixserverlib.Transaction{PDUs: []json.RawMessage{}}
+
+	// Transactions are rejected while relaying is disabled.
+	req := createFederationRequest(t, http.MethodPut, "remote", txn)
+	res := routing.SendTransactionToRelay(httpReq, req, relayAPI, "txn1", *userID)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	assert.Empty(t, relayAPI.stored)
+
+	relayAPI.relayingEnabled = true
+	res = routing.SendTransactionToRelay(httpReq, req, relayAPI, "txn1", *userID)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Len(t, relayAPI.stored, 1)
+	assert.Equal(t, spec.ServerName("remote"), relayAPI.stored[0].Origin)
+	assert.Equal(t, spec.ServerName("domain"), relayAPI.stored[0].Destination)
+	assert.Equal(t, gomatrixserverlib.TransactionID("txn1"), relayAPI.stored[0].TransactionID)
+
+	// Transactions are limited to 50 PDUs.
+	txn.PDUs = make([]json.RawMessage, 51)
+	for i := range txn.PDUs {
+		txn.PDUs[i] = json.RawMessage("{}")
+	}
+	req = createFederationRequest(t, http.MethodPut, "remote", txn)
+	res = routing.SendTransactionToRelay(httpReq, req, relayAPI, "txn2", *userID)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Len(t, relayAPI.stored, 1)
+
+	// Destinations which aren't relayed for and full queues are reported.
+	req = createFederationRequest(t, http.MethodPut, "remote", gomatrixserverlib.Transaction{PDUs: []json.RawMessage{}})
+	relayAPI.storeErr = api.ErrDestinationNotAllowed
+	res = routing.SendTransactionToRelay(httpReq, req, relayAPI, "txn3", *userID)
+	assert.Equal(t, http.StatusForbidden, res.Code)
+	relayAPI.storeErr = api.ErrQueueFull
+	res = routing.SendTransactionToRelay(httpReq, req, relayAPI, "txn3", *userID)
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	relayAPI.storeErr = errors.New("database error")
+	res = routing.SendTransactionToRelay(httpReq, req, relayAPI, "txn3", *userID)
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+}
@@ -0,0 +1,51 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// UpAddQueueAddedTS records when each queue entry was stored, so that entries
+// which are never retrieved can expire. Existing entries are treated as if
+// they had just been stored.
+func UpAddQueueAddedTS(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "ALTER TABLE relayapi_queue ADD COLUMN IF NOT EXISTS added_ts BIGINT NOT NULL DEFAULT 0;")
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE relayapi_queue SET added_ts = $1 WHERE added_ts = 0", spec.AsTimestamp(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to update relayapi_queue: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS relayapi_queue_added_ts_idx ON relayapi_queue (added_ts);")
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownAddQueueAddedTS(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "ALTER TABLE relayapi_queue DROP COLUMN added_ts;")
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
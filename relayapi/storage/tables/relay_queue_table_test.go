@@ -0,0 +1,150 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tables_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/relayapi/storage/postgres"
+	"github.com/matrix-org/dendrite/relayapi/storage/ql"
+	"github.com/matrix-org/dendrite/relayapi/storage/tables"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	server1 = spec.ServerName("server1")
+	server2 = spec.ServerName("server2")
+)
+
+func mustCreateQueueTables(t *testing.T, dbType test.DBType) (tables.RelayQueue, tables.RelayQueueJSON, func()) {
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewDummyWriter())
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	var queue tables.RelayQueue
+	var queueJSON tables.RelayQueueJSON
+	switch dbType {
+	case test.DBTypeQL:
+		queue, err = ql.NewQLRelayQueueTable(db)
+		if err == nil {
+			queueJSON, err = ql.NewQLRelayQueueJSONTable(db)
+		}
+	case test.DBTypePostgres:
+		queue, err = postgres.NewPostgresRelayQueueTable(db)
+		if err == nil {
+			queueJSON, err = postgres.NewPostgresRelayQueueJSONTable(db)
+		}
+	}
+	if err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	return queue, queueJSON, close
+}
+
+func TestRelayQueueTable(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		ctx := context.Background()
+		queue, _, close := mustCreateQueueTables(t, dbType)
+		defer close()
+
+		for nid := int64(1); nid <= 3; nid++ {
+			err := queue.InsertQueueEntry(ctx, nil, gomatrixserverlib.TransactionID("txn"), server1, nid)
+			assert.NoError(t, err)
+		}
+		err := queue.InsertQueueEntry(ctx, nil, gomatrixserverlib.TransactionID("txn"), server2, 4)
+		assert.NoError(t, err)
+
+		// Entries are returned oldest first and limited
+		nids, err := queue.SelectQueueEntries(ctx, nil, server1, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2}, nids)
+
+		count, err := queue.SelectQueueEntryCount(ctx, nil, server1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), count)
+
+		// Deleting only affects the given server
+		err = queue.DeleteQueueEntries(ctx, nil, server1, []int64{1, 2, 4})
+		assert.NoError(t, err)
+		nids, err = queue.SelectQueueEntries(ctx, nil, server1, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{3}, nids)
+		count, err = queue.SelectQueueEntryCount(ctx, nil, server2)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+	})
+}
+
+func TestRelayQueueTableExpiry(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		ctx := context.Background()
+		queue, _, close := mustCreateQueueTables(t, dbType)
+		defer close()
+
+		err := queue.InsertQueueEntry(ctx, nil, gomatrixserverlib.TransactionID("txn"), server1, 1)
+		assert.NoError(t, err)
+		err = queue.InsertQueueEntry(ctx, nil, gomatrixserverlib.TransactionID("txn"), server2, 2)
+		assert.NoError(t, err)
+
+		// Nothing was added before an hour ago.
+		nids, err := queue.DeleteExpiredQueueEntries(ctx, nil, spec.AsTimestamp(time.Now().Add(-time.Hour)))
+		assert.NoError(t, err)
+		assert.Empty(t, nids)
+
+		// Entries for every server expire.
+		nids, err = queue.DeleteExpiredQueueEntries(ctx, nil, spec.AsTimestamp(time.Now().Add(time.Minute)))
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []int64{1, 2}, nids)
+		count, err := queue.SelectQueueEntryCount(ctx, nil, server1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+	})
+}
+
+func TestRelayQueueJSONTable(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		ctx := context.Background()
+		_, queueJSON, close := mustCreateQueueTables(t, dbType)
+		defer close()
+
+		nid1, err := queueJSON.InsertQueueJSON(ctx, nil, `{"a":1}`)
+		assert.NoError(t, err)
+		nid2, err := queueJSON.InsertQueueJSON(ctx, nil, `{"a":1}`)
+		assert.NoError(t, err)
+		assert.NotEqual(t, nid1, nid2)
+
+		blobs, err := queueJSON.SelectQueueJSON(ctx, nil, []int64{nid1, nid2, 1000})
+		assert.NoError(t, err)
+		assert.Len(t, blobs, 2)
+		assert.JSONEq(t, `{"a":1}`, string(blobs[nid1]))
+
+		err = queueJSON.DeleteQueueJSON(ctx, nil, []int64{nid1})
+		assert.NoError(t, err)
+		blobs, err = queueJSON.SelectQueueJSON(ctx, nil, []int64{nid1, nid2})
+		assert.NoError(t, err)
+		assert.Len(t, blobs, 1)
+		assert.Contains(t, blobs, nid2)
+	})
+}
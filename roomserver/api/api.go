@@ -9,6 +9,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
 
+	asAPI "github.com/matrix-org/dendrite/appservice/api"
 	fsAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -74,6 +75,7 @@ type RoomserverInternalAPI interface {
 	// interdependencies between the roomserver and other input APIs
 	SetFederationAPI(fsAPI fsAPI.RoomserverFederationAPI, keyRing *gomatrixserverlib.KeyRing)
 	SetUserAPI(userAPI userapi.RoomserverUserAPI)
+	SetAppserviceAPI(asAPI asAPI.AppServiceInternalAPI)
 
 	// QueryAuthChain returns the entire auth chain for the event IDs given.
 	// The response includes the events in the request.
@@ -147,6 +149,14 @@ type QueryRoomHierarchyAPI interface {
 	)
 }
 
+type QueryRoomSummaryAPI interface {
+	// QueryRoomSummary returns the summary of a room, if the caller is allowed
+	// to see it. Rooms the server isn't joined to are fetched from the given
+	// servers over federation. Returns ErrRoomUnknownOrNotAllowed if the room
+	// is unknown or the caller isn't allowed to see it.
+	QueryRoomSummary(ctx context.Context, caller types.DeviceOrServerName, roomID spec.RoomID, vias []string) (*RoomSummary, error)
+}
+
 type QueryMembershipAPI interface {
 	QueryMembershipForSenderID(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID, res *QueryMembershipForUserResponse) error
 	QueryMembershipForUser(ctx context.Context, req *QueryMembershipForUserRequest, res *QueryMembershipForUserResponse) error
@@ -192,6 +202,10 @@ type SyncRoomserverAPI interface {
 		req *PerformBackfillRequest,
 		res *PerformBackfillResponse,
 	) error
+
+	// PerformRedactExpiredEvents redacts the given events in the room, which have expired under
+	// the room's retention policy. State events are never redacted.
+	PerformRedactExpiredEvents(ctx context.Context, roomID string, eventIDs []string) error
 }
 
 type AppserviceRoomserverAPI interface {
@@ -225,6 +239,7 @@ type ClientRoomserverAPI interface {
 	QuerySenderIDAPI
 	UserRoomPrivateKeyCreator
 	QueryRoomHierarchyAPI
+	QueryRoomSummaryAPI
 	DefaultRoomVersionAPI
 
 	QueryMembershipForUser(ctx context.Context, req *QueryMembershipForUserRequest, res *QueryMembershipForUserResponse) error
@@ -249,6 +264,8 @@ type ClientRoomserverAPI interface {
 	PerformInvite(ctx context.Context, req *PerformInviteRequest) error
 	PerformJoin(ctx context.Context, req *PerformJoinRequest) (roomID string, joinedVia spec.ServerName, err error)
 	PerformLeave(ctx context.Context, req *PerformLeaveRequest, res *PerformLeaveResponse) error
+	// PerformKnock knocks on a room, returning the room ID that was knocked on
+	PerformKnock(ctx context.Context, req *PerformKnockRequest) (roomID string, err error)
 	PerformPublish(ctx context.Context, req *PerformPublishRequest) error
 	// PerformForget forgets a rooms history for a specific user
 	PerformForget(ctx context.Context, req *PerformForgetRequest, resp *PerformForgetResponse) error
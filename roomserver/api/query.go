@@ -23,6 +23,7 @@ import (
 	"strings"
 
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
 
@@ -577,3 +578,19 @@ func (s RoomSet) Copy() RoomSet {
 	}
 	return copied
 }
+
+// RoomSummary is the summary of a room, which allows previewing it before
+// joining. See https://github.com/matrix-org/matrix-spec-proposals/pull/3266
+type RoomSummary struct {
+	fclient.PublicRoom
+	// The type of the room from the m.room.create event, if any.
+	RoomType string `json:"room_type,omitempty"`
+	// The rooms whose members may join a restricted room.
+	AllowedRoomIDs []string `json:"allowed_room_ids,omitempty"`
+	// The encryption algorithm of the room, if it is encrypted.
+	Encryption string `json:"encryption,omitempty"`
+	// The room version, if known.
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version,omitempty"`
+	// The membership of the requesting user, if requested by a user.
+	Membership string `json:"membership,omitempty"`
+}
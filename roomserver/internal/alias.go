@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"time"
 
+	asAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
@@ -70,6 +71,29 @@ func (r *RoomserverInternalAPI) GetRoomIDForAlias(
 		return nil
 	}
 
+	if r.asAPI != nil && request.IncludeAppservices { // appservice component is wired in
+		// No room found locally, try our application services by making a call to
+		// the appservice component
+		aliasReq := &asAPI.RoomAliasExistsRequest{
+			Alias: request.Alias,
+		}
+		aliasRes := &asAPI.RoomAliasExistsResponse{}
+		if err = r.asAPI.RoomAliasExists(ctx, aliasReq, aliasRes); err != nil {
+			return err
+		}
+
+		if aliasRes.AliasExists {
+			// The application service should have created the room and
+			// the alias by now, so look it up again
+			roomID, err = r.DB.GetRoomIDForAlias(ctx, request.Alias)
+			if err != nil {
+				return err
+			}
+			response.RoomID = roomID
+			return nil
+		}
+	}
+
 	return err
 }
 
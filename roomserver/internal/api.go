@@ -12,6 +12,7 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 
+	asAPI "github.com/matrix-org/dendrite/appservice/api"
 	fsAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/roomserver/acls"
@@ -35,6 +36,7 @@ type RoomserverInternalAPI struct {
 	*perform.Inviter
 	*perform.Joiner
 	*perform.Leaver
+	*perform.Knocker
 	*perform.Publisher
 	*perform.Backfiller
 	*perform.Forgetter
@@ -49,6 +51,7 @@ type RoomserverInternalAPI struct {
 	KeyRing                gomatrixserverlib.JSONVerifier
 	ServerACLs             *acls.ServerACLs
 	fsAPI                  fsAPI.RoomserverFederationAPI
+	asAPI                  asAPI.AppServiceInternalAPI
 	NATSClient             *nats.Conn
 	JetStream              nats.JetStreamContext
 	Durable                string
@@ -150,6 +153,14 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		RSAPI:   r,
 		Inputer: r.Inputer,
 	}
+	r.Knocker = &perform.Knocker{
+		Cfg:     &r.Cfg.RoomServer,
+		DB:      r.DB,
+		FSAPI:   r.fsAPI,
+		RSAPI:   r,
+		Inputer: r.Inputer,
+		Queryer: r.Queryer,
+	}
 	r.Publisher = &perform.Publisher{
 		DB: r.DB,
 	}
@@ -194,6 +205,10 @@ func (r *RoomserverInternalAPI) SetUserAPI(userAPI userapi.RoomserverUserAPI) {
 	r.Inputer.UserAPI = userAPI
 }
 
+func (r *RoomserverInternalAPI) SetAppserviceAPI(asAPI asAPI.AppServiceInternalAPI) {
+	r.asAPI = asAPI
+}
+
 func (r *RoomserverInternalAPI) DefaultRoomVersion() gomatrixserverlib.RoomVersion {
 	return r.defaultRoomVersion
 }
@@ -245,6 +260,21 @@ func (r *RoomserverInternalAPI) PerformLeave(
 	return r.OutputProducer.ProduceRoomEvents(req.RoomID, outputEvents)
 }
 
+func (r *RoomserverInternalAPI) PerformKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+) (string, error) {
+	roomID, outputEvents, err := r.Knocker.PerformKnock(ctx, req)
+	if err != nil {
+		sentry.CaptureException(err)
+		return "", err
+	}
+	if len(outputEvents) == 0 {
+		return roomID, nil
+	}
+	return roomID, r.OutputProducer.ProduceRoomEvents(roomID, outputEvents)
+}
+
 func (r *RoomserverInternalAPI) PerformForget(
 	ctx context.Context,
 	req *api.PerformForgetRequest,
@@ -322,3 +352,7 @@ func (r *RoomserverInternalAPI) InsertReportedEvent(
 ) (int64, error) {
 	return r.DB.InsertReportedEvent(ctx, roomID, eventID, reportingUserID, reason, score)
 }
+
+func (r *RoomserverInternalAPI) PerformRedactExpiredEvents(ctx context.Context, roomID string, eventIDs []string) error {
+	return r.DB.RedactExpiredEvents(ctx, roomID, eventIDs)
+}
@@ -0,0 +1,298 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	fsAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+type Knocker struct {
+	Cfg   *config.RoomServer
+	DB    storage.Database
+	FSAPI fsAPI.RoomserverFederationAPI
+	RSAPI api.RoomserverInternalAPI
+
+	Inputer *input.Inputer
+	Queryer *query.Queryer
+}
+
+// PerformKnock handles knocking on matrix rooms, including over federation by talking to the federationapi.
+func (r *Knocker) PerformKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+) (roomID string, outputEvents []api.OutputEvent, err error) {
+	logger := logrus.WithContext(ctx).WithFields(logrus.Fields{
+		"room_id": req.RoomIDOrAlias,
+		"user_id": req.UserID.String(),
+		"servers": req.ServerNames,
+	})
+	logger.Info("User requested to knock on room")
+	if !r.Cfg.Matrix.IsLocalServerName(req.UserID.Domain()) {
+		return "", nil, api.ErrInvalidID{Err: fmt.Errorf("user %q does not belong to this homeserver", req.UserID.String())}
+	}
+	switch {
+	case strings.HasPrefix(req.RoomIDOrAlias, "!"):
+	case strings.HasPrefix(req.RoomIDOrAlias, "#"):
+		if err = r.resolveRoomAlias(ctx, req); err != nil {
+			return "", nil, err
+		}
+	default:
+		return "", nil, api.ErrInvalidID{Err: fmt.Errorf("room ID or alias %q is invalid", req.RoomIDOrAlias)}
+	}
+	outputEvents, err = r.performKnockRoomByID(ctx, req)
+	if err != nil {
+		logger.WithError(err).Error("Failed to knock on room")
+		return "", nil, err
+	}
+	logger.Info("User knocked on room successfully")
+	return req.RoomIDOrAlias, outputEvents, nil
+}
+
+// resolveRoomAlias replaces the alias in the request with the room ID that
+// it points to, adding the alias server to the list of servers to try.
+func (r *Knocker) resolveRoomAlias(ctx context.Context, req *api.PerformKnockRequest) error {
+	_, domain, err := gomatrixserverlib.SplitID('#', req.RoomIDOrAlias)
+	if err != nil {
+		return api.ErrInvalidID{Err: fmt.Errorf("alias %q is not in the correct format", req.RoomIDOrAlias)}
+	}
+	req.ServerNames = append(req.ServerNames, domain)
+
+	var roomID string
+	if !r.Cfg.Matrix.IsLocalServerName(domain) {
+		dirReq := fsAPI.PerformDirectoryLookupRequest{
+			RoomAlias:  req.RoomIDOrAlias,
+			ServerName: domain,
+		}
+		dirRes := fsAPI.PerformDirectoryLookupResponse{}
+		if err = r.FSAPI.PerformDirectoryLookup(ctx, &dirReq, &dirRes); err != nil {
+			return fmt.Errorf("looking up alias %q over federation failed: %w", req.RoomIDOrAlias, err)
+		}
+		roomID = dirRes.RoomID
+		req.ServerNames = append(req.ServerNames, dirRes.ServerNames...)
+	} else {
+		getRoomReq := api.GetRoomIDForAliasRequest{
+			Alias:              req.RoomIDOrAlias,
+			IncludeAppservices: true,
+		}
+		getRoomRes := api.GetRoomIDForAliasResponse{}
+		if err = r.RSAPI.GetRoomIDForAlias(ctx, &getRoomReq, &getRoomRes); err != nil {
+			return fmt.Errorf("lookup room alias %q failed: %w", req.RoomIDOrAlias, err)
+		}
+		roomID = getRoomRes.RoomID
+	}
+	if roomID == "" {
+		return api.ErrRoomUnknownOrNotAllowed{Err: fmt.Errorf("alias %q not found", req.RoomIDOrAlias)}
+	}
+	req.RoomIDOrAlias = roomID
+	return nil
+}
+
+func (r *Knocker) performKnockRoomByID(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+) ([]api.OutputEvent, error) {
+	roomID, err := spec.NewRoomID(req.RoomIDOrAlias)
+	if err != nil {
+		return nil, api.ErrInvalidID{Err: fmt.Errorf("room ID %q is invalid: %w", req.RoomIDOrAlias, err)}
+	}
+
+	// The original client request ?server_name=... may include this HS so
+	// filter that out so we don't attempt to make_knock with ourselves.
+	serverNames := make([]spec.ServerName, 0, len(req.ServerNames)+1)
+	for _, serverName := range req.ServerNames {
+		if !r.Cfg.Matrix.IsLocalServerName(serverName) {
+			serverNames = append(serverNames, serverName)
+		}
+	}
+	if !r.Cfg.Matrix.IsLocalServerName(roomID.Domain()) {
+		serverNames = append(serverNames, roomID.Domain())
+	}
+	req.ServerNames = serverNames
+
+	inRoomReq := &api.QueryServerJoinedToRoomRequest{
+		RoomID: roomID.String(),
+	}
+	inRoomRes := &api.QueryServerJoinedToRoomResponse{}
+	if err = r.Queryer.QueryServerJoinedToRoom(ctx, inRoomReq, inRoomRes); err != nil {
+		return nil, fmt.Errorf("r.Queryer.QueryServerJoinedToRoom: %w", err)
+	}
+	if inRoomRes.RoomExists && inRoomRes.IsInRoom {
+		return nil, r.performLocalKnock(ctx, req, *roomID, inRoomRes.RoomVersion)
+	}
+	if len(req.ServerNames) == 0 {
+		return nil, api.ErrRoomUnknownOrNotAllowed{Err: fmt.Errorf("room %q is not known and no servers were supplied to knock via", roomID.String())}
+	}
+	return r.performFederatedKnock(ctx, req, *roomID)
+}
+
+// performLocalKnock sends a knock event into a room that this server is
+// already joined to.
+func (r *Knocker) performLocalKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+	roomID spec.RoomID,
+	roomVersion gomatrixserverlib.RoomVersion,
+) error {
+	if roomVersion == gomatrixserverlib.RoomVersionPseudoIDs {
+		return api.ErrNotAllowed{Err: fmt.Errorf("knocking is not supported in room version %q", roomVersion)}
+	}
+
+	senderID := req.UserID.String()
+	proto := gomatrixserverlib.ProtoEvent{
+		Type:     spec.MRoomMember,
+		SenderID: senderID,
+		StateKey: &senderID,
+		RoomID:   roomID.String(),
+	}
+	if err := proto.SetContent(gomatrixserverlib.MemberContent{
+		Membership: spec.Knock,
+		Reason:     req.Reason,
+	}); err != nil {
+		return fmt.Errorf("proto.SetContent: %w", err)
+	}
+
+	// Attach the stripped state of the room to the knock, so that the
+	// knocking user can identify the room they knocked on.
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID:       roomID.String(),
+		StateToFetch: eventutil.StrippedStateTuples(),
+	}
+	stateRes := api.QueryLatestEventsAndStateResponse{}
+	if err := helpers.QueryLatestEventsAndState(ctx, r.DB, r.RSAPI, &stateReq, &stateRes); err != nil {
+		return fmt.Errorf("helpers.QueryLatestEventsAndState: %w", err)
+	}
+	knockRoomState := make([]gomatrixserverlib.InviteStrippedState, 0, len(stateRes.StateEvents))
+	for _, ev := range stateRes.StateEvents {
+		knockRoomState = append(knockRoomState, gomatrixserverlib.NewInviteStrippedState(ev.PDU))
+	}
+	if err := proto.SetUnsigned(map[string]interface{}{
+		"knock_room_state": knockRoomState,
+	}); err != nil {
+		return fmt.Errorf("proto.SetUnsigned: %w", err)
+	}
+
+	identity, err := r.RSAPI.SigningIdentityFor(ctx, roomID, req.UserID)
+	if err != nil {
+		return fmt.Errorf("SigningIdentityFor: %w", err)
+	}
+	var buildRes api.QueryLatestEventsAndStateResponse
+	event, err := eventutil.QueryAndBuildEvent(ctx, &proto, &identity, time.Now(), r.RSAPI, &buildRes)
+	if err != nil {
+		return fmt.Errorf("eventutil.QueryAndBuildEvent: %w", err)
+	}
+
+	// Give our knock event to the roomserver input stream. The event auth
+	// checks will reject the knock if the join rules don't allow it.
+	inputReq := api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{
+			{
+				Kind:         api.KindNew,
+				Event:        event,
+				Origin:       req.UserID.Domain(),
+				SendAsServer: string(req.UserID.Domain()),
+			},
+		},
+	}
+	inputRes := api.InputRoomEventsResponse{}
+	r.Inputer.InputRoomEvents(ctx, &inputReq, &inputRes)
+	if err = inputRes.Err(); err != nil {
+		return api.ErrNotAllowed{Err: err}
+	}
+	return nil
+}
+
+// performFederatedKnock asks the federation API to knock on a room that this
+// server isn't joined to. As we don't have the room state, the knock event is
+// recorded in the membership table and handed directly to downstream
+// components, so that the knocking user can see it in /sync.
+func (r *Knocker) performFederatedKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+	roomID spec.RoomID,
+) ([]api.OutputEvent, error) {
+	fedReq := fsAPI.PerformKnockRequest{
+		RoomID:      roomID.String(),
+		UserID:      req.UserID.String(),
+		ServerNames: req.ServerNames,
+	}
+	if req.Reason != "" {
+		fedReq.Content = map[string]interface{}{
+			"reason": req.Reason,
+		}
+	}
+	fedRes := fsAPI.PerformKnockResponse{}
+	if err := r.FSAPI.PerformKnock(ctx, &fedReq, &fedRes); err != nil {
+		return nil, err
+	}
+	if fedRes.Event == nil {
+		return nil, fmt.Errorf("federation API returned no knock event")
+	}
+
+	updater, err := r.DB.MembershipUpdater(ctx, roomID.String(), req.UserID.String(), true, fedRes.Event.Version())
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.MembershipUpdater: %w", err)
+	}
+	if _, _, err = updater.Update(tables.MembershipStateKnock, &types.Event{
+		EventNID: 0,
+		PDU:      fedRes.Event.PDU,
+	}); err != nil {
+		_ = updater.Rollback()
+		return nil, fmt.Errorf("updater.Update: %w", err)
+	}
+	if err = updater.Commit(); err != nil {
+		return nil, fmt.Errorf("updater.Commit: %w", err)
+	}
+
+	// Remember the servers we knocked through, starting with the one which
+	// accepted the knock, so that it can be rescinded through them too.
+	knockServers := []spec.ServerName{fedRes.KnockedVia}
+	for _, serverName := range req.ServerNames {
+		if serverName != fedRes.KnockedVia {
+			knockServers = append(knockServers, serverName)
+		}
+	}
+	if err = r.DB.StoreKnockServers(ctx, roomID.String(), req.UserID.String(), knockServers); err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("failed to store the servers knocked through")
+	}
+
+	return []api.OutputEvent{
+		{
+			Type: api.OutputTypeNewRoomEvent,
+			NewRoomEvent: &api.OutputNewRoomEvent{
+				Event:             fedRes.Event,
+				AddsStateEventIDs: []string{fedRes.Event.EventID()},
+				HistoryVisibility: gomatrixserverlib.HistoryVisibilityShared,
+				SendAsServer:      api.DoNotSendToOtherServers,
+			},
+		},
+	}, nil
+}
@@ -34,6 +34,9 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/internal/input"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
@@ -136,6 +139,21 @@ func (r *Leaver) performLeaveRoomByID(
 		}
 	}
 
+	// If there's a knock outstanding for a room that we aren't joined to
+	// then we'll need to rescind it over federation.
+	if info, infoErr := r.DB.RoomInfo(ctx, req.RoomID); infoErr == nil && info != nil && info.IsStub() {
+		updater, updaterErr := r.DB.MembershipUpdater(ctx, req.RoomID, string(*leaver), true, info.RoomVersion)
+		if updaterErr != nil {
+			return nil, fmt.Errorf("r.DB.MembershipUpdater: %w", updaterErr)
+		}
+		if updater.IsKnock() {
+			return r.performFederatedRescindKnock(ctx, req, *roomID, updater)
+		}
+		if err = updater.Rollback(); err != nil {
+			return nil, fmt.Errorf("updater.Rollback: %w", err)
+		}
+	}
+
 	// There's no invite pending, so first of all we want to find out
 	// if the room exists and if the user is actually in it.
 	latestReq := api.QueryLatestEventsAndStateRequest{
@@ -163,7 +181,7 @@ func (r *Leaver) performLeaveRoomByID(
 	if err != nil {
 		return nil, fmt.Errorf("error getting membership: %w", err)
 	}
-	if membership != spec.Join && membership != spec.Invite {
+	if membership != spec.Join && membership != spec.Invite && membership != spec.Knock {
 		return nil, fmt.Errorf("user %q is not joined to the room (membership is %q)", req.Leaver.String(), membership)
 	}
 
@@ -225,6 +243,65 @@ func (r *Leaver) performLeaveRoomByID(
 	return nil, nil
 }
 
+// performFederatedRescindKnock rescinds a knock on a room that this server
+// isn't joined to, by performing a federated leave via the servers which the
+// knock was made through.
+func (r *Leaver) performFederatedRescindKnock(
+	ctx context.Context,
+	req *api.PerformLeaveRequest,
+	roomID spec.RoomID,
+	updater *shared.MembershipUpdater,
+) ([]api.OutputEvent, error) {
+	serverNames, err := r.DB.GetKnockServers(ctx, roomID.String(), req.Leaver.String())
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("failed to get the servers knocked through")
+	}
+	if len(serverNames) == 0 {
+		serverNames = []spec.ServerName{roomID.Domain()}
+	}
+	leaveReq := fsAPI.PerformLeaveRequest{
+		RoomID:      req.RoomID,
+		UserID:      req.Leaver.String(),
+		ServerNames: serverNames,
+	}
+	leaveRes := fsAPI.PerformLeaveResponse{}
+	if err = r.FSAPI.PerformLeave(ctx, &leaveReq, &leaveRes); err != nil {
+		_ = updater.Rollback()
+		return nil, fmt.Errorf("r.FSAPI.PerformLeave: %w", err)
+	}
+	if leaveRes.Event == nil {
+		_ = updater.Rollback()
+		return nil, fmt.Errorf("federation API returned no leave event")
+	}
+	if _, _, err = updater.Update(tables.MembershipStateLeaveOrBan, &types.Event{
+		EventNID: 0,
+		PDU:      leaveRes.Event.PDU,
+	}); err != nil {
+		_ = updater.Rollback()
+		return nil, fmt.Errorf("updater.Update: %w", err)
+	}
+	if err = updater.Commit(); err != nil {
+		return nil, fmt.Errorf("updater.Commit: %w", err)
+	}
+	if err = r.DB.DeleteKnockServers(ctx, roomID.String(), req.Leaver.String()); err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("failed to delete the servers knocked through")
+	}
+
+	// We don't have the room state, so tell the sync API etc about the
+	// leave event directly so that the knock is withdrawn.
+	return []api.OutputEvent{
+		{
+			Type: api.OutputTypeNewRoomEvent,
+			NewRoomEvent: &api.OutputNewRoomEvent{
+				Event:             leaveRes.Event,
+				AddsStateEventIDs: []string{leaveRes.Event.EventID()},
+				HistoryVisibility: gomatrixserverlib.HistoryVisibilityShared,
+				SendAsServer:      api.DoNotSendToOtherServers,
+			},
+		},
+	}, nil
+}
+
 func (r *Leaver) performFederatedRejectInvite(
 	ctx context.Context,
 	req *api.PerformLeaveRequest,
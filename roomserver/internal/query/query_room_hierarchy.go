@@ -221,6 +221,27 @@ func authorised(ctx context.Context, querier *Queryer, caller types.DeviceOrServ
 
 // authorisedServer returns true iff the server is joined this room or the room is world_readable, public, or knockable
 func authorisedServer(ctx context.Context, querier *Queryer, roomID spec.RoomID, callerServerName spec.ServerName) (bool, []string) {
+	return authorisedByJoinRules(ctx, querier, roomID, func(allowedRoomID spec.RoomID) bool {
+		var queryRes fs.QueryJoinedHostServerNamesInRoomResponse
+		err := querier.FSAPI.QueryJoinedHostServerNamesInRoom(ctx, &fs.QueryJoinedHostServerNamesInRoomRequest{
+			RoomID: allowedRoomID.String(),
+		}, &queryRes)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("failed to QueryJoinedHostServerNamesInRoom")
+			return false
+		}
+		for _, srv := range queryRes.ServerNames {
+			if srv == callerServerName {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// authorisedByJoinRules returns true iff the room is world_readable, public or knockable, or if isJoined
+// returns true for the room or, for restricted rooms, for one of the allowed rooms.
+func authorisedByJoinRules(ctx context.Context, querier *Queryer, roomID spec.RoomID, isJoined func(spec.RoomID) bool) (bool, []string) {
 	// Check history visibility / join rules first
 	hisVisTuple := gomatrixserverlib.StateKeyTuple{
 		EventType: spec.MRoomHistoryVisibility,
@@ -270,24 +291,14 @@ func authorisedServer(ctx context.Context, querier *Queryer, roomID spec.RoomID,
 		}
 	}
 
-	// check if server is joined to any allowed room
+	// check if the caller is joined to any allowed room
 	resultAllowedRoomIDs := make([]string, 0, len(allowJoinedToRoomIDs))
 	for _, allowedRoomID := range allowJoinedToRoomIDs {
 		resultAllowedRoomIDs = append(resultAllowedRoomIDs, allowedRoomID.String())
 	}
 	for _, allowedRoomID := range allowJoinedToRoomIDs {
-		var queryRes fs.QueryJoinedHostServerNamesInRoomResponse
-		err = querier.FSAPI.QueryJoinedHostServerNamesInRoom(ctx, &fs.QueryJoinedHostServerNamesInRoomRequest{
-			RoomID: allowedRoomID.String(),
-		}, &queryRes)
-		if err != nil {
-			util.GetLogger(ctx).WithError(err).Error("failed to QueryJoinedHostServerNamesInRoom")
-			continue
-		}
-		for _, srv := range queryRes.ServerNames {
-			if srv == callerServerName {
-				return true, resultAllowedRoomIDs[1:]
-			}
+		if isJoined(allowedRoomID) {
+			return true, resultAllowedRoomIDs[1:]
 		}
 	}
 
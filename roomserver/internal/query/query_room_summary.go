@@ -0,0 +1,134 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+// QueryRoomSummary returns the summary of a room, if the caller is allowed to see it.
+// Rooms the server isn't joined to are fetched from the given servers over federation.
+func (querier *Queryer) QueryRoomSummary(ctx context.Context, caller types.DeviceOrServerName, roomID spec.RoomID, vias []string) (*roomserver.RoomSummary, error) {
+	errNotAllowed := roomserver.ErrRoomUnknownOrNotAllowed{Err: fmt.Errorf("room is unknown/forbidden")}
+
+	// Users always get their membership, as they may e.g. be invited to a room
+	// the server isn't joined to.
+	membership := ""
+	if device := caller.Device(); device != nil {
+		userID, err := spec.NewUserID(device.UserID, true)
+		if err != nil {
+			return nil, err
+		}
+		var memberRes roomserver.QueryMembershipForUserResponse
+		if err = querier.QueryMembershipForUser(ctx, &roomserver.QueryMembershipForUserRequest{
+			RoomID: roomID.String(),
+			UserID: *userID,
+		}, &memberRes); err != nil {
+			return nil, err
+		}
+		membership = spec.Leave
+		if memberRes.HasBeenInRoom {
+			membership = memberRes.Membership
+		}
+	}
+
+	// If we aren't in the room, our view of it may be stale or missing, so ask
+	// a server which is. The remote server applies the visibility checks.
+	if !roomExists(ctx, querier, roomID) {
+		if len(vias) == 0 {
+			vias = []string{string(roomID.Domain())}
+		}
+		fedRes := federatedRoomInfo(ctx, querier, caller, false, roomID, vias)
+		if fedRes == nil {
+			return nil, errNotAllowed
+		}
+		return &roomserver.RoomSummary{
+			PublicRoom:     fedRes.Room.PublicRoom,
+			RoomType:       fedRes.Room.RoomType,
+			AllowedRoomIDs: fedRes.Room.AllowedRoomIDs,
+			Membership:     membership,
+		}, nil
+	}
+
+	authed, allowedRoomIDs := authorisedSummary(ctx, querier, caller, roomID, membership)
+	if !authed {
+		return nil, errNotAllowed
+	}
+
+	pubRoom := publicRoomsChunk(ctx, querier, roomID)
+	if pubRoom == nil {
+		return nil, fmt.Errorf("failed to get the public room information")
+	}
+	roomVersion, err := querier.QueryRoomVersionForRoom(ctx, roomID.String())
+	if err != nil {
+		return nil, err
+	}
+	summary := &roomserver.RoomSummary{
+		PublicRoom:     *pubRoom,
+		AllowedRoomIDs: allowedRoomIDs,
+		RoomVersion:    roomVersion,
+		Membership:     membership,
+	}
+	if create := stateEvent(ctx, querier, roomID, spec.MRoomCreate, ""); create != nil {
+		var createContent gomatrixserverlib.CreateContent
+		if err = json.Unmarshal(create.Content(), &createContent); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("create_content", create.Content()).Warn("failed to unmarshal m.room.create event")
+		}
+		summary.RoomType = createContent.RoomType
+	}
+	if encryption := stateEvent(ctx, querier, roomID, spec.MRoomEncryption, ""); encryption != nil {
+		summary.Encryption = gjson.GetBytes(encryption.Content(), "algorithm").Str
+	}
+	return summary, nil
+}
+
+// authorisedSummary returns true iff the caller may see the summary of the room. Users which are joined,
+// invited or knocking may always see it, otherwise the same rules as for servers in the room hierarchy apply.
+func authorisedSummary(ctx context.Context, querier *Queryer, caller types.DeviceOrServerName, roomID spec.RoomID, membership string) (bool, []string) {
+	if serverCaller := caller.ServerName(); serverCaller != nil {
+		return authorisedServer(ctx, querier, roomID, *serverCaller)
+	}
+	clientCaller := caller.Device()
+	if clientCaller == nil {
+		return false, nil
+	}
+	switch membership {
+	case spec.Join, spec.Invite, spec.Knock:
+		var allowedRoomIDs []string
+		if joinRuleEv := stateEvent(ctx, querier, roomID, spec.MRoomJoinRules, ""); joinRuleEv != nil {
+			for _, allowedRoomID := range restrictedJoinRuleAllowedRooms(ctx, joinRuleEv) {
+				allowedRoomIDs = append(allowedRoomIDs, allowedRoomID.String())
+			}
+		}
+		return true, allowedRoomIDs
+	}
+	return authorisedByJoinRules(ctx, querier, roomID, func(allowedRoomID spec.RoomID) bool {
+		memberEv := stateEvent(ctx, querier, allowedRoomID, spec.MRoomMember, clientCaller.UserID)
+		if memberEv == nil {
+			return false
+		}
+		allowedMembership, _ := memberEv.Membership()
+		return allowedMembership == spec.Join
+	})
+}
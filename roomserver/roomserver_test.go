@@ -28,6 +28,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/dendrite/federationapi"
+	fsAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/syncapi"
 
@@ -767,6 +768,145 @@ func TestQueryRestrictedJoinAllowed(t *testing.T) {
 	})
 }
 
+func TestQueryRoomSummary(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	bobDevice := types.NewDeviceNotServerName(userAPI.Device{UserID: bob.ID})
+
+	// bob is joined to this room, which allows him to see restricted rooms
+	allowedRoom := test.NewRoom(t, alice)
+	allowedRoom.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": spec.Join,
+	}, test.WithStateKey(bob.ID))
+
+	testCases := []struct {
+		name            string
+		prepareRoomFunc func(t *testing.T) *test.Room
+		wantError       bool
+		wantMembership  string
+		wantAllowed     []string
+		wantName        string
+		wantEncryption  string
+	}{
+		{
+			name: "public room",
+			prepareRoomFunc: func(t *testing.T) *test.Room {
+				r := test.NewRoom(t, alice)
+				r.CreateAndInsert(t, alice, spec.MRoomName, map[string]interface{}{"name": "Public"}, test.WithStateKey(""))
+				r.CreateAndInsert(t, alice, spec.MRoomEncryption, map[string]interface{}{"algorithm": "m.megolm.v1.aes-sha2"}, test.WithStateKey(""))
+				return r
+			},
+			wantMembership: spec.Leave,
+			wantName:       "Public",
+			wantEncryption: "m.megolm.v1.aes-sha2",
+		},
+		{
+			name: "invite only room",
+			prepareRoomFunc: func(t *testing.T) *test.Room {
+				return test.NewRoom(t, alice, test.RoomPreset(test.PresetPrivateChat))
+			},
+			wantError: true,
+		},
+		{
+			name: "invite only room, invited",
+			prepareRoomFunc: func(t *testing.T) *test.Room {
+				r := test.NewRoom(t, alice, test.RoomPreset(test.PresetPrivateChat))
+				r.CreateAndInsert(t, alice, spec.MRoomMember, map[string]interface{}{
+					"membership": spec.Invite,
+				}, test.WithStateKey(bob.ID))
+				return r
+			},
+			wantMembership: spec.Invite,
+		},
+		{
+			name: "world readable room",
+			prepareRoomFunc: func(t *testing.T) *test.Room {
+				return test.NewRoom(t, alice, test.RoomPreset(test.PresetPrivateChat), test.RoomHistoryVisibility(gomatrixserverlib.HistoryVisibilityWorldReadable))
+			},
+			wantMembership: spec.Leave,
+		},
+		{
+			name: "restricted room, joined to allowed room",
+			prepareRoomFunc: func(t *testing.T) *test.Room {
+				r := test.NewRoom(t, alice, test.RoomVersion(gomatrixserverlib.RoomVersionV10))
+				r.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{
+					"join_rule": spec.Restricted,
+					"allow": []map[string]interface{}{
+						{"room_id": allowedRoom.ID, "type": spec.MRoomMembership},
+					},
+				}, test.WithStateKey(""))
+				return r
+			},
+			wantMembership: spec.Leave,
+			wantAllowed:    []string{allowedRoom.ID},
+		},
+		{
+			name: "restricted room, not joined to allowed room",
+			prepareRoomFunc: func(t *testing.T) *test.Room {
+				r := test.NewRoom(t, alice, test.RoomVersion(gomatrixserverlib.RoomVersionV10))
+				r.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{
+					"join_rule": spec.Restricted,
+					"allow": []map[string]interface{}{
+						{"room_id": test.NewRoom(t, alice).ID, "type": spec.MRoomMembership},
+					},
+				}, test.WithStateKey(""))
+				return r
+			},
+			wantError: true,
+		},
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		natsInstance := jetstream.NATSInstance{}
+		defer close()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		if err := api.SendEvents(processCtx.Context(), rsAPI, api.KindNew, allowedRoom.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				testRoom := tc.prepareRoomFunc(t)
+				if err := api.SendEvents(processCtx.Context(), rsAPI, api.KindNew, testRoom.Events(), "test", "test", "test", nil, false); err != nil {
+					t.Fatalf("failed to send events: %v", err)
+				}
+
+				roomID, _ := spec.NewRoomID(testRoom.ID)
+				summary, err := rsAPI.QueryRoomSummary(processCtx.Context(), bobDevice, *roomID, nil)
+				if tc.wantError {
+					if _, ok := err.(api.ErrRoomUnknownOrNotAllowed); !ok {
+						t.Fatalf("expected ErrRoomUnknownOrNotAllowed, got %v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, testRoom.ID, summary.RoomID)
+				assert.Equal(t, testRoom.Version, summary.RoomVersion)
+				assert.Equal(t, tc.wantMembership, summary.Membership)
+				assert.ElementsMatch(t, tc.wantAllowed, summary.AllowedRoomIDs)
+				assert.Equal(t, tc.wantName, summary.Name)
+				assert.Equal(t, tc.wantEncryption, summary.Encryption)
+				assert.Equal(t, 1, summary.JoinedMembersCount)
+			})
+		}
+
+		// Unknown rooms are fetched over federation, but never from ourselves
+		roomID, _ := spec.NewRoomID(test.NewRoom(t, alice).ID)
+		if _, err := rsAPI.QueryRoomSummary(processCtx.Context(), bobDevice, *roomID, []string{string(cfg.Global.ServerName)}); err == nil {
+			t.Fatalf("expected an error for an unknown room")
+		}
+	})
+}
+
 func TestUpgrade(t *testing.T) {
 	alice := test.NewUser(t)
 	bob := test.NewUser(t)
@@ -1319,3 +1459,116 @@ func TestRoomsWithACLs(t *testing.T) {
 		assert.Equal(t, []string{aclRoom.ID}, roomsWithACLs)
 	})
 }
+
+func TestRedactExpiredEvents(t *testing.T) {
+	alice := test.NewUser(t)
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		room := test.NewRoom(t, alice)
+		msg := room.CreateAndInsert(t, alice, "m.room.message", map[string]any{"body": "hello world"})
+		topic := room.CreateAndInsert(t, alice, spec.MRoomTopic, map[string]any{"topic": "testing"}, test.WithStateKey(""))
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		if err := rsAPI.PerformRedactExpiredEvents(ctx, room.ID, []string{msg.EventID(), topic.EventID()}); err != nil {
+			t.Fatalf("failed to redact expired events: %v", err)
+		}
+
+		res := &api.QueryEventsByIDResponse{}
+		if err := rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{
+			RoomID:   room.ID,
+			EventIDs: []string{msg.EventID(), topic.EventID()},
+		}, res); err != nil {
+			t.Fatalf("failed to query events: %v", err)
+		}
+		if len(res.Events) != 2 {
+			t.Fatalf("expected 2 events, got %d", len(res.Events))
+		}
+		for _, ev := range res.Events {
+			switch ev.EventID() {
+			case msg.EventID():
+				if gjson.GetBytes(ev.Content(), "body").Exists() {
+					t.Errorf("expected message to be redacted, got content %s", ev.Content())
+				}
+			case topic.EventID():
+				if gjson.GetBytes(ev.Content(), "topic").Str != "testing" {
+					t.Errorf("expected state event to be kept, got content %s", ev.Content())
+				}
+			}
+		}
+	})
+}
+
+// knockFederationAPI accepts knocks and leaves, recording the servers used.
+type knockFederationAPI struct {
+	fsAPI.RoomserverFederationAPI
+	t           *testing.T
+	room        *test.Room
+	user        *test.User
+	knockedVia  spec.ServerName
+	leaveServer []spec.ServerName
+}
+
+func (f *knockFederationAPI) PerformKnock(ctx context.Context, req *fsAPI.PerformKnockRequest, res *fsAPI.PerformKnockResponse) error {
+	res.Event = f.room.CreateEvent(f.t, f.user, spec.MRoomMember, map[string]interface{}{"membership": spec.Knock}, test.WithStateKey(f.user.ID))
+	res.KnockedVia = f.knockedVia
+	return nil
+}
+
+func (f *knockFederationAPI) PerformLeave(ctx context.Context, req *fsAPI.PerformLeaveRequest, res *fsAPI.PerformLeaveResponse) error {
+	f.leaveServer = req.ServerNames
+	res.Event = f.room.CreateEvent(f.t, f.user, spec.MRoomMember, map[string]interface{}{"membership": spec.Leave}, test.WithStateKey(f.user.ID))
+	return nil
+}
+
+func TestRescindKnockServers(t *testing.T) {
+	remote := test.NewUser(t, test.WithSigningServer("remote", "ed25519:remote", test.PrivateKeyB))
+	bob := test.NewUser(t)
+	bobID, err := spec.NewUserID(bob.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := &jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+
+		room := test.NewRoom(t, remote, test.RoomVersion(gomatrixserverlib.RoomVersionV10))
+		room.CreateAndInsert(t, remote, spec.MRoomJoinRules, map[string]interface{}{"join_rule": spec.Knock}, test.WithStateKey(""))
+		fedAPI := &knockFederationAPI{t: t, room: room, user: bob, knockedVia: "b"}
+		rsAPI.SetFederationAPI(fedAPI, nil)
+
+		if _, err = rsAPI.PerformKnock(ctx, &api.PerformKnockRequest{
+			RoomIDOrAlias: room.ID,
+			UserID:        *bobID,
+			ServerNames:   []spec.ServerName{"a", "b"},
+		}); err != nil {
+			t.Fatalf("failed to knock: %s", err)
+		}
+		if err = rsAPI.PerformLeave(ctx, &api.PerformLeaveRequest{
+			RoomID: room.ID,
+			Leaver: *bobID,
+		}, &api.PerformLeaveResponse{}); err != nil {
+			t.Fatalf("failed to rescind knock: %s", err)
+		}
+
+		// The server which accepted the knock is tried first, then the others.
+		assert.Equal(t, []spec.ServerName{"b", "a", "remote"}, fedAPI.leaveServer)
+	})
+}
@@ -150,6 +150,14 @@ type Database interface {
 	GetPublishedRooms(ctx context.Context, networkID string, includeAllNetworks bool) ([]string, error)
 	// Returns whether a given room is published or not.
 	GetPublishedRoom(ctx context.Context, roomID string) (bool, error)
+	// StoreKnockServers remembers the servers that a knock on a room this server
+	// isn't joined to was made through.
+	StoreKnockServers(ctx context.Context, roomID, userID string, serverNames []spec.ServerName) error
+	// GetKnockServers returns the servers that a knock was made through, or nil
+	// if they aren't known.
+	GetKnockServers(ctx context.Context, roomID, userID string) ([]spec.ServerName, error)
+	// DeleteKnockServers forgets the servers that a knock was made through.
+	DeleteKnockServers(ctx context.Context, roomID, userID string) error
 
 	// TODO: factor out - from currentstateserver
 
@@ -177,6 +185,9 @@ type Database interface {
 	GetHistoryVisibilityState(ctx context.Context, roomInfo *types.RoomInfo, eventID string, domain string) ([]gomatrixserverlib.PDU, error)
 	GetLeftUsers(ctx context.Context, userIDs []string) ([]string, error)
 	PurgeRoom(ctx context.Context, roomID string) error
+	// RedactExpiredEvents replaces the given events in the room with their redacted form, as they
+	// have expired under the room's retention policy. State events are never redacted.
+	RedactExpiredEvents(ctx context.Context, roomID string, eventIDs []string) error
 	UpgradeRoom(ctx context.Context, oldRoomID, newRoomID, eventSender string) error
 
 	// GetMembershipForHistoryVisibility queries the membership events for the given eventIDs.
@@ -0,0 +1,104 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/postgres/deltas"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+)
+
+// The roomserver_knock_servers table is created by the deltas.UpKnockServers
+// migration. It stores, for knocks on rooms this server isn't joined to, the
+// servers that the knock was made through as a JSON array, so that the knock
+// can be rescinded through the same servers.
+
+const upsertKnockServersSQL = "" +
+	"INSERT INTO roomserver_knock_servers (room_id, user_id, server_names) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (room_id, user_id) DO UPDATE SET server_names = $3"
+
+const selectKnockServersSQL = "" +
+	"SELECT server_names FROM roomserver_knock_servers WHERE room_id = $1 AND user_id = $2"
+
+const deleteKnockServersSQL = "" +
+	"DELETE FROM roomserver_knock_servers WHERE room_id = $1 AND user_id = $2"
+
+type knockServersStatements struct {
+	upsertKnockServersStmt *sql.Stmt
+	selectKnockServersStmt *sql.Stmt
+	deleteKnockServersStmt *sql.Stmt
+}
+
+func CreateKnockServersTable(db *sql.DB) error {
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "roomserver: add knock servers table",
+		Up:      deltas.UpKnockServers,
+	})
+	return m.Up(context.Background())
+}
+
+func PrepareKnockServersTable(db *sql.DB) (tables.KnockServers, error) {
+	s := &knockServersStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertKnockServersStmt, upsertKnockServersSQL},
+		{&s.selectKnockServersStmt, selectKnockServersSQL},
+		{&s.deleteKnockServersStmt, deleteKnockServersSQL},
+	}.Prepare(db)
+}
+
+func (s *knockServersStatements) UpsertKnockServers(
+	ctx context.Context, txn *sql.Tx, roomID, userID string, serverNames []spec.ServerName,
+) error {
+	serverNamesJSON, err := json.Marshal(serverNames)
+	if err != nil {
+		return err
+	}
+	stmt := sqlutil.TxStmt(txn, s.upsertKnockServersStmt)
+	_, err = stmt.ExecContext(ctx, roomID, userID, string(serverNamesJSON))
+	return err
+}
+
+func (s *knockServersStatements) SelectKnockServers(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) ([]spec.ServerName, error) {
+	var serverNamesJSON string
+	stmt := sqlutil.TxStmt(txn, s.selectKnockServersStmt)
+	err := stmt.QueryRowContext(ctx, roomID, userID).Scan(&serverNamesJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var serverNames []spec.ServerName
+	err = json.Unmarshal([]byte(serverNamesJSON), &serverNames)
+	return serverNames, err
+}
+
+func (s *knockServersStatements) DeleteKnockServers(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteKnockServersStmt)
+	_, err := stmt.ExecContext(ctx, roomID, userID)
+	return err
+}
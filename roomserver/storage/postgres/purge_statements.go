@@ -46,6 +46,9 @@ const purgePreviousEventsSQL = "" +
 const purgePreviousEvents2SQL = "" +
 	"DELETE FROM roomserver_previous_events rpe WHERE EXISTS(SELECT event_id FROM roomserver_events re WHERE room_nid = $1 AND re.event_id = rpe.previous_event_id)"
 
+const purgeKnockServersSQL = "" +
+	"DELETE FROM roomserver_knock_servers WHERE room_id = $1"
+
 const purgePublishedSQL = "" +
 	"DELETE FROM roomserver_published WHERE room_id = $1"
 
@@ -72,6 +75,7 @@ type purgeStatements struct {
 	purgeEventJSONStmt            *sql.Stmt
 	purgeEventsStmt               *sql.Stmt
 	purgeInvitesStmt              *sql.Stmt
+	purgeKnockServersStmt         *sql.Stmt
 	purgeMembershipsStmt          *sql.Stmt
 	purgePreviousEventsStmt       *sql.Stmt
 	purgePreviousEvents2Stmt      *sql.Stmt
@@ -90,6 +94,7 @@ func PreparePurgeStatements(db *sql.DB) (*purgeStatements, error) {
 		{&s.purgeEventJSONStmt, purgeEventJSONSQL},
 		{&s.purgeEventsStmt, purgeEventsSQL},
 		{&s.purgeInvitesStmt, purgeInvitesSQL},
+		{&s.purgeKnockServersStmt, purgeKnockServersSQL},
 		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
 		{&s.purgePublishedStmt, purgePublishedSQL},
 		{&s.purgePreviousEventsStmt, purgePreviousEventsSQL},
@@ -110,6 +115,7 @@ func (s *purgeStatements) PurgeRoom(
 	purgeByRoomID := []*sql.Stmt{
 		s.purgeRoomAliasesStmt,
 		s.purgePublishedStmt,
+		s.purgeKnockServersStmt,
 	}
 	for _, stmt := range purgeByRoomID {
 		_, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomID)
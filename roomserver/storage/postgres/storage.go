@@ -137,6 +137,9 @@ func (d *Database) create(db *sql.DB) error {
 	if err := CreateReportedEventsTable(db); err != nil {
 		return err
 	}
+	if err := CreateKnockServersTable(db); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -206,6 +209,10 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 	if err != nil {
 		return err
 	}
+	knockServers, err := PrepareKnockServersTable(db)
+	if err != nil {
+		return err
+	}
 
 	d.Database = shared.Database{
 		DB: db,
@@ -232,6 +239,7 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 		PublishedTable:     published,
 		Purge:              purge,
 		UserRoomKeyTable:   userRoomKeys,
+		KnockServersTable:  knockServers,
 	}
 	return nil
 }
@@ -0,0 +1,122 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const eventJSONSchema = `
+-- Stores the JSON for each event. This kept separate from the main events
+-- table to keep the rows in the main events table small.
+CREATE TABLE IF NOT EXISTS roomserver_event_json (
+    -- Local numeric ID for the event.
+    event_nid int64 NOT NULL,
+    -- The JSON for the event.
+    -- Stored as string because this should be valid UTF-8.
+    -- TODO: Should we be compressing the events with Snappy or DEFLATE?
+    event_json blob NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_event_json_event_nid_idx ON roomserver_event_json(event_nid);
+`
+
+const insertEventJSONSQL = "" +
+	"INSERT INTO roomserver_event_json (event_nid, event_json) VALUES ($1, $2)"
+
+const updateEventJSONSQL = "" +
+	"UPDATE roomserver_event_json SET event_json = $2 WHERE event_nid = $1"
+
+// Bulk event JSON lookup by numeric event ID.
+// The results are sorted by the numeric event ID after querying, since the
+// lookup may be split across several queries.
+// This means that we can use binary search to lookup by numeric event ID.
+const bulkSelectEventJSONSQL = "" +
+	"SELECT event_nid, event_json FROM roomserver_event_json" +
+	" WHERE event_nid IN ($1)"
+
+type eventJSONStatements struct {
+	db                  *sql.DB
+	insertEventJSONStmt *sql.Stmt
+	updateEventJSONStmt *sql.Stmt
+	// bulkSelectEventJSONStmt *sql.Stmt - prepared at runtime due to variadic
+}
+
+func CreateEventJSONTable(db *sql.DB) error {
+	_, err := db.Exec(eventJSONSchema)
+	return err
+}
+
+func PrepareEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
+	s := &eventJSONStatements{
+		db: db,
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertEventJSONStmt, insertEventJSONSQL},
+		{&s.updateEventJSONStmt, updateEventJSONSQL},
+	}.Prepare(db)
+}
+
+func (s *eventJSONStatements) InsertEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
+) error {
+	res, err := sqlutil.TxStmt(txn, s.updateEventJSONStmt).ExecContext(ctx, int64(eventNID), eventJSON)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertEventJSONStmt).ExecContext(ctx, int64(eventNID), eventJSON)
+	return err
+}
+
+func (s *eventJSONStatements) BulkSelectEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) ([]tables.EventJSONPair, error) {
+	// We know that we will only get as many results as event NIDs
+	// because of the unique constraint on event NIDs.
+	results := make([]tables.EventJSONPair, 0, len(eventNIDs))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectEventJSONSQL, queryProvider(s.db, txn), eventNIDsAsArray(eventNIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var eventNID int64
+			for rows.Next() {
+				var result tables.EventJSONPair
+				if err := rows.Scan(&eventNID, &result.EventJSON); err != nil {
+					return err
+				}
+				result.EventNID = types.EventNID(eventNID)
+				results = append(results, result)
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].EventNID < results[j].EventNID
+	})
+	return results, nil
+}
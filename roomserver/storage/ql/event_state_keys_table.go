@@ -0,0 +1,179 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const eventStateKeysSchema = `
+-- Numeric versions of the event "state_key"s. State keys tend to be reused so
+-- assigning each string a numeric ID should reduce the amount of data that
+-- needs to be stored and fetched from the database.
+-- It also means that many operations can work with int64 arrays rather than
+-- string arrays which may help reduce GC pressure.
+-- Well known state keys are pre-assigned numeric IDs:
+--   1 -> "" (the empty string)
+-- Other state keys are automatically assigned numeric IDs starting from 2**16.
+-- This leaves room to add more pre-assigned numeric IDs and clearly separates
+-- the automatically assigned IDs from the pre-assigned IDs.
+CREATE TABLE IF NOT EXISTS roomserver_event_state_keys (
+    -- Local numeric ID for the state key.
+    event_state_key_nid int64 NOT NULL,
+    event_state_key string NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_event_state_keys_event_state_key_nid_idx ON roomserver_event_state_keys(event_state_key_nid);
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_event_state_keys_event_state_key_idx ON roomserver_event_state_keys(event_state_key);
+`
+
+const insertWellKnownEventStateKeysSQL = "" +
+	"INSERT INTO roomserver_event_state_keys (event_state_key_nid, event_state_key) VALUES (1, \"\")"
+
+// Same as insertEventTypeNIDSQL
+const insertEventStateKeyNIDSQL = "" +
+	"INSERT INTO roomserver_event_state_keys (event_state_key_nid, event_state_key) VALUES ($1, $2)"
+
+const selectEventStateKeyNIDSQL = "" +
+	"SELECT event_state_key_nid FROM roomserver_event_state_keys" +
+	" WHERE event_state_key = $1"
+
+// Bulk lookup from string state key to numeric ID for that state key.
+// The "($1)" placeholder is expanded at runtime.
+const bulkSelectEventStateKeyNIDSQL = "" +
+	"SELECT event_state_key, event_state_key_nid FROM roomserver_event_state_keys" +
+	" WHERE event_state_key IN ($1)"
+
+// Bulk lookup from numeric ID to string state key for that state key.
+// The "($1)" placeholder is expanded at runtime.
+const bulkSelectEventStateKeySQL = "" +
+	"SELECT event_state_key, event_state_key_nid FROM roomserver_event_state_keys" +
+	" WHERE event_state_key_nid IN ($1)"
+
+type eventStateKeyStatements struct {
+	db                         *sql.DB
+	eventStateKeyNIDs          *nidSequence
+	insertEventStateKeyNIDStmt *sql.Stmt
+	selectEventStateKeyNIDStmt *sql.Stmt
+	// bulkSelectEventStateKeyNIDStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectEventStateKeyStmt *sql.Stmt - prepared at runtime due to variadic
+}
+
+func CreateEventStateKeysTable(db *sql.DB) error {
+	if _, err := db.Exec(eventStateKeysSchema); err != nil {
+		return err
+	}
+	_, err := db.Exec(insertWellKnownEventStateKeysSQL)
+	if err != nil && !sqlutil.IsQLUniqueConstraintViolation(err) {
+		return err
+	}
+	return createSequence(db, "roomserver_event_state_keys", 65535)
+}
+
+func PrepareEventStateKeysTable(db *sql.DB) (tables.EventStateKeys, error) {
+	eventStateKeyNIDs, err := prepareSequence(db, "roomserver_event_state_keys")
+	if err != nil {
+		return nil, err
+	}
+	s := &eventStateKeyStatements{
+		db:                db,
+		eventStateKeyNIDs: eventStateKeyNIDs,
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertEventStateKeyNIDStmt, insertEventStateKeyNIDSQL},
+		{&s.selectEventStateKeyNIDStmt, selectEventStateKeyNIDSQL},
+	}.Prepare(db)
+}
+
+func (s *eventStateKeyStatements) InsertEventStateKeyNID(
+	ctx context.Context, txn *sql.Tx, eventStateKey string,
+) (types.EventStateKeyNID, error) {
+	eventStateKeyNID, err := s.eventStateKeyNIDs.next(ctx, txn)
+	if err != nil {
+		return 0, err
+	}
+	stmt := sqlutil.TxStmt(txn, s.insertEventStateKeyNIDStmt)
+	_, err = stmt.ExecContext(ctx, eventStateKeyNID, eventStateKey)
+	if sqlutil.IsQLUniqueConstraintViolation(err) {
+		return 0, sql.ErrNoRows
+	}
+	return types.EventStateKeyNID(eventStateKeyNID), err
+}
+
+func (s *eventStateKeyStatements) SelectEventStateKeyNID(
+	ctx context.Context, txn *sql.Tx, eventStateKey string,
+) (types.EventStateKeyNID, error) {
+	var eventStateKeyNID int64
+	stmt := sqlutil.TxStmt(txn, s.selectEventStateKeyNIDStmt)
+	err := stmt.QueryRowContext(ctx, eventStateKey).Scan(&eventStateKeyNID)
+	return types.EventStateKeyNID(eventStateKeyNID), err
+}
+
+func (s *eventStateKeyStatements) BulkSelectEventStateKeyNID(
+	ctx context.Context, txn *sql.Tx, eventStateKeys []string,
+) (map[string]types.EventStateKeyNID, error) {
+	params := make([]interface{}, len(eventStateKeys))
+	for i := range eventStateKeys {
+		params[i] = eventStateKeys[i]
+	}
+	result := make(map[string]types.EventStateKeyNID, len(eventStateKeys))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectEventStateKeyNIDSQL, queryProvider(s.db, txn), params, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var stateKey string
+			var stateKeyNID int64
+			for rows.Next() {
+				if err := rows.Scan(&stateKey, &stateKeyNID); err != nil {
+					return err
+				}
+				result[stateKey] = types.EventStateKeyNID(stateKeyNID)
+			}
+			return rows.Err()
+		},
+	)
+	return result, err
+}
+
+func (s *eventStateKeyStatements) BulkSelectEventStateKey(
+	ctx context.Context, txn *sql.Tx, eventStateKeyNIDs []types.EventStateKeyNID,
+) (map[types.EventStateKeyNID]string, error) {
+	params := make([]interface{}, len(eventStateKeyNIDs))
+	for i := range eventStateKeyNIDs {
+		params[i] = int64(eventStateKeyNIDs[i])
+	}
+	result := make(map[types.EventStateKeyNID]string, len(eventStateKeyNIDs))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectEventStateKeySQL, queryProvider(s.db, txn), params, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var stateKey string
+			var stateKeyNID int64
+			for rows.Next() {
+				if err := rows.Scan(&stateKey, &stateKeyNID); err != nil {
+					return err
+				}
+				result[types.EventStateKeyNID(stateKeyNID)] = stateKey
+			}
+			return rows.Err()
+		},
+	)
+	return result, err
+}
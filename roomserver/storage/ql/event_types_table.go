@@ -0,0 +1,172 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const eventTypesSchema = `
+-- Numeric versions of the event "type"s. Event types tend to be taken from a
+-- small internal pool. Assigning each a numeric ID should reduce the amount of
+-- data that needs to be stored and fetched from the database.
+-- It also means that many operations can work with int64 arrays rather than
+-- string arrays which may help reduce GC pressure.
+-- Well known event types are pre-assigned numeric IDs:
+--   1 -> m.room.create
+--   2 -> m.room.power_levels
+--   3 -> m.room.join_rules
+--   4 -> m.room.third_party_invite
+--   5 -> m.room.member
+--   6 -> m.room.redaction
+--   7 -> m.room.history_visibility
+-- Picking well-known numeric IDs for the events types that require special
+-- attention during state conflict resolution means that we write that code
+-- using numeric constants.
+-- It also means that the numeric IDs for internal event types should be
+-- consistent between different instances which might make ad-hoc debugging
+-- easier.
+-- Other event types are automatically assigned numeric IDs starting from 2**16.
+-- This leaves room to add more pre-assigned numeric IDs and clearly separates
+-- the automatically assigned IDs from the pre-assigned IDs.
+CREATE TABLE IF NOT EXISTS roomserver_event_types (
+    -- Local numeric ID for the event type.
+    event_type_nid int64 NOT NULL,
+    -- The string event_type.
+    event_type string NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_event_types_event_type_nid_idx ON roomserver_event_types(event_type_nid);
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_event_types_event_type_idx ON roomserver_event_types(event_type);
+`
+
+const insertWellKnownEventTypesSQL = "" +
+	"INSERT INTO roomserver_event_types (event_type_nid, event_type) VALUES" +
+	" (1, \"m.room.create\")," +
+	" (2, \"m.room.power_levels\")," +
+	" (3, \"m.room.join_rules\")," +
+	" (4, \"m.room.third_party_invite\")," +
+	" (5, \"m.room.member\")," +
+	" (6, \"m.room.redaction\")," +
+	" (7, \"m.room.history_visibility\")"
+
+// Assign a new numeric event type ID.
+// The usual case is that the event type is not in the database.
+// In that case the ID will be assigned from the sequence.
+// But it's possible that the type was added in a query that raced with us.
+// This will result in a conflict on the unique event_type index, in this
+// case we return sql.ErrNoRows and rely on the caller catching it and
+// running a select to get the row.
+const insertEventTypeNIDSQL = "" +
+	"INSERT INTO roomserver_event_types (event_type_nid, event_type) VALUES ($1, $2)"
+
+const selectEventTypeNIDSQL = "" +
+	"SELECT event_type_nid FROM roomserver_event_types WHERE event_type = $1"
+
+// Bulk lookup from string event type to numeric ID for that event type.
+// The "($1)" placeholder is expanded at runtime.
+const bulkSelectEventTypeNIDSQL = "" +
+	"SELECT event_type, event_type_nid FROM roomserver_event_types" +
+	" WHERE event_type IN ($1)"
+
+type eventTypeStatements struct {
+	db                     *sql.DB
+	eventTypeNIDs          *nidSequence
+	insertEventTypeNIDStmt *sql.Stmt
+	selectEventTypeNIDStmt *sql.Stmt
+	// bulkSelectEventTypeNIDStmt *sql.Stmt - prepared at runtime due to variadic
+}
+
+func CreateEventTypesTable(db *sql.DB) error {
+	if _, err := db.Exec(eventTypesSchema); err != nil {
+		return err
+	}
+	_, err := db.Exec(insertWellKnownEventTypesSQL)
+	if err != nil && !sqlutil.IsQLUniqueConstraintViolation(err) {
+		return err
+	}
+	return createSequence(db, "roomserver_event_types", 65535)
+}
+
+func PrepareEventTypesTable(db *sql.DB) (tables.EventTypes, error) {
+	eventTypeNIDs, err := prepareSequence(db, "roomserver_event_types")
+	if err != nil {
+		return nil, err
+	}
+	s := &eventTypeStatements{
+		db:            db,
+		eventTypeNIDs: eventTypeNIDs,
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertEventTypeNIDStmt, insertEventTypeNIDSQL},
+		{&s.selectEventTypeNIDStmt, selectEventTypeNIDSQL},
+	}.Prepare(db)
+}
+
+func (s *eventTypeStatements) InsertEventTypeNID(
+	ctx context.Context, txn *sql.Tx, eventType string,
+) (types.EventTypeNID, error) {
+	eventTypeNID, err := s.eventTypeNIDs.next(ctx, txn)
+	if err != nil {
+		return 0, err
+	}
+	stmt := sqlutil.TxStmt(txn, s.insertEventTypeNIDStmt)
+	_, err = stmt.ExecContext(ctx, eventTypeNID, eventType)
+	if sqlutil.IsQLUniqueConstraintViolation(err) {
+		return 0, sql.ErrNoRows
+	}
+	return types.EventTypeNID(eventTypeNID), err
+}
+
+func (s *eventTypeStatements) SelectEventTypeNID(
+	ctx context.Context, txn *sql.Tx, eventType string,
+) (types.EventTypeNID, error) {
+	var eventTypeNID int64
+	stmt := sqlutil.TxStmt(txn, s.selectEventTypeNIDStmt)
+	err := stmt.QueryRowContext(ctx, eventType).Scan(&eventTypeNID)
+	return types.EventTypeNID(eventTypeNID), err
+}
+
+func (s *eventTypeStatements) BulkSelectEventTypeNID(
+	ctx context.Context, txn *sql.Tx, eventTypes []string,
+) (map[string]types.EventTypeNID, error) {
+	params := make([]interface{}, len(eventTypes))
+	for i := range eventTypes {
+		params[i] = eventTypes[i]
+	}
+	result := make(map[string]types.EventTypeNID, len(eventTypes))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectEventTypeNIDSQL, queryProvider(s.db, txn), params, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var eventType string
+			var eventTypeNID int64
+			for rows.Next() {
+				if err := rows.Scan(&eventType, &eventTypeNID); err != nil {
+					return err
+				}
+				result[eventType] = types.EventTypeNID(eventTypeNID)
+			}
+			return rows.Err()
+		},
+	)
+	return result, err
+}
@@ -0,0 +1,670 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const eventsSchema = `
+-- The events table holds metadata for each event, the actual JSON is stored
+-- separately to keep the size of the rows small.
+CREATE TABLE IF NOT EXISTS roomserver_events (
+    -- Local numeric ID for the event.
+    event_nid int64 NOT NULL,
+    -- Local numeric ID for the room the event is in.
+    -- This is never 0.
+    room_nid int64 NOT NULL,
+    -- Local numeric ID for the type of the event.
+    -- This is never 0.
+    event_type_nid int64 NOT NULL,
+    -- Local numeric ID for the state_key of the event
+    -- This is 0 if the event is not a state event.
+    event_state_key_nid int64 NOT NULL,
+    -- Whether the event has been written to the output log.
+    sent_to_output bool NOT NULL DEFAULT false,
+    -- Local numeric ID for the state at the event.
+    -- This is 0 if we don't know the state at the event.
+    -- If the state is not 0 then this event is part of the contiguous
+    -- part of the event graph
+    -- Since many different events can have the same state we store the
+    -- state into a separate state table and refer to it by numeric ID.
+    state_snapshot_nid int64 NOT NULL DEFAULT 0,
+    -- Depth of the event in the event graph.
+    depth int64 NOT NULL,
+    -- The textual event id.
+    -- Used to lookup the numeric ID when processing requests.
+    -- Needed for state resolution.
+    -- An event may only appear in this table once.
+    event_id string NOT NULL,
+    -- A JSON list of numeric IDs for events that can authenticate this event.
+	auth_event_nids string NOT NULL DEFAULT "[]",
+	is_rejected bool NOT NULL DEFAULT false
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_events_event_nid_idx ON roomserver_events (event_nid);
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_events_event_id_idx ON roomserver_events (event_id);
+
+-- Create an index which helps in resolving membership events (used for history visibility)
+CREATE INDEX IF NOT EXISTS roomserver_events_memberships_idx ON roomserver_events (room_nid, event_state_key_nid);
+
+-- The following indexes are used by bulkSelectStateEventByNIDSQL 
+CREATE INDEX IF NOT EXISTS roomserver_event_event_type_nid_idx ON roomserver_events (event_type_nid);
+CREATE INDEX IF NOT EXISTS roomserver_event_state_key_nid_idx ON roomserver_events (event_state_key_nid);
+`
+
+const insertEventSQL = "" +
+	"INSERT INTO roomserver_events (event_nid, room_nid, event_type_nid, event_state_key_nid, event_id, auth_event_nids, depth, is_rejected)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+
+const selectEventForInsertSQL = "" +
+	"SELECT event_nid, state_snapshot_nid, is_rejected FROM roomserver_events WHERE event_id = $1"
+
+const updateEventRejectedSQL = "" +
+	"UPDATE roomserver_events SET is_rejected = $1 WHERE event_nid = $2"
+
+const selectEventSQL = "" +
+	"SELECT event_nid, state_snapshot_nid FROM roomserver_events WHERE event_id = $1"
+
+const bulkSelectSnapshotsForEventIDsSQL = "" +
+	"SELECT event_id, state_snapshot_nid FROM roomserver_events WHERE event_id IN ($1)"
+
+// Bulk lookup of events by string ID.
+// The results are sorted by the numeric IDs for event type and state key
+// after querying. This means we can use binary search to lookup entries by
+// type and state key.
+const bulkSelectStateEventByIDSQL = "" +
+	"SELECT event_type_nid, event_state_key_nid, event_nid FROM roomserver_events" +
+	" WHERE event_id IN ($1)"
+
+// Bulk lookup of events by string ID that aren't excluded.
+// The results are sorted by the numeric IDs for event type and state key
+// after querying. This means we can use binary search to lookup entries by
+// type and state key.
+const bulkSelectStateEventByIDExcludingRejectedSQL = "" +
+	"SELECT event_type_nid, event_state_key_nid, event_nid FROM roomserver_events" +
+	" WHERE is_rejected = false AND event_id IN ($1)"
+
+// Bulk look up of events by event NID, optionally filtering by the event type
+// or event state key NIDs if provided. The filters are appended at runtime.
+const bulkSelectStateEventByNIDSQL = "" +
+	"SELECT event_type_nid, event_state_key_nid, event_nid FROM roomserver_events" +
+	" WHERE event_nid IN ($1)"
+
+const bulkSelectStateAtEventByIDSQL = "" +
+	"SELECT event_type_nid, event_state_key_nid, event_nid, state_snapshot_nid, is_rejected FROM roomserver_events" +
+	" WHERE event_id IN ($1)"
+
+const updateEventStateSQL = "" +
+	"UPDATE roomserver_events SET state_snapshot_nid = $1 WHERE event_nid = $2"
+
+const selectEventSentToOutputSQL = "" +
+	"SELECT sent_to_output FROM roomserver_events WHERE event_nid = $1"
+
+const updateEventSentToOutputSQL = "" +
+	"UPDATE roomserver_events SET sent_to_output = true WHERE event_nid = $1"
+
+const selectEventIDSQL = "" +
+	"SELECT event_id FROM roomserver_events WHERE event_nid = $1"
+
+const bulkSelectStateAtEventAndReferenceSQL = "" +
+	"SELECT event_type_nid, event_state_key_nid, event_nid, state_snapshot_nid, event_id" +
+	" FROM roomserver_events WHERE event_nid IN ($1) ORDER BY event_nid ASC"
+
+const bulkSelectEventIDSQL = "" +
+	"SELECT event_nid, event_id FROM roomserver_events WHERE event_nid IN ($1)"
+
+const bulkSelectEventNIDSQL = "" +
+	"SELECT event_id, event_nid, room_nid FROM roomserver_events WHERE event_id IN ($1)"
+
+const bulkSelectUnsentEventNIDSQL = "" +
+	"SELECT event_id, event_nid, room_nid FROM roomserver_events WHERE sent_to_output = false AND event_id IN ($1)"
+
+const selectMaxEventDepthSQL = "" +
+	"SELECT coalesce(max(depth) + 1, 0) FROM roomserver_events WHERE event_nid IN ($1)"
+
+const selectRoomNIDsForEventNIDsSQL = "" +
+	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_nid IN ($1)"
+
+const selectEventRejectedSQL = "" +
+	"SELECT is_rejected FROM roomserver_events WHERE room_nid = $1 AND event_id = $2"
+
+const selectRoomsWithEventTypeNIDSQL = `SELECT DISTINCT room_nid FROM roomserver_events WHERE event_type_nid = $1`
+
+type eventStatements struct {
+	db                              *sql.DB
+	eventNIDs                       *nidSequence
+	insertEventStmt                 *sql.Stmt
+	selectEventForInsertStmt        *sql.Stmt
+	updateEventRejectedStmt         *sql.Stmt
+	selectEventStmt                 *sql.Stmt
+	updateEventStateStmt            *sql.Stmt
+	selectEventSentToOutputStmt     *sql.Stmt
+	updateEventSentToOutputStmt     *sql.Stmt
+	selectEventIDStmt               *sql.Stmt
+	selectEventRejectedStmt         *sql.Stmt
+	selectRoomsWithEventTypeNIDStmt *sql.Stmt
+	// bulkSelectSnapshotsForEventIDsStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectStateEventByIDStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectStateEventByIDExcludingRejectedStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectStateEventByNIDStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectStateAtEventByIDStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectStateAtEventAndReferenceStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectEventIDStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectEventNIDStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectUnsentEventNIDStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectMaxEventDepthStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectRoomNIDsForEventNIDsStmt *sql.Stmt - prepared at runtime due to variadic
+}
+
+func CreateEventsTable(db *sql.DB) error {
+	if _, err := db.Exec(eventsSchema); err != nil {
+		return err
+	}
+	return createSequence(db, "roomserver_events", 0)
+}
+
+func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
+	eventNIDs, err := prepareSequence(db, "roomserver_events")
+	if err != nil {
+		return nil, err
+	}
+	s := &eventStatements{
+		db:        db,
+		eventNIDs: eventNIDs,
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertEventStmt, insertEventSQL},
+		{&s.selectEventForInsertStmt, selectEventForInsertSQL},
+		{&s.updateEventRejectedStmt, updateEventRejectedSQL},
+		{&s.selectEventStmt, selectEventSQL},
+		{&s.updateEventStateStmt, updateEventStateSQL},
+		{&s.updateEventSentToOutputStmt, updateEventSentToOutputSQL},
+		{&s.selectEventSentToOutputStmt, selectEventSentToOutputSQL},
+		{&s.selectEventIDStmt, selectEventIDSQL},
+		{&s.selectEventRejectedStmt, selectEventRejectedSQL},
+		{&s.selectRoomsWithEventTypeNIDStmt, selectRoomsWithEventTypeNIDSQL},
+	}.Prepare(db)
+}
+
+func (s *eventStatements) InsertEvent(
+	ctx context.Context,
+	txn *sql.Tx,
+	roomNID types.RoomNID,
+	eventTypeNID types.EventTypeNID,
+	eventStateKeyNID types.EventStateKeyNID,
+	eventID string,
+	authEventNIDs []types.EventNID,
+	depth int64,
+	isRejected bool,
+) (types.EventNID, types.StateSnapshotNID, error) {
+	authEventNIDsJSON, err := json.Marshal(eventNIDsAsInt64s(authEventNIDs))
+	if err != nil {
+		return 0, 0, fmt.Errorf("json.Marshal: %w", err)
+	}
+	// If the event already exists then we only update it if it was previously
+	// rejected, otherwise we return sql.ErrNoRows so that the caller looks up
+	// the existing event instead.
+	var eventNID int64
+	var stateNID int64
+	var wasRejected bool
+	err = sqlutil.TxStmt(txn, s.selectEventForInsertStmt).QueryRowContext(ctx, eventID).Scan(&eventNID, &stateNID, &wasRejected)
+	switch {
+	case err == nil && !wasRejected:
+		return 0, 0, sql.ErrNoRows
+	case err == nil:
+		_, err = sqlutil.TxStmt(txn, s.updateEventRejectedStmt).ExecContext(ctx, isRejected, eventNID)
+		return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
+	case err != sql.ErrNoRows:
+		return 0, 0, err
+	}
+	if eventNID, err = s.eventNIDs.next(ctx, txn); err != nil {
+		return 0, 0, err
+	}
+	stmt := sqlutil.TxStmt(txn, s.insertEventStmt)
+	_, err = stmt.ExecContext(
+		ctx, eventNID, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
+		eventID, string(authEventNIDsJSON), depth,
+		isRejected,
+	)
+	return types.EventNID(eventNID), 0, err
+}
+
+func (s *eventStatements) SelectEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) (types.EventNID, types.StateSnapshotNID, error) {
+	var eventNID int64
+	var stateNID int64
+	stmt := sqlutil.TxStmt(txn, s.selectEventStmt)
+	err := stmt.QueryRowContext(ctx, eventID).Scan(&eventNID, &stateNID)
+	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
+}
+
+func (s *eventStatements) BulkSelectSnapshotsFromEventIDs(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) (map[types.StateSnapshotNID][]string, error) {
+	result := make(map[types.StateSnapshotNID][]string)
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectSnapshotsForEventIDsSQL, queryProvider(s.db, txn), stringsAsParams(eventIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var eventID string
+			var stateNID types.StateSnapshotNID
+			for rows.Next() {
+				if err := rows.Scan(&eventID, &stateNID); err != nil {
+					return err
+				}
+				result[stateNID] = append(result[stateNID], eventID)
+			}
+			return rows.Err()
+		},
+	)
+	return result, err
+}
+
+// bulkSelectStateEventByID lookups a list of state events by event ID.
+// If not excluding rejected events, and any of the requested events are missing from
+// the database it returns a types.MissingEventError. If excluding rejected events,
+// the events will be silently omitted without error.
+func (s *eventStatements) BulkSelectStateEventByID(
+	ctx context.Context, txn *sql.Tx, eventIDs []string, excludeRejected bool,
+) ([]types.StateEntry, error) {
+	query := bulkSelectStateEventByIDSQL
+	if excludeRejected {
+		query = bulkSelectStateEventByIDExcludingRejectedSQL
+	}
+	// We know that we will only get as many results as event IDs
+	// because of the unique constraint on event IDs.
+	results := make([]types.StateEntry, 0, len(eventIDs))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, query, queryProvider(s.db, txn), stringsAsParams(eventIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			for rows.Next() {
+				var result types.StateEntry
+				if err := rows.Scan(
+					&result.EventTypeNID,
+					&result.EventStateKeyNID,
+					&result.EventNID,
+				); err != nil {
+					return err
+				}
+				results = append(results, result)
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !excludeRejected && len(results) != len(eventIDs) {
+		// If there are fewer rows returned than IDs then we were asked to lookup event IDs we don't have.
+		// We don't know which ones were missing because we don't return the string IDs in the query.
+		// However it should be possible debug this by replaying queries or entries from the input kafka logs.
+		// If this turns out to be impossible and we do need the debug information here, it would be better
+		// to do it as a separate query rather than slowing down/complicating the internal case.
+		return nil, types.MissingEventError(
+			fmt.Sprintf("storage: state event IDs missing from the database (%d != %d)", len(results), len(eventIDs)),
+		)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].StateKeyTuple.LessThan(results[j].StateKeyTuple)
+	})
+	return results, nil
+}
+
+// bulkSelectStateEventByNID lookups a list of state events by event NID.
+// If any of the requested events are missing from the database it returns a types.MissingEventError
+func (s *eventStatements) BulkSelectStateEventByNID(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+	stateKeyTuples []types.StateKeyTuple,
+) ([]types.StateEntry, error) {
+	if len(eventNIDs) == 0 {
+		return nil, nil
+	}
+	tuples := types.StateKeyTupleSorter(stateKeyTuples)
+	sort.Sort(tuples)
+	eventTypeNIDArray, eventStateKeyNIDArray := tuples.TypesAndStateKeysAsArrays()
+	params := eventNIDsAsArray(eventNIDs)
+	query := strings.Replace(bulkSelectStateEventByNIDSQL, "($1)", sqlutil.QueryVariadic(len(params)), 1)
+	if len(eventTypeNIDArray) > 0 {
+		query += " AND event_type_nid IN " + sqlutil.QueryVariadicOffset(len(eventTypeNIDArray), len(params))
+		for _, v := range eventTypeNIDArray {
+			params = append(params, v)
+		}
+	}
+	if len(eventStateKeyNIDArray) > 0 {
+		query += " AND event_state_key_nid IN " + sqlutil.QueryVariadicOffset(len(eventStateKeyNIDArray), len(params))
+		for _, v := range eventStateKeyNIDArray {
+			params = append(params, v)
+		}
+	}
+	query += " ORDER BY event_type_nid, event_state_key_nid ASC"
+	selectStmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("s.db.Prepare: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, selectStmt, "bulkSelectStateEventByNID: selectStmt.close() failed")
+	rows, err := sqlutil.TxStmt(txn, selectStmt).QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectStateEventByID: rows.close() failed")
+	// We know that we will only get as many results as event IDs
+	// because of the unique constraint on event IDs.
+	// So we can allocate an array of the correct size now.
+	// We might get fewer results than IDs so we adjust the length of the slice before returning it.
+	results := make([]types.StateEntry, len(eventNIDs))
+	i := 0
+	for ; rows.Next(); i++ {
+		result := &results[i]
+		if err = rows.Scan(
+			&result.EventTypeNID,
+			&result.EventStateKeyNID,
+			&result.EventNID,
+		); err != nil {
+			return nil, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return results[:i], nil
+}
+
+// bulkSelectStateAtEventByID lookups the state at a list of events by event ID.
+// If any of the requested events are missing from the database it returns a types.MissingEventError.
+// If we do not have the state for any of the requested events it returns a types.MissingEventError.
+func (s *eventStatements) BulkSelectStateAtEventByID(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) ([]types.StateAtEvent, error) {
+	results := make([]types.StateAtEvent, 0, len(eventIDs))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectStateAtEventByIDSQL, queryProvider(s.db, txn), stringsAsParams(eventIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			for rows.Next() {
+				var result types.StateAtEvent
+				if err := rows.Scan(
+					&result.EventTypeNID,
+					&result.EventStateKeyNID,
+					&result.EventNID,
+					&result.BeforeStateSnapshotNID,
+					&result.IsRejected,
+				); err != nil {
+					return err
+				}
+				// Genuine create events are the only case where it's OK to have no previous state.
+				isCreate := result.EventTypeNID == types.MRoomCreateNID && result.EventStateKeyNID == 1
+				if result.BeforeStateSnapshotNID == 0 && !isCreate {
+					return types.MissingStateError(
+						fmt.Sprintf("storage: missing state for event NID %d", result.EventNID),
+					)
+				}
+				results = append(results, result)
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(eventIDs) {
+		return nil, types.MissingEventError(
+			fmt.Sprintf("storage: event IDs missing from the database (%d != %d)", len(results), len(eventIDs)),
+		)
+	}
+	return results, nil
+}
+
+func (s *eventStatements) UpdateEventState(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, stateNID types.StateSnapshotNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateEventStateStmt)
+	_, err := stmt.ExecContext(ctx, int64(stateNID), int64(eventNID))
+	return err
+}
+
+func (s *eventStatements) SelectEventSentToOutput(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) (sentToOutput bool, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventSentToOutputStmt)
+	err = stmt.QueryRowContext(ctx, int64(eventNID)).Scan(&sentToOutput)
+	return
+}
+
+func (s *eventStatements) UpdateEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error {
+	stmt := sqlutil.TxStmt(txn, s.updateEventSentToOutputStmt)
+	_, err := stmt.ExecContext(ctx, int64(eventNID))
+	return err
+}
+
+func (s *eventStatements) SelectEventID(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) (eventID string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventIDStmt)
+	err = stmt.QueryRowContext(ctx, int64(eventNID)).Scan(&eventID)
+	return
+}
+
+func (s *eventStatements) BulkSelectStateAtEventAndReference(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) ([]types.StateAtEventAndReference, error) {
+	results := make([]types.StateAtEventAndReference, 0, len(eventNIDs))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectStateAtEventAndReferenceSQL, queryProvider(s.db, txn), eventNIDsAsArray(eventNIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var (
+				eventTypeNID     int64
+				eventStateKeyNID int64
+				eventNID         int64
+				stateSnapshotNID int64
+				eventID          string
+			)
+			for rows.Next() {
+				if err := rows.Scan(
+					&eventTypeNID, &eventStateKeyNID, &eventNID, &stateSnapshotNID, &eventID,
+				); err != nil {
+					return err
+				}
+				var result types.StateAtEventAndReference
+				result.EventTypeNID = types.EventTypeNID(eventTypeNID)
+				result.EventStateKeyNID = types.EventStateKeyNID(eventStateKeyNID)
+				result.EventNID = types.EventNID(eventNID)
+				result.BeforeStateSnapshotNID = types.StateSnapshotNID(stateSnapshotNID)
+				result.EventID = eventID
+				results = append(results, result)
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(eventNIDs) {
+		return nil, fmt.Errorf("storage: event NIDs missing from the database (%d != %d)", len(results), len(eventNIDs))
+	}
+	return results, nil
+}
+
+// bulkSelectEventID returns a map from numeric event ID to string event ID.
+func (s *eventStatements) BulkSelectEventID(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	results := make(map[types.EventNID]string, len(eventNIDs))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectEventIDSQL, queryProvider(s.db, txn), eventNIDsAsArray(eventNIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var eventNID int64
+			var eventID string
+			for rows.Next() {
+				if err := rows.Scan(&eventNID, &eventID); err != nil {
+					return err
+				}
+				results[types.EventNID(eventNID)] = eventID
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(eventNIDs) {
+		return nil, fmt.Errorf("storage: event NIDs missing from the database (%d != %d)", len(results), len(eventNIDs))
+	}
+	return results, nil
+}
+
+// BulkSelectEventNIDs returns a map from string event ID to numeric event ID.
+// If an event ID is not in the database then it is omitted from the map.
+func (s *eventStatements) BulkSelectEventNID(ctx context.Context, txn *sql.Tx, eventIDs []string) (map[string]types.EventMetadata, error) {
+	return s.bulkSelectEventNID(ctx, txn, eventIDs, false)
+}
+
+// BulkSelectEventNIDs returns a map from string event ID to numeric event ID
+// only for events that haven't already been sent to the roomserver output.
+// If an event ID is not in the database then it is omitted from the map.
+func (s *eventStatements) BulkSelectUnsentEventNID(ctx context.Context, txn *sql.Tx, eventIDs []string) (map[string]types.EventMetadata, error) {
+	return s.bulkSelectEventNID(ctx, txn, eventIDs, true)
+}
+
+// bulkSelectEventNIDs returns a map from string event ID to numeric event ID.
+// If an event ID is not in the database then it is omitted from the map.
+func (s *eventStatements) bulkSelectEventNID(ctx context.Context, txn *sql.Tx, eventIDs []string, onlyUnsent bool) (map[string]types.EventMetadata, error) {
+	query := bulkSelectEventNIDSQL
+	if onlyUnsent {
+		query = bulkSelectUnsentEventNIDSQL
+	}
+	results := make(map[string]types.EventMetadata, len(eventIDs))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, query, queryProvider(s.db, txn), stringsAsParams(eventIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var eventID string
+			var eventNID int64
+			var roomNID int64
+			for rows.Next() {
+				if err := rows.Scan(&eventID, &eventNID, &roomNID); err != nil {
+					return err
+				}
+				results[eventID] = types.EventMetadata{
+					EventNID: types.EventNID(eventNID),
+					RoomNID:  types.RoomNID(roomNID),
+				}
+			}
+			return rows.Err()
+		},
+	)
+	return results, err
+}
+
+func (s *eventStatements) SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error) {
+	var result int64
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, selectMaxEventDepthSQL, queryProvider(s.db, txn), eventNIDsAsArray(eventNIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var depth int64
+			for rows.Next() {
+				if err := rows.Scan(&depth); err != nil {
+					return err
+				}
+				if depth > result {
+					result = depth
+				}
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+func (s *eventStatements) SelectRoomNIDsForEventNIDs(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) (map[types.EventNID]types.RoomNID, error) {
+	result := make(map[types.EventNID]types.RoomNID)
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, selectRoomNIDsForEventNIDsSQL, queryProvider(s.db, txn), eventNIDsAsArray(eventNIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var eventNID types.EventNID
+			var roomNID types.RoomNID
+			for rows.Next() {
+				if err := rows.Scan(&eventNID, &roomNID); err != nil {
+					return err
+				}
+				result[eventNID] = roomNID
+			}
+			return rows.Err()
+		},
+	)
+	return result, err
+}
+
+// eventNIDsAsArray converts the event NIDs into query parameters.
+func eventNIDsAsArray(eventNIDs []types.EventNID) []interface{} {
+	nids := make([]interface{}, len(eventNIDs))
+	for i := range eventNIDs {
+		nids[i] = int64(eventNIDs[i])
+	}
+	return nids
+}
+
+// eventNIDsAsInt64s converts the event NIDs into a list suitable for
+// storing as JSON.
+func eventNIDsAsInt64s(eventNIDs []types.EventNID) []int64 {
+	nids := make([]int64, len(eventNIDs))
+	for i := range eventNIDs {
+		nids[i] = int64(eventNIDs[i])
+	}
+	return nids
+}
+
+func (s *eventStatements) SelectEventRejected(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID string,
+) (rejected bool, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventRejectedStmt)
+	err = stmt.QueryRowContext(ctx, roomNID, eventID).Scan(&rejected)
+	return
+}
+
+func (s *eventStatements) SelectRoomsWithEventTypeNID(
+	ctx context.Context, txn *sql.Tx, eventTypeNID types.EventTypeNID,
+) ([]types.RoomNID, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomsWithEventTypeNIDStmt)
+	rows, err := stmt.QueryContext(ctx, eventTypeNID)
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomsWithEventTypeNID: rows.close() failed")
+	if err != nil {
+		return nil, err
+	}
+
+	var roomNIDs []types.RoomNID
+	var roomNID types.RoomNID
+	for rows.Next() {
+		if err := rows.Scan(&roomNID); err != nil {
+			return nil, err
+		}
+		roomNIDs = append(roomNIDs, roomNID)
+	}
+
+	return roomNIDs, rows.Err()
+}
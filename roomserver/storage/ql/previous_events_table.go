@@ -0,0 +1,134 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const previousEventSchema = `
+-- The previous events table stores the event_ids referenced by the events
+-- stored in the events table.
+-- This is used to tell if a new event is already referenced by an event in
+-- the database.
+CREATE TABLE IF NOT EXISTS roomserver_previous_events (
+    -- The string event ID taken from the prev_events key of an event.
+    previous_event_id string NOT NULL,
+    -- A JSON list of numeric event IDs of events that reference this prev_event.
+    event_nids blob NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_previous_events_previous_event_id_idx ON roomserver_previous_events(previous_event_id);
+`
+
+// Insert an entry into the previous_events table.
+// If there is already an entry indicating that an event references that previous event then
+// add the event NID to the list to indicate that this event references that previous event as well.
+// This should only be modified while holding a "FOR UPDATE" lock on the row in the rooms table for this room.
+// The lock is necessary to avoid data races when checking whether an event is already referenced by another event.
+// QL can't modify JSON lists, so the list is updated in Go.
+const insertPreviousEventSQL = "" +
+	"INSERT INTO roomserver_previous_events" +
+	" (previous_event_id, event_nids)" +
+	" VALUES ($1, $2)"
+
+const selectPreviousEventNIDsSQL = "" +
+	"SELECT event_nids FROM roomserver_previous_events" +
+	" WHERE previous_event_id = $1"
+
+const updatePreviousEventNIDsSQL = "" +
+	"UPDATE roomserver_previous_events SET event_nids = $1" +
+	" WHERE previous_event_id = $2"
+
+// Check if the event is referenced by another event in the table.
+// This should only be done while holding a "FOR UPDATE" lock on the row in the rooms table for this room.
+const selectPreviousEventExistsSQL = "" +
+	"SELECT 1 FROM roomserver_previous_events" +
+	" WHERE previous_event_id = $1"
+
+type previousEventStatements struct {
+	insertPreviousEventStmt       *sql.Stmt
+	selectPreviousEventNIDsStmt   *sql.Stmt
+	updatePreviousEventNIDsStmt   *sql.Stmt
+	selectPreviousEventExistsStmt *sql.Stmt
+}
+
+func CreatePrevEventsTable(db *sql.DB) error {
+	_, err := db.Exec(previousEventSchema)
+	return err
+}
+
+func PreparePrevEventsTable(db *sql.DB) (tables.PreviousEvents, error) {
+	s := &previousEventStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertPreviousEventStmt, insertPreviousEventSQL},
+		{&s.selectPreviousEventNIDsStmt, selectPreviousEventNIDsSQL},
+		{&s.updatePreviousEventNIDsStmt, updatePreviousEventNIDsSQL},
+		{&s.selectPreviousEventExistsStmt, selectPreviousEventExistsSQL},
+	}.Prepare(db)
+}
+
+func (s *previousEventStatements) InsertPreviousEvent(
+	ctx context.Context,
+	txn *sql.Tx,
+	previousEventID string,
+	eventNID types.EventNID,
+) error {
+	var eventNIDsJSON string
+	err := sqlutil.TxStmt(txn, s.selectPreviousEventNIDsStmt).QueryRowContext(ctx, previousEventID).Scan(&eventNIDsJSON)
+	if err == sql.ErrNoRows {
+		stmt := sqlutil.TxStmt(txn, s.insertPreviousEventStmt)
+		_, err = stmt.ExecContext(ctx, previousEventID, []byte(fmt.Sprintf("[%d]", eventNID)))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	var eventNIDs []int64
+	if err = json.Unmarshal([]byte(eventNIDsJSON), &eventNIDs); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	for _, nid := range eventNIDs {
+		if nid == int64(eventNID) {
+			return nil
+		}
+	}
+	newEventNIDsJSON, err := json.Marshal(append(eventNIDs, int64(eventNID)))
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	stmt := sqlutil.TxStmt(txn, s.updatePreviousEventNIDsStmt)
+	_, err = stmt.ExecContext(ctx, newEventNIDsJSON, previousEventID)
+	return err
+}
+
+// Check if the event reference exists
+// Returns sql.ErrNoRows if the event reference doesn't exist.
+func (s *previousEventStatements) SelectPreviousEventExists(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	var ok int64
+	stmt := sqlutil.TxStmt(txn, s.selectPreviousEventExistsStmt)
+	return stmt.QueryRowContext(ctx, eventID).Scan(&ok)
+}
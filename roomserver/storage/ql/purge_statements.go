@@ -0,0 +1,263 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const purgeEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid IN (" +
+	"	SELECT event_nid FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE room_nid = $1"
+
+const purgeInvitesSQL = "" +
+	"DELETE FROM roomserver_invites WHERE room_nid = $1"
+
+const purgeMembershipsSQL = "" +
+	"DELETE FROM roomserver_membership WHERE room_nid = $1"
+
+// QL can't expand the JSON lists of event NIDs in a query, so the remaining
+// previous events which reference the room's events are found in Go.
+const selectPurgeEventNIDsSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1"
+
+const selectPurgePreviousEventsSQL = "" +
+	"SELECT previous_event_id, event_nids FROM roomserver_previous_events"
+
+const purgePreviousEventsSQL = "" +
+	"DELETE FROM roomserver_previous_events WHERE previous_event_id IN ($1)"
+
+// This removes the majority of prev events and is way faster than the above.
+// The above query is still needed to delete the remaining prev events.
+const purgePreviousEvents2SQL = "" +
+	"DELETE FROM roomserver_previous_events WHERE previous_event_id IN (SELECT event_id FROM roomserver_events WHERE room_nid = $1)"
+
+const purgeKnockServersSQL = "" +
+	"DELETE FROM roomserver_knock_servers WHERE room_id = $1"
+
+const purgePublishedSQL = "" +
+	"DELETE FROM roomserver_published WHERE room_id = $1"
+
+const purgeRedactionsSQL = "" +
+	"DELETE FROM roomserver_redactions WHERE redaction_event_id IN (" +
+	"	SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeRoomAliasesSQL = "" +
+	"DELETE FROM roomserver_room_aliases WHERE room_id = $1"
+
+const purgeRoomSQL = "" +
+	"DELETE FROM roomserver_rooms WHERE room_nid = $1"
+
+const selectPurgeStateBlockNIDsSQL = "" +
+	"SELECT state_block_nids FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+const purgeStateBlockEntriesSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid IN ($1)"
+
+const purgeStateSnapshotEntriesSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+type purgeStatements struct {
+	db                            *sql.DB
+	selectPurgeEventNIDsStmt      *sql.Stmt
+	selectPurgePreviousEventsStmt *sql.Stmt
+	selectPurgeStateBlockNIDsStmt *sql.Stmt
+	purgeEventJSONStmt            *sql.Stmt
+	purgeEventsStmt               *sql.Stmt
+	purgeInvitesStmt              *sql.Stmt
+	purgeKnockServersStmt         *sql.Stmt
+	purgeMembershipsStmt          *sql.Stmt
+	purgePreviousEvents2Stmt      *sql.Stmt
+	purgePublishedStmt            *sql.Stmt
+	purgeRedactionStmt            *sql.Stmt
+	purgeRoomAliasesStmt          *sql.Stmt
+	purgeRoomStmt                 *sql.Stmt
+	purgeStateSnapshotEntriesStmt *sql.Stmt
+	// purgePreviousEventsStmt *sql.Stmt - prepared at runtime due to variadic
+	// purgeStateBlockEntriesStmt *sql.Stmt - prepared at runtime due to variadic
+}
+
+func PreparePurgeStatements(db *sql.DB) (*purgeStatements, error) {
+	s := &purgeStatements{
+		db: db,
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.selectPurgeEventNIDsStmt, selectPurgeEventNIDsSQL},
+		{&s.selectPurgePreviousEventsStmt, selectPurgePreviousEventsSQL},
+		{&s.selectPurgeStateBlockNIDsStmt, selectPurgeStateBlockNIDsSQL},
+		{&s.purgeEventJSONStmt, purgeEventJSONSQL},
+		{&s.purgeEventsStmt, purgeEventsSQL},
+		{&s.purgeInvitesStmt, purgeInvitesSQL},
+		{&s.purgeKnockServersStmt, purgeKnockServersSQL},
+		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
+		{&s.purgePublishedStmt, purgePublishedSQL},
+		{&s.purgePreviousEvents2Stmt, purgePreviousEvents2SQL},
+		{&s.purgeRedactionStmt, purgeRedactionsSQL},
+		{&s.purgeRoomAliasesStmt, purgeRoomAliasesSQL},
+		{&s.purgeRoomStmt, purgeRoomSQL},
+		{&s.purgeStateSnapshotEntriesStmt, purgeStateSnapshotEntriesSQL},
+	}.Prepare(db)
+}
+
+func (s *purgeStatements) PurgeRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, roomID string,
+) error {
+
+	// purge by roomID
+	purgeByRoomID := []*sql.Stmt{
+		s.purgeRoomAliasesStmt,
+		s.purgePublishedStmt,
+		s.purgeKnockServersStmt,
+	}
+	for _, stmt := range purgeByRoomID {
+		_, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := s.purgeStateBlockEntries(ctx, txn, roomNID); err != nil {
+		return err
+	}
+
+	// purge by roomNID
+	purgeByRoomNID := []*sql.Stmt{
+		s.purgeStateSnapshotEntriesStmt,
+		s.purgeInvitesStmt,
+		s.purgeMembershipsStmt,
+		s.purgePreviousEvents2Stmt, // Fast purge the majority of events
+	}
+	for _, stmt := range purgeByRoomNID {
+		_, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomNID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Slow purge the remaining events
+	if err := s.purgePreviousEvents(ctx, txn, roomNID); err != nil {
+		return err
+	}
+
+	purgeByRoomNID = []*sql.Stmt{
+		s.purgeEventJSONStmt,
+		s.purgeRedactionStmt,
+		s.purgeEventsStmt,
+		s.purgeRoomStmt,
+	}
+	for _, stmt := range purgeByRoomNID {
+		_, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomNID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeStateBlockEntries deletes the state blocks referenced by the state
+// snapshots of the room.
+func (s *purgeStatements) purgeStateBlockEntries(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	rows, err := sqlutil.TxStmt(txn, s.selectPurgeStateBlockNIDsStmt).QueryContext(ctx, roomNID)
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "purgeStateBlockEntries: rows.close() failed")
+	seen := make(map[types.StateBlockNID]struct{})
+	var stateBlockNIDs []interface{}
+	var stateBlockNIDsJSON string
+	for rows.Next() {
+		if err = rows.Scan(&stateBlockNIDsJSON); err != nil {
+			return err
+		}
+		var nids []types.StateBlockNID
+		if err = json.Unmarshal([]byte(stateBlockNIDsJSON), &nids); err != nil {
+			return err
+		}
+		for _, nid := range nids {
+			if _, ok := seen[nid]; !ok {
+				seen[nid] = struct{}{}
+				stateBlockNIDs = append(stateBlockNIDs, int64(nid))
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return sqlutil.RunLimitedVariablesExec(ctx, purgeStateBlockEntriesSQL, execProvider(s.db, txn), stateBlockNIDs, sqlutil.QLMaxVariables)
+}
+
+// purgePreviousEvents deletes the previous events which are referenced by
+// any of the events in the room.
+func (s *purgeStatements) purgePreviousEvents(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	eventNIDs := make(map[types.EventNID]struct{})
+	rows, err := sqlutil.TxStmt(txn, s.selectPurgeEventNIDsStmt).QueryContext(ctx, roomNID)
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "purgePreviousEvents: rows.close() failed")
+	var eventNID types.EventNID
+	for rows.Next() {
+		if err = rows.Scan(&eventNID); err != nil {
+			return err
+		}
+		eventNIDs[eventNID] = struct{}{}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	prevRows, err := sqlutil.TxStmt(txn, s.selectPurgePreviousEventsStmt).QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, prevRows, "purgePreviousEvents: prevRows.close() failed")
+	var previousEventIDs []interface{}
+	var previousEventID, eventNIDsJSON string
+	for prevRows.Next() {
+		if err = prevRows.Scan(&previousEventID, &eventNIDsJSON); err != nil {
+			return err
+		}
+		var nids []types.EventNID
+		if err = json.Unmarshal([]byte(eventNIDsJSON), &nids); err != nil {
+			return err
+		}
+		for _, nid := range nids {
+			if _, ok := eventNIDs[nid]; ok {
+				previousEventIDs = append(previousEventIDs, previousEventID)
+				break
+			}
+		}
+	}
+	if err = prevRows.Err(); err != nil {
+		return err
+	}
+	return sqlutil.RunLimitedVariablesExec(ctx, purgePreviousEventsSQL, execProvider(s.db, txn), previousEventIDs, sqlutil.QLMaxVariables)
+}
@@ -0,0 +1,232 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const reportedEventsScheme = `
+CREATE TABLE IF NOT EXISTS roomserver_reported_events
+(
+	id 					int64 NOT NULL,
+    room_nid 			int64 NOT NULL,
+	event_nid 			int64 NOT NULL,
+    reporting_user_nid	int64 NOT NULL, -- the user reporting the event
+    event_sender_nid	int64 NOT NULL, -- the user who sent the reported event
+    reason      		string,
+    score       		int64,
+    received_ts 		int64 NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_reported_events_id_idx ON roomserver_reported_events(id);
+`
+
+const insertReportedEventSQL = `
+	INSERT INTO roomserver_reported_events (id, room_nid, event_nid, reporting_user_nid, event_sender_nid, reason, score, received_ts)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+`
+
+const countReportedEventsSQL = `
+SELECT count(*)
+FROM roomserver_reported_events
+WHERE ($1 = 0 OR room_nid = $1) AND ($2 = 0 OR reporting_user_nid = $2)
+`
+
+const selectReportedEventsDescSQL = `
+SELECT id, room_nid, event_nid, reporting_user_nid, event_sender_nid, reason, score, received_ts
+FROM roomserver_reported_events
+WHERE ($1 = 0 OR room_nid = $1) AND ($2 = 0 OR reporting_user_nid = $2)
+ORDER BY received_ts DESC
+LIMIT $3
+OFFSET $4
+`
+
+const selectReportedEventsAscSQL = `
+SELECT id, room_nid, event_nid, reporting_user_nid, event_sender_nid, reason, score, received_ts
+FROM roomserver_reported_events
+WHERE ($1 = 0 OR room_nid = $1) AND ($2 = 0 OR reporting_user_nid = $2)
+ORDER BY received_ts ASC
+LIMIT $3
+OFFSET $4
+`
+
+const selectReportedEventSQL = `
+SELECT id, room_nid, event_nid, reporting_user_nid, event_sender_nid, reason, score, received_ts
+FROM roomserver_reported_events
+WHERE id = $1
+`
+
+const deleteReportedEventSQL = `DELETE FROM roomserver_reported_events WHERE id = $1`
+
+type reportedEventsStatements struct {
+	reportIDs                    *nidSequence
+	insertReportedEventsStmt     *sql.Stmt
+	countReportedEventsStmt      *sql.Stmt
+	selectReportedEventsDescStmt *sql.Stmt
+	selectReportedEventsAscStmt  *sql.Stmt
+	selectReportedEventStmt      *sql.Stmt
+	deleteReportedEventStmt      *sql.Stmt
+}
+
+func CreateReportedEventsTable(db *sql.DB) error {
+	if _, err := db.Exec(reportedEventsScheme); err != nil {
+		return err
+	}
+	return createSequence(db, "roomserver_reported_events", 0)
+}
+
+func PrepareReportedEventsTable(db *sql.DB) (tables.ReportedEvents, error) {
+	reportIDs, err := prepareSequence(db, "roomserver_reported_events")
+	if err != nil {
+		return nil, err
+	}
+	s := &reportedEventsStatements{
+		reportIDs: reportIDs,
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertReportedEventsStmt, insertReportedEventSQL},
+		{&s.countReportedEventsStmt, countReportedEventsSQL},
+		{&s.selectReportedEventsDescStmt, selectReportedEventsDescSQL},
+		{&s.selectReportedEventsAscStmt, selectReportedEventsAscSQL},
+		{&s.selectReportedEventStmt, selectReportedEventSQL},
+		{&s.deleteReportedEventStmt, deleteReportedEventSQL},
+	}.Prepare(db)
+}
+
+func (r *reportedEventsStatements) InsertReportedEvent(
+	ctx context.Context,
+	txn *sql.Tx,
+	roomNID types.RoomNID,
+	eventNID types.EventNID,
+	reportingUserID types.EventStateKeyNID,
+	eventSenderID types.EventStateKeyNID,
+	reason string,
+	score int64,
+) (int64, error) {
+	reportID, err := r.reportIDs.next(ctx, txn)
+	if err != nil {
+		return 0, err
+	}
+	stmt := sqlutil.TxStmt(txn, r.insertReportedEventsStmt)
+	_, err = stmt.ExecContext(ctx,
+		reportID,
+		int64(roomNID),
+		int64(eventNID),
+		int64(reportingUserID),
+		int64(eventSenderID),
+		reason,
+		score,
+		int64(spec.AsTimestamp(time.Now())),
+	)
+	return reportID, err
+}
+
+func (r *reportedEventsStatements) SelectReportedEvents(
+	ctx context.Context,
+	txn *sql.Tx,
+	from, limit uint64,
+	backwards bool,
+	reportingUserID types.EventStateKeyNID,
+	roomNID types.RoomNID,
+) ([]api.QueryAdminEventReportsResponse, int64, error) {
+	var stmt *sql.Stmt
+	if backwards {
+		stmt = sqlutil.TxStmt(txn, r.selectReportedEventsDescStmt)
+	} else {
+		stmt = sqlutil.TxStmt(txn, r.selectReportedEventsAscStmt)
+	}
+
+	// QL never matches a row when a column is compared with a NULL parameter,
+	// even as part of an OR, so a NID of 0 means "don't filter" instead.
+	var count int64
+	err := sqlutil.TxStmt(txn, r.countReportedEventsStmt).QueryRowContext(ctx,
+		int64(roomNID),
+		int64(reportingUserID),
+	).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := stmt.QueryContext(ctx,
+		int64(roomNID),
+		int64(reportingUserID),
+		int64(limit),
+		int64(from),
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectReportedEvents: failed to close rows")
+
+	var result []api.QueryAdminEventReportsResponse
+	var row api.QueryAdminEventReportsResponse
+	for rows.Next() {
+		if err = rows.Scan(
+			&row.ID,
+			&row.RoomNID,
+			&row.EventNID,
+			&row.ReportingUserNID,
+			&row.SenderNID,
+			&row.Reason,
+			&row.Score,
+			&row.ReceivedTS,
+		); err != nil {
+			return nil, 0, err
+		}
+		result = append(result, row)
+	}
+
+	return result, count, rows.Err()
+}
+
+func (r *reportedEventsStatements) SelectReportedEvent(
+	ctx context.Context,
+	txn *sql.Tx,
+	reportID uint64,
+) (api.QueryAdminEventReportResponse, error) {
+	stmt := sqlutil.TxStmt(txn, r.selectReportedEventStmt)
+
+	var row api.QueryAdminEventReportResponse
+	if err := stmt.QueryRowContext(ctx, int64(reportID)).Scan(
+		&row.ID,
+		&row.RoomNID,
+		&row.EventNID,
+		&row.ReportingUserNID,
+		&row.SenderNID,
+		&row.Reason,
+		&row.Score,
+		&row.ReceivedTS,
+	); err != nil {
+		return api.QueryAdminEventReportResponse{}, err
+	}
+	return row, nil
+}
+
+func (r *reportedEventsStatements) DeleteReportedEvent(ctx context.Context, txn *sql.Tx, reportID uint64) error {
+	stmt := sqlutil.TxStmt(txn, r.deleteReportedEventStmt)
+	_, err := stmt.ExecContext(ctx, int64(reportID))
+	return err
+}
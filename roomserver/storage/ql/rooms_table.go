@@ -0,0 +1,309 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const roomsSchema = `
+CREATE TABLE IF NOT EXISTS roomserver_rooms (
+    -- Local numeric ID for the room.
+    room_nid int64 NOT NULL,
+    -- Textual ID for the room.
+    room_id string NOT NULL,
+    -- The most recent events in the room that aren't referenced by another event.
+    -- This JSON list may empty if the server hasn't joined the room yet.
+    -- (The server will be in that state while it stores the events for the initial state of the room)
+    latest_event_nids string NOT NULL DEFAULT "[]",
+    -- The last event written to the output log for this room.
+    last_event_sent_nid int64 NOT NULL DEFAULT 0,
+    -- The state of the room after the current set of latest events.
+    -- This will be 0 if there are no latest events in the room.
+    state_snapshot_nid int64 NOT NULL DEFAULT 0,
+    -- The version of the room, which will assist in determining the state resolution
+    -- algorithm, event ID format, etc.
+    room_version string NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_rooms_room_nid_idx ON roomserver_rooms(room_nid);
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_rooms_room_id_idx ON roomserver_rooms(room_id);
+`
+
+// Same as insertEventTypeNIDSQL
+const insertRoomNIDSQL = "" +
+	"INSERT INTO roomserver_rooms (room_nid, room_id, room_version) VALUES ($1, $2, $3)"
+
+const selectRoomNIDSQL = "" +
+	"SELECT room_nid FROM roomserver_rooms WHERE room_id = $1"
+
+// QL has no row locks, but all writes are serialised by the
+// exclusive writer, so a plain select is sufficient here.
+const selectRoomNIDForUpdateSQL = "" +
+	"SELECT room_nid FROM roomserver_rooms WHERE room_id = $1"
+
+const selectLatestEventNIDsSQL = "" +
+	"SELECT latest_event_nids, state_snapshot_nid FROM roomserver_rooms WHERE room_nid = $1"
+
+const selectLatestEventNIDsForUpdateSQL = "" +
+	"SELECT latest_event_nids, last_event_sent_nid, state_snapshot_nid FROM roomserver_rooms WHERE room_nid = $1"
+
+const updateLatestEventNIDsSQL = "" +
+	"UPDATE roomserver_rooms SET latest_event_nids = $1, last_event_sent_nid = $2, state_snapshot_nid = $3 WHERE room_nid = $4"
+
+const selectRoomVersionsForRoomNIDsSQL = "" +
+	"SELECT room_nid, room_version FROM roomserver_rooms WHERE room_nid IN ($1)"
+
+const selectRoomInfoSQL = "" +
+	"SELECT room_version, room_nid, state_snapshot_nid, latest_event_nids FROM roomserver_rooms WHERE room_id = $1"
+
+const bulkSelectRoomIDsSQL = "" +
+	"SELECT room_id FROM roomserver_rooms WHERE room_nid IN ($1)"
+
+const bulkSelectRoomNIDsSQL = "" +
+	"SELECT room_nid FROM roomserver_rooms WHERE room_id IN ($1)"
+
+type roomStatements struct {
+	db                                 *sql.DB
+	roomNIDs                           *nidSequence
+	insertRoomNIDStmt                  *sql.Stmt
+	selectRoomNIDStmt                  *sql.Stmt
+	selectRoomNIDForUpdateStmt         *sql.Stmt
+	selectLatestEventNIDsStmt          *sql.Stmt
+	selectLatestEventNIDsForUpdateStmt *sql.Stmt
+	updateLatestEventNIDsStmt          *sql.Stmt
+	selectRoomInfoStmt                 *sql.Stmt
+	// selectRoomVersionsForRoomNIDsStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectRoomIDsStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectRoomNIDsStmt *sql.Stmt - prepared at runtime due to variadic
+}
+
+func CreateRoomsTable(db *sql.DB) error {
+	if _, err := db.Exec(roomsSchema); err != nil {
+		return err
+	}
+	return createSequence(db, "roomserver_rooms", 0)
+}
+
+func PrepareRoomsTable(db *sql.DB) (tables.Rooms, error) {
+	roomNIDs, err := prepareSequence(db, "roomserver_rooms")
+	if err != nil {
+		return nil, err
+	}
+	s := &roomStatements{
+		db:       db,
+		roomNIDs: roomNIDs,
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertRoomNIDStmt, insertRoomNIDSQL},
+		{&s.selectRoomNIDStmt, selectRoomNIDSQL},
+		{&s.selectRoomNIDForUpdateStmt, selectRoomNIDForUpdateSQL},
+		{&s.selectLatestEventNIDsStmt, selectLatestEventNIDsSQL},
+		{&s.selectLatestEventNIDsForUpdateStmt, selectLatestEventNIDsForUpdateSQL},
+		{&s.updateLatestEventNIDsStmt, updateLatestEventNIDsSQL},
+		{&s.selectRoomInfoStmt, selectRoomInfoSQL},
+	}.Prepare(db)
+}
+
+func (s *roomStatements) InsertRoomNID(
+	ctx context.Context, txn *sql.Tx,
+	roomID string, roomVersion gomatrixserverlib.RoomVersion,
+) (types.RoomNID, error) {
+	roomNID, err := s.roomNIDs.next(ctx, txn)
+	if err != nil {
+		return 0, err
+	}
+	stmt := sqlutil.TxStmt(txn, s.insertRoomNIDStmt)
+	_, err = stmt.ExecContext(ctx, roomNID, roomID, string(roomVersion))
+	if sqlutil.IsQLUniqueConstraintViolation(err) {
+		return 0, sql.ErrNoRows
+	}
+	return types.RoomNID(roomNID), err
+}
+
+func (s *roomStatements) SelectRoomInfo(ctx context.Context, txn *sql.Tx, roomID string) (*types.RoomInfo, error) {
+	var info types.RoomInfo
+	var latestNIDsJSON string
+	var stateSnapshotNID types.StateSnapshotNID
+	stmt := sqlutil.TxStmt(txn, s.selectRoomInfoStmt)
+	err := stmt.QueryRowContext(ctx, roomID).Scan(
+		&info.RoomVersion, &info.RoomNID, &stateSnapshotNID, &latestNIDsJSON,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var latestNIDs []int64
+	if err = json.Unmarshal([]byte(latestNIDsJSON), &latestNIDs); err != nil {
+		return nil, err
+	}
+	info.SetStateSnapshotNID(stateSnapshotNID)
+	info.SetIsStub(len(latestNIDs) == 0)
+	return &info, nil
+}
+
+func (s *roomStatements) SelectRoomNID(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (types.RoomNID, error) {
+	var roomNID int64
+	stmt := sqlutil.TxStmt(txn, s.selectRoomNIDStmt)
+	err := stmt.QueryRowContext(ctx, roomID).Scan(&roomNID)
+	return types.RoomNID(roomNID), err
+}
+
+func (s *roomStatements) SelectRoomNIDForUpdate(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (types.RoomNID, error) {
+	var roomNID int64
+	stmt := sqlutil.TxStmt(txn, s.selectRoomNIDForUpdateStmt)
+	err := stmt.QueryRowContext(ctx, roomID).Scan(&roomNID)
+	return types.RoomNID(roomNID), err
+}
+
+func (s *roomStatements) SelectLatestEventNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]types.EventNID, types.StateSnapshotNID, error) {
+	var nidsJSON string
+	var stateSnapshotNID int64
+	stmt := sqlutil.TxStmt(txn, s.selectLatestEventNIDsStmt)
+	err := stmt.QueryRowContext(ctx, int64(roomNID)).Scan(&nidsJSON, &stateSnapshotNID)
+	if err != nil {
+		return nil, 0, err
+	}
+	var eventNIDs []types.EventNID
+	if err = json.Unmarshal([]byte(nidsJSON), &eventNIDs); err != nil {
+		return nil, 0, err
+	}
+	return eventNIDs, types.StateSnapshotNID(stateSnapshotNID), nil
+}
+
+func (s *roomStatements) SelectLatestEventsNIDsForUpdate(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]types.EventNID, types.EventNID, types.StateSnapshotNID, error) {
+	var nidsJSON string
+	var lastEventSentNID int64
+	var stateSnapshotNID int64
+	stmt := sqlutil.TxStmt(txn, s.selectLatestEventNIDsForUpdateStmt)
+	err := stmt.QueryRowContext(ctx, int64(roomNID)).Scan(&nidsJSON, &lastEventSentNID, &stateSnapshotNID)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var eventNIDs []types.EventNID
+	if err = json.Unmarshal([]byte(nidsJSON), &eventNIDs); err != nil {
+		return nil, 0, 0, err
+	}
+	return eventNIDs, types.EventNID(lastEventSentNID), types.StateSnapshotNID(stateSnapshotNID), nil
+}
+
+func (s *roomStatements) UpdateLatestEventNIDs(
+	ctx context.Context,
+	txn *sql.Tx,
+	roomNID types.RoomNID,
+	eventNIDs []types.EventNID,
+	lastEventSentNID types.EventNID,
+	stateSnapshotNID types.StateSnapshotNID,
+) error {
+	eventNIDsJSON, err := json.Marshal(eventNIDsAsInt64s(eventNIDs))
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	stmt := sqlutil.TxStmt(txn, s.updateLatestEventNIDsStmt)
+	_, err = stmt.ExecContext(
+		ctx,
+		string(eventNIDsJSON),
+		int64(lastEventSentNID),
+		int64(stateSnapshotNID),
+		roomNID,
+	)
+	return err
+}
+
+func (s *roomStatements) SelectRoomVersionsForRoomNIDs(
+	ctx context.Context, txn *sql.Tx, roomNIDs []types.RoomNID,
+) (map[types.RoomNID]gomatrixserverlib.RoomVersion, error) {
+	result := make(map[types.RoomNID]gomatrixserverlib.RoomVersion)
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, selectRoomVersionsForRoomNIDsSQL, queryProvider(s.db, txn), roomNIDsAsArray(roomNIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var roomNID types.RoomNID
+			var roomVersion gomatrixserverlib.RoomVersion
+			for rows.Next() {
+				if err := rows.Scan(&roomNID, &roomVersion); err != nil {
+					return err
+				}
+				result[roomNID] = roomVersion
+			}
+			return rows.Err()
+		},
+	)
+	return result, err
+}
+
+func (s *roomStatements) BulkSelectRoomIDs(ctx context.Context, txn *sql.Tx, roomNIDs []types.RoomNID) ([]string, error) {
+	var roomIDs []string
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectRoomIDsSQL, queryProvider(s.db, txn), roomNIDsAsArray(roomNIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var roomID string
+			for rows.Next() {
+				if err := rows.Scan(&roomID); err != nil {
+					return err
+				}
+				roomIDs = append(roomIDs, roomID)
+			}
+			return rows.Err()
+		},
+	)
+	return roomIDs, err
+}
+
+func (s *roomStatements) BulkSelectRoomNIDs(ctx context.Context, txn *sql.Tx, roomIDs []string) ([]types.RoomNID, error) {
+	var roomNIDs []types.RoomNID
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectRoomNIDsSQL, queryProvider(s.db, txn), stringsAsParams(roomIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var roomNID types.RoomNID
+			for rows.Next() {
+				if err := rows.Scan(&roomNID); err != nil {
+					return err
+				}
+				roomNIDs = append(roomNIDs, roomNID)
+			}
+			return rows.Err()
+		},
+	)
+	return roomNIDs, err
+}
+
+// roomNIDsAsArray converts the room NIDs into query parameters.
+func roomNIDsAsArray(roomNIDs []types.RoomNID) []interface{} {
+	nids := make([]interface{}, len(roomNIDs))
+	for i := range roomNIDs {
+		nids[i] = int64(roomNIDs[i])
+	}
+	return nids
+}
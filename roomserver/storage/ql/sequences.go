@@ -0,0 +1,80 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const sequencesSchema = `
+-- QL has no sequences or auto-incrementing columns, so this table stores the
+-- last numeric ID that was assigned for each kind of NID instead.
+CREATE TABLE IF NOT EXISTS roomserver_sequences (
+    name string NOT NULL,
+    nid int64 NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_sequences_name_idx ON roomserver_sequences(name);
+`
+
+const insertSequenceSQL = "" +
+	"INSERT INTO roomserver_sequences (name, nid) VALUES ($1, $2)"
+
+const updateSequenceSQL = "" +
+	"UPDATE roomserver_sequences SET nid = nid + 1 WHERE name = $1"
+
+const selectSequenceSQL = "" +
+	"SELECT nid FROM roomserver_sequences WHERE name = $1"
+
+// nidSequence assigns increasing NIDs to the rows of a table. NIDs are never
+// reused, even if the row they were assigned to is deleted.
+type nidSequence struct {
+	name       string
+	updateStmt *sql.Stmt
+	selectStmt *sql.Stmt
+}
+
+// createSequence creates the named sequence if it doesn't exist already. The
+// first NID that the sequence assigns is one more than the given NID.
+func createSequence(db *sql.DB, name string, nid int64) error {
+	if _, err := db.Exec(sequencesSchema); err != nil {
+		return err
+	}
+	_, err := db.Exec(insertSequenceSQL, name, nid)
+	if sqlutil.IsQLUniqueConstraintViolation(err) { // the sequence already exists
+		return nil
+	}
+	return err
+}
+
+func prepareSequence(db *sql.DB, name string) (*nidSequence, error) {
+	s := &nidSequence{name: name}
+	return s, sqlutil.StatementList{
+		{&s.updateStmt, updateSequenceSQL},
+		{&s.selectStmt, selectSequenceSQL},
+	}.Prepare(db)
+}
+
+// next returns the next NID in the sequence.
+func (s *nidSequence) next(ctx context.Context, txn *sql.Tx) (nid int64, err error) {
+	if _, err = sqlutil.TxStmt(txn, s.updateStmt).ExecContext(ctx, s.name); err != nil {
+		return 0, err
+	}
+	err = sqlutil.TxStmt(txn, s.selectStmt).QueryRowContext(ctx, s.name).Scan(&nid)
+	return nid, err
+}
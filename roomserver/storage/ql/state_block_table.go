@@ -0,0 +1,177 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/util"
+)
+
+const stateDataSchema = `
+-- The state data map.
+-- Designed to give enough information to run the state resolution algorithm
+-- without hitting the database in the internal case.
+-- The type and state_key are included in the index to make it easier to
+-- lookup a specific (type, state_key) pair for an event. It also makes it easy
+-- to read the state for a given state_block_nid ordered by (type, state_key)
+-- which in turn makes it easier to merge state data blocks.
+CREATE TABLE IF NOT EXISTS roomserver_state_block (
+	-- The state snapshot NID that identifies this snapshot.
+	state_block_nid int64 NOT NULL,
+	-- The hex-encoded hash of the state block, which is used to enforce uniqueness.
+	-- The hash is generated in Dendrite and passed through to the database.
+	state_block_hash string NOT NULL,
+	-- A JSON list of the event NIDs contained within the state block.
+	event_nids blob NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_state_block_nid_idx ON roomserver_state_block(state_block_nid);
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_state_block_hash_idx ON roomserver_state_block(state_block_hash);
+`
+
+// Insert a new state block. The caller must first check that there isn't
+// already a block with the same hash, so that we can refer to the original
+// block instead. Like the Postgres sequence, a NID is used up either way.
+const insertStateDataSQL = "" +
+	"INSERT INTO roomserver_state_block (state_block_nid, state_block_hash, event_nids)" +
+	" VALUES ($1, $2, $3)"
+
+const selectStateDataNIDSQL = "" +
+	"SELECT state_block_nid FROM roomserver_state_block WHERE state_block_hash = $1"
+
+const bulkSelectStateBlockEntriesSQL = "" +
+	"SELECT state_block_nid, event_nids" +
+	" FROM roomserver_state_block WHERE state_block_nid IN ($1)"
+
+type stateBlockStatements struct {
+	db                     *sql.DB
+	stateBlockNIDs         *nidSequence
+	insertStateDataStmt    *sql.Stmt
+	selectStateDataNIDStmt *sql.Stmt
+	// bulkSelectStateBlockEntriesStmt *sql.Stmt - prepared at runtime due to variadic
+}
+
+func CreateStateBlockTable(db *sql.DB) error {
+	if _, err := db.Exec(stateDataSchema); err != nil {
+		return err
+	}
+	return createSequence(db, "roomserver_state_block", 0)
+}
+
+func PrepareStateBlockTable(db *sql.DB) (tables.StateBlock, error) {
+	stateBlockNIDs, err := prepareSequence(db, "roomserver_state_block")
+	if err != nil {
+		return nil, err
+	}
+	s := &stateBlockStatements{
+		db:             db,
+		stateBlockNIDs: stateBlockNIDs,
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertStateDataStmt, insertStateDataSQL},
+		{&s.selectStateDataNIDStmt, selectStateDataNIDSQL},
+	}.Prepare(db)
+}
+
+func (s *stateBlockStatements) BulkInsertStateData(
+	ctx context.Context, txn *sql.Tx,
+	entries types.StateEntries,
+) (id types.StateBlockNID, err error) {
+	entries = entries[:util.SortAndUnique(entries)]
+	nids := make(types.EventNIDs, entries.Len())
+	for i := range entries {
+		nids[i] = entries[i].EventNID
+	}
+	nidsJSON, err := json.Marshal(eventNIDsAsInt64s(nids))
+	if err != nil {
+		return 0, fmt.Errorf("json.Marshal: %w", err)
+	}
+	nid, err := s.stateBlockNIDs.next(ctx, txn)
+	if err != nil {
+		return 0, err
+	}
+	hash := hex.EncodeToString(nids.Hash())
+	err = sqlutil.TxStmt(txn, s.selectStateDataNIDStmt).QueryRowContext(ctx, hash).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+	stmt := sqlutil.TxStmt(txn, s.insertStateDataStmt)
+	if _, err = stmt.ExecContext(ctx, nid, hash, nidsJSON); err != nil {
+		return 0, err
+	}
+	return types.StateBlockNID(nid), nil
+}
+
+func (s *stateBlockStatements) BulkSelectStateBlockEntries(
+	ctx context.Context, txn *sql.Tx, stateBlockNIDs types.StateBlockNIDs,
+) ([][]types.EventNID, error) {
+	type stateBlock struct {
+		nid       types.StateBlockNID
+		eventNIDs []types.EventNID
+	}
+	blocks := make([]stateBlock, 0, len(stateBlockNIDs))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectStateBlockEntriesSQL, queryProvider(s.db, txn), stateBlockNIDsAsArray(stateBlockNIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var stateBlockNID types.StateBlockNID
+			var eventNIDsJSON string
+			for rows.Next() {
+				if err := rows.Scan(&stateBlockNID, &eventNIDsJSON); err != nil {
+					return err
+				}
+				block := stateBlock{nid: stateBlockNID}
+				if err := json.Unmarshal([]byte(eventNIDsJSON), &block.eventNIDs); err != nil {
+					return err
+				}
+				blocks = append(blocks, block)
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) != len(stateBlockNIDs) {
+		return nil, fmt.Errorf("storage: state data NIDs missing from the database (%d != %d)", len(blocks), len(stateBlockNIDs))
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].nid < blocks[j].nid
+	})
+	results := make([][]types.EventNID, len(blocks))
+	for i := range blocks {
+		results[i] = blocks[i].eventNIDs
+	}
+	return results, nil
+}
+
+// stateBlockNIDsAsArray converts the state block NIDs into query parameters.
+func stateBlockNIDsAsArray(stateBlockNIDs []types.StateBlockNID) []interface{} {
+	nids := make([]interface{}, len(stateBlockNIDs))
+	for i := range stateBlockNIDs {
+		nids[i] = int64(stateBlockNIDs[i])
+	}
+	return nids
+}
@@ -0,0 +1,461 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const stateSnapshotSchema = `
+-- The state of a room before an event.
+-- Stored as a list of state_block entries stored in a separate table.
+-- The actual state is constructed by combining all the state_block entries
+-- referenced by state_block_nids together. If the same state key tuple appears
+-- multiple times then the entry from the later state_block clobbers the earlier
+-- entries.
+-- This encoding format allows us to implement a delta encoding which is useful
+-- because room state tends to accumulate small changes over time. Although if
+-- the list of deltas becomes too long it becomes more efficient to encode
+-- the full state under single state_block_nid.
+CREATE TABLE IF NOT EXISTS roomserver_state_snapshots (
+	-- The state snapshot NID that identifies this snapshot.
+	state_snapshot_nid int64 NOT NULL,
+	-- The hex-encoded hash of the state snapshot, which is used to enforce uniqueness.
+	-- The hash is generated in Dendrite and passed through to the database.
+	state_snapshot_hash string NOT NULL,
+	-- The room NID that the snapshot belongs to.
+	room_nid int64 NOT NULL,
+	-- A JSON list of the state blocks contained within this snapshot.
+	state_block_nids blob NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_state_snapshots_nid_idx ON roomserver_state_snapshots(state_snapshot_nid);
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_state_snapshots_hash_idx ON roomserver_state_snapshots(state_snapshot_hash);
+`
+
+// Insert a new state snapshot. The caller must first check that there isn't
+// already a snapshot with the same hash, so that we can refer to the original
+// snapshot instead. Like the Postgres sequence, a NID is used up either way.
+const insertStateSQL = "" +
+	"INSERT INTO roomserver_state_snapshots (state_snapshot_nid, state_snapshot_hash, room_nid, state_block_nids)" +
+	" VALUES ($1, $2, $3, $4)"
+
+const selectStateNIDSQL = "" +
+	"SELECT state_snapshot_nid FROM roomserver_state_snapshots WHERE state_snapshot_hash = $1"
+
+const updateStateRoomNIDSQL = "" +
+	"UPDATE roomserver_state_snapshots SET room_nid = $1 WHERE state_snapshot_nid = $2"
+
+// Bulk state data NID lookup.
+// The results are sorted by state_snapshot_nid after querying, which means we
+// can use binary search over the result to lookup the state data NIDs for a
+// state snapshot NID.
+const bulkSelectStateBlockNIDsSQL = "" +
+	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
+	" WHERE state_snapshot_nid IN ($1)"
+
+// QL can't expand the JSON lists of state block and event NIDs in a query,
+// so the history visibility lookups below walk from the state snapshot to
+// the events in Go instead.
+const bulkSelectStateBlockEventNIDsSQL = "" +
+	"SELECT state_block_nid, event_nids FROM roomserver_state_block WHERE state_block_nid IN ($1)"
+
+// Event type NIDs are:
+// - 5: m.room.member as per https://github.com/matrix-org/dendrite/blob/c7f7aec4d07d59120d37d5b16a900f6d608a75c4/roomserver/storage/postgres/event_types_table.go#L40
+// - 7: m.room.history_visibility as per https://github.com/matrix-org/dendrite/blob/c7f7aec4d07d59120d37d5b16a900f6d608a75c4/roomserver/storage/postgres/event_types_table.go#L42
+const bulkSelectHistoryVisibilityEventsSQL = "" +
+	"SELECT event_nid, event_type_nid, event_state_key_nid, depth FROM roomserver_events" +
+	" WHERE (event_type_nid = 5 OR event_type_nid = 7) AND event_nid IN ($1)"
+
+const bulkSelectEventStateKeysForHistoryVisibilitySQL = "" +
+	"SELECT event_state_key_nid, event_state_key FROM roomserver_event_state_keys" +
+	" WHERE event_state_key_nid IN ($1)"
+
+const bulkSelectSnapshotsForHistoryVisibilitySQL = "" +
+	"SELECT event_id, state_snapshot_nid FROM roomserver_events WHERE event_id IN ($1)"
+
+const selectMembershipsForHistoryVisibilitySQL = "" +
+	"SELECT event_nid, event_id FROM roomserver_events" +
+	" WHERE event_state_key_nid = $1 AND room_nid = $2 AND event_type_nid = 5"
+
+const bulkSelectEventJSONForHistoryVisibilitySQL = "" +
+	"SELECT event_nid, event_json FROM roomserver_event_json WHERE event_nid IN ($1)"
+
+type stateSnapshotStatements struct {
+	db                                        *sql.DB
+	stateSnapshotNIDs                         *nidSequence
+	insertStateStmt                           *sql.Stmt
+	selectStateNIDStmt                        *sql.Stmt
+	updateStateRoomNIDStmt                    *sql.Stmt
+	selectMembershipsForHistoryVisibilityStmt *sql.Stmt
+	// bulkSelectStateBlockNIDsStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectStateBlockEventNIDsStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectHistoryVisibilityEventsStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectEventStateKeysForHistoryVisibilityStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectSnapshotsForHistoryVisibilityStmt *sql.Stmt - prepared at runtime due to variadic
+	// bulkSelectEventJSONForHistoryVisibilityStmt *sql.Stmt - prepared at runtime due to variadic
+}
+
+func CreateStateSnapshotTable(db *sql.DB) error {
+	if _, err := db.Exec(stateSnapshotSchema); err != nil {
+		return err
+	}
+	return createSequence(db, "roomserver_state_snapshots", 0)
+}
+
+func PrepareStateSnapshotTable(db *sql.DB) (*stateSnapshotStatements, error) {
+	stateSnapshotNIDs, err := prepareSequence(db, "roomserver_state_snapshots")
+	if err != nil {
+		return nil, err
+	}
+	s := &stateSnapshotStatements{
+		db:                db,
+		stateSnapshotNIDs: stateSnapshotNIDs,
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertStateStmt, insertStateSQL},
+		{&s.selectStateNIDStmt, selectStateNIDSQL},
+		{&s.updateStateRoomNIDStmt, updateStateRoomNIDSQL},
+		{&s.selectMembershipsForHistoryVisibilityStmt, selectMembershipsForHistoryVisibilitySQL},
+	}.Prepare(db)
+}
+
+func (s *stateSnapshotStatements) InsertState(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, nids types.StateBlockNIDs,
+) (stateNID types.StateSnapshotNID, err error) {
+	nids = nids[:util.SortAndUnique(nids)]
+	nidsJSON, err := json.Marshal(nids)
+	if err != nil {
+		return 0, fmt.Errorf("json.Marshal: %w", err)
+	}
+	nid, err := s.stateSnapshotNIDs.next(ctx, txn)
+	if err != nil {
+		return 0, err
+	}
+	hash := hex.EncodeToString(nids.Hash())
+	err = sqlutil.TxStmt(txn, s.selectStateNIDStmt).QueryRowContext(ctx, hash).Scan(&stateNID)
+	switch err {
+	case nil:
+		_, err = sqlutil.TxStmt(txn, s.updateStateRoomNIDStmt).ExecContext(ctx, int64(roomNID), int64(stateNID))
+		return stateNID, err
+	case sql.ErrNoRows:
+	default:
+		return 0, err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertStateStmt).ExecContext(ctx, nid, hash, int64(roomNID), nidsJSON)
+	if err != nil {
+		return 0, err
+	}
+	return types.StateSnapshotNID(nid), nil
+}
+
+func (s *stateSnapshotStatements) BulkSelectStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, stateNIDs []types.StateSnapshotNID,
+) ([]types.StateBlockNIDList, error) {
+	nids := make([]interface{}, len(stateNIDs))
+	for i := range stateNIDs {
+		nids[i] = int64(stateNIDs[i])
+	}
+	results := make([]types.StateBlockNIDList, 0, len(stateNIDs))
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectStateBlockNIDsSQL, queryProvider(s.db, txn), nids, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var stateBlockNIDsJSON string
+			for rows.Next() {
+				var result types.StateBlockNIDList
+				if err := rows.Scan(&result.StateSnapshotNID, &stateBlockNIDsJSON); err != nil {
+					return err
+				}
+				if err := json.Unmarshal([]byte(stateBlockNIDsJSON), &result.StateBlockNIDs); err != nil {
+					return err
+				}
+				results = append(results, result)
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(stateNIDs) {
+		return nil, types.MissingStateError(fmt.Sprintf("storage: state NIDs missing from the database (%d != %d)", len(results), len(stateNIDs)))
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].StateSnapshotNID < results[j].StateSnapshotNID
+	})
+	return results, nil
+}
+
+// selectStateEventNIDs returns the event NIDs in the state blocks of each of
+// the given state snapshots. Snapshots that don't exist are omitted.
+func (s *stateSnapshotStatements) selectStateEventNIDs(
+	ctx context.Context, txn *sql.Tx, stateNIDs []types.StateSnapshotNID,
+) (map[types.StateSnapshotNID][]types.EventNID, error) {
+	nids := make([]interface{}, len(stateNIDs))
+	for i := range stateNIDs {
+		nids[i] = int64(stateNIDs[i])
+	}
+	snapshots := make(map[types.StateSnapshotNID]types.StateBlockNIDs, len(stateNIDs))
+	var blockNIDs []interface{}
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectStateBlockNIDsSQL, queryProvider(s.db, txn), nids, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var stateNID types.StateSnapshotNID
+			var stateBlockNIDsJSON string
+			for rows.Next() {
+				if err := rows.Scan(&stateNID, &stateBlockNIDsJSON); err != nil {
+					return err
+				}
+				var stateBlockNIDs types.StateBlockNIDs
+				if err := json.Unmarshal([]byte(stateBlockNIDsJSON), &stateBlockNIDs); err != nil {
+					return err
+				}
+				snapshots[stateNID] = stateBlockNIDs
+				for _, blockNID := range stateBlockNIDs {
+					blockNIDs = append(blockNIDs, int64(blockNID))
+				}
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make(map[types.StateBlockNID][]types.EventNID, len(blockNIDs))
+	err = sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectStateBlockEventNIDsSQL, queryProvider(s.db, txn), blockNIDs, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var blockNID types.StateBlockNID
+			var eventNIDsJSON string
+			for rows.Next() {
+				if err := rows.Scan(&blockNID, &eventNIDsJSON); err != nil {
+					return err
+				}
+				var eventNIDs []types.EventNID
+				if err := json.Unmarshal([]byte(eventNIDsJSON), &eventNIDs); err != nil {
+					return err
+				}
+				blocks[blockNID] = eventNIDs
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[types.StateSnapshotNID][]types.EventNID, len(snapshots))
+	for stateNID, stateBlockNIDs := range snapshots {
+		for _, blockNID := range stateBlockNIDs {
+			result[stateNID] = append(result[stateNID], blocks[blockNID]...)
+		}
+	}
+	return result, nil
+}
+
+// BulkSelectStateForHistoryVisibility looks up both the history visibility event
+// and relevant membership events from a given domain name from a given state
+// snapshot. This is used to optimise the helpers.CheckServerAllowedToSeeEvent
+// function.
+func (s *stateSnapshotStatements) BulkSelectStateForHistoryVisibility(
+	ctx context.Context, txn *sql.Tx, stateSnapshotNID types.StateSnapshotNID, domain string,
+) ([]types.EventNID, error) {
+	snapshots, err := s.selectStateEventNIDs(ctx, txn, []types.StateSnapshotNID{stateSnapshotNID})
+	if err != nil {
+		return nil, err
+	}
+	eventNIDs := eventNIDsAsArray(snapshots[stateSnapshotNID])
+	type stateEvent struct {
+		eventNID         types.EventNID
+		eventTypeNID     types.EventTypeNID
+		eventStateKeyNID types.EventStateKeyNID
+		depth            int64
+	}
+	var events []stateEvent
+	var stateKeyNIDs []interface{}
+	err = sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectHistoryVisibilityEventsSQL, queryProvider(s.db, txn), eventNIDs, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			for rows.Next() {
+				var ev stateEvent
+				if err := rows.Scan(&ev.eventNID, &ev.eventTypeNID, &ev.eventStateKeyNID, &ev.depth); err != nil {
+					return err
+				}
+				events = append(events, ev)
+				if ev.eventTypeNID == types.MRoomMemberNID {
+					stateKeyNIDs = append(stateKeyNIDs, int64(ev.eventStateKeyNID))
+				}
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	stateKeys := make(map[types.EventStateKeyNID]string, len(stateKeyNIDs))
+	err = sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectEventStateKeysForHistoryVisibilitySQL, queryProvider(s.db, txn), stateKeyNIDs, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var stateKeyNID types.EventStateKeyNID
+			var stateKey string
+			for rows.Next() {
+				if err := rows.Scan(&stateKeyNID, &stateKey); err != nil {
+					return err
+				}
+				stateKeys[stateKeyNID] = stateKey
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].depth < events[j].depth
+	})
+	results := make([]types.EventNID, 0, 16)
+	for _, ev := range events {
+		if ev.eventTypeNID == types.MRoomMemberNID && !strings.HasSuffix(stateKeys[ev.eventStateKeyNID], ":"+domain) {
+			continue
+		}
+		results = append(results, ev.eventNID)
+	}
+	return results, nil
+}
+
+// BulkSelectMembershipForHistoryVisibility is an optimization to get membership events for a specific user for defined set of events.
+// Returns a map from the event_id of the event we want the membership event for to the membership event.
+func (s *stateSnapshotStatements) BulkSelectMembershipForHistoryVisibility(
+	ctx context.Context, txn *sql.Tx, userNID types.EventStateKeyNID, roomInfo *types.RoomInfo, eventIDs ...string,
+) (map[string]*types.HeaderedEvent, error) {
+	eventSnapshots := make(map[string]types.StateSnapshotNID, len(eventIDs))
+	var stateNIDs []types.StateSnapshotNID
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectSnapshotsForHistoryVisibilitySQL, queryProvider(s.db, txn), stringsAsParams(eventIDs), sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var eventID string
+			var stateNID types.StateSnapshotNID
+			for rows.Next() {
+				if err := rows.Scan(&eventID, &stateNID); err != nil {
+					return err
+				}
+				eventSnapshots[eventID] = stateNID
+				stateNIDs = append(stateNIDs, stateNID)
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := s.selectStateEventNIDs(ctx, txn, stateNIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find all of the user's membership events in the room, so that we can
+	// pick out the ones which are in the state before each event.
+	stmt := sqlutil.TxStmt(txn, s.selectMembershipsForHistoryVisibilityStmt)
+	rows, err := stmt.QueryContext(ctx, int64(userNID), int64(roomInfo.RoomNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "BulkSelectMembershipForHistoryVisibility: rows.close() failed")
+	membershipEventIDs := make(map[types.EventNID]string)
+	for rows.Next() {
+		var eventNID types.EventNID
+		var eventID string
+		if err = rows.Scan(&eventNID, &eventID); err != nil {
+			return nil, err
+		}
+		membershipEventIDs[eventNID] = eventID
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	eventMemberships := make(map[string]types.EventNID, len(eventIDs))
+	var membershipNIDs []interface{}
+	for eventID, stateNID := range eventSnapshots {
+		for _, eventNID := range snapshots[stateNID] {
+			if _, ok := membershipEventIDs[eventNID]; ok {
+				eventMemberships[eventID] = eventNID
+				membershipNIDs = append(membershipNIDs, int64(eventNID))
+			}
+		}
+	}
+	eventJSONs := make(map[types.EventNID][]byte, len(membershipNIDs))
+	err = sqlutil.RunLimitedVariablesQuery(
+		ctx, bulkSelectEventJSONForHistoryVisibilitySQL, queryProvider(s.db, txn), membershipNIDs, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var eventNID types.EventNID
+			var eventJSON string
+			for rows.Next() {
+				if err := rows.Scan(&eventNID, &eventJSON); err != nil {
+					return err
+				}
+				eventJSONs[eventNID] = []byte(eventJSON)
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*types.HeaderedEvent, len(eventIDs))
+	knownEvents := make(map[types.EventNID]*types.HeaderedEvent, len(eventIDs))
+	verImpl, err := gomatrixserverlib.GetRoomVersion(roomInfo.RoomVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	for eventID, membershipNID := range eventMemberships {
+		evJson := eventJSONs[membershipNID]
+		if len(evJson) == 0 {
+			result[eventID] = &types.HeaderedEvent{}
+			continue
+		}
+		// If we already know this event, don't try to marshal the json again
+		if ev, ok := knownEvents[membershipNID]; ok {
+			result[eventID] = ev
+			continue
+		}
+		event, err := verImpl.NewEventFromTrustedJSON(evJson, false)
+		if err != nil {
+			result[eventID] = &types.HeaderedEvent{}
+			// not fatal
+			continue
+		}
+		he := &types.HeaderedEvent{PDU: event}
+		result[eventID] = he
+		knownEvents[membershipNID] = he
+	}
+	return result, nil
+}
@@ -47,6 +47,7 @@ type Database struct {
 	PublishedTable     tables.Published
 	Purge              tables.Purge
 	UserRoomKeyTable   tables.UserRoomKeys
+	KnockServersTable  tables.KnockServers
 	GetRoomUpdaterFn   func(ctx context.Context, roomInfo *types.RoomInfo) (*RoomUpdater, error)
 }
 
@@ -714,8 +715,17 @@ func (d *Database) GetOrCreateRoomInfo(ctx context.Context, event gomatrixserver
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 	if roomVersion != "" {
 		d.Cache.StoreRoomVersion(event.RoomID().String(), roomVersion)
+	} else {
+		// This isn't the create event, so the version must already be
+		// known, either from the cache or the rooms table.
+		if roomVersion, err = d.GetRoomVersion(ctx, event.RoomID().String()); err != nil {
+			return nil, err
+		}
 	}
 	return &types.RoomInfo{
 		RoomVersion: roomVersion,
@@ -854,6 +864,22 @@ func (d *Database) GetPublishedRoom(ctx context.Context, roomID string) (bool, e
 	return d.PublishedTable.SelectPublishedFromRoomID(ctx, nil, roomID)
 }
 
+func (d *Database) StoreKnockServers(ctx context.Context, roomID, userID string, serverNames []spec.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.KnockServersTable.UpsertKnockServers(ctx, txn, roomID, userID, serverNames)
+	})
+}
+
+func (d *Database) GetKnockServers(ctx context.Context, roomID, userID string) ([]spec.ServerName, error) {
+	return d.KnockServersTable.SelectKnockServers(ctx, nil, roomID, userID)
+}
+
+func (d *Database) DeleteKnockServers(ctx context.Context, roomID, userID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.KnockServersTable.DeleteKnockServers(ctx, txn, roomID, userID)
+	})
+}
+
 func (d *Database) GetPublishedRooms(ctx context.Context, networkID string, includeAllNetworks bool) ([]string, error) {
 	return d.PublishedTable.SelectAllPublishedRooms(ctx, nil, networkID, true, includeAllNetworks)
 }
@@ -902,7 +928,9 @@ func (d *Database) assignRoomNID(
 		return 0, err
 	}
 	d.Cache.StoreRoomServerRoomID(roomNID, roomID)
-	d.Cache.StoreRoomVersion(roomID, roomVersion)
+	if roomVersion != "" {
+		d.Cache.StoreRoomVersion(roomID, roomVersion)
+	}
 	return roomNID, nil
 }
 
@@ -1680,6 +1708,56 @@ func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
 	})
 }
 
+// RedactExpiredEvents replaces the given events in the room with their redacted form, removing
+// their content once they have expired under the room's retention policy. The events are kept in
+// the room DAG. State events are never redacted, as they are needed to calculate the room state.
+func (d *Database) RedactExpiredEvents(ctx context.Context, roomID string, eventIDs []string) error {
+	roomInfo, err := d.RoomInfo(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("d.RoomInfo: %w", err)
+	}
+	if roomInfo == nil {
+		return fmt.Errorf("room %s does not exist", roomID)
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(roomInfo.RoomVersion)
+	if err != nil {
+		return err
+	}
+	eventMetadata, err := d.EventNIDs(ctx, eventIDs)
+	if err != nil {
+		return fmt.Errorf("d.EventNIDs: %w", err)
+	}
+	eventNIDs := make([]types.EventNID, 0, len(eventMetadata))
+	for _, metadata := range eventMetadata {
+		if metadata.RoomNID == roomInfo.RoomNID {
+			eventNIDs = append(eventNIDs, metadata.EventNID)
+		}
+	}
+	if len(eventNIDs) == 0 {
+		return nil
+	}
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		eventJSONs, err := d.EventJSONTable.BulkSelectEventJSON(ctx, txn, eventNIDs)
+		if err != nil {
+			return fmt.Errorf("d.EventJSONTable.BulkSelectEventJSON: %w", err)
+		}
+		for _, eventJSON := range eventJSONs {
+			if gjson.GetBytes(eventJSON.EventJSON, "state_key").Exists() {
+				continue
+			}
+			redactedJSON, err := verImpl.RedactEventJSON(eventJSON.EventJSON)
+			if err != nil {
+				return fmt.Errorf("verImpl.RedactEventJSON: %w", err)
+			}
+			if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventJSON.EventNID, redactedJSON); err != nil {
+				return fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
+			}
+			d.Cache.InvalidateRoomServerEvent(eventJSON.EventNID)
+		}
+		return nil
+	})
+}
+
 func (d *Database) UpgradeRoom(ctx context.Context, oldRoomID, newRoomID, eventSender string) error {
 
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
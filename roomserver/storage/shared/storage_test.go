@@ -15,6 +15,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/ql"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -24,7 +25,7 @@ import (
 func mustCreateRoomserverDatabase(t *testing.T, dbType test.DBType) (*shared.Database, func()) {
 	t.Helper()
 
-	connStr, clearDB := test.PrepareDBConnectionString(t)
+	connStr, clearDB := test.PrepareDBConnectionString(t, dbType)
 	dbOpts := &config.DatabaseOptions{ConnectionString: config.DataSource(connStr)}
 
 	writer := sqlutil.NewDummyWriter()
@@ -36,6 +37,22 @@ func mustCreateRoomserverDatabase(t *testing.T, dbType test.DBType) (*shared.Dat
 	var userRoomKeys tables.UserRoomKeys
 	var roomsTable tables.Rooms
 	switch dbType {
+	case test.DBTypeQL:
+		err = ql.CreateRoomsTable(db)
+		assert.NoError(t, err)
+		err = ql.CreateEventStateKeysTable(db)
+		assert.NoError(t, err)
+		err = ql.CreateMembershipTable(db)
+		assert.NoError(t, err)
+		err = ql.CreateUserRoomKeysTable(db)
+		assert.NoError(t, err)
+		roomsTable, err = ql.PrepareRoomsTable(db)
+		assert.NoError(t, err)
+		membershipTable, err = ql.PrepareMembershipTable(db)
+		assert.NoError(t, err)
+		stateKeyTable, err = ql.PrepareEventStateKeysTable(db)
+		assert.NoError(t, err)
+		userRoomKeys, err = ql.PrepareUserRoomKeysTable(db)
 	case test.DBTypePostgres:
 		err = postgres.CreateRoomsTable(db)
 		assert.NoError(t, err)
@@ -24,12 +24,15 @@ import (
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/ql"
 	"github.com/matrix-org/dendrite/setup/config"
 )
 
 // Open opens a database connection.
 func Open(ctx context.Context, conMan *sqlutil.Connections, dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches) (Database, error) {
 	switch {
+	case dbProperties.ConnectionString.IsFile():
+		return ql.Open(ctx, conMan, dbProperties, cache)
 	case dbProperties.ConnectionString.IsPostgres():
 		return postgres.Open(ctx, conMan, dbProperties, cache)
 	default:
@@ -7,6 +7,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/ql"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -16,13 +17,17 @@ import (
 
 func mustCreateEventTypesTable(t *testing.T, dbType test.DBType) (tables.EventTypes, func()) {
 	t.Helper()
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
 	}, sqlutil.NewDummyWriter())
 	assert.NoError(t, err)
 	var tab tables.EventTypes
 	switch dbType {
+	case test.DBTypeQL:
+		err = ql.CreateEventTypesTable(db)
+		assert.NoError(t, err)
+		tab, err = ql.PrepareEventTypesTable(db)
 	case test.DBTypePostgres:
 		err = postgres.CreateEventTypesTable(db)
 		assert.NoError(t, err)
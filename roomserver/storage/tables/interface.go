@@ -214,6 +214,15 @@ type Purge interface {
 	) error
 }
 
+// KnockServers stores the servers that knocks on rooms this server isn't
+// joined to were made through.
+type KnockServers interface {
+	UpsertKnockServers(ctx context.Context, txn *sql.Tx, roomID, userID string, serverNames []spec.ServerName) error
+	// SelectKnockServers returns nil if there are no servers stored for the knock.
+	SelectKnockServers(ctx context.Context, txn *sql.Tx, roomID, userID string) ([]spec.ServerName, error)
+	DeleteKnockServers(ctx context.Context, txn *sql.Tx, roomID, userID string) error
+}
+
 type UserRoomKeys interface {
 	// InsertUserRoomPrivatePublicKey inserts the given private key as well as the public key for it. This should be used
 	// when creating keys locally.
@@ -9,6 +9,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/ql"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -17,13 +18,17 @@ import (
 
 func mustCreateInviteTable(t *testing.T, dbType test.DBType) (tables.Invites, func()) {
 	t.Helper()
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
 	}, sqlutil.NewDummyWriter())
 	assert.NoError(t, err)
 	var tab tables.Invites
 	switch dbType {
+	case test.DBTypeQL:
+		err = ql.CreateInvitesTable(db)
+		assert.NoError(t, err)
+		tab, err = ql.PrepareInvitesTable(db)
 	case test.DBTypePostgres:
 		err = postgres.CreateInvitesTable(db)
 		assert.NoError(t, err)
@@ -0,0 +1,67 @@
+package tables_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/ql"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+)
+
+func mustCreateKnockServersTable(t *testing.T, dbType test.DBType) (tab tables.KnockServers, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewDummyWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypeQL:
+		err = ql.CreateKnockServersTable(db)
+		assert.NoError(t, err)
+		tab, err = ql.PrepareKnockServersTable(db)
+	case test.DBTypePostgres:
+		err = postgres.CreateKnockServersTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PrepareKnockServersTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestKnockServersTable(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateKnockServersTable(t, dbType)
+		defer close()
+
+		serverNames, err := tab.SelectKnockServers(ctx, nil, room.ID, alice.ID)
+		assert.NoError(t, err)
+		assert.Nil(t, serverNames)
+
+		err = tab.UpsertKnockServers(ctx, nil, room.ID, alice.ID, []spec.ServerName{"a", "b"})
+		assert.NoError(t, err)
+		err = tab.UpsertKnockServers(ctx, nil, room.ID, alice.ID, []spec.ServerName{"c", "a"})
+		assert.NoError(t, err)
+		serverNames, err = tab.SelectKnockServers(ctx, nil, room.ID, alice.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []spec.ServerName{"c", "a"}, serverNames)
+
+		err = tab.DeleteKnockServers(ctx, nil, room.ID, alice.ID)
+		assert.NoError(t, err)
+		serverNames, err = tab.SelectKnockServers(ctx, nil, room.ID, alice.ID)
+		assert.NoError(t, err)
+		assert.Nil(t, serverNames)
+	})
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/ql"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -16,12 +17,20 @@ import (
 
 func mustCreateMembershipTable(t *testing.T, dbType test.DBType) (tab tables.Membership, stateKeyTab tables.EventStateKeys, close func()) {
 	t.Helper()
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
 	}, sqlutil.NewDummyWriter())
 	assert.NoError(t, err)
 	switch dbType {
+	case test.DBTypeQL:
+		err = ql.CreateEventStateKeysTable(db)
+		assert.NoError(t, err)
+		err = ql.CreateMembershipTable(db)
+		assert.NoError(t, err)
+		tab, err = ql.PrepareMembershipTable(db)
+		assert.NoError(t, err)
+		stateKeyTab, err = ql.PrepareEventStateKeysTable(db)
 	case test.DBTypePostgres:
 		err = postgres.CreateEventStateKeysTable(db)
 		assert.NoError(t, err)
@@ -6,6 +6,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/ql"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -15,12 +16,27 @@ import (
 
 func mustCreateStateSnapshotTable(t *testing.T, dbType test.DBType) (tab tables.StateSnapshot, close func()) {
 	t.Helper()
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
 	}, sqlutil.NewDummyWriter())
 	assert.NoError(t, err)
 	switch dbType {
+	case test.DBTypeQL:
+		// for the PostgreSQL history visibility optimisation to work,
+		// we also need some other tables to exist
+		err = ql.CreateEventStateKeysTable(db)
+		assert.NoError(t, err)
+		err = ql.CreateEventsTable(db)
+		assert.NoError(t, err)
+		err = ql.CreateEventJSONTable(db)
+		assert.NoError(t, err)
+		err = ql.CreateStateBlockTable(db)
+		assert.NoError(t, err)
+		// ... and then the snapshot table itself
+		err = ql.CreateStateSnapshotTable(db)
+		assert.NoError(t, err)
+		tab, err = ql.PrepareStateSnapshotTable(db)
 	case test.DBTypePostgres:
 		// for the PostgreSQL history visibility optimisation to work,
 		// we also need some other tables to exist
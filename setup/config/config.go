@@ -59,6 +59,7 @@ type Dendrite struct {
 	FederationAPI FederationAPI `yaml:"federation_api"`
 	KeyServer     KeyServer     `yaml:"key_server"`
 	MediaAPI      MediaAPI      `yaml:"media_api"`
+	RelayAPI      RelayAPI      `yaml:"relay_api"`
 	RoomServer    RoomServer    `yaml:"room_server"`
 	SyncAPI       SyncAPI       `yaml:"sync_api"`
 	UserAPI       UserAPI       `yaml:"user_api"`
@@ -115,14 +116,16 @@ type Path string
 // A DataSource for opening a postgresql database using lib/pq.
 type DataSource string
 
-func (d DataSource) IsSQLite() bool {
+// IsFile returns true if the data source is a file: URI, which is stored in
+// a file using the embedded database engine.
+func (d DataSource) IsFile() bool {
 	return strings.HasPrefix(string(d), "file:")
 }
 
 func (d DataSource) IsPostgres() bool {
 	// commented line may not always be true?
 	// return strings.HasPrefix(string(d), "postgres:")
-	return !d.IsSQLite()
+	return !d.IsFile()
 }
 
 // A Topic in kafka.
@@ -316,6 +319,7 @@ func (c *Dendrite) Defaults(opts DefaultOpts) {
 	c.FederationAPI.Defaults(opts)
 	c.KeyServer.Defaults(opts)
 	c.MediaAPI.Defaults(opts)
+	c.RelayAPI.Defaults(opts)
 	c.RoomServer.Defaults(opts)
 	c.SyncAPI.Defaults(opts)
 	c.UserAPI.Defaults(opts)
@@ -331,7 +335,7 @@ func (c *Dendrite) Verify(configErrs *ConfigErrors) {
 		&c.Global, &c.ClientAPI, &c.FederationAPI,
 		&c.KeyServer, &c.MediaAPI, &c.RoomServer,
 		&c.SyncAPI, &c.UserAPI,
-		&c.AppServiceAPI,
+		&c.AppServiceAPI, &c.RelayAPI,
 	} {
 		c.Verify(configErrs)
 	}
@@ -343,6 +347,7 @@ func (c *Dendrite) Wiring() {
 	c.FederationAPI.Matrix = &c.Global
 	c.KeyServer.Matrix = &c.Global
 	c.MediaAPI.Matrix = &c.Global
+	c.RelayAPI.Matrix = &c.Global
 	c.RoomServer.Matrix = &c.Global
 	c.SyncAPI.Matrix = &c.Global
 	c.UserAPI.Matrix = &c.Global
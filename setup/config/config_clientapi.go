@@ -2,6 +2,9 @@ package config
 
 import (
 	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -54,6 +57,9 @@ type ClientAPI struct {
 
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
+
+	// Single sign-on options
+	SSO SSO `yaml:"sso"`
 }
 
 func (c *ClientAPI) Defaults(opts DefaultOpts) {
@@ -72,6 +78,7 @@ func (c *ClientAPI) Defaults(opts DefaultOpts) {
 func (c *ClientAPI) Verify(configErrs *ConfigErrors) {
 	c.TURN.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
+	c.SSO.Verify(configErrs)
 	if c.RecaptchaEnabled {
 		if c.RecaptchaSiteVerifyAPI == "" {
 			c.RecaptchaSiteVerifyAPI = "https://www.google.com/recaptcha/api/siteverify"
@@ -146,12 +153,48 @@ type RateLimiting struct {
 	// A list of users that are exempt from rate limiting, i.e. if you want
 	// to run Mjolnir or other bots.
 	ExemptUserIDs []string `yaml:"exempt_user_ids"`
+
+	// Where to keep track of requests, either "memory" or "nats". The NATS
+	// backend shares the limits between all processes using the same NATS
+	// server. default: memory
+	Backend string `yaml:"backend"`
+
+	// Limits for specific classes of endpoints. Unset values fall back to
+	// the threshold and cooloff above.
+	Login        RateLimitBucket `yaml:"login"`
+	Registration RateLimitBucket `yaml:"registration"`
+	Message      RateLimitBucket `yaml:"message"`
+	Join         RateLimitBucket `yaml:"join"`
+	Invite       RateLimitBucket `yaml:"invite"`
+	MediaUpload  RateLimitBucket `yaml:"media_upload"`
+}
+
+// RateLimitBucket overrides the rate limits for a class of endpoints.
+type RateLimitBucket struct {
+	Threshold int64 `yaml:"threshold"`
+	CooloffMS int64 `yaml:"cooloff_ms"`
 }
 
+const (
+	// RateLimitingMemory keeps rate limiting state in memory
+	RateLimitingMemory = "memory"
+	// RateLimitingNATS keeps rate limiting state in a NATS key-value bucket
+	RateLimitingNATS = "nats"
+)
+
 func (r *RateLimiting) Verify(configErrs *ConfigErrors) {
 	if r.Enabled {
 		checkPositive(configErrs, "client_api.rate_limiting.threshold", r.Threshold)
 		checkPositive(configErrs, "client_api.rate_limiting.cooloff_ms", r.CooloffMS)
+		for name, bucket := range r.Buckets() {
+			checkPositive(configErrs, "client_api.rate_limiting."+name+".threshold", bucket.Threshold)
+			checkPositive(configErrs, "client_api.rate_limiting."+name+".cooloff_ms", bucket.CooloffMS)
+		}
+		switch r.Backend {
+		case RateLimitingMemory, RateLimitingNATS:
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "client_api.rate_limiting.backend", r.Backend))
+		}
 	}
 }
 
@@ -159,4 +202,155 @@ func (r *RateLimiting) Defaults() {
 	r.Enabled = true
 	r.Threshold = 5
 	r.CooloffMS = 500
+	r.Backend = RateLimitingMemory
+}
+
+// Buckets returns the endpoint class limits by their config key.
+func (r *RateLimiting) Buckets() map[string]RateLimitBucket {
+	return map[string]RateLimitBucket{
+		"login":        r.Login,
+		"registration": r.Registration,
+		"message":      r.Message,
+		"join":         r.Join,
+		"invite":       r.Invite,
+		"media_upload": r.MediaUpload,
+	}
+}
+
+type SSO struct {
+	// Is single sign-on enabled or disabled?
+	Enabled bool `yaml:"enabled"`
+
+	// The URL identity providers redirect users back to after they signed in.
+	// Defaults to https://<server_name>/_matrix/client/v3/login/sso/callback,
+	// using the well-known client name instead of the server name if it is set.
+	CallbackURL string `yaml:"callback_url"`
+
+	// The ID of the identity provider to use if the client doesn't pick one.
+	// Defaults to the first identity provider.
+	DefaultProviderID string `yaml:"default_provider"`
+
+	// The OpenID Connect identity providers users can sign in with.
+	Providers []IdentityProvider `yaml:"providers"`
+
+	// The clients users may be sent back to with a login token after they
+	// signed in, e.g. https://app.element.io/. The redirectUrl given by the
+	// client must have the same scheme and host and start with the same path.
+	ClientRedirectURLs []string `yaml:"client_redirect_urls"`
+}
+
+type IdentityProvider struct {
+	// The ID of the identity provider, which is shown to clients and stored
+	// with the identities of users. It mustn't be changed once in use.
+	ID string `yaml:"id"`
+
+	// The human-readable name shown to users.
+	Name string `yaml:"name"`
+
+	// An optional mxc:// URI of an icon for the identity provider.
+	Icon string `yaml:"icon"`
+
+	// An optional brand hint for clients, e.g. "github", see MSC2858.
+	Brand string `yaml:"brand"`
+
+	// The HTTPS issuer URL. The OpenID Connect configuration is discovered from
+	// <issuer>/.well-known/openid-configuration.
+	Issuer string `yaml:"issuer"`
+
+	// The credentials of the client registered at the identity provider.
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+
+	// The scopes to request. Defaults to "openid", "profile" and "email".
+	Scopes []string `yaml:"scopes"`
+
+	// The claim the localpart of new users is derived from. Defaults to
+	// "preferred_username".
+	LocalpartClaim string `yaml:"localpart_claim"`
+
+	// The claim the display name of new users is taken from. Defaults to "name".
+	DisplayNameClaim string `yaml:"display_name_claim"`
+
+	// Whether a user signing in for the first time may take over an existing
+	// account with the same localpart. Only enable this if the identity provider
+	// is trusted to assert the usernames of all existing users.
+	AllowExistingUsers bool `yaml:"allow_existing_users"`
+}
+
+// identityProviderIDRegex is the format of identity provider IDs, as defined by the spec.
+var identityProviderIDRegex = regexp.MustCompile(`^[a-zA-Z0-9._~-]{1,255}$`)
+
+func (s *SSO) Verify(configErrs *ConfigErrors) {
+	if !s.Enabled {
+		return
+	}
+	if len(s.Providers) == 0 {
+		configErrs.Add("client_api.sso.providers must contain at least one identity provider if single sign-on is enabled")
+	}
+	if len(s.ClientRedirectURLs) == 0 {
+		configErrs.Add("client_api.sso.client_redirect_urls must contain at least one client URL if single sign-on is enabled")
+	}
+	for i, clientURL := range s.ClientRedirectURLs {
+		if u, err := url.Parse(clientURL); err != nil || !u.IsAbs() || u.Host == "" {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("client_api.sso.client_redirect_urls[%d]", i), clientURL))
+		}
+	}
+	if s.CallbackURL != "" {
+		if u, err := url.Parse(s.CallbackURL); err != nil || !u.IsAbs() {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "client_api.sso.callback_url", s.CallbackURL))
+		}
+	}
+	ids := make(map[string]struct{}, len(s.Providers))
+	for i := range s.Providers {
+		p := &s.Providers[i]
+		key := fmt.Sprintf("client_api.sso.providers[%d]", i)
+		if !identityProviderIDRegex.MatchString(p.ID) {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".id", p.ID))
+		}
+		if _, ok := ids[p.ID]; ok {
+			configErrs.Add(fmt.Sprintf("duplicate identity provider ID %q in %s", p.ID, "client_api.sso.providers"))
+		}
+		ids[p.ID] = struct{}{}
+		checkNotEmpty(configErrs, key+".name", p.Name)
+		checkNotEmpty(configErrs, key+".client_id", p.ClientID)
+		if u, err := url.Parse(p.Issuer); err != nil || u.Scheme != "https" || u.Host == "" {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".issuer", p.Issuer))
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "profile", "email"}
+		}
+		if p.LocalpartClaim == "" {
+			p.LocalpartClaim = "preferred_username"
+		}
+		if p.DisplayNameClaim == "" {
+			p.DisplayNameClaim = "name"
+		}
+	}
+	if s.DefaultProviderID == "" && len(s.Providers) > 0 {
+		s.DefaultProviderID = s.Providers[0].ID
+	}
+	if _, ok := ids[s.DefaultProviderID]; !ok && len(s.Providers) > 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "client_api.sso.default_provider", s.DefaultProviderID))
+	}
+}
+
+// IsAllowedRedirectURL returns true if users may be sent back to the given URL
+// with a login token after they signed in.
+func (s *SSO) IsAllowedRedirectURL(redirectURL *url.URL) bool {
+	path := redirectURL.Path
+	if path == "" {
+		path = "/"
+	}
+	for _, clientURL := range s.ClientRedirectURLs {
+		allowed, err := url.Parse(clientURL)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(allowed.Scheme, redirectURL.Scheme) &&
+			strings.EqualFold(allowed.Host, redirectURL.Host) &&
+			strings.HasPrefix(path, allowed.Path) {
+			return true
+		}
+	}
+	return false
 }
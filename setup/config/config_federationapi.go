@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
@@ -18,6 +20,20 @@ type FederationAPI struct {
 	// The default value is 16 if not specified, which is circa 18 hours.
 	FederationMaxRetries uint32 `yaml:"send_max_retries"`
 
+	// P2P Feature: How many consecutive failures that we should tolerate when
+	// sending federation requests to a specific server until we should assume they
+	// are offline. If we assume they are offline then we will attempt to send
+	// messages to their relay server if we know of one that is appropriate.
+	P2PFederationRetriesUntilAssumedOffline uint32 `yaml:"p2p_retries_until_assumed_offline"`
+
+	// EnableRelays allows transactions for destinations which are assumed to be
+	// offline to be sent to their known relay servers instead.
+	EnableRelays bool `yaml:"enable_relays"`
+
+	// The relay servers which store transactions for each destination while it
+	// is offline. Only used if EnableRelays is set.
+	DestinationRelays []DestinationRelays `yaml:"destination_relays"`
+
 	// FederationDisableTLSValidation disables the validation of X.509 TLS certs
 	// on remote federation endpoints. This is not recommended in production!
 	DisableTLSValidation bool `yaml:"disable_tls_validation"`
@@ -33,12 +49,18 @@ type FederationAPI struct {
 
 	// Should we prefer direct key fetches over perspective ones?
 	PreferDirectFetch bool `yaml:"prefer_direct_fetch"`
+
+	// Rate limits for inbound federation requests, per origin server.
+	RateLimiting FederationRateLimiting `yaml:"rate_limiting"`
 }
 
 func (c *FederationAPI) Defaults(opts DefaultOpts) {
 	c.FederationMaxRetries = 16
+	c.P2PFederationRetriesUntilAssumedOffline = 1
+	c.EnableRelays = false
 	c.DisableTLSValidation = false
 	c.DisableHTTPKeepalives = false
+	c.RateLimiting.Defaults()
 	if opts.Generate {
 		c.KeyPerspectives = KeyPerspectives{
 			{
@@ -65,6 +87,60 @@ func (c *FederationAPI) Verify(configErrs *ConfigErrors) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "federation_api.database.connection_string", string(c.Database.ConnectionString))
 	}
+	c.RateLimiting.Verify(configErrs)
+	for _, destination := range c.DestinationRelays {
+		checkNotEmpty(configErrs, "federation_api.destination_relays.server_name", string(destination.ServerName))
+		if len(destination.RelayServers) == 0 {
+			configErrs.Add(fmt.Sprintf("missing config key %q for %s", "federation_api.destination_relays.relay_servers", destination.ServerName))
+		}
+	}
+}
+
+// DestinationRelays are the relay servers of a remote server.
+type DestinationRelays struct {
+	// The remote server
+	ServerName spec.ServerName `yaml:"server_name"`
+	// The relay servers which store transactions for the remote server
+	RelayServers []spec.ServerName `yaml:"relay_servers"`
+}
+
+// FederationRateLimiting limits the inbound federation requests of each origin
+// server. Transactions sent to /send aren't rate limited: senders only have one
+// transaction in flight at a time, and turning them away delays federation.
+type FederationRateLimiting struct {
+	// Is rate limiting enabled or disabled?
+	Enabled bool `yaml:"enabled"`
+
+	// How many "slots" an origin server has to make requests
+	Threshold int64 `yaml:"threshold"`
+
+	// The cooloff period in milliseconds after a request before the "slot"
+	// is freed again
+	CooloffMS int64 `yaml:"cooloff_ms"`
+
+	// Where to keep track of requests, either "memory" or "nats". The NATS
+	// backend shares the limits between all processes using the same NATS
+	// server. default: memory
+	Backend string `yaml:"backend"`
+}
+
+func (r *FederationRateLimiting) Defaults() {
+	r.Enabled = true
+	r.Threshold = 50
+	r.CooloffMS = 1000
+	r.Backend = RateLimitingMemory
+}
+
+func (r *FederationRateLimiting) Verify(configErrs *ConfigErrors) {
+	if r.Enabled {
+		checkPositive(configErrs, "federation_api.rate_limiting.threshold", r.Threshold)
+		checkPositive(configErrs, "federation_api.rate_limiting.cooloff_ms", r.CooloffMS)
+		switch r.Backend {
+		case RateLimitingMemory, RateLimitingNATS:
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "federation_api.rate_limiting.backend", r.Backend))
+		}
+	}
 }
 
 // The config for setting a proxy to use for server->server requests
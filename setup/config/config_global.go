@@ -132,6 +132,17 @@ func (c *Global) Verify(configErrs *ConfigErrors) {
 	c.Cache.Verify(configErrs)
 }
 
+// ClientAPIBaseURL returns the URL users reach the client API at, for links
+// which are opened in a browser. This is the well-known client name if it is
+// configured.
+func (c *Global) ClientAPIBaseURL() string {
+	base := c.WellKnownClientName
+	if base == "" {
+		base = "https://" + string(c.ServerName)
+	}
+	return strings.TrimRight(base, "/")
+}
+
 func (c *Global) IsLocalServerName(serverName spec.ServerName) bool {
 	if c.ServerName == serverName {
 		return true
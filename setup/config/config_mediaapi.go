@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"time"
 )
 
 type MediaAPI struct {
@@ -30,6 +32,112 @@ type MediaAPI struct {
 
 	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// Configuration for generating previews of URLs posted by clients
+	URLPreview URLPreview `yaml:"url_preview"`
+
+	// Where the content of media files and thumbnails is stored
+	Storage MediaStorage `yaml:"storage"`
+
+	// How long media is kept for before it is purged
+	Retention MediaRetention `yaml:"retention"`
+}
+
+type MediaRetention struct {
+	// How long media from remote servers is kept after it was first fetched.
+	// Purged media will be fetched again if it is requested. default: 0 (forever)
+	RemoteMediaLifetime time.Duration `yaml:"remote_media_lifetime"`
+
+	// How long media uploaded to this server is kept after it was last
+	// downloaded. Purged media is gone for good. default: 0 (forever)
+	LocalMediaLifetime time.Duration `yaml:"local_media_lifetime"`
+
+	// How often to look for media to purge. default: 1h
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+const (
+	// MediaStorageLocal stores media in the filesystem, under the base path
+	MediaStorageLocal = "local"
+	// MediaStorageS3 stores media in an S3-compatible object store
+	MediaStorageS3 = "s3"
+)
+
+type MediaStorage struct {
+	// The storage backend to use, either "local" or "s3". default: local
+	Backend string `yaml:"backend"`
+
+	// Configuration for the S3-compatible object store backend
+	S3 S3MediaStorage `yaml:"s3"`
+}
+
+type S3MediaStorage struct {
+	// The URL of the object store, e.g. https://s3.eu-west-1.amazonaws.com
+	Endpoint string `yaml:"endpoint"`
+
+	// The region the bucket is in. default: us-east-1
+	Region string `yaml:"region"`
+
+	// The bucket to store media in. The bucket must already exist.
+	Bucket string `yaml:"bucket"`
+
+	// Credentials used to sign requests to the object store
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+
+	// An optional prefix which is added to all object keys
+	Prefix string `yaml:"prefix"`
+
+	// Whether the bucket is addressed in the path (endpoint/bucket/key) instead of
+	// as a subdomain (bucket.endpoint/key). Most non-AWS object stores need this.
+	ForcePathStyle bool `yaml:"force_path_style"`
+}
+
+type URLPreview struct {
+	// Whether the /preview_url endpoint is enabled. default: false
+	Enabled bool `yaml:"enabled"`
+
+	// The maximum size of a page (or image) that will be downloaded to generate
+	// a preview. default: 10485760 (10MB)
+	MaxPageSizeBytes FileSizeBytes `yaml:"max_page_size_bytes"`
+
+	// How long to wait for the remote server before giving up. default: 10s
+	Timeout time.Duration `yaml:"timeout"`
+
+	// How long generated previews are cached for. default: 24h
+	CacheLifetime time.Duration `yaml:"cache_lifetime"`
+
+	// The User-Agent header which is sent when fetching pages.
+	UserAgent string `yaml:"user_agent"`
+
+	// A list of IP ranges (in CIDR notation) which will never be contacted when
+	// generating previews, to stop the server from being used to probe private
+	// networks. Defaults to the private, loopback and link-local ranges.
+	IPRangeBlacklist []string `yaml:"ip_range_blacklist"`
+}
+
+// DefaultURLPreviewIPRangeBlacklist contains the IP ranges which are not
+// reachable when generating URL previews unless configured otherwise.
+var DefaultURLPreviewIPRangeBlacklist = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"::1/128",
+	"fe80::/10",
+	"fc00::/7",
+	"2001:db8::/32",
+	"ff00::/8",
+	"fec0::/10",
 }
 
 // DefaultMaxFileSizeBytes defines the default file size allowed in transfers
@@ -38,6 +146,9 @@ var DefaultMaxFileSizeBytes = FileSizeBytes(10485760)
 func (c *MediaAPI) Defaults(opts DefaultOpts) {
 	c.MaxFileSizeBytes = DefaultMaxFileSizeBytes
 	c.MaxThumbnailGenerators = 10
+	c.URLPreview.Defaults()
+	c.Storage.Defaults()
+	c.Retention.Defaults()
 	if opts.Generate {
 		c.ThumbnailSizes = []ThumbnailSize{
 			{
@@ -76,4 +187,82 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "media_api.database.connection_string", string(c.Database.ConnectionString))
 	}
+
+	c.URLPreview.Verify(configErrs)
+	c.Storage.Verify(configErrs)
+	c.Retention.Verify(configErrs)
+}
+
+func (c *URLPreview) Defaults() {
+	c.MaxPageSizeBytes = DefaultMaxFileSizeBytes
+	c.Timeout = time.Second * 10
+	c.CacheLifetime = time.Hour * 24
+	c.UserAgent = "Dendrite"
+	c.IPRangeBlacklist = DefaultURLPreviewIPRangeBlacklist
+}
+
+func (c *URLPreview) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkPositive(configErrs, "media_api.url_preview.max_page_size_bytes", int64(c.MaxPageSizeBytes))
+	checkPositive(configErrs, "media_api.url_preview.timeout", int64(c.Timeout))
+	checkPositive(configErrs, "media_api.url_preview.cache_lifetime", int64(c.CacheLifetime))
+	for i, cidr := range c.IPRangeBlacklist {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("media_api.url_preview.ip_range_blacklist[%d]", i), cidr))
+		}
+	}
+}
+
+// IPRangeBlacklistNetworks returns the parsed IP range blacklist. Invalid
+// entries are rejected by Verify and are skipped here.
+func (c *URLPreview) IPRangeBlacklistNetworks() []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(c.IPRangeBlacklist))
+	for _, cidr := range c.IPRangeBlacklist {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+func (c *MediaStorage) Defaults() {
+	c.Backend = MediaStorageLocal
+	c.S3.Region = "us-east-1"
+}
+
+func (c *MediaStorage) Verify(configErrs *ConfigErrors) {
+	switch c.Backend {
+	case MediaStorageLocal:
+	case MediaStorageS3:
+		checkNotEmpty(configErrs, "media_api.storage.s3.endpoint", c.S3.Endpoint)
+		checkNotEmpty(configErrs, "media_api.storage.s3.region", c.S3.Region)
+		checkNotEmpty(configErrs, "media_api.storage.s3.bucket", c.S3.Bucket)
+		checkNotEmpty(configErrs, "media_api.storage.s3.access_key_id", c.S3.AccessKeyID)
+		checkNotEmpty(configErrs, "media_api.storage.s3.secret_access_key", c.S3.SecretAccessKey)
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.storage.backend", c.Backend))
+	}
+}
+
+func (c *MediaRetention) Defaults() {
+	c.PurgeInterval = time.Hour
+}
+
+func (c *MediaRetention) Verify(configErrs *ConfigErrors) {
+	if c.RemoteMediaLifetime < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.retention.remote_media_lifetime", c.RemoteMediaLifetime))
+	}
+	if c.LocalMediaLifetime < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.retention.local_media_lifetime", c.LocalMediaLifetime))
+	}
+	if c.Enabled() {
+		checkPositive(configErrs, "media_api.retention.purge_interval", int64(c.PurgeInterval))
+	}
+}
+
+// Enabled returns true if any media is ever purged automatically.
+func (c *MediaRetention) Enabled() bool {
+	return c.RemoteMediaLifetime > 0 || c.LocalMediaLifetime > 0
 }
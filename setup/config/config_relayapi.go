@@ -0,0 +1,81 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+type RelayAPI struct {
+	Matrix *Global `yaml:"-"`
+
+	// The database stores information used by the relay queue to
+	// forward transactions to remote servers.
+	Database DatabaseOptions `yaml:"database,omitempty"`
+
+	// Whether this server will act as a relay for other servers, storing
+	// transactions destined for them until they come back online.
+	EnableRelaying bool `yaml:"enable_relaying"`
+
+	// The servers this server will store transactions for when relaying is
+	// enabled. Transactions for any other destination are rejected.
+	Destinations []spec.ServerName `yaml:"destinations"`
+
+	// The maximum number of transactions which will be stored for a single
+	// destination. Further transactions are rejected until it catches up.
+	// Defaults to 1000.
+	MaxTransactionsPerDestination int64 `yaml:"max_transactions_per_destination"`
+
+	// How long stored transactions are kept before they are discarded if the
+	// destination hasn't retrieved them. Defaults to 168h (one week).
+	TransactionLifetime time.Duration `yaml:"transaction_lifetime"`
+
+	// A list of relay servers which are periodically polled for any
+	// transactions that have been stored for this server while it was offline.
+	RelayServers []spec.ServerName `yaml:"relay_servers"`
+
+	// How often to poll the relay servers for stored transactions.
+	// Defaults to 30s.
+	SyncInterval time.Duration `yaml:"sync_interval"`
+}
+
+func (c *RelayAPI) Defaults(opts DefaultOpts) {
+	c.SyncInterval = time.Second * 30
+	c.MaxTransactionsPerDestination = 1000
+	c.TransactionLifetime = time.Hour * 24 * 7
+	if opts.Generate {
+		if !opts.SingleDatabase {
+			c.Database.ConnectionString = "file:relayapi.db"
+		}
+	}
+}
+
+func (c *RelayAPI) Verify(configErrs *ConfigErrors) {
+	if len(c.RelayServers) > 0 {
+		checkPositive(configErrs, "relay_api.sync_interval", int64(c.SyncInterval))
+	}
+	if c.EnableRelaying {
+		if len(c.Destinations) == 0 {
+			configErrs.Add("relay_api.destinations must not be empty when relaying is enabled")
+		}
+		checkPositive(configErrs, "relay_api.max_transactions_per_destination", c.MaxTransactionsPerDestination)
+		checkPositive(configErrs, "relay_api.transaction_lifetime", int64(c.TransactionLifetime))
+	}
+	if c.Matrix.DatabaseOptions.ConnectionString == "" {
+		checkNotEmpty(configErrs, "relay_api.database.connection_string", string(c.Database.ConnectionString))
+	}
+}
@@ -1,5 +1,10 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 type SyncAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -8,10 +13,14 @@ type SyncAPI struct {
 	RealIPHeader string `yaml:"real_ip_header"`
 
 	Fulltext Fulltext `yaml:"search"`
+
+	// Configuration for purging messages according to m.room.retention
+	Retention MessageRetention `yaml:"retention"`
 }
 
 func (c *SyncAPI) Defaults(opts DefaultOpts) {
 	c.Fulltext.Defaults(opts)
+	c.Retention.Defaults()
 	if opts.Generate {
 		if !opts.SingleDatabase {
 			c.Database.ConnectionString = "file:syncapi.db"
@@ -21,13 +30,32 @@ func (c *SyncAPI) Defaults(opts DefaultOpts) {
 
 func (c *SyncAPI) Verify(configErrs *ConfigErrors) {
 	c.Fulltext.Verify(configErrs)
+	c.Retention.Verify(configErrs)
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "sync_api.database", string(c.Database.ConnectionString))
 	}
+	if c.Fulltext.Enabled && c.Fulltext.Backend == FulltextBackendPostgres {
+		connectionString := c.Database.ConnectionString
+		if connectionString == "" {
+			connectionString = c.Matrix.DatabaseOptions.ConnectionString
+		}
+		if !connectionString.IsPostgres() {
+			configErrs.Add("the postgres search backend requires the sync API to use a postgres database")
+		}
+	}
 }
 
+// The backends which can be used for the fulltext search
+const (
+	FulltextBackendBleve    = "bleve"
+	FulltextBackendPostgres = "postgres"
+)
+
 type Fulltext struct {
-	Enabled   bool   `yaml:"enabled"`
+	Enabled bool `yaml:"enabled"`
+	// Where the index is stored: "bleve" for a local index at the IndexPath,
+	// or "postgres" for the sync API database. default: bleve
+	Backend   string `yaml:"backend"`
 	IndexPath Path   `yaml:"index_path"`
 	InMemory  bool   `yaml:"in_memory"` // only useful in tests
 	Language  string `yaml:"language"`  // the language to use when analysing content
@@ -35,6 +63,7 @@ type Fulltext struct {
 
 func (f *Fulltext) Defaults(opts DefaultOpts) {
 	f.Enabled = false
+	f.Backend = FulltextBackendBleve
 	f.IndexPath = "./searchindex"
 	f.Language = "en"
 }
@@ -43,6 +72,49 @@ func (f *Fulltext) Verify(configErrs *ConfigErrors) {
 	if !f.Enabled {
 		return
 	}
-	checkNotEmpty(configErrs, "syncapi.search.index_path", string(f.IndexPath))
+	switch f.Backend {
+	case FulltextBackendBleve:
+		checkNotEmpty(configErrs, "syncapi.search.index_path", string(f.IndexPath))
+	case FulltextBackendPostgres:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "syncapi.search.backend", f.Backend))
+	}
 	checkNotEmpty(configErrs, "syncapi.search.language", f.Language)
 }
+
+type MessageRetention struct {
+	// Whether messages are purged once they expire. default: false
+	Enabled bool `yaml:"enabled"`
+
+	// How long messages are kept for in rooms which don't have a m.room.retention
+	// state event, or whose event doesn't set a max_lifetime. default: 0 (forever)
+	DefaultMaxLifetime time.Duration `yaml:"default_max_lifetime"`
+
+	// The shortest and longest lifetime a room may set. Lifetimes outside of these
+	// bounds are clamped to them. default: 0 (no limit)
+	AllowedLifetimeMin time.Duration `yaml:"allowed_lifetime_min"`
+	AllowedLifetimeMax time.Duration `yaml:"allowed_lifetime_max"`
+
+	// How often to look for expired messages. default: 1h
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+func (c *MessageRetention) Defaults() {
+	c.PurgeInterval = time.Hour
+}
+
+func (c *MessageRetention) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if c.DefaultMaxLifetime < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "sync_api.retention.default_max_lifetime", c.DefaultMaxLifetime))
+	}
+	if c.AllowedLifetimeMin < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "sync_api.retention.allowed_lifetime_min", c.AllowedLifetimeMin))
+	}
+	if c.AllowedLifetimeMax < 0 || (c.AllowedLifetimeMax > 0 && c.AllowedLifetimeMax < c.AllowedLifetimeMin) {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "sync_api.retention.allowed_lifetime_max", c.AllowedLifetimeMax))
+	}
+	checkPositive(configErrs, "sync_api.retention.purge_interval", int64(c.PurgeInterval))
+}
@@ -110,6 +110,9 @@ key_server:
     max_open_conns: 100
     max_idle_conns: 2
     conn_max_lifetime: -1
+relay_api:
+  database:
+    connection_string: file:relayapi.db
 media_api:
   database:
     connection_string: file:mediaapi.db
@@ -1,6 +1,12 @@
 package config
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 type UserAPI struct {
 	Matrix *Global `yaml:"-"`
@@ -11,6 +17,10 @@ type UserAPI struct {
 	// The length of time an OpenID token is condidered valid in milliseconds
 	OpenIDTokenLifetimeMS int64 `yaml:"openid_token_lifetime_ms"`
 
+	// The length of time an access token is considered valid in milliseconds, if the
+	// client supports refresh tokens. Other access tokens never expire.
+	AccessTokenLifetimeMS int64 `yaml:"access_token_lifetime_ms"`
+
 	// Disable TLS validation on HTTPS calls to push gatways. NOT RECOMMENDED!
 	PushGatewayDisableTLSValidation bool `yaml:"push_gateway_disable_tls_validation"`
 
@@ -25,14 +35,25 @@ type UserAPI struct {
 	// The number of workers to start for the DeviceListUpdater. Defaults to 8.
 	// This only needs updating if the "InputDeviceListUpdate" stream keeps growing indefinitely.
 	WorkerCount int `yaml:"worker_count"`
+
+	// Configuration for sending email, e.g. to validate email addresses.
+	Email Email `yaml:"email"`
+
+	// External sources of users, e.g. an LDAP directory, which are asked in order
+	// to check a password if it doesn't match the password of a local account.
+	// Accounts are created for users who log in for the first time.
+	PasswordProviders []PasswordProvider `yaml:"password_providers"`
 }
 
 const DefaultOpenIDTokenLifetimeMS = 3600000 // 60 minutes
+const DefaultAccessTokenLifetimeMS = 300000  // 5 minutes
 
 func (c *UserAPI) Defaults(opts DefaultOpts) {
 	c.BCryptCost = bcrypt.DefaultCost
 	c.OpenIDTokenLifetimeMS = DefaultOpenIDTokenLifetimeMS
+	c.AccessTokenLifetimeMS = DefaultAccessTokenLifetimeMS
 	c.WorkerCount = 8
+	c.Email.Defaults()
 	if opts.Generate {
 		if !opts.SingleDatabase {
 			c.AccountDatabase.ConnectionString = "file:userapi_accounts.db"
@@ -42,7 +63,134 @@ func (c *UserAPI) Defaults(opts DefaultOpts) {
 
 func (c *UserAPI) Verify(configErrs *ConfigErrors) {
 	checkPositive(configErrs, "user_api.openid_token_lifetime_ms", c.OpenIDTokenLifetimeMS)
+	checkPositive(configErrs, "user_api.access_token_lifetime_ms", c.AccessTokenLifetimeMS)
+	c.Email.Verify(configErrs)
+	for i := range c.PasswordProviders {
+		c.PasswordProviders[i].Verify(configErrs, fmt.Sprintf("user_api.password_providers[%d]", i))
+	}
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	}
 }
+
+type Email struct {
+	// Whether sending email is enabled. default: false
+	Enabled bool `yaml:"enabled"`
+
+	// The SMTP server to send email through, as host:port.
+	SMTPServer string `yaml:"smtp_server"`
+
+	// The credentials to authenticate with, if the SMTP server requires them.
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+
+	// Whether to refuse to send email if the SMTP server doesn't support STARTTLS. default: true
+	RequireTLS bool `yaml:"require_tls"`
+
+	// The address email is sent from, e.g. "Dendrite <noreply@example.com>".
+	From string `yaml:"from"`
+
+	// The name of the service, which is used in the email templates. default: Matrix
+	AppName string `yaml:"app_name"`
+
+	// A directory containing templates which override the built-in email templates.
+	TemplateDir Path `yaml:"template_dir"`
+
+	// How often to try sending an email before giving up. default: 10
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// How long to wait for notifications to be read before they are emailed to users
+	// who set up an email pusher, in milliseconds. default: 600000 (10 minutes)
+	NotificationDelayMS int64 `yaml:"notification_delay_ms"`
+}
+
+func (c *Email) Defaults() {
+	c.RequireTLS = true
+	c.AppName = "Matrix"
+	c.MaxAttempts = 10
+	c.NotificationDelayMS = 600000
+}
+
+func (c *Email) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "user_api.email.smtp_server", c.SMTPServer)
+	checkNotEmpty(configErrs, "user_api.email.from", c.From)
+	if c.From != "" {
+		if _, err := mail.ParseAddress(c.From); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "user_api.email.from", c.From))
+		}
+	}
+	checkPositive(configErrs, "user_api.email.max_attempts", int64(c.MaxAttempts))
+	checkPositive(configErrs, "user_api.email.notification_delay_ms", c.NotificationDelayMS)
+}
+
+type PasswordProvider struct {
+	// The type of the password provider, either "ldap" or "http".
+	Type string `yaml:"type"`
+
+	// The configuration of the provider, depending on its type.
+	LDAP LDAPPasswordProvider `yaml:"ldap"`
+	HTTP HTTPPasswordProvider `yaml:"http"`
+}
+
+type LDAPPasswordProvider struct {
+	// The URL of the LDAP server, e.g. ldaps://ldap.example.com.
+	URL string `yaml:"url"`
+
+	// Whether to upgrade ldap:// connections to TLS with StartTLS.
+	StartTLS bool `yaml:"start_tls"`
+
+	// The credentials to bind with when searching for users. Users are
+	// searched for anonymously if they are empty.
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+
+	// The DN users are searched under, e.g. ou=users,dc=example,dc=com.
+	BaseDN string `yaml:"base_dn"`
+
+	// An optional filter users must match to log in,
+	// e.g. (memberOf=cn=matrix,ou=groups,dc=example,dc=com).
+	Filter string `yaml:"filter"`
+
+	// The attribute which matches the localpart of users. Defaults to "uid".
+	UIDAttribute string `yaml:"uid_attribute"`
+
+	// The attribute the display name of new users is taken from. Defaults to "cn".
+	DisplayNameAttribute string `yaml:"display_name_attribute"`
+
+	// The attribute the email addresses of new users are taken from. Defaults to "mail".
+	EmailAttribute string `yaml:"email_attribute"`
+}
+
+type HTTPPasswordProvider struct {
+	// The URL credentials are POSTed to, using the protocol of the REST
+	// password provider for Synapse.
+	URL string `yaml:"url"`
+}
+
+func (p *PasswordProvider) Verify(configErrs *ConfigErrors, key string) {
+	switch p.Type {
+	case "ldap":
+		if u, err := url.Parse(p.LDAP.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".ldap.url", p.LDAP.URL))
+		}
+		checkNotEmpty(configErrs, key+".ldap.base_dn", p.LDAP.BaseDN)
+		if p.LDAP.UIDAttribute == "" {
+			p.LDAP.UIDAttribute = "uid"
+		}
+		if p.LDAP.DisplayNameAttribute == "" {
+			p.LDAP.DisplayNameAttribute = "cn"
+		}
+		if p.LDAP.EmailAttribute == "" {
+			p.LDAP.EmailAttribute = "mail"
+		}
+	case "http":
+		if u, err := url.Parse(p.HTTP.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".http.url", p.HTTP.URL))
+		}
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", key+".type", p.Type))
+	}
+}
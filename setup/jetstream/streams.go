@@ -30,10 +30,15 @@ var (
 	OutputStreamEvent       = "OutputStreamEvent"
 	OutputReadUpdate        = "OutputReadUpdate"
 	RequestPresence         = "GetPresence"
+	RequestTimestampToEvent = "TimestampToEvent"
 	OutputPresenceEvent     = "OutputPresenceEvent"
 	InputFulltextReindex    = "InputFulltextReindex"
 )
 
+// RateLimits is the key-value bucket which holds the rate limiting state that
+// is shared between processes.
+var RateLimits = "RateLimits"
+
 var safeCharacters = regexp.MustCompile("[^A-Za-z0-9$]+")
 
 func Tokenise(str string) string {
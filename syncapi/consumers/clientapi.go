@@ -29,6 +29,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/fulltext"
+	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/setup/process"
@@ -48,10 +49,15 @@ type OutputClientDataConsumer struct {
 	topicReIndex string
 	db           storage.Database
 	stream       streams.StreamProvider
+	inviteStream streams.StreamProvider
 	notifier     *notifier.Notifier
+	rsAPI        api.SyncRoomserverAPI
 	serverName   spec.ServerName
 	fts          fulltext.Indexer
 	cfg          *config.SyncAPI
+	// Whether to index all events again once started, as the index was
+	// rebuilt.
+	reIndexOnStart bool
 }
 
 // NewOutputClientDataConsumer creates a new OutputClientData consumer. Call Start() to begin consuming from room servers.
@@ -63,7 +69,9 @@ func NewOutputClientDataConsumer(
 	store storage.Database,
 	notifier *notifier.Notifier,
 	stream streams.StreamProvider,
-	fts *fulltext.Search,
+	inviteStream streams.StreamProvider,
+	rsAPI api.SyncRoomserverAPI,
+	fts fulltext.Indexer,
 ) *OutputClientDataConsumer {
 	return &OutputClientDataConsumer{
 		ctx:          process.Context(),
@@ -75,9 +83,13 @@ func NewOutputClientDataConsumer(
 		db:           store,
 		notifier:     notifier,
 		stream:       stream,
+		inviteStream: inviteStream,
+		rsAPI:        rsAPI,
 		serverName:   cfg.Matrix.ServerName,
 		fts:          fts,
 		cfg:          cfg,
+
+		reIndexOnStart: cfg.Fulltext.Enabled && fts.NeedsReindex(),
 	}
 }
 
@@ -91,67 +103,80 @@ func (s *OutputClientDataConsumer) Start() error {
 			logrus.Warn("Fulltext indexing is disabled")
 			return
 		}
-		ctx := context.Background()
-		logrus.Infof("Starting to index events")
-		var offset int
-		start := time.Now()
-		count := 0
-		var id int64 = 0
-		for {
-			evs, err := s.db.ReIndex(ctx, 1000, id)
-			if err != nil {
-				logrus.WithError(err).Errorf("unable to get events to index")
-				return
-			}
-			if len(evs) == 0 {
-				break
-			}
-			logrus.Debugf("Indexing %d events", len(evs))
-			elements := make([]fulltext.IndexElement, 0, len(evs))
-
-			for streamPos, ev := range evs {
-				id = streamPos
-				e := fulltext.IndexElement{
-					EventID:        ev.EventID(),
-					RoomID:         ev.RoomID().String(),
-					StreamPosition: streamPos,
-				}
-				e.SetContentType(ev.Type())
-
-				switch ev.Type() {
-				case "m.room.message":
-					e.Content = gjson.GetBytes(ev.Content(), "body").String()
-				case spec.MRoomName:
-					e.Content = gjson.GetBytes(ev.Content(), "name").String()
-				case spec.MRoomTopic:
-					e.Content = gjson.GetBytes(ev.Content(), "topic").String()
-				default:
-					continue
-				}
-
-				if strings.TrimSpace(e.Content) == "" {
-					continue
-				}
-				elements = append(elements, e)
-			}
-			if err = s.fts.Index(elements...); err != nil {
-				logrus.WithError(err).Error("unable to index events")
-				continue
-			}
-			offset += len(evs)
-			count += len(elements)
-		}
-		logrus.Infof("Indexed %d events in %v", count, time.Since(start))
+		s.reIndex()
 	})
 	if err != nil {
 		return err
 	}
+	if s.reIndexOnStart {
+		go s.reIndex()
+	}
 	return jetstream.JetStreamConsumer(
 		s.ctx, s.jetstream, s.topic, s.durable, 1,
 		s.onMessage, nats.DeliverAll(), nats.ManualAck(),
 	)
 }
 
+// reIndex adds all events to the fulltext index again.
+func (s *OutputClientDataConsumer) reIndex() {
+	ctx := context.Background()
+	logrus.Infof("Starting to index events")
+	var offset int
+	start := time.Now()
+	count := 0
+	var id int64 = 0
+	for {
+		evs, err := s.db.ReIndex(ctx, 1000, id)
+		if err != nil {
+			logrus.WithError(err).Errorf("unable to get events to index")
+			return
+		}
+		if len(evs) == 0 {
+			break
+		}
+		logrus.Debugf("Indexing %d events", len(evs))
+		elements := make([]fulltext.IndexElement, 0, len(evs))
+
+		for streamPos, ev := range evs {
+			// the events aren't ordered, so continue after the latest one
+			if streamPos > id {
+				id = streamPos
+			}
+			e := fulltext.IndexElement{
+				EventID:        ev.EventID(),
+				RoomID:         ev.RoomID().String(),
+				Sender:         string(ev.SenderID()),
+				StreamPosition: streamPos,
+				OriginServerTS: int64(ev.OriginServerTS()),
+			}
+			e.SetContentType(ev.Type())
+
+			switch ev.Type() {
+			case "m.room.message":
+				e.Content = gjson.GetBytes(ev.Content(), "body").String()
+			case spec.MRoomName:
+				e.Content = gjson.GetBytes(ev.Content(), "name").String()
+			case spec.MRoomTopic:
+				e.Content = gjson.GetBytes(ev.Content(), "topic").String()
+			default:
+				continue
+			}
+
+			if strings.TrimSpace(e.Content) == "" {
+				continue
+			}
+			elements = append(elements, e)
+		}
+		if err = s.fts.Index(elements...); err != nil {
+			logrus.WithError(err).Error("unable to index events")
+			continue
+		}
+		offset += len(evs)
+		count += len(elements)
+	}
+	logrus.Infof("Indexed %d events in %v", count, time.Since(start))
+}
+
 // onMessage is called when the sync server receives a new event from the client API server output log.
 // It is not safe for this function to be called from multiple goroutines, or else the
 // sync stream position may race and be incorrectly calculated.
@@ -191,6 +216,8 @@ func (s *OutputClientDataConsumer) onMessage(ctx context.Context, msgs []*nats.M
 				"user_id": userID,
 			}).Errorf("Failed to update ignored users")
 			sentry.CaptureException(err)
+		} else {
+			s.retireIgnoredInvites(ctx, userID, output.IgnoredUsers)
 		}
 	}
 
@@ -199,3 +226,41 @@ func (s *OutputClientDataConsumer) onMessage(ctx context.Context, msgs []*nats.M
 
 	return true
 }
+
+// retireIgnoredInvites retires the pending invites of a user which were sent
+// by users they now ignore, so that clients which already received them are
+// told to remove them.
+func (s *OutputClientDataConsumer) retireIgnoredInvites(ctx context.Context, userID string, ignores *types.IgnoredUsers) {
+	if len(ignores.List) == 0 {
+		return
+	}
+	snapshot, err := s.db.NewDatabaseSnapshot(ctx)
+	if err != nil {
+		log.WithError(err).Error("Failed to get snapshot to retire invites")
+		return
+	}
+	invites, _, _, err := snapshot.InviteEventsInRange(
+		ctx, userID, types.Range{From: 0, To: s.inviteStream.LatestPosition(ctx)},
+	)
+	snapshot.Rollback() // nolint: errcheck
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Error("Failed to get invites to retire")
+		return
+	}
+	for _, invite := range invites {
+		sender, err := s.rsAPI.QueryUserIDForSender(ctx, invite.RoomID(), invite.SenderID())
+		if err != nil || sender == nil || !ignores.IsIgnored(sender.String()) {
+			continue
+		}
+		pos, err := s.db.RetireInviteEvent(ctx, invite.EventID())
+		if err != nil {
+			log.WithError(err).WithFields(logrus.Fields{
+				"user_id":  userID,
+				"event_id": invite.EventID(),
+			}).Error("Failed to retire invite of ignored user")
+			continue
+		}
+		s.inviteStream.Advance(pos)
+		s.notifier.OnNewInvite(types.StreamingToken{InvitePosition: pos}, userID)
+	}
+}
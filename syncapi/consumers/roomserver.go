@@ -69,7 +69,7 @@ func NewOutputRoomEventConsumer(
 	pduStream streams.StreamProvider,
 	inviteStream streams.StreamProvider,
 	rsAPI api.SyncRoomserverAPI,
-	fts *fulltext.Search,
+	fts fulltext.Indexer,
 	asProducer *producers.AppserviceEventProducer,
 ) *OutputRoomEventConsumer {
 	return &OutputRoomEventConsumer{
@@ -510,7 +510,9 @@ func (s *OutputRoomEventConsumer) writeFTS(ev *rstypes.HeaderedEvent, pduPositio
 	e := fulltext.IndexElement{
 		EventID:        ev.EventID(),
 		RoomID:         ev.RoomID().String(),
+		Sender:         string(ev.SenderID()),
 		StreamPosition: int64(pduPosition),
+		OriginServerTS: int64(ev.OriginServerTS()),
 	}
 	e.SetContentType(ev.Type())
 
@@ -0,0 +1,153 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+)
+
+// TimestampToEventConsumer answers requests from other components for
+// the event closest to a given timestamp in a room.
+type TimestampToEventConsumer struct {
+	ctx          context.Context
+	nats         *nats.Conn
+	requestTopic string
+	db           storage.Database
+	rsAPI        api.SyncRoomserverAPI
+}
+
+// NewTimestampToEventConsumer creates a new TimestampToEventConsumer.
+// Call Start() to begin answering requests.
+func NewTimestampToEventConsumer(
+	process *process.ProcessContext,
+	cfg *config.SyncAPI,
+	nats *nats.Conn,
+	db storage.Database,
+	rsAPI api.SyncRoomserverAPI,
+) *TimestampToEventConsumer {
+	return &TimestampToEventConsumer{
+		ctx:          process.Context(),
+		nats:         nats,
+		requestTopic: cfg.Matrix.JetStream.Prefixed(jetstream.RequestTimestampToEvent),
+		db:           db,
+		rsAPI:        rsAPI,
+	}
+}
+
+// Start answering requests.
+func (s *TimestampToEventConsumer) Start() error {
+	// Normal NATS subscription, used by Request/Reply
+	_, err := s.nats.Subscribe(s.requestTopic, func(msg *nats.Msg) {
+		m := &nats.Msg{
+			Header: nats.Header{},
+		}
+		if err := s.onRequest(msg, m); err != nil {
+			m.Header.Set("error", err.Error())
+		}
+		if err := msg.RespondMsg(m); err != nil {
+			logrus.WithError(err).Error("Unable to respond to messages")
+		}
+	})
+	return err
+}
+
+// onRequest looks up the event closest to the requested timestamp and sets
+// the result on the reply. The "gap" header is set if we might be missing
+// events which are closer to the timestamp than the one we found. If the
+// request is on behalf of a user, events they can't see aren't returned.
+func (s *TimestampToEventConsumer) onRequest(msg, reply *nats.Msg) (err error) {
+	roomID := msg.Header.Get(jetstream.RoomID)
+	ts, err := strconv.ParseUint(msg.Header.Get("ts"), 10, 64)
+	if err != nil {
+		return err
+	}
+	backwards := msg.Header.Get("dir") == "b"
+
+	snapshot, err := s.db.NewDatabaseSnapshot(s.ctx)
+	if err != nil {
+		return err
+	}
+	var succeeded bool
+	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
+
+	eventID, originServerTS, err := snapshot.EventIDAtTimestamp(s.ctx, roomID, spec.Timestamp(ts), backwards)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		reply.Header.Set("gap", "true")
+		succeeded = true
+		return nil
+	case err != nil:
+		return err
+	}
+	if userID := msg.Header.Get(jetstream.UserID); userID != "" {
+		var visible bool
+		if visible, err = s.visibleToUser(snapshot, userID, eventID); err != nil {
+			return err
+		}
+		if !visible {
+			succeeded = true
+			return nil
+		}
+	}
+	reply.Header.Set(jetstream.EventID, eventID)
+	reply.Header.Set("origin_server_ts", strconv.FormatUint(uint64(originServerTS), 10))
+
+	// When looking forwards, any events between the timestamp and the event we
+	// found would be older than the event. If we are missing the prev events
+	// of the event then we can't be sure that there aren't closer events.
+	if !backwards {
+		extremities, err := snapshot.BackwardExtremitiesForRoom(s.ctx, roomID)
+		if err != nil {
+			return err
+		}
+		if _, ok := extremities[eventID]; ok {
+			reply.Header.Set("gap", "true")
+		}
+	}
+	succeeded = true
+	return nil
+}
+
+// visibleToUser returns true if the history visibility of the event allows the user to see it.
+func (s *TimestampToEventConsumer) visibleToUser(snapshot storage.DatabaseTransaction, rawUserID, eventID string) (bool, error) {
+	userID, err := spec.NewUserID(rawUserID, true)
+	if err != nil {
+		return false, err
+	}
+	events, err := snapshot.Events(s.ctx, []string{eventID})
+	if err != nil {
+		return false, err
+	}
+	events, err = internal.ApplyHistoryVisibilityFilter(s.ctx, snapshot, s.rsAPI, events, nil, *userID, "timestamp_to_event")
+	if err != nil {
+		return false, err
+	}
+	return len(events) == 1, nil
+}
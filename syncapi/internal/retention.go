@@ -0,0 +1,150 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/internal/fulltext"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// MRoomRetention is the state event which sets the message retention policy of a room
+const MRoomRetention = "m.room.retention"
+
+// retentionPurgeBatchSize is the number of events looked at for each database query
+const retentionPurgeBatchSize = 100
+
+// retentionPolicy is the content of a m.room.retention event. Lifetimes are in milliseconds.
+type retentionPolicy struct {
+	MinLifetime *int64 `json:"min_lifetime,omitempty"`
+	MaxLifetime *int64 `json:"max_lifetime,omitempty"`
+}
+
+// RetentionLifetime returns how long messages in a room are kept for, given the content of its
+// m.room.retention state event, or nil if it has none. The room's lifetime is clamped to the
+// lifetimes allowed by the server. Returns 0 if messages are kept forever.
+func RetentionLifetime(cfg *config.MessageRetention, content []byte) time.Duration {
+	lifetime := cfg.DefaultMaxLifetime
+	var policy retentionPolicy
+	if len(content) > 0 && json.Unmarshal(content, &policy) == nil {
+		if policy.MaxLifetime != nil && *policy.MaxLifetime > 0 {
+			lifetime = time.Duration(*policy.MaxLifetime) * time.Millisecond
+		}
+		// min_lifetime asks for messages to be kept for at least that long
+		if lifetime > 0 && policy.MinLifetime != nil {
+			if minLifetime := time.Duration(*policy.MinLifetime) * time.Millisecond; minLifetime > lifetime {
+				lifetime = minLifetime
+			}
+		}
+	}
+	if lifetime <= 0 {
+		return 0
+	}
+	if cfg.AllowedLifetimeMin > 0 && lifetime < cfg.AllowedLifetimeMin {
+		lifetime = cfg.AllowedLifetimeMin
+	}
+	if cfg.AllowedLifetimeMax > 0 && lifetime > cfg.AllowedLifetimeMax {
+		lifetime = cfg.AllowedLifetimeMax
+	}
+	return lifetime
+}
+
+// PurgeExpiredEvents purges all messages which have expired under the retention policy of their
+// room. The roomserver redacts the events, so that they stay in the room DAG without their
+// content, and the events are then removed from the timeline and the fulltext index.
+// State events are never purged. Returns the number of events purged.
+func PurgeExpiredEvents(
+	ctx context.Context, cfg *config.SyncAPI, db storage.Database, rsAPI api.SyncRoomserverAPI, fts fulltext.Indexer,
+) (int, error) {
+	roomIDs, err := db.RoomIDs(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("db.RoomIDs: %w", err)
+	}
+	now := time.Now()
+	purged := 0
+	for _, roomID := range roomIDs {
+		var content []byte
+		retentionEvent, err := db.CurrentStateEvent(ctx, roomID, MRoomRetention, "")
+		if err != nil {
+			return purged, fmt.Errorf("db.CurrentStateEvent: %w", err)
+		}
+		if retentionEvent != nil {
+			content = retentionEvent.Content()
+		}
+		lifetime := RetentionLifetime(&cfg.Retention, content)
+		if lifetime == 0 {
+			continue
+		}
+		n, err := purgeRoomEventsBefore(ctx, cfg, db, rsAPI, fts, roomID, spec.AsTimestamp(now.Add(-lifetime)))
+		purged += n
+		if err != nil {
+			return purged, fmt.Errorf("failed to purge expired events in room %s: %w", roomID, err)
+		}
+	}
+	return purged, nil
+}
+
+func purgeRoomEventsBefore(
+	ctx context.Context, cfg *config.SyncAPI, db storage.Database, rsAPI api.SyncRoomserverAPI, fts fulltext.Indexer,
+	roomID string, before spec.Timestamp,
+) (int, error) {
+	purged := 0
+	var afterPos types.StreamPosition
+	for {
+		events, err := db.EventsBeforeTimestamp(ctx, roomID, before, afterPos, retentionPurgeBatchSize)
+		if err != nil {
+			return purged, fmt.Errorf("db.EventsBeforeTimestamp: %w", err)
+		}
+		eventIDs := make([]string, 0, len(events))
+		for _, event := range events {
+			afterPos = event.StreamPosition
+			if event.StateKey() != nil {
+				continue
+			}
+			eventIDs = append(eventIDs, event.EventID())
+		}
+		if len(eventIDs) > 0 {
+			// Redact the events in the roomserver first, so that we try again
+			// next time if that fails.
+			if err = rsAPI.PerformRedactExpiredEvents(ctx, roomID, eventIDs); err != nil {
+				return purged, fmt.Errorf("rsAPI.PerformRedactExpiredEvents: %w", err)
+			}
+			if err = db.DeleteEvents(ctx, roomID, eventIDs); err != nil {
+				return purged, fmt.Errorf("db.DeleteEvents: %w", err)
+			}
+			if cfg.Fulltext.Enabled {
+				for _, eventID := range eventIDs {
+					if err = fts.Delete(eventID); err != nil {
+						logrus.WithError(err).WithField("event_id", eventID).Warn("Failed to delete expired event from fulltext index")
+					}
+				}
+			}
+			purged += len(eventIDs)
+		}
+		if len(events) < retentionPurgeBatchSize {
+			return purged, nil
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/internal/fulltext"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/test"
+)
+
+func TestRetentionLifetime(t *testing.T) {
+	cfg := &config.MessageRetention{
+		Enabled:            true,
+		DefaultMaxLifetime: 30 * 24 * time.Hour,
+		AllowedLifetimeMin: 24 * time.Hour,
+		AllowedLifetimeMax: 365 * 24 * time.Hour,
+	}
+	tests := []struct {
+		name    string
+		cfg     *config.MessageRetention
+		content string
+		want    time.Duration
+	}{
+		{name: "no retention event uses the default", content: "", want: 30 * 24 * time.Hour},
+		{name: "no max_lifetime uses the default", content: `{}`, want: 30 * 24 * time.Hour},
+		{name: "room max_lifetime", content: `{"max_lifetime":172800000}`, want: 48 * time.Hour},
+		{name: "max_lifetime is clamped to the allowed minimum", content: `{"max_lifetime":1000}`, want: 24 * time.Hour},
+		{name: "max_lifetime is clamped to the allowed maximum", content: `{"max_lifetime":315360000000}`, want: 365 * 24 * time.Hour},
+		{name: "min_lifetime extends max_lifetime", content: `{"min_lifetime":259200000,"max_lifetime":172800000}`, want: 72 * time.Hour},
+		{name: "invalid content uses the default", content: `{"max_lifetime":"forever"}`, want: 30 * 24 * time.Hour},
+		{name: "no default keeps messages forever", cfg: &config.MessageRetention{}, content: `{}`, want: 0},
+		{name: "no limits", cfg: &config.MessageRetention{}, content: `{"max_lifetime":1000}`, want: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cfg
+			if tt.cfg != nil {
+				c = tt.cfg
+			}
+			if got := RetentionLifetime(c, []byte(tt.content)); got != tt.want {
+				t.Errorf("RetentionLifetime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type retentionRoomserverAPI struct {
+	rsapi.SyncRoomserverAPI
+	redacted []string
+}
+
+func (r *retentionRoomserverAPI) PerformRedactExpiredEvents(ctx context.Context, roomID string, eventIDs []string) error {
+	r.redacted = append(r.redacted, eventIDs...)
+	return nil
+}
+
+func TestPurgeExpiredEvents(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		ctx := context.Background()
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+		db, err := storage.NewSyncServerDatasource(ctx, cm, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("failed to open database: %s", err)
+		}
+
+		processCtx := process.NewProcessContext()
+		defer processCtx.ShutdownDendrite()
+		fts, err := fulltext.New(processCtx, config.Fulltext{Enabled: true, InMemory: true, Language: "en"})
+		if err != nil {
+			t.Fatalf("failed to open fulltext index: %s", err)
+		}
+
+		alice := test.NewUser(t)
+		old := time.Now().Add(-72 * time.Hour)
+		room := test.NewRoom(t, alice)
+		expiredMsg := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "old message"}, test.WithTimestamp(old))
+		expiredState := room.CreateAndInsert(t, alice, "m.room.topic", map[string]interface{}{"topic": "old topic"}, test.WithStateKey(""), test.WithTimestamp(old))
+		recentMsg := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "new message"})
+		room.CreateAndInsert(t, alice, MRoomRetention, map[string]interface{}{"max_lifetime": (48 * time.Hour).Milliseconds()}, test.WithStateKey(""))
+
+		// a room without a retention policy keeps its messages, as there is no default
+		otherRoom := test.NewRoom(t, alice)
+		otherMsg := otherRoom.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "old message"}, test.WithTimestamp(old))
+
+		for _, ev := range append(room.Events(), otherRoom.Events()...) {
+			var addStateEvents []*types.HeaderedEvent
+			var addStateEventIDs []string
+			if ev.StateKey() != nil {
+				ev.StateKeyResolved = ev.StateKey()
+				addStateEvents = append(addStateEvents, ev)
+				addStateEventIDs = append(addStateEventIDs, ev.EventID())
+			}
+			if _, err = db.WriteEvent(ctx, ev, addStateEvents, addStateEventIDs, nil, nil, false, gomatrixserverlib.HistoryVisibilityShared); err != nil {
+				t.Fatalf("failed to write event: %s", err)
+			}
+		}
+		if err = fts.Index(
+			fulltext.IndexElement{EventID: expiredMsg.EventID(), RoomID: room.ID, Content: "old message", ContentType: "content.body"},
+			fulltext.IndexElement{EventID: recentMsg.EventID(), RoomID: room.ID, Content: "new message", ContentType: "content.body"},
+		); err != nil {
+			t.Fatalf("failed to index events: %s", err)
+		}
+
+		cfg := &config.SyncAPI{Fulltext: config.Fulltext{Enabled: true}}
+		cfg.Retention.Enabled = true
+		rsAPI := &retentionRoomserverAPI{}
+		purged, err := PurgeExpiredEvents(ctx, cfg, db, rsAPI, fts)
+		if err != nil {
+			t.Fatalf("failed to purge expired events: %s", err)
+		}
+		if purged != 1 {
+			t.Fatalf("expected 1 event to be purged, got %d", purged)
+		}
+		if len(rsAPI.redacted) != 1 || rsAPI.redacted[0] != expiredMsg.EventID() {
+			t.Fatalf("expected the roomserver to redact %s, got %v", expiredMsg.EventID(), rsAPI.redacted)
+		}
+
+		events, err := db.Events(ctx, []string{expiredMsg.EventID(), expiredState.EventID(), recentMsg.EventID(), otherMsg.EventID()})
+		if err != nil {
+			t.Fatalf("failed to get events: %s", err)
+		}
+		got := make(map[string]bool, len(events))
+		for _, ev := range events {
+			got[ev.EventID()] = true
+		}
+		if got[expiredMsg.EventID()] {
+			t.Errorf("expected expired message to be purged")
+		}
+		for _, ev := range []*types.HeaderedEvent{expiredState, recentMsg, otherMsg} {
+			if !got[ev.EventID()] {
+				t.Errorf("expected event %s of type %s to be kept", ev.EventID(), ev.Type())
+			}
+		}
+
+		result, err := fts.Search("message", []string{room.ID}, nil, fulltext.SearchFilter{}, 10, 0, false)
+		if err != nil {
+			t.Fatalf("failed to search: %s", err)
+		}
+		if len(result.Hits) != 1 || result.Hits[0].ID != recentMsg.EventID() {
+			t.Errorf("expected only the recent message to be searchable, got %v", result.Hits)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/sjson"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	rstypes "github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/synctypes"
+)
+
+// threadAggregation is the m.thread bundled aggregation, as added to
+// unsigned.m.relations of a thread root.
+type threadAggregation struct {
+	LatestEvent             *synctypes.ClientEvent `json:"latest_event"`
+	Count                   int                    `json:"count"`
+	CurrentUserParticipated bool                   `json:"current_user_participated"`
+}
+
+// BundleThreadAggregations adds the m.thread bundled aggregation to the
+// unsigned section of every event in events which is the root of a thread.
+// The events are modified in place and must all belong to the given room.
+func BundleThreadAggregations(
+	ctx context.Context,
+	snapshot storage.DatabaseTransaction,
+	rsAPI api.SyncRoomserverAPI,
+	userID spec.UserID,
+	roomID string,
+	events []synctypes.ClientEvent,
+	format synctypes.ClientEventFormat,
+) error {
+	if len(events) == 0 {
+		return nil
+	}
+	eventIDs := make([]string, 0, len(events))
+	for _, ev := range events {
+		if ev.EventID != "" {
+			eventIDs = append(eventIDs, ev.EventID)
+		}
+	}
+	summaries, err := snapshot.ThreadSummaries(ctx, roomID, eventIDs, userID.String())
+	if err != nil {
+		return fmt.Errorf("snapshot.ThreadSummaries: %w", err)
+	}
+	if len(summaries) == 0 {
+		return nil
+	}
+
+	latestEventIDs := make([]string, 0, len(summaries))
+	for _, summary := range summaries {
+		latestEventIDs = append(latestEventIDs, summary.LatestEventID)
+	}
+	latestEvents, err := snapshot.Events(ctx, latestEventIDs)
+	if err != nil {
+		return fmt.Errorf("snapshot.Events: %w", err)
+	}
+	// The user may not be allowed to see the latest reply, in which case the
+	// thread isn't bundled, as the latest event is required.
+	latestEvents, err = ApplyHistoryVisibilityFilter(ctx, snapshot, rsAPI, latestEvents, nil, userID, "threads")
+	if err != nil {
+		return fmt.Errorf("ApplyHistoryVisibilityFilter: %w", err)
+	}
+	latestByID := make(map[string]*rstypes.HeaderedEvent, len(latestEvents))
+	for _, ev := range latestEvents {
+		latestByID[ev.EventID()] = ev
+	}
+
+	for i := range events {
+		summary, ok := summaries[events[i].EventID]
+		if !ok {
+			continue
+		}
+		latest, ok := latestByID[summary.LatestEventID]
+		if !ok {
+			continue
+		}
+		latestEvent, err := synctypes.ToClientEvent(latest.PDU, format, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+			return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+		})
+		if err != nil {
+			return fmt.Errorf("synctypes.ToClientEvent: %w", err)
+		}
+		aggregation, err := json.Marshal(threadAggregation{
+			LatestEvent:             latestEvent,
+			Count:                   summary.Count,
+			CurrentUserParticipated: summary.Participated || events[i].Sender == userID.String(),
+		})
+		if err != nil {
+			return err
+		}
+		unsigned := events[i].Unsigned
+		if len(unsigned) == 0 {
+			unsigned = spec.RawJSON("{}")
+		}
+		unsigned, err = sjson.SetRawBytes(unsigned, `m\.relations.m\.thread`, aggregation)
+		if err != nil {
+			return fmt.Errorf("sjson.SetRawBytes: %w", err)
+		}
+		events[i].Unsigned = unsigned
+	}
+	return nil
+}
@@ -100,7 +100,7 @@ func (n *Notifier) OnNewEvent(
 	if ev != nil {
 		// Map this event's room_id to a list of joined users, and wake them up.
 		usersToNotify := n._joinedUsers(ev.RoomID().String())
-		// If this is an invite, also add in the invitee to this list.
+		// If this is an invite or a knock, also add in the target user to this list.
 		if ev.Type() == "m.room.member" && ev.StateKey() != nil {
 			targetUserID, err := n.rsAPI.QueryUserIDForSender(context.Background(), ev.RoomID(), spec.SenderID(*ev.StateKey()))
 			if err != nil || targetUserID == nil {
@@ -116,7 +116,7 @@ func (n *Notifier) OnNewEvent(
 				} else {
 					// Keep the joined user map up-to-date
 					switch membership {
-					case spec.Invite:
+					case spec.Invite, spec.Knock:
 						usersToNotify = append(usersToNotify, targetUserID.String())
 					case spec.Join:
 						// Manually append the new user's ID so they get notified
@@ -126,6 +126,9 @@ func (n *Notifier) OnNewEvent(
 					case spec.Leave:
 						fallthrough
 					case spec.Ban:
+						// Also notify the target user, who may not have been joined,
+						// e.g. if their knock was rejected.
+						usersToNotify = append(usersToNotify, targetUserID.String())
 						n._removeJoinedUser(ev.RoomID().String(), targetUserID.String())
 					}
 				}
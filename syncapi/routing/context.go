@@ -163,6 +163,18 @@ func Context(
 		filter.Limit = filter.Limit / 2
 	}
 
+	// Don't return events of ignored users around the requested event.
+	// The state filter was created before, as state events aren't hidden.
+	ignores, err := ignoredUsers(ctx, snapshot, device.UserID)
+	if err != nil {
+		logrus.WithError(err).Error("unable to fetch ignored users")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	ignores.AddToFilter(filter)
+
 	eventsBefore, err := snapshot.SelectContextBeforeEvent(ctx, id, roomID, filter)
 	if err != nil && err != sql.ErrNoRows {
 		logrus.WithError(err).Error("unable to fetch before events")
@@ -233,6 +245,15 @@ func Context(
 	ev := synctypes.ToClientEventDefault(func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 	}, requestedEvent)
+
+	// Bundle the thread aggregations for any thread roots in the response.
+	requestedClientEvent := []synctypes.ClientEvent{ev}
+	for _, events := range [][]synctypes.ClientEvent{requestedClientEvent, eventsBeforeClient, eventsAfterClient} {
+		if err = internal.BundleThreadAggregations(ctx, snapshot, rsAPI, *userID, roomID, events, synctypes.FormatAll); err != nil {
+			logrus.WithError(err).Warn("failed to bundle thread aggregations")
+		}
+	}
+	ev = requestedClientEvent[0]
 	response := ContextRespsonse{
 		Event:        &ev,
 		EventsAfter:  eventsAfterClient,
@@ -373,3 +394,16 @@ func parseRoomEventFilter(req *http.Request) (*synctypes.RoomEventFilter, error)
 
 	return filter, nil
 }
+
+// ignoredUsers returns the users ignored by the given user. A user without an
+// ignore list doesn't ignore anyone.
+func ignoredUsers(ctx context.Context, snapshot storage.DatabaseTransaction, userID string) (*types.IgnoredUsers, error) {
+	ignores, err := snapshot.IgnoresForUser(ctx, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return &types.IgnoredUsers{}, nil
+		}
+		return nil, err
+	}
+	return ignores, nil
+}
@@ -54,6 +54,7 @@ type messagesReq struct {
 	wasToProvided    bool
 	backwardOrdering bool
 	filter           *synctypes.RoomEventFilter
+	ignores          *types.IgnoredUsers
 	didBackfill      bool
 }
 
@@ -130,6 +131,17 @@ func OnIncomingMessagesRequest(
 		}
 	}
 
+	// Don't return events of ignored users.
+	ignores, err := ignoredUsers(req.Context(), snapshot, device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("unable to fetch ignored users")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	ignores.AddToFilter(filter)
+
 	// Extract parameters from the request's URL.
 	// Pagination tokens.
 	var fromStream *types.StreamingToken
@@ -258,6 +270,7 @@ func OnIncomingMessagesRequest(
 		to:               &to,
 		wasToProvided:    wasToProvided,
 		filter:           filter,
+		ignores:          ignores,
 		backwardOrdering: backwardOrdering,
 		device:           device,
 		deviceUserID:     *deviceUserID,
@@ -373,6 +386,12 @@ func (r *messagesReq) retrieveEvents(ctx context.Context, rsAPI api.SyncRoomserv
 		}
 	}
 
+	// Backfilled events don't go through the database filter, so the events
+	// of ignored users need to be removed here.
+	if r.didBackfill {
+		events = r.removeIgnoredEvents(events)
+	}
+
 	// If we didn't get any event, we don't need to proceed any further.
 	if len(events) == 0 {
 		return []synctypes.ClientEvent{}, *r.from, emptyToken, nil
@@ -426,9 +445,30 @@ func (r *messagesReq) retrieveEvents(ctx context.Context, rsAPI api.SyncRoomserv
 
 	start = *r.from
 
-	return synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(filteredEvents), synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	clientEvents = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(filteredEvents), synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
-	}), start, end, nil
+	})
+	if err = internal.BundleThreadAggregations(ctx, r.snapshot, rsAPI, r.deviceUserID, r.roomID, clientEvents, synctypes.FormatAll); err != nil {
+		logrus.WithError(err).Warn("failed to bundle thread aggregations")
+	}
+	return clientEvents, start, end, nil
+}
+
+// removeIgnoredEvents removes the events sent by users ignored by the
+// requesting user.
+func (r *messagesReq) removeIgnoredEvents(events []*rstypes.HeaderedEvent) []*rstypes.HeaderedEvent {
+	if len(r.ignores.List) == 0 {
+		return events
+	}
+	filtered := make([]*rstypes.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		sender, err := r.rsAPI.QueryUserIDForSender(r.ctx, ev.RoomID(), ev.SenderID())
+		if err == nil && sender != nil && r.ignores.IsIgnored(sender.String()) {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered
 }
 
 func (r *messagesReq) getStartEnd(events []*rstypes.HeaderedEvent) (start, end types.TopologyToken, err error) {
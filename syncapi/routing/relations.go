@@ -126,6 +126,11 @@ func Relations(
 		return util.ErrorResponse(err)
 	}
 
+	ignores, err := ignoredUsers(req.Context(), snapshot, device.UserID)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
 	// Convert the events into client events, and optionally filter based on the event
 	// type if it was specified.
 	res.Chunk = make([]synctypes.ClientEvent, 0, len(filteredEvents))
@@ -137,6 +142,10 @@ func Relations(
 			util.GetLogger(req.Context()).WithError(err).WithField("senderID", events[0].SenderID()).WithField("roomID", *roomID).Error("Failed converting to ClientEvent")
 			continue
 		}
+		// Don't return relations sent by ignored users.
+		if ignores.IsIgnored(clientEvent.Sender) {
+			continue
+		}
 		res.Chunk = append(
 			res.Chunk,
 			*clientEvent,
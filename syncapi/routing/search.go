@@ -67,6 +67,23 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 		searchReq.SearchCategories.RoomEvents.Filter.Limit = 5
 	}
 
+	groupBy := make(map[string]bool, len(searchReq.SearchCategories.RoomEvents.Groupings.GroupBy))
+	for _, grouping := range searchReq.SearchCategories.RoomEvents.Groupings.GroupBy {
+		switch grouping.Key {
+		case groupByRoomID, groupBySender:
+			groupBy[grouping.Key] = true
+		default:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("Unknown group_by key: " + grouping.Key),
+			}
+		}
+	}
+	// Clients which don't ask for groups still get them by room
+	if len(groupBy) == 0 {
+		groupBy[groupByRoomID] = true
+	}
+
 	snapshot, err := syncDB.NewDatabaseSnapshot(req.Context())
 	if err != nil {
 		return util.JSONResponse{
@@ -115,10 +132,37 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 
 	orderByTime := searchReq.SearchCategories.RoomEvents.OrderBy == "recent"
 
+	// Events of ignored users are neither returned as results nor as context.
+	ignores, err := ignoredUsers(ctx, snapshot, device.UserID)
+	if err != nil {
+		logrus.WithError(err).Error("failed to get ignored users")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	ignores.AddToFilter(&searchReq.SearchCategories.RoomEvents.Filter)
+
+	searchFilter := fulltext.SearchFilter{
+		FromTS: searchReq.SearchCategories.RoomEvents.FromTS,
+		ToTS:   searchReq.SearchCategories.RoomEvents.ToTS,
+	}
+	if senders := searchReq.SearchCategories.RoomEvents.Filter.Senders; senders != nil {
+		searchFilter.Senders = senderIDsInRooms(ctx, rsAPI, rooms, *senders)
+		if len(searchFilter.Senders) == 0 {
+			// None of the senders are known, so nothing can match
+			searchFilter.Senders = *senders
+		}
+	}
+	if notSenders := searchReq.SearchCategories.RoomEvents.Filter.NotSenders; notSenders != nil {
+		searchFilter.NotSenders = senderIDsInRooms(ctx, rsAPI, rooms, *notSenders)
+	}
+
 	result, err := fts.Search(
 		searchReq.SearchCategories.RoomEvents.SearchTerm,
 		rooms,
 		searchReq.SearchCategories.RoomEvents.Keys,
+		searchFilter,
 		searchReq.SearchCategories.RoomEvents.Filter.Limit,
 		nextBatch,
 		orderByTime,
@@ -164,6 +208,7 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 		Rooms: &rooms,
 		Types: &types,
 	}
+	ignores.AddToFilter(roomFilter)
 
 	evs, err := syncDB.Events(ctx, wantEvents)
 	if err != nil {
@@ -174,15 +219,21 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 		}
 	}
 
-	groups := make(map[string]RoomResult)
+	groups := make(map[string]map[string]RoomResult, len(groupBy))
+	for key := range groupBy {
+		groups[key] = make(map[string]RoomResult)
+	}
 	knownUsersProfiles := make(map[string]ProfileInfoResponse)
 
-	// Sort the events by depth, as the returned values aren't ordered
-	if orderByTime {
-		sort.Slice(evs, func(i, j int) bool {
-			return evs[i].Depth() > evs[j].Depth()
-		})
+	// Return the events in the order of the search hits, as the events
+	// returned by the database aren't ordered
+	hitOrder := make(map[string]int, len(result.Hits))
+	for i, hit := range result.Hits {
+		hitOrder[hit.ID] = i
 	}
+	sort.Slice(evs, func(i, j int) bool {
+		return hitOrder[evs[i].EventID()] < hitOrder[evs[j].EventID()]
+	})
 
 	stateForRooms := make(map[string][]synctypes.ClientEvent)
 	for _, event := range evs {
@@ -253,9 +304,19 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 			Rank:   eventScore[event.EventID()].Score,
 			Result: *clientEvent,
 		})
-		roomGroup := groups[event.RoomID().String()]
-		roomGroup.Results = append(roomGroup.Results, event.EventID())
-		groups[event.RoomID().String()] = roomGroup
+		for key, group := range groups {
+			groupValue := clientEvent.RoomID
+			if key == groupBySender {
+				groupValue = clientEvent.Sender
+			}
+			groupResult, ok := group[groupValue]
+			if !ok {
+				// Groups are ordered by their best result
+				groupResult.Order = len(group)
+			}
+			groupResult.Results = append(groupResult.Results, event.EventID())
+			group[groupValue] = groupResult
+		}
 		if _, ok := stateForRooms[event.RoomID().String()]; searchReq.SearchCategories.RoomEvents.IncludeState && !ok {
 			stateFilter := synctypes.DefaultStateFilter()
 			state, err := snapshot.CurrentState(ctx, event.RoomID().String(), &stateFilter, nil)
@@ -272,21 +333,31 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 		}
 	}
 
+	// Continue after all hits of this page, even if some of them couldn't
+	// be returned, so that the next page doesn't repeat results.
 	var nextBatchResult *string = nil
-	if int(result.Total) > nextBatch+len(results) {
-		nb := strconv.Itoa(len(results) + nextBatch)
+	if int(result.Total) > nextBatch+len(result.Hits) {
+		nb := strconv.Itoa(len(result.Hits) + nextBatch)
 		nextBatchResult = &nb
-	} else if int(result.Total) == nextBatch+len(results) {
+	} else if int(result.Total) == nextBatch+len(result.Hits) {
 		// Sytest expects a next_batch even if we don't actually have any more results
 		nb := ""
 		nextBatchResult = &nb
 	}
+	if nextBatchResult != nil && *nextBatchResult != "" {
+		for _, group := range groups {
+			for groupValue, groupResult := range group {
+				groupResult.NextBatch = nextBatchResult
+				group[groupValue] = groupResult
+			}
+		}
+	}
 
 	res := SearchResponse{
 		SearchCategories: SearchCategoriesResponse{
 			RoomEvents: RoomEventsResponse{
 				Count:      int(result.Total),
-				Groups:     Groups{RoomID: groups},
+				Groups:     Groups{RoomID: groups[groupByRoomID], Sender: groups[groupBySender]},
 				Results:    results,
 				NextBatch:  nextBatchResult,
 				Highlights: fts.GetHighlights(result),
@@ -304,6 +375,34 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 	}
 }
 
+// senderIDsInRooms returns the sender IDs of the given users in the rooms, as
+// the fulltext index contains sender IDs rather than user IDs.
+func senderIDsInRooms(ctx context.Context, rsAPI roomserverAPI.SyncRoomserverAPI, roomIDs, userIDs []string) []string {
+	seen := make(map[spec.SenderID]struct{}, len(userIDs))
+	senderIDs := make([]string, 0, len(userIDs))
+	for _, u := range userIDs {
+		userID, err := spec.NewUserID(u, true)
+		if err != nil {
+			continue
+		}
+		for _, r := range roomIDs {
+			roomID, err := spec.NewRoomID(r)
+			if err != nil {
+				continue
+			}
+			senderID, err := rsAPI.QuerySenderIDForUser(ctx, *roomID, *userID)
+			if err != nil || senderID == nil {
+				continue
+			}
+			if _, ok := seen[*senderID]; !ok {
+				seen[*senderID] = struct{}{}
+				senderIDs = append(senderIDs, string(*senderID))
+			}
+		}
+	}
+	return senderIDs
+}
+
 // contextEvents returns the events around a given eventID
 func contextEvents(
 	ctx context.Context,
@@ -338,6 +437,12 @@ type EventContext struct {
 	IncludeProfile bool `json:"include_profile,omitempty"`
 }
 
+// The keys search results can be grouped by
+const (
+	groupByRoomID = "room_id"
+	groupBySender = "sender"
+)
+
 type GroupBy struct {
 	Key string `json:"key"`
 }
@@ -354,6 +459,11 @@ type RoomEvents struct {
 	Keys         []string                  `json:"keys"`
 	OrderBy      string                    `json:"order_by"`
 	SearchTerm   string                    `json:"search_term"`
+	// FromTS and ToTS restrict the results to events with an origin_server_ts
+	// in the given range, in milliseconds. Both are inclusive and not part
+	// of the spec.
+	FromTS int64 `json:"from_ts,omitempty"`
+	ToTS   int64 `json:"to_ts,omitempty"`
 }
 
 type SearchCategories struct {
@@ -374,7 +484,8 @@ type RoomResult struct {
 }
 
 type Groups struct {
-	RoomID map[string]RoomResult `json:"room_id"`
+	RoomID map[string]RoomResult `json:"room_id,omitempty"`
+	Sender map[string]RoomResult `json:"sender,omitempty"`
 }
 
 type Result struct {
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/fulltext"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -29,6 +30,11 @@ func (f *FakeSyncRoomserverAPI) QueryUserIDForSender(ctx context.Context, roomID
 	return spec.NewUserID(string(senderID), true)
 }
 
+func (f *FakeSyncRoomserverAPI) QuerySenderIDForUser(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (*spec.SenderID, error) {
+	senderID := spec.SenderID(userID.String())
+	return &senderID, nil
+}
+
 func TestSearch(t *testing.T) {
 	alice := test.NewUser(t)
 	aliceDevice := userapi.Device{UserID: alice.ID}
@@ -39,6 +45,8 @@ func TestSearch(t *testing.T) {
 
 	roomsFilter := []string{room.ID}
 	roomsFilterUnknown := []string{"!unknown"}
+	sendersFilter := []string{alice.ID}
+	sendersFilterUnknown := []string{"@unknown:test"}
 
 	emptyFromString := ""
 	fromStringValid := "1"
@@ -51,6 +59,8 @@ func TestSearch(t *testing.T) {
 		device            *userapi.Device
 		wantResponseCount int
 		from              *string
+		// The groups expected in the response, results aren't compared
+		wantGroups Groups
 	}{
 		{
 			name:      "no user ID",
@@ -196,6 +206,125 @@ func TestSearch(t *testing.T) {
 			device: &aliceDevice,
 			from:   &fromStringInvalid,
 		},
+		{
+			name:   "filter on sender",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "hello",
+						Filter: synctypes.RoomEventFilter{
+							Senders: &sendersFilter,
+						},
+					},
+				},
+			},
+			device:            &aliceDevice,
+			wantResponseCount: 1,
+		},
+		{
+			name:   "filter on unknown sender",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "hello",
+						Filter: synctypes.RoomEventFilter{
+							Senders: &sendersFilterUnknown,
+						},
+					},
+				},
+			},
+			device: &aliceDevice,
+		},
+		{
+			name:   "filter on excluded sender",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "hello",
+						Filter: synctypes.RoomEventFilter{
+							NotSenders: &sendersFilter,
+						},
+					},
+				},
+			},
+			device: &aliceDevice,
+		},
+		{
+			name:   "filter on time range",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "hello",
+						FromTS:     time.Now().Add(-time.Hour).UnixMilli(),
+						ToTS:       time.Now().Add(time.Hour).UnixMilli(),
+					},
+				},
+			},
+			device:            &aliceDevice,
+			wantResponseCount: 1,
+		},
+		{
+			name:   "filter on time range without results",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "hello",
+						FromTS:     time.Now().Add(time.Hour).UnixMilli(),
+					},
+				},
+			},
+			device: &aliceDevice,
+		},
+		{
+			name:   "group by sender",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "hello",
+						Groupings:  Groupings{GroupBy: []GroupBy{{Key: "sender"}}},
+					},
+				},
+			},
+			device:            &aliceDevice,
+			wantResponseCount: 1,
+			wantGroups:        Groups{Sender: map[string]RoomResult{alice.ID: {}}},
+		},
+		{
+			name:   "group by room and sender",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "hello",
+						Groupings:  Groupings{GroupBy: []GroupBy{{Key: "room_id"}, {Key: "sender"}}},
+					},
+				},
+			},
+			device:            &aliceDevice,
+			wantResponseCount: 1,
+			wantGroups: Groups{
+				RoomID: map[string]RoomResult{room.ID: {}},
+				Sender: map[string]RoomResult{alice.ID: {}},
+			},
+		},
+		{
+			name: "group by unknown key",
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "hello",
+						Groupings:  Groupings{GroupBy: []GroupBy{{Key: "unknown"}}},
+					},
+				},
+			},
+			device: &aliceDevice,
+		},
 		{
 			name:   "order by stream position",
 			wantOK: true,
@@ -239,9 +368,11 @@ func TestSearch(t *testing.T) {
 			elements = append(elements, fulltext.IndexElement{
 				EventID:        x.EventID(),
 				RoomID:         x.RoomID().String(),
+				Sender:         string(x.SenderID()),
 				Content:        string(x.Content()),
 				ContentType:    x.Type(),
 				StreamPosition: int64(sp),
+				OriginServerTS: int64(x.OriginServerTS()),
 			})
 		}
 		// Index the events
@@ -265,6 +396,17 @@ func TestSearch(t *testing.T) {
 					t.Fatalf("not a SearchResponse: %T: %s", res.JSON, res.JSON)
 				}
 				assert.Equal(t, tc.wantResponseCount, resp.SearchCategories.RoomEvents.Count)
+				if tc.wantGroups.RoomID != nil || tc.wantGroups.Sender != nil {
+					groups := resp.SearchCategories.RoomEvents.Groups
+					assert.Equal(t, len(tc.wantGroups.RoomID), len(groups.RoomID))
+					for roomID := range tc.wantGroups.RoomID {
+						assert.NotEmpty(t, groups.RoomID[roomID].Results)
+					}
+					assert.Equal(t, len(tc.wantGroups.Sender), len(groups.Sender))
+					for sender := range tc.wantGroups.Sender {
+						assert.NotEmpty(t, groups.Sender[sender].Results)
+					}
+				}
 
 				// if we requested state, it should not be empty
 				if tc.searchReq.SearchCategories.RoomEvents.IncludeState {
@@ -110,6 +110,16 @@ type DatabaseTransaction interface {
 	GetPresences(ctx context.Context, userID []string) ([]*types.PresenceInternal, error)
 	PresenceAfter(ctx context.Context, after types.StreamPosition, filter synctypes.EventFilter) (map[string]*types.PresenceInternal, error)
 	RelationsFor(ctx context.Context, roomID, eventID, relType, eventType string, from, to types.StreamPosition, backwards bool, limit int) (events []types.StreamEvent, prevBatch, nextBatch string, err error)
+	// ThreadsFor returns the thread root events in the given room, ordered by most recent thread activity.
+	// If userID is not empty, only threads the user has participated in are returned. A "from" position
+	// of 0 starts from the most recent thread. The returned nextBatch is empty if there are no more threads.
+	ThreadsFor(ctx context.Context, roomID, userID string, from types.StreamPosition, limit int) (events []types.StreamEvent, nextBatch string, err error)
+	// ThreadSummaries returns the thread summaries for those of the given events which are thread roots.
+	ThreadSummaries(ctx context.Context, roomID string, eventIDs []string, userID string) (map[string]types.ThreadSummary, error)
+	// EventIDAtTimestamp returns the ID and timestamp of the event closest to the given timestamp, looking at
+	// events sent at or before it if backwards is true, or at or after it otherwise. Returns sql.ErrNoRows if
+	// there is no such event.
+	EventIDAtTimestamp(ctx context.Context, roomID string, ts spec.Timestamp, backwards bool) (eventID string, originServerTS spec.Timestamp, err error)
 }
 
 type Database interface {
@@ -172,6 +182,17 @@ type Database interface {
 	ReIndex(ctx context.Context, limit, afterID int64) (map[int64]rstypes.HeaderedEvent, error)
 	UpdateRelations(ctx context.Context, event *rstypes.HeaderedEvent) error
 	RedactRelations(ctx context.Context, roomID, redactedEventID string) error
+	// RoomIDs returns the IDs of all rooms which have current state.
+	RoomIDs(ctx context.Context) ([]string, error)
+	// CurrentStateEvent returns the current state event of the given type and state key in the room,
+	// or nil if there is none.
+	CurrentStateEvent(ctx context.Context, roomID, evType, stateKey string) (*rstypes.HeaderedEvent, error)
+	// EventsBeforeTimestamp returns up to limit events in the room which were sent before the given
+	// timestamp, ordered by stream position and starting after afterPos.
+	EventsBeforeTimestamp(ctx context.Context, roomID string, before spec.Timestamp, afterPos types.StreamPosition, limit int) ([]types.StreamEvent, error)
+	// DeleteEvents removes the given events in the room from the timeline, e.g. once they have
+	// expired under the room's retention policy.
+	DeleteEvents(ctx context.Context, roomID string, eventIDs []string) error
 	SelectMemberships(
 		ctx context.Context,
 		roomID string, pos types.TopologyToken,
@@ -191,5 +212,5 @@ type SharedUsers interface {
 
 type Notifications interface {
 	// UpsertRoomUnreadNotificationCounts updates the notification statistics about a (user, room) key.
-	UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int) (types.StreamPosition, error)
+	UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int, threadCounts map[string]eventutil.ThreadNotificationData) (types.StreamPosition, error)
 }
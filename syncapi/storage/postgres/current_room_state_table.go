@@ -123,6 +123,9 @@ ORDER BY added_at, state_key
 LIMIT 5
 `
 
+const selectRoomIDsSQL = "" +
+	"SELECT DISTINCT room_id FROM syncapi_current_room_state"
+
 type currentRoomStateStatements struct {
 	upsertRoomStateStmt                *sql.Stmt
 	deleteRoomStateByEventIDStmt       *sql.Stmt
@@ -137,6 +140,7 @@ type currentRoomStateStatements struct {
 	selectSharedUsersStmt              *sql.Stmt
 	selectMembershipCountStmt          *sql.Stmt
 	selectRoomHeroesStmt               *sql.Stmt
+	selectRoomIDsStmt                  *sql.Stmt
 }
 
 func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, error) {
@@ -170,6 +174,7 @@ func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, erro
 		{&s.selectSharedUsersStmt, selectSharedUsersSQL},
 		{&s.selectMembershipCountStmt, selectMembershipCount},
 		{&s.selectRoomHeroesStmt, selectRoomHeroes},
+		{&s.selectRoomIDsStmt, selectRoomIDsSQL},
 	}.Prepare(db)
 }
 
@@ -483,3 +488,21 @@ func (s *currentRoomStateStatements) SelectMembershipCount(ctx context.Context,
 	}
 	return count, nil
 }
+
+func (s *currentRoomStateStatements) SelectRoomIDs(ctx context.Context, txn *sql.Tx) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomIDsStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomIDs: rows.close() failed")
+
+	var roomID string
+	var result []string
+	for rows.Next() {
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		result = append(result, roomID)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,297 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !wasm
+// +build !wasm
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/lib/pq"
+
+	"github.com/matrix-org/dendrite/internal/fulltext"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/syncapi/storage/postgres/deltas"
+)
+
+const fulltextSchema = `
+-- Stores the searchable content of events, for the postgres fulltext backend
+CREATE TABLE IF NOT EXISTS syncapi_fulltext (
+	event_id TEXT NOT NULL PRIMARY KEY,
+	room_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	-- The field the content was taken from, e.g. content.body
+	content_type TEXT NOT NULL,
+	content TEXT NOT NULL,
+	stream_pos BIGINT NOT NULL,
+	origin_server_ts BIGINT NOT NULL,
+	-- The content, stemmed according to the configured language
+	vector TSVECTOR NOT NULL,
+	-- The text search configuration the vector was created with, e.g. english
+	language TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS syncapi_fulltext_vector_idx ON syncapi_fulltext USING GIN(vector);
+CREATE INDEX IF NOT EXISTS syncapi_fulltext_room_id_idx ON syncapi_fulltext(room_id);
+`
+
+const upsertFulltextSQL = "" +
+	"INSERT INTO syncapi_fulltext (event_id, room_id, sender, content_type, content, stream_pos, origin_server_ts, vector, language)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, to_tsvector($8::regconfig, $5), $8)" +
+	" ON CONFLICT (event_id) DO UPDATE SET room_id = $2, sender = $3, content_type = $4, content = $5," +
+	" stream_pos = $6, origin_server_ts = $7, vector = to_tsvector($8::regconfig, $5), language = $8"
+
+const deleteFulltextSQL = "" +
+	"DELETE FROM syncapi_fulltext WHERE event_id = $1"
+
+const selectRegconfigExistsSQL = "" +
+	"SELECT to_regconfig($1) IS NOT NULL"
+
+const selectFulltextEmptySQL = "" +
+	"SELECT NOT EXISTS (SELECT 1 FROM syncapi_fulltext)"
+
+const selectFulltextOtherLanguageSQL = "" +
+	"SELECT EXISTS (SELECT 1 FROM syncapi_fulltext WHERE language <> $1)"
+
+// The conditions are the same as the queries of the bleve index.
+const fulltextConditions = "" +
+	" WHERE vector @@ query" +
+	" AND ( $3::text[] IS NULL OR     room_id = ANY($3)  )" +
+	" AND ( $4::text[] IS NULL OR     content_type = ANY($4)  )" +
+	" AND ( $5::text[] IS NULL OR     sender = ANY($5)  )" +
+	" AND ( $6::text[] IS NULL OR NOT(sender = ANY($6)) )" +
+	" AND ( $7::bigint = 0 OR origin_server_ts >= $7 )" +
+	" AND ( $8::bigint = 0 OR origin_server_ts <= $8 )"
+
+const selectFulltextSQL = "" +
+	"SELECT event_id, COUNT(*) OVER(), ts_rank_cd(vector, query)," +
+	" ts_headline($1::regconfig, content, query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true')" +
+	" FROM syncapi_fulltext, plainto_tsquery($1::regconfig, $2) query" +
+	fulltextConditions
+
+const selectFulltextByRankSQL = selectFulltextSQL +
+	" ORDER BY 3 DESC, stream_pos DESC LIMIT $9 OFFSET $10"
+
+const selectFulltextByStreamPosSQL = selectFulltextSQL +
+	" ORDER BY stream_pos DESC LIMIT $9 OFFSET $10"
+
+const selectFulltextCountSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_fulltext, plainto_tsquery($1::regconfig, $2) query" +
+	fulltextConditions
+
+// postgresLanguages maps the languages supported by bleve to the text search
+// configurations of postgres. Languages without a configuration aren't
+// stemmed.
+var postgresLanguages = map[string]string{
+	"ar":  "arabic",
+	"da":  "danish",
+	"de":  "german",
+	"en":  "english",
+	"es":  "spanish",
+	"fi":  "finnish",
+	"fr":  "french",
+	"hu":  "hungarian",
+	"it":  "italian",
+	"nl":  "dutch",
+	"no":  "norwegian",
+	"pt":  "portuguese",
+	"ro":  "romanian",
+	"ru":  "russian",
+	"sv":  "swedish",
+	"tr":  "turkish",
+	"cjk": "simple",
+	"ckb": "simple",
+	"fa":  "simple",
+	"hi":  "simple",
+	"hr":  "simple",
+}
+
+// Fulltext is a fulltext index stored in the postgres database of the sync
+// API, so that it can be shared by multiple sync API instances.
+type Fulltext struct {
+	ctx context.Context
+	db  *sql.DB
+	// The text search configuration, e.g. english
+	language     string
+	needsReindex bool
+
+	upsertStmt            *sql.Stmt
+	deleteStmt            *sql.Stmt
+	selectByRankStmt      *sql.Stmt
+	selectByStreamPosStmt *sql.Stmt
+	selectCountStmt       *sql.Stmt
+}
+
+// NewFulltext creates the fulltext index in the given postgres database.
+func NewFulltext(
+	processCtx *process.ProcessContext, cm *sqlutil.Connections,
+	dbProperties *config.DatabaseOptions, cfg config.Fulltext,
+) (*Fulltext, error) {
+	db, _, err := cm.Connection(dbProperties)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(fulltextSchema); err != nil {
+		return nil, err
+	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "syncapi: add language to fulltext index",
+		Up:      deltas.UpAddFulltextLanguage,
+	})
+	if err = m.Up(processCtx.Context()); err != nil {
+		return nil, err
+	}
+	f := &Fulltext{
+		ctx:      processCtx.Context(),
+		db:       db,
+		language: cfg.Language,
+	}
+	if language, ok := postgresLanguages[cfg.Language]; ok {
+		f.language = language
+	}
+	// Other languages are used as the name of the text search configuration,
+	// so make sure that postgres knows it rather than failing every query.
+	var languageExists bool
+	if err = db.QueryRow(selectRegconfigExistsSQL, f.language).Scan(&languageExists); err != nil {
+		return nil, err
+	}
+	if !languageExists {
+		return nil, fmt.Errorf("search language %q is not supported by postgres", cfg.Language)
+	}
+	if err = (sqlutil.StatementList{
+		{&f.upsertStmt, upsertFulltextSQL},
+		{&f.deleteStmt, deleteFulltextSQL},
+		{&f.selectByRankStmt, selectFulltextByRankSQL},
+		{&f.selectByStreamPosStmt, selectFulltextByStreamPosSQL},
+		{&f.selectCountStmt, selectFulltextCountSQL},
+	}.Prepare(db)); err != nil {
+		return nil, err
+	}
+	// Index the existing events when starting with an empty index, e.g.
+	// after switching from bleve, or when some events were stemmed with a
+	// different language.
+	if err = db.QueryRow(selectFulltextEmptySQL).Scan(&f.needsReindex); err != nil {
+		return nil, err
+	}
+	if !f.needsReindex {
+		if err = db.QueryRow(selectFulltextOtherLanguageSQL, f.language).Scan(&f.needsReindex); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Close does nothing, as the database connection is shared.
+func (f *Fulltext) Close() error {
+	return nil
+}
+
+// NeedsReindex returns whether the index was empty or built with a different
+// language when it was opened.
+func (f *Fulltext) NeedsReindex() bool {
+	return f.needsReindex
+}
+
+// Index indexes the given elements
+func (f *Fulltext) Index(elements ...fulltext.IndexElement) error {
+	return sqlutil.WithTransaction(f.db, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, f.upsertStmt)
+		for _, e := range elements {
+			if _, err := stmt.ExecContext(
+				f.ctx, e.EventID, e.RoomID, e.Sender, e.ContentType, e.Content,
+				e.StreamPosition, e.OriginServerTS, f.language,
+			); err != nil {
+				return fmt.Errorf("failed to index event %s: %w", e.EventID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Delete deletes an indexed element by the eventID
+func (f *Fulltext) Delete(eventID string) error {
+	_, err := f.deleteStmt.ExecContext(f.ctx, eventID)
+	return err
+}
+
+// GetHighlights extracts the highlights from a SearchResult.
+func (f *Fulltext) GetHighlights(result *bleve.SearchResult) []string {
+	return fulltext.GetHighlights(result)
+}
+
+// Search searches the index given a search term, roomIDs, keys and filter.
+// The results are returned in the same form as those of the bleve index.
+func (f *Fulltext) Search(term string, roomIDs, keys []string, filter fulltext.SearchFilter, limit, from int, orderByStreamPos bool) (*bleve.SearchResult, error) {
+	start := time.Now()
+	args := []interface{}{
+		f.language, term,
+		nullableArray(roomIDs), nullableArray(keys),
+		nullableArray(filter.Senders), nullableArray(filter.NotSenders),
+		filter.FromTS, filter.ToTS,
+	}
+	stmt := f.selectByRankStmt
+	if orderByStreamPos {
+		stmt = f.selectByStreamPosStmt
+	}
+	rows, err := stmt.QueryContext(f.ctx, append(args, limit, from)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	result := &bleve.SearchResult{}
+	for rows.Next() {
+		var (
+			hit       search.DocumentMatch
+			headline  string
+			total     uint64
+			rankScore float64
+		)
+		if err = rows.Scan(&hit.ID, &total, &rankScore, &headline); err != nil {
+			return nil, err
+		}
+		hit.Score = rankScore
+		hit.Fragments = search.FieldFragmentMap{"Content": {headline}}
+		result.Total = total
+		result.Hits = append(result.Hits, &hit)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// Paginating past the end still returns the total number of results.
+	if len(result.Hits) == 0 && from > 0 {
+		if err = f.selectCountStmt.QueryRowContext(f.ctx, args...).Scan(&result.Total); err != nil {
+			return nil, err
+		}
+	}
+	result.Took = time.Since(start)
+	return result, nil
+}
+
+// nullableArray returns NULL for empty lists, which don't restrict the search.
+func nullableArray(values []string) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	return pq.StringArray(values)
+}
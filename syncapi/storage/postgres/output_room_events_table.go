@@ -32,6 +32,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/synctypes"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 const outputRoomEventsSchema = `
@@ -71,7 +72,9 @@ CREATE TABLE IF NOT EXISTS syncapi_output_room_events (
   -- were emitted.
   exclude_from_sync BOOL DEFAULT FALSE,
   -- The history visibility before this event (1 - world_readable; 2 - shared; 3 - invited; 4 - joined)
-  history_visibility SMALLINT NOT NULL DEFAULT 2
+  history_visibility SMALLINT NOT NULL DEFAULT 2,
+  -- The 'origin_server_ts' of the event, used to find events closest to a given time.
+  origin_server_ts BIGINT NOT NULL DEFAULT 0
 );
 
 CREATE INDEX IF NOT EXISTS syncapi_output_room_events_type_idx ON syncapi_output_room_events (type);
@@ -87,8 +90,8 @@ CREATE INDEX IF NOT EXISTS syncapi_output_room_events_recent_events_idx ON synca
 
 const insertEventSQL = "" +
 	"INSERT INTO syncapi_output_room_events (" +
-	"room_id, event_id, headered_event_json, type, sender, contains_url, add_state_ids, remove_state_ids, session_id, transaction_id, exclude_from_sync, history_visibility" +
-	") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) " +
+	"room_id, event_id, headered_event_json, type, sender, contains_url, add_state_ids, remove_state_ids, session_id, transaction_id, exclude_from_sync, history_visibility, origin_server_ts" +
+	") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) " +
 	"ON CONFLICT ON CONSTRAINT syncapi_output_room_event_id_idx DO UPDATE SET exclude_from_sync = (excluded.exclude_from_sync AND $11) " +
 	"RETURNING id"
 
@@ -189,6 +192,24 @@ const selectContextAfterEventSQL = "" +
 const purgeEventsSQL = "" +
 	"DELETE FROM syncapi_output_room_events WHERE room_id = $1"
 
+const selectEventBeforeTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND origin_server_ts <= $2" +
+	" ORDER BY origin_server_ts DESC, id DESC LIMIT 1"
+
+const selectEventAfterTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND origin_server_ts >= $2" +
+	" ORDER BY origin_server_ts ASC, id ASC LIMIT 1"
+
+const selectEventsBeforeTimestampSQL = "" +
+	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND origin_server_ts < $2 AND id > $3" +
+	" ORDER BY id ASC LIMIT $4"
+
+const deleteEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE event_id = ANY($1)"
+
 const selectSearchSQL = "SELECT id, event_id, headered_event_json FROM syncapi_output_room_events WHERE id > $1 AND type = ANY($2) ORDER BY id ASC LIMIT $3"
 
 type outputRoomEventsStatements struct {
@@ -207,6 +228,10 @@ type outputRoomEventsStatements struct {
 	selectContextAfterEventStmt    *sql.Stmt
 	purgeEventsStmt                *sql.Stmt
 	selectSearchStmt               *sql.Stmt
+	selectEventBeforeTSStmt        *sql.Stmt
+	selectEventAfterTSStmt         *sql.Stmt
+	selectEventsBeforeTSStmt       *sql.Stmt
+	deleteEventsStmt               *sql.Stmt
 }
 
 func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
@@ -240,6 +265,10 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 			Version: migrationName,
 			Up:      deltas.UpRenameOutputRoomEventsIndex,
 		},
+		sqlutil.Migration{
+			Version: "syncapi: add origin_server_ts column (output_room_events)",
+			Up:      deltas.UpAddOriginServerTSColumn,
+		},
 	)
 	err = m.Up(context.Background())
 	if err != nil {
@@ -262,6 +291,10 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.selectContextAfterEventStmt, selectContextAfterEventSQL},
 		{&s.purgeEventsStmt, purgeEventsSQL},
 		{&s.selectSearchStmt, selectSearchSQL},
+		{&s.selectEventBeforeTSStmt, selectEventBeforeTimestampSQL},
+		{&s.selectEventAfterTSStmt, selectEventAfterTimestampSQL},
+		{&s.selectEventsBeforeTSStmt, selectEventsBeforeTimestampSQL},
+		{&s.deleteEventsStmt, deleteEventsSQL},
 	}.Prepare(db)
 }
 
@@ -415,6 +448,7 @@ func (s *outputRoomEventsStatements) InsertEvent(
 		txnID,
 		excludeFromSync,
 		historyVisibility,
+		event.OriginServerTS(),
 	).Scan(&streamPos)
 	return
 }
@@ -733,3 +767,37 @@ func (s *outputRoomEventsStatements) ReIndex(ctx context.Context, txn *sql.Tx, l
 	}
 	return result, rows.Err()
 }
+
+// SelectEventIDAtTimestamp returns the event closest to the given timestamp in the room, looking
+// at events sent at or before the timestamp if backwards is true, and at or after it otherwise.
+// Returns sql.ErrNoRows if there is no such event.
+func (s *outputRoomEventsStatements) SelectEventIDAtTimestamp(
+	ctx context.Context, txn *sql.Tx, roomID string, ts spec.Timestamp, backwards bool,
+) (eventID string, originServerTS spec.Timestamp, err error) {
+	stmt := s.selectEventAfterTSStmt
+	if backwards {
+		stmt = s.selectEventBeforeTSStmt
+	}
+	err = sqlutil.TxStmt(txn, stmt).QueryRowContext(ctx, roomID, ts).Scan(&eventID, &originServerTS)
+	return
+}
+
+// SelectEventsBeforeTimestamp returns up to limit events in the room which were sent before the
+// given timestamp, ordered by stream position and starting after the given stream position.
+func (s *outputRoomEventsStatements) SelectEventsBeforeTimestamp(
+	ctx context.Context, txn *sql.Tx, roomID string, before spec.Timestamp, afterPos types.StreamPosition, limit int,
+) ([]types.StreamEvent, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectEventsBeforeTSStmt).QueryContext(ctx, roomID, before, afterPos, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventsBeforeTimestamp: rows.close() failed")
+	return rowsToStreamEvents(rows)
+}
+
+func (s *outputRoomEventsStatements) DeleteEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteEventsStmt).ExecContext(ctx, pq.StringArray(eventIDs))
+	return err
+}
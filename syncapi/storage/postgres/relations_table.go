@@ -18,6 +18,8 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/lib/pq"
+
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
@@ -66,12 +68,40 @@ const selectRelationsInRangeDescSQL = "" +
 const selectMaxRelationIDSQL = "" +
 	"SELECT COALESCE(MAX(id), 0) FROM syncapi_relations"
 
+const selectThreadsSQL = "" +
+	"SELECT event_id, MAX(id) AS latest_id FROM syncapi_relations" +
+	" WHERE room_id = $1 AND rel_type = 'm.thread'" +
+	" AND ( $2 = '' OR event_id IN (" +
+	"  SELECT event_id FROM syncapi_output_room_events WHERE room_id = $1 AND sender = $2" +
+	"  UNION" +
+	"  SELECT p.event_id FROM syncapi_relations p" +
+	"  JOIN syncapi_output_room_events e ON e.event_id = p.child_event_id" +
+	"  WHERE p.room_id = $1 AND p.rel_type = 'm.thread' AND e.sender = $2" +
+	" ) )" +
+	" GROUP BY event_id" +
+	" HAVING MAX(id) < $3" +
+	" ORDER BY latest_id DESC LIMIT $4"
+
+const selectThreadSummariesSQL = "" +
+	"SELECT r.event_id, COUNT(*), MAX(r.id)," +
+	" COALESCE(MAX(CASE WHEN e.sender = $1 THEN 1 ELSE 0 END), 0)" +
+	" FROM syncapi_relations r" +
+	" LEFT JOIN syncapi_output_room_events e ON e.event_id = r.child_event_id" +
+	" WHERE r.room_id = $2 AND r.rel_type = 'm.thread' AND r.event_id = ANY($3)" +
+	" GROUP BY r.event_id"
+
+const selectRelationChildEventIDsSQL = "" +
+	"SELECT id, child_event_id FROM syncapi_relations WHERE id = ANY($1)"
+
 type relationsStatements struct {
-	insertRelationStmt             *sql.Stmt
-	selectRelationsInRangeAscStmt  *sql.Stmt
-	selectRelationsInRangeDescStmt *sql.Stmt
-	deleteRelationStmt             *sql.Stmt
-	selectMaxRelationIDStmt        *sql.Stmt
+	insertRelationStmt              *sql.Stmt
+	selectRelationsInRangeAscStmt   *sql.Stmt
+	selectRelationsInRangeDescStmt  *sql.Stmt
+	deleteRelationStmt              *sql.Stmt
+	selectMaxRelationIDStmt         *sql.Stmt
+	selectThreadsStmt               *sql.Stmt
+	selectThreadSummariesStmt       *sql.Stmt
+	selectRelationChildEventIDsStmt *sql.Stmt
 }
 
 func NewPostgresRelationsTable(db *sql.DB) (tables.Relations, error) {
@@ -86,6 +116,9 @@ func NewPostgresRelationsTable(db *sql.DB) (tables.Relations, error) {
 		{&s.selectRelationsInRangeDescStmt, selectRelationsInRangeDescSQL},
 		{&s.deleteRelationStmt, deleteRelationSQL},
 		{&s.selectMaxRelationIDStmt, selectMaxRelationIDSQL},
+		{&s.selectThreadsStmt, selectThreadsSQL},
+		{&s.selectThreadSummariesStmt, selectThreadSummariesSQL},
+		{&s.selectRelationChildEventIDsStmt, selectRelationChildEventIDsSQL},
 	}.Prepare(db)
 }
 
@@ -156,3 +189,86 @@ func (s *relationsStatements) SelectMaxRelationID(
 	err = stmt.QueryRowContext(ctx).Scan(&id)
 	return
 }
+
+func (s *relationsStatements) SelectThreads(
+	ctx context.Context, txn *sql.Tx, roomID, userID string, from types.StreamPosition, limit int,
+) ([]types.RelationEntry, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectThreadsStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, userID, from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectThreads: rows.close() failed")
+	var result []types.RelationEntry
+	for rows.Next() {
+		var entry types.RelationEntry
+		if err = rows.Scan(&entry.EventID, &entry.Position); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+func (s *relationsStatements) SelectThreadSummaries(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string, userID string,
+) (map[string]types.ThreadSummary, error) {
+	result := make(map[string]types.ThreadSummary, len(eventIDs))
+	if len(eventIDs) == 0 {
+		return result, nil
+	}
+	stmt := sqlutil.TxStmt(txn, s.selectThreadSummariesStmt)
+	rows, err := stmt.QueryContext(ctx, userID, roomID, pq.StringArray(eventIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectThreadSummaries: rows.close() failed")
+	latestIDs := map[int64]string{}
+	for rows.Next() {
+		var (
+			eventID      string
+			count        int
+			latestID     int64
+			participated int
+		)
+		if err = rows.Scan(&eventID, &count, &latestID, &participated); err != nil {
+			return nil, err
+		}
+		result[eventID] = types.ThreadSummary{
+			Count:        count,
+			Participated: participated > 0,
+		}
+		latestIDs[latestID] = eventID
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(latestIDs) == 0 {
+		return result, nil
+	}
+
+	ids := make([]int64, 0, len(latestIDs))
+	for id := range latestIDs {
+		ids = append(ids, id)
+	}
+	stmt = sqlutil.TxStmt(txn, s.selectRelationChildEventIDsStmt)
+	childRows, err := stmt.QueryContext(ctx, pq.Int64Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, childRows, "selectRelationChildEventIDs: rows.close() failed")
+	for childRows.Next() {
+		var (
+			id           int64
+			childEventID string
+		)
+		if err = childRows.Scan(&id, &childEventID); err != nil {
+			return nil, err
+		}
+		rootEventID := latestIDs[id]
+		summary := result[rootEventID]
+		summary.LatestEventID = childEventID
+		result[rootEventID] = summary
+	}
+	return result, childRows.Err()
+}
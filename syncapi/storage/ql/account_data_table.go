@@ -0,0 +1,169 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/synctypes"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const accountDataSchema = `
+-- Stores the types of account data that a user set has globally and in each room
+-- and the stream ID when that type was last updated.
+CREATE TABLE IF NOT EXISTS syncapi_account_data_type (
+    -- An incrementing ID which denotes the position in the log that this event resides at.
+    id int64 NOT NULL,
+    -- ID of the user the data belongs to
+    user_id string NOT NULL,
+    -- ID of the room the data is related to (empty string if not related to a specific room)
+    room_id string NOT NULL,
+    -- Type of the data
+    type string NOT NULL
+);
+
+-- We don't want two entries of the same type for the same user
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_account_data_unique_idx ON syncapi_account_data_type(user_id, room_id, type);
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_account_data_id_idx ON syncapi_account_data_type(id, type);
+`
+
+const insertAccountDataSQL = "" +
+	"INSERT INTO syncapi_account_data_type (id, user_id, room_id, type) VALUES ($1, $2, $3, $4)"
+
+const updateAccountDataSQL = "" +
+	"UPDATE syncapi_account_data_type SET id = $1 WHERE user_id = $2 AND room_id = $3 AND type = $4"
+
+// further parameters are added by prepareWithFilters
+const selectAccountDataInRangeSQL = "" +
+	"SELECT id, room_id, type FROM syncapi_account_data_type" +
+	" WHERE user_id = $1 AND id > $2 AND id <= $3"
+
+const selectMaxAccountDataIDSQL = "" +
+	"SELECT max(id) FROM syncapi_account_data_type"
+
+type accountDataStatements struct {
+	db                         *sql.DB
+	streamIDStatements         *StreamIDStatements
+	insertAccountDataStmt      *sql.Stmt
+	updateAccountDataStmt      *sql.Stmt
+	selectMaxAccountDataIDStmt *sql.Stmt
+	// selectAccountDataInRangeStmt *sql.Stmt - prepared at runtime due to variadic
+}
+
+func NewQLAccountDataTable(db *sql.DB, streamID *StreamIDStatements) (tables.AccountData, error) {
+	s := &accountDataStatements{
+		db:                 db,
+		streamIDStatements: streamID,
+	}
+	_, err := db.Exec(accountDataSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertAccountDataStmt, insertAccountDataSQL},
+		{&s.updateAccountDataStmt, updateAccountDataSQL},
+		{&s.selectMaxAccountDataIDStmt, selectMaxAccountDataIDSQL},
+	}.Prepare(db)
+}
+
+func (s *accountDataStatements) InsertAccountData(
+	ctx context.Context, txn *sql.Tx,
+	userID, roomID, dataType string,
+) (pos types.StreamPosition, err error) {
+	pos, err = s.streamIDStatements.nextPDUID(ctx, txn)
+	if err != nil {
+		return
+	}
+	res, err := sqlutil.TxStmt(txn, s.updateAccountDataStmt).ExecContext(ctx, pos, userID, roomID, dataType)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return pos, err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertAccountDataStmt).ExecContext(ctx, pos, userID, roomID, dataType)
+	return
+}
+
+func (s *accountDataStatements) SelectAccountDataInRange(
+	ctx context.Context, txn *sql.Tx,
+	userID string,
+	r types.Range,
+	accountDataEventFilter *synctypes.EventFilter,
+) (data map[string][]string, pos types.StreamPosition, err error) {
+	data = make(map[string][]string)
+
+	stmt, params, err := prepareWithFilters(
+		s.db, txn, selectAccountDataInRangeSQL,
+		[]interface{}{
+			userID, r.Low(), r.High(),
+		},
+		nil, nil,
+		filterConvertTypeWildcardToSQL(accountDataEventFilter.Types),
+		filterConvertTypeWildcardToSQL(accountDataEventFilter.NotTypes),
+		nil, nil, accountDataEventFilter.Limit, FilterOrderAsc,
+	)
+	if err != nil {
+		return
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "selectAccountDataInRange: stmt.close() failed")
+
+	rows, err := stmt.QueryContext(ctx, params...)
+	if err != nil {
+		return
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAccountDataInRange: rows.close() failed")
+
+	var dataType string
+	var roomID string
+	var id types.StreamPosition
+
+	for rows.Next() {
+		if err = rows.Scan(&id, &roomID, &dataType); err != nil {
+			return
+		}
+
+		if len(data[roomID]) > 0 {
+			data[roomID] = append(data[roomID], dataType)
+		} else {
+			data[roomID] = []string{dataType}
+		}
+		if id > pos {
+			pos = id
+		}
+	}
+	if pos == 0 {
+		pos = r.High()
+	}
+	return data, pos, rows.Err()
+}
+
+func (s *accountDataStatements) SelectMaxAccountDataID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxAccountDataIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
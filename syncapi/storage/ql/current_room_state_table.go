@@ -0,0 +1,562 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	rstypes "github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/synctypes"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const currentRoomStateSchema = `
+-- Stores the current room state for every room.
+CREATE TABLE IF NOT EXISTS syncapi_current_room_state (
+    -- The 'room_id' key for the state event.
+    room_id string NOT NULL,
+    -- The state event ID
+    event_id string NOT NULL,
+    -- The state event type e.g 'm.room.member'
+    type string NOT NULL,
+    -- The 'sender' property of the event.
+    sender string NOT NULL,
+	-- true if the event content contains a url key
+    contains_url bool NOT NULL,
+    -- The state_key value for this state event e.g ''
+    state_key string NOT NULL,
+    -- The JSON for the event.
+    headered_event_json blob NOT NULL,
+    -- The 'content.membership' value if this event is an m.room.member event. For other
+    -- events, this will be NULL.
+    membership string,
+    -- The serial ID of the output_room_events table when this event became
+    -- part of the current state of the room.
+    added_at int64,
+    history_visibility int64 NOT NULL DEFAULT 2
+);
+-- Clobber based on 3-uple of room_id, type and state_key
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_current_room_state_unique_idx ON syncapi_current_room_state(room_id, type, state_key);
+-- for event deletion
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_event_id_idx ON syncapi_current_room_state(event_id, room_id, type, sender, contains_url);
+-- for querying membership states of users
+CREATE INDEX IF NOT EXISTS syncapi_membership_idx ON syncapi_current_room_state(type, state_key, membership);
+-- for querying state by event IDs
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_current_room_state_eventid_idx ON syncapi_current_room_state(event_id);
+-- for improving selectRoomIDsWithAnyMembershipSQL
+CREATE INDEX IF NOT EXISTS syncapi_current_room_state_type_state_key_idx ON syncapi_current_room_state(type, state_key);
+`
+
+const insertRoomStateSQL = "" +
+	"INSERT INTO syncapi_current_room_state (room_id, event_id, type, sender, contains_url, state_key, headered_event_json, membership, added_at, history_visibility)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+
+const updateRoomStateSQL = "" +
+	"UPDATE syncapi_current_room_state SET event_id = $2, sender = $4, contains_url = $5, headered_event_json = $7, membership = $8, added_at = $9" +
+	" WHERE room_id = $1 AND type = $3 AND state_key = $6"
+
+const deleteRoomStateByEventIDSQL = "" +
+	"DELETE FROM syncapi_current_room_state WHERE event_id = $1"
+
+const deleteRoomStateForRoomSQL = "" +
+	"DELETE FROM syncapi_current_room_state WHERE room_id = $1"
+
+const selectRoomIDsWithMembershipSQL = "" +
+	"SELECT DISTINCT room_id FROM syncapi_current_room_state WHERE type = \"m.room.member\" AND state_key = $1 AND membership = $2"
+
+const selectRoomIDsWithAnyMembershipSQL = "" +
+	"SELECT room_id, membership FROM syncapi_current_room_state WHERE type = \"m.room.member\" AND state_key = $1"
+
+// further parameters are added by prepareWithFilters
+const selectCurrentStateSQL = "" +
+	"SELECT event_id, headered_event_json FROM syncapi_current_room_state WHERE room_id = $1"
+
+const selectJoinedUsersSQL = "" +
+	"SELECT room_id, state_key FROM syncapi_current_room_state WHERE type = \"m.room.member\" AND membership = \"join\""
+
+const selectJoinedUsersInRoomSQL = "" +
+	"SELECT room_id, state_key FROM syncapi_current_room_state WHERE type = \"m.room.member\" AND membership = \"join\" AND room_id IN ($1)"
+
+const selectStateEventSQL = "" +
+	"SELECT headered_event_json FROM syncapi_current_room_state WHERE room_id = $1 AND type = $2 AND state_key = $3"
+
+const selectEventsWithEventIDsSQL = "" +
+	"SELECT event_id, added_at, headered_event_json, history_visibility FROM syncapi_current_room_state WHERE event_id IN ($1)"
+
+const selectSharedUsersSQL = "" +
+	"SELECT state_key FROM syncapi_current_room_state WHERE room_id IN (" +
+	"	SELECT DISTINCT room_id FROM syncapi_current_room_state WHERE state_key = $1 AND membership = \"join\"" +
+	") AND type = \"m.room.member\" AND state_key IN ($2) AND membership IN (\"join\", \"invite\")"
+
+const selectMembershipCount = `SELECT count(*) FROM syncapi_current_room_state WHERE type = "m.room.member" AND room_id = $1 AND membership = $2`
+
+// QL can only order by selected columns, hence the subquery.
+const selectRoomHeroes = `
+SELECT state_key FROM (
+	SELECT added_at, state_key FROM syncapi_current_room_state
+	WHERE type = "m.room.member" AND room_id = $1 AND state_key != $2 AND membership IN ($3)
+	ORDER BY added_at, state_key
+)
+LIMIT 5
+`
+
+const selectRoomIDsSQL = "" +
+	"SELECT DISTINCT room_id FROM syncapi_current_room_state"
+
+type currentRoomStateStatements struct {
+	db                                 *sql.DB
+	insertRoomStateStmt                *sql.Stmt
+	updateRoomStateStmt                *sql.Stmt
+	deleteRoomStateByEventIDStmt       *sql.Stmt
+	deleteRoomStateForRoomStmt         *sql.Stmt
+	selectRoomIDsWithMembershipStmt    *sql.Stmt
+	selectRoomIDsWithAnyMembershipStmt *sql.Stmt
+	selectJoinedUsersStmt              *sql.Stmt
+	selectStateEventStmt               *sql.Stmt
+	selectMembershipCountStmt          *sql.Stmt
+	selectRoomIDsStmt                  *sql.Stmt
+	// selectCurrentStateStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectJoinedUsersInRoomStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectEventsWithEventIDsStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectSharedUsersStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectRoomHeroesStmt *sql.Stmt - prepared at runtime due to variadic
+}
+
+func NewQLCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, error) {
+	s := &currentRoomStateStatements{
+		db: db,
+	}
+	_, err := db.Exec(currentRoomStateSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertRoomStateStmt, insertRoomStateSQL},
+		{&s.updateRoomStateStmt, updateRoomStateSQL},
+		{&s.deleteRoomStateByEventIDStmt, deleteRoomStateByEventIDSQL},
+		{&s.deleteRoomStateForRoomStmt, deleteRoomStateForRoomSQL},
+		{&s.selectRoomIDsWithMembershipStmt, selectRoomIDsWithMembershipSQL},
+		{&s.selectRoomIDsWithAnyMembershipStmt, selectRoomIDsWithAnyMembershipSQL},
+		{&s.selectJoinedUsersStmt, selectJoinedUsersSQL},
+		{&s.selectStateEventStmt, selectStateEventSQL},
+		{&s.selectMembershipCountStmt, selectMembershipCount},
+		{&s.selectRoomIDsStmt, selectRoomIDsSQL},
+	}.Prepare(db)
+}
+
+// SelectJoinedUsers returns a map of room ID to a list of joined user IDs.
+func (s *currentRoomStateStatements) SelectJoinedUsers(
+	ctx context.Context, txn *sql.Tx,
+) (map[string][]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectJoinedUsersStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectJoinedUsers: rows.close() failed")
+
+	result := make(map[string][]string)
+	var roomID string
+	var userID string
+	for rows.Next() {
+		if err := rows.Scan(&roomID, &userID); err != nil {
+			return nil, err
+		}
+		users := result[roomID]
+		users = append(users, userID)
+		result[roomID] = users
+	}
+	return result, rows.Err()
+}
+
+// SelectJoinedUsersInRoom returns a map of room ID to a list of joined user IDs for a given room.
+func (s *currentRoomStateStatements) SelectJoinedUsersInRoom(
+	ctx context.Context, txn *sql.Tx, roomIDs []string,
+) (map[string][]string, error) {
+	params := make([]interface{}, len(roomIDs))
+	for k, v := range roomIDs {
+		params[k] = v
+	}
+	var qp sqlutil.QueryProvider = s.db
+	if txn != nil {
+		qp = txn
+	}
+
+	result := make(map[string][]string)
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, selectJoinedUsersInRoomSQL, qp, params, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			var userID, roomID string
+			for rows.Next() {
+				if err := rows.Scan(&roomID, &userID); err != nil {
+					return err
+				}
+				result[roomID] = append(result[roomID], userID)
+			}
+			return rows.Err()
+		},
+	)
+	return result, err
+}
+
+// SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
+func (s *currentRoomStateStatements) SelectRoomIDsWithMembership(
+	ctx context.Context,
+	txn *sql.Tx,
+	userID string,
+	membership string, // nolint: unparam
+) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomIDsWithMembershipStmt)
+	rows, err := stmt.QueryContext(ctx, userID, membership)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomIDsWithMembership: rows.close() failed")
+
+	var result []string
+	for rows.Next() {
+		var roomID string
+		if err := rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		result = append(result, roomID)
+	}
+	return result, rows.Err()
+}
+
+// SelectRoomIDsWithAnyMembership returns a map of all memberships for the given user.
+func (s *currentRoomStateStatements) SelectRoomIDsWithAnyMembership(
+	ctx context.Context,
+	txn *sql.Tx,
+	userID string,
+) (map[string]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomIDsWithAnyMembershipStmt)
+	rows, err := stmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomIDsWithAnyMembership: rows.close() failed")
+
+	result := map[string]string{}
+	for rows.Next() {
+		var roomID string
+		var membership string
+		if err := rows.Scan(&roomID, &membership); err != nil {
+			return nil, err
+		}
+		result[roomID] = membership
+	}
+	return result, rows.Err()
+}
+
+// SelectCurrentState returns all the current state events for the given room.
+func (s *currentRoomStateStatements) SelectCurrentState(
+	ctx context.Context, txn *sql.Tx, roomID string,
+	stateFilter *synctypes.StateFilter,
+	excludeEventIDs []string,
+) ([]*rstypes.HeaderedEvent, error) {
+	senders, notSenders := getSendersStateFilterFilter(stateFilter)
+	// We're going to query members later, so remove them from this request
+	if stateFilter.LazyLoadMembers && !stateFilter.IncludeRedundantMembers {
+		notTypes := &[]string{spec.MRoomMember}
+		if stateFilter.NotTypes != nil {
+			*stateFilter.NotTypes = append(*stateFilter.NotTypes, spec.MRoomMember)
+		} else {
+			stateFilter.NotTypes = notTypes
+		}
+	}
+	// The state filter limit is not applied to the current state, hence -1.
+	stmt, params, err := prepareWithFilters(
+		s.db, txn, selectCurrentStateSQL,
+		[]interface{}{
+			roomID,
+		},
+		senders, notSenders,
+		filterConvertTypeWildcardToSQL(stateFilter.Types),
+		filterConvertTypeWildcardToSQL(stateFilter.NotTypes),
+		excludeEventIDs, stateFilter.ContainsURL, -1, FilterOrderNone,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "selectCurrentState: stmt.close() failed")
+
+	rows, err := stmt.QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectCurrentState: rows.close() failed")
+
+	return rowsToEvents(rows)
+}
+
+func (s *currentRoomStateStatements) DeleteRoomStateByEventID(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRoomStateByEventIDStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *currentRoomStateStatements) DeleteRoomStateForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRoomStateForRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *currentRoomStateStatements) UpsertRoomState(
+	ctx context.Context, txn *sql.Tx,
+	event *rstypes.HeaderedEvent, membership *string, addedAt types.StreamPosition,
+) error {
+	// Parse content as JSON and search for an "url" key
+	containsURL := false
+	var content map[string]interface{}
+	if json.Unmarshal(event.Content(), &content) != nil {
+		// Set containsURL to true if url is present
+		_, containsURL = content["url"]
+	}
+
+	headeredJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// upsert state event
+	params := []interface{}{
+		event.RoomID().String(),
+		event.EventID(),
+		event.Type(),
+		event.UserID.String(),
+		containsURL,
+		*event.StateKeyResolved,
+		headeredJSON,
+		membership,
+		addedAt,
+		event.Visibility,
+	}
+	res, err := sqlutil.TxStmt(txn, s.updateRoomStateStmt).ExecContext(ctx, params[:9]...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertRoomStateStmt).ExecContext(ctx, params...)
+	return err
+}
+
+func (s *currentRoomStateStatements) SelectEventsWithEventIDs(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) ([]types.StreamEvent, error) {
+	params := make([]interface{}, len(eventIDs))
+	for k, v := range eventIDs {
+		params[k] = v
+	}
+	var qp sqlutil.QueryProvider = s.db
+	if txn != nil {
+		qp = txn
+	}
+
+	var result []types.StreamEvent
+	err := sqlutil.RunLimitedVariablesQuery(
+		ctx, selectEventsWithEventIDsSQL, qp, params, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			events, err := currentRoomStateRowsToStreamEvents(rows)
+			if err != nil {
+				return err
+			}
+			result = append(result, events...)
+			return nil
+		},
+	)
+	return result, err
+}
+
+func currentRoomStateRowsToStreamEvents(rows *sql.Rows) ([]types.StreamEvent, error) {
+	var events []types.StreamEvent
+	for rows.Next() {
+		var (
+			eventID           string
+			streamPos         types.StreamPosition
+			eventBytes        []byte
+			historyVisibility gomatrixserverlib.HistoryVisibility
+		)
+		if err := rows.Scan(&eventID, &streamPos, &eventBytes, &historyVisibility); err != nil {
+			return nil, err
+		}
+		// TODO: Handle redacted events
+		var ev rstypes.HeaderedEvent
+		if err := json.Unmarshal(eventBytes, &ev); err != nil {
+			return nil, err
+		}
+
+		ev.Visibility = historyVisibility
+
+		events = append(events, types.StreamEvent{
+			HeaderedEvent:  &ev,
+			StreamPosition: streamPos,
+		})
+	}
+
+	return events, rows.Err()
+}
+
+func rowsToEvents(rows *sql.Rows) ([]*rstypes.HeaderedEvent, error) {
+	result := []*rstypes.HeaderedEvent{}
+	for rows.Next() {
+		var eventID string
+		var eventBytes []byte
+		if err := rows.Scan(&eventID, &eventBytes); err != nil {
+			return nil, err
+		}
+		// TODO: Handle redacted events
+		var ev rstypes.HeaderedEvent
+		if err := json.Unmarshal(eventBytes, &ev); err != nil {
+			return nil, err
+		}
+		result = append(result, &ev)
+	}
+	return result, rows.Err()
+}
+
+func (s *currentRoomStateStatements) SelectStateEvent(
+	ctx context.Context, txn *sql.Tx, roomID, evType, stateKey string,
+) (*rstypes.HeaderedEvent, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectStateEventStmt)
+	var res []byte
+	err := stmt.QueryRowContext(ctx, roomID, evType, stateKey).Scan(&res)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ev rstypes.HeaderedEvent
+	if err = json.Unmarshal(res, &ev); err != nil {
+		return nil, err
+	}
+	return &ev, err
+}
+
+func (s *currentRoomStateStatements) SelectSharedUsers(
+	ctx context.Context, txn *sql.Tx, userID string, otherUserIDs []string,
+) ([]string, error) {
+	if len(otherUserIDs) == 0 {
+		return []string{}, nil
+	}
+	query := strings.Replace(selectSharedUsersSQL, "($2)", sqlutil.QueryVariadicOffset(len(otherUserIDs), 1), 1)
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "selectSharedUsersStmt: stmt.close() failed")
+
+	params := make([]interface{}, len(otherUserIDs)+1)
+	params[0] = userID
+	for k, v := range otherUserIDs {
+		params[k+1] = v
+	}
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectSharedUsersStmt: rows.close() failed")
+
+	var stateKey string
+	result := make([]string, 0, len(otherUserIDs))
+	for rows.Next() {
+		if err := rows.Scan(&stateKey); err != nil {
+			return nil, err
+		}
+		result = append(result, stateKey)
+	}
+	return result, rows.Err()
+}
+
+func (s *currentRoomStateStatements) SelectRoomHeroes(ctx context.Context, txn *sql.Tx, roomID, excludeUserID string, memberships []string) ([]string, error) {
+	if len(memberships) == 0 {
+		return []string{}, nil
+	}
+	query := strings.Replace(selectRoomHeroes, "($3)", sqlutil.QueryVariadicOffset(len(memberships), 2), 1)
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "selectRoomHeroesStmt: stmt.close() failed")
+
+	params := make([]interface{}, len(memberships)+2)
+	params[0] = roomID
+	params[1] = excludeUserID
+	for k, v := range memberships {
+		params[k+2] = v
+	}
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomHeroesStmt: rows.close() failed")
+
+	var stateKey string
+	result := make([]string, 0, 5)
+	for rows.Next() {
+		if err = rows.Scan(&stateKey); err != nil {
+			return nil, err
+		}
+		result = append(result, stateKey)
+	}
+	return result, rows.Err()
+}
+
+func (s *currentRoomStateStatements) SelectMembershipCount(ctx context.Context, txn *sql.Tx, roomID, membership string) (count int, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMembershipCountStmt)
+	err = stmt.QueryRowContext(ctx, roomID, membership).Scan(&count)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *currentRoomStateStatements) SelectRoomIDs(ctx context.Context, txn *sql.Tx) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomIDsStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomIDs: rows.close() failed")
+
+	var roomID string
+	var result []string
+	for rows.Next() {
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		result = append(result, roomID)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,221 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	rstypes "github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// The memberships table is designed to track the last time that
+// the user was a given state. This allows us to find out the
+// most recent time that a user was invited to, joined or left
+// a room, either by choice or otherwise. This is important for
+// building history visibility.
+
+const membershipsSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_memberships (
+    -- The 'room_id' key for the state event.
+    room_id string NOT NULL,
+    -- The state event ID
+	user_id string NOT NULL,
+	-- The status of the membership
+	membership string NOT NULL,
+	-- The event ID that last changed the membership
+	event_id string NOT NULL,
+	-- The stream position of the change
+	stream_pos int64 NOT NULL,
+	-- The topological position of the change in the room
+	topological_pos int64 NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_memberships_unique_idx ON syncapi_memberships(room_id, user_id, membership);
+`
+
+const insertMembershipSQL = "" +
+	"INSERT INTO syncapi_memberships (room_id, user_id, membership, event_id, stream_pos, topological_pos)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const updateMembershipSQL = "" +
+	"UPDATE syncapi_memberships SET event_id = $4, stream_pos = $5, topological_pos = $6" +
+	" WHERE room_id = $1 AND user_id = $2 AND membership = $3"
+
+// QL has no DISTINCT ON, so the latest membership of each user is picked
+// from these rows by latestMemberships.
+const selectMembershipCountSQL = "" +
+	"SELECT user_id, event_id, membership, stream_pos FROM syncapi_memberships WHERE room_id = $1 AND stream_pos <= $2"
+
+const selectMembershipBeforeSQL = "" +
+	"SELECT membership, topological_pos FROM syncapi_memberships WHERE room_id = $1 and user_id = $2 AND topological_pos <= $3 ORDER BY topological_pos DESC LIMIT 1"
+
+const purgeMembershipsSQL = "" +
+	"DELETE FROM syncapi_memberships WHERE room_id = $1"
+
+const selectMembersSQL = "" +
+	"SELECT user_id, event_id, membership, stream_pos FROM syncapi_memberships WHERE room_id = $1 AND topological_pos <= $2"
+
+type membershipsStatements struct {
+	insertMembershipStmt        *sql.Stmt
+	updateMembershipStmt        *sql.Stmt
+	selectMembershipCountStmt   *sql.Stmt
+	selectMembershipForUserStmt *sql.Stmt
+	purgeMembershipsStmt        *sql.Stmt
+	selectMembersStmt           *sql.Stmt
+}
+
+func NewQLMembershipsTable(db *sql.DB) (tables.Memberships, error) {
+	s := &membershipsStatements{}
+	_, err := db.Exec(membershipsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertMembershipStmt, insertMembershipSQL},
+		{&s.updateMembershipStmt, updateMembershipSQL},
+		{&s.selectMembershipCountStmt, selectMembershipCountSQL},
+		{&s.selectMembershipForUserStmt, selectMembershipBeforeSQL},
+		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
+		{&s.selectMembersStmt, selectMembersSQL},
+	}.Prepare(db)
+}
+
+func (s *membershipsStatements) UpsertMembership(
+	ctx context.Context, txn *sql.Tx, event *rstypes.HeaderedEvent,
+	streamPos, topologicalPos types.StreamPosition,
+) error {
+	membership, err := event.Membership()
+	if err != nil {
+		return fmt.Errorf("event.Membership: %w", err)
+	}
+	params := []interface{}{
+		event.RoomID().String(),
+		*event.StateKeyResolved,
+		membership,
+		event.EventID(),
+		streamPos,
+		topologicalPos,
+	}
+	res, err := sqlutil.TxStmt(txn, s.updateMembershipStmt).ExecContext(ctx, params...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertMembershipStmt).ExecContext(ctx, params...)
+	return err
+}
+
+func (s *membershipsStatements) SelectMembershipCount(
+	ctx context.Context, txn *sql.Tx, roomID, membership string, pos types.StreamPosition,
+) (count int, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMembershipCountStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, pos)
+	if err != nil {
+		return 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMembershipCount: failed to close rows")
+	latest, err := latestMemberships(rows)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range latest {
+		if m.membership == membership {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// SelectMembershipForUser returns the membership of the user before and including the given position. If no membership can be found
+// returns "leave", the topological position and no error. If an error occurs, other than sql.ErrNoRows, returns that and an empty
+// string as the membership.
+func (s *membershipsStatements) SelectMembershipForUser(
+	ctx context.Context, txn *sql.Tx, roomID, userID string, pos int64,
+) (membership string, topologyPos int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMembershipForUserStmt)
+	err = stmt.QueryRowContext(ctx, roomID, userID, pos).Scan(&membership, &topologyPos)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "leave", 0, nil
+		}
+		return "", 0, err
+	}
+	return membership, topologyPos, nil
+}
+
+func (s *membershipsStatements) PurgeMemberships(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.purgeMembershipsStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *membershipsStatements) SelectMemberships(
+	ctx context.Context, txn *sql.Tx,
+	roomID string, pos types.TopologyToken,
+	membership, notMembership *string,
+) (eventIDs []string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMembersStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, pos.Depth)
+	if err != nil {
+		return
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMemberships: failed to close rows")
+	latest, err := latestMemberships(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range latest {
+		if membership != nil && m.membership != *membership {
+			continue
+		}
+		if notMembership != nil && m.membership == *notMembership {
+			continue
+		}
+		eventIDs = append(eventIDs, m.eventID)
+	}
+	return eventIDs, nil
+}
+
+type latestMembership struct {
+	eventID    string
+	membership string
+	streamPos  int64
+}
+
+// latestMemberships returns the membership with the highest stream position
+// for each user from rows of user ID, event ID, membership and stream position.
+func latestMemberships(rows *sql.Rows) (map[string]latestMembership, error) {
+	latest := map[string]latestMembership{}
+	for rows.Next() {
+		var userID string
+		var m latestMembership
+		if err := rows.Scan(&userID, &m.eventID, &m.membership, &m.streamPos); err != nil {
+			return nil, err
+		}
+		if l, ok := latest[userID]; !ok || m.streamPos > l.streamPos {
+			latest[userID] = m
+		}
+	}
+	return latest, rows.Err()
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+func NewQLNotificationDataTable(db *sql.DB, streamID *StreamIDStatements) (tables.NotificationData, error) {
+	_, err := db.Exec(notificationDataSchema)
+	if err != nil {
+		return nil, err
+	}
+	r := &notificationDataStatements{
+		db:                 db,
+		streamIDStatements: streamID,
+	}
+	return r, sqlutil.StatementList{
+		{&r.insertRoomUnreadCounts, insertRoomUnreadNotificationCountsSQL},
+		{&r.updateRoomUnreadCounts, updateRoomUnreadNotificationCountsSQL},
+		{&r.selectMaxID, selectMaxNotificationIDSQL},
+		{&r.purgeNotificationData, purgeNotificationDataSQL},
+	}.Prepare(db)
+}
+
+type notificationDataStatements struct {
+	db                     *sql.DB
+	streamIDStatements     *StreamIDStatements
+	insertRoomUnreadCounts *sql.Stmt
+	updateRoomUnreadCounts *sql.Stmt
+	// selectUserUnreadCountsForRooms *sql.Stmt - prepared at runtime due to variadic
+	selectMaxID           *sql.Stmt
+	purgeNotificationData *sql.Stmt
+}
+
+const notificationDataSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_notification_data (
+	id int64 NOT NULL,
+	user_id string NOT NULL,
+	room_id string NOT NULL,
+	notification_count int64 NOT NULL DEFAULT 0,
+	highlight_count int64 NOT NULL DEFAULT 0,
+	-- JSON encoded unread counts for each thread in the room
+	thread_counts string NOT NULL DEFAULT "{}"
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_notification_data_id_idx ON syncapi_notification_data(id);
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_notification_data_user_id_room_id_idx ON syncapi_notification_data(user_id, room_id);
+`
+
+const insertRoomUnreadNotificationCountsSQL = `INSERT INTO syncapi_notification_data
+  (id, user_id, room_id, notification_count, highlight_count, thread_counts)
+  VALUES ($1, $2, $3, $4, $5, $6)`
+
+const updateRoomUnreadNotificationCountsSQL = `UPDATE syncapi_notification_data
+  SET id = $1, notification_count = $4, highlight_count = $5, thread_counts = $6
+  WHERE user_id = $2 AND room_id = $3`
+
+const selectUserUnreadNotificationsForRooms = `SELECT room_id, notification_count, highlight_count, thread_counts
+	FROM syncapi_notification_data
+	WHERE user_id = $1 AND
+	      room_id IN ($2)`
+
+const selectMaxNotificationIDSQL = `SELECT max(id) FROM syncapi_notification_data`
+
+const purgeNotificationDataSQL = "" +
+	"DELETE FROM syncapi_notification_data WHERE room_id = $1"
+
+func (r *notificationDataStatements) UpsertRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, notificationCount, highlightCount int, threadCounts map[string]eventutil.ThreadNotificationData) (pos types.StreamPosition, err error) {
+	threadCountsJSON, err := json.Marshal(threadCounts)
+	if err != nil {
+		return
+	}
+	pos, err = r.streamIDStatements.nextNotificationID(ctx, txn)
+	if err != nil {
+		return
+	}
+	params := []interface{}{pos, userID, roomID, notificationCount, highlightCount, string(threadCountsJSON)}
+	res, err := sqlutil.TxStmt(txn, r.updateRoomUnreadCounts).ExecContext(ctx, params...)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return pos, err
+	}
+	_, err = sqlutil.TxStmt(txn, r.insertRoomUnreadCounts).ExecContext(ctx, params...)
+	return
+}
+
+func (r *notificationDataStatements) SelectUserUnreadCountsForRooms(
+	ctx context.Context, txn *sql.Tx, userID string, roomIDs []string,
+) (map[string]*eventutil.NotificationData, error) {
+	if len(roomIDs) == 0 {
+		return map[string]*eventutil.NotificationData{}, nil
+	}
+	params := make([]interface{}, len(roomIDs)+1)
+	params[0] = userID
+	for i := range roomIDs {
+		params[i+1] = roomIDs[i]
+	}
+	sql := strings.Replace(selectUserUnreadNotificationsForRooms, "($2)", sqlutil.QueryVariadicOffset(len(roomIDs), 1), 1)
+	prep, err := r.db.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, prep, "SelectUserUnreadCountsForRooms: prep.close() failed")
+	rows, err := sqlutil.TxStmt(txn, prep).QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectUserUnreadCountsForRooms: rows.close() failed")
+
+	roomCounts := map[string]*eventutil.NotificationData{}
+	var roomID, threadCounts string
+	var notificationCount, highlightCount int
+	for rows.Next() {
+		if err = rows.Scan(&roomID, &notificationCount, &highlightCount, &threadCounts); err != nil {
+			return nil, err
+		}
+
+		data := &eventutil.NotificationData{
+			RoomID:                  roomID,
+			UnreadNotificationCount: notificationCount,
+			UnreadHighlightCount:    highlightCount,
+		}
+		if err = json.Unmarshal([]byte(threadCounts), &data.UnreadThreadNotifications); err != nil {
+			return nil, err
+		}
+		roomCounts[roomID] = data
+	}
+	return roomCounts, rows.Err()
+}
+
+func (r *notificationDataStatements) SelectMaxID(ctx context.Context, txn *sql.Tx) (int64, error) {
+	var id sql.NullInt64
+	err := sqlutil.TxStmt(txn, r.selectMaxID).QueryRowContext(ctx).Scan(&id)
+	return id.Int64, err
+}
+
+func (s *notificationDataStatements) PurgeNotificationData(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.purgeNotificationData).ExecContext(ctx, roomID)
+	return err
+}
@@ -0,0 +1,824 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	rstypes "github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/synctypes"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const outputRoomEventsSchema = `
+-- Stores output room events received from the roomserver.
+CREATE TABLE IF NOT EXISTS syncapi_output_room_events (
+  -- An incrementing ID which denotes the position in the log that this event resides at.
+  -- The ID is taken from the global stream in syncapi_stream_id.
+  id int64 NOT NULL,
+  -- The event ID for the event
+  event_id string NOT NULL,
+  -- The 'room_id' key for the event.
+  room_id string NOT NULL,
+  -- The headered JSON for the event, containing potentially additional metadata such as
+  -- the room version.
+  headered_event_json blob NOT NULL,
+  -- The event type e.g 'm.room.member'.
+  type string NOT NULL,
+  -- The 'sender' property of the event.
+  sender string NOT NULL,
+  -- true if the event content contains a url key.
+  contains_url bool NOT NULL,
+  -- A JSON list of event IDs which represent a delta of added/removed room state. This can be NULL
+  -- if there is no delta.
+  add_state_ids blob,
+  remove_state_ids blob,
+  -- The client session that sent the event, if any
+  session_id int64,
+  -- The transaction id used to send the event, if any
+  transaction_id string,
+  -- Should the event be excluded from responses to /sync requests. Useful for
+  -- events retrieved through backfilling that have a position in the stream
+  -- that relates to the moment these were retrieved rather than the moment these
+  -- were emitted.
+  exclude_from_sync bool NOT NULL DEFAULT false,
+  -- The history visibility before this event (1 - world_readable; 2 - shared; 3 - invited; 4 - joined)
+  history_visibility int64 NOT NULL DEFAULT 2,
+  -- The 'origin_server_ts' of the event, used to find events closest to a given time.
+  origin_server_ts int64 NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_output_room_events_id_idx ON syncapi_output_room_events (id);
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_output_room_events_event_id_idx ON syncapi_output_room_events (event_id);
+CREATE INDEX IF NOT EXISTS syncapi_output_room_events_type_idx ON syncapi_output_room_events (type);
+CREATE INDEX IF NOT EXISTS syncapi_output_room_events_sender_idx ON syncapi_output_room_events (sender);
+CREATE INDEX IF NOT EXISTS syncapi_output_room_events_room_id_idx ON syncapi_output_room_events (room_id);
+CREATE INDEX IF NOT EXISTS syncapi_output_room_events_exclude_from_sync_idx ON syncapi_output_room_events (exclude_from_sync);
+CREATE INDEX IF NOT EXISTS syncapi_output_room_events_recent_events_idx ON syncapi_output_room_events (room_id, exclude_from_sync, id, sender, type);
+CREATE INDEX IF NOT EXISTS syncapi_output_room_events_room_id_origin_server_ts_idx ON syncapi_output_room_events (room_id, origin_server_ts);
+`
+
+const insertEventSQL = "" +
+	"INSERT INTO syncapi_output_room_events (" +
+	"id, room_id, event_id, headered_event_json, type, sender, contains_url, add_state_ids, remove_state_ids, session_id, transaction_id, exclude_from_sync, history_visibility, origin_server_ts" +
+	") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)"
+
+const selectEventForInsertSQL = "" +
+	"SELECT id, exclude_from_sync FROM syncapi_output_room_events WHERE event_id = $1"
+
+const updateEventExcludeFromSyncSQL = "" +
+	"UPDATE syncapi_output_room_events SET exclude_from_sync = $1 WHERE event_id = $2"
+
+const selectEventsSQL = "" +
+	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events WHERE event_id IN ($1)"
+
+// further parameters are added by prepareWithFilters
+const selectEventsWithFilterSQL = "" +
+	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events WHERE event_id IN ($1)"
+
+// further parameters are added by prepareWithFilters
+const selectRecentEventsSQL = "" +
+	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND id > $2 AND id <= $3"
+
+// further parameters are added by prepareWithFilters
+const selectRecentEventsForSyncSQL = "" +
+	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND id > $2 AND id <= $3 AND !exclude_from_sync"
+
+const selectMaxEventIDSQL = "" +
+	"SELECT max(id) FROM syncapi_output_room_events"
+
+const updateEventJSONSQL = "" +
+	"UPDATE syncapi_output_room_events SET headered_event_json = $1 WHERE event_id = $2"
+
+// In order for us to apply the state updates correctly, rows need to be ordered in the order they were received (id).
+// further parameters are added by prepareWithFilters
+const selectStateInRangeSQL = "" +
+	"SELECT event_id, id, headered_event_json, exclude_from_sync, add_state_ids, remove_state_ids, history_visibility" +
+	" FROM syncapi_output_room_events" +
+	" WHERE (id > $1 AND id <= $2) AND (add_state_ids IS NOT NULL OR remove_state_ids IS NOT NULL)" +
+	" AND room_id IN ($3)"
+
+const deleteEventsForRoomSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE room_id = $1"
+
+const selectContextEventSQL = "" +
+	"SELECT id, headered_event_json, history_visibility FROM syncapi_output_room_events WHERE room_id = $1 AND event_id = $2"
+
+// further parameters are added by prepareWithFilters
+const selectContextBeforeEventSQL = "" +
+	"SELECT id, headered_event_json, history_visibility FROM syncapi_output_room_events WHERE room_id = $1 AND id < $2"
+
+// further parameters are added by prepareWithFilters
+const selectContextAfterEventSQL = "" +
+	"SELECT id, headered_event_json, history_visibility FROM syncapi_output_room_events WHERE room_id = $1 AND id > $2"
+
+const purgeEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE room_id = $1"
+
+// QL can only order by selected columns, hence the subqueries.
+const selectEventBeforeTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM (" +
+	" SELECT id, event_id, origin_server_ts FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND origin_server_ts <= $2" +
+	" ORDER BY origin_server_ts, id DESC" +
+	") LIMIT 1"
+
+const selectEventAfterTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM (" +
+	" SELECT id, event_id, origin_server_ts FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND origin_server_ts >= $2" +
+	" ORDER BY origin_server_ts, id ASC" +
+	") LIMIT 1"
+
+const selectEventsBeforeTimestampSQL = "" +
+	"SELECT event_id, id, headered_event_json, session_id, exclude_from_sync, transaction_id, history_visibility FROM syncapi_output_room_events" +
+	" WHERE room_id = $1 AND origin_server_ts < $2 AND id > $3" +
+	" ORDER BY id ASC LIMIT $4"
+
+const deleteEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE event_id IN ($1)"
+
+const selectSearchSQL = "SELECT id, event_id, headered_event_json FROM syncapi_output_room_events WHERE id > $1 AND type IN ($2)"
+
+type outputRoomEventsStatements struct {
+	db                       *sql.DB
+	streamIDStatements       *StreamIDStatements
+	insertEventStmt          *sql.Stmt
+	selectEventForInsertStmt *sql.Stmt
+	updateEventExcludeStmt   *sql.Stmt
+	selectMaxEventIDStmt     *sql.Stmt
+	updateEventJSONStmt      *sql.Stmt
+	deleteEventsForRoomStmt  *sql.Stmt
+	selectContextEventStmt   *sql.Stmt
+	purgeEventsStmt          *sql.Stmt
+	selectEventBeforeTSStmt  *sql.Stmt
+	selectEventAfterTSStmt   *sql.Stmt
+	selectEventsBeforeTSStmt *sql.Stmt
+	// selectEventsStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectEventsWitFilterStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectRecentEventsStmt *sql.Stmt - prepared at runtime due to variadic
+	// deleteEventsStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectRecentEventsForSyncStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectStateInRangeStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectContextBeforeEventStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectContextAfterEventStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectSearchStmt *sql.Stmt - prepared at runtime due to variadic
+}
+
+func NewQLEventsTable(db *sql.DB, streamID *StreamIDStatements) (tables.Events, error) {
+	s := &outputRoomEventsStatements{
+		db:                 db,
+		streamIDStatements: streamID,
+	}
+	_, err := db.Exec(outputRoomEventsSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertEventStmt, insertEventSQL},
+		{&s.selectEventForInsertStmt, selectEventForInsertSQL},
+		{&s.updateEventExcludeStmt, updateEventExcludeFromSyncSQL},
+		{&s.selectMaxEventIDStmt, selectMaxEventIDSQL},
+		{&s.updateEventJSONStmt, updateEventJSONSQL},
+		{&s.deleteEventsForRoomStmt, deleteEventsForRoomSQL},
+		{&s.selectContextEventStmt, selectContextEventSQL},
+		{&s.purgeEventsStmt, purgeEventsSQL},
+		{&s.selectEventBeforeTSStmt, selectEventBeforeTimestampSQL},
+		{&s.selectEventAfterTSStmt, selectEventAfterTimestampSQL},
+		{&s.selectEventsBeforeTSStmt, selectEventsBeforeTimestampSQL},
+	}.Prepare(db)
+}
+
+func (s *outputRoomEventsStatements) UpdateEventJSON(ctx context.Context, txn *sql.Tx, event *rstypes.HeaderedEvent) error {
+	headeredJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.updateEventJSONStmt).ExecContext(ctx, headeredJSON, event.EventID())
+	return err
+}
+
+// selectStateInRange returns the state events between the two given PDU stream positions, exclusive of oldPos, inclusive of newPos.
+// Results are bucketed based on the room ID. If the same state is overwritten multiple times between the
+// two positions, only the most recent state is returned.
+func (s *outputRoomEventsStatements) SelectStateInRange(
+	ctx context.Context, txn *sql.Tx, r types.Range,
+	stateFilter *synctypes.StateFilter, roomIDs []string,
+) (map[string]map[string]bool, map[string]types.StreamEvent, error) {
+	if len(roomIDs) == 0 {
+		return map[string]map[string]bool{}, map[string]types.StreamEvent{}, nil
+	}
+	stmtSQL := strings.Replace(selectStateInRangeSQL, "($3)", sqlutil.QueryVariadicOffset(len(roomIDs), 2), 1)
+	inputParams := []interface{}{
+		r.Low(), r.High(),
+	}
+	for _, roomID := range roomIDs {
+		inputParams = append(inputParams, roomID)
+	}
+	var (
+		stmt   *sql.Stmt
+		params []interface{}
+		err    error
+	)
+	if stateFilter != nil {
+		senders, notSenders := getSendersStateFilterFilter(stateFilter)
+		stmt, params, err = prepareWithFilters(
+			s.db, txn, stmtSQL, inputParams,
+			senders, notSenders,
+			filterConvertTypeWildcardToSQL(stateFilter.Types),
+			filterConvertTypeWildcardToSQL(stateFilter.NotTypes),
+			nil, stateFilter.ContainsURL, -1, FilterOrderAsc,
+		)
+	} else {
+		stmt, params, err = prepareWithFilters(
+			s.db, txn, stmtSQL, inputParams,
+			nil, nil, nil, nil, nil, nil, -1, FilterOrderAsc,
+		)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("s.prepareWithFilters: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "selectStateInRange: stmt.close() failed")
+
+	rows, err := stmt.QueryContext(ctx, params...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStateInRange: rows.close() failed")
+	// Fetch all the state change events for all rooms between the two positions then loop each event and:
+	//  - Keep a cache of the event by ID (99% of state change events are for the event itself)
+	//  - For each room ID, build up an array of event IDs which represents cumulative adds/removes
+	// For each room, map cumulative event IDs to events and return. This may need to a batch SELECT based on event ID
+	// if they aren't in the event ID cache. We don't handle state deletion yet.
+	eventIDToEvent := make(map[string]types.StreamEvent)
+
+	// RoomID => A set (map[string]bool) of state event IDs which are between the two positions
+	stateNeeded := make(map[string]map[string]bool)
+
+	for rows.Next() {
+		var (
+			eventID           string
+			streamPos         types.StreamPosition
+			eventBytes        []byte
+			excludeFromSync   bool
+			addIDsJSON        sql.NullString
+			delIDsJSON        sql.NullString
+			addIDs            []string
+			delIDs            []string
+			historyVisibility gomatrixserverlib.HistoryVisibility
+		)
+		if err := rows.Scan(&eventID, &streamPos, &eventBytes, &excludeFromSync, &addIDsJSON, &delIDsJSON, &historyVisibility); err != nil {
+			return nil, nil, err
+		}
+		if addIDsJSON.Valid {
+			if err := json.Unmarshal([]byte(addIDsJSON.String), &addIDs); err != nil {
+				return nil, nil, err
+			}
+		}
+		if delIDsJSON.Valid {
+			if err := json.Unmarshal([]byte(delIDsJSON.String), &delIDs); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		// TODO: Handle redacted events
+		var ev rstypes.HeaderedEvent
+		if err := json.Unmarshal(eventBytes, &ev); err != nil {
+			return nil, nil, err
+		}
+		needSet := stateNeeded[ev.RoomID().String()]
+		if needSet == nil { // make set if required
+			needSet = make(map[string]bool)
+		}
+		for _, id := range delIDs {
+			needSet[id] = false
+		}
+		for _, id := range addIDs {
+			needSet[id] = true
+		}
+		stateNeeded[ev.RoomID().String()] = needSet
+		ev.Visibility = historyVisibility
+
+		eventIDToEvent[eventID] = types.StreamEvent{
+			HeaderedEvent:   &ev,
+			StreamPosition:  streamPos,
+			ExcludeFromSync: excludeFromSync,
+		}
+	}
+
+	return stateNeeded, eventIDToEvent, rows.Err()
+}
+
+// MaxID returns the ID of the last inserted event in this table. 'txn' is optional. If it is not supplied,
+// then this function should only ever be used at startup, as it will race with inserting events if it is
+// done afterwards. If there are no inserted events, 0 is returned.
+func (s *outputRoomEventsStatements) SelectMaxEventID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxEventIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
+
+// InsertEvent into the output_room_events table. addState and removeState are an optional list of state event IDs. Returns the position
+// of the inserted event.
+func (s *outputRoomEventsStatements) InsertEvent(
+	ctx context.Context, txn *sql.Tx,
+	event *rstypes.HeaderedEvent, addState, removeState []string,
+	transactionID *api.TransactionID, excludeFromSync bool, historyVisibility gomatrixserverlib.HistoryVisibility,
+) (streamPos types.StreamPosition, err error) {
+	var txnID *string
+	var sessionID *int64
+	if transactionID != nil {
+		sessionID = &transactionID.SessionID
+		txnID = &transactionID.TransactionID
+	}
+
+	// Parse content as JSON and search for an "url" key
+	containsURL := false
+	var content map[string]interface{}
+	if json.Unmarshal(event.Content(), &content) == nil {
+		// Set containsURL to true if url is present
+		_, containsURL = content["url"]
+	}
+
+	var headeredJSON []byte
+	headeredJSON, err = json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	// The state deltas are stored as JSON lists, keeping NULL for no delta.
+	var addStateJSON, removeStateJSON interface{}
+	if addState != nil {
+		if addStateJSON, err = json.Marshal(addState); err != nil {
+			return
+		}
+	}
+	if removeState != nil {
+		if removeStateJSON, err = json.Marshal(removeState); err != nil {
+			return
+		}
+	}
+
+	// If the event already exists, the existing stream position is returned
+	// and the newly allocated one is simply never used.
+	streamPos, err = s.streamIDStatements.nextPDUID(ctx, txn)
+	if err != nil {
+		return
+	}
+
+	var existingPos types.StreamPosition
+	var existingExcludeFromSync bool
+	err = sqlutil.TxStmt(txn, s.selectEventForInsertStmt).QueryRowContext(ctx, event.EventID()).Scan(&existingPos, &existingExcludeFromSync)
+	switch {
+	case err == nil:
+		if existingExcludeFromSync != excludeFromSync {
+			_, err = sqlutil.TxStmt(txn, s.updateEventExcludeStmt).ExecContext(ctx, excludeFromSync, event.EventID())
+		}
+		return existingPos, err
+	case err != sql.ErrNoRows:
+		return
+	}
+
+	stmt := sqlutil.TxStmt(txn, s.insertEventStmt)
+	_, err = stmt.ExecContext(
+		ctx,
+		streamPos,
+		event.RoomID().String(),
+		event.EventID(),
+		headeredJSON,
+		event.Type(),
+		event.UserID.String(),
+		containsURL,
+		addStateJSON,
+		removeStateJSON,
+		sessionID,
+		txnID,
+		excludeFromSync,
+		historyVisibility,
+		event.OriginServerTS(),
+	)
+	return
+}
+
+// selectRecentEvents returns the most recent events in the given room, up to a maximum of 'limit'.
+// If onlySyncEvents has a value of true, only returns the events that aren't marked as to exclude
+// from sync.
+func (s *outputRoomEventsStatements) SelectRecentEvents(
+	ctx context.Context, txn *sql.Tx,
+	roomIDs []string, ra types.Range, eventFilter *synctypes.RoomEventFilter,
+	chronologicalOrder bool, onlySyncEvents bool,
+) (map[string]types.RecentEvents, error) {
+	var query string
+	if onlySyncEvents {
+		query = selectRecentEventsForSyncSQL
+	} else {
+		query = selectRecentEventsSQL
+	}
+	senders, notSenders := getSendersRoomEventFilter(eventFilter)
+
+	// QL has no LATERAL joins, so the recent events are queried room by room.
+	result := make(map[string]types.RecentEvents, len(roomIDs))
+	for _, roomID := range roomIDs {
+		stmt, params, err := prepareWithFilters(
+			s.db, txn, query,
+			[]interface{}{
+				roomID, ra.Low(), ra.High(),
+			},
+			senders, notSenders,
+			filterConvertTypeWildcardToSQL(eventFilter.Types),
+			filterConvertTypeWildcardToSQL(eventFilter.NotTypes),
+			nil, eventFilter.ContainsURL, eventFilter.Limit+1, FilterOrderDesc,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("s.prepareWithFilters: %w", err)
+		}
+		streamEvents, err := s.selectStreamEvents(ctx, stmt, params)
+		if err != nil {
+			return nil, err
+		}
+		if len(streamEvents) == 0 {
+			continue
+		}
+		result[roomID] = types.RecentEvents{Events: streamEvents}
+	}
+
+	if chronologicalOrder {
+		for roomID, evs := range result {
+			// The events need to be returned from oldest to latest, which isn't
+			// necessary the way the SQL query returns them, so a sort is necessary to
+			// ensure the events are in the right order in the slice.
+			sort.SliceStable(evs.Events, func(i int, j int) bool {
+				return evs.Events[i].StreamPosition < evs.Events[j].StreamPosition
+			})
+
+			if len(evs.Events) > eventFilter.Limit {
+				evs.Limited = true
+				evs.Events = evs.Events[1:]
+			}
+
+			result[roomID] = evs
+		}
+	} else {
+		for roomID, evs := range result {
+			if len(evs.Events) > eventFilter.Limit {
+				evs.Limited = true
+				evs.Events = evs.Events[:len(evs.Events)-1]
+			}
+
+			result[roomID] = evs
+		}
+	}
+	return result, nil
+}
+
+// selectStreamEvents runs the given runtime prepared statement, closing it
+// afterwards, and returns the rows as stream events.
+func (s *outputRoomEventsStatements) selectStreamEvents(
+	ctx context.Context, stmt *sql.Stmt, params []interface{},
+) ([]types.StreamEvent, error) {
+	defer internal.CloseAndLogIfError(ctx, stmt, "selectStreamEvents: stmt.close() failed")
+	rows, err := stmt.QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStreamEvents: rows.close() failed")
+	return rowsToStreamEvents(rows)
+}
+
+// selectEvents returns the events for the given event IDs. If an event is
+// missing from the database, it will be omitted.
+func (s *outputRoomEventsStatements) SelectEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string, filter *synctypes.RoomEventFilter, preserveOrder bool,
+) ([]types.StreamEvent, error) {
+	params := make([]interface{}, len(eventIDs))
+	for k, v := range eventIDs {
+		params[k] = v
+	}
+	var (
+		streamEvents []types.StreamEvent
+		err          error
+	)
+	if filter == nil {
+		var qp sqlutil.QueryProvider = s.db
+		if txn != nil {
+			qp = txn
+		}
+		err = sqlutil.RunLimitedVariablesQuery(
+			ctx, selectEventsSQL, qp, params, sqlutil.QLMaxVariables,
+			func(rows *sql.Rows) error {
+				evs, rowsErr := rowsToStreamEvents(rows)
+				if rowsErr != nil {
+					return rowsErr
+				}
+				streamEvents = append(streamEvents, evs...)
+				return nil
+			},
+		)
+	} else if len(eventIDs) > 0 {
+		senders, notSenders := getSendersRoomEventFilter(filter)
+		query := strings.Replace(selectEventsWithFilterSQL, "($1)", sqlutil.QueryVariadic(len(eventIDs)), 1)
+		var stmt *sql.Stmt
+		stmt, params, err = prepareWithFilters(
+			s.db, txn, query, params,
+			senders, notSenders,
+			filterConvertTypeWildcardToSQL(filter.Types),
+			filterConvertTypeWildcardToSQL(filter.NotTypes),
+			nil, filter.ContainsURL, filter.Limit, FilterOrderNone,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("s.prepareWithFilters: %w", err)
+		}
+		streamEvents, err = s.selectStreamEvents(ctx, stmt, params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if preserveOrder {
+		eventMap := make(map[string]types.StreamEvent)
+		for _, ev := range streamEvents {
+			eventMap[ev.EventID()] = ev
+		}
+		var returnEvents []types.StreamEvent
+		for _, eventID := range eventIDs {
+			ev, ok := eventMap[eventID]
+			if ok {
+				returnEvents = append(returnEvents, ev)
+			}
+		}
+		return returnEvents, nil
+	}
+	return streamEvents, nil
+}
+
+func (s *outputRoomEventsStatements) DeleteEventsForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteEventsForRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *outputRoomEventsStatements) SelectContextEvent(ctx context.Context, txn *sql.Tx, roomID, eventID string) (id int, evt rstypes.HeaderedEvent, err error) {
+	row := sqlutil.TxStmt(txn, s.selectContextEventStmt).QueryRowContext(ctx, roomID, eventID)
+
+	var eventAsString string
+	var historyVisibility gomatrixserverlib.HistoryVisibility
+	if err = row.Scan(&id, &eventAsString, &historyVisibility); err != nil {
+		return 0, evt, err
+	}
+
+	if err = json.Unmarshal([]byte(eventAsString), &evt); err != nil {
+		return 0, evt, err
+	}
+	evt.Visibility = historyVisibility
+	return id, evt, nil
+}
+
+func (s *outputRoomEventsStatements) SelectContextBeforeEvent(
+	ctx context.Context, txn *sql.Tx, id int, roomID string, filter *synctypes.RoomEventFilter,
+) (evts []*rstypes.HeaderedEvent, err error) {
+	senders, notSenders := getSendersRoomEventFilter(filter)
+	stmt, params, err := prepareWithFilters(
+		s.db, txn, selectContextBeforeEventSQL,
+		[]interface{}{
+			roomID, id,
+		},
+		senders, notSenders,
+		filterConvertTypeWildcardToSQL(filter.Types),
+		filterConvertTypeWildcardToSQL(filter.NotTypes),
+		nil, nil, filter.Limit, FilterOrderDesc,
+	)
+	if err != nil {
+		return
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "stmt.close() failed")
+
+	rows, err := stmt.QueryContext(ctx, params...)
+	if err != nil {
+		return
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "rows.close() failed")
+
+	for rows.Next() {
+		var (
+			streamPos         int
+			eventBytes        []byte
+			evt               *rstypes.HeaderedEvent
+			historyVisibility gomatrixserverlib.HistoryVisibility
+		)
+		if err = rows.Scan(&streamPos, &eventBytes, &historyVisibility); err != nil {
+			return evts, err
+		}
+		if err = json.Unmarshal(eventBytes, &evt); err != nil {
+			return evts, err
+		}
+		evt.Visibility = historyVisibility
+		evts = append(evts, evt)
+	}
+
+	return evts, rows.Err()
+}
+
+func (s *outputRoomEventsStatements) SelectContextAfterEvent(
+	ctx context.Context, txn *sql.Tx, id int, roomID string, filter *synctypes.RoomEventFilter,
+) (lastID int, evts []*rstypes.HeaderedEvent, err error) {
+	senders, notSenders := getSendersRoomEventFilter(filter)
+	stmt, params, err := prepareWithFilters(
+		s.db, txn, selectContextAfterEventSQL,
+		[]interface{}{
+			roomID, id,
+		},
+		senders, notSenders,
+		filterConvertTypeWildcardToSQL(filter.Types),
+		filterConvertTypeWildcardToSQL(filter.NotTypes),
+		nil, nil, filter.Limit, FilterOrderAsc,
+	)
+	if err != nil {
+		return
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "stmt.close() failed")
+
+	rows, err := stmt.QueryContext(ctx, params...)
+	if err != nil {
+		return
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "rows.close() failed")
+
+	for rows.Next() {
+		var (
+			eventBytes        []byte
+			evt               *rstypes.HeaderedEvent
+			historyVisibility gomatrixserverlib.HistoryVisibility
+		)
+		if err = rows.Scan(&lastID, &eventBytes, &historyVisibility); err != nil {
+			return 0, evts, err
+		}
+		if err = json.Unmarshal(eventBytes, &evt); err != nil {
+			return 0, evts, err
+		}
+		evt.Visibility = historyVisibility
+		evts = append(evts, evt)
+	}
+
+	return lastID, evts, rows.Err()
+}
+
+func rowsToStreamEvents(rows *sql.Rows) ([]types.StreamEvent, error) {
+	var result []types.StreamEvent
+	for rows.Next() {
+		var (
+			eventID           string
+			streamPos         types.StreamPosition
+			eventBytes        []byte
+			excludeFromSync   bool
+			sessionID         *int64
+			txnID             *string
+			transactionID     *api.TransactionID
+			historyVisibility gomatrixserverlib.HistoryVisibility
+		)
+		if err := rows.Scan(&eventID, &streamPos, &eventBytes, &sessionID, &excludeFromSync, &txnID, &historyVisibility); err != nil {
+			return nil, err
+		}
+		// TODO: Handle redacted events
+		var ev rstypes.HeaderedEvent
+		if err := json.Unmarshal(eventBytes, &ev); err != nil {
+			return nil, err
+		}
+
+		if sessionID != nil && txnID != nil {
+			transactionID = &api.TransactionID{
+				SessionID:     *sessionID,
+				TransactionID: *txnID,
+			}
+		}
+		ev.Visibility = historyVisibility
+		result = append(result, types.StreamEvent{
+			HeaderedEvent:   &ev,
+			StreamPosition:  streamPos,
+			TransactionID:   transactionID,
+			ExcludeFromSync: excludeFromSync,
+		})
+	}
+	return result, rows.Err()
+}
+
+func (s *outputRoomEventsStatements) PurgeEvents(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.purgeEventsStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *outputRoomEventsStatements) ReIndex(ctx context.Context, txn *sql.Tx, limit, afterID int64, types []string) (map[int64]rstypes.HeaderedEvent, error) {
+	if len(types) == 0 {
+		return map[int64]rstypes.HeaderedEvent{}, nil
+	}
+	params := make([]interface{}, 0, len(types)+2)
+	params = append(params, afterID)
+	for _, t := range types {
+		params = append(params, t)
+	}
+	params = append(params, limit)
+	query := strings.Replace(selectSearchSQL, "($2)", sqlutil.QueryVariadicOffset(len(types), 1), 1)
+	query += fmt.Sprintf(" ORDER BY id ASC LIMIT $%d", len(types)+2)
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "stmt.close() failed")
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "rows.close() failed")
+
+	var eventID string
+	var id int64
+	result := make(map[int64]rstypes.HeaderedEvent)
+	for rows.Next() {
+		var ev rstypes.HeaderedEvent
+		var eventBytes []byte
+		if err = rows.Scan(&id, &eventID, &eventBytes); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(eventBytes, &ev); err != nil {
+			return nil, err
+		}
+		result[id] = ev
+	}
+	return result, rows.Err()
+}
+
+// SelectEventIDAtTimestamp returns the event closest to the given timestamp in the room, looking
+// at events sent at or before the timestamp if backwards is true, and at or after it otherwise.
+// Returns sql.ErrNoRows if there is no such event.
+func (s *outputRoomEventsStatements) SelectEventIDAtTimestamp(
+	ctx context.Context, txn *sql.Tx, roomID string, ts spec.Timestamp, backwards bool,
+) (eventID string, originServerTS spec.Timestamp, err error) {
+	stmt := s.selectEventAfterTSStmt
+	if backwards {
+		stmt = s.selectEventBeforeTSStmt
+	}
+	err = sqlutil.TxStmt(txn, stmt).QueryRowContext(ctx, roomID, ts).Scan(&eventID, &originServerTS)
+	return
+}
+
+// SelectEventsBeforeTimestamp returns up to limit events in the room which were sent before the
+// given timestamp, ordered by stream position and starting after the given stream position.
+func (s *outputRoomEventsStatements) SelectEventsBeforeTimestamp(
+	ctx context.Context, txn *sql.Tx, roomID string, before spec.Timestamp, afterPos types.StreamPosition, limit int,
+) ([]types.StreamEvent, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectEventsBeforeTSStmt).QueryContext(ctx, roomID, before, afterPos, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventsBeforeTimestamp: rows.close() failed")
+	return rowsToStreamEvents(rows)
+}
+
+func (s *outputRoomEventsStatements) DeleteEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) error {
+	params := make([]interface{}, len(eventIDs))
+	for i := range eventIDs {
+		params[i] = eventIDs[i]
+	}
+	var ep sqlutil.ExecProvider = s.db
+	if txn != nil {
+		ep = txn
+	}
+	return sqlutil.RunLimitedVariablesExec(ctx, deleteEventsSQL, ep, params, sqlutil.QLMaxVariables)
+}
@@ -0,0 +1,213 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/synctypes"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const presenceSchema = `
+-- Stores data about presence
+CREATE TABLE IF NOT EXISTS syncapi_presence (
+	-- The ID
+	id int64 NOT NULL,
+	-- The Matrix user ID
+	user_id string NOT NULL,
+	-- The actual presence
+	presence int64 NOT NULL,
+	-- The status message
+	status_msg string,
+	-- The last time an action was received by this user
+	last_active_ts int64 NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_presence_id_idx ON syncapi_presence(id);
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_presence_user_id ON syncapi_presence(user_id);
+`
+
+const insertPresenceSQL = "" +
+	"INSERT INTO syncapi_presence" +
+	" (id, user_id, presence, status_msg, last_active_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)"
+
+const updatePresenceSQL = "" +
+	"UPDATE syncapi_presence SET id = $1," +
+	" presence = $3, status_msg = $4, last_active_ts = $5" +
+	" WHERE user_id = $2"
+
+// Used when the status message is unchanged, i.e. when updating the presence
+// from /sync or when no status message was given.
+const updatePresenceFromSyncSQL = "" +
+	"UPDATE syncapi_presence SET id = $1," +
+	" presence = $3, last_active_ts = $4" +
+	" WHERE user_id = $2"
+
+const selectPresenceForUserSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts" +
+	" FROM syncapi_presence" +
+	" WHERE user_id IN ($1)"
+
+const selectMaxPresenceSQL = "" +
+	"SELECT coalesce(max(id), 0) FROM syncapi_presence"
+
+const selectPresenceAfter = "" +
+	" SELECT id, user_id, presence, status_msg, last_active_ts" +
+	" FROM syncapi_presence" +
+	" WHERE id > $1 AND last_active_ts >= $2" +
+	" ORDER BY id ASC LIMIT $3"
+
+type presenceStatements struct {
+	db                         *sql.DB
+	streamIDStatements         *StreamIDStatements
+	insertPresenceStmt         *sql.Stmt
+	updatePresenceStmt         *sql.Stmt
+	updatePresenceFromSyncStmt *sql.Stmt
+	// selectPresenceForUsersStmt *sql.Stmt - prepared at runtime due to variadic
+	selectMaxPresenceStmt   *sql.Stmt
+	selectPresenceAfterStmt *sql.Stmt
+}
+
+func NewQLPresenceTable(db *sql.DB, streamID *StreamIDStatements) (*presenceStatements, error) {
+	_, err := db.Exec(presenceSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &presenceStatements{
+		db:                 db,
+		streamIDStatements: streamID,
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertPresenceStmt, insertPresenceSQL},
+		{&s.updatePresenceStmt, updatePresenceSQL},
+		{&s.updatePresenceFromSyncStmt, updatePresenceFromSyncSQL},
+		{&s.selectMaxPresenceStmt, selectMaxPresenceSQL},
+		{&s.selectPresenceAfterStmt, selectPresenceAfter},
+	}.Prepare(db)
+}
+
+// UpsertPresence creates/updates a presence status.
+func (p *presenceStatements) UpsertPresence(
+	ctx context.Context,
+	txn *sql.Tx,
+	userID string,
+	statusMsg *string,
+	presence types.Presence,
+	lastActiveTS spec.Timestamp,
+	fromSync bool,
+) (pos types.StreamPosition, err error) {
+	pos, err = p.streamIDStatements.nextPresenceID(ctx, txn)
+	if err != nil {
+		return
+	}
+	var res sql.Result
+	if fromSync || statusMsg == nil {
+		stmt := sqlutil.TxStmt(txn, p.updatePresenceFromSyncStmt)
+		res, err = stmt.ExecContext(ctx, pos, userID, presence, lastActiveTS)
+	} else {
+		stmt := sqlutil.TxStmt(txn, p.updatePresenceStmt)
+		res, err = stmt.ExecContext(ctx, pos, userID, presence, *statusMsg, lastActiveTS)
+	}
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return pos, err
+	}
+	if fromSync {
+		statusMsg = nil
+	}
+	stmt := sqlutil.TxStmt(txn, p.insertPresenceStmt)
+	_, err = stmt.ExecContext(ctx, pos, userID, presence, statusMsg, lastActiveTS)
+	return
+}
+
+// GetPresenceForUsers returns the current presence for a list of users.
+// If the user doesn't have a presence status yet, it is omitted from the response.
+func (p *presenceStatements) GetPresenceForUsers(
+	ctx context.Context, txn *sql.Tx,
+	userIDs []string,
+) ([]*types.PresenceInternal, error) {
+	if len(userIDs) == 0 {
+		return []*types.PresenceInternal{}, nil
+	}
+	qry := strings.Replace(selectPresenceForUserSQL, "($1)", sqlutil.QueryVariadic(len(userIDs)), 1)
+	prepStmt, err := p.db.Prepare(qry)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, prepStmt, "GetPresenceForUsers: stmt.close() failed")
+
+	params := make([]interface{}, len(userIDs))
+	for i := range userIDs {
+		params[i] = userIDs[i]
+	}
+
+	result := make([]*types.PresenceInternal, 0, len(userIDs))
+	rows, err := sqlutil.TxStmt(txn, prepStmt).QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "GetPresenceForUsers: rows.close() failed")
+
+	for rows.Next() {
+		presence := &types.PresenceInternal{}
+		if err = rows.Scan(&presence.UserID, &presence.Presence, &presence.ClientFields.StatusMsg, &presence.LastActiveTS); err != nil {
+			return nil, err
+		}
+		presence.ClientFields.Presence = presence.Presence.String()
+		result = append(result, presence)
+	}
+	return result, rows.Err()
+}
+
+func (p *presenceStatements) GetMaxPresenceID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	stmt := sqlutil.TxStmt(txn, p.selectMaxPresenceStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&pos)
+	return
+}
+
+// GetPresenceAfter returns the changes presences after a given stream id
+func (p *presenceStatements) GetPresenceAfter(
+	ctx context.Context, txn *sql.Tx,
+	after types.StreamPosition,
+	filter synctypes.EventFilter,
+) (presences map[string]*types.PresenceInternal, err error) {
+	presences = make(map[string]*types.PresenceInternal)
+	stmt := sqlutil.TxStmt(txn, p.selectPresenceAfterStmt)
+	afterTS := spec.AsTimestamp(time.Now().Add(time.Minute * -5))
+	rows, err := stmt.QueryContext(ctx, after, afterTS, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "GetPresenceAfter: failed to close rows")
+	for rows.Next() {
+		qryRes := &types.PresenceInternal{}
+		if err := rows.Scan(&qryRes.StreamPos, &qryRes.UserID, &qryRes.Presence, &qryRes.ClientFields.StatusMsg, &qryRes.LastActiveTS); err != nil {
+			return nil, err
+		}
+		qryRes.ClientFields.Presence = qryRes.Presence.String()
+		presences[qryRes.UserID] = qryRes
+	}
+	return presences, rows.Err()
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const receiptsSchema = `
+-- Stores data about receipts
+CREATE TABLE IF NOT EXISTS syncapi_receipts (
+	-- The ID
+	id int64 NOT NULL,
+	room_id string NOT NULL,
+	receipt_type string NOT NULL,
+	user_id string NOT NULL,
+	event_id string NOT NULL,
+	receipt_ts int64 NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_receipts_id_idx ON syncapi_receipts(id);
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_receipts_unique_idx ON syncapi_receipts(room_id, receipt_type, user_id);
+CREATE INDEX IF NOT EXISTS syncapi_receipts_room_id ON syncapi_receipts(room_id);
+`
+
+const insertReceipt = "" +
+	"INSERT INTO syncapi_receipts" +
+	" (id, room_id, receipt_type, user_id, event_id, receipt_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const updateReceipt = "" +
+	"UPDATE syncapi_receipts SET id = $1, event_id = $5, receipt_ts = $6" +
+	" WHERE room_id = $2 AND receipt_type = $3 AND user_id = $4"
+
+const selectRoomReceipts = "" +
+	"SELECT id, room_id, receipt_type, user_id, event_id, receipt_ts" +
+	" FROM syncapi_receipts" +
+	" WHERE id > $1 AND room_id IN ($2)"
+
+const selectMaxReceiptIDSQL = "" +
+	"SELECT max(id) FROM syncapi_receipts"
+
+const purgeReceiptsSQL = "" +
+	"DELETE FROM syncapi_receipts WHERE room_id = $1"
+
+type receiptStatements struct {
+	db                 *sql.DB
+	streamIDStatements *StreamIDStatements
+	insertReceipt      *sql.Stmt
+	updateReceipt      *sql.Stmt
+	// selectRoomReceipts *sql.Stmt - prepared at runtime due to variadic
+	selectMaxReceiptID *sql.Stmt
+	purgeReceiptsStmt  *sql.Stmt
+}
+
+func NewQLReceiptsTable(db *sql.DB, streamID *StreamIDStatements) (tables.Receipts, error) {
+	_, err := db.Exec(receiptsSchema)
+	if err != nil {
+		return nil, err
+	}
+	r := &receiptStatements{
+		db:                 db,
+		streamIDStatements: streamID,
+	}
+	return r, sqlutil.StatementList{
+		{&r.insertReceipt, insertReceipt},
+		{&r.updateReceipt, updateReceipt},
+		{&r.selectMaxReceiptID, selectMaxReceiptIDSQL},
+		{&r.purgeReceiptsStmt, purgeReceiptsSQL},
+	}.Prepare(db)
+}
+
+func (r *receiptStatements) UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId string, timestamp spec.Timestamp) (pos types.StreamPosition, err error) {
+	pos, err = r.streamIDStatements.nextReceiptID(ctx, txn)
+	if err != nil {
+		return
+	}
+	params := []interface{}{pos, roomId, receiptType, userId, eventId, timestamp}
+	res, err := sqlutil.TxStmt(txn, r.updateReceipt).ExecContext(ctx, params...)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return pos, err
+	}
+	_, err = sqlutil.TxStmt(txn, r.insertReceipt).ExecContext(ctx, params...)
+	return
+}
+
+func (r *receiptStatements) SelectRoomReceiptsAfter(ctx context.Context, txn *sql.Tx, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []types.OutputReceiptEvent, error) {
+	var lastPos types.StreamPosition
+	if len(roomIDs) == 0 {
+		return 0, nil, nil
+	}
+	selectSQL := strings.Replace(selectRoomReceipts, "($2)", sqlutil.QueryVariadicOffset(len(roomIDs), 1), 1)
+	params := make([]interface{}, len(roomIDs)+1)
+	params[0] = streamPos
+	for k, v := range roomIDs {
+		params[k+1] = v
+	}
+	prep, err := r.db.Prepare(selectSQL)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to prepare statement: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, prep, "SelectRoomReceiptsAfter: prep.close() failed")
+	rows, err := sqlutil.TxStmt(txn, prep).QueryContext(ctx, params...)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to query room receipts: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomReceiptsAfter: rows.close() failed")
+	var res []types.OutputReceiptEvent
+	for rows.Next() {
+		r := types.OutputReceiptEvent{}
+		var id types.StreamPosition
+		err = rows.Scan(&id, &r.RoomID, &r.Type, &r.UserID, &r.EventID, &r.Timestamp)
+		if err != nil {
+			return 0, res, fmt.Errorf("unable to scan row to api.Receipts: %w", err)
+		}
+		res = append(res, r)
+		if id > lastPos {
+			lastPos = id
+		}
+	}
+	return lastPos, res, rows.Err()
+}
+
+func (s *receiptStatements) SelectMaxReceiptID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxReceiptID)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
+
+func (s *receiptStatements) PurgeReceipts(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.purgeReceiptsStmt).ExecContext(ctx, roomID)
+	return err
+}
@@ -0,0 +1,348 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const relationsSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_relations (
+	id int64 NOT NULL,
+	room_id string NOT NULL,
+	event_id string NOT NULL,
+	child_event_id string NOT NULL,
+	child_event_type string NOT NULL,
+	rel_type string NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_relations_id_idx ON syncapi_relations(id);
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_relations_unique_idx ON syncapi_relations(room_id, event_id, child_event_id, rel_type);
+`
+
+const insertRelationSQL = "" +
+	"INSERT INTO syncapi_relations (" +
+	"  id, room_id, event_id, child_event_id, child_event_type, rel_type" +
+	") VALUES ($1, $2, $3, $4, $5, $6)"
+
+const deleteRelationSQL = "" +
+	"DELETE FROM syncapi_relations WHERE room_id = $1 AND child_event_id = $2"
+
+const selectRelationsInRangeAscSQL = "" +
+	"SELECT id, child_event_id, rel_type FROM syncapi_relations" +
+	" WHERE room_id = $1 AND event_id = $2" +
+	" AND ( $3 = \"\" OR rel_type = $3 )" +
+	" AND ( $4 = \"\" OR child_event_type = $4 )" +
+	" AND id > $5 AND id <= $6" +
+	" ORDER BY id ASC LIMIT $7"
+
+const selectRelationsInRangeDescSQL = "" +
+	"SELECT id, child_event_id, rel_type FROM syncapi_relations" +
+	" WHERE room_id = $1 AND event_id = $2" +
+	" AND ( $3 = \"\" OR rel_type = $3 )" +
+	" AND ( $4 = \"\" OR child_event_type = $4 )" +
+	" AND id >= $5 AND id < $6" +
+	" ORDER BY id DESC LIMIT $7"
+
+const selectMaxRelationIDSQL = "" +
+	"SELECT max(id) FROM syncapi_relations"
+
+// QL has no CASE or LEFT JOIN, so the threads are put together by
+// SelectThreads and SelectThreadSummaries from the thread relations.
+const selectThreadRelationsSQL = "" +
+	"SELECT id, event_id, child_event_id FROM syncapi_relations" +
+	" WHERE room_id = $1 AND rel_type = \"m.thread\""
+
+const selectThreadRelationsForEventsSQL = "" +
+	"SELECT id, event_id, child_event_id FROM syncapi_relations" +
+	" WHERE room_id = $1 AND rel_type = \"m.thread\" AND event_id IN ($2)"
+
+const selectEventIDsBySenderSQL = "" +
+	"SELECT event_id FROM syncapi_output_room_events WHERE room_id = $1 AND sender = $2"
+
+const selectEventSendersSQL = "" +
+	"SELECT event_id, sender FROM syncapi_output_room_events WHERE event_id IN ($1)"
+
+type relationsStatements struct {
+	db                             *sql.DB
+	insertRelationStmt             *sql.Stmt
+	selectRelationsInRangeAscStmt  *sql.Stmt
+	selectRelationsInRangeDescStmt *sql.Stmt
+	deleteRelationStmt             *sql.Stmt
+	selectMaxRelationIDStmt        *sql.Stmt
+	selectThreadRelationsStmt      *sql.Stmt
+	selectEventIDsBySenderStmt     *sql.Stmt
+	streamIDStatements             *StreamIDStatements
+	// selectThreadRelationsForEventsStmt *sql.Stmt - prepared at runtime due to variadic
+	// selectEventSendersStmt *sql.Stmt - prepared at runtime due to variadic
+}
+
+func NewQLRelationsTable(db *sql.DB, streamID *StreamIDStatements) (tables.Relations, error) {
+	s := &relationsStatements{
+		db:                 db,
+		streamIDStatements: streamID,
+	}
+	_, err := db.Exec(relationsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertRelationStmt, insertRelationSQL},
+		{&s.selectRelationsInRangeAscStmt, selectRelationsInRangeAscSQL},
+		{&s.selectRelationsInRangeDescStmt, selectRelationsInRangeDescSQL},
+		{&s.deleteRelationStmt, deleteRelationSQL},
+		{&s.selectMaxRelationIDStmt, selectMaxRelationIDSQL},
+		{&s.selectThreadRelationsStmt, selectThreadRelationsSQL},
+		{&s.selectEventIDsBySenderStmt, selectEventIDsBySenderSQL},
+	}.Prepare(db)
+}
+
+func (s *relationsStatements) InsertRelation(
+	ctx context.Context, txn *sql.Tx, roomID, eventID, childEventID, childEventType, relType string,
+) (err error) {
+	pos, err := s.streamIDStatements.nextRelationID(ctx, txn)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertRelationStmt).ExecContext(
+		ctx, pos, roomID, eventID, childEventID, childEventType, relType,
+	)
+	if sqlutil.IsQLUniqueConstraintViolation(err) {
+		return nil
+	}
+	return
+}
+func (s *relationsStatements) DeleteRelation(
+	ctx context.Context, txn *sql.Tx, roomID, childEventID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRelationStmt)
+	_, err := stmt.ExecContext(
+		ctx, roomID, childEventID,
+	)
+	return err
+}
+
+// SelectRelationsInRange returns a map rel_type -> []child_event_id
+func (s *relationsStatements) SelectRelationsInRange(
+	ctx context.Context, txn *sql.Tx, roomID, eventID, relType, eventType string,
+	r types.Range, limit int,
+) (map[string][]types.RelationEntry, types.StreamPosition, error) {
+	var lastPos types.StreamPosition
+	var stmt *sql.Stmt
+	if r.Backwards {
+		stmt = sqlutil.TxStmt(txn, s.selectRelationsInRangeDescStmt)
+	} else {
+		stmt = sqlutil.TxStmt(txn, s.selectRelationsInRangeAscStmt)
+	}
+	rows, err := stmt.QueryContext(ctx, roomID, eventID, relType, eventType, r.Low(), r.High(), limit)
+	if err != nil {
+		return nil, lastPos, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRelationsInRange: rows.close() failed")
+	result := map[string][]types.RelationEntry{}
+	var (
+		id           types.StreamPosition
+		childEventID string
+		relationType string
+	)
+	for rows.Next() {
+		if err = rows.Scan(&id, &childEventID, &relationType); err != nil {
+			return nil, lastPos, err
+		}
+		if id > lastPos {
+			lastPos = id
+		}
+		result[relationType] = append(result[relationType], types.RelationEntry{
+			Position: id,
+			EventID:  childEventID,
+		})
+	}
+	if lastPos == 0 {
+		lastPos = r.To
+	}
+	return result, lastPos, rows.Err()
+}
+
+func (s *relationsStatements) SelectMaxRelationID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxRelationIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	return nullableID.Int64, err
+}
+
+// threadRelation is a reply to a thread root event.
+type threadRelation struct {
+	id           int64
+	eventID      string
+	childEventID string
+}
+
+func scanThreadRelations(rows *sql.Rows) ([]threadRelation, error) {
+	var result []threadRelation
+	for rows.Next() {
+		var r threadRelation
+		if err := rows.Scan(&r.id, &r.eventID, &r.childEventID); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+func (s *relationsStatements) SelectThreads(
+	ctx context.Context, txn *sql.Tx, roomID, userID string, from types.StreamPosition, limit int,
+) ([]types.RelationEntry, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectThreadRelationsStmt).QueryContext(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectThreads: rows.close() failed")
+	relations, err := scanThreadRelations(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var sent map[string]struct{}
+	if userID != "" {
+		sent = map[string]struct{}{}
+		var senderRows *sql.Rows
+		senderRows, err = sqlutil.TxStmt(txn, s.selectEventIDsBySenderStmt).QueryContext(ctx, roomID, userID)
+		if err != nil {
+			return nil, err
+		}
+		defer internal.CloseAndLogIfError(ctx, senderRows, "selectThreads: senderRows.close() failed")
+		for senderRows.Next() {
+			var eventID string
+			if err = senderRows.Scan(&eventID); err != nil {
+				return nil, err
+			}
+			sent[eventID] = struct{}{}
+		}
+		if err = senderRows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	latest := map[string]int64{}
+	participated := map[string]bool{}
+	for _, r := range relations {
+		if r.id > latest[r.eventID] {
+			latest[r.eventID] = r.id
+		}
+		if sent != nil {
+			_, sentRoot := sent[r.eventID]
+			_, sentReply := sent[r.childEventID]
+			participated[r.eventID] = participated[r.eventID] || sentRoot || sentReply
+		}
+	}
+	result := make([]types.RelationEntry, 0, len(latest))
+	for eventID, id := range latest {
+		if id >= int64(from) || (sent != nil && !participated[eventID]) {
+			continue
+		}
+		result = append(result, types.RelationEntry{
+			Position: types.StreamPosition(id),
+			EventID:  eventID,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Position > result[j].Position
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (s *relationsStatements) SelectThreadSummaries(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string, userID string,
+) (map[string]types.ThreadSummary, error) {
+	result := make(map[string]types.ThreadSummary, len(eventIDs))
+	if len(eventIDs) == 0 {
+		return result, nil
+	}
+	query := strings.Replace(selectThreadRelationsForEventsSQL, "($2)", sqlutil.QueryVariadicOffset(len(eventIDs), 1), 1)
+	prep, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, prep, "SelectThreadSummaries: prep.close() failed")
+	params := make([]interface{}, 0, len(eventIDs)+1)
+	params = append(params, roomID)
+	for _, eventID := range eventIDs {
+		params = append(params, eventID)
+	}
+	rows, err := sqlutil.TxStmt(txn, prep).QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectThreadSummaries: rows.close() failed")
+	relations, err := scanThreadRelations(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(relations) == 0 {
+		return result, nil
+	}
+
+	childParams := make([]interface{}, 0, len(relations))
+	for _, r := range relations {
+		childParams = append(childParams, r.childEventID)
+	}
+	senders := make(map[string]string, len(relations))
+	var qp sqlutil.QueryProvider = s.db
+	if txn != nil {
+		qp = txn
+	}
+	err = sqlutil.RunLimitedVariablesQuery(
+		ctx, selectEventSendersSQL, qp, childParams, sqlutil.QLMaxVariables,
+		func(rows *sql.Rows) error {
+			for rows.Next() {
+				var eventID, sender string
+				if err := rows.Scan(&eventID, &sender); err != nil {
+					return err
+				}
+				senders[eventID] = sender
+			}
+			return rows.Err()
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	latestIDs := make(map[string]int64, len(eventIDs))
+	for _, r := range relations {
+		summary := result[r.eventID]
+		summary.Count++
+		summary.Participated = summary.Participated || senders[r.childEventID] == userID
+		if r.id > latestIDs[r.eventID] {
+			latestIDs[r.eventID] = r.id
+			summary.LatestEventID = r.childEventID
+		}
+		result[r.eventID] = summary
+	}
+	return result, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// QL has no sequences, so the stream positions which Postgres takes from
+// sequences are handed out from counters stored in this table instead.
+const streamIDTableSchema = `
+-- Global stream ID counter, used by other tables.
+CREATE TABLE IF NOT EXISTS syncapi_stream_id (
+  stream_name string NOT NULL,
+  stream_id int64 NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_stream_id_stream_name_idx ON syncapi_stream_id(stream_name);
+`
+
+// streamNames are the counters stored in the stream ID table.
+var streamNames = []string{"global", "receipt", "presence", "notification", "send_to_device", "relation"}
+
+const insertStreamIDStmt = "" +
+	"INSERT INTO syncapi_stream_id (stream_name, stream_id) VALUES ($1, 0)"
+
+const increaseStreamIDStmt = "" +
+	"UPDATE syncapi_stream_id SET stream_id = stream_id + 1 WHERE stream_name = $1"
+
+const selectStreamIDStmt = "" +
+	"SELECT stream_id FROM syncapi_stream_id WHERE stream_name = $1"
+
+type StreamIDStatements struct {
+	increaseStreamIDStmt *sql.Stmt
+	selectStreamIDStmt   *sql.Stmt
+}
+
+func (s *StreamIDStatements) Prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(streamIDTableSchema)
+	if err != nil {
+		return
+	}
+	for _, name := range streamNames {
+		_, err = db.Exec(insertStreamIDStmt, name)
+		if err != nil && !sqlutil.IsQLUniqueConstraintViolation(err) {
+			return
+		}
+	}
+	return sqlutil.StatementList{
+		{&s.increaseStreamIDStmt, increaseStreamIDStmt},
+		{&s.selectStreamIDStmt, selectStreamIDStmt},
+	}.Prepare(db)
+}
+
+func (s *StreamIDStatements) nextPDUID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.next(ctx, txn, "global")
+}
+
+func (s *StreamIDStatements) nextReceiptID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.next(ctx, txn, "receipt")
+}
+
+func (s *StreamIDStatements) nextPresenceID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.next(ctx, txn, "presence")
+}
+
+func (s *StreamIDStatements) nextNotificationID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.next(ctx, txn, "notification")
+}
+
+func (s *StreamIDStatements) nextSendToDeviceID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.next(ctx, txn, "send_to_device")
+}
+
+func (s *StreamIDStatements) nextRelationID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.next(ctx, txn, "relation")
+}
+
+func (s *StreamIDStatements) next(ctx context.Context, txn *sql.Tx, streamName string) (pos types.StreamPosition, err error) {
+	if _, err = sqlutil.TxStmt(txn, s.increaseStreamIDStmt).ExecContext(ctx, streamName); err != nil {
+		return
+	}
+	err = sqlutil.TxStmt(txn, s.selectStreamIDStmt).QueryRowContext(ctx, streamName).Scan(&pos)
+	return
+}
@@ -492,9 +492,9 @@ func (d *Database) StoreReceipt(ctx context.Context, roomId, receiptType, userId
 	return
 }
 
-func (d *Database) UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int) (pos types.StreamPosition, err error) {
+func (d *Database) UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int, threadCounts map[string]eventutil.ThreadNotificationData) (pos types.StreamPosition, err error) {
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		pos, err = d.NotificationData.UpsertRoomUnreadCounts(ctx, txn, userID, roomID, notificationCount, highlightCount)
+		pos, err = d.NotificationData.UpsertRoomUnreadCounts(ctx, txn, userID, roomID, notificationCount, highlightCount, threadCounts)
 		return err
 	})
 	return
@@ -587,3 +587,41 @@ func (d *Database) SelectMemberships(
 ) (eventIDs []string, err error) {
 	return d.Memberships.SelectMemberships(ctx, nil, roomID, pos, membership, notMembership)
 }
+
+// RoomIDs returns the IDs of all rooms which have current state.
+func (d *Database) RoomIDs(ctx context.Context) ([]string, error) {
+	return d.CurrentRoomState.SelectRoomIDs(ctx, nil)
+}
+
+// CurrentStateEvent returns the current state event of the given type and state key
+// in the room, or nil if there is none.
+func (d *Database) CurrentStateEvent(ctx context.Context, roomID, evType, stateKey string) (*rstypes.HeaderedEvent, error) {
+	return d.CurrentRoomState.SelectStateEvent(ctx, nil, roomID, evType, stateKey)
+}
+
+// EventsBeforeTimestamp returns up to limit events in the room which were sent before the given
+// timestamp, ordered by stream position and starting after afterPos.
+func (d *Database) EventsBeforeTimestamp(
+	ctx context.Context, roomID string, before spec.Timestamp, afterPos types.StreamPosition, limit int,
+) ([]types.StreamEvent, error) {
+	return d.OutputEvents.SelectEventsBeforeTimestamp(ctx, nil, roomID, before, afterPos, limit)
+}
+
+// DeleteEvents removes the given events in the room from the timeline, along with
+// the relations they were part of.
+func (d *Database) DeleteEvents(ctx context.Context, roomID string, eventIDs []string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.OutputEvents.DeleteEvents(ctx, txn, eventIDs); err != nil {
+			return fmt.Errorf("d.OutputEvents.DeleteEvents: %w", err)
+		}
+		if err := d.Topology.DeleteEventsTopology(ctx, txn, eventIDs); err != nil {
+			return fmt.Errorf("d.Topology.DeleteEventsTopology: %w", err)
+		}
+		for _, eventID := range eventIDs {
+			if err := d.Relations.DeleteRelation(ctx, txn, roomID, eventID); err != nil {
+				return fmt.Errorf("d.Relations.DeleteRelation: %w", err)
+			}
+		}
+		return nil
+	})
+}
@@ -747,3 +747,61 @@ func (d *DatabaseTransaction) RelationsFor(ctx context.Context, roomID, eventID,
 
 	return events, prevBatch, nextBatch, nil
 }
+
+func (d *DatabaseTransaction) ThreadsFor(ctx context.Context, roomID, userID string, from types.StreamPosition, limit int) (
+	events []types.StreamEvent, nextBatch string, err error,
+) {
+	if from == 0 {
+		// Thread roots are returned if their latest reply is before "from", so
+		// start just after the most recent relation if no position was given.
+		if from, err = d.MaxStreamPositionForRelations(ctx); err != nil {
+			return nil, "", fmt.Errorf("d.MaxStreamPositionForRelations: %w", err)
+		}
+		from++
+	}
+
+	// Request one more entry than needed so that we can tell whether or
+	// not there are more threads and so whether to set "next_batch".
+	entries, err := d.Relations.SelectThreads(ctx, d.txn, roomID, userID, from, limit+1)
+	if err != nil {
+		return nil, "", fmt.Errorf("d.Relations.SelectThreads: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, "", nil
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		nextBatch = fmt.Sprintf("%d", entries[len(entries)-1].Position)
+	}
+
+	eventIDs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		eventIDs = append(eventIDs, entry.EventID)
+	}
+	streamEvents, err := d.OutputEvents.SelectEvents(ctx, d.txn, eventIDs, nil, true)
+	if err != nil {
+		return nil, "", fmt.Errorf("d.OutputEvents.SelectEvents: %w", err)
+	}
+
+	// SelectEvents doesn't preserve the order of the requested event IDs, so
+	// put the events back into order of most recent thread activity.
+	byID := make(map[string]types.StreamEvent, len(streamEvents))
+	for _, ev := range streamEvents {
+		byID[ev.EventID()] = ev
+	}
+	events = make([]types.StreamEvent, 0, len(entries))
+	for _, entry := range entries {
+		if ev, ok := byID[entry.EventID]; ok {
+			events = append(events, ev)
+		}
+	}
+	return events, nextBatch, nil
+}
+
+func (d *DatabaseTransaction) ThreadSummaries(ctx context.Context, roomID string, eventIDs []string, userID string) (map[string]types.ThreadSummary, error) {
+	return d.Relations.SelectThreadSummaries(ctx, d.txn, roomID, eventIDs, userID)
+}
+
+func (d *DatabaseTransaction) EventIDAtTimestamp(ctx context.Context, roomID string, ts spec.Timestamp, backwards bool) (string, spec.Timestamp, error) {
+	return d.OutputEvents.SelectEventIDAtTimestamp(ctx, d.txn, roomID, ts, backwards)
+}
@@ -21,17 +21,32 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/matrix-org/dendrite/internal/fulltext"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/dendrite/syncapi/storage/postgres"
+	"github.com/matrix-org/dendrite/syncapi/storage/ql"
 )
 
 // NewSyncServerDatasource opens a database connection.
 func NewSyncServerDatasource(ctx context.Context, conMan *sqlutil.Connections, dbProperties *config.DatabaseOptions) (Database, error) {
 	switch {
+	case dbProperties.ConnectionString.IsFile():
+		return ql.NewDatabase(ctx, conMan, dbProperties)
 	case dbProperties.ConnectionString.IsPostgres():
 		return postgres.NewDatabase(ctx, conMan, dbProperties)
 	default:
 		return nil, fmt.Errorf("unexpected database type")
 	}
 }
+
+// NewFulltextIndex opens the fulltext index stored in the sync API database.
+func NewFulltextIndex(processCtx *process.ProcessContext, conMan *sqlutil.Connections, dbProperties *config.DatabaseOptions, cfg config.Fulltext) (fulltext.Indexer, error) {
+	switch {
+	case dbProperties.ConnectionString.IsPostgres():
+		return postgres.NewFulltext(processCtx, conMan, dbProperties, cfg)
+	default:
+		return nil, fmt.Errorf("unexpected database type")
+	}
+}
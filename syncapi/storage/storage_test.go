@@ -3,11 +3,13 @@ package storage_test
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"math"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -26,7 +28,7 @@ import (
 var ctx = context.Background()
 
 func MustCreateDatabase(t *testing.T, dbType test.DBType) (storage.Database, func()) {
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
 	db, err := storage.NewSyncServerDatasource(context.Background(), cm, &config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
@@ -1066,3 +1068,125 @@ func TestRedaction(t *testing.T) {
 		}
 	})
 }
+
+func TestThreads(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(bob.ID))
+
+	thread := func(root string) map[string]interface{} {
+		return map[string]interface{}{
+			"body": "reply",
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.thread",
+				"event_id": root,
+			},
+		}
+	}
+
+	root1 := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "root 1"})
+	root2 := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "root 2"})
+	room.CreateAndInsert(t, bob, "m.room.message", thread(root1.EventID()))
+	latest1 := room.CreateAndInsert(t, bob, "m.room.message", thread(root1.EventID()))
+	latest2 := room.CreateAndInsert(t, alice, "m.room.message", thread(root2.EventID()))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		t.Cleanup(close)
+		// The roomserver consumer sets the user ID and updates relations
+		// when writing events, so do the same here.
+		for _, ev := range room.Events() {
+			userID, err := spec.NewUserID(string(ev.SenderID()), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ev.UserID = *userID
+		}
+		MustWriteEvents(t, db, room.Events())
+		for _, ev := range room.Events() {
+			if err := db.UpdateRelations(ctx, ev); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		WithSnapshot(t, db, func(snapshot storage.DatabaseTransaction) {
+			// All threads, most recently active first
+			events, nextBatch, err := snapshot.ThreadsFor(ctx, room.ID, "", 0, 10)
+			assert.NoError(t, err)
+			assert.Equal(t, "", nextBatch)
+			assert.Equal(t, 2, len(events))
+			assert.Equal(t, root2.EventID(), events[0].EventID())
+			assert.Equal(t, root1.EventID(), events[1].EventID())
+
+			// Paginate one thread at a time
+			events, nextBatch, err = snapshot.ThreadsFor(ctx, room.ID, "", 0, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(events))
+			assert.Equal(t, root2.EventID(), events[0].EventID())
+			assert.NotEqual(t, "", nextBatch)
+			var from types.StreamPosition
+			_, err = fmt.Sscanf(nextBatch, "%d", &from)
+			assert.NoError(t, err)
+			events, nextBatch, err = snapshot.ThreadsFor(ctx, room.ID, "", from, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, "", nextBatch)
+			assert.Equal(t, 1, len(events))
+			assert.Equal(t, root1.EventID(), events[0].EventID())
+
+			// Bob only participated in the first thread
+			events, _, err = snapshot.ThreadsFor(ctx, room.ID, bob.ID, 0, 10)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(events))
+			assert.Equal(t, root1.EventID(), events[0].EventID())
+
+			summaries, err := snapshot.ThreadSummaries(ctx, room.ID, []string{root1.EventID(), root2.EventID()}, bob.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, types.ThreadSummary{Count: 2, LatestEventID: latest1.EventID(), Participated: true}, summaries[root1.EventID()])
+			assert.Equal(t, types.ThreadSummary{Count: 1, LatestEventID: latest2.EventID(), Participated: false}, summaries[root2.EventID()])
+		})
+	})
+}
+
+func TestEventIDAtTimestamp(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+
+	start := time.Now().Add(-time.Hour)
+	first := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "first"}, test.WithTimestamp(start))
+	second := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "second"}, test.WithTimestamp(start.Add(time.Minute)))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		t.Cleanup(close)
+		MustWriteEvents(t, db, room.Events())
+
+		WithSnapshot(t, db, func(snapshot storage.DatabaseTransaction) {
+			between := spec.AsTimestamp(start.Add(30 * time.Second))
+
+			// Looking backwards finds the event sent before the timestamp
+			eventID, ts, err := snapshot.EventIDAtTimestamp(ctx, room.ID, between, true)
+			assert.NoError(t, err)
+			assert.Equal(t, first.EventID(), eventID)
+			assert.Equal(t, first.OriginServerTS(), ts)
+
+			// Looking forwards finds the event sent after the timestamp
+			eventID, ts, err = snapshot.EventIDAtTimestamp(ctx, room.ID, between, false)
+			assert.NoError(t, err)
+			assert.Equal(t, second.EventID(), eventID)
+			assert.Equal(t, second.OriginServerTS(), ts)
+
+			// An exact match is returned in both directions
+			eventID, _, err = snapshot.EventIDAtTimestamp(ctx, room.ID, second.OriginServerTS(), false)
+			assert.NoError(t, err)
+			assert.Equal(t, second.EventID(), eventID)
+			eventID, _, err = snapshot.EventIDAtTimestamp(ctx, room.ID, second.OriginServerTS(), true)
+			assert.NoError(t, err)
+			assert.Equal(t, second.EventID(), eventID)
+
+			// There are no events after the last one
+			_, _, err = snapshot.EventIDAtTimestamp(ctx, room.ID, spec.AsTimestamp(time.Now().Add(time.Hour)), false)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+		})
+	})
+}
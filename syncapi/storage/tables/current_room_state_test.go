@@ -9,6 +9,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/syncapi/storage/postgres"
+	"github.com/matrix-org/dendrite/syncapi/storage/ql"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/synctypes"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -18,7 +19,7 @@ import (
 
 func newCurrentRoomStateTable(t *testing.T, dbType test.DBType) (tables.CurrentRoomState, *sql.DB, func()) {
 	t.Helper()
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
 	}, sqlutil.NewDummyWriter())
@@ -30,6 +31,8 @@ func newCurrentRoomStateTable(t *testing.T, dbType test.DBType) (tables.CurrentR
 	switch dbType {
 	case test.DBTypePostgres:
 		tab, err = postgres.NewPostgresCurrentRoomStateTable(db)
+	case test.DBTypeQL:
+		tab, err = ql.NewQLCurrentRoomStateTable(db)
 	}
 	if err != nil {
 		t.Fatalf("failed to make new table: %s", err)
@@ -70,6 +70,14 @@ type Events interface {
 	SelectContextAfterEvent(ctx context.Context, txn *sql.Tx, id int, roomID string, filter *synctypes.RoomEventFilter) (int, []*rstypes.HeaderedEvent, error)
 
 	PurgeEvents(ctx context.Context, txn *sql.Tx, roomID string) error
+	// SelectEventsBeforeTimestamp returns up to limit events in the room which were sent before the given
+	// timestamp, ordered by stream position and starting after afterPos.
+	SelectEventsBeforeTimestamp(ctx context.Context, txn *sql.Tx, roomID string, before spec.Timestamp, afterPos types.StreamPosition, limit int) ([]types.StreamEvent, error)
+	// DeleteEvents removes the given events.
+	DeleteEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) error
+	// SelectEventIDAtTimestamp returns the event closest to the given timestamp in the given direction.
+	// Returns sql.ErrNoRows if there is no such event.
+	SelectEventIDAtTimestamp(ctx context.Context, txn *sql.Tx, roomID string, ts spec.Timestamp, backwards bool) (eventID string, originServerTS spec.Timestamp, err error)
 	ReIndex(ctx context.Context, txn *sql.Tx, limit, offset int64, types []string) (map[int64]rstypes.HeaderedEvent, error)
 }
 
@@ -89,6 +97,8 @@ type Topology interface {
 	// SelectStreamToTopologicalPosition converts a stream position to a topological position by finding the nearest topological position in the room.
 	SelectStreamToTopologicalPosition(ctx context.Context, txn *sql.Tx, roomID string, streamPos types.StreamPosition, forward bool) (topoPos types.StreamPosition, err error)
 	PurgeEventsTopology(ctx context.Context, txn *sql.Tx, roomID string) error
+	// DeleteEventsTopology removes the given events from the topology.
+	DeleteEventsTopology(ctx context.Context, txn *sql.Tx, eventIDs []string) error
 }
 
 type CurrentRoomState interface {
@@ -112,6 +122,8 @@ type CurrentRoomState interface {
 
 	SelectRoomHeroes(ctx context.Context, txn *sql.Tx, roomID, excludeUserID string, memberships []string) ([]string, error)
 	SelectMembershipCount(ctx context.Context, txn *sql.Tx, roomID, membership string) (int, error)
+	// SelectRoomIDs returns the IDs of all rooms which have current state.
+	SelectRoomIDs(ctx context.Context, txn *sql.Tx) ([]string, error)
 }
 
 // BackwardsExtremities keeps track of backwards extremities for a room.
@@ -194,7 +206,7 @@ type Memberships interface {
 }
 
 type NotificationData interface {
-	UpsertRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, notificationCount, highlightCount int) (types.StreamPosition, error)
+	UpsertRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, notificationCount, highlightCount int, threadCounts map[string]eventutil.ThreadNotificationData) (types.StreamPosition, error)
 	SelectUserUnreadCountsForRooms(ctx context.Context, txn *sql.Tx, userID string, roomIDs []string) (map[string]*eventutil.NotificationData, error)
 	SelectMaxID(ctx context.Context, txn *sql.Tx) (int64, error)
 	PurgeNotificationData(ctx context.Context, txn *sql.Tx, roomID string) error
@@ -229,4 +241,13 @@ type Relations interface {
 	// should be if there are no boundaries supplied (i.e. we want to work backwards but don't have a
 	// "from" or want to work forwards and don't have a "to").
 	SelectMaxRelationID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	// SelectThreads returns the thread roots in the given room, ordered by the position of their most
+	// recent thread reply, newest first. Only threads whose latest reply is before the "from" position
+	// are returned. If a sender ID is specified then only threads which the sender either started or
+	// replied to are returned. The position of each entry is the position of its latest reply.
+	SelectThreads(ctx context.Context, txn *sql.Tx, roomID, userID string, from types.StreamPosition, limit int) ([]types.RelationEntry, error)
+	// SelectThreadSummaries returns a summary of the threads for the given thread root event IDs,
+	// keyed by the root event ID. Events which aren't thread roots are omitted from the result.
+	// Participation is determined by whether the given sender ID has replied to the thread.
+	SelectThreadSummaries(ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string, userID string) (map[string]types.ThreadSummary, error)
 }
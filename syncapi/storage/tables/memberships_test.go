@@ -12,6 +12,7 @@ import (
 	rstypes "github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/syncapi/storage/postgres"
+	"github.com/matrix-org/dendrite/syncapi/storage/ql"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/dendrite/test"
@@ -19,7 +20,7 @@ import (
 
 func newMembershipsTable(t *testing.T, dbType test.DBType) (tables.Memberships, *sql.DB, func()) {
 	t.Helper()
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
 	}, sqlutil.NewDummyWriter())
@@ -31,6 +32,8 @@ func newMembershipsTable(t *testing.T, dbType test.DBType) (tables.Memberships,
 	switch dbType {
 	case test.DBTypePostgres:
 		tab, err = postgres.NewPostgresMembershipsTable(db)
+	case test.DBTypeQL:
+		tab, err = ql.NewQLMembershipsTable(db)
 	}
 	if err != nil {
 		t.Fatalf("failed to make new table: %s", err)
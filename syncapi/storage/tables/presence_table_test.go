@@ -10,6 +10,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/syncapi/storage/postgres"
+	"github.com/matrix-org/dendrite/syncapi/storage/ql"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/synctypes"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -19,7 +20,7 @@ import (
 
 func mustPresenceTable(t *testing.T, dbType test.DBType) (tables.Presence, func()) {
 	t.Helper()
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
 	}, sqlutil.NewDummyWriter())
@@ -31,6 +32,12 @@ func mustPresenceTable(t *testing.T, dbType test.DBType) (tables.Presence, func(
 	switch dbType {
 	case test.DBTypePostgres:
 		tab, err = postgres.NewPostgresPresenceTable(db)
+	case test.DBTypeQL:
+		var stream ql.StreamIDStatements
+		if err = stream.Prepare(db); err != nil {
+			t.Fatalf("failed to prepare stream stmts: %s", err)
+		}
+		tab, err = ql.NewQLPresenceTable(db, &stream)
 	}
 	if err != nil {
 		t.Fatalf("failed to make new table: %s", err)
@@ -8,6 +8,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/syncapi/storage/postgres"
+	"github.com/matrix-org/dendrite/syncapi/storage/ql"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/dendrite/test"
@@ -15,7 +16,7 @@ import (
 
 func newRelationsTable(t *testing.T, dbType test.DBType) (tables.Relations, *sql.DB, func()) {
 	t.Helper()
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
 	}, sqlutil.NewDummyWriter())
@@ -23,10 +24,23 @@ func newRelationsTable(t *testing.T, dbType test.DBType) (tables.Relations, *sql
 		t.Fatalf("failed to open db: %s", err)
 	}
 
+	// The relations table queries the events table to find thread participants.
 	var tab tables.Relations
 	switch dbType {
 	case test.DBTypePostgres:
+		if _, err = postgres.NewPostgresEventsTable(db); err != nil {
+			t.Fatalf("failed to make events table: %s", err)
+		}
 		tab, err = postgres.NewPostgresRelationsTable(db)
+	case test.DBTypeQL:
+		var stream ql.StreamIDStatements
+		if err = stream.Prepare(db); err != nil {
+			t.Fatalf("failed to prepare stream stmts: %s", err)
+		}
+		if _, err = ql.NewQLEventsTable(db, &stream); err != nil {
+			t.Fatalf("failed to make events table: %s", err)
+		}
+		tab, err = ql.NewQLRelationsTable(db, &stream)
 	}
 	if err != nil {
 		t.Fatalf("failed to make new table: %s", err)
@@ -76,7 +76,7 @@ func (p *InviteStreamProvider) IncrementalSync(
 		}
 
 		// skip ignored user events
-		if _, ok := req.IgnoredUsers.List[user.String()]; ok {
+		if req.IgnoredUsers.IsIgnored(user.String()) {
 			continue
 		}
 		ir, err := types.NewInviteResponse(ctx, p.rsAPI, inviteEvent, eventFormat)
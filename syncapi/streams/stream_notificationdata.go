@@ -50,6 +50,10 @@ func (p *NotificationDataStreamProvider) IncrementalSync(
 		return from
 	}
 
+	// If the client asked for unread thread notifications, the counts for
+	// threads are returned separately and not included in the room counts.
+	threaded := req.Filter.Room.Timeline.UnreadThreadNotifications
+
 	// We're merely decorating existing rooms.
 	for roomID, jr := range req.Response.Rooms.Join {
 		counts := countsByRoom[roomID]
@@ -60,6 +64,17 @@ func (p *NotificationDataStreamProvider) IncrementalSync(
 			HighlightCount:    counts.UnreadHighlightCount,
 			NotificationCount: counts.UnreadNotificationCount,
 		}
+		if threaded && len(counts.UnreadThreadNotifications) > 0 {
+			jr.UnreadThreadNotifications = make(map[string]*types.UnreadNotifications, len(counts.UnreadThreadNotifications))
+			for threadID, threadCounts := range counts.UnreadThreadNotifications {
+				jr.UnreadThreadNotifications[threadID] = &types.UnreadNotifications{
+					HighlightCount:    threadCounts.UnreadHighlightCount,
+					NotificationCount: threadCounts.UnreadNotificationCount,
+				}
+				jr.UnreadNotifications.HighlightCount -= threadCounts.UnreadHighlightCount
+				jr.UnreadNotifications.NotificationCount -= threadCounts.UnreadNotificationCount
+			}
+		}
 		req.Response.Rooms.Join[roomID] = jr
 	}
 
@@ -120,6 +120,26 @@ func (p *PDUStreamProvider) CompleteSync(
 		req.Rooms[roomID] = spec.Join
 	}
 
+	// Add knocked rooms, so that the user can see the outcome of any
+	// outstanding knocks.
+	knockedRoomIDs, err := snapshot.RoomIDsWithMembership(ctx, req.Device.UserID, spec.Knock)
+	if err != nil {
+		req.Log.WithError(err).Error("p.DB.RoomIDsWithMembership failed")
+		return to
+	}
+	for _, roomID := range knockedRoomIDs {
+		knockEvent, kerr := snapshot.GetStateEvent(ctx, roomID, spec.MRoomMember, req.Device.UserID)
+		if kerr != nil || knockEvent == nil {
+			continue
+		}
+		kr, kerr := types.NewKnockResponse(ctx, p.rsAPI, knockEvent, eventFormat)
+		if kerr != nil {
+			req.Log.WithError(kerr).Error("types.NewKnockResponse failed")
+			continue
+		}
+		req.Response.Rooms.Knock[roomID] = kr
+	}
+
 	return to
 }
 
@@ -302,6 +322,11 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 		return r.To, nil
 	}
 
+	// Knocked rooms only get the stripped state, rather than a timeline.
+	if delta.Membership == spec.Knock {
+		return p.addKnockDeltaToResponse(ctx, snapshot, device, r, delta, req, recentEvents)
+	}
+
 	// Work out what the highest stream position is for all of the events in this
 	// room that were returned.
 	latestPosition := r.To
@@ -341,7 +366,7 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 	}
 
 	// Applies the history visibility rules
-	events, err := applyHistoryVisibilityFilter(ctx, snapshot, p.rsAPI, delta.RoomID, device.UserID, recentEvents)
+	events, err := ApplyHistoryVisibilityFilter(ctx, snapshot, p.rsAPI, delta.RoomID, device.UserID, recentEvents)
 	if err != nil {
 		logrus.WithError(err).Error("unable to apply history visibility filter")
 	}
@@ -406,6 +431,7 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 		jr.Timeline.Events = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(events), eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 			return p.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 		})
+		p.bundleThreadAggregations(ctx, snapshot, device, delta.RoomID, jr.Timeline.Events, eventFormat)
 		// If we are limited by the filter AND the history visibility filter
 		// didn't "remove" events, return that the response is limited.
 		jr.Timeline.Limited = (limited && len(events) == len(recentEvents)) || delta.NewlyJoined
@@ -423,6 +449,7 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 		lr.Timeline.Events = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(events), eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 			return p.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 		})
+		p.bundleThreadAggregations(ctx, snapshot, device, delta.RoomID, lr.Timeline.Events, eventFormat)
 		// If we are limited by the filter AND the history visibility filter
 		// didn't "remove" events, return that the response is limited.
 		lr.Timeline.Limited = limited && len(events) == len(recentEvents)
@@ -435,9 +462,71 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 	return latestPosition, nil
 }
 
-// applyHistoryVisibilityFilter gets the current room state and supplies it to ApplyHistoryVisibilityFilter, to make
+// addKnockDeltaToResponse adds a room that the user has knocked on to the
+// "knock" section of the /sync response.
+func (p *PDUStreamProvider) addKnockDeltaToResponse(
+	ctx context.Context,
+	snapshot storage.DatabaseTransaction,
+	device *userapi.Device,
+	r types.Range,
+	delta types.StateDelta,
+	req *types.SyncRequest,
+	recentEvents []*rstypes.HeaderedEvent,
+) (types.StreamPosition, error) {
+	latestPosition := r.To
+	if r.Backwards {
+		latestPosition = r.From
+	}
+
+	// Find the most recent knock event for this user, which will be in either
+	// the state or the timeline.
+	candidates := make([]*rstypes.HeaderedEvent, 0, len(delta.StateEvents)+len(recentEvents))
+	candidates = append(candidates, delta.StateEvents...)
+	candidates = append(candidates, recentEvents...)
+	var knockEvent *rstypes.HeaderedEvent
+	for _, ev := range candidates {
+		if ev.Type() != spec.MRoomMember || ev.StateKey() == nil {
+			continue
+		}
+		if membership, _ := ev.Membership(); membership != spec.Knock {
+			continue
+		}
+		userID, err := p.rsAPI.QueryUserIDForSender(ctx, ev.RoomID(), spec.SenderID(*ev.StateKey()))
+		if err != nil || userID == nil || userID.String() != device.UserID {
+			continue
+		}
+		if knockEvent == nil || ev.OriginServerTS() >= knockEvent.OriginServerTS() {
+			knockEvent = ev
+		}
+	}
+	if knockEvent == nil {
+		// The state filter may have removed the knock event, so fall back to
+		// the current state.
+		var err error
+		knockEvent, err = snapshot.GetStateEvent(ctx, delta.RoomID, spec.MRoomMember, device.UserID)
+		if err != nil {
+			return r.From, fmt.Errorf("snapshot.GetStateEvent: %w", err)
+		}
+		if knockEvent == nil {
+			return latestPosition, nil
+		}
+	}
+
+	eventFormat := synctypes.FormatSync
+	if req.Filter.EventFormat == synctypes.EventFormatFederation {
+		eventFormat = synctypes.FormatSyncFederation
+	}
+	kr, err := types.NewKnockResponse(ctx, p.rsAPI, knockEvent, eventFormat)
+	if err != nil {
+		return r.From, fmt.Errorf("types.NewKnockResponse: %w", err)
+	}
+	req.Response.Rooms.Knock[delta.RoomID] = kr
+	return latestPosition, nil
+}
+
+// ApplyHistoryVisibilityFilter gets the current room state and supplies it to internal.ApplyHistoryVisibilityFilter, to make
 // sure we always return the required events in the timeline.
-func applyHistoryVisibilityFilter(
+func ApplyHistoryVisibilityFilter(
 	ctx context.Context,
 	snapshot storage.DatabaseTransaction,
 	rsAPI roomserverAPI.SyncRoomserverAPI,
@@ -536,7 +625,7 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 
 	events := recentEvents
 
-	events, err = applyHistoryVisibilityFilter(ctx, snapshot, p.rsAPI, roomID, device.UserID, recentEvents)
+	events, err = ApplyHistoryVisibilityFilter(ctx, snapshot, p.rsAPI, roomID, device.UserID, recentEvents)
 	if err != nil {
 		logrus.WithError(err).Error("unable to apply history visibility filter")
 	}
@@ -585,6 +674,7 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	jr.Timeline.Events = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(events), eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return p.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 	})
+	p.bundleThreadAggregations(ctx, snapshot, device, roomID, jr.Timeline.Events, eventFormat)
 	// If we are limited by the filter AND the history visibility filter
 	// didn't "remove" events, return that the response is limited.
 	jr.Timeline.Limited = limited && len(events) == len(recentEvents)
@@ -594,6 +684,22 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	return jr, nil
 }
 
+// bundleThreadAggregations adds the m.thread aggregations to any thread roots in the
+// timeline. Failing to do so isn't fatal, the events are then sent without them.
+func (p *PDUStreamProvider) bundleThreadAggregations(
+	ctx context.Context, snapshot storage.DatabaseTransaction,
+	device *userapi.Device, roomID string,
+	events []synctypes.ClientEvent, eventFormat synctypes.ClientEventFormat,
+) {
+	userID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		return
+	}
+	if err = internal.BundleThreadAggregations(ctx, snapshot, p.rsAPI, *userID, roomID, events, eventFormat); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Warn("failed to bundle thread aggregations")
+	}
+}
+
 func (p *PDUStreamProvider) lazyLoadMembers(
 	ctx context.Context, snapshot storage.DatabaseTransaction, roomID string,
 	incremental, limited bool, stateFilter *synctypes.StateFilter,
@@ -674,13 +780,7 @@ func (p *PDUStreamProvider) addIgnoredUsersToFilter(ctx context.Context, snapsho
 		return err
 	}
 	req.IgnoredUsers = *ignores
-	userList := make([]string, 0, len(ignores.List))
-	for userID := range ignores.List {
-		userList = append(userList, userID)
-	}
-	if len(userList) > 0 {
-		eventFilter.NotSenders = &userList
-	}
+	ignores.AddToFilter(eventFilter)
 	return nil
 }
 
@@ -102,6 +102,10 @@ func (p *PresenceStreamProvider) IncrementalSync(
 		if req.Device.UserID != presence.UserID && !p.notifier.IsSharedUser(req.Device.UserID, presence.UserID) {
 			continue
 		}
+		// skip presence of ignored users
+		if req.IgnoredUsers.IsIgnored(presence.UserID) {
+			continue
+		}
 		cacheKey := req.Device.UserID + req.Device.ID + presence.UserID
 		pres, ok := p.cache.Load(cacheKey)
 		if ok {
@@ -65,7 +65,7 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 	receiptsByRoom := make(map[string][]types.OutputReceiptEvent)
 	for _, receipt := range receipts {
 		// skip ignored user events
-		if _, ok := req.IgnoredUsers.List[receipt.UserID]; ok {
+		if req.IgnoredUsers.IsIgnored(receipt.UserID) {
 			continue
 		}
 		// Don't send private read receipts to other users
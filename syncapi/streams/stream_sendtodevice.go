@@ -50,7 +50,7 @@ func (p *SendToDeviceStreamProvider) IncrementalSync(
 	// Add the updates into the sync response.
 	for _, event := range events {
 		// skip ignored user events
-		if _, ok := req.IgnoredUsers.List[event.Sender]; ok {
+		if req.IgnoredUsers.IsIgnored(event.Sender) {
 			continue
 		}
 		req.Response.ToDevice.Events = append(req.Response.ToDevice.Events, event.SendToDeviceEvent)
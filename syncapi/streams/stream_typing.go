@@ -47,7 +47,7 @@ func (p *TypingStreamProvider) IncrementalSync(
 			typingUsers := make([]string, 0, len(users))
 			for i := range users {
 				// skip ignored user events
-				if _, ok := req.IgnoredUsers.List[users[i]]; !ok {
+				if !req.IgnoredUsers.IsIgnored(users[i]) {
 					typingUsers = append(typingUsers, users[i])
 				}
 			}
@@ -33,6 +33,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/notifier"
 	"github.com/matrix-org/dendrite/syncapi/storage"
@@ -53,6 +54,8 @@ type RequestPool struct {
 	Notifier *notifier.Notifier
 	producer PresencePublisher
 	consumer PresenceConsumer
+	// The connections of native sliding sync clients.
+	slidingSync *slidingSyncConns
 }
 
 type PresencePublisher interface {
@@ -65,6 +68,7 @@ type PresenceConsumer interface {
 
 // NewRequestPool makes a new RequestPool
 func NewRequestPool(
+	processContext *process.ProcessContext,
 	db storage.Database, cfg *config.SyncAPI,
 	userAPI userapi.SyncUserAPI,
 	rsAPI roomserverAPI.SyncRoomserverAPI,
@@ -87,8 +91,11 @@ func NewRequestPool(
 		Notifier: notifier,
 		producer: producer,
 		consumer: consumer,
+
+		slidingSync: newSlidingSyncConns(),
 	}
 	go rp.cleanLastSeen()
+	go rp.cleanSlidingSyncConns(processContext)
 	go rp.cleanPresence(db, time.Minute*5)
 	return rp
 }
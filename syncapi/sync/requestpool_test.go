@@ -2,11 +2,13 @@ package sync
 
 import (
 	"context"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/dendrite/syncapi/synctypes"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib/spec"
@@ -142,3 +144,51 @@ func TestRequestPool_updatePresence(t *testing.T) {
 		})
 	}
 }
+
+func TestCleanSlidingSyncConnsStops(t *testing.T) {
+	processCtx := process.NewProcessContext()
+	rp := &RequestPool{slidingSync: newSlidingSyncConns()}
+	done := make(chan struct{})
+	go func() {
+		rp.cleanSlidingSyncConns(processCtx)
+		close(done)
+	}()
+	processCtx.ShutdownDendrite()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected cleaning sliding sync connections to stop on shutdown")
+	}
+}
+
+func TestSlidingSyncConnsPerDevice(t *testing.T) {
+	conns := newSlidingSyncConns()
+	positions := map[string]string{}
+	for i := 0; i < slidingSyncConnsPerDevice; i++ {
+		connID := strconv.Itoa(i)
+		positions[connID] = conns.store("@alice:test|ALICE", connID, newSlidingSyncState())
+		conns.conns["@alice:test|ALICE"][connID].lastUsed = time.Now().Add(-time.Duration(slidingSyncConnsPerDevice-i) * time.Second)
+	}
+	// Using the oldest connection makes the second oldest the least recently used one
+	if _, ok := conns.load("@alice:test|ALICE", "0", positions["0"]); !ok {
+		t.Fatalf("expected connection 0 to be known")
+	}
+	// Other devices have their own connections
+	conns.store("@alice:test|OTHER", "new", newSlidingSyncState())
+
+	conns.store("@alice:test|ALICE", "new", newSlidingSyncState())
+	if got := len(conns.conns["@alice:test|ALICE"]); got != slidingSyncConnsPerDevice {
+		t.Fatalf("expected %d connections, got %d", slidingSyncConnsPerDevice, got)
+	}
+	if _, ok := conns.load("@alice:test|ALICE", "1", positions["1"]); ok {
+		t.Fatalf("expected the least recently used connection to be forgotten")
+	}
+	for _, connID := range []string{"0", "2"} {
+		if _, ok := conns.load("@alice:test|ALICE", connID, positions[connID]); !ok {
+			t.Fatalf("expected connection %s to be known", connID)
+		}
+	}
+	if got := len(conns.conns["@alice:test|OTHER"]); got != 1 {
+		t.Fatalf("expected the other device to keep its connection, got %d", got)
+	}
+}
@@ -0,0 +1,1083 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	rstypes "github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/streams"
+	"github.com/matrix-org/dendrite/syncapi/synctypes"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// How many positions of a sliding sync connection are kept, so that clients
+// can retry requests whose responses they didn't receive.
+const slidingSyncPositions = 10
+
+// How long sliding sync connections are kept after they were last used.
+const slidingSyncConnTimeout = 30 * time.Minute
+
+// How many sliding sync connections a device may have. Clients pick the
+// connection IDs, so the least recently used connection is forgotten when
+// a device starts more than this.
+const slidingSyncConnsPerDevice = 10
+
+// slidingSyncState is what the client of a sliding sync connection knows
+// about after receiving the response for a position. It must not be
+// modified once stored, as clients may retry from it.
+type slidingSyncState struct {
+	token types.StreamingToken
+	// The rooms which were sent to the client.
+	rooms map[string]slidingRoomState
+	// The position of the latest event in each room, used to sort by recency.
+	bumpStamps map[string]types.StreamPosition
+	// The windows of each list which were sent to the client.
+	lists map[string]string
+	// The extensions are sticky, so they stay enabled until disabled.
+	extensions types.SlidingExtensionsRequest
+}
+
+type slidingRoomState struct {
+	config     types.SlidingRoomConfig
+	membership string
+	// The PDU position up to which the client has the room's timeline.
+	position          types.StreamPosition
+	notificationCount int
+	highlightCount    int
+}
+
+func newSlidingSyncState() *slidingSyncState {
+	return &slidingSyncState{
+		rooms:      map[string]slidingRoomState{},
+		bumpStamps: map[string]types.StreamPosition{},
+		lists:      map[string]string{},
+	}
+}
+
+func (s *slidingSyncState) copy() *slidingSyncState {
+	c := &slidingSyncState{
+		token:      s.token,
+		rooms:      make(map[string]slidingRoomState, len(s.rooms)),
+		bumpStamps: make(map[string]types.StreamPosition, len(s.bumpStamps)),
+		lists:      make(map[string]string, len(s.lists)),
+		extensions: s.extensions,
+	}
+	for roomID, room := range s.rooms {
+		c.rooms[roomID] = room
+	}
+	for roomID, bumpStamp := range s.bumpStamps {
+		c.bumpStamps[roomID] = bumpStamp
+	}
+	return c
+}
+
+// slidingSyncConns keeps track of the sliding sync connections of all devices.
+// The connections are only kept in memory, so they are lost on restart and
+// aren't shared between sync API instances. Clients then restart the
+// connection after being told that the position is unknown.
+type slidingSyncConns struct {
+	mutex sync.Mutex
+	// Positions are unique across all connections, so that a position of
+	// an expired connection is never mistaken for one of a newer connection.
+	lastPos int64
+	// The connections of each device, by connection ID.
+	conns map[string]map[string]*slidingSyncConn
+}
+
+type slidingSyncConn struct {
+	lastUsed time.Time
+	states   map[int64]*slidingSyncState
+}
+
+func newSlidingSyncConns() *slidingSyncConns {
+	return &slidingSyncConns{
+		conns: map[string]map[string]*slidingSyncConn{},
+	}
+}
+
+// load returns the state of the connection at the given position. Requests
+// without a position start the connection from scratch. Returns false if
+// the position is unknown, e.g. because the connection expired.
+func (c *slidingSyncConns) load(deviceKey, connID, pos string) (*slidingSyncState, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if pos == "" {
+		delete(c.conns[deviceKey], connID)
+		return newSlidingSyncState(), true
+	}
+	conn, ok := c.conns[deviceKey][connID]
+	if !ok {
+		return nil, false
+	}
+	p, err := strconv.ParseInt(pos, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	state, ok := conn.states[p]
+	if !ok {
+		return nil, false
+	}
+	conn.lastUsed = time.Now()
+	return state, true
+}
+
+// store remembers the state of the connection and returns its position.
+func (c *slidingSyncConns) store(deviceKey, connID string, state *slidingSyncState) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	deviceConns, ok := c.conns[deviceKey]
+	if !ok {
+		deviceConns = map[string]*slidingSyncConn{}
+		c.conns[deviceKey] = deviceConns
+	}
+	conn, ok := deviceConns[connID]
+	if !ok {
+		for len(deviceConns) >= slidingSyncConnsPerDevice {
+			var oldestID string
+			for id, other := range deviceConns {
+				if oldestID == "" || other.lastUsed.Before(deviceConns[oldestID].lastUsed) {
+					oldestID = id
+				}
+			}
+			delete(deviceConns, oldestID)
+		}
+		conn = &slidingSyncConn{states: map[int64]*slidingSyncState{}}
+		deviceConns[connID] = conn
+	}
+	c.lastPos++
+	conn.states[c.lastPos] = state
+	conn.lastUsed = time.Now()
+	for len(conn.states) > slidingSyncPositions {
+		oldest := c.lastPos
+		for pos := range conn.states {
+			if pos < oldest {
+				oldest = pos
+			}
+		}
+		delete(conn.states, oldest)
+	}
+	return strconv.FormatInt(c.lastPos, 10)
+}
+
+// cleanSlidingSyncConns forgets connections which haven't been used for a
+// while, until the process shuts down.
+func (rp *RequestPool) cleanSlidingSyncConns(processContext *process.ProcessContext) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-processContext.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		rp.slidingSync.mutex.Lock()
+		for deviceKey, deviceConns := range rp.slidingSync.conns {
+			for connID, conn := range deviceConns {
+				if time.Since(conn.lastUsed) > slidingSyncConnTimeout {
+					delete(deviceConns, connID)
+				}
+			}
+			if len(deviceConns) == 0 {
+				delete(rp.slidingSync.conns, deviceKey)
+			}
+		}
+		rp.slidingSync.mutex.Unlock()
+	}
+}
+
+// slidingSyncRequest is a sliding sync request being processed.
+type slidingSyncRequest struct {
+	ctx    context.Context
+	log    *logrus.Entry
+	device *userapi.Device
+	body   *types.SlidingSyncRequest
+	// The extension settings of the connection, including this request.
+	extensions types.SlidingExtensionsRequest
+	// The position the to_device extension continues from, if the client
+	// sent one.
+	toDeviceSince *types.StreamPosition
+}
+
+// OnIncomingSlidingSyncRequest is called when a client makes a sliding sync
+// request, see MSC3575 and MSC4186. Like OnIncomingSyncRequest, this blocks
+// until there is something new for the client or the timeout is reached.
+func (rp *RequestPool) OnIncomingSlidingSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	var body types.SlidingSyncRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	for name, list := range body.Lists {
+		for _, window := range list.Windows() {
+			if window[0] < 0 || window[1] < window[0] {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: spec.InvalidParam(fmt.Sprintf("Invalid range for list %q", name)),
+				}
+			}
+		}
+	}
+
+	query := req.URL.Query()
+	deviceKey := device.UserID + "|" + device.ID
+	state, ok := rp.slidingSync.load(deviceKey, body.ConnID, query.Get("pos"))
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MatrixError{ErrCode: "M_UNKNOWN_POS", Err: "Unknown position, the connection has to be restarted"},
+		}
+	}
+
+	syncReq := &slidingSyncRequest{
+		ctx: req.Context(),
+		log: util.GetLogger(req.Context()).WithFields(logrus.Fields{
+			"user_id":   device.UserID,
+			"device_id": device.ID,
+			"conn_id":   body.ConnID,
+			"pos":       query.Get("pos"),
+		}),
+		device:     device,
+		body:       &body,
+		extensions: mergeSlidingExtensions(state.extensions, body.Extensions),
+	}
+	if toDevice := body.Extensions.ToDevice; toDevice != nil && toDevice.Since != "" {
+		since, err := types.NewStreamPositionFromString(toDevice.Since)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("Invalid to_device since token"),
+			}
+		}
+		syncReq.toDeviceSince = &since
+	}
+
+	activeSyncRequests.Inc()
+	defer activeSyncRequests.Dec()
+
+	rp.updateLastSeen(req, device)
+	rp.updatePresence(rp.db, query.Get("set_presence"), device.UserID)
+
+	// Clean up the send-to-device messages the client has received, so that
+	// they aren't sent again.
+	if syncReq.extensions.ToDevice.IsEnabled() {
+		if err := rp.db.CleanSendToDeviceUpdates(syncReq.ctx, device.UserID, device.ID, syncReq.toDeviceFrom(state)); err != nil {
+			syncReq.log.WithError(err).Error("p.DB.CleanSendToDeviceUpdates failed")
+		}
+	}
+
+	deadline := time.Now().Add(getTimeout(query.Get("timeout")))
+	// The position the previous attempt looked at. The stream providers may
+	// return positions behind it, so it is tracked separately from the token
+	// of the connection to avoid waking up for the same updates again.
+	waitFrom := state.token
+	for {
+		currentPos := rp.Notifier.CurrentPosition()
+		if !waitFrom.IsEmpty() && !currentPos.IsAfter(waitFrom) && time.Now().Before(deadline) {
+			waitingSyncRequests.Inc()
+			rp.waitForSlidingSyncUpdates(syncReq.ctx, device, waitFrom, time.Until(deadline))
+			waitingSyncRequests.Dec()
+			currentPos = rp.Notifier.CurrentPosition()
+		}
+		waitFrom = currentPos
+
+		res, newState, err := rp.slidingSyncResponse(syncReq, state, currentPos)
+		if err != nil {
+			syncReq.log.WithError(err).Error("Failed to build sliding sync response")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+
+		// There may be no updates for this user even though the streams moved
+		// on, in which case keep waiting rather than returning nothing.
+		if !res.HasUpdates() && !state.token.IsEmpty() && syncReq.ctx.Err() == nil && time.Now().Before(deadline) {
+			state = newState
+			continue
+		}
+
+		res.Pos = rp.slidingSync.store(deviceKey, body.ConnID, newState)
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+}
+
+// waitForSlidingSyncUpdates blocks until the notifier has something new for
+// the device, the timeout is reached or the client gave up.
+func (rp *RequestPool) waitForSlidingSyncUpdates(ctx context.Context, device *userapi.Device, since types.StreamingToken, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	listener := rp.Notifier.GetListener(types.SyncRequest{Context: ctx, Device: device})
+	defer listener.Close()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	case <-listener.GetNotifyChannel(since):
+	}
+}
+
+// slidingSyncResponse works out what changed for the client between the state
+// of the connection and the given position.
+func (rp *RequestPool) slidingSyncResponse(
+	req *slidingSyncRequest, prev *slidingSyncState, to types.StreamingToken,
+) (res *types.SlidingSyncResponse, state *slidingSyncState, err error) {
+	ctx := req.ctx
+	snapshot, err := rp.db.NewDatabaseSnapshot(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("rp.db.NewDatabaseSnapshot: %w", err)
+	}
+	var succeeded bool
+	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
+
+	state = prev.copy()
+	state.token = to
+	state.lists = make(map[string]string, len(req.body.Lists))
+	state.extensions = req.extensions
+	res = &types.SlidingSyncResponse{
+		Lists: make(map[string]types.SlidingListResponse, len(req.body.Lists)),
+		Rooms: map[string]*types.SlidingRoomResponse{},
+	}
+
+	ignores, err := snapshot.IgnoresForUser(ctx, req.device.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("snapshot.IgnoresForUser: %w", err)
+	}
+	if ignores == nil {
+		ignores = &types.IgnoredUsers{}
+	}
+	eventFilter := synctypes.DefaultRoomEventFilter()
+	ignores.AddToFilter(&eventFilter)
+
+	rooms, err := rp.slidingSyncRooms(req, snapshot, state, prev.token, to, eventFilter, ignores)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Work out which rooms are in the windows of the lists, and with which
+	// room config. Rooms in several lists get the combined config.
+	roomConfigs := map[string]types.SlidingRoomConfig{}
+	addRoom := func(roomID string, config types.SlidingRoomConfig) {
+		if existing, ok := roomConfigs[roomID]; ok {
+			config = existing.Combine(config)
+		}
+		roomConfigs[roomID] = config
+	}
+	listFilter := &slidingListFilter{ctx: ctx, snapshot: snapshot}
+	for _, list := range req.body.Lists {
+		if list.Filters != nil && (len(list.Filters.Tags) > 0 || len(list.Filters.NotTags) > 0) {
+			dataRes := userapi.QueryAccountDataResponse{}
+			if err = rp.userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{UserID: req.device.UserID}, &dataRes); err != nil {
+				return nil, nil, fmt.Errorf("rp.userAPI.QueryAccountData: %w", err)
+			}
+			listFilter.tags = roomTags(dataRes.RoomAccountData)
+			break
+		}
+	}
+	listRoomIDs := make(map[string][]string, len(req.body.Lists))
+	for name, list := range req.body.Lists {
+		var listRooms []*slidingRoom
+		for _, room := range rooms {
+			var matches bool
+			if matches, err = listFilter.matches(room, list.Filters); err != nil {
+				return nil, nil, fmt.Errorf("failed to filter list %q: %w", name, err)
+			}
+			if matches {
+				listRooms = append(listRooms, room)
+			}
+		}
+		sorts := list.Sort
+		if len(sorts) == 0 {
+			sorts = []string{types.SlidingSortByRecency}
+		}
+		if err = sortSlidingRooms(ctx, snapshot, listRooms, sorts); err != nil {
+			return nil, nil, fmt.Errorf("failed to sort list %q: %w", name, err)
+		}
+
+		listRes := types.SlidingListResponse{Count: len(listRooms)}
+		windows := list.Windows()
+		windowIDs := windowRooms(listRooms, windows)
+		var sent strings.Builder
+		for i, roomIDs := range windowIDs {
+			for _, roomID := range roomIDs {
+				addRoom(roomID, list.SlidingRoomConfig)
+			}
+			listRoomIDs[name] = append(listRoomIDs[name], roomIDs...)
+			fmt.Fprintf(&sent, "%d-%d:%s;", windows[i][0], windows[i][1], strings.Join(roomIDs, ","))
+		}
+		// Only tell the client about the windows if they changed.
+		if state.lists[name] = sent.String(); state.lists[name] != prev.lists[name] {
+			for i, roomIDs := range windowIDs {
+				listRes.Ops = append(listRes.Ops, types.SlidingListOp{
+					Op:      "SYNC",
+					Range:   windows[i],
+					RoomIDs: roomIDs,
+				})
+			}
+		}
+		res.Lists[name] = listRes
+	}
+	for roomID, config := range req.body.RoomSubscriptions {
+		// Peeking into rooms the user isn't in is not supported.
+		if _, ok := rooms[roomID]; ok {
+			addRoom(roomID, config)
+		}
+	}
+
+	leftRooms, err := rp.addSlidingSyncRooms(req, snapshot, res, state, prev, rooms, roomConfigs, to.PDUPosition, eventFilter)
+	if err != nil {
+		return nil, nil, err
+	}
+	rp.addSlidingSyncExtensions(req, snapshot, res, state, prev.token, to, rooms, leftRooms, listRoomIDs, ignores)
+
+	succeeded = true
+	return res, state, nil
+}
+
+// slidingSyncRooms returns the rooms the user is joined or invited to, with
+// what is needed to filter and sort them.
+func (rp *RequestPool) slidingSyncRooms(
+	req *slidingSyncRequest, snapshot storage.DatabaseTransaction, state *slidingSyncState,
+	since, to types.StreamingToken, eventFilter synctypes.RoomEventFilter, ignores *types.IgnoredUsers,
+) (map[string]*slidingRoom, error) {
+	ctx, userID := req.ctx, req.device.UserID
+	joinedRoomIDs, err := snapshot.RoomIDsWithMembership(ctx, userID, spec.Join)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot.RoomIDsWithMembership: %w", err)
+	}
+	rooms := make(map[string]*slidingRoom, len(joinedRoomIDs))
+	memberships := make(map[string]string, len(joinedRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		rooms[roomID] = &slidingRoom{roomID: roomID, membership: spec.Join}
+		memberships[roomID] = spec.Join
+	}
+
+	invites, _, _, err := snapshot.InviteEventsInRange(ctx, userID, types.Range{From: 0, To: to.InvitePosition})
+	if err != nil {
+		return nil, fmt.Errorf("snapshot.InviteEventsInRange: %w", err)
+	}
+	for roomID, inviteEvent := range invites {
+		if _, ok := rooms[roomID]; ok {
+			continue
+		}
+		sender, err := rp.rsAPI.QueryUserIDForSender(ctx, inviteEvent.RoomID(), inviteEvent.SenderID())
+		if err == nil && sender != nil {
+			// skip invites from ignored users
+			if ignores.IsIgnored(sender.String()) {
+				continue
+			}
+		}
+		rooms[roomID] = &slidingRoom{
+			roomID:     roomID,
+			membership: spec.Invite,
+			invite:     inviteEvent,
+			isDM:       gjson.GetBytes(inviteEvent.Content(), "is_direct").Bool(),
+		}
+	}
+
+	// Update the position of the latest event in each room, which is used as
+	// bump stamp. Rooms we haven't seen before are looked up in full, for the
+	// others it is enough to look at the events since the last request.
+	eventFilter.Limit = 1
+	var newRoomIDs, knownRoomIDs []string
+	for _, roomID := range joinedRoomIDs {
+		if _, ok := state.bumpStamps[roomID]; ok && !since.IsEmpty() {
+			knownRoomIDs = append(knownRoomIDs, roomID)
+		} else {
+			newRoomIDs = append(newRoomIDs, roomID)
+		}
+	}
+	for _, r := range []struct {
+		roomIDs []string
+		r       types.Range
+	}{
+		{newRoomIDs, types.Range{From: to.PDUPosition, To: 0, Backwards: true}},
+		{knownRoomIDs, types.Range{From: since.PDUPosition, To: to.PDUPosition}},
+	} {
+		if len(r.roomIDs) == 0 {
+			continue
+		}
+		recentEvents, err := snapshot.RecentEvents(ctx, r.roomIDs, r.r, &eventFilter, true, true)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot.RecentEvents: %w", err)
+		}
+		for roomID, events := range recentEvents {
+			if len(events.Events) > 0 {
+				state.bumpStamps[roomID] = events.Events[len(events.Events)-1].StreamPosition
+			}
+		}
+	}
+	for roomID := range state.bumpStamps {
+		if _, ok := rooms[roomID]; !ok {
+			delete(state.bumpStamps, roomID)
+		}
+	}
+	for roomID, room := range rooms {
+		if _, ok := state.bumpStamps[roomID]; !ok && room.membership == spec.Invite {
+			// The invite is the latest thing that happened in the room, as
+			// far as the user is concerned.
+			state.bumpStamps[roomID] = to.PDUPosition
+		}
+		room.bumpStamp = state.bumpStamps[roomID]
+	}
+
+	dataRes := userapi.QueryAccountDataResponse{}
+	if err = rp.userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{UserID: userID, DataType: "m.direct"}, &dataRes); err != nil {
+		return nil, fmt.Errorf("rp.userAPI.QueryAccountData: %w", err)
+	}
+	var direct map[string][]string
+	if data, ok := dataRes.GlobalAccountData["m.direct"]; ok {
+		if err = json.Unmarshal(data, &direct); err != nil {
+			req.log.WithError(err).Warn("Failed to parse m.direct account data")
+		}
+	}
+	for _, roomIDs := range direct {
+		for _, roomID := range roomIDs {
+			if room, ok := rooms[roomID]; ok {
+				room.isDM = true
+			}
+		}
+	}
+
+	counts, err := snapshot.GetUserUnreadNotificationCountsForRooms(ctx, userID, memberships)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot.GetUserUnreadNotificationCountsForRooms: %w", err)
+	}
+	for roomID, count := range counts {
+		if room, ok := rooms[roomID]; ok {
+			room.notificationCount = count.UnreadNotificationCount
+			room.highlightCount = count.UnreadHighlightCount
+		}
+	}
+	return rooms, nil
+}
+
+// addSlidingSyncRooms adds the rooms in the lists and room subscriptions to
+// the response, if anything changed since the client last saw them. Rooms
+// the client knows about but has left since are added as well, and their
+// IDs returned.
+func (rp *RequestPool) addSlidingSyncRooms(
+	req *slidingSyncRequest, snapshot storage.DatabaseTransaction,
+	res *types.SlidingSyncResponse, state, prev *slidingSyncState,
+	rooms map[string]*slidingRoom, roomConfigs map[string]types.SlidingRoomConfig,
+	to types.StreamPosition, eventFilter synctypes.RoomEventFilter,
+) ([]string, error) {
+	ctx := req.ctx
+	since := prev.token.PDUPosition
+
+	// Group the rooms by the events they need, so that they can be
+	// looked up together.
+	type fetch struct {
+		from    types.StreamPosition
+		limit   int
+		initial bool
+	}
+	fetches := map[fetch][]string{}
+	for roomID, config := range roomConfigs {
+		room := rooms[roomID]
+		prevRoom, sent := prev.rooms[roomID]
+		if room.membership == spec.Invite {
+			if !sent || prevRoom.membership != spec.Invite {
+				roomRes := &types.SlidingRoomResponse{
+					Initial:   true,
+					IsDM:      room.isDM,
+					BumpStamp: room.bumpStamp,
+				}
+				ir, err := types.NewInviteResponse(ctx, rp.rsAPI, room.invite, synctypes.FormatSync)
+				if err != nil {
+					return nil, fmt.Errorf("types.NewInviteResponse: %w", err)
+				}
+				roomRes.InviteState = ir.InviteState.Events
+				res.Rooms[roomID] = roomRes
+			}
+			state.rooms[roomID] = slidingRoomState{config: config, membership: spec.Invite, position: to}
+			continue
+		}
+		if sent && prevRoom.membership == spec.Join && prevRoom.config.Covers(config) {
+			f := fetch{from: prevRoom.position, limit: config.TimelineLimit}
+			if f.limit < 1 {
+				// We still need to know whether there are new events.
+				f.limit = 1
+			}
+			fetches[f] = append(fetches[f], roomID)
+		} else {
+			f := fetch{limit: config.TimelineLimit, initial: true}
+			fetches[f] = append(fetches[f], roomID)
+		}
+	}
+
+	for f, roomIDs := range fetches {
+		r := types.Range{From: f.from, To: to}
+		if f.initial {
+			r = types.Range{From: to, To: 0, Backwards: true}
+		}
+		var recentEvents map[string]types.RecentEvents
+		if f.limit > 0 {
+			filter := eventFilter
+			filter.Limit = f.limit
+			var err error
+			recentEvents, err = snapshot.RecentEvents(ctx, roomIDs, r, &filter, true, true)
+			if err != nil {
+				return nil, fmt.Errorf("snapshot.RecentEvents: %w", err)
+			}
+		}
+		for _, roomID := range roomIDs {
+			room, config := rooms[roomID], roomConfigs[roomID]
+			prevRoom := prev.rooms[roomID]
+			roomState := slidingRoomState{
+				config:            config,
+				membership:        spec.Join,
+				position:          to,
+				notificationCount: room.notificationCount,
+				highlightCount:    room.highlightCount,
+			}
+			if !f.initial {
+				// Keep the wider config, as the client still has the room
+				// data from it.
+				roomState.config = prevRoom.config
+			}
+			state.rooms[roomID] = roomState
+
+			countsChanged := room.notificationCount != prevRoom.notificationCount || room.highlightCount != prevRoom.highlightCount
+			if !f.initial && len(recentEvents[roomID].Events) == 0 && !countsChanged {
+				continue
+			}
+			roomRes, err := rp.slidingSyncRoom(req, snapshot, roomID, config, recentEvents[roomID], f.initial, since)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get room %s: %w", roomID, err)
+			}
+			roomRes.IsDM = room.isDM
+			roomRes.BumpStamp = room.bumpStamp
+			roomRes.NotificationCount = room.notificationCount
+			roomRes.HighlightCount = room.highlightCount
+			res.Rooms[roomID] = roomRes
+		}
+	}
+
+	// Let the client know about rooms it has left, so that it sees the leave
+	// event.
+	var leftRoomIDs []string
+	for roomID, prevRoom := range prev.rooms {
+		if _, ok := rooms[roomID]; ok {
+			continue
+		}
+		delete(state.rooms, roomID)
+		if prevRoom.membership != spec.Join {
+			continue
+		}
+		filter := eventFilter
+		filter.Limit = prevRoom.config.TimelineLimit
+		if filter.Limit < 1 {
+			filter.Limit = 1
+		}
+		recentEvents, err := snapshot.RecentEvents(ctx, []string{roomID}, types.Range{From: prevRoom.position, To: to}, &filter, true, true)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot.RecentEvents: %w", err)
+		}
+		roomRes, err := rp.slidingSyncRoom(req, snapshot, roomID, prevRoom.config, recentEvents[roomID], false, since)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get left room %s: %w", roomID, err)
+		}
+		res.Rooms[roomID] = roomRes
+		leftRoomIDs = append(leftRoomIDs, roomID)
+	}
+	return leftRoomIDs, nil
+}
+
+// slidingSyncRoom builds the response for a joined room from the given recent
+// events. Initial rooms include the full required state, otherwise only what
+// changed is included.
+func (rp *RequestPool) slidingSyncRoom(
+	req *slidingSyncRequest, snapshot storage.DatabaseTransaction,
+	roomID string, config types.SlidingRoomConfig, recent types.RecentEvents,
+	initial bool, since types.StreamPosition,
+) (*types.SlidingRoomResponse, error) {
+	ctx, device := req.ctx, req.device
+	roomRes := &types.SlidingRoomResponse{Initial: initial}
+	userIDForSender := func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		return rp.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+	}
+
+	streamEvents, limited := recent.Events, recent.Limited
+	if len(streamEvents) > config.TimelineLimit {
+		streamEvents = streamEvents[len(streamEvents)-config.TimelineLimit:]
+		limited = true
+	}
+	positions := make(map[string]types.StreamPosition, len(streamEvents))
+	for _, ev := range streamEvents {
+		positions[ev.EventID()] = ev.StreamPosition
+	}
+	recentEvents := snapshot.StreamEventsToEvents(ctx, device, streamEvents, rp.rsAPI)
+	events, err := streams.ApplyHistoryVisibilityFilter(ctx, snapshot, rp.rsAPI, roomID, device.UserID, recentEvents)
+	if err != nil {
+		return nil, fmt.Errorf("streams.ApplyHistoryVisibilityFilter: %w", err)
+	}
+	// If we are limited by the filter AND the history visibility filter
+	// didn't "remove" events, return that the response is limited.
+	roomRes.Limited = limited && len(events) == len(recentEvents)
+	for _, ev := range events {
+		if since > 0 && positions[ev.EventID()] > since {
+			roomRes.NumLive++
+		}
+	}
+
+	roomRes.Timeline = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(events), synctypes.FormatSync, userIDForSender)
+	if userID, err := spec.NewUserID(device.UserID, true); err == nil {
+		if err = internal.BundleThreadAggregations(ctx, snapshot, rp.rsAPI, *userID, roomID, roomRes.Timeline, synctypes.FormatSync); err != nil {
+			req.log.WithError(err).WithField("room_id", roomID).Warn("failed to bundle thread aggregations")
+		}
+	}
+
+	if len(events) > 0 && (initial || roomRes.Limited) {
+		event := events[0]
+		// If this is the beginning of the room, we can't go back further.
+		if event.Type() == spec.MRoomCreate && event.StateKeyEquals("") {
+			event = events[len(events)-1]
+		}
+		topologyPos, streamPos, err := snapshot.PositionInTopology(ctx, event.EventID())
+		if err != nil {
+			return nil, fmt.Errorf("snapshot.PositionInTopology: %w", err)
+		}
+		roomRes.PrevBatch = &types.TopologyToken{
+			Depth:       topologyPos,
+			PDUPosition: streamPos,
+		}
+		roomRes.PrevBatch.Decrement()
+	}
+
+	// Send the full required state if the client doesn't have it yet, or may
+	// have missed state changes because of a gap in the timeline. Otherwise
+	// the state changes are part of the timeline.
+	var stateEvents []*rstypes.HeaderedEvent
+	if (initial || roomRes.Limited) && len(config.RequiredState) > 0 {
+		filter := synctypes.DefaultStateFilter()
+		if eventTypes := config.RequiredState.Types(); eventTypes != nil {
+			filter.Types = &eventTypes
+		}
+		currentState, err := snapshot.CurrentState(ctx, roomID, &filter, nil)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot.CurrentState: %w", err)
+		}
+		for _, ev := range currentState {
+			if ev.StateKey() != nil && config.RequiredState.Matches(ev.Type(), *ev.StateKey(), device.UserID) {
+				stateEvents = append(stateEvents, ev)
+			}
+		}
+	}
+	if config.RequiredState.LazyMembers() {
+		members := make(map[string]struct{}, len(events))
+		for _, ev := range stateEvents {
+			if ev.Type() == spec.MRoomMember && ev.StateKey() != nil {
+				members[*ev.StateKey()] = struct{}{}
+			}
+		}
+		for _, ev := range events {
+			sender := string(ev.SenderID())
+			if _, ok := members[sender]; ok {
+				continue
+			}
+			members[sender] = struct{}{}
+			member, err := snapshot.GetStateEvent(ctx, roomID, spec.MRoomMember, sender)
+			if err != nil {
+				return nil, fmt.Errorf("snapshot.GetStateEvent: %w", err)
+			}
+			if member != nil {
+				stateEvents = append(stateEvents, member)
+			}
+		}
+	}
+	roomRes.RequiredState = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(stateEvents), synctypes.FormatSync, userIDForSender)
+
+	summaryChanged := initial
+	for _, ev := range events {
+		switch ev.Type() {
+		case spec.MRoomName, spec.MRoomAvatar, spec.MRoomCanonicalAlias, spec.MRoomMember:
+			summaryChanged = true
+		}
+	}
+	if summaryChanged {
+		if err = rp.addSlidingSyncRoomSummary(ctx, snapshot, device.UserID, roomID, roomRes); err != nil {
+			return nil, err
+		}
+	}
+	return roomRes, nil
+}
+
+// addSlidingSyncRoomSummary adds the name, avatar, heroes and member counts
+// of the room to the response.
+func (rp *RequestPool) addSlidingSyncRoomSummary(
+	ctx context.Context, snapshot storage.DatabaseTransaction,
+	userID, roomID string, roomRes *types.SlidingRoomResponse,
+) error {
+	filter := synctypes.DefaultStateFilter()
+	filter.Types = &[]string{spec.MRoomName, spec.MRoomAvatar}
+	stateEvents, err := snapshot.CurrentState(ctx, roomID, &filter, nil)
+	if err != nil {
+		return fmt.Errorf("snapshot.CurrentState: %w", err)
+	}
+	for _, ev := range stateEvents {
+		switch {
+		case ev.Type() == spec.MRoomName && ev.StateKeyEquals(""):
+			roomRes.Name = gjson.GetBytes(ev.Content(), "name").Str
+		case ev.Type() == spec.MRoomAvatar && ev.StateKeyEquals(""):
+			roomRes.Avatar = gjson.GetBytes(ev.Content(), "url").Str
+		}
+	}
+
+	summary, err := snapshot.GetRoomSummary(ctx, roomID, userID)
+	if err != nil {
+		return fmt.Errorf("snapshot.GetRoomSummary: %w", err)
+	}
+	roomRes.JoinedCount = summary.JoinedMemberCount
+	roomRes.InvitedCount = summary.InvitedMemberCount
+	for _, hero := range summary.Heroes {
+		h := types.SlidingRoomHero{UserID: hero}
+		member, err := snapshot.GetStateEvent(ctx, roomID, spec.MRoomMember, hero)
+		if err != nil {
+			return fmt.Errorf("snapshot.GetStateEvent: %w", err)
+		}
+		if member != nil {
+			h.DisplayName = gjson.GetBytes(member.Content(), "displayname").Str
+			h.AvatarURL = gjson.GetBytes(member.Content(), "avatar_url").Str
+		}
+		roomRes.Heroes = append(roomRes.Heroes, h)
+	}
+	return nil
+}
+
+// addSlidingSyncExtensions runs the stream providers for the enabled
+// extensions and adds their output to the response.
+func (rp *RequestPool) addSlidingSyncExtensions(
+	req *slidingSyncRequest, snapshot storage.DatabaseTransaction,
+	res *types.SlidingSyncResponse, state *slidingSyncState, since, to types.StreamingToken,
+	rooms map[string]*slidingRoom, leftRoomIDs []string, listRoomIDs map[string][]string,
+	ignores *types.IgnoredUsers,
+) {
+	ctx, ext := req.ctx, req.extensions
+	syncReq := &types.SyncRequest{
+		Context:           ctx,
+		Log:               req.log,
+		Device:            req.device,
+		Response:          types.NewResponse(),
+		Filter:            synctypes.DefaultFilter(),
+		Since:             since,
+		Rooms:             make(map[string]string),
+		MembershipChanges: make(map[string]struct{}),
+		IgnoredUsers:      *ignores,
+	}
+	if since.IsEmpty() {
+		syncReq.Filter.AccountData.Limit = math.MaxInt32
+		syncReq.Filter.Room.AccountData.Limit = math.MaxInt32
+	}
+	// The device list catchup looks at the memberships in the timelines to
+	// find users whose devices the client needs to track.
+	for roomID, roomRes := range res.Rooms {
+		if slices.Contains(leftRoomIDs, roomID) {
+			lr := types.NewLeaveResponse()
+			lr.Timeline.Events = roomRes.Timeline
+			syncReq.Response.Rooms.Leave[roomID] = lr
+		} else if rooms[roomID].membership == spec.Join {
+			jr := types.NewJoinResponse()
+			jr.Timeline.Events = roomRes.Timeline
+			syncReq.Response.Rooms.Join[roomID] = jr
+		}
+	}
+
+	scopes := map[*types.SlidingExtensionConfig]map[string]struct{}{}
+	for _, config := range []*types.SlidingExtensionConfig{ext.AccountData, ext.Receipts, ext.Typing} {
+		if !config.IsEnabled() {
+			continue
+		}
+		scopes[config] = extensionRooms(config, listRoomIDs, req.body.RoomSubscriptions, rooms)
+		for roomID := range scopes[config] {
+			if rooms[roomID].membership == spec.Join {
+				syncReq.Rooms[roomID] = spec.Join
+			}
+		}
+	}
+
+	if ext.ToDevice.IsEnabled() {
+		state.token.SendToDevicePosition = rp.streams.SendToDeviceStreamProvider.IncrementalSync(
+			ctx, snapshot, syncReq, req.toDeviceFrom(&slidingSyncState{token: since}), to.SendToDevicePosition,
+		)
+		res.Extensions.ToDevice = &types.SlidingToDeviceResponse{
+			NextBatch: strconv.FormatInt(int64(state.token.SendToDevicePosition), 10),
+			Events:    syncReq.Response.ToDevice.Events,
+		}
+		if res.Extensions.ToDevice.Events == nil {
+			res.Extensions.ToDevice.Events = []gomatrixserverlib.SendToDeviceEvent{}
+		}
+	}
+
+	if ext.E2EE.IsEnabled() {
+		state.token.DeviceListPosition = syncStream(ctx, snapshot, syncReq, rp.streams.DeviceListStreamProvider, since.DeviceListPosition, to.DeviceListPosition)
+		if since.DeviceListPosition == 0 {
+			// Complete syncs of the device list stream don't include the
+			// one-time key counts.
+			if err := internal.DeviceOTKCounts(ctx, rp.userAPI, req.device.UserID, req.device.ID, syncReq.Response); err != nil {
+				req.log.WithError(err).Warn("failed to get OTK counts")
+			}
+		}
+		e2ee := &types.SlidingE2EEResponse{
+			DeviceOneTimeKeysCount:       syncReq.Response.DeviceListsOTKCount,
+			DeviceUnusedFallbackKeyTypes: syncReq.Response.DeviceUnusedFallbackKeyTypes,
+		}
+		if deviceLists := syncReq.Response.DeviceLists; len(deviceLists.Changed) > 0 || len(deviceLists.Left) > 0 {
+			e2ee.DeviceLists = deviceLists
+		}
+		res.Extensions.E2EE = e2ee
+	}
+
+	if ext.AccountData.IsEnabled() {
+		state.token.AccountDataPosition = syncStream(ctx, snapshot, syncReq, rp.streams.AccountDataStreamProvider, since.AccountDataPosition, to.AccountDataPosition)
+		accountData := &types.SlidingAccountDataResponse{
+			Global: syncReq.Response.AccountData.Events,
+			Rooms:  map[string][]synctypes.ClientEvent{},
+		}
+		if accountData.Global == nil {
+			accountData.Global = []synctypes.ClientEvent{}
+		}
+		for roomID, jr := range syncReq.Response.Rooms.Join {
+			if _, ok := scopes[ext.AccountData][roomID]; ok && len(jr.AccountData.Events) > 0 {
+				accountData.Rooms[roomID] = jr.AccountData.Events
+			}
+		}
+		res.Extensions.AccountData = accountData
+	}
+
+	ephemeral := func(eventType string, scope map[string]struct{}) *types.SlidingEphemeralResponse {
+		ephemeralRes := &types.SlidingEphemeralResponse{Rooms: map[string]synctypes.ClientEvent{}}
+		for roomID, jr := range syncReq.Response.Rooms.Join {
+			if _, ok := scope[roomID]; !ok {
+				continue
+			}
+			for _, ev := range jr.Ephemeral.Events {
+				if ev.Type == eventType {
+					ev.RoomID = ""
+					ephemeralRes.Rooms[roomID] = ev
+				}
+			}
+		}
+		return ephemeralRes
+	}
+	if ext.Receipts.IsEnabled() {
+		state.token.ReceiptPosition = syncStream(ctx, snapshot, syncReq, rp.streams.ReceiptStreamProvider, since.ReceiptPosition, to.ReceiptPosition)
+		res.Extensions.Receipts = ephemeral(spec.MReceipt, scopes[ext.Receipts])
+	}
+	if ext.Typing.IsEnabled() {
+		state.token.TypingPosition = syncStream(ctx, snapshot, syncReq, rp.streams.TypingStreamProvider, since.TypingPosition, to.TypingPosition)
+		res.Extensions.Typing = ephemeral(spec.MTyping, scopes[ext.Typing])
+	}
+}
+
+// syncStream runs a complete sync of the stream if the client has no
+// position for it yet, or an incremental sync otherwise.
+func syncStream(
+	ctx context.Context, snapshot storage.DatabaseTransaction, req *types.SyncRequest,
+	provider streams.StreamProvider, from, to types.StreamPosition,
+) types.StreamPosition {
+	if from == 0 {
+		return provider.CompleteSync(ctx, snapshot, req)
+	}
+	return provider.IncrementalSync(ctx, snapshot, req, from, to)
+}
+
+// toDeviceFrom returns the position the to_device extension continues from.
+func (r *slidingSyncRequest) toDeviceFrom(state *slidingSyncState) types.StreamPosition {
+	if r.toDeviceSince != nil {
+		return *r.toDeviceSince
+	}
+	return state.token.SendToDevicePosition
+}
+
+// extensionRooms returns the rooms an extension returns data for. Without
+// any lists or rooms configured, all lists and room subscriptions are used.
+func extensionRooms(
+	config *types.SlidingExtensionConfig, listRoomIDs map[string][]string,
+	subscriptions map[string]types.SlidingRoomConfig, rooms map[string]*slidingRoom,
+) map[string]struct{} {
+	scope := map[string]struct{}{}
+	for name, roomIDs := range listRoomIDs {
+		if config.Lists == nil || slices.Contains(config.Lists, name) || slices.Contains(config.Lists, "*") {
+			for _, roomID := range roomIDs {
+				scope[roomID] = struct{}{}
+			}
+		}
+	}
+	for roomID := range subscriptions {
+		if _, ok := rooms[roomID]; !ok {
+			continue
+		}
+		if config.Rooms == nil || slices.Contains(config.Rooms, roomID) || slices.Contains(config.Rooms, "*") {
+			scope[roomID] = struct{}{}
+		}
+	}
+	return scope
+}
+
+// mergeSlidingExtensions applies the extension settings of a request on top
+// of the previous settings of the connection.
+func mergeSlidingExtensions(prev, next types.SlidingExtensionsRequest) types.SlidingExtensionsRequest {
+	merge := func(prev, next *types.SlidingExtensionConfig) *types.SlidingExtensionConfig {
+		if next == nil {
+			return prev
+		}
+		merged := *next
+		// The to_device since token only applies to a single request.
+		merged.Since = ""
+		if prev != nil {
+			if merged.Enabled == nil {
+				merged.Enabled = prev.Enabled
+			}
+			if merged.Lists == nil {
+				merged.Lists = prev.Lists
+			}
+			if merged.Rooms == nil {
+				merged.Rooms = prev.Rooms
+			}
+		}
+		return &merged
+	}
+	return types.SlidingExtensionsRequest{
+		ToDevice:    merge(prev.ToDevice, next.ToDevice),
+		E2EE:        merge(prev.E2EE, next.E2EE),
+		AccountData: merge(prev.AccountData, next.AccountData),
+		Receipts:    merge(prev.Receipts, next.Receipts),
+		Typing:      merge(prev.Typing, next.Typing),
+	}
+}
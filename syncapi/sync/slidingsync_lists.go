@@ -0,0 +1,250 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+
+	rstypes "github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/synctypes"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// slidingRoom is a room the user is joined or invited to, along with what is
+// needed to filter and sort the sliding sync lists.
+type slidingRoom struct {
+	roomID            string
+	membership        string
+	bumpStamp         types.StreamPosition
+	isDM              bool
+	notificationCount int
+	highlightCount    int
+	// The invite event, if the user is invited to the room.
+	invite *rstypes.HeaderedEvent
+
+	// Loaded on demand by loadState, as not every list needs them.
+	stateLoaded bool
+	name        string
+	encrypted   bool
+	roomType    *string
+}
+
+// loadState looks up the room name, encryption and room type. For invites,
+// the stripped state of the invite is used, as the server may not be in
+// the room.
+func (r *slidingRoom) loadState(ctx context.Context, snapshot storage.DatabaseTransaction) error {
+	if r.stateLoaded {
+		return nil
+	}
+	r.stateLoaded = true
+	var alias string
+	apply := func(eventType string, stateKey *string, content []byte) {
+		if stateKey == nil || *stateKey != "" {
+			return
+		}
+		switch eventType {
+		case spec.MRoomName:
+			r.name = gjson.GetBytes(content, "name").Str
+		case spec.MRoomCanonicalAlias:
+			alias = gjson.GetBytes(content, "alias").Str
+		case spec.MRoomEncryption:
+			r.encrypted = true
+		case spec.MRoomCreate:
+			if roomType := gjson.GetBytes(content, "type"); roomType.Type == gjson.String {
+				r.roomType = &roomType.Str
+			}
+		}
+	}
+
+	if r.invite != nil {
+		for _, ev := range gjson.GetBytes(r.invite.Unsigned(), "invite_room_state").Array() {
+			var stateKey *string
+			if sk := ev.Get("state_key"); sk.Exists() {
+				stateKey = &sk.Str
+			}
+			apply(ev.Get("type").Str, stateKey, []byte(ev.Get("content").Raw))
+		}
+	} else {
+		filter := synctypes.DefaultStateFilter()
+		filter.Types = &[]string{spec.MRoomName, spec.MRoomCanonicalAlias, spec.MRoomEncryption, spec.MRoomCreate}
+		stateEvents, err := snapshot.CurrentState(ctx, r.roomID, &filter, nil)
+		if err != nil {
+			return err
+		}
+		for _, ev := range stateEvents {
+			apply(ev.Type(), ev.StateKey(), ev.Content())
+		}
+	}
+	if r.name == "" {
+		r.name = alias
+	}
+	return nil
+}
+
+// slidingListFilter checks which rooms are part of a sliding sync list.
+type slidingListFilter struct {
+	ctx      context.Context
+	snapshot storage.DatabaseTransaction
+	// The tags of the user's rooms, only set if a list is filtered by tags.
+	tags map[string]map[string]struct{}
+}
+
+func (f *slidingListFilter) matches(room *slidingRoom, filters *types.SlidingListFilters) (bool, error) {
+	if filters == nil {
+		return true, nil
+	}
+	if filters.IsDM != nil && *filters.IsDM != room.isDM {
+		return false, nil
+	}
+	if filters.IsInvite != nil && *filters.IsInvite != (room.membership == spec.Invite) {
+		return false, nil
+	}
+	if filters.IsEncrypted != nil || filters.RoomTypes != nil || filters.NotRoomTypes != nil || filters.RoomNameLike != "" {
+		if err := room.loadState(f.ctx, f.snapshot); err != nil {
+			return false, err
+		}
+	}
+	if filters.IsEncrypted != nil && *filters.IsEncrypted != room.encrypted {
+		return false, nil
+	}
+	if filters.RoomTypes != nil && !matchesRoomType(room.roomType, filters.RoomTypes) {
+		return false, nil
+	}
+	if filters.NotRoomTypes != nil && matchesRoomType(room.roomType, filters.NotRoomTypes) {
+		return false, nil
+	}
+	if filters.RoomNameLike != "" && !strings.Contains(strings.ToLower(room.name), strings.ToLower(filters.RoomNameLike)) {
+		return false, nil
+	}
+	if len(filters.Tags) > 0 && !hasAnyTag(f.tags[room.roomID], filters.Tags) {
+		return false, nil
+	}
+	if len(filters.NotTags) > 0 && hasAnyTag(f.tags[room.roomID], filters.NotTags) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func matchesRoomType(roomType *string, roomTypes []*string) bool {
+	for _, t := range roomTypes {
+		switch {
+		case t == nil && roomType == nil:
+			return true
+		case t != nil && roomType != nil && *t == *roomType:
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyTag(tags map[string]struct{}, wanted []string) bool {
+	for _, tag := range wanted {
+		if _, ok := tags[tag]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// roomTags parses the m.tag room account data of the user.
+func roomTags(roomAccountData map[string]map[string]json.RawMessage) map[string]map[string]struct{} {
+	tags := make(map[string]map[string]struct{}, len(roomAccountData))
+	for roomID, data := range roomAccountData {
+		content, ok := data["m.tag"]
+		if !ok {
+			continue
+		}
+		tags[roomID] = make(map[string]struct{})
+		gjson.GetBytes(content, "tags").ForEach(func(key, _ gjson.Result) bool {
+			tags[roomID][key.Str] = struct{}{}
+			return true
+		})
+	}
+	return tags
+}
+
+// sortSlidingRooms sorts the rooms by the given sort orders. Rooms which are
+// equal by all of them are sorted by recency.
+func sortSlidingRooms(ctx context.Context, snapshot storage.DatabaseTransaction, rooms []*slidingRoom, sorts []string) error {
+	for _, s := range sorts {
+		if s != types.SlidingSortByName {
+			continue
+		}
+		for _, room := range rooms {
+			if err := room.loadState(ctx, snapshot); err != nil {
+				return err
+			}
+		}
+	}
+	sort.SliceStable(rooms, func(i, j int) bool {
+		a, b := rooms[i], rooms[j]
+		for _, s := range sorts {
+			switch s {
+			case types.SlidingSortByName:
+				if an, bn := strings.ToLower(a.name), strings.ToLower(b.name); an != bn {
+					// Rooms without a name go last.
+					if an == "" || bn == "" {
+						return bn == ""
+					}
+					return an < bn
+				}
+			case types.SlidingSortByNotificationLevel:
+				if (a.highlightCount > 0) != (b.highlightCount > 0) {
+					return a.highlightCount > 0
+				}
+				if (a.notificationCount > 0) != (b.notificationCount > 0) {
+					return a.notificationCount > 0
+				}
+			case types.SlidingSortByRecency:
+				if a.bumpStamp != b.bumpStamp {
+					return a.bumpStamp > b.bumpStamp
+				}
+			}
+		}
+		if a.bumpStamp != b.bumpStamp {
+			return a.bumpStamp > b.bumpStamp
+		}
+		return a.roomID < b.roomID
+	})
+	return nil
+}
+
+// windowRooms returns the IDs of the rooms in each of the windows. Windows
+// which go beyond the end of the list are cut short.
+func windowRooms(rooms []*slidingRoom, windows [][2]int) [][]string {
+	roomIDs := make([][]string, 0, len(windows))
+	for _, window := range windows {
+		start, end := window[0], window[1]
+		if start < 0 {
+			start = 0
+		}
+		if end >= len(rooms) {
+			end = len(rooms) - 1
+		}
+		ids := []string{}
+		for i := start; i <= end; i++ {
+			ids = append(ids, rooms[i].roomID)
+		}
+		roomIDs = append(roomIDs, ids)
+	}
+	return roomIDs
+}
@@ -16,6 +16,7 @@ package syncapi
 
 import (
 	"context"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/fulltext"
 	"github.com/matrix-org/dendrite/internal/httputil"
@@ -31,6 +32,7 @@ import (
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 
 	"github.com/matrix-org/dendrite/syncapi/consumers"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/notifier"
 	"github.com/matrix-org/dendrite/syncapi/producers"
 	"github.com/matrix-org/dendrite/syncapi/routing"
@@ -67,9 +69,14 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to load notifier ")
 	}
 
-	var fts *fulltext.Search
+	var fts fulltext.Indexer
 	if dendriteCfg.SyncAPI.Fulltext.Enabled {
-		fts, err = fulltext.New(processContext, dendriteCfg.SyncAPI.Fulltext)
+		switch dendriteCfg.SyncAPI.Fulltext.Backend {
+		case config.FulltextBackendPostgres:
+			fts, err = storage.NewFulltextIndex(processContext, cm, &dendriteCfg.SyncAPI.Database, dendriteCfg.SyncAPI.Fulltext)
+		default:
+			fts, err = fulltext.New(processContext, dendriteCfg.SyncAPI.Fulltext)
+		}
 		if err != nil {
 			logrus.WithError(err).Panicf("failed to create full text")
 		}
@@ -85,12 +92,19 @@ func AddPublicRoutes(
 		userAPI,
 	)
 
-	requestPool := sync.NewRequestPool(syncDB, &dendriteCfg.SyncAPI, userAPI, rsAPI, streams, notifier, federationPresenceProducer, presenceConsumer, enableMetrics)
+	requestPool := sync.NewRequestPool(processContext, syncDB, &dendriteCfg.SyncAPI, userAPI, rsAPI, streams, notifier, federationPresenceProducer, presenceConsumer, enableMetrics)
 
 	if err = presenceConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start presence consumer")
 	}
 
+	timestampToEventConsumer := consumers.NewTimestampToEventConsumer(
+		processContext, &dendriteCfg.SyncAPI, natsClient, syncDB, rsAPI,
+	)
+	if err = timestampToEventConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start timestamp to event consumer")
+	}
+
 	keyChangeConsumer := consumers.NewOutputKeyChangeEventConsumer(
 		processContext, &dendriteCfg.SyncAPI, dendriteCfg.Global.JetStream.Prefixed(jetstream.OutputKeyChangeEvent),
 		js, rsAPI, syncDB, notifier,
@@ -117,7 +131,7 @@ func AddPublicRoutes(
 
 	clientConsumer := consumers.NewOutputClientDataConsumer(
 		processContext, &dendriteCfg.SyncAPI, js, natsClient, syncDB, notifier,
-		streams.AccountDataStreamProvider, fts,
+		streams.AccountDataStreamProvider, streams.InviteStreamProvider, rsAPI, fts,
 	)
 	if err = clientConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start client data consumer")
@@ -151,7 +165,17 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start receipts consumer")
 	}
 
-	rateLimits := httputil.NewRateLimits(&dendriteCfg.ClientAPI.RateLimiting)
+	if dendriteCfg.SyncAPI.Retention.Enabled {
+		startPurgeExpiredEvents(processContext, &dendriteCfg.SyncAPI, syncDB, rsAPI, fts)
+	}
+
+	rateLimitStore, err := httputil.NewRateLimitStore(
+		dendriteCfg.ClientAPI.RateLimiting.Enabled, dendriteCfg.ClientAPI.RateLimiting.Backend, js, dendriteCfg.Global.JetStream.Prefixed(jetstream.RateLimits),
+	)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to set up rate limiting")
+	}
+	rateLimits := httputil.NewRateLimits(&dendriteCfg.ClientAPI.RateLimiting, rateLimitStore, userAPI)
 
 	routing.Setup(
 		routers.Client, requestPool, syncDB, userAPI,
@@ -159,3 +183,25 @@ func AddPublicRoutes(
 		rateLimits,
 	)
 }
+
+// startPurgeExpiredEvents periodically purges messages which have expired under
+// the retention policy of their room.
+func startPurgeExpiredEvents(
+	processContext *process.ProcessContext, cfg *config.SyncAPI, syncDB storage.Database,
+	rsAPI api.SyncRoomserverAPI, fts fulltext.Indexer,
+) {
+	var purgeExpiredEvents func()
+	purgeExpiredEvents = func() {
+		if processContext.Context().Err() != nil {
+			return
+		}
+		purged, err := internal.PurgeExpiredEvents(processContext.Context(), cfg, syncDB, rsAPI, fts)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to purge expired events")
+		} else if purged > 0 {
+			logrus.WithField("purged", purged).Info("Purged expired events")
+		}
+		time.AfterFunc(cfg.Retention.PurgeInterval, purgeExpiredEvents)
+	}
+	time.AfterFunc(time.Minute, purgeExpiredEvents)
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/synctypes"
 
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	rsapi "github.com/matrix-org/dendrite/roomserver/api"
@@ -116,6 +117,14 @@ func (s *syncUserAPI) PerformLastSeenUpdate(ctx context.Context, req *userapi.Pe
 	return nil
 }
 
+func (s *syncUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
+	return nil
+}
+
+func (s *syncUserAPI) QueryRateLimitOverride(ctx context.Context, userID string) (*userapi.RateLimitOverride, error) {
+	return nil, nil
+}
+
 func TestSyncAPIAccessTokens(t *testing.T) {
 	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
 		testSyncAccessTokens(t, dbType)
@@ -1176,7 +1185,7 @@ func testContext(t *testing.T, dbType test.DBType) {
 	room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "hello world 1!"})
 	room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "hello world 2!"})
 	thirdMsg := room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "hello world3!"})
-	room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "hello world4!"})
+	lastMsg := room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "hello world4!"})
 
 	if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
 		t.Fatalf("failed to send events: %v", err)
@@ -1187,7 +1196,7 @@ func testContext(t *testing.T, dbType test.DBType) {
 
 	syncUntil(t, routers, alice.AccessToken, false, func(syncBody string) bool {
 		// wait for the last sent eventID to come down sync
-		path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, room.ID, thirdMsg.EventID())
+		path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, room.ID, lastMsg.EventID())
 		return gjson.Get(syncBody, path).Exists()
 	})
 
@@ -1324,6 +1333,493 @@ func TestUpdateRelations(t *testing.T) {
 	})
 }
 
+func TestSlidingSync(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		testSlidingSync(t, dbType)
+	})
+}
+
+func testSlidingSync(t *testing.T, dbType test.DBType) {
+	user := test.NewUser(t)
+	room1 := test.NewRoom(t, user)
+	room1.CreateAndInsert(t, user, spec.MRoomName, map[string]interface{}{"name": "Room One"}, test.WithStateKey(""))
+	room2 := test.NewRoom(t, user)
+	alice := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      user.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+	routers := httputil.NewRouters()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+	natsInstance := jetstream.NATSInstance{}
+	defer close()
+
+	jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room1, room2}}, caches, caching.DisableMetrics)
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, cfg, room1.Events()...)...)
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, cfg, room2.Events()...)...)
+	syncUntil(t, routers, alice.AccessToken, false, func(syncBody string) bool {
+		path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, room2.ID, room2.Events()[len(room2.Events())-1].EventID())
+		return gjson.Get(syncBody, path).Exists()
+	})
+
+	slidingSync := func(pos, timeout string, wantCode int) gjson.Result {
+		t.Helper()
+		w := httptest.NewRecorder()
+		routers.Client.ServeHTTP(w, test.NewRequest(t, "POST", "/_matrix/client/unstable/org.matrix.simplified_msc3575/sync", test.WithQueryParams(map[string]string{
+			"access_token": alice.AccessToken,
+			"timeout":      timeout,
+			"pos":          pos,
+		}), test.WithJSONBody(t, map[string]interface{}{
+			"lists": map[string]interface{}{
+				"all": map[string]interface{}{
+					"ranges":         [][2]int{{0, 0}},
+					"timeline_limit": 1,
+					"required_state": [][2]string{{spec.MRoomName, ""}},
+				},
+			},
+		})))
+		if w.Code != wantCode {
+			t.Fatalf("got HTTP %d want %d: %s", w.Code, wantCode, w.Body.String())
+		}
+		return gjson.Parse(w.Body.String())
+	}
+
+	// The most recently active room is in the window.
+	res := slidingSync("", "0", http.StatusOK)
+	if count := res.Get("lists.all.count").Int(); count != 2 {
+		t.Fatalf("expected 2 rooms in the list, got %d", count)
+	}
+	if roomIDs := res.Get("lists.all.ops.0.room_ids").Array(); len(roomIDs) != 1 || roomIDs[0].Str != room2.ID {
+		t.Fatalf("expected only %s in the window, got %v", room2.ID, roomIDs)
+	}
+	roomRes := res.Get("rooms." + gjson.Escape(room2.ID))
+	if !roomRes.Get("initial").Bool() || !roomRes.Get("limited").Bool() {
+		t.Fatalf("expected an initial, limited room, got %s", roomRes.Raw)
+	}
+	if timeline := roomRes.Get("timeline.#.event_id").Array(); len(timeline) != 1 || timeline[0].Str != room2.Events()[len(room2.Events())-1].EventID() {
+		t.Fatalf("expected only the latest event in the timeline, got %v", timeline)
+	}
+	if res.Get("rooms." + gjson.Escape(room1.ID)).Exists() {
+		t.Fatalf("expected %s not to be in the response", room1.ID)
+	}
+
+	// Nothing happened since, so there is nothing new.
+	pos := res.Get("pos").Str
+	res = slidingSync(pos, "0", http.StatusOK)
+	if len(res.Get("rooms").Map()) > 0 || res.Get("lists.all.ops").Exists() {
+		t.Fatalf("expected no updates, got %s", res.Raw)
+	}
+
+	// A new message moves the other room into the window.
+	ev := room1.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "hello"})
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, cfg, ev)...)
+	res = slidingSync(res.Get("pos").Str, "5000", http.StatusOK)
+	if roomIDs := res.Get("lists.all.ops.0.room_ids").Array(); len(roomIDs) != 1 || roomIDs[0].Str != room1.ID {
+		t.Fatalf("expected only %s in the window, got %v", room1.ID, roomIDs)
+	}
+	roomRes = res.Get("rooms." + gjson.Escape(room1.ID))
+	if timeline := roomRes.Get("timeline.#.event_id").Array(); len(timeline) != 1 || timeline[0].Str != ev.EventID() {
+		t.Fatalf("expected the new message in the timeline, got %v", timeline)
+	}
+	if name := roomRes.Get("name").Str; name != "Room One" {
+		t.Fatalf("expected the room name, got %q", name)
+	}
+	if eventType := roomRes.Get("required_state.0.type").Str; eventType != spec.MRoomName {
+		t.Fatalf("expected the room name in the required state, got %s", roomRes.Get("required_state").Raw)
+	}
+
+	// Old positions can be retried, unknown ones can't.
+	slidingSync(pos, "0", http.StatusOK)
+	res = slidingSync("1000", "0", http.StatusBadRequest)
+	if errcode := res.Get("errcode").Str; errcode != "M_UNKNOWN_POS" {
+		t.Fatalf("expected M_UNKNOWN_POS, got %s", errcode)
+	}
+}
+
+func TestIgnoredUsers(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		testIgnoredUsers(t, dbType)
+	})
+}
+
+func testIgnoredUsers(t *testing.T, dbType test.DBType) {
+	user := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, user, test.RoomHistoryVisibility(gomatrixserverlib.HistoryVisibilityWorldReadable))
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+	bobMsg := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "hello from bob"})
+	userMsg := room.CreateAndInsert(t, user, "m.room.message", map[string]interface{}{"body": "hello from alice"})
+	inviteRoom := test.NewRoom(t, bob)
+	invite := inviteRoom.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Invite}, test.WithStateKey(user.ID))
+	alice := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      user.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+	routers := httputil.NewRouters()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+	natsInstance := jetstream.NATSInstance{}
+	defer close()
+
+	jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room, inviteRoom}}, caches, caching.DisableMetrics)
+	testrig.MustPublishMsgs(t, jsctx, toNATSMsgs(t, cfg, room.Events()...)...)
+	testrig.MustPublishMsgs(t, jsctx, testrig.NewOutputEventMsg(t, cfg, inviteRoom.ID, api.OutputEvent{
+		Type: rsapi.OutputTypeNewInviteEvent,
+		NewInviteEvent: &rsapi.OutputNewInviteEvent{
+			Event:       invite,
+			RoomVersion: inviteRoom.Version,
+		},
+	}))
+
+	var since string
+	syncUntil(t, routers, alice.AccessToken, false, func(syncBody string) bool {
+		since = gjson.Get(syncBody, "next_batch").Str
+		path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, room.ID, userMsg.EventID())
+		return gjson.Get(syncBody, path).Exists() && gjson.Get(syncBody, "rooms.invite."+gjson.Escape(inviteRoom.ID)).Exists()
+	})
+
+	// Alice ignores Bob
+	msg := nats.NewMsg(cfg.Global.JetStream.Prefixed(jetstream.OutputClientData))
+	msg.Header.Set(jetstream.UserID, alice.UserID)
+	var err error
+	msg.Data, err = json.Marshal(eventutil.AccountData{
+		Type:         "m.ignored_user_list",
+		IgnoredUsers: &types.IgnoredUsers{List: map[string]interface{}{bob.ID: struct{}{}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testrig.MustPublishMsgs(t, jsctx, msg)
+
+	// The invite of Bob is retired, so clients which already have it remove it.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		routers.Client.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+			"access_token": alice.AccessToken,
+			"since":        since,
+			"timeout":      "1000",
+		})))
+		if gjson.Get(w.Body.String(), "rooms.leave."+gjson.Escape(inviteRoom.ID)).Exists() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the invite to be retired: %s", w.Body.String())
+		}
+	}
+
+	// Bob's messages are hidden from now on.
+	syncUntil(t, routers, alice.AccessToken, false, func(syncBody string) bool {
+		timeline := gjson.Get(syncBody, fmt.Sprintf("rooms.join.%s.timeline.events.#.event_id", gjson.Escape(room.ID))).Array()
+		for _, eventID := range timeline {
+			if eventID.Str == bobMsg.EventID() {
+				return false
+			}
+		}
+		return len(timeline) > 0 && !gjson.Get(syncBody, "rooms.invite."+gjson.Escape(inviteRoom.ID)).Exists()
+	})
+	w := httptest.NewRecorder()
+	routers.Client.ServeHTTP(w, test.NewRequest(t, "GET", fmt.Sprintf("/_matrix/client/v3/rooms/%s/messages", room.ID), test.WithQueryParams(map[string]string{
+		"access_token": alice.AccessToken,
+		"dir":          "b",
+	})))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var res struct {
+		Chunk []synctypes.ClientEvent `json:"chunk"`
+	}
+	if err = json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response body: %s", err)
+	}
+	verifyEventVisible(t, false, bobMsg, res.Chunk)
+	verifyEventVisible(t, true, userMsg, res.Chunk)
+}
+
+func TestThreads(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		testThreads(t, dbType)
+	})
+}
+
+func testThreads(t *testing.T, dbType test.DBType) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	aliceDev := userapi.Device{ID: "ALICEID", UserID: alice.ID, AccessToken: "ALICE_BEARER_TOKEN", AccountType: userapi.AccountTypeUser}
+	bobDev := userapi.Device{ID: "BOBID", UserID: bob.ID, AccessToken: "BOB_BEARER_TOKEN", AccountType: userapi.AccountTypeUser}
+
+	cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+	cfg.ClientAPI.RateLimiting = config.RateLimiting{Enabled: false}
+	routers := httputil.NewRouters()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+	defer close()
+	natsInstance := jetstream.NATSInstance{}
+	jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
+
+	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+	rsAPI.SetFederationAPI(nil, nil)
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, caches, caching.DisableMetrics)
+
+	// Bob sees the thread root, but leaves before Alice replies to it.
+	room := test.NewRoom(t, alice, test.RoomHistoryVisibility(gomatrixserverlib.HistoryVisibilityJoined))
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+	root := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "thread root"})
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Leave}, test.WithStateKey(bob.ID))
+	reply := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{
+		"body": "secret reply",
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.thread",
+			"event_id": root.EventID(),
+		},
+	})
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+		t.Fatalf("failed to send events: %v", err)
+	}
+	syncUntil(t, routers, aliceDev.AccessToken, false, func(syncBody string) bool {
+		path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, gjson.Escape(room.ID), reply.EventID())
+		return gjson.Get(syncBody, path).Exists()
+	})
+
+	threads := func(t *testing.T, accessToken string, params map[string]string) []gjson.Result {
+		t.Helper()
+		query := map[string]string{"access_token": accessToken}
+		for k, v := range params {
+			query[k] = v
+		}
+		w := httptest.NewRecorder()
+		routers.Client.ServeHTTP(w, test.NewRequest(t, "GET", fmt.Sprintf("/_matrix/client/v1/rooms/%s/threads", room.ID), test.WithQueryParams(query)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		return gjson.Get(w.Body.String(), "chunk").Array()
+	}
+
+	t.Run("threads include the latest reply", func(t *testing.T) {
+		chunk := threads(t, aliceDev.AccessToken, nil)
+		if len(chunk) != 1 || chunk[0].Get("event_id").Str != root.EventID() {
+			t.Fatalf("expected the thread root, got %v", chunk)
+		}
+		thread := chunk[0].Get(`unsigned.m\.relations.m\.thread`)
+		if thread.Get("latest_event.event_id").Str != reply.EventID() || thread.Get("count").Int() != 1 || !thread.Get("current_user_participated").Bool() {
+			t.Fatalf("unexpected thread aggregation: %s", thread.Raw)
+		}
+	})
+
+	t.Run("replies the user can't see are not bundled", func(t *testing.T) {
+		chunk := threads(t, bobDev.AccessToken, nil)
+		if len(chunk) != 1 || chunk[0].Get("event_id").Str != root.EventID() {
+			t.Fatalf("expected the thread root, got %v", chunk)
+		}
+		if thread := chunk[0].Get(`unsigned.m\.relations.m\.thread`); thread.Exists() {
+			t.Fatalf("expected the thread aggregation to be hidden, got %s", thread.Raw)
+		}
+	})
+
+	t.Run("only participated threads", func(t *testing.T) {
+		if chunk := threads(t, bobDev.AccessToken, map[string]string{"include": "participated"}); len(chunk) != 0 {
+			t.Fatalf("expected no threads, got %v", chunk)
+		}
+		if chunk := threads(t, aliceDev.AccessToken, map[string]string{"include": "participated"}); len(chunk) != 1 {
+			t.Fatalf("expected the thread, got %v", chunk)
+		}
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		for _, params := range []map[string]string{{"include": "mine"}, {"limit": "-1"}, {"from": "abc"}} {
+			query := map[string]string{"access_token": aliceDev.AccessToken}
+			for k, v := range params {
+				query[k] = v
+			}
+			w := httptest.NewRecorder()
+			routers.Client.ServeHTTP(w, test.NewRequest(t, "GET", fmt.Sprintf("/_matrix/client/v1/rooms/%s/threads", room.ID), test.WithQueryParams(query)))
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected HTTP 400 for %v, got %d", params, w.Code)
+			}
+		}
+	})
+}
+
+func TestTimestampToEvent(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		testTimestampToEvent(t, dbType)
+	})
+}
+
+func testTimestampToEvent(t *testing.T, dbType test.DBType) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	aliceDev := userapi.Device{ID: "ALICEID", UserID: alice.ID, AccessToken: "ALICE_BEARER_TOKEN", AccountType: userapi.AccountTypeUser}
+
+	cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+	routers := httputil.NewRouters()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+	defer close()
+	natsInstance := jetstream.NATSInstance{}
+	jsctx, natsClient := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
+
+	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+	rsAPI.SetFederationAPI(nil, nil)
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{aliceDev}}, rsAPI, caches, caching.DisableMetrics)
+
+	// Bob joins after the message was sent, so can't see it.
+	room := test.NewRoom(t, alice, test.RoomHistoryVisibility(gomatrixserverlib.HistoryVisibilityJoined))
+	now := time.Now()
+	msgEv := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "before bob joined"}, test.WithTimestamp(now.Add(time.Second)))
+	joinEv := room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID), test.WithTimestamp(now.Add(2*time.Second)))
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+		t.Fatalf("failed to send events: %v", err)
+	}
+	syncUntil(t, routers, aliceDev.AccessToken, false, func(syncBody string) bool {
+		path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, gjson.Escape(room.ID), joinEv.EventID())
+		return gjson.Get(syncBody, path).Exists()
+	})
+
+	eventAt := func(t *testing.T, userID string, ts spec.Timestamp) string {
+		t.Helper()
+		msg := nats.NewMsg(cfg.Global.JetStream.Prefixed(jetstream.RequestTimestampToEvent))
+		msg.Header.Set(jetstream.RoomID, room.ID)
+		if userID != "" {
+			msg.Header.Set(jetstream.UserID, userID)
+		}
+		msg.Header.Set("ts", fmt.Sprintf("%d", ts))
+		msg.Header.Set("dir", "b")
+		reply, err := natsClient.RequestMsg(msg, time.Second*10)
+		if err != nil {
+			t.Fatalf("failed to request event at timestamp: %s", err)
+		}
+		if e := reply.Header.Get("error"); e != "" {
+			t.Fatalf("failed to find event at timestamp: %s", e)
+		}
+		return reply.Header.Get(jetstream.EventID)
+	}
+
+	ts := msgEv.OriginServerTS()
+	if eventID := eventAt(t, alice.ID, ts); eventID != msgEv.EventID() {
+		t.Fatalf("expected %s to be returned to alice, got %q", msgEv.EventID(), eventID)
+	}
+	if eventID := eventAt(t, "", ts); eventID != msgEv.EventID() {
+		t.Fatalf("expected %s to be returned without a user, got %q", msgEv.EventID(), eventID)
+	}
+	if eventID := eventAt(t, bob.ID, ts); eventID != "" {
+		t.Fatalf("expected no event to be returned to bob, got %q", eventID)
+	}
+}
+
+func TestKnockSync(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		testKnockSync(t, dbType)
+	})
+}
+
+func testKnockSync(t *testing.T, dbType test.DBType) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	bobDev := userapi.Device{ID: "BOBID", UserID: bob.ID, AccessToken: "BOB_BEARER_TOKEN", AccountType: userapi.AccountTypeUser}
+
+	cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+	routers := httputil.NewRouters()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+	defer close()
+	natsInstance := jetstream.NATSInstance{}
+	jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
+
+	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+	rsAPI.SetFederationAPI(nil, nil)
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{bobDev}}, rsAPI, caches, caching.DisableMetrics)
+
+	// Bob knocks on a room, keeping the stripped state of the room.
+	room := test.NewRoom(t, alice, test.RoomVersion(gomatrixserverlib.RoomVersionV10), test.RoomPreset(test.PresetPrivateChat))
+	room.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{"join_rule": spec.Knock}, test.WithStateKey(""))
+	knockEv := room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Knock}, test.WithStateKey(bob.ID), test.WithUnsigned(map[string]interface{}{
+		"knock_room_state": []map[string]interface{}{
+			{"type": spec.MRoomJoinRules, "state_key": "", "sender": alice.ID, "content": map[string]interface{}{"join_rule": spec.Knock}},
+		},
+	}))
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+		t.Fatalf("failed to send events: %v", err)
+	}
+
+	knockState := fmt.Sprintf(`rooms.knock.%s.knock_state.events`, gjson.Escape(room.ID))
+	checkKnockState := func(t *testing.T, syncBody string) {
+		t.Helper()
+		events := gjson.Get(syncBody, knockState).Array()
+		if len(events) != 2 || events[0].Get("type").Str != spec.MRoomJoinRules || events[1].Get("event_id").Str != knockEv.EventID() {
+			t.Fatalf("unexpected knock state: %s", gjson.Get(syncBody, knockState).Raw)
+		}
+		if gjson.Get(syncBody, fmt.Sprintf(`rooms.join.%s`, gjson.Escape(room.ID))).Exists() {
+			t.Fatalf("expected the room not to be joined")
+		}
+	}
+
+	var since string
+	syncUntil(t, routers, bobDev.AccessToken, false, func(syncBody string) bool {
+		since = gjson.Get(syncBody, "next_batch").Str
+		return gjson.Get(syncBody, knockState).Exists()
+	})
+
+	sync := func(t *testing.T, since string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		routers.Client.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+			"access_token": bobDev.AccessToken,
+			"timeout":      "0",
+			"since":        since,
+		})))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	t.Run("initial sync includes knocked rooms", func(t *testing.T) {
+		checkKnockState(t, sync(t, ""))
+	})
+
+	t.Run("rejected knocks leave the room", func(t *testing.T) {
+		room.CreateAndInsert(t, alice, spec.MRoomMember, map[string]interface{}{"membership": spec.Leave}, test.WithStateKey(bob.ID))
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events()[len(room.Events())-1:], "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		// The membership can be visible before the notifier has advanced the
+		// stream position, so wait for the leave to reach incremental syncs.
+		leftRoom := fmt.Sprintf(`rooms.leave.%s`, gjson.Escape(room.ID))
+		syncBody := sync(t, since)
+		for deadline := time.Now().Add(time.Second * 5); !gjson.Get(syncBody, leftRoom).Exists() && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond * 10)
+			syncBody = sync(t, since)
+		}
+		if gjson.Get(syncBody, knockState).Exists() {
+			t.Fatalf("expected the knock to be gone, got %s", syncBody)
+		}
+		if !gjson.Get(syncBody, leftRoom).Exists() {
+			t.Fatalf("expected the room to be left, got %s", syncBody)
+		}
+	})
+}
+
 func syncUntil(t *testing.T,
 	routers httputil.Routers, accessToken string,
 	skip bool,
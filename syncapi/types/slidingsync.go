@@ -0,0 +1,295 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/syncapi/synctypes"
+)
+
+// Sort orders of sliding sync lists.
+const (
+	SlidingSortByRecency           = "by_recency"
+	SlidingSortByName              = "by_name"
+	SlidingSortByNotificationLevel = "by_notification_level"
+)
+
+// Wildcards which may be used in the required_state of sliding sync requests.
+const (
+	RequiredStateWildcard = "*"
+	RequiredStateMe       = "$ME"
+	RequiredStateLazy     = "$LAZY"
+)
+
+// SlidingSyncRequest is the body of a sliding sync request, as per MSC3575
+// and its simplified version MSC4186.
+type SlidingSyncRequest struct {
+	ConnID            string                       `json:"conn_id,omitempty"`
+	Lists             map[string]SlidingListConfig `json:"lists,omitempty"`
+	RoomSubscriptions map[string]SlidingRoomConfig `json:"room_subscriptions,omitempty"`
+	Extensions        SlidingExtensionsRequest     `json:"extensions"`
+}
+
+// RequiredState is a list of [event type, state key] pairs.
+type RequiredState [][2]string
+
+// Matches returns whether a state event with the given type and state key
+// was requested. Lazy-loaded memberships are not matched.
+func (r RequiredState) Matches(eventType, stateKey, userID string) bool {
+	for _, s := range r {
+		if s[0] != RequiredStateWildcard && s[0] != eventType {
+			continue
+		}
+		switch s[1] {
+		case RequiredStateWildcard, stateKey:
+			return true
+		case RequiredStateMe:
+			if stateKey == userID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LazyMembers returns whether the memberships of the timeline senders
+// were requested.
+func (r RequiredState) LazyMembers() bool {
+	for _, s := range r {
+		if s[0] == spec.MRoomMember && s[1] == RequiredStateLazy {
+			return true
+		}
+	}
+	return false
+}
+
+// Types returns the requested event types, or nil if all types were
+// requested.
+func (r RequiredState) Types() []string {
+	types := make([]string, 0, len(r))
+	for _, s := range r {
+		if s[0] == RequiredStateWildcard {
+			return nil
+		}
+		types = append(types, s[0])
+	}
+	return types
+}
+
+// SlidingRoomConfig describes what to return for a room.
+type SlidingRoomConfig struct {
+	RequiredState RequiredState `json:"required_state,omitempty"`
+	TimelineLimit int           `json:"timeline_limit,omitempty"`
+}
+
+// Combine returns the config to use for a room matched by both configs.
+func (c SlidingRoomConfig) Combine(other SlidingRoomConfig) SlidingRoomConfig {
+	combined := SlidingRoomConfig{
+		RequiredState: make(RequiredState, 0, len(c.RequiredState)+len(other.RequiredState)),
+		TimelineLimit: c.TimelineLimit,
+	}
+	if other.TimelineLimit > combined.TimelineLimit {
+		combined.TimelineLimit = other.TimelineLimit
+	}
+	seen := make(map[[2]string]struct{}, cap(combined.RequiredState))
+	for _, s := range append(append(RequiredState{}, c.RequiredState...), other.RequiredState...) {
+		if _, ok := seen[s]; !ok {
+			seen[s] = struct{}{}
+			combined.RequiredState = append(combined.RequiredState, s)
+		}
+	}
+	return combined
+}
+
+// Covers returns whether everything requested by the other config was
+// already requested by this config.
+func (c SlidingRoomConfig) Covers(other SlidingRoomConfig) bool {
+	if other.TimelineLimit > c.TimelineLimit {
+		return false
+	}
+	requested := make(map[[2]string]struct{}, len(c.RequiredState))
+	for _, s := range c.RequiredState {
+		requested[s] = struct{}{}
+	}
+	for _, s := range other.RequiredState {
+		if _, ok := requested[s]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// SlidingListConfig describes a list of rooms.
+type SlidingListConfig struct {
+	SlidingRoomConfig
+	// Ranges are the windows of the list to return rooms for. Both ends
+	// are inclusive. MSC4186 uses a single range instead.
+	Ranges  [][2]int            `json:"ranges,omitempty"`
+	Range   *[2]int             `json:"range,omitempty"`
+	Sort    []string            `json:"sort,omitempty"`
+	Filters *SlidingListFilters `json:"filters,omitempty"`
+}
+
+// Windows returns the requested windows of the list.
+func (c SlidingListConfig) Windows() [][2]int {
+	if c.Range != nil {
+		return append([][2]int{*c.Range}, c.Ranges...)
+	}
+	return c.Ranges
+}
+
+// SlidingListFilters restrict which rooms are part of a list.
+type SlidingListFilters struct {
+	IsDM        *bool `json:"is_dm,omitempty"`
+	IsEncrypted *bool `json:"is_encrypted,omitempty"`
+	IsInvite    *bool `json:"is_invite,omitempty"`
+	// A nil entry matches rooms without a room type.
+	RoomTypes    []*string `json:"room_types,omitempty"`
+	NotRoomTypes []*string `json:"not_room_types,omitempty"`
+	RoomNameLike string    `json:"room_name_like,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+	NotTags      []string  `json:"not_tags,omitempty"`
+}
+
+// SlidingExtensionsRequest enables extensions for the connection. Extensions
+// which are left out keep their previous settings.
+type SlidingExtensionsRequest struct {
+	ToDevice    *SlidingExtensionConfig `json:"to_device,omitempty"`
+	E2EE        *SlidingExtensionConfig `json:"e2ee,omitempty"`
+	AccountData *SlidingExtensionConfig `json:"account_data,omitempty"`
+	Receipts    *SlidingExtensionConfig `json:"receipts,omitempty"`
+	Typing      *SlidingExtensionConfig `json:"typing,omitempty"`
+}
+
+// SlidingExtensionConfig configures a single extension.
+type SlidingExtensionConfig struct {
+	Enabled *bool `json:"enabled,omitempty"`
+	// The lists and room subscriptions to return room data for. All of them
+	// are used if neither is set. "*" matches all lists or subscriptions.
+	Lists []string `json:"lists,omitempty"`
+	Rooms []string `json:"rooms,omitempty"`
+	// Since is the next_batch of the previous to_device response.
+	Since string `json:"since,omitempty"`
+}
+
+// IsEnabled returns whether the extension is enabled.
+func (c *SlidingExtensionConfig) IsEnabled() bool {
+	return c != nil && c.Enabled != nil && *c.Enabled
+}
+
+// SlidingSyncResponse is the response to a sliding sync request.
+type SlidingSyncResponse struct {
+	Pos        string                          `json:"pos"`
+	Lists      map[string]SlidingListResponse  `json:"lists"`
+	Rooms      map[string]*SlidingRoomResponse `json:"rooms"`
+	Extensions SlidingExtensionsResponse       `json:"extensions"`
+}
+
+// HasUpdates returns whether the response contains anything the client
+// doesn't know about yet.
+func (r *SlidingSyncResponse) HasUpdates() bool {
+	if len(r.Rooms) > 0 {
+		return true
+	}
+	for _, list := range r.Lists {
+		if len(list.Ops) > 0 {
+			return true
+		}
+	}
+	return r.Extensions.HasUpdates()
+}
+
+type SlidingListResponse struct {
+	Count int             `json:"count"`
+	Ops   []SlidingListOp `json:"ops,omitempty"`
+}
+
+// SlidingListOp tells MSC3575 clients which rooms are in a window of the
+// list. Only SYNC operations are sent.
+type SlidingListOp struct {
+	Op      string   `json:"op"`
+	Range   [2]int   `json:"range"`
+	RoomIDs []string `json:"room_ids"`
+}
+
+// SlidingRoomResponse contains the data of a room in a sliding sync response.
+type SlidingRoomResponse struct {
+	Name              string                  `json:"name,omitempty"`
+	Avatar            string                  `json:"avatar,omitempty"`
+	Heroes            []SlidingRoomHero       `json:"heroes,omitempty"`
+	Initial           bool                    `json:"initial,omitempty"`
+	IsDM              bool                    `json:"is_dm,omitempty"`
+	InviteState       []json.RawMessage       `json:"invite_state,omitempty"`
+	RequiredState     []synctypes.ClientEvent `json:"required_state,omitempty"`
+	Timeline          []synctypes.ClientEvent `json:"timeline,omitempty"`
+	PrevBatch         *TopologyToken          `json:"prev_batch,omitempty"`
+	Limited           bool                    `json:"limited,omitempty"`
+	NumLive           int                     `json:"num_live,omitempty"`
+	JoinedCount       *int                    `json:"joined_count,omitempty"`
+	InvitedCount      *int                    `json:"invited_count,omitempty"`
+	NotificationCount int                     `json:"notification_count"`
+	HighlightCount    int                     `json:"highlight_count"`
+	BumpStamp         StreamPosition          `json:"bump_stamp,omitempty"`
+}
+
+type SlidingRoomHero struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type SlidingExtensionsResponse struct {
+	ToDevice    *SlidingToDeviceResponse    `json:"to_device,omitempty"`
+	E2EE        *SlidingE2EEResponse        `json:"e2ee,omitempty"`
+	AccountData *SlidingAccountDataResponse `json:"account_data,omitempty"`
+	Receipts    *SlidingEphemeralResponse   `json:"receipts,omitempty"`
+	Typing      *SlidingEphemeralResponse   `json:"typing,omitempty"`
+}
+
+// HasUpdates returns whether any of the extensions returned data. The
+// one-time key counts are ignored, as they are always included.
+func (r *SlidingExtensionsResponse) HasUpdates() bool {
+	return (r.ToDevice != nil && len(r.ToDevice.Events) > 0) ||
+		(r.E2EE != nil && r.E2EE.DeviceLists != nil) ||
+		(r.AccountData != nil && (len(r.AccountData.Global) > 0 || len(r.AccountData.Rooms) > 0)) ||
+		(r.Receipts != nil && len(r.Receipts.Rooms) > 0) ||
+		(r.Typing != nil && len(r.Typing.Rooms) > 0)
+}
+
+type SlidingToDeviceResponse struct {
+	NextBatch string                                `json:"next_batch"`
+	Events    []gomatrixserverlib.SendToDeviceEvent `json:"events"`
+}
+
+type SlidingE2EEResponse struct {
+	DeviceLists                  *DeviceLists   `json:"device_lists,omitempty"`
+	DeviceOneTimeKeysCount       map[string]int `json:"device_one_time_keys_count"`
+	DeviceUnusedFallbackKeyTypes []string       `json:"device_unused_fallback_key_types"`
+}
+
+type SlidingAccountDataResponse struct {
+	Global []synctypes.ClientEvent            `json:"global"`
+	Rooms  map[string][]synctypes.ClientEvent `json:"rooms"`
+}
+
+// SlidingEphemeralResponse contains the receipts or typing notifications,
+// keyed by room ID.
+type SlidingEphemeralResponse struct {
+	Rooms map[string]synctypes.ClientEvent `json:"rooms"`
+}
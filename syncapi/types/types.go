@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -348,6 +349,7 @@ type DeviceLists struct {
 type RoomsResponse struct {
 	Join   map[string]*JoinResponse   `json:"join,omitempty"`
 	Invite map[string]*InviteResponse `json:"invite,omitempty"`
+	Knock  map[string]*KnockResponse  `json:"knock,omitempty"`
 	Leave  map[string]*LeaveResponse  `json:"leave,omitempty"`
 }
 
@@ -364,6 +366,9 @@ type Response struct {
 	ToDevice            *ToDeviceResponse `json:"to_device,omitempty"`
 	DeviceLists         *DeviceLists      `json:"device_lists,omitempty"`
 	DeviceListsOTKCount map[string]int    `json:"device_one_time_keys_count,omitempty"`
+	// Clients treat a missing field as the server not supporting fallback keys,
+	// so this is always included.
+	DeviceUnusedFallbackKeyTypes []string `json:"device_unused_fallback_key_types"`
 }
 
 func (r Response) MarshalJSON() ([]byte, error) {
@@ -381,7 +386,7 @@ func (r Response) MarshalJSON() ([]byte, error) {
 		}
 	}
 	if r.Rooms != nil {
-		if len(r.Rooms.Join) == 0 && len(r.Rooms.Invite) == 0 && len(r.Rooms.Leave) == 0 {
+		if len(r.Rooms.Join) == 0 && len(r.Rooms.Invite) == 0 && len(r.Rooms.Knock) == 0 && len(r.Rooms.Leave) == 0 {
 			a.Rooms = nil
 		}
 	}
@@ -392,10 +397,11 @@ func (r Response) MarshalJSON() ([]byte, error) {
 }
 
 func (r *Response) HasUpdates() bool {
-	// purposefully exclude DeviceListsOTKCount as we always include them
+	// purposefully exclude DeviceListsOTKCount and DeviceUnusedFallbackKeyTypes as we always include them
 	return (len(r.AccountData.Events) > 0 ||
 		len(r.Presence.Events) > 0 ||
 		len(r.Rooms.Invite) > 0 ||
+		len(r.Rooms.Knock) > 0 ||
 		len(r.Rooms.Join) > 0 ||
 		len(r.Rooms.Leave) > 0 ||
 		len(r.ToDevice.Events) > 0 ||
@@ -411,6 +417,7 @@ func NewResponse() *Response {
 	res.Rooms = &RoomsResponse{
 		Join:   map[string]*JoinResponse{},
 		Invite: map[string]*InviteResponse{},
+		Knock:  map[string]*KnockResponse{},
 		Leave:  map[string]*LeaveResponse{},
 	}
 
@@ -423,6 +430,7 @@ func NewResponse() *Response {
 	res.DeviceLists = &DeviceLists{}
 	res.ToDevice = &ToDeviceResponse{}
 	res.DeviceListsOTKCount = map[string]int{}
+	res.DeviceUnusedFallbackKeyTypes = []string{}
 
 	return &res
 }
@@ -432,6 +440,7 @@ func NewResponse() *Response {
 func (r *Response) IsEmpty() bool {
 	return len(r.Rooms.Join) == 0 &&
 		len(r.Rooms.Invite) == 0 &&
+		len(r.Rooms.Knock) == 0 &&
 		len(r.Rooms.Leave) == 0 &&
 		len(r.AccountData.Events) == 0 &&
 		len(r.Presence.Events) == 0 &&
@@ -467,6 +476,10 @@ type JoinResponse struct {
 	Ephemeral            *ClientEvents `json:"ephemeral,omitempty"`
 	AccountData          *ClientEvents `json:"account_data,omitempty"`
 	*UnreadNotifications `json:"unread_notifications,omitempty"`
+	// UnreadThreadNotifications contains the unread counts for each thread,
+	// keyed by thread root event ID. Only populated if the client requested
+	// it using the unread_thread_notifications filter option.
+	UnreadThreadNotifications map[string]*UnreadNotifications `json:"unread_thread_notifications,omitempty"`
 }
 
 func (jr JoinResponse) MarshalJSON() ([]byte, error) {
@@ -504,6 +517,7 @@ func (jr JoinResponse) MarshalJSON() ([]byte, error) {
 		// if everything else is nil, also remove UnreadNotifications
 		if a.State == nil && a.Ephemeral == nil && a.AccountData == nil && a.Timeline == nil && a.Summary == nil {
 			a.UnreadNotifications = nil
+			a.UnreadThreadNotifications = nil
 		}
 	}
 	return json.Marshal(a)
@@ -575,6 +589,50 @@ func NewInviteResponse(ctx context.Context, rsAPI api.QuerySenderIDAPI, event *t
 	return &res, nil
 }
 
+// KnockResponse represents a /sync response for a room which is under the 'knock' key.
+type KnockResponse struct {
+	KnockState struct {
+		Events []json.RawMessage `json:"events"`
+	} `json:"knock_state"`
+}
+
+// NewKnockResponse creates a response for the given knock event, using the
+// stripped state in the "knock_room_state" unsigned key of the event.
+func NewKnockResponse(ctx context.Context, rsAPI api.QuerySenderIDAPI, event *types.HeaderedEvent, eventFormat synctypes.ClientEventFormat) (*KnockResponse, error) {
+	res := KnockResponse{}
+	res.KnockState.Events = []json.RawMessage{}
+
+	// The stripped state may already contain the knock event itself, which
+	// we'll add separately below, so skip over it here.
+	if knockRoomState := gjson.GetBytes(event.Unsigned(), "knock_room_state"); knockRoomState.IsArray() {
+		for _, ev := range knockRoomState.Array() {
+			if ev.Get("type").Str == spec.MRoomMember && ev.Get("state_key").Str == *event.StateKey() {
+				continue
+			}
+			res.KnockState.Events = append(res.KnockState.Events, json.RawMessage(ev.Raw))
+		}
+	}
+
+	// Clear unsigned so that the stripped state isn't repeated in the knock event.
+	eventNoUnsigned, err := event.SetUnsigned(nil)
+	if err != nil {
+		return nil, err
+	}
+	knockEvent, err := synctypes.ToClientEvent(eventNoUnsigned, eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	knockEvent.Unsigned = nil
+
+	if ev, err := json.Marshal(*knockEvent); err == nil {
+		res.KnockState.Events = append(res.KnockState.Events, ev)
+	}
+
+	return &res, nil
+}
+
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
 type LeaveResponse struct {
 	State    *ClientEvents `json:"state,omitempty"`
@@ -631,7 +689,55 @@ type IgnoredUsers struct {
 	List map[string]interface{} `json:"ignored_users"`
 }
 
+// IsIgnored returns whether the given user is ignored. It is safe to call
+// on a nil IgnoredUsers.
+func (i *IgnoredUsers) IsIgnored(userID string) bool {
+	if i == nil {
+		return false
+	}
+	_, ok := i.List[userID]
+	return ok
+}
+
+// UserIDs returns the ignored users, e.g. to be used as not_senders of an
+// event filter.
+func (i *IgnoredUsers) UserIDs() []string {
+	if i == nil || len(i.List) == 0 {
+		return nil
+	}
+	userIDs := make([]string, 0, len(i.List))
+	for userID := range i.List {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
+// AddToFilter excludes the events of the ignored users from the given filter,
+// keeping any not_senders which are already set.
+func (i *IgnoredUsers) AddToFilter(filter *synctypes.RoomEventFilter) {
+	userIDs := i.UserIDs()
+	if len(userIDs) == 0 {
+		return
+	}
+	if filter.NotSenders != nil {
+		userIDs = append(append([]string{}, *filter.NotSenders...), userIDs...)
+	}
+	filter.NotSenders = &userIDs
+}
+
 type RelationEntry struct {
 	Position StreamPosition
 	EventID  string
 }
+
+// ThreadSummary contains the aggregated information about a thread,
+// as used by the m.thread bundled aggregation.
+type ThreadSummary struct {
+	// The number of replies in the thread.
+	Count int
+	// The event ID of the most recent reply in the thread.
+	LatestEventID string
+	// Whether the requesting user has replied to the thread.
+	Participated bool
+}
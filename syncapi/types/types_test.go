@@ -105,6 +105,30 @@ func TestNewInviteResponse(t *testing.T) {
 	}
 }
 
+func TestNewKnockResponse(t *testing.T) {
+	event := `{"auth_events":["$create","$join_rules"],"content":{"membership":"knock","reason":"let me in"},"depth":5,"hashes":{"sha256":"fake"},"origin_server_ts":1602087113066,"prev_events":["$prev"],"room_id":"!room:remote","sender":"@alice:local","signatures":{},"state_key":"@alice:local","type":"m.room.member","unsigned":{"knock_room_state":[{"content":{"join_rule":"knock"},"sender":"@bob:remote","state_key":"","type":"m.room.join_rules"},{"content":{"membership":"knock"},"sender":"@alice:local","state_key":"@alice:local","type":"m.room.member"},{"content":{"name":"Test room"},"sender":"@bob:remote","state_key":"","type":"m.room.name"}]}}`
+
+	ev, err := gomatrixserverlib.MustGetRoomVersion(gomatrixserverlib.RoomVersionV10).NewEventFromTrustedJSON([]byte(event), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsAPI := FakeRoomserverAPI{}
+	res, err := NewKnockResponse(context.Background(), &rsAPI, &types.HeaderedEvent{PDU: ev}, synctypes.FormatSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"knock_state":{"events":[{"content":{"join_rule":"knock"},"sender":"@bob:remote","state_key":"","type":"m.room.join_rules"},{"content":{"name":"Test room"},"sender":"@bob:remote","state_key":"","type":"m.room.name"},{"content":{"membership":"knock","reason":"let me in"},"event_id":"` + ev.EventID() + `","origin_server_ts":1602087113066,"sender":"@alice:local","state_key":"@alice:local","type":"m.room.member"}]}}`
+	if string(j) != expected {
+		t.Fatalf("Knock response didn't contain correct info, \nexpected: %s \ngot: %s", expected, string(j))
+	}
+}
+
 func TestJoinResponse_MarshalJSON(t *testing.T) {
 	type fields struct {
 		Summary             *Summary
@@ -203,3 +227,32 @@ func TestJoinResponse_MarshalJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestIgnoredUsers(t *testing.T) {
+	var nilIgnores *IgnoredUsers
+	if nilIgnores.IsIgnored("@bob:test") {
+		t.Fatalf("expected nobody to be ignored")
+	}
+
+	ignores := &IgnoredUsers{List: map[string]interface{}{"@bob:test": struct{}{}, "@alice:test": struct{}{}}}
+	if !ignores.IsIgnored("@bob:test") || ignores.IsIgnored("@charlie:test") {
+		t.Fatalf("unexpected ignored users")
+	}
+
+	filter := synctypes.DefaultRoomEventFilter()
+	ignores.AddToFilter(&filter)
+	if want := []string{"@alice:test", "@bob:test"}; !reflect.DeepEqual(*filter.NotSenders, want) {
+		t.Fatalf("expected not_senders %v, got %v", want, *filter.NotSenders)
+	}
+
+	// Existing not_senders are kept
+	notSenders := []string{"@charlie:test"}
+	filter = synctypes.RoomEventFilter{NotSenders: &notSenders}
+	ignores.AddToFilter(&filter)
+	if want := []string{"@charlie:test", "@alice:test", "@bob:test"}; !reflect.DeepEqual(*filter.NotSenders, want) {
+		t.Fatalf("expected not_senders %v, got %v", want, *filter.NotSenders)
+	}
+	if len(notSenders) != 1 {
+		t.Fatalf("expected the original not_senders to be unchanged")
+	}
+}
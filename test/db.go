@@ -22,6 +22,7 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"testing"
 
 	"github.com/lib/pq"
@@ -30,6 +31,7 @@ import (
 type DBType int
 
 var DBTypePostgres DBType = 1
+var DBTypeQL DBType = 2
 
 var Quiet = false
 var Required = os.Getenv("DENDRITE_TEST_SKIP_NODB") == ""
@@ -99,7 +101,15 @@ func currentUser() string {
 // Returns the connection string to use and a close function which must be called when the test finishes.
 // Calling this function twice will return the same database, which will have data from previous tests
 // unless close() is called.
-func PrepareDBConnectionString(t *testing.T) (connStr string, close func()) {
+func PrepareDBConnectionString(t *testing.T, dbType DBType) (connStr string, close func()) {
+	if dbType == DBTypeQL {
+		// this will be made in the t.TempDir, which is unique per test
+		dbname := filepath.Join(t.TempDir(), "dendrite_test.db")
+		return fmt.Sprintf("file:%s", dbname), func() {
+			// t.TempDir() is removed automatically when the test finishes
+		}
+	}
+
 	// Required vars: user and db
 	// We'll try to infer from the local env if they are missing
 	user := os.Getenv("POSTGRES_USER")
@@ -158,6 +168,7 @@ func PrepareDBConnectionString(t *testing.T) (connStr string, close func()) {
 func WithAllDatabases(t *testing.T, testFn func(t *testing.T, db DBType)) {
 	dbs := map[string]DBType{
 		"postgres": DBTypePostgres,
+		"ql":       DBTypeQL,
 	}
 	for dbName, dbType := range dbs {
 		dbt := dbType
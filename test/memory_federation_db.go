@@ -41,6 +41,7 @@ type InMemoryFederationDatabase struct {
 	pendingEDUs        map[*receipt.Receipt]*gomatrixserverlib.EDU
 	associatedPDUs     map[spec.ServerName]map[*receipt.Receipt]struct{}
 	associatedEDUs     map[spec.ServerName]map[*receipt.Receipt]struct{}
+	relayServers       map[spec.ServerName][]spec.ServerName
 }
 
 func NewInMemoryFederationDatabase() *InMemoryFederationDatabase {
@@ -53,6 +54,7 @@ func NewInMemoryFederationDatabase() *InMemoryFederationDatabase {
 		pendingEDUs:        make(map[*receipt.Receipt]*gomatrixserverlib.EDU),
 		associatedPDUs:     make(map[spec.ServerName]map[*receipt.Receipt]struct{}),
 		associatedEDUs:     make(map[spec.ServerName]map[*receipt.Receipt]struct{}),
+		relayServers:       make(map[spec.ServerName][]spec.ServerName),
 	}
 }
 
@@ -310,6 +312,118 @@ func (d *InMemoryFederationDatabase) IsServerBlacklisted(
 	return isBlacklisted, nil
 }
 
+func (d *InMemoryFederationDatabase) SetServerAssumedOffline(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	d.assumedOffline[serverName] = struct{}{}
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) RemoveServerAssumedOffline(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	delete(d.assumedOffline, serverName)
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) RemoveAllServersAssumedOffline(
+	ctx context.Context,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	d.assumedOffline = make(map[spec.ServerName]struct{})
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) IsServerAssumedOffline(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (bool, error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	_, assumedOffline := d.assumedOffline[serverName]
+	return assumedOffline, nil
+}
+
+func (d *InMemoryFederationDatabase) P2PAddRelayServersForServer(
+	ctx context.Context,
+	serverName spec.ServerName,
+	relayServers []spec.ServerName,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	for _, relayServer := range relayServers {
+		known := false
+		for _, existing := range d.relayServers[serverName] {
+			if existing == relayServer {
+				known = true
+				break
+			}
+		}
+		if !known {
+			d.relayServers[serverName] = append(d.relayServers[serverName], relayServer)
+		}
+	}
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) P2PGetRelayServersForServer(
+	ctx context.Context,
+	serverName spec.ServerName,
+) ([]spec.ServerName, error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	return d.relayServers[serverName], nil
+}
+
+func (d *InMemoryFederationDatabase) P2PRemoveRelayServersForServer(
+	ctx context.Context,
+	serverName spec.ServerName,
+	relayServers []spec.ServerName,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	remaining := []spec.ServerName{}
+	for _, existing := range d.relayServers[serverName] {
+		removed := false
+		for _, relayServer := range relayServers {
+			if existing == relayServer {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			remaining = append(remaining, existing)
+		}
+	}
+	d.relayServers[serverName] = remaining
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) P2PRemoveAllRelayServersForServer(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	delete(d.relayServers, serverName)
+	return nil
+}
+
 func (d *InMemoryFederationDatabase) FetchKeys(ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
 	return nil, nil
 }
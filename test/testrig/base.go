@@ -16,6 +16,7 @@ package testrig
 
 import (
 	"fmt"
+	"path/filepath"
 	"testing"
 
 	"github.com/matrix-org/dendrite/setup/config"
@@ -47,12 +48,12 @@ func CreateConfig(t *testing.T, dbType test.DBType) (*config.Dendrite, *process.
 			SingleDatabase: true,
 		})
 		cfg.Global.ServerName = "test"
-		// use a distinct prefix else concurrent postgres/sqlite runs will clash since NATS will use
+		// use a distinct prefix else concurrent postgres/ql runs will clash since NATS will use
 		// the file system event with InMemory=true :(
 		cfg.Global.JetStream.TopicPrefix = fmt.Sprintf("Test_%d_", dbType)
 		cfg.SyncAPI.Fulltext.InMemory = true
 
-		connStr, closeDb := test.PrepareDBConnectionString(t)
+		connStr, closeDb := test.PrepareDBConnectionString(t, dbType)
 		cfg.Global.DatabaseOptions = config.DatabaseOptions{
 			ConnectionString:       config.DataSource(connStr),
 			MaxOpenConnections:     10,
@@ -64,6 +65,32 @@ func CreateConfig(t *testing.T, dbType test.DBType) (*config.Dendrite, *process.
 			ctx.WaitForShutdown()
 			closeDb()
 		}
+	case test.DBTypeQL:
+		cfg.Defaults(config.DefaultOpts{
+			Generate:       true,
+			SingleDatabase: false,
+		})
+		cfg.Global.ServerName = "test"
+		// use a distinct prefix else concurrent postgres/ql runs will clash since NATS will use
+		// the file system event with InMemory=true :(
+		cfg.Global.JetStream.TopicPrefix = fmt.Sprintf("Test_%d_", dbType)
+		cfg.SyncAPI.Fulltext.InMemory = true
+
+		// override database paths to use temp dir
+		tempDir := t.TempDir()
+		cfg.FederationAPI.Database.ConnectionString = config.DataSource(filepath.Join("file://", tempDir, "federationapi.db"))
+		cfg.KeyServer.Database.ConnectionString = config.DataSource(filepath.Join("file://", tempDir, "keyserver.db"))
+		cfg.MediaAPI.Database.ConnectionString = config.DataSource(filepath.Join("file://", tempDir, "mediaapi.db"))
+		cfg.RelayAPI.Database.ConnectionString = config.DataSource(filepath.Join("file://", tempDir, "relayapi.db"))
+		cfg.RoomServer.Database.ConnectionString = config.DataSource(filepath.Join("file://", tempDir, "roomserver.db"))
+		cfg.SyncAPI.Database.ConnectionString = config.DataSource(filepath.Join("file://", tempDir, "syncapi.db"))
+		cfg.UserAPI.AccountDatabase.ConnectionString = config.DataSource(filepath.Join("file://", tempDir, "userapi.db"))
+
+		return &cfg, ctx, func() {
+			ctx.ShutdownDendrite()
+			ctx.WaitForShutdown()
+			// t.TempDir(), where all database files are created, is removed automatically
+		}
 	default:
 		t.Fatalf("unknown db type: %v", dbType)
 	}
@@ -57,6 +57,7 @@ type RoomserverUserAPI interface {
 // api functions required by the media api
 type MediaUserAPI interface {
 	QueryAcccessTokenAPI
+	RateLimitOverrideAPI
 }
 
 // api functions required by the federation api
@@ -74,6 +75,7 @@ type FederationUserAPI interface {
 // api functions required by the sync api
 type SyncUserAPI interface {
 	QueryAcccessTokenAPI
+	RateLimitOverrideAPI
 	SyncKeyAPI
 	QueryAccountData(ctx context.Context, req *QueryAccountDataRequest, res *QueryAccountDataResponse) error
 	PerformLastSeenUpdate(ctx context.Context, req *PerformLastSeenUpdateRequest, res *PerformLastSeenUpdateResponse) error
@@ -85,6 +87,7 @@ type SyncUserAPI interface {
 // api functions required by the client api
 type ClientUserAPI interface {
 	QueryAcccessTokenAPI
+	RateLimitOverrideAPI
 	LoginTokenInternalAPI
 	UserLoginAPI
 	ClientKeyAPI
@@ -101,13 +104,17 @@ type ClientUserAPI interface {
 	PerformAdminGetRegistrationToken(ctx context.Context, tokenString string) (*clientapi.RegistrationToken, error)
 	PerformAdminDeleteRegistrationToken(ctx context.Context, tokenString string) error
 	PerformAdminUpdateRegistrationToken(ctx context.Context, tokenString string, newAttributes map[string]interface{}) (*clientapi.RegistrationToken, error)
+	PerformAdminSetRateLimitOverride(ctx context.Context, override *RateLimitOverride) error
+	PerformAdminDeleteRateLimitOverride(ctx context.Context, userID string) error
 	PerformAccountCreation(ctx context.Context, req *PerformAccountCreationRequest, res *PerformAccountCreationResponse) error
 	PerformDeviceCreation(ctx context.Context, req *PerformDeviceCreationRequest, res *PerformDeviceCreationResponse) error
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
 	PerformDeviceDeletion(ctx context.Context, req *PerformDeviceDeletionRequest, res *PerformDeviceDeletionResponse) error
+	PerformTokenRefresh(ctx context.Context, req *PerformTokenRefreshRequest, res *PerformTokenRefreshResponse) error
 	PerformPasswordUpdate(ctx context.Context, req *PerformPasswordUpdateRequest, res *PerformPasswordUpdateResponse) error
 	PerformPusherDeletion(ctx context.Context, req *PerformPusherDeletionRequest, res *struct{}) error
 	PerformPusherSet(ctx context.Context, req *PerformPusherSetRequest, res *struct{}) error
+	PerformEmailUnsubscribe(ctx context.Context, req *PerformEmailUnsubscribeRequest, res *PerformEmailUnsubscribeResponse) error
 	PerformPushRulesPut(ctx context.Context, userID string, ruleSets *pushrules.AccountRuleSets) error
 	PerformAccountDeactivation(ctx context.Context, req *PerformAccountDeactivationRequest, res *PerformAccountDeactivationResponse) error
 	PerformOpenIDTokenCreation(ctx context.Context, req *PerformOpenIDTokenCreationRequest, res *PerformOpenIDTokenCreationResponse) error
@@ -115,9 +122,11 @@ type ClientUserAPI interface {
 	InputAccountData(ctx context.Context, req *InputAccountDataRequest, res *InputAccountDataResponse) error
 
 	QueryThreePIDsForLocalpart(ctx context.Context, req *QueryThreePIDsForLocalpartRequest, res *QueryThreePIDsForLocalpartResponse) error
-	QueryLocalpartForThreePID(ctx context.Context, req *QueryLocalpartForThreePIDRequest, res *QueryLocalpartForThreePIDResponse) error
 	PerformForgetThreePID(ctx context.Context, req *PerformForgetThreePIDRequest, res *struct{}) error
 	PerformSaveThreePIDAssociation(ctx context.Context, req *PerformSaveThreePIDAssociationRequest, res *struct{}) error
+	PerformSendEmail(ctx context.Context, req *PerformSendEmailRequest) error
+	QueryLocalpartForSSO(ctx context.Context, req *QueryLocalpartForSSORequest, res *QueryLocalpartForSSOResponse) error
+	PerformSaveSSOAssociation(ctx context.Context, req *PerformSaveSSOAssociationRequest, res *struct{}) error
 }
 
 type KeyBackupAPI interface {
@@ -144,8 +153,15 @@ type QueryAcccessTokenAPI interface {
 	QueryAccessToken(ctx context.Context, req *QueryAccessTokenRequest, res *QueryAccessTokenResponse) error
 }
 
+type RateLimitOverrideAPI interface {
+	// QueryRateLimitOverride returns the rate limit override for the user,
+	// or nil if the configured rate limits apply.
+	QueryRateLimitOverride(ctx context.Context, userID string) (*RateLimitOverride, error)
+}
+
 type UserLoginAPI interface {
 	QueryAccountByPassword(ctx context.Context, req *QueryAccountByPasswordRequest, res *QueryAccountByPasswordResponse) error
+	QueryLocalpartForThreePID(ctx context.Context, req *QueryLocalpartForThreePIDRequest, res *QueryLocalpartForThreePIDResponse) error
 }
 
 type PerformKeyBackupRequest struct {
@@ -280,6 +296,8 @@ type QueryAccessTokenRequest struct {
 type QueryAccessTokenResponse struct {
 	Device *Device
 	Err    string // e.g ErrorForbidden
+	// Expired is true if the access token is known but has expired, and must be refreshed.
+	Expired bool
 }
 
 // QueryAccountDataRequest is the request for QueryAccountData
@@ -368,6 +386,8 @@ type PerformDeviceCreationRequest struct {
 	Localpart   string
 	ServerName  spec.ServerName // optional: if blank, default server name used
 	AccessToken string          // optional: if blank one will be made on your behalf
+	// optional: if set, the access token expires and can be refreshed with this refresh token.
+	RefreshToken string
 	// optional: if nil an ID is generated for you. If set, replaces any existing device session,
 	// which will generate a new access token and invalidate the old one.
 	DeviceID *string
@@ -393,6 +413,19 @@ type PerformDeviceCreationResponse struct {
 	Device        *Device
 }
 
+// PerformTokenRefreshRequest is the request for PerformTokenRefresh
+type PerformTokenRefreshRequest struct {
+	RefreshToken    string
+	NewAccessToken  string
+	NewRefreshToken string
+}
+
+// PerformTokenRefreshResponse is the response for PerformTokenRefresh
+type PerformTokenRefreshResponse struct {
+	// The device with the new access token, or nil if the refresh token isn't valid.
+	Device *Device
+}
+
 // PerformAccountDeactivationRequest is the request for PerformAccountDeactivation
 type PerformAccountDeactivationRequest struct {
 	Localpart  string
@@ -444,6 +477,9 @@ type Device struct {
 	// this is the appservice ID.
 	AppserviceID string
 	AccountType  AccountType
+	// When the access token expires, as a unix timestamp (ms resolution),
+	// or 0 if it never expires.
+	AccessTokenExpiresTS int64
 }
 
 func (d *Device) UserDomain() spec.ServerName {
@@ -548,6 +584,25 @@ type PerformPusherDeletionRequest struct {
 	SessionID  int64
 }
 
+type PerformEmailUnsubscribeRequest struct {
+	// The token from the unsubscribe link of a notification digest
+	Token string
+}
+
+type PerformEmailUnsubscribeResponse struct {
+	// The user and the email address the pusher was removed for. Empty if the token is invalid.
+	UserID string
+	Email  string
+}
+
+// RateLimitOverride replaces the configured rate limits for a user. A zero
+// threshold exempts the user from rate limiting.
+type RateLimitOverride struct {
+	UserID    string `json:"user_id"`
+	Threshold int64  `json:"threshold"`
+	CooloffMS int64  `json:"cooloff_ms"`
+}
+
 // Pusher represents a push notification subscriber
 type Pusher struct {
 	SessionID         int64                  `json:"session_id,omitempty"`
@@ -562,6 +617,15 @@ type Pusher struct {
 	Data              map[string]interface{} `json:"data"`
 }
 
+// EmailPusher is an email pusher and the user it belongs to.
+type EmailPusher struct {
+	Pusher
+	Localpart  string
+	ServerName spec.ServerName
+	// LastNotificationID is the ID of the last notification which was emailed.
+	LastNotificationID int64
+}
+
 type PusherKind string
 
 const (
@@ -591,6 +655,12 @@ type Notification struct {
 	TS         spec.Timestamp        `json:"ts"`          // Required.
 }
 
+// ThreadNotificationCounts holds the unread notification counts for a single thread.
+type ThreadNotificationCounts struct {
+	Total     int64
+	Highlight int64
+}
+
 type QueryNumericLocalpartRequest struct {
 	ServerName spec.ServerName
 }
@@ -646,6 +716,52 @@ type PerformSaveThreePIDAssociationRequest struct {
 	Medium     string
 }
 
+type QueryLocalpartForSSORequest struct {
+	// The ID of the identity provider, as configured in client_api.sso
+	IDPID string
+	// The identifier of the user at the identity provider
+	Subject string
+}
+
+type QueryLocalpartForSSOResponse struct {
+	Localpart  string
+	ServerName spec.ServerName
+}
+
+type PerformSaveSSOAssociationRequest struct {
+	IDPID      string
+	Subject    string
+	Localpart  string
+	ServerName spec.ServerName
+}
+
+// EmailTemplate is the name of a template the mailer renders emails with.
+type EmailTemplate string
+
+const (
+	// EmailTemplateRegistrationValidation asks to validate an email address. The data must
+	// contain the "Link" to validate the address with, and may contain its "Token".
+	EmailTemplateRegistrationValidation EmailTemplate = "registration_validation"
+	// EmailTemplateAccountNotice tells a user about a change to their account. The data must
+	// contain the "Subject" and the "Message".
+	EmailTemplateAccountNotice EmailTemplate = "account_notice"
+	// EmailTemplatePasswordReset asks to confirm resetting the password of an account.
+	// The data must contain the "Link" to confirm the reset with.
+	EmailTemplatePasswordReset EmailTemplate = "password_reset"
+	// EmailTemplateNotificationDigest tells a user about notifications they missed. It is
+	// rendered with a mailer.NotificationDigest rather than a map.
+	EmailTemplateNotificationDigest EmailTemplate = "notification_digest"
+)
+
+type PerformSendEmailRequest struct {
+	// The address to send the email to
+	To string
+	// The template to render the email with
+	Template EmailTemplate
+	// The data made available to the template, in addition to the "AppName" and "ServerName"
+	Data map[string]string
+}
+
 type QueryAccountByLocalpartRequest struct {
 	Localpart  string
 	ServerName spec.ServerName
@@ -804,6 +920,9 @@ type PerformUploadKeysRequest struct {
 	DeviceID    string // Optional - Device performing the request, for fetching OTK count
 	DeviceKeys  []DeviceKeys
 	OneTimeKeys []OneTimeKeys
+	// FallbackKeys replace the existing fallback key of the device for each algorithm.
+	// They are handed out by PerformClaimKeys once the device has run out of one-time keys.
+	FallbackKeys []OneTimeKeys
 	// OnlyDisplayNameUpdates should be `true` if ALL the DeviceKeys are present to update
 	// the display name for their respective device, and NOT to modify the keys. The key
 	// itself doesn't change but it's easier to pretend upload new keys and reuse the same code paths.
@@ -928,7 +1047,9 @@ type QueryOneTimeKeysRequest struct {
 type QueryOneTimeKeysResponse struct {
 	// OTK key counts, in the extended /sync form described by https://matrix.org/docs/spec/client_server/r0.6.1#id84
 	Count OneTimeKeysCount
-	Error *KeyError
+	// The algorithms of the fallback keys which haven't been claimed yet
+	UnusedFallbackKeyTypes []string
+	Error                  *KeyError
 }
 
 type QueryDeviceMessagesRequest struct {
@@ -969,3 +1090,7 @@ type PerformMarkAsStaleRequest struct {
 // ErrProfileNotExists is returned when trying to lookup a user's profile that
 // doesn't exist locally.
 var ErrProfileNotExists = errors.New("no known profile for given user ID")
+
+// ErrEmailDisabled is returned when trying to send an email while sending email
+// isn't enabled in the config.
+var ErrEmailDisabled = errors.New("sending email is not enabled on this server")
@@ -610,7 +610,9 @@ func (s *OutputRoomEventConsumer) notifyLocal(ctx context.Context, event *rstype
 		var rejected []*pushgateway.Device
 		for url, fmts := range devicesByURLAndFormat {
 			for format, devices := range fmts {
-				// TODO: support "email".
+				// Email pushers are sent a digest of unread notifications
+				// by the EmailNotifier instead, once it is clear the user
+				// hasn't seen them.
 				if !strings.HasPrefix(url, "http") {
 					continue
 				}
@@ -667,8 +669,9 @@ func (s *OutputRoomEventConsumer) evaluatePushRules(ctx context.Context, event *
 		if err != nil {
 			return nil, err
 		}
-		if _, ok := ignored.List[sender.String()]; ok {
-			return nil, fmt.Errorf("user %s is ignored", sender.String())
+		// Events of ignored users never notify.
+		if ignored.IsIgnored(user) {
+			return nil, nil
 		}
 	}
 	ruleSets, err := s.db.QueryPushRules(ctx, mem.Localpart, mem.Domain)
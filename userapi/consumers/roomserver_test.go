@@ -29,7 +29,7 @@ import (
 
 func mustCreateDatabase(t *testing.T, dbType test.DBType) (storage.UserDatabase, func()) {
 	t.Helper()
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
 	db, err := storage.NewUserDatabase(context.Background(), cm, &config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
@@ -138,6 +138,26 @@ func Test_evaluatePushRules(t *testing.T) {
 			})
 
 		}
+
+		t.Run("ignored users don't notify", func(t *testing.T) {
+			err := db.SaveAccountData(ctx, "test", "localhost", "", "m.ignored_user_list", []byte(`{"ignored_users":{"@ignored:localhost":{}}}`))
+			if err != nil {
+				t.Fatalf("failed to save ignored users: %v", err)
+			}
+			mem := &localMembership{UserID: "@test:localhost", Localpart: "test", Domain: "localhost"}
+			actions, err := consumer.evaluatePushRules(ctx, mustCreateEvent(t, `{"type":"m.room.message","room_id":"!room:example.com","sender":"@ignored:localhost"}`), mem, 10)
+			if err != nil {
+				t.Fatalf("failed to evaluate push rules: %v", err)
+			}
+			assert.Nil(t, actions)
+
+			// Other users still notify
+			actions, err = consumer.evaluatePushRules(ctx, mustCreateEvent(t, `{"type":"m.room.message","room_id":"!room:example.com","sender":"@other:localhost"}`), mem, 10)
+			if err != nil {
+				t.Fatalf("failed to evaluate push rules: %v", err)
+			}
+			assert.Equal(t, []*pushrules.Action{{Kind: pushrules.NotifyAction}}, actions)
+		})
 	})
 }
 
@@ -0,0 +1,346 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/syncapi/synctypes"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/mailer"
+	"github.com/matrix-org/dendrite/userapi/storage"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+)
+
+const (
+	// emailNotifierInterval is how often we look for notifications which are due to be emailed
+	emailNotifierInterval = time.Minute
+	// digestLimit is the maximum number of notifications in a single digest
+	digestLimit = 50
+	// digestBodyLength is the maximum number of characters of a message shown in a digest
+	digestBodyLength = 200
+	// emailUnsubscribePath is the path of the client API page which removes email pushers
+	emailUnsubscribePath = "/_matrix/client/unstable/pushers/email/unsubscribe"
+	// unsubscribeTokenContext is prepended to unsubscribe tokens before they are signed, so
+	// that the signatures can't be confused with signatures made by the server for other reasons
+	unsubscribeTokenContext = "dendrite email unsubscribe\n"
+)
+
+// EmailNotifier emails a digest of missed notifications to users who set up an email
+// pusher. Notifications are only emailed if they haven't been read after a while, so
+// that users who are active in a client don't receive emails.
+type EmailNotifier struct {
+	cfg    *config.UserAPI
+	db     storage.UserDatabase
+	rsAPI  rsapi.UserRoomserverAPI
+	mailer *mailer.Mailer
+}
+
+func NewEmailNotifier(cfg *config.UserAPI, db storage.UserDatabase, rsAPI rsapi.UserRoomserverAPI, m *mailer.Mailer) *EmailNotifier {
+	return &EmailNotifier{
+		cfg:    cfg,
+		db:     db,
+		rsAPI:  rsAPI,
+		mailer: m,
+	}
+}
+
+// Start sends digests in the background until the process shuts down.
+func (n *EmailNotifier) Start(processCtx *process.ProcessContext) {
+	go func() {
+		ctx := processCtx.Context()
+		for {
+			n.sendDigests(ctx, time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(emailNotifierInterval):
+			}
+		}
+	}()
+}
+
+// sendDigests sends a digest to every email pusher with notifications which are due.
+func (n *EmailNotifier) sendDigests(ctx context.Context, now time.Time) {
+	pushers, err := n.db.GetEmailPushers(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			logrus.WithError(err).Error("Failed to get email pushers")
+		}
+		return
+	}
+	for i := range pushers {
+		if ctx.Err() != nil {
+			return
+		}
+		if err = n.sendDigest(ctx, &pushers[i], now); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"localpart": pushers[i].Localpart,
+				"app_id":    pushers[i].AppID,
+			}).Error("Failed to send notification digest")
+		}
+	}
+}
+
+// sendDigest emails the unread notifications which haven't been emailed to the pusher
+// yet, once the oldest of them is older than the configured delay.
+func (n *EmailNotifier) sendDigest(ctx context.Context, p *api.EmailPusher, now time.Time) error {
+	notifs, lastID, err := n.db.GetNotifications(ctx, p.Localpart, p.ServerName, p.LastNotificationID, digestLimit, tables.AllNotifications)
+	if err != nil {
+		return fmt.Errorf("n.db.GetNotifications: %w", err)
+	}
+	// Notifications from before the pusher was set up are never emailed.
+	createdTS := spec.Timestamp(p.PushKeyTS * 1000)
+	unsent := make([]*api.Notification, 0, len(notifs))
+	for _, notif := range notifs {
+		if notif.TS >= createdTS {
+			unsent = append(unsent, notif)
+		}
+	}
+	if len(unsent) == 0 {
+		if lastID > p.LastNotificationID {
+			return n.db.SetPusherLastNotificationID(ctx, p.AppID, p.PushKey, p.Localpart, p.ServerName, lastID)
+		}
+		return nil
+	}
+	// Give the user a chance to read the notifications in a client first.
+	delay := time.Duration(n.cfg.Email.NotificationDelayMS) * time.Millisecond
+	if now.Sub(unsent[0].TS.Time()) < delay {
+		return nil
+	}
+
+	digest, err := n.buildDigest(ctx, p, unsent)
+	if err != nil {
+		return err
+	}
+	if err = n.mailer.QueueNotificationDigest(ctx, p.PushKey, digest); err != nil {
+		return fmt.Errorf("n.mailer.QueueNotificationDigest: %w", err)
+	}
+	return n.db.SetPusherLastNotificationID(ctx, p.AppID, p.PushKey, p.Localpart, p.ServerName, lastID)
+}
+
+// buildDigest groups the notifications by room, in the order the rooms first appear.
+func (n *EmailNotifier) buildDigest(ctx context.Context, p *api.EmailPusher, notifs []*api.Notification) (*mailer.NotificationDigest, error) {
+	userID := userutil.MakeUserID(p.Localpart, p.ServerName)
+	unread, err := n.db.GetNotificationCount(ctx, p.Localpart, p.ServerName, tables.AllNotifications)
+	if err != nil {
+		return nil, fmt.Errorf("n.db.GetNotificationCount: %w", err)
+	}
+	profile, err := n.db.GetProfileByLocalpart(ctx, p.Localpart, p.ServerName)
+	if err != nil {
+		return nil, fmt.Errorf("n.db.GetProfileByLocalpart: %w", err)
+	}
+	token, err := makeUnsubscribeToken(n.cfg.Matrix.PrivateKey, unsubscribeToken{
+		UserID:  userID,
+		AppID:   p.AppID,
+		PushKey: p.PushKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	digest := &mailer.NotificationDigest{
+		UserID:          userID,
+		DisplayName:     profile.DisplayName,
+		UnreadCount:     int(unread),
+		UnsubscribeLink: n.cfg.Matrix.ClientAPIBaseURL() + emailUnsubscribePath + "?token=" + url.QueryEscape(token),
+	}
+	if digest.UnreadCount < len(notifs) {
+		digest.UnreadCount = len(notifs)
+	}
+	rooms := make(map[string]int)         // room ID -> index in digest.Rooms
+	senders := make(map[[2]string]string) // [room ID, user ID] -> display name, as they are per room
+	for _, notif := range notifs {
+		i, ok := rooms[notif.RoomID]
+		if !ok {
+			i = len(digest.Rooms)
+			rooms[notif.RoomID] = i
+			digest.Rooms = append(digest.Rooms, mailer.DigestRoom{
+				Name: n.roomName(ctx, notif.RoomID),
+				Link: "https://matrix.to/#/" + url.PathEscape(notif.RoomID),
+			})
+		}
+		key := [2]string{notif.RoomID, notif.Event.Sender}
+		sender, ok := senders[key]
+		if !ok {
+			sender = n.senderName(ctx, notif.RoomID, notif.Event.Sender)
+			senders[key] = sender
+		}
+		digest.Rooms[i].Notifications = append(digest.Rooms[i].Notifications, mailer.DigestNotification{
+			Sender: sender,
+			Body:   notificationBody(&notif.Event),
+			TS:     notif.TS.Time(),
+		})
+	}
+	return digest, nil
+}
+
+// roomName returns the name or the canonical alias of the room, or the room ID if
+// it has neither.
+func (n *EmailNotifier) roomName(ctx context.Context, roomID string) string {
+	var res rsapi.QueryCurrentStateResponse
+	if err := n.rsAPI.QueryCurrentState(ctx, &rsapi.QueryCurrentStateRequest{
+		RoomID: roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{
+			{EventType: spec.MRoomName},
+			{EventType: spec.MRoomCanonicalAlias},
+		},
+	}, &res); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Warn("Failed to query room name")
+		return roomID
+	}
+	if ev := res.StateEvents[gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomName}]; ev != nil {
+		if name := gjson.GetBytes(ev.Content(), "name").Str; name != "" {
+			return name
+		}
+	}
+	if ev := res.StateEvents[gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomCanonicalAlias}]; ev != nil {
+		if alias := gjson.GetBytes(ev.Content(), "alias").Str; alias != "" {
+			return alias
+		}
+	}
+	return roomID
+}
+
+// senderName returns the display name of the sender in the room, or their user ID
+// if they don't have one.
+func (n *EmailNotifier) senderName(ctx context.Context, roomID, sender string) string {
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return sender
+	}
+	userID, err := spec.NewUserID(sender, true)
+	if err != nil {
+		return sender
+	}
+	senderID, err := n.rsAPI.QuerySenderIDForUser(ctx, *validRoomID, *userID)
+	if err != nil || senderID == nil {
+		return sender
+	}
+	var res rsapi.QueryCurrentStateResponse
+	tuple := gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomMember, StateKey: string(*senderID)}
+	if err = n.rsAPI.QueryCurrentState(ctx, &rsapi.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{tuple},
+	}, &res); err != nil {
+		return sender
+	}
+	if ev := res.StateEvents[tuple]; ev != nil {
+		if name := gjson.GetBytes(ev.Content(), "displayname").Str; name != "" {
+			return name
+		}
+	}
+	return sender
+}
+
+// notificationBody returns a short description of the event of a notification.
+func notificationBody(ev *synctypes.ClientEvent) string {
+	var body string
+	switch ev.Type {
+	case "m.room.message":
+		switch msgtype := gjson.GetBytes(ev.Content, "msgtype").Str; msgtype {
+		case "m.image":
+			body = "sent an image"
+		case "m.video":
+			body = "sent a video"
+		case "m.audio":
+			body = "sent an audio file"
+		case "m.file":
+			body = "sent a file"
+		default:
+			body = gjson.GetBytes(ev.Content, "body").Str
+		}
+	case "m.room.encrypted":
+		body = "sent an encrypted message"
+	case spec.MRoomMember:
+		if gjson.GetBytes(ev.Content, "membership").Str == spec.Invite {
+			body = "invited you to the room"
+		}
+	}
+	if body == "" {
+		body = "sent an event of type " + ev.Type
+	}
+	if runes := []rune(body); len(runes) > digestBodyLength {
+		body = strings.TrimSpace(string(runes[:digestBodyLength])) + "…"
+	}
+	return body
+}
+
+// unsubscribeToken identifies the email pusher an unsubscribe link removes.
+type unsubscribeToken struct {
+	UserID  string `json:"user_id"`
+	AppID   string `json:"app_id"`
+	PushKey string `json:"pushkey"`
+}
+
+// makeUnsubscribeToken returns a token which is signed with the key of the server, so
+// that the pusher can be removed without the user having to log in.
+func makeUnsubscribeToken(key ed25519.PrivateKey, t unsubscribeToken) (string, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return "", errors.New("no signing key to sign the unsubscribe token with")
+	}
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(key, append([]byte(unsubscribeTokenContext), payload...))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parseUnsubscribeToken returns the content of the token, or false if the token wasn't
+// signed by the server.
+func parseUnsubscribeToken(key ed25519.PrivateKey, token string) (*unsubscribeToken, bool) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, false
+	}
+	encPayload, encSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil {
+		return nil, false
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	if !ed25519.Verify(pub, append([]byte(unsubscribeTokenContext), payload...), sig) {
+		return nil, false
+	}
+	var t unsubscribeToken
+	if err = json.Unmarshal(payload, &t); err != nil {
+		return nil, false
+	}
+	return &t, true
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	rstypes "github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/synctypes"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/mailer"
+	"github.com/matrix-org/dendrite/userapi/storage"
+)
+
+// emailNotifierRoomserverAPI answers state queries from test rooms.
+type emailNotifierRoomserverAPI struct {
+	rsapi.UserRoomserverAPI
+	rooms map[string]*test.Room
+}
+
+func (r *emailNotifierRoomserverAPI) QuerySenderIDForUser(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (*spec.SenderID, error) {
+	senderID := spec.SenderID(userID.String())
+	return &senderID, nil
+}
+
+func (r *emailNotifierRoomserverAPI) QueryCurrentState(ctx context.Context, req *rsapi.QueryCurrentStateRequest, res *rsapi.QueryCurrentStateResponse) error {
+	res.StateEvents = make(map[gomatrixserverlib.StateKeyTuple]*rstypes.HeaderedEvent)
+	room := r.rooms[req.RoomID]
+	if room == nil {
+		return nil
+	}
+	for _, tuple := range req.StateTuples {
+		for _, ev := range room.CurrentState() {
+			if ev.Type() == tuple.EventType && ev.StateKey() != nil && *ev.StateKey() == tuple.StateKey {
+				res.StateEvents[tuple] = ev
+			}
+		}
+	}
+	return nil
+}
+
+type nopSender struct{}
+
+func (nopSender) Send(ctx context.Context, from string, to []string, message []byte) error {
+	return nil
+}
+
+// plainTextBody returns the plain text part of a queued email.
+func plainTextBody(t *testing.T, message []byte) string {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(string(message)))
+	if err != nil {
+		t.Fatalf("failed to parse email: %s", err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("failed to parse content type: %s", err)
+	}
+	part, err := multipart.NewReader(msg.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatalf("failed to read the plain text part: %s", err)
+	}
+	text, err := io.ReadAll(part)
+	if err != nil {
+		t.Fatalf("failed to read the plain text part: %s", err)
+	}
+	return string(text)
+}
+
+func TestEmailNotifier(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	ctx := context.Background()
+
+	// Bob has a display name in the first room only
+	namedRoom := test.NewRoom(t, bob)
+	namedRoom.CreateAndInsert(t, bob, spec.MRoomName, map[string]interface{}{"name": "Tea Party"}, test.WithStateKey(""))
+	namedRoom.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership":  spec.Join,
+		"displayname": "Bob the Builder",
+	}, test.WithStateKey(bob.ID))
+	unnamedRoom := test.NewRoom(t, bob)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+		db, err := storage.NewUserDatabase(ctx, cm, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		}, "test", bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS, api.DefaultLoginTokenLifetime, "")
+		if err != nil {
+			t.Fatalf("failed to create user db: %s", err)
+		}
+
+		_, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := &config.UserAPI{
+			Matrix: &config.Global{},
+		}
+		cfg.Matrix.ServerName = "test"
+		cfg.Matrix.PrivateKey = privateKey
+		cfg.Email.Defaults()
+		cfg.Email.Enabled = true
+		cfg.Email.From = "Dendrite <noreply@test>"
+		m, err := mailer.NewMailer(cfg, db, nopSender{})
+		if err != nil {
+			t.Fatalf("failed to create mailer: %s", err)
+		}
+		rsAPI := &emailNotifierRoomserverAPI{rooms: map[string]*test.Room{
+			namedRoom.ID:   namedRoom,
+			unnamedRoom.ID: unnamedRoom,
+		}}
+		notifier := NewEmailNotifier(cfg, db, rsAPI, m)
+
+		localpart, serverName, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		if _, err = db.CreateAccount(ctx, localpart, serverName, "", "", api.AccountTypeUser); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+		start := time.Now().Add(-time.Hour)
+		if err = db.UpsertPusher(ctx, api.Pusher{
+			Kind:    api.EmailKind,
+			AppID:   "m.email",
+			PushKey: "alice@example.com",
+			// The pusher was set up after the first notification
+			PushKeyTS: start.Add(time.Minute).Unix(),
+			Data:      map[string]interface{}{},
+		}, localpart, serverName); err != nil {
+			t.Fatalf("failed to create pusher: %s", err)
+		}
+
+		notify := func(pos uint64, room *test.Room, ts time.Time, body string) {
+			t.Helper()
+			if err = db.InsertNotification(ctx, localpart, serverName, fmt.Sprintf("$event%d", pos), pos, nil, &api.Notification{
+				Event: synctypes.ClientEvent{
+					Type:    "m.room.message",
+					Sender:  bob.ID,
+					Content: spec.RawJSON(`{"msgtype":"m.text","body":"` + body + `"}`),
+				},
+				RoomID: room.ID,
+				TS:     spec.AsTimestamp(ts),
+			}); err != nil {
+				t.Fatalf("failed to insert notification: %s", err)
+			}
+		}
+		notify(1, namedRoom, start, "from before the pusher was set up")
+		notify(2, namedRoom, start.Add(2*time.Minute), "hello")
+		notify(3, unnamedRoom, start.Add(3*time.Minute), "anyone there?")
+		notify(4, namedRoom, start.Add(4*time.Minute), "tea is ready")
+
+		// Nothing is sent until the notification delay has passed
+		notifier.sendDigests(ctx, start.Add(5*time.Minute))
+		if emails, _ := db.DueEmails(ctx, 10); len(emails) != 0 {
+			t.Fatalf("expected no emails before the delay, got %d", len(emails))
+		}
+
+		notifier.sendDigests(ctx, start.Add(15*time.Minute))
+		emails, err := db.DueEmails(ctx, 10)
+		if err != nil {
+			t.Fatalf("failed to get queued emails: %s", err)
+		}
+		if len(emails) != 1 || emails[0].Recipient != "alice@example.com" {
+			t.Fatalf("expected one email to alice@example.com, got %+v", emails)
+		}
+		text := plainTextBody(t, emails[0].Message)
+		for _, want := range []string{
+			"Tea Party", "Bob the Builder: hello", "Bob the Builder: tea is ready",
+			unnamedRoom.ID, bob.ID + ": anyone there?", "You have 4 unread notifications",
+		} {
+			if !strings.Contains(text, want) {
+				t.Errorf("expected the digest to contain %q:\n%s", want, text)
+			}
+		}
+		if strings.Contains(text, "from before the pusher was set up") {
+			t.Errorf("expected notifications from before the pusher to be left out:\n%s", text)
+		}
+		// Notifications are grouped by room
+		if strings.Index(text, "tea is ready") > strings.Index(text, "anyone there?") {
+			t.Errorf("expected the notifications to be grouped by room:\n%s", text)
+		}
+		if err = db.RemoveEmail(ctx, emails[0].ID); err != nil {
+			t.Fatal(err)
+		}
+
+		// Notifications are only emailed once, and read notifications aren't emailed
+		notify(5, namedRoom, start.Add(20*time.Minute), "more tea?")
+		if _, err = db.SetNotificationsRead(ctx, localpart, serverName, namedRoom.ID, 5, true); err != nil {
+			t.Fatalf("failed to mark notifications as read: %s", err)
+		}
+		notifier.sendDigests(ctx, start.Add(time.Hour))
+		if emails, _ = db.DueEmails(ctx, 10); len(emails) != 0 {
+			t.Fatalf("expected no more emails, got %d", len(emails))
+		}
+
+		// The unsubscribe link removes the pusher
+		link := text[strings.Index(text, "https://test/_matrix/client/unstable/pushers/email/unsubscribe"):]
+		link = strings.TrimSpace(link)
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatalf("failed to parse unsubscribe link %q: %s", link, err)
+		}
+		userAPI := &UserInternalAPI{DB: db, Config: cfg}
+		var res api.PerformEmailUnsubscribeResponse
+		if err = userAPI.PerformEmailUnsubscribe(ctx, &api.PerformEmailUnsubscribeRequest{Token: u.Query().Get("token") + "x"}, &res); err != nil || res.UserID != "" {
+			t.Fatalf("expected a modified token to be rejected, got %+v, %v", res, err)
+		}
+		if err = userAPI.PerformEmailUnsubscribe(ctx, &api.PerformEmailUnsubscribeRequest{Token: u.Query().Get("token")}, &res); err != nil {
+			t.Fatalf("failed to unsubscribe: %s", err)
+		}
+		if res.UserID != alice.ID || res.Email != "alice@example.com" {
+			t.Fatalf("unexpected response: %+v", res)
+		}
+		if pushers, _ := db.GetEmailPushers(ctx); len(pushers) != 0 {
+			t.Fatalf("expected the pusher to be removed, got %+v", pushers)
+		}
+	})
+}
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -55,6 +56,9 @@ func (a *UserInternalAPI) PerformUploadKeys(ctx context.Context, req *api.Perfor
 	if len(req.OneTimeKeys) > 0 {
 		a.uploadOneTimeKeys(ctx, req, res)
 	}
+	if len(req.FallbackKeys) > 0 {
+		a.uploadFallbackKeys(ctx, req, res)
+	}
 	otks, err := a.KeyDatabase.OneTimeKeysCount(ctx, req.UserID, req.DeviceID)
 	if err != nil {
 		return err
@@ -178,6 +182,12 @@ func (a *UserInternalAPI) QueryOneTimeKeys(ctx context.Context, req *api.QueryOn
 		return nil
 	}
 	res.Count = *count
+	res.UnusedFallbackKeyTypes, err = a.KeyDatabase.UnusedFallbackKeyAlgorithms(ctx, req.UserID, req.DeviceID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("Failed to query unused fallback key types: %s", err),
+		}
+	}
 	return nil
 }
 
@@ -779,6 +789,40 @@ func (a *UserInternalAPI) uploadOneTimeKeys(ctx context.Context, req *api.Perfor
 
 }
 
+func (a *UserInternalAPI) uploadFallbackKeys(ctx context.Context, req *api.PerformUploadKeysRequest, res *api.PerformUploadKeysResponse) {
+	for _, key := range req.FallbackKeys {
+		// a device has at most one fallback key per algorithm
+		algorithms := make(map[string]bool, len(key.KeyJSON))
+		valid := true
+		for keyIDWithAlgo := range key.KeyJSON {
+			algo, keyID, ok := strings.Cut(keyIDWithAlgo, ":")
+			if !ok || algo == "" || keyID == "" {
+				res.KeyError(req.UserID, req.DeviceID, &api.KeyError{
+					Err: fmt.Sprintf("%s device %s: fallback key ID %q is not of the form algorithm:key_id", req.UserID, req.DeviceID, keyIDWithAlgo),
+				})
+				valid = false
+				break
+			}
+			if algorithms[algo] {
+				res.KeyError(req.UserID, req.DeviceID, &api.KeyError{
+					Err: fmt.Sprintf("%s device %s: more than one fallback key for algorithm %s", req.UserID, req.DeviceID, algo),
+				})
+				valid = false
+				break
+			}
+			algorithms[algo] = true
+		}
+		if !valid {
+			continue
+		}
+		if err := a.KeyDatabase.StoreFallbackKeys(ctx, key); err != nil {
+			res.KeyError(req.UserID, req.DeviceID, &api.KeyError{
+				Err: fmt.Sprintf("%s device %s : failed to store fallback keys: %s", req.UserID, req.DeviceID, err.Error()),
+			})
+		}
+	}
+}
+
 func emitDeviceKeyChanges(producer KeyChangeProducer, existing, new []api.DeviceMessage, onlyUpdateDisplayName bool) error {
 	// if we only want to update the display names, we can skip the checks below
 	if onlyUpdateDisplayName {
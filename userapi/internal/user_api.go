@@ -21,8 +21,10 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
+	asAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	fedsenderapi "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/pushrules"
@@ -34,6 +36,7 @@ import (
 
 	clientapi "github.com/matrix-org/dendrite/clientapi/api"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/pushgateway"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -41,6 +44,8 @@ import (
 	"github.com/matrix-org/dendrite/setup/config"
 	synctypes "github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/mailer"
+	"github.com/matrix-org/dendrite/userapi/passwordproviders"
 	"github.com/matrix-org/dendrite/userapi/producers"
 	"github.com/matrix-org/dendrite/userapi/storage"
 	"github.com/matrix-org/dendrite/userapi/storage/tables"
@@ -57,10 +62,15 @@ type UserInternalAPI struct {
 	DisableTLSValidation bool
 	// AppServices is the list of all registered AS
 	AppServices []config.ApplicationService
+	ASAPI       asAPI.AppServiceInternalAPI
 	RSAPI       rsapi.UserRoomserverAPI
 	PgClient    pushgateway.Client
 	FedClient   fedsenderapi.KeyserverFederationAPI
 	Updater     *DeviceListUpdater
+	// Mailer is nil if sending email isn't enabled
+	Mailer *mailer.Mailer
+	// PasswordProviders are asked in order if a password doesn't match a local account
+	PasswordProviders []passwordproviders.Provider
 }
 
 func (a *UserInternalAPI) PerformAdminCreateRegistrationToken(ctx context.Context, registrationToken *clientapi.RegistrationToken) (bool, error) {
@@ -94,6 +104,33 @@ func (a *UserInternalAPI) PerformAdminUpdateRegistrationToken(ctx context.Contex
 	return a.DB.UpdateRegistrationToken(ctx, tokenString, newAttributes)
 }
 
+func (a *UserInternalAPI) QueryRateLimitOverride(ctx context.Context, userID string) (*api.RateLimitOverride, error) {
+	local, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	if !a.Config.Matrix.IsLocalServerName(domain) {
+		return nil, nil
+	}
+	return a.DB.GetRateLimitOverride(ctx, local, domain)
+}
+
+func (a *UserInternalAPI) PerformAdminSetRateLimitOverride(ctx context.Context, override *api.RateLimitOverride) error {
+	local, domain, err := a.Config.Matrix.SplitLocalID('@', override.UserID)
+	if err != nil {
+		return err
+	}
+	return a.DB.SetRateLimitOverride(ctx, local, domain, override.Threshold, override.CooloffMS)
+}
+
+func (a *UserInternalAPI) PerformAdminDeleteRateLimitOverride(ctx context.Context, userID string) error {
+	local, domain, err := a.Config.Matrix.SplitLocalID('@', userID)
+	if err != nil {
+		return err
+	}
+	return a.DB.DeleteRateLimitOverride(ctx, local, domain)
+}
+
 func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse) error {
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
 	if err != nil {
@@ -305,7 +342,11 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 		"device_id":    req.DeviceID,
 		"display_name": req.DeviceDisplayName,
 	}).Info("PerformDeviceCreation")
-	dev, err := a.DB.CreateDevice(ctx, req.Localpart, serverName, req.DeviceID, req.AccessToken, req.DeviceDisplayName, req.IPAddr, req.UserAgent)
+	var accessTokenExpiresTS int64
+	if req.RefreshToken != "" {
+		accessTokenExpiresTS = a.accessTokenExpiresTS()
+	}
+	dev, err := a.DB.CreateDevice(ctx, req.Localpart, serverName, req.DeviceID, req.AccessToken, req.RefreshToken, accessTokenExpiresTS, req.DeviceDisplayName, req.IPAddr, req.UserAgent)
 	if err != nil {
 		return err
 	}
@@ -318,6 +359,25 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 	return a.deviceListUpdate(dev.UserID, []string{dev.ID}, req.FromRegistration)
 }
 
+// PerformTokenRefresh replaces the access and refresh tokens of the device with the
+// given refresh token.
+func (a *UserInternalAPI) PerformTokenRefresh(ctx context.Context, req *api.PerformTokenRefreshRequest, res *api.PerformTokenRefreshResponse) error {
+	dev, err := a.DB.RefreshDeviceTokens(ctx, req.RefreshToken, req.NewAccessToken, req.NewRefreshToken, a.accessTokenExpiresTS())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	res.Device = dev
+	return nil
+}
+
+// accessTokenExpiresTS returns when an access token issued now expires, if it can be refreshed.
+func (a *UserInternalAPI) accessTokenExpiresTS() int64 {
+	return time.Now().Add(time.Duration(a.Config.AccessTokenLifetimeMS) * time.Millisecond).UnixMilli()
+}
+
 func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
 	util.GetLogger(ctx).WithField("user_id", req.UserID).WithField("devices", req.DeviceIDs).Info("PerformDeviceDeletion")
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
@@ -587,6 +647,10 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 	if !a.Config.Matrix.IsLocalServerName(domain) {
 		return nil
 	}
+	if device.AccessTokenExpiresTS != 0 && time.Now().UnixMilli() >= device.AccessTokenExpiresTS {
+		res.Expired = true
+		return nil
+	}
 	acc, err := a.DB.GetAccountByLocalpart(ctx, localPart, domain)
 	if err != nil {
 		return err
@@ -878,6 +942,23 @@ func (a *UserInternalAPI) PerformPusherDeletion(ctx context.Context, req *api.Pe
 	return nil
 }
 
+func (a *UserInternalAPI) PerformEmailUnsubscribe(ctx context.Context, req *api.PerformEmailUnsubscribeRequest, res *api.PerformEmailUnsubscribeResponse) error {
+	token, ok := parseUnsubscribeToken(a.Config.Matrix.PrivateKey, req.Token)
+	if !ok {
+		return nil
+	}
+	localpart, domain, err := gomatrixserverlib.SplitID('@', token.UserID)
+	if err != nil || !a.Config.Matrix.IsLocalServerName(domain) {
+		return nil
+	}
+	if err = a.DB.RemovePusher(ctx, token.AppID, token.PushKey, localpart, domain); err != nil {
+		return err
+	}
+	res.UserID = token.UserID
+	res.Email = token.PushKey
+	return nil
+}
+
 func (a *UserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
 	var err error
 	res.Pushers, err = a.DB.GetPushers(ctx, req.Localpart, req.ServerName)
@@ -933,11 +1014,11 @@ func (a *UserInternalAPI) QueryAccountByPassword(ctx context.Context, req *api.Q
 	acc, err := a.DB.GetAccountByPassword(ctx, req.Localpart, req.ServerName, req.PlaintextPassword)
 	switch err {
 	case sql.ErrNoRows: // user does not exist
-		return nil
+		return a.queryAccountByExternalPassword(ctx, req, res)
 	case bcrypt.ErrMismatchedHashAndPassword: // user exists, but password doesn't match
 		return nil
 	case bcrypt.ErrHashTooShort: // user exists, but probably a passwordless account
-		return nil
+		return a.queryAccountByExternalPassword(ctx, req, res)
 	case nil:
 		res.Exists = true
 		res.Account = acc
@@ -946,6 +1027,105 @@ func (a *UserInternalAPI) QueryAccountByPassword(ctx context.Context, req *api.Q
 	return err
 }
 
+// passwordProviderIDPID is the identity provider ID under which accounts created by
+// password providers are recorded. It can't clash with the ID of an SSO identity
+// provider, as those can't contain a colon.
+const passwordProviderIDPID = "dendrite:password_providers"
+
+// queryAccountByExternalPassword asks the password providers in order to check the
+// password. The account of the user is created the first time they log in. Password
+// providers may only log in to accounts they created, so that they can't be used to
+// take over local, appservice or single sign-on accounts.
+func (a *UserInternalAPI) queryAccountByExternalPassword(ctx context.Context, req *api.QueryAccountByPasswordRequest, res *api.QueryAccountByPasswordResponse) error {
+	if len(a.PasswordProviders) == 0 || !a.Config.Matrix.IsLocalServerName(req.ServerName) {
+		return nil
+	}
+	// Directories tend to be case-insensitive, so accounts use the canonical lowercase form.
+	localpart := strings.ToLower(req.Localpart)
+	acc, err := a.DB.GetAccountByLocalpart(ctx, localpart, req.ServerName)
+	switch err {
+	case nil:
+		external, extErr := a.isExternalAccount(ctx, acc)
+		if extErr != nil || !external {
+			return extErr
+		}
+	case sql.ErrNoRows:
+		acc = nil
+	default:
+		return fmt.Errorf("a.DB.GetAccountByLocalpart: %w", err)
+	}
+
+	logger := util.GetLogger(ctx).WithField("localpart", req.Localpart)
+	for _, provider := range a.PasswordProviders {
+		profile, err := provider.CheckPassword(ctx, req.Localpart, req.ServerName, req.PlaintextPassword)
+		if err != nil {
+			// Carry on with the next provider, so that one provider being
+			// unavailable doesn't prevent everyone from logging in.
+			logger.WithError(err).Warn("Failed to check password with password provider")
+			continue
+		}
+		if profile == nil {
+			continue
+		}
+		if acc == nil {
+			if acc, err = a.provisionExternalAccount(ctx, localpart, req.ServerName, profile); err != nil {
+				return err
+			}
+		}
+		res.Exists = true
+		res.Account = acc
+		return nil
+	}
+	return nil
+}
+
+// isExternalAccount returns true if the account was created by a password provider.
+func (a *UserInternalAPI) isExternalAccount(ctx context.Context, acc *api.Account) (bool, error) {
+	if acc.AccountType == api.AccountTypeAppService {
+		return false, nil
+	}
+	localpart, serverName, err := a.DB.GetLocalpartForSSO(ctx, passwordProviderIDPID, acc.UserID)
+	if err != nil {
+		return false, fmt.Errorf("a.DB.GetLocalpartForSSO: %w", err)
+	}
+	return localpart == acc.Localpart && serverName == acc.ServerName, nil
+}
+
+// provisionExternalAccount creates the account of a user whose password was checked by a
+// password provider, using their profile from the password provider.
+func (a *UserInternalAPI) provisionExternalAccount(ctx context.Context, localpart string, serverName spec.ServerName, profile *passwordproviders.Profile) (*api.Account, error) {
+	if err := internal.ValidateUsername(localpart, serverName); err != nil {
+		return nil, fmt.Errorf("cannot create an account for %q: %w", localpart, err)
+	}
+
+	var accRes api.PerformAccountCreationResponse
+	if err := a.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+		AccountType: api.AccountTypeUser,
+		Localpart:   localpart,
+		ServerName:  serverName,
+		OnConflict:  api.ConflictAbort,
+	}, &accRes); err != nil {
+		return nil, err
+	}
+	if err := a.DB.SaveSSOAssociation(ctx, passwordProviderIDPID, accRes.Account.UserID, localpart, serverName); err != nil {
+		return nil, fmt.Errorf("a.DB.SaveSSOAssociation: %w", err)
+	}
+
+	logger := util.GetLogger(ctx).WithField("user_id", accRes.Account.UserID)
+	if profile.DisplayName != "" {
+		if _, _, err := a.DB.SetDisplayName(ctx, localpart, serverName, profile.DisplayName); err != nil {
+			logger.WithError(err).Error("Failed to set display name of new account")
+		}
+	}
+	for _, email := range profile.Emails {
+		if err := a.DB.SaveThreePIDAssociation(ctx, strings.ToLower(email), localpart, serverName, "email"); err != nil {
+			logger.WithError(err).Warn("Failed to associate email address with new account")
+		}
+	}
+	logger.Info("Created account for user authenticated by password provider")
+	return accRes.Account, nil
+}
+
 func (a *UserInternalAPI) SetDisplayName(ctx context.Context, localpart string, serverName spec.ServerName, displayName string) (*authtypes.Profile, bool, error) {
 	return a.DB.SetDisplayName(ctx, localpart, serverName, displayName)
 }
@@ -977,6 +1157,28 @@ func (a *UserInternalAPI) PerformSaveThreePIDAssociation(ctx context.Context, re
 	return a.DB.SaveThreePIDAssociation(ctx, req.ThreePID, req.Localpart, req.ServerName, req.Medium)
 }
 
+func (a *UserInternalAPI) QueryLocalpartForSSO(ctx context.Context, req *api.QueryLocalpartForSSORequest, res *api.QueryLocalpartForSSOResponse) error {
+	localpart, domain, err := a.DB.GetLocalpartForSSO(ctx, req.IDPID, req.Subject)
+	if err != nil {
+		return err
+	}
+	res.Localpart = localpart
+	res.ServerName = domain
+	return nil
+}
+
+func (a *UserInternalAPI) PerformSaveSSOAssociation(ctx context.Context, req *api.PerformSaveSSOAssociationRequest, res *struct{}) error {
+	return a.DB.SaveSSOAssociation(ctx, req.IDPID, req.Subject, req.Localpart, req.ServerName)
+}
+
+// PerformSendEmail renders an email with the given template and queues it for sending.
+func (a *UserInternalAPI) PerformSendEmail(ctx context.Context, req *api.PerformSendEmailRequest) error {
+	if a.Mailer == nil {
+		return api.ErrEmailDisabled
+	}
+	return a.Mailer.Queue(ctx, req.To, req.Template, req.Data)
+}
+
 func (a *UserInternalAPI) RetrieveUserProfile(
 	ctx context.Context,
 	userID string,
@@ -986,9 +1188,32 @@ func (a *UserInternalAPI) RetrieveUserProfile(
 	if err == nil {
 		return profile, nil
 	}
+	if a.ASAPI == nil {
+		return nil, api.ErrProfileNotExists
+	}
+
+	// If no user exists, query the application services, which may
+	// create the user if it falls within one of their namespaces
+	userResp := &asAPI.UserIDExistsResponse{}
+	if err = a.ASAPI.UserIDExists(ctx, &asAPI.UserIDExistsRequest{UserID: userID}, userResp); err != nil {
+		return nil, err
+	}
+	if !userResp.UserIDExists {
+		return nil, api.ErrProfileNotExists
+	}
+
+	// Try to query the user from the local database again
+	profile, err = a.QueryProfile(ctx, userID)
+	if err != nil {
+		return nil, api.ErrProfileNotExists
+	}
+	return profile, nil
+}
 
-	// If no user exists, return
-	return nil, api.ErrProfileNotExists
+// SetAppserviceAPI passes in an appservice API reference so that profile
+// lookups for users in application service namespaces can be answered.
+func (a *UserInternalAPI) SetAppserviceAPI(asAPI asAPI.AppServiceInternalAPI) {
+	a.ASAPI = asAPI
 }
 
 const pushRulesAccountDataType = "m.push_rules"
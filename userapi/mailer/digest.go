@@ -0,0 +1,48 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mailer
+
+import "time"
+
+// NotificationDigest is the data the notification digest template is rendered with.
+type NotificationDigest struct {
+	// AppName and ServerName are filled in by the mailer.
+	AppName    string
+	ServerName string
+	// The user the notifications are for.
+	UserID      string
+	DisplayName string
+	// The number of unread notifications of the user, which may be more than the
+	// notifications in the digest.
+	UnreadCount int
+	// The rooms with notifications, in the order they should be listed.
+	Rooms []DigestRoom
+	// A link to stop receiving notifications by email.
+	UnsubscribeLink string
+}
+
+// DigestRoom lists the notifications in a single room.
+type DigestRoom struct {
+	Name          string
+	Link          string
+	Notifications []DigestNotification
+}
+
+// DigestNotification is a single notification in a digest.
+type DigestNotification struct {
+	Sender string
+	Body   string
+	TS     time.Time
+}
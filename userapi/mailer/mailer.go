@@ -0,0 +1,248 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mailer renders emails from templates and sends them through SMTP.
+// Emails are queued in the database before they are sent, so that they survive
+// restarts and are retried if the SMTP server is unavailable.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage"
+	"github.com/matrix-org/dendrite/userapi/types"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// sendBatchSize is the number of queued emails looked at for each database query
+	sendBatchSize = 50
+	// pollInterval is how often the queue is checked for emails which are due to be retried
+	pollInterval = time.Minute
+	// maxRetryInterval is the longest we wait before retrying to send an email
+	maxRetryInterval = 6 * time.Hour
+)
+
+// Mailer sends emails rendered from the configured templates.
+type Mailer struct {
+	cfg       *config.UserAPI
+	db        storage.EmailQueue
+	sender    Sender
+	templates templates
+	from      *mail.Address
+	wake      chan struct{}
+	// retryInterval is how long we wait before retrying to send an email the first
+	// time it fails. The interval doubles with every failed attempt.
+	retryInterval time.Duration
+}
+
+// NewMailer returns a mailer which sends queued email with the given sender.
+// Returns an error if the templates or the from address are invalid.
+func NewMailer(cfg *config.UserAPI, db storage.EmailQueue, sender Sender) (*Mailer, error) {
+	from, err := mail.ParseAddress(cfg.Email.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %q: %w", cfg.Email.From, err)
+	}
+	t, err := loadTemplates(string(cfg.Email.TemplateDir))
+	if err != nil {
+		return nil, err
+	}
+	return &Mailer{
+		cfg:           cfg,
+		db:            db,
+		sender:        sender,
+		templates:     t,
+		from:          from,
+		wake:          make(chan struct{}, 1),
+		retryInterval: time.Minute,
+	}, nil
+}
+
+// Start sends queued email in the background until the process shuts down.
+func (m *Mailer) Start(processCtx *process.ProcessContext) {
+	go func() {
+		ctx := processCtx.Context()
+		for {
+			more := m.sendDueEmails(ctx)
+			if more {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.wake:
+			case <-time.After(pollInterval):
+			}
+		}
+	}()
+}
+
+// Queue renders an email with the given template and queues it for sending.
+func (m *Mailer) Queue(ctx context.Context, to string, template api.EmailTemplate, data map[string]string) error {
+	templateData := map[string]string{
+		"AppName":    m.cfg.Email.AppName,
+		"ServerName": string(m.cfg.Matrix.ServerName),
+	}
+	for k, v := range data {
+		templateData[k] = v
+	}
+	return m.queue(ctx, to, template, templateData)
+}
+
+// QueueNotificationDigest renders a digest of missed notifications and queues it for sending.
+func (m *Mailer) QueueNotificationDigest(ctx context.Context, to string, digest *NotificationDigest) error {
+	digest.AppName = m.cfg.Email.AppName
+	digest.ServerName = string(m.cfg.Matrix.ServerName)
+	return m.queue(ctx, to, api.EmailTemplateNotificationDigest, digest)
+}
+
+func (m *Mailer) queue(ctx context.Context, to string, template api.EmailTemplate, data interface{}) error {
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid email address %q: %w", to, err)
+	}
+	subject, text, html, err := m.templates.render(template, data)
+	if err != nil {
+		return err
+	}
+	message, err := m.buildMessage(recipient, subject, text, html)
+	if err != nil {
+		return fmt.Errorf("failed to build message: %w", err)
+	}
+	if err = m.db.QueueEmail(ctx, recipient.Address, message); err != nil {
+		return fmt.Errorf("m.db.QueueEmail: %w", err)
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sendDueEmails tries to send a batch of emails which are due. Returns true if there
+// may be more emails which are due. If the queue can't be updated after sending an
+// email, that email is still due, so this returns false to wait before retrying
+// rather than sending the same batch again straight away.
+func (m *Mailer) sendDueEmails(ctx context.Context) bool {
+	emails, err := m.db.DueEmails(ctx, sendBatchSize)
+	if err != nil {
+		if ctx.Err() == nil {
+			logrus.WithError(err).Error("Failed to get queued emails")
+		}
+		return false
+	}
+	for _, email := range emails {
+		if ctx.Err() != nil {
+			return false
+		}
+		if !m.sendEmail(ctx, email) {
+			return false
+		}
+	}
+	return len(emails) == sendBatchSize
+}
+
+// sendEmail tries to send the email and updates the queue accordingly. Returns false
+// if the queue couldn't be updated.
+func (m *Mailer) sendEmail(ctx context.Context, email types.QueuedEmail) bool {
+	logger := logrus.WithField("email_id", email.ID)
+	err := m.sender.Send(ctx, m.from.Address, []string{email.Recipient}, email.Message)
+	if err == nil {
+		logger.Debug("Sent email")
+		if err = m.db.RemoveEmail(ctx, email.ID); err != nil {
+			logger.WithError(err).Error("Failed to remove sent email from the queue")
+			return false
+		}
+		return true
+	}
+
+	attempts := email.Attempts + 1
+	if attempts >= m.cfg.Email.MaxAttempts {
+		logger.WithError(err).Errorf("Failed to send email %d times, giving up", attempts)
+		if err = m.db.RemoveEmail(ctx, email.ID); err != nil {
+			logger.WithError(err).Error("Failed to remove email from the queue")
+			return false
+		}
+		return true
+	}
+	retryInterval := m.retryInterval << (attempts - 1)
+	if retryInterval > maxRetryInterval || retryInterval < 0 {
+		retryInterval = maxRetryInterval
+	}
+	logger.WithError(err).Warnf("Failed to send email, retrying in %s", retryInterval)
+	if err = m.db.UpdateEmailAttempts(ctx, email.ID, attempts, time.Now().Add(retryInterval)); err != nil {
+		logger.WithError(err).Error("Failed to update queued email")
+		return false
+	}
+	return true
+}
+
+// buildMessage returns a multipart message with a plain text and a HTML part.
+func (m *Mailer) buildMessage(to *mail.Address, subject, text, html string) ([]byte, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain", text},
+		{"text/html", html},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=UTF-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err = qw.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err = qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	for _, header := range [][2]string{
+		{"From", m.from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("UTF-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", util.RandomString(24), m.cfg.Matrix.ServerName)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", w.Boundary())},
+	} {
+		msg.WriteString(header[0] + ": " + header[1] + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
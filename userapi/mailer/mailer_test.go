@@ -0,0 +1,369 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage"
+	"github.com/matrix-org/dendrite/userapi/types"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+)
+
+type receivedEmail struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// smtpStandIn is a minimal SMTP server which accepts all email.
+type smtpStandIn struct {
+	addr     string
+	mu       sync.Mutex
+	received []receivedEmail
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	s := &smtpStandIn{addr: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) handle(conn net.Conn) {
+	c := textproto.NewConn(conn)
+	defer c.Close() // nolint:errcheck
+	_ = c.PrintfLine("220 localhost ESMTP")
+	var email receivedEmail
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			_ = c.PrintfLine("250-localhost")
+			_ = c.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			email.from = smtpPath(arg, "FROM:")
+			_ = c.PrintfLine("250 OK")
+		case "RCPT":
+			email.to = append(email.to, smtpPath(arg, "TO:"))
+			_ = c.PrintfLine("250 OK")
+		case "DATA":
+			_ = c.PrintfLine("354 Go ahead")
+			if email.data, err = c.ReadDotBytes(); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.received = append(s.received, email)
+			s.mu.Unlock()
+			email = receivedEmail{}
+			_ = c.PrintfLine("250 OK")
+		case "QUIT":
+			_ = c.PrintfLine("221 Bye")
+			return
+		default:
+			_ = c.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+// smtpPath returns the address of a MAIL or RCPT command, without any parameters.
+func smtpPath(arg, prefix string) string {
+	path, _, _ := strings.Cut(strings.TrimPrefix(arg, prefix), " ")
+	return strings.Trim(path, "<>")
+}
+
+func (s *smtpStandIn) emails() []receivedEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedEmail{}, s.received...)
+}
+
+type failingSender struct{}
+
+func (failingSender) Send(ctx context.Context, from string, to []string, message []byte) error {
+	return errors.New("SMTP server unavailable")
+}
+
+func testConfig(smtpServer string) *config.UserAPI {
+	cfg := &config.UserAPI{
+		Matrix: &config.Global{SigningIdentity: fclient.SigningIdentity{ServerName: "test"}},
+	}
+	cfg.Email.Defaults()
+	cfg.Email.Enabled = true
+	cfg.Email.SMTPServer = smtpServer
+	cfg.Email.RequireTLS = false
+	cfg.Email.From = "Dendrite <noreply@test>"
+	cfg.Email.MaxAttempts = 3
+	return cfg
+}
+
+func mustCreateDatabase(t *testing.T, dbType test.DBType) (storage.UserDatabase, func()) {
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.NewUserDatabase(context.Background(), cm, &config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, "test", 4, 0, 0, "")
+	if err != nil {
+		t.Fatalf("NewUserDatabase returned %s", err)
+	}
+	return db, close
+}
+
+func TestMailer(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, closeDB := mustCreateDatabase(t, dbType)
+		defer closeDB()
+		smtpServer := newSMTPStandIn(t)
+		cfg := testConfig(smtpServer.addr)
+
+		// The SMTP server is unavailable, so the email stays in the queue
+		m, err := NewMailer(cfg, db, failingSender{})
+		if err != nil {
+			t.Fatalf("failed to create mailer: %s", err)
+		}
+		m.retryInterval = 0
+		if err = m.Queue(ctx, "alice@example.com", api.EmailTemplateRegistrationValidation, map[string]string{
+			"Link": "https://test/validate?token=abc",
+		}); err != nil {
+			t.Fatalf("failed to queue email: %s", err)
+		}
+		m.sendDueEmails(ctx)
+		queued, err := db.DueEmails(ctx, 10)
+		if err != nil {
+			t.Fatalf("failed to get queued emails: %s", err)
+		}
+		if len(queued) != 1 || queued[0].Attempts != 1 {
+			t.Fatalf("expected 1 queued email with 1 attempt, got %+v", queued)
+		}
+
+		// A new mailer, e.g. after a restart, sends the queued email
+		m, err = NewMailer(cfg, db, NewSMTPSender(cfg))
+		if err != nil {
+			t.Fatalf("failed to create mailer: %s", err)
+		}
+		m.sendDueEmails(ctx)
+		if queued, err = db.DueEmails(ctx, 10); err != nil || len(queued) != 0 {
+			t.Fatalf("expected no queued emails, got %+v (err: %v)", queued, err)
+		}
+		emails := smtpServer.emails()
+		if len(emails) != 1 {
+			t.Fatalf("expected 1 email to be sent, got %d", len(emails))
+		}
+		if emails[0].from != "noreply@test" || len(emails[0].to) != 1 || emails[0].to[0] != "alice@example.com" {
+			t.Fatalf("unexpected envelope: from %s to %v", emails[0].from, emails[0].to)
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(emails[0].data))
+		if err != nil {
+			t.Fatalf("failed to parse email: %s", err)
+		}
+		subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		if err != nil || subject != "Validate your email address on test" {
+			t.Fatalf("unexpected subject %q (err: %v)", subject, err)
+		}
+		_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatalf("failed to parse content type: %s", err)
+		}
+		r := multipart.NewReader(msg.Body, params["boundary"])
+		for _, contentType := range []string{"text/plain", "text/html"} {
+			part, err := r.NextPart()
+			if err != nil {
+				t.Fatalf("failed to read %s part: %s", contentType, err)
+			}
+			if !strings.HasPrefix(part.Header.Get("Content-Type"), contentType) {
+				t.Fatalf("expected %s part, got %s", contentType, part.Header.Get("Content-Type"))
+			}
+			body, _ := io.ReadAll(part)
+			if !strings.Contains(string(body), "https://test/validate?token=abc") {
+				t.Errorf("expected %s part to contain the link, got %s", contentType, body)
+			}
+		}
+	})
+}
+
+func TestMailerGivesUp(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, closeDB := mustCreateDatabase(t, dbType)
+		defer closeDB()
+		cfg := testConfig("localhost:25")
+
+		m, err := NewMailer(cfg, db, failingSender{})
+		if err != nil {
+			t.Fatalf("failed to create mailer: %s", err)
+		}
+		m.retryInterval = 0
+		if err = m.Queue(ctx, "alice@example.com", api.EmailTemplateAccountNotice, map[string]string{
+			"Subject": "Your password was changed",
+			"Message": "The password of your account was changed.",
+		}); err != nil {
+			t.Fatalf("failed to queue email: %s", err)
+		}
+		for i := 1; i <= cfg.Email.MaxAttempts; i++ {
+			m.sendDueEmails(ctx)
+			queued, err := db.DueEmails(ctx, 10)
+			if err != nil {
+				t.Fatalf("failed to get queued emails: %s", err)
+			}
+			if i < cfg.Email.MaxAttempts && (len(queued) != 1 || queued[0].Attempts != i) {
+				t.Fatalf("expected 1 queued email with %d attempts, got %+v", i, queued)
+			}
+			if i == cfg.Email.MaxAttempts && len(queued) != 0 {
+				t.Fatalf("expected the email to be removed after %d attempts, got %+v", i, queued)
+			}
+		}
+	})
+}
+
+func TestMailerRetryBackoff(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, closeDB := mustCreateDatabase(t, dbType)
+		defer closeDB()
+
+		m, err := NewMailer(testConfig("localhost:25"), db, failingSender{})
+		if err != nil {
+			t.Fatalf("failed to create mailer: %s", err)
+		}
+		m.retryInterval = time.Hour
+		if err = m.Queue(ctx, "alice@example.com", api.EmailTemplateAccountNotice, nil); err != nil {
+			t.Fatalf("failed to queue email: %s", err)
+		}
+		m.sendDueEmails(ctx)
+		// The email isn't due again until the retry interval has passed
+		queued, err := db.DueEmails(ctx, 10)
+		if err != nil || len(queued) != 0 {
+			t.Fatalf("expected no emails to be due, got %+v (err: %v)", queued, err)
+		}
+	})
+}
+
+// brokenEmailQueue always returns a full batch of due emails, but can't update them.
+type brokenEmailQueue struct {
+	storage.EmailQueue
+}
+
+func (brokenEmailQueue) DueEmails(ctx context.Context, limit int) ([]types.QueuedEmail, error) {
+	emails := make([]types.QueuedEmail, limit)
+	for i := range emails {
+		emails[i] = types.QueuedEmail{ID: int64(i), Recipient: "alice@example.com"}
+	}
+	return emails, nil
+}
+
+func (brokenEmailQueue) RemoveEmail(ctx context.Context, id int64) error {
+	return errors.New("database unavailable")
+}
+
+func (brokenEmailQueue) UpdateEmailAttempts(ctx context.Context, id int64, attempts int, nextAttempt time.Time) error {
+	return errors.New("database unavailable")
+}
+
+type countingSender struct {
+	sent int
+}
+
+func (s *countingSender) Send(ctx context.Context, from string, to []string, message []byte) error {
+	s.sent++
+	return nil
+}
+
+func TestMailerBacksOffWhenQueueUpdateFails(t *testing.T) {
+	for name, sender := range map[string]Sender{
+		"sent":   &countingSender{},
+		"failed": failingSender{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m, err := NewMailer(testConfig("localhost:25"), brokenEmailQueue{}, sender)
+			if err != nil {
+				t.Fatalf("failed to create mailer: %s", err)
+			}
+			// The emails are still due, so sending them again straight away would
+			// send them twice.
+			if more := m.sendDueEmails(context.Background()); more {
+				t.Fatalf("expected the mailer to wait before retrying")
+			}
+			if s, ok := sender.(*countingSender); ok && s.sent != 1 {
+				t.Fatalf("expected the batch to stop after the first email, sent %d", s.sent)
+			}
+		})
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	dir := t.TempDir()
+	override := `{{define "subject"}}Custom notice for {{.ServerName}}{{end}}{{.Message}}`
+	if err := os.WriteFile(filepath.Join(dir, "account_notice.txt"), []byte(override), 0o644); err != nil {
+		t.Fatalf("failed to write template: %s", err)
+	}
+	tmpls, err := loadTemplates(dir)
+	if err != nil {
+		t.Fatalf("failed to load templates: %s", err)
+	}
+
+	subject, text, html, err := tmpls.render(api.EmailTemplateAccountNotice, map[string]string{
+		"ServerName": "test",
+		"Message":    "<b>hello</b>",
+	})
+	if err != nil {
+		t.Fatalf("failed to render template: %s", err)
+	}
+	if subject != "Custom notice for test" || text != "<b>hello</b>" {
+		t.Errorf("expected the overridden text template to be used, got subject %q, text %q", subject, text)
+	}
+	if !strings.Contains(html, "&lt;b&gt;hello&lt;/b&gt;") {
+		t.Errorf("expected the built-in HTML template to escape the message, got %s", html)
+	}
+
+	// The built-in templates are used if there is no override
+	subject, _, _, err = tmpls.render(api.EmailTemplateRegistrationValidation, map[string]string{"ServerName": "test"})
+	if err != nil || subject != "Validate your email address on test" {
+		t.Errorf("unexpected subject %q (err: %v)", subject, err)
+	}
+
+	if _, _, _, err = tmpls.render("unknown", nil); err == nil {
+		t.Errorf("expected an error for an unknown template")
+	}
+
+	// Templates must define a subject
+	if err = os.WriteFile(filepath.Join(dir, "account_notice.txt"), []byte(`{{.Message}}`), 0o644); err != nil {
+		t.Fatalf("failed to write template: %s", err)
+	}
+	if _, err = loadTemplates(dir); err == nil {
+		t.Errorf("expected an error for a template without a subject")
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// smtpTimeout is how long sending a single email may take
+const smtpTimeout = time.Minute
+
+// Sender delivers an email, which has already been rendered, to its recipients.
+type Sender interface {
+	Send(ctx context.Context, from string, to []string, message []byte) error
+}
+
+// SMTPSender sends email through the SMTP server configured in user_api.email.
+type SMTPSender struct {
+	cfg *config.UserAPI
+}
+
+func NewSMTPSender(cfg *config.UserAPI) *SMTPSender {
+	return &SMTPSender{cfg: cfg}
+}
+
+func (s *SMTPSender) Send(ctx context.Context, from string, to []string, message []byte) error {
+	cfg := &s.cfg.Email
+	host, _, err := net.SplitHostPort(cfg.SMTPServer)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP server %q: %w", cfg.SMTPServer, err)
+	}
+
+	dialer := net.Dialer{Timeout: smtpTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.SMTPServer)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the SMTP server: %w", err)
+	}
+	deadline := time.Now().Add(smtpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("smtp.NewClient: %w", err)
+	}
+	defer c.Close() // nolint:errcheck
+
+	if err = c.Hello(string(s.cfg.Matrix.ServerName)); err != nil {
+		return fmt.Errorf("c.Hello: %w", err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("c.StartTLS: %w", err)
+		}
+	} else if cfg.RequireTLS {
+		return fmt.Errorf("the SMTP server %s doesn't support STARTTLS", cfg.SMTPServer)
+	}
+	if cfg.SMTPUsername != "" {
+		if err = c.Auth(smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)); err != nil {
+			return fmt.Errorf("c.Auth: %w", err)
+		}
+	}
+
+	if err = c.Mail(from); err != nil {
+		return fmt.Errorf("c.Mail: %w", err)
+	}
+	for _, recipient := range to {
+		if err = c.Rcpt(recipient); err != nil {
+			return fmt.Errorf("c.Rcpt: %w", err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("c.Data: %w", err)
+	}
+	if _, err = w.Write(message); err != nil {
+		return fmt.Errorf("w.Write: %w", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("w.Close: %w", err)
+	}
+	return c.Quit()
+}
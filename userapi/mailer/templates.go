@@ -0,0 +1,113 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+//go:embed templates
+var defaultTemplates embed.FS
+
+// templateNames are the templates the mailer can render. Each template consists of
+// a <name>.txt file, which must define a "subject" template, and a <name>.html file.
+var templateNames = []api.EmailTemplate{
+	api.EmailTemplateRegistrationValidation,
+	api.EmailTemplateAccountNotice,
+	api.EmailTemplatePasswordReset,
+	api.EmailTemplateNotificationDigest,
+}
+
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+type templates map[api.EmailTemplate]emailTemplate
+
+// loadTemplates parses all email templates. Templates in dir override the built-in ones.
+func loadTemplates(dir string) (templates, error) {
+	t := make(templates, len(templateNames))
+	for _, name := range templateNames {
+		text, err := readTemplate(dir, string(name)+".txt")
+		if err != nil {
+			return nil, err
+		}
+		textTmpl, err := texttemplate.New(string(name)).Option("missingkey=zero").Parse(string(text))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template %s.txt: %w", name, err)
+		}
+		if textTmpl.Lookup("subject") == nil {
+			return nil, fmt.Errorf("template %s.txt doesn't define a subject", name)
+		}
+		html, err := readTemplate(dir, string(name)+".html")
+		if err != nil {
+			return nil, err
+		}
+		htmlTmpl, err := htmltemplate.New(string(name)).Option("missingkey=zero").Parse(string(html))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template %s.html: %w", name, err)
+		}
+		t[name] = emailTemplate{text: textTmpl, html: htmlTmpl}
+	}
+	return t, nil
+}
+
+func readTemplate(dir, file string) ([]byte, error) {
+	if dir != "" {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err == nil {
+			return data, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read template %s: %w", file, err)
+		}
+	}
+	return defaultTemplates.ReadFile("templates/" + file)
+}
+
+// render returns the subject, plain text and HTML body of an email.
+func (t templates) render(name api.EmailTemplate, data interface{}) (subject, text, html string, err error) {
+	tmpl, ok := t[name]
+	if !ok {
+		return "", "", "", fmt.Errorf("unknown email template %q", name)
+	}
+	var buf bytes.Buffer
+	if err = tmpl.text.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return "", "", "", fmt.Errorf("failed to render the subject of %s: %w", name, err)
+	}
+	// Headers can't contain line breaks
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+	buf.Reset()
+	if err = tmpl.text.Execute(&buf, data); err != nil {
+		return "", "", "", fmt.Errorf("failed to render %s.txt: %w", name, err)
+	}
+	text = buf.String()
+	buf.Reset()
+	if err = tmpl.html.Execute(&buf, data); err != nil {
+		return "", "", "", fmt.Errorf("failed to render %s.html: %w", name, err)
+	}
+	html = buf.String()
+	return subject, text, html, nil
+}
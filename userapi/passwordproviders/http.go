@@ -0,0 +1,105 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package passwordproviders
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// HTTPProvider checks passwords by POSTing them to an external service, using
+// the protocol of https://github.com/ma1uta/matrix-synapse-rest-password-provider
+type HTTPProvider struct {
+	cfg    *config.HTTPPasswordProvider
+	client *http.Client
+}
+
+type httpAuthRequest struct {
+	User struct {
+		ID       string `json:"id"`
+		Password string `json:"password"`
+	} `json:"user"`
+}
+
+type httpAuthResponse struct {
+	Auth struct {
+		Success bool   `json:"success"`
+		MXID    string `json:"mxid"`
+		Profile struct {
+			DisplayName string         `json:"display_name"`
+			ThreePIDs   []httpThreePID `json:"three_pids"`
+		} `json:"profile"`
+	} `json:"auth"`
+}
+
+type httpThreePID struct {
+	Medium  string `json:"medium"`
+	Address string `json:"address"`
+}
+
+func NewHTTPProvider(cfg *config.HTTPPasswordProvider) *HTTPProvider {
+	return &HTTPProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (p *HTTPProvider) CheckPassword(ctx context.Context, localpart string, serverName spec.ServerName, password string) (*Profile, error) {
+	userID := fmt.Sprintf("@%s:%s", localpart, serverName)
+	var body httpAuthRequest
+	body.User.ID = userID
+	body.User.Password = password
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to POST to %s: %w", p.cfg.URL, err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with HTTP %d", p.cfg.URL, resp.StatusCode)
+	}
+	var res httpAuthResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("failed to decode response from %s: %w", p.cfg.URL, err)
+	}
+	// The service may only vouch for the user we asked about.
+	if !res.Auth.Success || (res.Auth.MXID != "" && res.Auth.MXID != userID) {
+		return nil, nil
+	}
+
+	profile := &Profile{DisplayName: res.Auth.Profile.DisplayName}
+	for _, pid := range res.Auth.Profile.ThreePIDs {
+		if pid.Medium == "email" {
+			profile.Emails = append(profile.Emails, pid.Address)
+		}
+	}
+	return profile, nil
+}
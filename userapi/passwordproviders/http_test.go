@@ -0,0 +1,79 @@
+package passwordproviders
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestHTTPProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var body httpAuthRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var res httpAuthResponse
+		switch {
+		case body.User.ID == "@alice:test" && body.User.Password == "alicepassword":
+			res.Auth.Success = true
+			res.Auth.MXID = body.User.ID
+			res.Auth.Profile.DisplayName = "Alice"
+			res.Auth.Profile.ThreePIDs = []httpThreePID{
+				{Medium: "email", Address: "alice@example.com"},
+				{Medium: "msisdn", Address: "441234567890"},
+			}
+		case body.User.ID == "@bob:test" && body.User.Password == "bobpassword":
+			// vouches for a different user than asked for
+			res.Auth.Success = true
+			res.Auth.MXID = "@alice:test"
+		case body.User.ID == "@broken:test":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	defer srv.Close()
+
+	provider := NewHTTPProvider(&config.HTTPPasswordProvider{URL: srv.URL})
+	ctx := context.Background()
+
+	testCases := []struct {
+		name        string
+		localpart   string
+		password    string
+		wantProfile *Profile
+		wantErr     bool
+	}{
+		{
+			name:        "correct password",
+			localpart:   "alice",
+			password:    "alicepassword",
+			wantProfile: &Profile{DisplayName: "Alice", Emails: []string{"alice@example.com"}},
+		},
+		{name: "wrong password", localpart: "alice", password: "bobpassword"},
+		{name: "unknown user", localpart: "charlie", password: "alicepassword"},
+		{name: "different user ID", localpart: "bob", password: "bobpassword"},
+		{name: "server error", localpart: "broken", password: "password", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			profile, err := provider.CheckPassword(ctx, tc.localpart, "test", tc.password)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if !reflect.DeepEqual(profile, tc.wantProfile) {
+				t.Fatalf("expected profile %+v, got %+v", tc.wantProfile, profile)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package passwordproviders
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// ldapTimeout is how long we wait for the LDAP server to respond
+const ldapTimeout = 10 * time.Second
+
+// LDAPProvider checks passwords by binding to an LDAP server as the user.
+// The DN of the user is looked up by searching for an entry whose UID
+// attribute matches the localpart.
+type LDAPProvider struct {
+	cfg *config.LDAPPasswordProvider
+}
+
+func NewLDAPProvider(cfg *config.LDAPPasswordProvider) *LDAPProvider {
+	return &LDAPProvider{cfg: cfg}
+}
+
+func (p *LDAPProvider) CheckPassword(ctx context.Context, localpart string, serverName spec.ServerName, password string) (*Profile, error) {
+	// An empty password would result in an unauthenticated bind, which
+	// succeeds without checking anything.
+	if password == "" {
+		return nil, nil
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() // nolint: errcheck
+
+	if p.cfg.BindDN != "" {
+		if err = conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+			return nil, fmt.Errorf("failed to bind as %q: %w", p.cfg.BindDN, err)
+		}
+	}
+
+	filter := fmt.Sprintf("(%s=%s)", ldap.EscapeFilter(p.cfg.UIDAttribute), ldap.EscapeFilter(localpart))
+	if p.cfg.Filter != "" {
+		filter = fmt.Sprintf("(&%s%s)", filter, p.cfg.Filter)
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		p.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout.Seconds()), false,
+		filter, []string{p.cfg.DisplayNameAttribute, p.cfg.EmailAttribute}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for %q: %w", localpart, err)
+	}
+	// Refuse to guess which entry is meant if the localpart is ambiguous.
+	if len(res.Entries) != 1 {
+		return nil, nil
+	}
+	entry := res.Entries[0]
+
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to bind as %q: %w", entry.DN, err)
+	}
+
+	return &Profile{
+		DisplayName: entry.GetAttributeValue(p.cfg.DisplayNameAttribute),
+		Emails:      entry.GetAttributeValues(p.cfg.EmailAttribute),
+	}, nil
+}
+
+func (p *LDAPProvider) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(p.cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ldap.DialURL(p.cfg.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", p.cfg.URL, err)
+	}
+	conn.SetTimeout(ldapTimeout)
+	if p.cfg.StartTLS && u.Scheme == "ldap" {
+		if err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close() // nolint: errcheck
+			return nil, fmt.Errorf("failed to start TLS with %s: %w", p.cfg.URL, err)
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,221 @@
+package passwordproviders
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"regexp"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+type ldapEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// ldapStandIn is a minimal LDAP server which supports simple binds and searches
+// with filters made of equality matches joined by "&".
+type ldapStandIn struct {
+	url          string
+	bindDN       string
+	bindPassword string
+	entries      []ldapEntry
+}
+
+var ldapFilterMatchRegex = regexp.MustCompile(`\(([^()&=]+)=([^()]*)\)`)
+
+func newLDAPStandIn(t *testing.T, bindDN, bindPassword string, entries []ldapEntry) *ldapStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	s := &ldapStandIn{url: "ldap://" + l.Addr().String(), bindDN: bindDN, bindPassword: bindPassword, entries: entries}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ldapStandIn) serve(conn net.Conn) {
+	defer conn.Close() // nolint: errcheck
+	var boundDN string
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		msgID := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if dn == s.bindDN && password == s.bindPassword {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, e := range s.entries {
+				if dn == e.dn && password == e.password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			if code == ldap.LDAPResultSuccess {
+				boundDN = dn
+			}
+			s.write(conn, msgID, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			if s.bindDN != "" && boundDN != s.bindDN {
+				s.write(conn, msgID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights))
+				continue
+			}
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+			for _, e := range s.entries {
+				if !e.matches(filter) {
+					continue
+				}
+				res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+				attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for name, values := range e.attrs {
+					attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, v := range values {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+					}
+					attr.AppendChild(set)
+					attrs.AppendChild(attr)
+				}
+				res.AppendChild(attrs)
+				s.write(conn, msgID, res)
+			}
+			s.write(conn, msgID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default: // e.g. unbind
+			return
+		}
+	}
+}
+
+func (s *ldapStandIn) write(conn net.Conn, msgID int64, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, ""))
+	packet.AppendChild(op)
+	_, _ = conn.Write(packet.Bytes())
+}
+
+func ldapResult(tag ber.Tag, code uint16) *ber.Packet {
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return res
+}
+
+func (e ldapEntry) matches(filter string) bool {
+	for _, m := range ldapFilterMatchRegex.FindAllStringSubmatch(filter, -1) {
+		found := false
+		for _, v := range e.attrs[m[1]] {
+			if v == m[2] {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLDAPProvider(t *testing.T) {
+	server := newLDAPStandIn(t, "cn=admin,dc=example,dc=com", "adminpassword", []ldapEntry{
+		{
+			dn:       "uid=alice,ou=users,dc=example,dc=com",
+			password: "alicepassword",
+			attrs: map[string][]string{
+				"uid":      {"alice"},
+				"cn":       {"Alice Liddell"},
+				"mail":     {"alice@example.com"},
+				"memberOf": {"cn=matrix,ou=groups,dc=example,dc=com"},
+			},
+		},
+		{
+			dn:       "uid=bob,ou=users,dc=example,dc=com",
+			password: "bobpassword",
+			attrs:    map[string][]string{"uid": {"bob"}, "cn": {"Bob"}},
+		},
+	})
+
+	cfg := &config.LDAPPasswordProvider{
+		URL:                  server.url,
+		BindDN:               "cn=admin,dc=example,dc=com",
+		BindPassword:         "adminpassword",
+		BaseDN:               "ou=users,dc=example,dc=com",
+		Filter:               "(memberOf=cn=matrix,ou=groups,dc=example,dc=com)",
+		UIDAttribute:         "uid",
+		DisplayNameAttribute: "cn",
+		EmailAttribute:       "mail",
+	}
+	provider := NewLDAPProvider(cfg)
+	ctx := context.Background()
+
+	testCases := []struct {
+		name        string
+		localpart   string
+		password    string
+		wantProfile *Profile
+	}{
+		{
+			name:        "correct password",
+			localpart:   "alice",
+			password:    "alicepassword",
+			wantProfile: &Profile{DisplayName: "Alice Liddell", Emails: []string{"alice@example.com"}},
+		},
+		{name: "wrong password", localpart: "alice", password: "bobpassword"},
+		{name: "empty password", localpart: "alice", password: ""},
+		{name: "unknown user", localpart: "charlie", password: "alicepassword"},
+		{name: "user not matching the filter", localpart: "bob", password: "bobpassword"},
+		{name: "filter injection", localpart: "*", password: "alicepassword"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			profile, err := provider.CheckPassword(ctx, tc.localpart, "test", tc.password)
+			if err != nil {
+				t.Fatalf("failed to check password: %s", err)
+			}
+			if !reflect.DeepEqual(profile, tc.wantProfile) {
+				t.Fatalf("expected profile %+v, got %+v", tc.wantProfile, profile)
+			}
+		})
+	}
+
+	t.Run("wrong bind credentials", func(t *testing.T) {
+		c := *cfg
+		c.BindPassword = "wrong"
+		if _, err := NewLDAPProvider(&c).CheckPassword(ctx, "alice", "test", "alicepassword"); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+
+	t.Run("server unavailable", func(t *testing.T) {
+		c := *cfg
+		c.URL = "ldap://127.0.0.1:1"
+		if _, err := NewLDAPProvider(&c).CheckPassword(ctx, "alice", "test", "alicepassword"); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package passwordproviders checks passwords against external sources of
+// users, such as an LDAP directory or an HTTP authentication service.
+package passwordproviders
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// Provider checks the password of a user against an external source of users.
+type Provider interface {
+	// CheckPassword returns the profile of the user if the password is correct,
+	// or nil if the user doesn't exist or the password is wrong.
+	CheckPassword(ctx context.Context, localpart string, serverName spec.ServerName, password string) (*Profile, error)
+}
+
+// Profile is the profile of a user as known to a password provider. It is
+// used to set up the account of the user when they log in for the first time.
+type Profile struct {
+	DisplayName string
+	Emails      []string
+}
+
+// NewProviders returns the configured password providers, in the order they
+// should be asked.
+func NewProviders(cfg []config.PasswordProvider) ([]Provider, error) {
+	providers := make([]Provider, 0, len(cfg))
+	for i := range cfg {
+		switch cfg[i].Type {
+		case "ldap":
+			providers = append(providers, NewLDAPProvider(&cfg[i].LDAP))
+		case "http":
+			providers = append(providers, NewHTTPProvider(&cfg[i].HTTP))
+		default:
+			return nil, fmt.Errorf("unknown password provider type %q", cfg[i].Type)
+		}
+	}
+	return providers, nil
+}
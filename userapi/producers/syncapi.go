@@ -71,11 +71,26 @@ func (p *SyncAPI) GetAndSendNotificationData(ctx context.Context, userID, roomID
 		return err
 	}
 
-	return p.sendNotificationData(userID, &eventutil.NotificationData{
+	threadCounts, err := p.db.GetRoomThreadNotificationCounts(ctx, localpart, domain, roomID)
+	if err != nil {
+		return err
+	}
+
+	data := &eventutil.NotificationData{
 		RoomID:                  roomID,
 		UnreadHighlightCount:    int(nhighlight),
 		UnreadNotificationCount: int(ntotal),
-	})
+	}
+	if len(threadCounts) > 0 {
+		data.UnreadThreadNotifications = make(map[string]eventutil.ThreadNotificationData, len(threadCounts))
+		for threadID, counts := range threadCounts {
+			data.UnreadThreadNotifications[threadID] = eventutil.ThreadNotificationData{
+				UnreadHighlightCount:    int(counts.Highlight),
+				UnreadNotificationCount: int(counts.Total),
+			}
+		}
+	}
+	return p.sendNotificationData(userID, data)
 }
 
 // sendNotificationData sends data about unread notifications to the Sync API server.
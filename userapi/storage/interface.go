@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
@@ -81,8 +82,14 @@ type Device interface {
 	// and replaced with the given accessToken. If the given accessToken is already in use for another device,
 	// an error will be returned.
 	// If no device ID is given one is generated.
+	// If a refresh token is given, the access token expires at accessTokenExpiresTS and can be
+	// refreshed with the refresh token.
 	// Returns the device on success.
-	CreateDevice(ctx context.Context, localpart string, serverName spec.ServerName, deviceID *string, accessToken string, displayName *string, ipAddr, userAgent string) (dev *api.Device, returnErr error)
+	CreateDevice(ctx context.Context, localpart string, serverName spec.ServerName, deviceID *string, accessToken, refreshToken string, accessTokenExpiresTS int64, displayName *string, ipAddr, userAgent string) (dev *api.Device, returnErr error)
+	// RefreshDeviceTokens replaces the tokens of the device with the given refresh token.
+	// The refresh token which was used stays valid until the new tokens are used.
+	// Returns sql.ErrNoRows if the refresh token isn't valid.
+	RefreshDeviceTokens(ctx context.Context, refreshToken, newAccessToken, newRefreshToken string, accessTokenExpiresTS int64) (*api.Device, error)
 	UpdateDevice(ctx context.Context, localpart string, serverName spec.ServerName, deviceID string, displayName *string) error
 	UpdateDeviceLastSeen(ctx context.Context, localpart string, serverName spec.ServerName, deviceID, ipAddr, userAgent string) error
 	RemoveDevices(ctx context.Context, localpart string, serverName spec.ServerName, devices []string) error
@@ -123,6 +130,10 @@ type Pusher interface {
 	GetPushers(ctx context.Context, localpart string, serverName spec.ServerName) ([]api.Pusher, error)
 	RemovePusher(ctx context.Context, appid, pushkey, localpart string, serverName spec.ServerName) error
 	RemovePushers(ctx context.Context, appid, pushkey string) error
+	// GetEmailPushers returns the email pushers of all users.
+	GetEmailPushers(ctx context.Context) ([]api.EmailPusher, error)
+	// SetPusherLastNotificationID records the last notification which was emailed to an email pusher.
+	SetPusherLastNotificationID(ctx context.Context, appid, pushkey, localpart string, serverName spec.ServerName, id int64) error
 }
 
 type ThreePID interface {
@@ -132,6 +143,22 @@ type ThreePID interface {
 	GetThreePIDsForLocalpart(ctx context.Context, localpart string, serverName spec.ServerName) (threepids []authtypes.ThreePID, err error)
 }
 
+type SSO interface {
+	// SaveSSOAssociation saves which local user an identity at an identity provider belongs to.
+	// Returns ErrSSOIdentityInUse if the identity already belongs to a user.
+	SaveSSOAssociation(ctx context.Context, idpID, subject, localpart string, serverName spec.ServerName) error
+	// GetLocalpartForSSO returns the local user an identity at an identity provider belongs to,
+	// or an empty localpart if it doesn't belong to anyone.
+	GetLocalpartForSSO(ctx context.Context, idpID, subject string) (localpart string, serverName spec.ServerName, err error)
+}
+
+type RateLimitOverrides interface {
+	// GetRateLimitOverride returns the rate limit override for a user, or nil if there is none.
+	GetRateLimitOverride(ctx context.Context, localpart string, serverName spec.ServerName) (*api.RateLimitOverride, error)
+	SetRateLimitOverride(ctx context.Context, localpart string, serverName spec.ServerName, threshold, cooloffMS int64) error
+	DeleteRateLimitOverride(ctx context.Context, localpart string, serverName spec.ServerName) error
+}
+
 type Notification interface {
 	InsertNotification(ctx context.Context, localpart string, serverName spec.ServerName, eventID string, pos uint64, tweaks map[string]interface{}, n *api.Notification) error
 	DeleteNotificationsUpTo(ctx context.Context, localpart string, serverName spec.ServerName, roomID string, pos uint64) (affected bool, err error)
@@ -139,19 +166,34 @@ type Notification interface {
 	GetNotifications(ctx context.Context, localpart string, serverName spec.ServerName, fromID int64, limit int, filter tables.NotificationFilter) ([]*api.Notification, int64, error)
 	GetNotificationCount(ctx context.Context, localpart string, serverName spec.ServerName, filter tables.NotificationFilter) (int64, error)
 	GetRoomNotificationCounts(ctx context.Context, localpart string, serverName spec.ServerName, roomID string) (total int64, highlight int64, _ error)
+	GetRoomThreadNotificationCounts(ctx context.Context, localpart string, serverName spec.ServerName, roomID string) (map[string]api.ThreadNotificationCounts, error)
 	DeleteOldNotifications(ctx context.Context) error
 }
 
+type EmailQueue interface {
+	// QueueEmail stores an email, so that the mailer sends it as soon as possible.
+	QueueEmail(ctx context.Context, recipient string, message []byte) error
+	// DueEmails returns up to limit emails which are due to be sent, oldest first.
+	DueEmails(ctx context.Context, limit int) ([]types.QueuedEmail, error)
+	// UpdateEmailAttempts records that sending an email failed, and when to try again.
+	UpdateEmailAttempts(ctx context.Context, id int64, attempts int, nextAttempt time.Time) error
+	// RemoveEmail removes an email from the queue, once it has been sent or we gave up on it.
+	RemoveEmail(ctx context.Context, id int64) error
+}
+
 type UserDatabase interface {
 	Account
 	AccountData
 	Device
+	EmailQueue
 	KeyBackup
 	LoginToken
 	Notification
 	OpenID
 	Profile
 	Pusher
+	RateLimitOverrides
+	SSO
 	Statistics
 	ThreePID
 	RegistrationTokens
@@ -175,6 +217,12 @@ type KeyDatabase interface {
 	// OneTimeKeysCount returns a count of all OTKs for this device.
 	OneTimeKeysCount(ctx context.Context, userID, deviceID string) (*api.OneTimeKeysCount, error)
 
+	// StoreFallbackKeys persists the given fallback keys, replacing any existing fallback key for the same algorithm.
+	StoreFallbackKeys(ctx context.Context, keys api.OneTimeKeys) error
+
+	// UnusedFallbackKeyAlgorithms returns the algorithms of the fallback keys for this device which haven't been claimed yet.
+	UnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error)
+
 	// DeviceKeysJSON populates the KeyJSON for the given keys. If any proided `keys` have a `KeyJSON` or `StreamID` already then it will be replaced.
 	DeviceKeysJSON(ctx context.Context, keys []api.DeviceMessage) error
 
@@ -202,6 +250,7 @@ type KeyDatabase interface {
 
 	// ClaimKeys based on the 3-uple of user_id, device_id and algorithm name. Returns the keys claimed. Returns no error if a key
 	// cannot be claimed or if none exist for this (user, device, algorithm), instead it is omitted from the returned slice.
+	// Falls back to the device's fallback key for the algorithm once it has run out of one-time keys.
 	ClaimKeys(ctx context.Context, userToDeviceToAlgorithm map[string]map[string]string) ([]api.OneTimeKeys, error)
 
 	// KeyChanges returns a list of user IDs who have modified their keys from the offset given (exclusive) to the offset given (inclusive).
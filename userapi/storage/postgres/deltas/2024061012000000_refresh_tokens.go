@@ -0,0 +1,47 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpRefreshTokens(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE userapi_devices ADD COLUMN IF NOT EXISTS refresh_token TEXT;
+ALTER TABLE userapi_devices ADD COLUMN IF NOT EXISTS previous_refresh_token TEXT;
+ALTER TABLE userapi_devices ADD COLUMN IF NOT EXISTS access_token_expires_ts BIGINT NOT NULL DEFAULT 0;
+CREATE UNIQUE INDEX IF NOT EXISTS userapi_device_refresh_token_idx ON userapi_devices(refresh_token);
+CREATE INDEX IF NOT EXISTS userapi_device_previous_refresh_token_idx ON userapi_devices(previous_refresh_token);`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownRefreshTokens(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+	DROP INDEX IF EXISTS userapi_device_refresh_token_idx;
+	DROP INDEX IF EXISTS userapi_device_previous_refresh_token_idx;
+	ALTER TABLE userapi_devices DROP COLUMN refresh_token;
+	ALTER TABLE userapi_devices DROP COLUMN previous_refresh_token;
+	ALTER TABLE userapi_devices DROP COLUMN access_token_expires_ts;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
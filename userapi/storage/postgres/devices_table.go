@@ -61,7 +61,14 @@ CREATE TABLE IF NOT EXISTS userapi_devices (
 	-- The last seen IP address of this device
 	ip TEXT,
 	-- User agent of this device
-	user_agent TEXT
+	user_agent TEXT,
+	-- The refresh token of this device, if the client supports refreshing its access token.
+	refresh_token TEXT,
+	-- The refresh token which was used to refresh the access token. It stays valid until
+	-- the new tokens are used, in case the client didn't receive them.
+	previous_refresh_token TEXT,
+	-- When the access token expires, as a unix timestamp (ms resolution), or 0 if it never expires.
+	access_token_expires_ts BIGINT NOT NULL DEFAULT 0
                                           
     -- TODO: device keys, device display names, token restrictions (if 3rd-party OAuth app)
 );
@@ -75,7 +82,19 @@ const insertDeviceSQL = "" +
 	" RETURNING session_id"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart, server_name FROM userapi_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, server_name, access_token_expires_ts, previous_refresh_token IS NOT NULL" +
+	" FROM userapi_devices WHERE access_token = $1"
+
+const selectDeviceByRefreshTokenSQL = "" +
+	"SELECT session_id, device_id, localpart, server_name FROM userapi_devices" +
+	" WHERE refresh_token = $1 OR previous_refresh_token = $2"
+
+const updateDeviceTokensSQL = "" +
+	"UPDATE userapi_devices SET access_token = $1, refresh_token = $2, previous_refresh_token = NULLIF($3, ''), access_token_expires_ts = $4" +
+	" WHERE localpart = $5 AND server_name = $6 AND device_id = $7"
+
+const deletePreviousRefreshTokenSQL = "" +
+	"UPDATE userapi_devices SET previous_refresh_token = NULL WHERE access_token = $1"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name, last_seen_ts, ip FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id = $3"
@@ -109,6 +128,9 @@ type devicesStatements struct {
 	selectDevicesByIDStmt        *sql.Stmt
 	updateDeviceNameStmt         *sql.Stmt
 	updateDeviceLastSeenStmt     *sql.Stmt
+	selectDeviceByRefreshStmt    *sql.Stmt
+	updateDeviceTokensStmt       *sql.Stmt
+	deletePreviousRefreshStmt    *sql.Stmt
 	deleteDeviceStmt             *sql.Stmt
 	deleteDevicesByLocalpartStmt *sql.Stmt
 	deleteDevicesStmt            *sql.Stmt
@@ -127,6 +149,9 @@ func NewPostgresDevicesTable(db *sql.DB, serverName spec.ServerName) (tables.Dev
 	m.AddMigrations(sqlutil.Migration{
 		Version: "userapi: add last_seen_ts",
 		Up:      deltas.UpLastSeenTSIP,
+	}, sqlutil.Migration{
+		Version: "userapi: add refresh tokens",
+		Up:      deltas.UpRefreshTokens,
 	})
 	err = m.Up(context.Background())
 	if err != nil {
@@ -143,6 +168,9 @@ func NewPostgresDevicesTable(db *sql.DB, serverName spec.ServerName) (tables.Dev
 		{&s.deleteDevicesStmt, deleteDevicesSQL},
 		{&s.selectDevicesByIDStmt, selectDevicesByIDSQL},
 		{&s.updateDeviceLastSeenStmt, updateDeviceLastSeen},
+		{&s.selectDeviceByRefreshStmt, selectDeviceByRefreshTokenSQL},
+		{&s.updateDeviceTokensStmt, updateDeviceTokensSQL},
+		{&s.deletePreviousRefreshStmt, deletePreviousRefreshTokenSQL},
 	}.Prepare(db)
 }
 
@@ -227,21 +255,63 @@ func (s *devicesStatements) UpdateDeviceName(
 	return err
 }
 
+// SelectDeviceByToken returns the device with the given access token, and whether
+// the previous refresh token of the device is still valid.
 func (s *devicesStatements) SelectDeviceByToken(
 	ctx context.Context, accessToken string,
-) (*api.Device, error) {
+) (*api.Device, bool, error) {
 	var dev api.Device
 	var localpart string
 	var serverName spec.ServerName
+	var hasPreviousRefreshToken bool
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &serverName)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(
+		&dev.SessionID, &dev.ID, &localpart, &serverName, &dev.AccessTokenExpiresTS, &hasPreviousRefreshToken,
+	)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, serverName)
 		dev.AccessToken = accessToken
 	}
+	return &dev, hasPreviousRefreshToken, err
+}
+
+// SelectDeviceByRefreshToken returns the device with the given current or previous
+// refresh token.
+func (s *devicesStatements) SelectDeviceByRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken string,
+) (*api.Device, error) {
+	var dev api.Device
+	var localpart string
+	var serverName spec.ServerName
+	stmt := sqlutil.TxStmt(txn, s.selectDeviceByRefreshStmt)
+	err := stmt.QueryRowContext(ctx, refreshToken, refreshToken).Scan(&dev.SessionID, &dev.ID, &localpart, &serverName)
+	if err == nil {
+		dev.UserID = userutil.MakeUserID(localpart, serverName)
+	}
 	return &dev, err
 }
 
+// UpdateDeviceTokens replaces the tokens of a device.
+func (s *devicesStatements) UpdateDeviceTokens(
+	ctx context.Context, txn *sql.Tx,
+	localpart string, serverName spec.ServerName, deviceID string,
+	accessToken, refreshToken, previousRefreshToken string, accessTokenExpiresTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceTokensStmt)
+	_, err := stmt.ExecContext(ctx, accessToken, refreshToken, previousRefreshToken, accessTokenExpiresTS, localpart, serverName, deviceID)
+	return err
+}
+
+// DeletePreviousRefreshToken revokes the previous refresh token of the device with
+// the given access token.
+func (s *devicesStatements) DeletePreviousRefreshToken(
+	ctx context.Context, txn *sql.Tx, accessToken string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deletePreviousRefreshStmt)
+	_, err := stmt.ExecContext(ctx, accessToken)
+	return err
+}
+
 // selectDeviceByID retrieves a device from the database with the given user
 // localpart and deviceID
 func (s *devicesStatements) SelectDeviceByID(
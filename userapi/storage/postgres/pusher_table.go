@@ -24,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/postgres/deltas"
 	"github.com/matrix-org/dendrite/userapi/storage/tables"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
@@ -44,7 +45,9 @@ CREATE TABLE IF NOT EXISTS userapi_pushers (
 	pushkey TEXT NOT NULL,
 	pushkey_ts_ms BIGINT NOT NULL DEFAULT 0,
 	lang TEXT NOT NULL,
-	data TEXT NOT NULL
+	data TEXT NOT NULL,
+	-- The ID of the last notification which was emailed, for email pushers
+	last_notification_id BIGINT NOT NULL DEFAULT 0
 );
 
 -- For faster deleting by app_id, pushkey pair.
@@ -71,17 +74,34 @@ const deletePusherSQL = "" +
 const deletePushersByAppIdAndPushKeySQL = "" +
 	"DELETE FROM userapi_pushers WHERE app_id = $1 AND pushkey = $2"
 
+const selectPushersByKindSQL = "" +
+	"SELECT localpart, server_name, session_id, pushkey, pushkey_ts_ms, kind, app_id, app_display_name, device_display_name, profile_tag, lang, data, last_notification_id FROM userapi_pushers WHERE kind = $1"
+
+const updatePusherLastNotificationIDSQL = "" +
+	"UPDATE userapi_pushers SET last_notification_id = $1 WHERE app_id = $2 AND pushkey = $3 AND localpart = $4 AND server_name = $5"
+
 func NewPostgresPusherTable(db *sql.DB) (tables.PusherTable, error) {
 	s := &pushersStatements{}
 	_, err := db.Exec(pushersSchema)
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "userapi: add pusher last notification id",
+		Up:      deltas.UpPusherLastNotificationID,
+		Down:    deltas.DownPusherLastNotificationID,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	return s, sqlutil.StatementList{
 		{&s.insertPusherStmt, insertPusherSQL},
 		{&s.selectPushersStmt, selectPushersSQL},
 		{&s.deletePusherStmt, deletePusherSQL},
 		{&s.deletePushersByAppIdAndPushKeyStmt, deletePushersByAppIdAndPushKeySQL},
+		{&s.selectPushersByKindStmt, selectPushersByKindSQL},
+		{&s.updateLastNotificationIDStmt, updatePusherLastNotificationIDSQL},
 	}.Prepare(db)
 }
 
@@ -90,6 +110,8 @@ type pushersStatements struct {
 	selectPushersStmt                  *sql.Stmt
 	deletePusherStmt                   *sql.Stmt
 	deletePushersByAppIdAndPushKeyStmt *sql.Stmt
+	selectPushersByKindStmt            *sql.Stmt
+	updateLastNotificationIDStmt       *sql.Stmt
 }
 
 // insertPusher creates a new pusher.
@@ -159,3 +181,49 @@ func (s *pushersStatements) DeletePushers(
 	_, err := sqlutil.TxStmt(txn, s.deletePushersByAppIdAndPushKeyStmt).ExecContext(ctx, appid, pushkey)
 	return err
 }
+
+// SelectPushersByKind returns the pushers of all users with the given kind.
+func (s *pushersStatements) SelectPushersByKind(
+	ctx context.Context, txn *sql.Tx, kind api.PusherKind,
+) ([]api.EmailPusher, error) {
+	var pushers []api.EmailPusher
+	rows, err := sqlutil.TxStmt(txn, s.selectPushersByKindStmt).QueryContext(ctx, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPushersByKind: rows.close() failed")
+
+	for rows.Next() {
+		var pusher api.EmailPusher
+		var data []byte
+		err = rows.Scan(
+			&pusher.Localpart,
+			&pusher.ServerName,
+			&pusher.SessionID,
+			&pusher.PushKey,
+			&pusher.PushKeyTS,
+			&pusher.Kind,
+			&pusher.AppID,
+			&pusher.AppDisplayName,
+			&pusher.DeviceDisplayName,
+			&pusher.ProfileTag,
+			&pusher.Language,
+			&data,
+			&pusher.LastNotificationID)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &pusher.Data); err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, pusher)
+	}
+	return pushers, rows.Err()
+}
+
+func (s *pushersStatements) UpdateLastNotificationID(
+	ctx context.Context, txn *sql.Tx, appid, pushkey, localpart string, serverName spec.ServerName, id int64,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateLastNotificationIDStmt).ExecContext(ctx, id, appid, pushkey, localpart, serverName)
+	return err
+}
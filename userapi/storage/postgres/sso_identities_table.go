@@ -0,0 +1,84 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const ssoIdentitiesSchema = `
+-- Stores which local user an identity at a single sign-on identity provider belongs to
+CREATE TABLE IF NOT EXISTS userapi_sso_identities (
+	-- The ID of the identity provider, as configured in client_api.sso
+	idp_id TEXT NOT NULL,
+	-- The identifier of the user at the identity provider, e.g. the OpenID Connect "sub" claim
+	subject TEXT NOT NULL,
+	-- The localpart of the Matrix user ID associated to this identity
+	localpart TEXT NOT NULL,
+	server_name TEXT NOT NULL,
+
+	PRIMARY KEY(idp_id, subject)
+);
+
+CREATE INDEX IF NOT EXISTS userapi_sso_identities_idx ON userapi_sso_identities(localpart, server_name);
+`
+
+const selectLocalpartForSSOIdentitySQL = "" +
+	"SELECT localpart, server_name FROM userapi_sso_identities WHERE idp_id = $1 AND subject = $2"
+
+const insertSSOIdentitySQL = "" +
+	"INSERT INTO userapi_sso_identities (idp_id, subject, localpart, server_name) VALUES ($1, $2, $3, $4)"
+
+type ssoIdentitiesStatements struct {
+	selectLocalpartForSSOIdentityStmt *sql.Stmt
+	insertSSOIdentityStmt             *sql.Stmt
+}
+
+func NewPostgresSSOIdentitiesTable(db *sql.DB) (tables.SSOIdentitiesTable, error) {
+	s := &ssoIdentitiesStatements{}
+	_, err := db.Exec(ssoIdentitiesSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.selectLocalpartForSSOIdentityStmt, selectLocalpartForSSOIdentitySQL},
+		{&s.insertSSOIdentityStmt, insertSSOIdentitySQL},
+	}.Prepare(db)
+}
+
+func (s *ssoIdentitiesStatements) SelectLocalpartForSSOIdentity(
+	ctx context.Context, txn *sql.Tx, idpID, subject string,
+) (localpart string, serverName spec.ServerName, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectLocalpartForSSOIdentityStmt)
+	err = stmt.QueryRowContext(ctx, idpID, subject).Scan(&localpart, &serverName)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return
+}
+
+func (s *ssoIdentitiesStatements) InsertSSOIdentity(
+	ctx context.Context, txn *sql.Tx, idpID, subject,
+	localpart string, serverName spec.ServerName,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.insertSSOIdentityStmt)
+	_, err = stmt.ExecContext(ctx, idpID, subject, localpart, serverName)
+	return
+}
@@ -105,6 +105,18 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresStatsTable: %w", err)
 	}
+	emailQueueTable, err := NewPostgresEmailQueueTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresEmailQueueTable: %w", err)
+	}
+	ssoIdentitiesTable, err := NewPostgresSSOIdentitiesTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresSSOIdentitiesTable: %w", err)
+	}
+	rateLimitOverridesTable, err := NewPostgresRateLimitOverridesTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresRateLimitOverridesTable: %w", err)
+	}
 
 	m = sqlutil.NewMigrator(db)
 	m.AddMigrations(sqlutil.Migration{
@@ -131,6 +143,9 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 		Notifications:         notificationsTable,
 		RegistrationTokens:    registationTokensTable,
 		Stats:                 statsTable,
+		EmailQueue:            emailQueueTable,
+		SSOIdentities:         ssoIdentitiesTable,
+		RateLimitOverrides:    rateLimitOverridesTable,
 		ServerName:            serverName,
 		DB:                    db,
 		Writer:                writer,
@@ -149,6 +164,10 @@ func NewKeyDatabase(conMan *sqlutil.Connections, dbProperties *config.DatabaseOp
 	if err != nil {
 		return nil, err
 	}
+	fk, err := NewPostgresFallbackKeysTable(db)
+	if err != nil {
+		return nil, err
+	}
 	dk, err := NewPostgresDeviceKeysTable(db)
 	if err != nil {
 		return nil, err
@@ -172,6 +191,7 @@ func NewKeyDatabase(conMan *sqlutil.Connections, dbProperties *config.DatabaseOp
 
 	return &shared.KeyDatabase{
 		OneTimeKeysTable:      otk,
+		FallbackKeysTable:     fk,
 		DeviceKeysTable:       dk,
 		KeyChangesTable:       kc,
 		StaleDeviceListsTable: sdl,
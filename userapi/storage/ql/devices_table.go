@@ -0,0 +1,469 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const devicesSchema = `
+-- Stores data about devices.
+CREATE TABLE IF NOT EXISTS userapi_devices (
+    -- The access token granted to this device. This has to be unique
+    -- so we can distinguish which device is making a given request.
+    access_token string NOT NULL,
+    -- The auto-allocated unique ID of the session identified by the access token.
+    -- This can be used as a secure substitution of the access token in situations
+    -- where data is associated with access tokens (e.g. transaction storage),
+    -- so we don't have to store users' access tokens everywhere.
+    session_id int64 NOT NULL,
+    -- The device identifier. This only needs to uniquely identify a device for a given user, not globally.
+    -- access_tokens will be clobbered based on the device ID for a user.
+    device_id string NOT NULL,
+    -- The Matrix user ID localpart for this device. This is preferable to storing the full user_id
+    -- as it is smaller, makes it clearer that we only manage devices for our own users, and may make
+    -- migration to different domain names easier.
+    localpart string NOT NULL,
+	server_name string NOT NULL,
+    -- When this devices was first recognised on the network, as a unix timestamp (ms resolution).
+    created_ts int64 NOT NULL,
+    -- The display name, human friendlier than device_id and updatable
+    display_name string,
+	-- The time the device was last used, as a unix timestamp (ms resolution).
+	last_seen_ts int64 NOT NULL,
+	-- The last seen IP address of this device
+	ip string,
+	-- User agent of this device
+	user_agent string,
+	-- The refresh token of this device, if the client supports refreshing its access token.
+	refresh_token string,
+	-- The refresh token which was used to refresh the access token. It stays valid until
+	-- the new tokens are used, in case the client didn't receive them.
+	previous_refresh_token string,
+	-- When the access token expires, as a unix timestamp (ms resolution), or 0 if it never expires.
+	access_token_expires_ts int64 NOT NULL DEFAULT 0
+                                          
+    -- TODO: device keys, device display names, token restrictions (if 3rd-party OAuth app)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS userapi_devices_access_token_idx ON userapi_devices(access_token);
+
+-- Device IDs must be unique for a given user.
+CREATE UNIQUE INDEX IF NOT EXISTS userapi_device_localpart_id_idx ON userapi_devices(localpart, server_name, device_id);
+
+-- QL has no sequences, so this single row is used for automatic allocation of session_id.
+-- Session IDs must never be reused, even after a device was deleted.
+CREATE TABLE IF NOT EXISTS userapi_device_session_id_seq (
+    session_id int64 NOT NULL
+);
+`
+
+const countSessionIDSeqSQL = "" +
+	"SELECT count(*) FROM userapi_device_session_id_seq"
+
+const insertSessionIDSeqSQL = "" +
+	"INSERT INTO userapi_device_session_id_seq (session_id) VALUES (0)"
+
+const insertDeviceSQL = "" +
+	"INSERT INTO userapi_devices(device_id, localpart, server_name, access_token, created_ts, display_name, session_id, last_seen_ts, ip, user_agent)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+
+const updateNextSessionIDSQL = "" +
+	"UPDATE userapi_device_session_id_seq SET session_id = session_id + 1"
+
+const selectNextSessionIDSQL = "" +
+	"SELECT session_id FROM userapi_device_session_id_seq"
+
+const selectDeviceByTokenSQL = "" +
+	"SELECT session_id, device_id, localpart, server_name, access_token_expires_ts, previous_refresh_token IS NOT NULL" +
+	" FROM userapi_devices WHERE access_token = $1"
+
+const selectDeviceByRefreshTokenSQL = "" +
+	"SELECT session_id, device_id, localpart, server_name FROM userapi_devices" +
+	" WHERE refresh_token = $1 OR previous_refresh_token = $2"
+
+const updateDeviceTokensSQL = "" +
+	"UPDATE userapi_devices SET access_token = $1, refresh_token = $2, previous_refresh_token = $3, access_token_expires_ts = $4" +
+	" WHERE localpart = $5 AND server_name = $6 AND device_id = $7"
+
+const deletePreviousRefreshTokenSQL = "" +
+	"UPDATE userapi_devices SET previous_refresh_token = NULL WHERE access_token = $1"
+
+const selectDeviceByIDSQL = "" +
+	"SELECT display_name, last_seen_ts, ip FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id = $3"
+
+const selectDevicesByLocalpartSQL = "" +
+	"SELECT device_id, display_name, last_seen_ts, ip, user_agent, session_id FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id != $3 ORDER BY last_seen_ts DESC"
+
+const updateDeviceNameSQL = "" +
+	"UPDATE userapi_devices SET display_name = $1 WHERE localpart = $2 AND server_name = $3 AND device_id = $4"
+
+const deleteDeviceSQL = "" +
+	"DELETE FROM userapi_devices WHERE device_id = $1 AND localpart = $2 AND server_name = $3"
+
+const deleteDevicesByLocalpartSQL = "" +
+	"DELETE FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id != $3"
+
+const deleteDevicesSQL = "" +
+	"DELETE FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id IN ($3)"
+
+const selectDevicesByIDSQL = "" +
+	"SELECT device_id, localpart, server_name, display_name, last_seen_ts, session_id FROM userapi_devices WHERE device_id IN ($1) ORDER BY last_seen_ts DESC"
+
+const updateDeviceLastSeen = "" +
+	"UPDATE userapi_devices SET last_seen_ts = $1, ip = $2, user_agent = $3 WHERE localpart = $4 AND server_name = $5 AND device_id = $6"
+
+type devicesStatements struct {
+	db                           *sql.DB
+	insertDeviceStmt             *sql.Stmt
+	updateNextSessionIDStmt      *sql.Stmt
+	selectNextSessionIDStmt      *sql.Stmt
+	selectDeviceByTokenStmt      *sql.Stmt
+	selectDeviceByIDStmt         *sql.Stmt
+	selectDevicesByLocalpartStmt *sql.Stmt
+	updateDeviceNameStmt         *sql.Stmt
+	updateDeviceLastSeenStmt     *sql.Stmt
+	selectDeviceByRefreshStmt    *sql.Stmt
+	updateDeviceTokensStmt       *sql.Stmt
+	deletePreviousRefreshStmt    *sql.Stmt
+	deleteDeviceStmt             *sql.Stmt
+	deleteDevicesByLocalpartStmt *sql.Stmt
+	serverName                   spec.ServerName
+}
+
+func NewQLDevicesTable(db *sql.DB, serverName spec.ServerName) (tables.DevicesTable, error) {
+	s := &devicesStatements{
+		db:         db,
+		serverName: serverName,
+	}
+	_, err := db.Exec(devicesSchema)
+	if err != nil {
+		return nil, err
+	}
+	var count int
+	if err = db.QueryRow(countSessionIDSeqSQL).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		if _, err = db.Exec(insertSessionIDSeqSQL); err != nil {
+			return nil, err
+		}
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertDeviceStmt, insertDeviceSQL},
+		{&s.updateNextSessionIDStmt, updateNextSessionIDSQL},
+		{&s.selectNextSessionIDStmt, selectNextSessionIDSQL},
+		{&s.selectDeviceByTokenStmt, selectDeviceByTokenSQL},
+		{&s.selectDeviceByIDStmt, selectDeviceByIDSQL},
+		{&s.selectDevicesByLocalpartStmt, selectDevicesByLocalpartSQL},
+		{&s.updateDeviceNameStmt, updateDeviceNameSQL},
+		{&s.deleteDeviceStmt, deleteDeviceSQL},
+		{&s.deleteDevicesByLocalpartStmt, deleteDevicesByLocalpartSQL},
+		{&s.updateDeviceLastSeenStmt, updateDeviceLastSeen},
+		{&s.selectDeviceByRefreshStmt, selectDeviceByRefreshTokenSQL},
+		{&s.updateDeviceTokensStmt, updateDeviceTokensSQL},
+		{&s.deletePreviousRefreshStmt, deletePreviousRefreshTokenSQL},
+	}.Prepare(db)
+}
+
+// insertDevice creates a new device. Returns an error if any device with the same access token already exists.
+// Returns an error if the user already has a device with the given device ID.
+// Returns the device on success.
+func (s *devicesStatements) InsertDevice(
+	ctx context.Context, txn *sql.Tx, id string,
+	localpart string, serverName spec.ServerName,
+	accessToken string, displayName *string, ipAddr, userAgent string,
+) (*api.Device, error) {
+	var sessionID int64
+	if _, err := sqlutil.TxStmt(txn, s.updateNextSessionIDStmt).ExecContext(ctx); err != nil {
+		return nil, fmt.Errorf("updateNextSessionIDStmt: %w", err)
+	}
+	if err := sqlutil.TxStmt(txn, s.selectNextSessionIDStmt).QueryRowContext(ctx).Scan(&sessionID); err != nil {
+		return nil, fmt.Errorf("selectNextSessionIDStmt: %w", err)
+	}
+	return s.InsertDeviceWithSessionID(ctx, txn, id, localpart, serverName, accessToken, displayName, ipAddr, userAgent, sessionID)
+}
+
+func (s *devicesStatements) InsertDeviceWithSessionID(ctx context.Context, txn *sql.Tx, id,
+	localpart string, serverName spec.ServerName,
+	accessToken string, displayName *string, ipAddr, userAgent string,
+	sessionID int64,
+) (*api.Device, error) {
+	createdTimeMS := time.Now().UnixNano() / 1000000
+	stmt := sqlutil.TxStmt(txn, s.insertDeviceStmt)
+	if _, err := stmt.ExecContext(ctx, id, localpart, serverName, accessToken, createdTimeMS, displayName, sessionID, createdTimeMS, ipAddr, userAgent); err != nil {
+		return nil, fmt.Errorf("insertDeviceStmt: %w", err)
+	}
+	dev := &api.Device{
+		ID:          id,
+		UserID:      userutil.MakeUserID(localpart, serverName),
+		AccessToken: accessToken,
+		SessionID:   sessionID,
+		LastSeenTS:  createdTimeMS,
+		LastSeenIP:  ipAddr,
+		UserAgent:   userAgent,
+	}
+	if displayName != nil {
+		dev.DisplayName = *displayName
+	}
+	return dev, nil
+}
+
+// deleteDevice removes a single device by id and user localpart.
+func (s *devicesStatements) DeleteDevice(
+	ctx context.Context, txn *sql.Tx, id string,
+	localpart string, serverName spec.ServerName,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteDeviceStmt)
+	_, err := stmt.ExecContext(ctx, id, localpart, serverName)
+	return err
+}
+
+// deleteDevices removes a single or multiple devices by ids and user localpart.
+// Returns an error if the execution failed.
+func (s *devicesStatements) DeleteDevices(
+	ctx context.Context, txn *sql.Tx,
+	localpart string, serverName spec.ServerName,
+	devices []string,
+) error {
+	if len(devices) == 0 {
+		return nil
+	}
+	orig := strings.Replace(deleteDevicesSQL, "($3)", sqlutil.QueryVariadicOffset(len(devices), 2), 1)
+	prep, err := s.db.Prepare(orig)
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, prep, "DeleteDevices: prep.close() failed")
+	stmt := sqlutil.TxStmt(txn, prep)
+	params := make([]interface{}, len(devices)+2)
+	params[0] = localpart
+	params[1] = serverName
+	for i, v := range devices {
+		params[i+2] = v
+	}
+	_, err = stmt.ExecContext(ctx, params...)
+	return err
+}
+
+// deleteDevicesByLocalpart removes all devices for the
+// given user localpart.
+func (s *devicesStatements) DeleteDevicesByLocalpart(
+	ctx context.Context, txn *sql.Tx,
+	localpart string, serverName spec.ServerName,
+	exceptDeviceID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteDevicesByLocalpartStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName, exceptDeviceID)
+	return err
+}
+
+func (s *devicesStatements) UpdateDeviceName(
+	ctx context.Context, txn *sql.Tx,
+	localpart string, serverName spec.ServerName,
+	deviceID string, displayName *string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceNameStmt)
+	_, err := stmt.ExecContext(ctx, displayName, localpart, serverName, deviceID)
+	return err
+}
+
+// SelectDeviceByToken returns the device with the given access token, and whether
+// the previous refresh token of the device is still valid.
+func (s *devicesStatements) SelectDeviceByToken(
+	ctx context.Context, accessToken string,
+) (*api.Device, bool, error) {
+	var dev api.Device
+	var localpart string
+	var serverName spec.ServerName
+	var hasPreviousRefreshToken bool
+	stmt := s.selectDeviceByTokenStmt
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(
+		&dev.SessionID, &dev.ID, &localpart, &serverName, &dev.AccessTokenExpiresTS, &hasPreviousRefreshToken,
+	)
+	if err == nil {
+		dev.UserID = userutil.MakeUserID(localpart, serverName)
+		dev.AccessToken = accessToken
+	}
+	return &dev, hasPreviousRefreshToken, err
+}
+
+// SelectDeviceByRefreshToken returns the device with the given current or previous
+// refresh token.
+func (s *devicesStatements) SelectDeviceByRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken string,
+) (*api.Device, error) {
+	var dev api.Device
+	var localpart string
+	var serverName spec.ServerName
+	stmt := sqlutil.TxStmt(txn, s.selectDeviceByRefreshStmt)
+	err := stmt.QueryRowContext(ctx, refreshToken, refreshToken).Scan(&dev.SessionID, &dev.ID, &localpart, &serverName)
+	if err == nil {
+		dev.UserID = userutil.MakeUserID(localpart, serverName)
+	}
+	return &dev, err
+}
+
+// UpdateDeviceTokens replaces the tokens of a device.
+func (s *devicesStatements) UpdateDeviceTokens(
+	ctx context.Context, txn *sql.Tx,
+	localpart string, serverName spec.ServerName, deviceID string,
+	accessToken, refreshToken, previousRefreshToken string, accessTokenExpiresTS int64,
+) error {
+	// The previous refresh token is stored as NULL when there isn't one.
+	var previous *string
+	if previousRefreshToken != "" {
+		previous = &previousRefreshToken
+	}
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceTokensStmt)
+	_, err := stmt.ExecContext(ctx, accessToken, refreshToken, previous, accessTokenExpiresTS, localpart, serverName, deviceID)
+	return err
+}
+
+// DeletePreviousRefreshToken revokes the previous refresh token of the device with
+// the given access token.
+func (s *devicesStatements) DeletePreviousRefreshToken(
+	ctx context.Context, txn *sql.Tx, accessToken string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deletePreviousRefreshStmt)
+	_, err := stmt.ExecContext(ctx, accessToken)
+	return err
+}
+
+// selectDeviceByID retrieves a device from the database with the given user
+// localpart and deviceID
+func (s *devicesStatements) SelectDeviceByID(
+	ctx context.Context,
+	localpart string, serverName spec.ServerName,
+	deviceID string,
+) (*api.Device, error) {
+	var dev api.Device
+	var displayName, ip sql.NullString
+	var lastseenTS sql.NullInt64
+	stmt := s.selectDeviceByIDStmt
+	err := stmt.QueryRowContext(ctx, localpart, serverName, deviceID).Scan(&displayName, &lastseenTS, &ip)
+	if err == nil {
+		dev.ID = deviceID
+		dev.UserID = userutil.MakeUserID(localpart, serverName)
+		if displayName.Valid {
+			dev.DisplayName = displayName.String
+		}
+		if lastseenTS.Valid {
+			dev.LastSeenTS = lastseenTS.Int64
+		}
+		if ip.Valid {
+			dev.LastSeenIP = ip.String
+		}
+	}
+	return &dev, err
+}
+
+func (s *devicesStatements) SelectDevicesByID(ctx context.Context, deviceIDs []string) ([]api.Device, error) {
+	if len(deviceIDs) == 0 {
+		return nil, nil
+	}
+	sqlQuery := strings.Replace(selectDevicesByIDSQL, "($1)", sqlutil.QueryVariadic(len(deviceIDs)), 1)
+	iDeviceIDs := make([]interface{}, len(deviceIDs))
+	for i := range deviceIDs {
+		iDeviceIDs[i] = deviceIDs[i]
+	}
+	rows, err := s.db.QueryContext(ctx, sqlQuery, iDeviceIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectDevicesByID: rows.close() failed")
+	var devices []api.Device
+	var dev api.Device
+	var localpart string
+	var serverName spec.ServerName
+	var lastseents sql.NullInt64
+	var displayName sql.NullString
+	for rows.Next() {
+		if err := rows.Scan(&dev.ID, &localpart, &serverName, &displayName, &lastseents, &dev.SessionID); err != nil {
+			return nil, err
+		}
+		if displayName.Valid {
+			dev.DisplayName = displayName.String
+		}
+		if lastseents.Valid {
+			dev.LastSeenTS = lastseents.Int64
+		}
+		dev.UserID = userutil.MakeUserID(localpart, serverName)
+		devices = append(devices, dev)
+	}
+	return devices, rows.Err()
+}
+
+func (s *devicesStatements) SelectDevicesByLocalpart(
+	ctx context.Context, txn *sql.Tx,
+	localpart string, serverName spec.ServerName,
+	exceptDeviceID string,
+) ([]api.Device, error) {
+	devices := []api.Device{}
+	rows, err := sqlutil.TxStmt(txn, s.selectDevicesByLocalpartStmt).QueryContext(ctx, localpart, serverName, exceptDeviceID)
+
+	if err != nil {
+		return devices, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectDevicesByLocalpart: rows.close() failed")
+
+	var dev api.Device
+	var lastseents sql.NullInt64
+	var id, displayname, ip, useragent sql.NullString
+	for rows.Next() {
+		err = rows.Scan(&id, &displayname, &lastseents, &ip, &useragent, &dev.SessionID)
+		if err != nil {
+			return devices, err
+		}
+		if id.Valid {
+			dev.ID = id.String
+		}
+		if displayname.Valid {
+			dev.DisplayName = displayname.String
+		}
+		if lastseents.Valid {
+			dev.LastSeenTS = lastseents.Int64
+		}
+		if ip.Valid {
+			dev.LastSeenIP = ip.String
+		}
+		if useragent.Valid {
+			dev.UserAgent = useragent.String
+		}
+
+		dev.UserID = userutil.MakeUserID(localpart, serverName)
+		devices = append(devices, dev)
+	}
+
+	return devices, rows.Err()
+}
+
+func (s *devicesStatements) UpdateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID, ipAddr, userAgent string) error {
+	lastSeenTs := time.Now().UnixNano() / 1000000
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceLastSeenStmt)
+	_, err := stmt.ExecContext(ctx, lastSeenTs, ipAddr, userAgent, localpart, serverName, deviceID)
+	return err
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/dendrite/userapi/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const emailQueueSchema = `
+-- Stores emails which are waiting to be sent, so that they survive restarts.
+-- The email ID is the QL row ID, which is unique and never reused.
+CREATE TABLE IF NOT EXISTS userapi_email_queue (
+	-- The address the email is sent to
+	recipient string NOT NULL,
+	-- The complete message, including headers
+	message blob NOT NULL,
+	-- How often sending the email has failed
+	attempts int64 NOT NULL DEFAULT 0,
+	-- When to try sending the email next, as a unix timestamp (ms resolution)
+	next_attempt_ts int64 NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS userapi_email_queue_id_idx ON userapi_email_queue(id());
+CREATE INDEX IF NOT EXISTS userapi_email_queue_next_attempt_ts_idx ON userapi_email_queue(next_attempt_ts);
+`
+
+const insertEmailSQL = "" +
+	"INSERT INTO userapi_email_queue(recipient, message, next_attempt_ts) VALUES ($1, $2, $3)"
+
+const selectDueEmailsSQL = "" +
+	"SELECT id(), recipient, message, attempts FROM userapi_email_queue WHERE next_attempt_ts <= $1 ORDER BY id() ASC LIMIT $2"
+
+const updateEmailAttemptsSQL = "" +
+	"UPDATE userapi_email_queue SET attempts = $1, next_attempt_ts = $2 WHERE id() = $3"
+
+const deleteEmailSQL = "" +
+	"DELETE FROM userapi_email_queue WHERE id() = $1"
+
+type emailQueueStatements struct {
+	insertEmailStmt         *sql.Stmt
+	selectDueEmailsStmt     *sql.Stmt
+	updateEmailAttemptsStmt *sql.Stmt
+	deleteEmailStmt         *sql.Stmt
+}
+
+func NewQLEmailQueueTable(db *sql.DB) (tables.EmailQueueTable, error) {
+	s := &emailQueueStatements{}
+	_, err := db.Exec(emailQueueSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertEmailStmt, insertEmailSQL},
+		{&s.selectDueEmailsStmt, selectDueEmailsSQL},
+		{&s.updateEmailAttemptsStmt, updateEmailAttemptsSQL},
+		{&s.deleteEmailStmt, deleteEmailSQL},
+	}.Prepare(db)
+}
+
+func (s *emailQueueStatements) InsertEmail(
+	ctx context.Context, txn *sql.Tx, recipient string, message []byte, nextAttemptTS spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertEmailStmt).ExecContext(ctx, recipient, message, nextAttemptTS)
+	return err
+}
+
+func (s *emailQueueStatements) SelectDueEmails(
+	ctx context.Context, txn *sql.Tx, now spec.Timestamp, limit int,
+) ([]types.QueuedEmail, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectDueEmailsStmt).QueryContext(ctx, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectDueEmails: rows.close() failed")
+
+	var emails []types.QueuedEmail
+	for rows.Next() {
+		var email types.QueuedEmail
+		if err = rows.Scan(&email.ID, &email.Recipient, &email.Message, &email.Attempts); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+func (s *emailQueueStatements) UpdateEmailAttempts(
+	ctx context.Context, txn *sql.Tx, id int64, attempts int, nextAttemptTS spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateEmailAttemptsStmt).ExecContext(ctx, attempts, nextAttemptTS, id)
+	return err
+}
+
+func (s *emailQueueStatements) DeleteEmail(ctx context.Context, txn *sql.Tx, id int64) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteEmailStmt).ExecContext(ctx, id)
+	return err
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+)
+
+var fallbackKeysSchema = `
+-- Stores fallback keys for users, which are handed out once a device has run
+-- out of one-time keys. There is at most one fallback key per algorithm.
+CREATE TABLE IF NOT EXISTS keyserver_fallback_keys (
+	user_id string NOT NULL,
+	device_id string NOT NULL,
+	algorithm string NOT NULL,
+	key_id string NOT NULL,
+	key_json string NOT NULL,
+	-- Whether the key has been handed out since it was uploaded
+	used bool NOT NULL DEFAULT false
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS keyserver_fallback_keys_unique ON keyserver_fallback_keys (user_id, device_id, algorithm);
+`
+
+const insertFallbackKeySQL = "" +
+	"INSERT INTO keyserver_fallback_keys (user_id, device_id, algorithm, key_id, key_json)" +
+	" VALUES ($1, $2, $3, $4, $5)"
+
+// Re-uploading the same key must not reset the used flag, or else clients
+// would never learn that their fallback key has been handed out.
+const updateFallbackKeySQL = "" +
+	"UPDATE keyserver_fallback_keys SET key_id = $4, key_json = $5, used = false" +
+	" WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 AND (key_id != $4 OR key_json != $5)"
+
+const selectUnusedFallbackKeyAlgorithmsSQL = "" +
+	"SELECT algorithm FROM keyserver_fallback_keys WHERE user_id = $1 AND device_id = $2 AND used = false"
+
+const selectFallbackKeyByAlgorithmSQL = "" +
+	"SELECT key_id, key_json FROM keyserver_fallback_keys WHERE user_id = $1 AND device_id = $2 AND algorithm = $3"
+
+const markFallbackKeyUsedSQL = "" +
+	"UPDATE keyserver_fallback_keys SET used = true WHERE user_id = $1 AND device_id = $2 AND algorithm = $3"
+
+const deleteFallbackKeysSQL = "" +
+	"DELETE FROM keyserver_fallback_keys WHERE user_id = $1 AND device_id = $2"
+
+type fallbackKeysStatements struct {
+	insertFallbackKeyStmt                 *sql.Stmt
+	updateFallbackKeyStmt                 *sql.Stmt
+	selectUnusedFallbackKeyAlgorithmsStmt *sql.Stmt
+	selectFallbackKeyByAlgorithmStmt      *sql.Stmt
+	markFallbackKeyUsedStmt               *sql.Stmt
+	deleteFallbackKeysStmt                *sql.Stmt
+}
+
+func NewQLFallbackKeysTable(db *sql.DB) (tables.FallbackKeys, error) {
+	s := &fallbackKeysStatements{}
+	_, err := db.Exec(fallbackKeysSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertFallbackKeyStmt, insertFallbackKeySQL},
+		{&s.updateFallbackKeyStmt, updateFallbackKeySQL},
+		{&s.selectUnusedFallbackKeyAlgorithmsStmt, selectUnusedFallbackKeyAlgorithmsSQL},
+		{&s.selectFallbackKeyByAlgorithmStmt, selectFallbackKeyByAlgorithmSQL},
+		{&s.markFallbackKeyUsedStmt, markFallbackKeyUsedSQL},
+		{&s.deleteFallbackKeysStmt, deleteFallbackKeysSQL},
+	}.Prepare(db)
+}
+
+func (s *fallbackKeysStatements) InsertFallbackKeys(ctx context.Context, txn *sql.Tx, keys api.OneTimeKeys) error {
+	for keyIDWithAlgo, keyJSON := range keys.KeyJSON {
+		algo, keyID := keys.Split(keyIDWithAlgo)
+		_, err := sqlutil.TxStmt(txn, s.updateFallbackKeyStmt).ExecContext(
+			ctx, keys.UserID, keys.DeviceID, algo, keyID, string(keyJSON),
+		)
+		if err != nil {
+			return err
+		}
+		// Nothing was updated if the key is new or unchanged, in which case
+		// inserting it either adds it or fails on the existing key.
+		_, err = sqlutil.TxStmt(txn, s.insertFallbackKeyStmt).ExecContext(
+			ctx, keys.UserID, keys.DeviceID, algo, keyID, string(keyJSON),
+		)
+		if err != nil && !sqlutil.IsQLUniqueConstraintViolation(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fallbackKeysStatements) SelectUnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error) {
+	rows, err := s.selectUnusedFallbackKeyAlgorithmsStmt.QueryContext(ctx, userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectUnusedFallbackKeyAlgorithmsStmt: rows.close() failed")
+	algorithms := []string{}
+	for rows.Next() {
+		var algorithm string
+		if err = rows.Scan(&algorithm); err != nil {
+			return nil, err
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms, rows.Err()
+}
+
+func (s *fallbackKeysStatements) SelectAndMarkFallbackKeyUsed(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string,
+) (map[string]json.RawMessage, error) {
+	var keyID string
+	var keyJSON string
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectFallbackKeyByAlgorithmStmt).QueryRowContext(ctx, userID, deviceID, algorithm).Scan(&keyID, &keyJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	_, err = sqlutil.TxStmtContext(ctx, txn, s.markFallbackKeyUsedStmt).ExecContext(ctx, userID, deviceID, algorithm)
+	return map[string]json.RawMessage{
+		algorithm + ":" + keyID: json.RawMessage(keyJSON),
+	}, err
+}
+
+func (s *fallbackKeysStatements) DeleteFallbackKeys(ctx context.Context, txn *sql.Tx, userID, deviceID string) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteFallbackKeysStmt).ExecContext(ctx, userID, deviceID)
+	return err
+}
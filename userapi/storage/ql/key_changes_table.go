@@ -0,0 +1,108 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+)
+
+var keyChangesSchema = `
+-- Stores key change information about users. Used to determine when to send updated device lists to clients.
+-- The change ID is the QL row ID, which is unique and never reused.
+CREATE TABLE IF NOT EXISTS keyserver_key_changes (
+    user_id string NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS keyserver_key_changes_user_id_idx ON keyserver_key_changes (user_id);
+`
+
+// Replace based on user ID. We don't care how many times the user's keys have changed, only that they
+// have changed, hence we can just keep bumping the change ID for this user. Replacing the row
+// allocates a fresh change ID.
+const deleteKeyChangeSQL = "" +
+	"DELETE FROM keyserver_key_changes WHERE user_id = $1"
+
+const insertKeyChangeSQL = "" +
+	"INSERT INTO keyserver_key_changes (user_id) VALUES ($1)"
+
+const selectKeyChangesSQL = "" +
+	"SELECT user_id, id() FROM keyserver_key_changes WHERE id() > $1 AND id() <= $2"
+
+type keyChangesStatements struct {
+	db                   *sql.DB
+	deleteKeyChangeStmt  *sql.Stmt
+	insertKeyChangeStmt  *sql.Stmt
+	selectKeyChangesStmt *sql.Stmt
+}
+
+func NewQLKeyChangesTable(db *sql.DB) (tables.KeyChanges, error) {
+	s := &keyChangesStatements{
+		db: db,
+	}
+	_, err := db.Exec(keyChangesSchema)
+	if err != nil {
+		return s, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.deleteKeyChangeStmt, deleteKeyChangeSQL},
+		{&s.insertKeyChangeStmt, insertKeyChangeSQL},
+		{&s.selectKeyChangesStmt, selectKeyChangesSQL},
+	}.Prepare(db)
+}
+
+func (s *keyChangesStatements) InsertKeyChange(ctx context.Context, userID string) (changeID int64, err error) {
+	err = sqlutil.WithTransaction(s.db, func(txn *sql.Tx) error {
+		if _, err = sqlutil.TxStmt(txn, s.deleteKeyChangeStmt).ExecContext(ctx, userID); err != nil {
+			return err
+		}
+		res, err := sqlutil.TxStmt(txn, s.insertKeyChangeStmt).ExecContext(ctx, userID)
+		if err != nil {
+			return err
+		}
+		changeID, err = res.LastInsertId()
+		return err
+	})
+	return
+}
+
+func (s *keyChangesStatements) SelectKeyChanges(
+	ctx context.Context, fromOffset, toOffset int64,
+) (userIDs []string, latestOffset int64, err error) {
+	latestOffset = fromOffset
+	rows, err := s.selectKeyChangesStmt.QueryContext(ctx, fromOffset, toOffset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectKeyChangesStmt: rows.close() failed")
+	for rows.Next() {
+		var userID string
+		var offset int64
+		if err = rows.Scan(&userID, &offset); err != nil {
+			return nil, 0, err
+		}
+		if offset > latestOffset {
+			latestOffset = offset
+		}
+		userIDs = append(userIDs, userID)
+	}
+	err = rows.Err()
+	return
+}
@@ -0,0 +1,313 @@
+// Copyright 2021 Dan Peleg <dan@globekeeper.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+type notificationsStatements struct {
+	insertStmt             *sql.Stmt
+	updateNextIDStmt       *sql.Stmt
+	selectNextIDStmt       *sql.Stmt
+	deleteUpToStmt         *sql.Stmt
+	updateReadStmt         *sql.Stmt
+	selectStmt             *sql.Stmt
+	selectCountStmt        *sql.Stmt
+	selectRoomCountsStmt   *sql.Stmt
+	selectThreadCountsStmt *sql.Stmt
+	cleanNotificationsStmt *sql.Stmt
+}
+
+const notificationSchema = `
+CREATE TABLE IF NOT EXISTS userapi_notifications (
+    id int64 NOT NULL,
+	localpart string NOT NULL,
+	server_name string NOT NULL,
+	room_id string NOT NULL,
+	event_id string NOT NULL,
+	stream_pos int64 NOT NULL,
+    ts_ms int64 NOT NULL,
+    highlight bool NOT NULL,
+    notification_json blob NOT NULL,
+    read bool NOT NULL DEFAULT false,
+    -- The thread root event ID, if the event is part of a thread
+    thread_id string NOT NULL DEFAULT ""
+);
+
+CREATE INDEX IF NOT EXISTS userapi_notification_localpart_room_id_event_id_idx ON userapi_notifications(localpart, server_name, room_id, event_id);
+CREATE UNIQUE INDEX IF NOT EXISTS userapi_notification_id_idx ON userapi_notifications(id);
+CREATE INDEX IF NOT EXISTS userapi_notification_localpart_idx ON userapi_notifications(localpart, server_name);
+
+-- QL has no sequences, so this single row is used for automatic allocation of notification IDs.
+-- Notification IDs must never be reused, even after a notification was deleted.
+CREATE TABLE IF NOT EXISTS userapi_notifications_id_seq (
+    id int64 NOT NULL
+);
+`
+
+const countNotificationIDSeqSQL = "" +
+	"SELECT count(*) FROM userapi_notifications_id_seq"
+
+const insertNotificationIDSeqSQL = "" +
+	"INSERT INTO userapi_notifications_id_seq (id) VALUES (0)"
+
+const updateNextNotificationIDSQL = "" +
+	"UPDATE userapi_notifications_id_seq SET id = id + 1"
+
+const selectNextNotificationIDSQL = "" +
+	"SELECT id FROM userapi_notifications_id_seq"
+
+const insertNotificationSQL = "" +
+	"INSERT INTO userapi_notifications (localpart, server_name, room_id, event_id, stream_pos, ts_ms, highlight, notification_json, thread_id, id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+
+const deleteNotificationsUpToSQL = "" +
+	"DELETE FROM userapi_notifications WHERE localpart = $1 AND server_name = $2 AND room_id = $3 AND stream_pos <= $4"
+
+const updateNotificationReadSQL = "" +
+	"UPDATE userapi_notifications SET read = $1 WHERE localpart = $2 AND server_name = $3 AND room_id = $4 AND stream_pos <= $5 AND read != $1"
+
+// The filter is passed in as whether to include highlighted notifications
+// and whether to include the other notifications, as QL has no bitwise
+// operators.
+const selectNotificationSQL = "" +
+	"SELECT id, room_id, ts_ms, read, notification_json FROM userapi_notifications WHERE localpart = $1 AND server_name = $2 AND id > $3 AND (" +
+	"($4 AND highlight) OR ($5 AND !highlight)" +
+	") AND !read ORDER BY id LIMIT $6"
+
+const selectNotificationCountSQL = "" +
+	"SELECT count(*) FROM userapi_notifications WHERE localpart = $1 AND server_name = $2 AND (" +
+	"($3 AND highlight) OR ($4 AND !highlight)" +
+	") AND !read"
+
+// QL has no aggregate filters, so unread notifications are counted separately
+// for highlights and everything else.
+const selectRoomNotificationCountsSQL = "" +
+	"SELECT highlight, count(*) FROM userapi_notifications " +
+	"WHERE localpart = $1 AND server_name = $2 AND room_id = $3 AND !read " +
+	"GROUP BY highlight"
+
+const selectRoomThreadNotificationCountsSQL = "" +
+	"SELECT thread_id, highlight, count(*) FROM userapi_notifications " +
+	"WHERE localpart = $1 AND server_name = $2 AND room_id = $3 AND thread_id != \"\" AND !read " +
+	"GROUP BY thread_id, highlight"
+
+const cleanNotificationsSQL = "" +
+	"DELETE FROM userapi_notifications WHERE" +
+	" (highlight = false AND ts_ms < $1) OR (highlight = true AND ts_ms < $2)"
+
+func NewQLNotificationTable(db *sql.DB) (tables.NotificationTable, error) {
+	s := &notificationsStatements{}
+	_, err := db.Exec(notificationSchema)
+	if err != nil {
+		return nil, err
+	}
+	var count int
+	if err = db.QueryRow(countNotificationIDSeqSQL).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		if _, err = db.Exec(insertNotificationIDSeqSQL); err != nil {
+			return nil, err
+		}
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertStmt, insertNotificationSQL},
+		{&s.updateNextIDStmt, updateNextNotificationIDSQL},
+		{&s.selectNextIDStmt, selectNextNotificationIDSQL},
+		{&s.deleteUpToStmt, deleteNotificationsUpToSQL},
+		{&s.updateReadStmt, updateNotificationReadSQL},
+		{&s.selectStmt, selectNotificationSQL},
+		{&s.selectCountStmt, selectNotificationCountSQL},
+		{&s.selectRoomCountsStmt, selectRoomNotificationCountsSQL},
+		{&s.selectThreadCountsStmt, selectRoomThreadNotificationCountsSQL},
+		{&s.cleanNotificationsStmt, cleanNotificationsSQL},
+	}.Prepare(db)
+}
+
+func (s *notificationsStatements) Clean(ctx context.Context, txn *sql.Tx) error {
+	_, err := sqlutil.TxStmt(txn, s.cleanNotificationsStmt).ExecContext(
+		ctx,
+		time.Now().AddDate(0, 0, -1).UnixNano()/int64(time.Millisecond), // keep non-highlights for a day
+		time.Now().AddDate(0, -1, 0).UnixNano()/int64(time.Millisecond), // keep highlights for a month
+	)
+	return err
+}
+
+// Insert inserts a notification into the database.
+func (s *notificationsStatements) Insert(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, eventID, threadID string, pos uint64, highlight bool, n *api.Notification) error {
+	roomID, tsMS := n.RoomID, n.TS
+	nn := *n
+	// Clears out fields that have their own columns to (1) shrink the
+	// data and (2) avoid difficult-to-debug inconsistency bugs.
+	nn.RoomID = ""
+	nn.TS, nn.Read = 0, false
+	bs, err := json.Marshal(nn)
+	if err != nil {
+		return err
+	}
+	if _, err = sqlutil.TxStmt(txn, s.updateNextIDStmt).ExecContext(ctx); err != nil {
+		return err
+	}
+	var id int64
+	if err = sqlutil.TxStmt(txn, s.selectNextIDStmt).QueryRowContext(ctx).Scan(&id); err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertStmt).ExecContext(ctx, localpart, serverName, roomID, eventID, pos, tsMS, highlight, bs, threadID, id)
+	return err
+}
+
+// DeleteUpTo deletes all previous notifications, up to and including the event.
+func (s *notificationsStatements) DeleteUpTo(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string, pos uint64) (affected bool, _ error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteUpToStmt).ExecContext(ctx, localpart, serverName, roomID, pos)
+	if err != nil {
+		return false, err
+	}
+	nrows, err := res.RowsAffected()
+	if err != nil {
+		return true, err
+	}
+	log.WithFields(log.Fields{"localpart": localpart, "room_id": roomID, "stream_pos": pos}).Tracef("DeleteUpTo: %d rows affected", nrows)
+	return nrows > 0, nil
+}
+
+// UpdateRead updates the "read" value for an event.
+func (s *notificationsStatements) UpdateRead(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string, pos uint64, v bool) (affected bool, _ error) {
+	res, err := sqlutil.TxStmt(txn, s.updateReadStmt).ExecContext(ctx, v, localpart, serverName, roomID, pos)
+	if err != nil {
+		return false, err
+	}
+	nrows, err := res.RowsAffected()
+	if err != nil {
+		return true, err
+	}
+	log.WithFields(log.Fields{"localpart": localpart, "room_id": roomID, "stream_pos": pos}).Tracef("UpdateRead: %d rows affected", nrows)
+	return nrows > 0, nil
+}
+
+func (s *notificationsStatements) Select(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, fromID int64, limit int, filter tables.NotificationFilter) ([]*api.Notification, int64, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectStmt).QueryContext(
+		ctx, localpart, serverName, fromID,
+		filter&tables.HighlightNotifications != 0, filter&tables.NonHighlightNotifications != 0, limit,
+	)
+
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "notifications.Select: rows.Close() failed")
+
+	var maxID int64 = -1
+	var notifs []*api.Notification
+	for rows.Next() {
+		var id int64
+		var roomID string
+		var ts spec.Timestamp
+		var read bool
+		var jsonStr string
+		err = rows.Scan(
+			&id,
+			&roomID,
+			&ts,
+			&read,
+			&jsonStr)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var n api.Notification
+		err := json.Unmarshal([]byte(jsonStr), &n)
+		if err != nil {
+			return nil, 0, err
+		}
+		n.RoomID = roomID
+		n.TS = ts
+		n.Read = read
+		notifs = append(notifs, &n)
+
+		if maxID < id {
+			maxID = id
+		}
+	}
+	return notifs, maxID, rows.Err()
+}
+
+func (s *notificationsStatements) SelectCount(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, filter tables.NotificationFilter) (count int64, err error) {
+	err = sqlutil.TxStmt(txn, s.selectCountStmt).QueryRowContext(
+		ctx, localpart, serverName,
+		filter&tables.HighlightNotifications != 0, filter&tables.NonHighlightNotifications != 0,
+	).Scan(&count)
+	return
+}
+
+func (s *notificationsStatements) SelectRoomCounts(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string) (total int64, highlight int64, err error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomCountsStmt).QueryContext(ctx, localpart, serverName, roomID)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "notifications.SelectRoomCounts: rows.Close() failed")
+
+	for rows.Next() {
+		var isHighlight bool
+		var count int64
+		if err = rows.Scan(&isHighlight, &count); err != nil {
+			return 0, 0, err
+		}
+		total += count
+		if isHighlight {
+			highlight += count
+		}
+	}
+	return total, highlight, rows.Err()
+}
+
+func (s *notificationsStatements) SelectRoomThreadCounts(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string) (map[string]api.ThreadNotificationCounts, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectThreadCountsStmt).QueryContext(ctx, localpart, serverName, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "notifications.SelectRoomThreadCounts: rows.Close() failed")
+
+	counts := map[string]api.ThreadNotificationCounts{}
+	for rows.Next() {
+		var threadID string
+		var isHighlight bool
+		var count int64
+		if err = rows.Scan(&threadID, &isHighlight, &count); err != nil {
+			return nil, err
+		}
+		// QL returns a single empty group if no rows match.
+		if count == 0 {
+			continue
+		}
+		c := counts[threadID]
+		c.Total += count
+		if isHighlight {
+			c.Highlight += count
+		}
+		counts[threadID] = c
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const rateLimitOverridesSchema = `
+-- Stores rate limits which replace the configured ones for specific users
+CREATE TABLE IF NOT EXISTS userapi_rate_limit_overrides (
+	localpart string NOT NULL,
+	server_name string NOT NULL,
+	-- The number of requests allowed per cooloff, or 0 to exempt the user from rate limiting
+	threshold int64 NOT NULL,
+	cooloff_ms int64 NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS userapi_rate_limit_overrides_idx ON userapi_rate_limit_overrides(localpart, server_name);
+`
+
+const selectRateLimitOverrideSQL = "" +
+	"SELECT threshold, cooloff_ms FROM userapi_rate_limit_overrides WHERE localpart = $1 AND server_name = $2"
+
+const insertRateLimitOverrideSQL = "" +
+	"INSERT INTO userapi_rate_limit_overrides (localpart, server_name, threshold, cooloff_ms) VALUES ($1, $2, $3, $4)"
+
+const updateRateLimitOverrideSQL = "" +
+	"UPDATE userapi_rate_limit_overrides SET threshold = $3, cooloff_ms = $4 WHERE localpart = $1 AND server_name = $2"
+
+const deleteRateLimitOverrideSQL = "" +
+	"DELETE FROM userapi_rate_limit_overrides WHERE localpart = $1 AND server_name = $2"
+
+type rateLimitOverridesStatements struct {
+	selectRateLimitOverrideStmt *sql.Stmt
+	insertRateLimitOverrideStmt *sql.Stmt
+	updateRateLimitOverrideStmt *sql.Stmt
+	deleteRateLimitOverrideStmt *sql.Stmt
+}
+
+func NewQLRateLimitOverridesTable(db *sql.DB) (tables.RateLimitOverridesTable, error) {
+	s := &rateLimitOverridesStatements{}
+	_, err := db.Exec(rateLimitOverridesSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.selectRateLimitOverrideStmt, selectRateLimitOverrideSQL},
+		{&s.insertRateLimitOverrideStmt, insertRateLimitOverrideSQL},
+		{&s.updateRateLimitOverrideStmt, updateRateLimitOverrideSQL},
+		{&s.deleteRateLimitOverrideStmt, deleteRateLimitOverrideSQL},
+	}.Prepare(db)
+}
+
+func (s *rateLimitOverridesStatements) SelectRateLimitOverride(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName,
+) (threshold, cooloffMS int64, found bool, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRateLimitOverrideStmt)
+	err = stmt.QueryRowContext(ctx, localpart, serverName).Scan(&threshold, &cooloffMS)
+	if err == sql.ErrNoRows {
+		return 0, 0, false, nil
+	}
+	return threshold, cooloffMS, err == nil, err
+}
+
+func (s *rateLimitOverridesStatements) UpsertRateLimitOverride(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, threshold, cooloffMS int64,
+) (err error) {
+	res, err := sqlutil.TxStmt(txn, s.updateRateLimitOverrideStmt).ExecContext(ctx, localpart, serverName, threshold, cooloffMS)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertRateLimitOverrideStmt).ExecContext(ctx, localpart, serverName, threshold, cooloffMS)
+	return
+}
+
+func (s *rateLimitOverridesStatements) DeleteRateLimitOverride(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteRateLimitOverrideStmt)
+	_, err = stmt.ExecContext(ctx, localpart, serverName)
+	return
+}
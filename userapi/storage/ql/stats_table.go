@@ -0,0 +1,585 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+	"github.com/matrix-org/dendrite/userapi/types"
+)
+
+const userDailyVisitsSchema = `
+CREATE TABLE IF NOT EXISTS userapi_daily_visits (
+    localpart string NOT NULL,
+	device_id string NOT NULL,
+	timestamp int64 NOT NULL,
+	user_agent string
+);
+
+-- Device IDs and timestamp must be unique for a given user per day
+CREATE UNIQUE INDEX IF NOT EXISTS userapi_daily_visits_localpart_device_timestamp_idx ON userapi_daily_visits(localpart, device_id, timestamp);
+CREATE INDEX IF NOT EXISTS userapi_daily_visits_timestamp_idx ON userapi_daily_visits(timestamp);
+CREATE INDEX IF NOT EXISTS userapi_daily_visits_localpart_timestamp_idx ON userapi_daily_visits(localpart, timestamp);
+`
+
+const messagesDailySchema = `
+CREATE TABLE IF NOT EXISTS userapi_daily_stats (
+	timestamp int64 NOT NULL,
+	server_name string NOT NULL,
+	messages int64 NOT NULL,
+	sent_messages int64 NOT NULL,
+	e2ee_messages int64 NOT NULL,
+	sent_e2ee_messages int64 NOT NULL,
+	active_rooms int64 NOT NULL,
+	active_e2ee_rooms int64 NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS userapi_daily_stats_timestamp_server_name_idx ON userapi_daily_stats(timestamp, server_name);
+`
+
+const insertDailyMessagesSQL = "" +
+	"INSERT INTO userapi_daily_stats (timestamp, server_name, messages, sent_messages, e2ee_messages, sent_e2ee_messages, active_rooms, active_e2ee_rooms)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
+
+const updateDailyMessagesSQL = "" +
+	"UPDATE userapi_daily_stats SET messages = $3, sent_messages = $4, e2ee_messages = $5, sent_e2ee_messages = $6, active_rooms = $7, active_e2ee_rooms = $8" +
+	" WHERE timestamp = $1 AND server_name = $2"
+
+const selectDailyMessagesSQL = `
+	SELECT messages, sent_messages, e2ee_messages, sent_e2ee_messages, active_rooms, active_e2ee_rooms
+	FROM userapi_daily_stats
+	WHERE server_name = $1 AND timestamp = $2;
+`
+
+const countUsersLastSeenAfterSQL = "" +
+	"SELECT count(*) FROM (" +
+	" SELECT DISTINCT localpart FROM userapi_devices WHERE last_seen_ts > $1" +
+	")"
+
+// Note on the following selectR30UsersSQL and selectR30UsersV2SQL: The different checks are intentional.
+// This is to ensure the values reported by Dendrite are the same as by Synapse.
+// Queries are taken from: https://github.com/matrix-org/synapse/blob/9ce51a47f6e37abd0a1275281806399d874eb026/synapse/storage/databases/main/stats.py
+// QL has no CASE expressions, so the platforms are worked out from the user agents in Go.
+
+/*
+R30Users counts the number of 30 day retained users, defined as:
+- Users who have created their accounts more than 30 days ago
+- Where last seen at most 30 days ago
+- Where account creation and last_seen are > 30 days apart
+*/
+const selectR30UsersSQL = "" +
+	"SELECT a.localpart, d.user_agent FROM userapi_accounts AS a, userapi_devices AS d" +
+	" WHERE a.localpart == d.localpart AND a.account_type != 4 AND a.created_ts < $1" +
+	" AND d.last_seen_ts > $1 AND d.last_seen_ts - a.created_ts > $2"
+
+/*
+R30UsersV2 counts the number of 30 day retained users, defined as users that:
+- Appear more than once in the past 60 days
+- Have more than 30 days between the most and least recent appearances that occurred in the past 60 days.
+*/
+const selectR30UsersV2SQL = "" +
+	"SELECT localpart, user_agent, timestamp FROM userapi_daily_visits" +
+	" WHERE timestamp > $1 AND timestamp < $2"
+
+const countUserByAccountTypeSQL = `
+SELECT count(*) FROM userapi_accounts WHERE account_type IN ($1)
+`
+
+const selectRegisteredUserTypesSQL = "" +
+	"SELECT account_type, appservice_id FROM userapi_accounts WHERE created_ts > $1"
+
+// account_type 1 = users; 3 = admins
+// Every device of a user who was active in the time window is recorded.
+const selectUserDailyVisitsSQL = "" +
+	"SELECT localpart, device_id, user_agent FROM userapi_devices WHERE localpart IN (" +
+	" SELECT d.localpart FROM userapi_devices AS d, userapi_accounts AS a" +
+	" WHERE d.localpart == a.localpart AND $1 <= d.last_seen_ts AND d.last_seen_ts < $2" +
+	" AND a.account_type IN (1, 3)" +
+	")"
+
+const insertUserDailyVisitSQL = "" +
+	"INSERT INTO userapi_daily_visits(localpart, device_id, timestamp, user_agent) VALUES ($1, $2, $3, $4)"
+
+type statsStatements struct {
+	db                          *sql.DB
+	serverName                  spec.ServerName
+	lastUpdate                  time.Time
+	countUsersLastSeenAfterStmt *sql.Stmt
+	selectR30UsersStmt          *sql.Stmt
+	selectR30UsersV2Stmt        *sql.Stmt
+	selectUserDailyVisitsStmt   *sql.Stmt
+	insertUserDailyVisitStmt    *sql.Stmt
+	// countUserByAccountTypeStmt *sql.Stmt - prepared at runtime due to variadic
+	selectRegisteredUserTypesStmt *sql.Stmt
+	insertMessagesStmt            *sql.Stmt
+	updateMessagesStmt            *sql.Stmt
+	selectDailyMessagesStmt       *sql.Stmt
+}
+
+func NewQLStatsTable(db *sql.DB, serverName spec.ServerName) (tables.StatsTable, error) {
+	s := &statsStatements{
+		db:         db,
+		serverName: serverName,
+		lastUpdate: time.Now(),
+	}
+
+	_, err := db.Exec(userDailyVisitsSchema)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(messagesDailySchema)
+	if err != nil {
+		return nil, err
+	}
+	go s.startTimers()
+	return s, sqlutil.StatementList{
+		{&s.countUsersLastSeenAfterStmt, countUsersLastSeenAfterSQL},
+		{&s.selectR30UsersStmt, selectR30UsersSQL},
+		{&s.selectR30UsersV2Stmt, selectR30UsersV2SQL},
+		{&s.selectUserDailyVisitsStmt, selectUserDailyVisitsSQL},
+		{&s.insertUserDailyVisitStmt, insertUserDailyVisitSQL},
+		{&s.selectRegisteredUserTypesStmt, selectRegisteredUserTypesSQL},
+		{&s.insertMessagesStmt, insertDailyMessagesSQL},
+		{&s.updateMessagesStmt, updateDailyMessagesSQL},
+		{&s.selectDailyMessagesStmt, selectDailyMessagesSQL},
+	}.Prepare(db)
+}
+
+// r30Platform returns the platform of a user agent for the R30Users statistics.
+func r30Platform(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		return "android"
+	case strings.Contains(userAgent, "iOS"):
+		return "ios"
+	case strings.Contains(userAgent, "Electron"):
+		return "electron"
+	case strings.Contains(userAgent, "Mozilla"), strings.Contains(userAgent, "Gecko"):
+		return "web"
+	default:
+		return "unknown"
+	}
+}
+
+// r30V2ClientType returns the client type of a user agent for the R30UsersV2 statistics.
+func r30V2ClientType(userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(userAgent, "riot"), strings.Contains(userAgent, "element"):
+		switch {
+		case strings.Contains(userAgent, "electron"):
+			return "electron"
+		case strings.Contains(userAgent, "android"):
+			return "android"
+		case strings.Contains(userAgent, "ios"):
+			return "ios"
+		default:
+			return "unknown"
+		}
+	case strings.Contains(userAgent, "mozilla"), strings.Contains(userAgent, "gecko"):
+		return "web"
+	default:
+		return "unknown"
+	}
+}
+
+func (s *statsStatements) startTimers() {
+	var updateStatsFunc func()
+	updateStatsFunc = func() {
+		logrus.Infof("Executing UpdateUserDailyVisits")
+		if err := s.UpdateUserDailyVisits(context.Background(), nil, time.Now(), s.lastUpdate); err != nil {
+			logrus.WithError(err).Error("failed to update daily user visits")
+		}
+		time.AfterFunc(time.Hour*3, updateStatsFunc)
+	}
+	time.AfterFunc(time.Minute*5, updateStatsFunc)
+}
+
+func (s *statsStatements) countUsersByAccountType(ctx context.Context, txn *sql.Tx, accountTypes ...api.AccountType) (result int64, err error) {
+	query := strings.Replace(countUserByAccountTypeSQL, "($1)", sqlutil.QueryVariadic(len(accountTypes)), 1)
+	params := make([]interface{}, len(accountTypes))
+	for i := range accountTypes {
+		params[i] = int64(accountTypes[i])
+	}
+	var qp sqlutil.QueryProvider = s.db
+	if txn != nil {
+		qp = txn
+	}
+	rows, err := qp.QueryContext(ctx, query, params...)
+	if err != nil {
+		return 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "countUsersByAccountType: failed to close rows")
+	if rows.Next() {
+		err = rows.Scan(&result)
+	}
+	return result, err
+}
+
+func (s *statsStatements) allUsers(ctx context.Context, txn *sql.Tx) (result int64, err error) {
+	return s.countUsersByAccountType(ctx, txn,
+		api.AccountTypeUser,
+		api.AccountTypeGuest,
+		api.AccountTypeAdmin,
+		api.AccountTypeAppService,
+	)
+}
+
+func (s *statsStatements) nonBridgedUsers(ctx context.Context, txn *sql.Tx) (result int64, err error) {
+	return s.countUsersByAccountType(ctx, txn,
+		api.AccountTypeUser,
+		api.AccountTypeGuest,
+		api.AccountTypeAdmin,
+	)
+}
+
+func (s *statsStatements) registeredUserByType(ctx context.Context, txn *sql.Tx) (map[string]int64, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRegisteredUserTypesStmt)
+	registeredAfter := time.Now().AddDate(0, 0, -30)
+
+	rows, err := stmt.QueryContext(ctx, spec.AsTimestamp(registeredAfter))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "RegisteredUserByType: failed to close rows")
+
+	var accountType api.AccountType
+	var appserviceID *string
+	var result = make(map[string]int64)
+	for rows.Next() {
+		if err = rows.Scan(&accountType, &appserviceID); err != nil {
+			return nil, err
+		}
+		switch accountType {
+		case api.AccountTypeUser, api.AccountTypeAdmin, api.AccountTypeAppService:
+			if appserviceID == nil {
+				result["native"]++
+			} else {
+				result["bridged"]++
+			}
+		case api.AccountTypeGuest:
+			if appserviceID == nil {
+				result["guest"]++
+			}
+		}
+	}
+
+	return result, rows.Err()
+}
+
+func (s *statsStatements) dailyUsers(ctx context.Context, txn *sql.Tx) (result int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.countUsersLastSeenAfterStmt)
+	lastSeenAfter := time.Now().AddDate(0, 0, -1)
+	err = stmt.QueryRowContext(ctx,
+		spec.AsTimestamp(lastSeenAfter),
+	).Scan(&result)
+	return
+}
+
+func (s *statsStatements) monthlyUsers(ctx context.Context, txn *sql.Tx) (result int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.countUsersLastSeenAfterStmt)
+	lastSeenAfter := time.Now().AddDate(0, 0, -30)
+	err = stmt.QueryRowContext(ctx,
+		spec.AsTimestamp(lastSeenAfter),
+	).Scan(&result)
+	return
+}
+
+/*
+R30Users counts the number of 30 day retained users, defined as:
+- Users who have created their accounts more than 30 days ago
+- Where last seen at most 30 days ago
+- Where account creation and last_seen are > 30 days apart
+*/
+func (s *statsStatements) r30Users(ctx context.Context, txn *sql.Tx) (map[string]int64, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectR30UsersStmt)
+	lastSeenAfter := time.Now().AddDate(0, 0, -30)
+	diff := time.Hour * 24 * 30
+
+	rows, err := stmt.QueryContext(ctx,
+		spec.AsTimestamp(lastSeenAfter),
+		diff.Milliseconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "R30Users: failed to close rows")
+
+	// Each user is counted once for every platform they were seen on.
+	seen := make(map[[2]string]struct{})
+	var localpart string
+	var userAgent *string
+	var result = make(map[string]int64)
+	for rows.Next() {
+		if err = rows.Scan(&localpart, &userAgent); err != nil {
+			return nil, err
+		}
+		platform := "unknown"
+		if userAgent != nil {
+			platform = r30Platform(*userAgent)
+		}
+		if platform == "unknown" {
+			continue
+		}
+		if _, ok := seen[[2]string{localpart, platform}]; ok {
+			continue
+		}
+		seen[[2]string{localpart, platform}] = struct{}{}
+		result["all"]++
+		result[platform]++
+	}
+
+	return result, rows.Err()
+}
+
+/*
+R30UsersV2 counts the number of 30 day retained users, defined as users that:
+- Appear more than once in the past 60 days
+- Have more than 30 days between the most and least recent appearances that occurred in the past 60 days.
+*/
+func (s *statsStatements) r30UsersV2(ctx context.Context, txn *sql.Tx) (map[string]int64, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectR30UsersV2Stmt)
+	sixtyDaysAgo := time.Now().AddDate(0, 0, -60)
+	diff := time.Hour * 24 * 30
+	tomorrow := time.Now().Add(time.Hour * 24)
+
+	rows, err := stmt.QueryContext(ctx,
+		spec.AsTimestamp(sixtyDaysAgo),
+		spec.AsTimestamp(tomorrow),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "R30UsersV2: failed to close rows")
+
+	// Find the first and last visit of each user on each client type.
+	type visits struct{ first, last int64 }
+	appearances := make(map[[2]string]*visits)
+	var localpart string
+	var userAgent *string
+	var ts int64
+	for rows.Next() {
+		if err = rows.Scan(&localpart, &userAgent, &ts); err != nil {
+			return nil, err
+		}
+		clientType := "unknown"
+		if userAgent != nil {
+			clientType = r30V2ClientType(*userAgent)
+		}
+		key := [2]string{localpart, clientType}
+		if v, ok := appearances[key]; !ok {
+			appearances[key] = &visits{first: ts, last: ts}
+		} else if ts < v.first {
+			v.first = ts
+		} else if ts > v.last {
+			v.last = ts
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var result = map[string]int64{
+		"ios":      0,
+		"android":  0,
+		"web":      0,
+		"electron": 0,
+		"all":      0,
+	}
+	for key, v := range appearances {
+		if v.last-v.first <= diff.Milliseconds() {
+			continue
+		}
+		if _, ok := result[key[1]]; !ok {
+			continue
+		}
+		result["all"]++
+		result[key[1]]++
+	}
+
+	return result, nil
+}
+
+// UserStatistics collects some information about users on this instance.
+// Returns the stats itself as well as the database engine version and type.
+// On error, returns the stats collected up to the error.
+func (s *statsStatements) UserStatistics(ctx context.Context, txn *sql.Tx) (*types.UserStatistics, *types.DatabaseEngine, error) {
+	var (
+		stats = &types.UserStatistics{
+			R30UsersV2: map[string]int64{
+				"ios":      0,
+				"android":  0,
+				"web":      0,
+				"electron": 0,
+				"all":      0,
+			},
+			R30Users:              map[string]int64{},
+			RegisteredUsersByType: map[string]int64{},
+		}
+		dbEngine = &types.DatabaseEngine{Engine: "QL", Version: qlVersion()}
+		err      error
+	)
+	stats.AllUsers, err = s.allUsers(ctx, txn)
+	if err != nil {
+		return stats, dbEngine, err
+	}
+	stats.DailyUsers, err = s.dailyUsers(ctx, txn)
+	if err != nil {
+		return stats, dbEngine, err
+	}
+	stats.MonthlyUsers, err = s.monthlyUsers(ctx, txn)
+	if err != nil {
+		return stats, dbEngine, err
+	}
+	stats.R30Users, err = s.r30Users(ctx, txn)
+	if err != nil {
+		return stats, dbEngine, err
+	}
+	stats.R30UsersV2, err = s.r30UsersV2(ctx, txn)
+	if err != nil {
+		return stats, dbEngine, err
+	}
+	stats.NonBridgedUsers, err = s.nonBridgedUsers(ctx, txn)
+	if err != nil {
+		return stats, dbEngine, err
+	}
+	stats.RegisteredUsersByType, err = s.registeredUserByType(ctx, txn)
+	if err != nil {
+		return stats, dbEngine, err
+	}
+	return stats, dbEngine, nil
+}
+
+// qlVersion returns the version of the QL database engine which was built
+// into this binary, as QL has no way to query it.
+func qlVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "modernc.org/ql" {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+func (s *statsStatements) UpdateUserDailyVisits(
+	ctx context.Context, txn *sql.Tx,
+	startTime, lastUpdate time.Time,
+) error {
+	startTime = startTime.Truncate(time.Hour * 24)
+
+	// edge case
+	if startTime.After(s.lastUpdate) {
+		startTime = startTime.AddDate(0, 0, -1)
+	}
+	update := func(txn *sql.Tx) error {
+		rows, err := sqlutil.TxStmt(txn, s.selectUserDailyVisitsStmt).QueryContext(ctx,
+			spec.AsTimestamp(lastUpdate),
+			spec.AsTimestamp(time.Now()),
+		)
+		if err != nil {
+			return err
+		}
+		defer internal.CloseAndLogIfError(ctx, rows, "UpdateUserDailyVisits: failed to close rows")
+		for rows.Next() {
+			var localpart, deviceID string
+			var userAgent *string
+			if err = rows.Scan(&localpart, &deviceID, &userAgent); err != nil {
+				return err
+			}
+			_, err = sqlutil.TxStmt(txn, s.insertUserDailyVisitStmt).ExecContext(ctx,
+				localpart, deviceID, spec.AsTimestamp(startTime), userAgent,
+			)
+			// Devices which were already recorded today are left alone.
+			if err != nil && !sqlutil.IsQLUniqueConstraintViolation(err) {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+	var err error
+	if txn != nil {
+		err = update(txn)
+	} else {
+		err = sqlutil.WithTransaction(s.db, update)
+	}
+	if err == nil {
+		s.lastUpdate = time.Now()
+	}
+	return err
+}
+
+func (s *statsStatements) UpsertDailyStats(
+	ctx context.Context, txn *sql.Tx,
+	serverName spec.ServerName, stats types.MessageStats,
+	activeRooms, activeE2EERooms int64,
+) error {
+	timestamp := time.Now().Truncate(time.Hour * 24)
+	// QL has no upserts, so the messages are added to today's existing stats
+	// if there are any.
+	current, currentActiveRooms, currentActiveE2EERooms, err := s.DailyRoomsMessages(ctx, txn, serverName)
+	if err != nil {
+		return err
+	}
+	res, err := sqlutil.TxStmt(txn, s.updateMessagesStmt).ExecContext(ctx,
+		spec.AsTimestamp(timestamp),
+		serverName,
+		current.Messages+stats.Messages, current.SentMessages+stats.SentMessages,
+		current.MessagesE2EE+stats.MessagesE2EE, current.SentMessagesE2EE+stats.SentMessagesE2EE,
+		max(currentActiveRooms, activeRooms), max(currentActiveE2EERooms, activeE2EERooms),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertMessagesStmt).ExecContext(ctx,
+		spec.AsTimestamp(timestamp),
+		serverName,
+		stats.Messages, stats.SentMessages, stats.MessagesE2EE, stats.SentMessagesE2EE,
+		activeRooms, activeE2EERooms,
+	)
+	return err
+}
+
+func (s *statsStatements) DailyRoomsMessages(
+	ctx context.Context, txn *sql.Tx,
+	serverName spec.ServerName,
+) (msgStats types.MessageStats, activeRooms, activeE2EERooms int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectDailyMessagesStmt)
+	timestamp := time.Now().Truncate(time.Hour * 24)
+
+	err = stmt.QueryRowContext(ctx, serverName, spec.AsTimestamp(timestamp)).
+		Scan(&msgStats.Messages, &msgStats.SentMessages, &msgStats.MessagesE2EE, &msgStats.SentMessagesE2EE, &activeRooms, &activeE2EERooms)
+	if err != nil && err != sql.ErrNoRows {
+		return msgStats, 0, 0, err
+	}
+	return msgStats, activeRooms, activeE2EERooms, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/storage/shared"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// NewDatabase creates a new accounts and profiles database
+func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties *config.DatabaseOptions, serverName spec.ServerName, bcryptCost int, openIDTokenLifetimeMS int64, loginTokenLifetime time.Duration, serverNoticesLocalpart string) (*shared.Database, error) {
+	db, writer, err := conMan.Connection(dbProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	registationTokensTable, err := NewQLRegistrationTokensTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLRegistrationsTokenTable: %w", err)
+	}
+	accountsTable, err := NewQLAccountsTable(db, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLAccountsTable: %w", err)
+	}
+	accountDataTable, err := NewQLAccountDataTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLAccountDataTable: %w", err)
+	}
+	devicesTable, err := NewQLDevicesTable(db, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLDevicesTable: %w", err)
+	}
+	keyBackupTable, err := NewQLKeyBackupTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLKeyBackupTable: %w", err)
+	}
+	keyBackupVersionTable, err := NewQLKeyBackupVersionTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLKeyBackupVersionTable: %w", err)
+	}
+	loginTokenTable, err := NewQLLoginTokenTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLLoginTokenTable: %w", err)
+	}
+	openIDTable, err := NewQLOpenIDTable(db, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLOpenIDTable: %w", err)
+	}
+	profilesTable, err := NewQLProfilesTable(db, serverNoticesLocalpart)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLProfilesTable: %w", err)
+	}
+	threePIDTable, err := NewQLThreePIDTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLThreePIDTable: %w", err)
+	}
+	pusherTable, err := NewQLPusherTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLPusherTable: %w", err)
+	}
+	notificationsTable, err := NewQLNotificationTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLNotificationTable: %w", err)
+	}
+	statsTable, err := NewQLStatsTable(db, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLStatsTable: %w", err)
+	}
+	emailQueueTable, err := NewQLEmailQueueTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLEmailQueueTable: %w", err)
+	}
+	ssoIdentitiesTable, err := NewQLSSOIdentitiesTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLSSOIdentitiesTable: %w", err)
+	}
+	rateLimitOverridesTable, err := NewQLRateLimitOverridesTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewQLRateLimitOverridesTable: %w", err)
+	}
+
+	return &shared.Database{
+		AccountDatas:          accountDataTable,
+		Accounts:              accountsTable,
+		Devices:               devicesTable,
+		KeyBackups:            keyBackupTable,
+		KeyBackupVersions:     keyBackupVersionTable,
+		LoginTokens:           loginTokenTable,
+		OpenIDTokens:          openIDTable,
+		Profiles:              profilesTable,
+		ThreePIDs:             threePIDTable,
+		Pushers:               pusherTable,
+		Notifications:         notificationsTable,
+		RegistrationTokens:    registationTokensTable,
+		Stats:                 statsTable,
+		EmailQueue:            emailQueueTable,
+		SSOIdentities:         ssoIdentitiesTable,
+		RateLimitOverrides:    rateLimitOverridesTable,
+		ServerName:            serverName,
+		DB:                    db,
+		Writer:                writer,
+		LoginTokenLifetime:    loginTokenLifetime,
+		BcryptCost:            bcryptCost,
+		OpenIDTokenLifetimeMS: openIDTokenLifetimeMS,
+	}, nil
+}
+
+func NewKeyDatabase(conMan *sqlutil.Connections, dbProperties *config.DatabaseOptions) (*shared.KeyDatabase, error) {
+	db, writer, err := conMan.Connection(dbProperties)
+	if err != nil {
+		return nil, err
+	}
+	otk, err := NewQLOneTimeKeysTable(db)
+	if err != nil {
+		return nil, err
+	}
+	fk, err := NewQLFallbackKeysTable(db)
+	if err != nil {
+		return nil, err
+	}
+	dk, err := NewQLDeviceKeysTable(db)
+	if err != nil {
+		return nil, err
+	}
+	kc, err := NewQLKeyChangesTable(db)
+	if err != nil {
+		return nil, err
+	}
+	sdl, err := NewQLStaleDeviceListsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	csk, err := NewQLCrossSigningKeysTable(db)
+	if err != nil {
+		return nil, err
+	}
+	css, err := NewQLCrossSigningSigsTable(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shared.KeyDatabase{
+		OneTimeKeysTable:      otk,
+		FallbackKeysTable:     fk,
+		DeviceKeysTable:       dk,
+		KeyChangesTable:       kc,
+		StaleDeviceListsTable: sdl,
+		CrossSigningKeysTable: csk,
+		CrossSigningSigsTable: css,
+		Writer:                writer,
+	}, nil
+}
@@ -29,10 +29,12 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
 	"golang.org/x/crypto/bcrypt"
 
 	clientapi "github.com/matrix-org/dendrite/clientapi/api"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/api"
@@ -57,6 +59,9 @@ type Database struct {
 	Notifications         tables.NotificationTable
 	Pushers               tables.PusherTable
 	Stats                 tables.StatsTable
+	EmailQueue            tables.EmailQueueTable
+	SSOIdentities         tables.SSOIdentitiesTable
+	RateLimitOverrides    tables.RateLimitOverridesTable
 	LoginTokenLifetime    time.Duration
 	ServerName            spec.ServerName
 	BcryptCost            int
@@ -65,6 +70,7 @@ type Database struct {
 
 type KeyDatabase struct {
 	OneTimeKeysTable      tables.OneTimeKeys
+	FallbackKeysTable     tables.FallbackKeys
 	DeviceKeysTable       tables.DeviceKeys
 	KeyChangesTable       tables.KeyChanges
 	StaleDeviceListsTable tables.StaleDeviceLists
@@ -276,6 +282,10 @@ func (d *Database) QueryPushRules(
 	if err := json.Unmarshal(data, &pushRules); err != nil {
 		return nil, err
 	}
+	// Default rules introduced since the push rules were stored apply
+	// to existing accounts too. They are persisted with the next change
+	// to the push rules.
+	pushRules.Global.AddMissingDefaultRules(localpart, serverName)
 
 	return &pushRules, nil
 }
@@ -393,6 +403,73 @@ func (d *Database) GetThreePIDsForLocalpart(
 	return d.ThreePIDs.SelectThreePIDsForLocalpart(ctx, localpart, serverName)
 }
 
+// ErrSSOIdentityInUse is the error returned when trying to save an association involving
+// an identity at an identity provider which is already associated to a local user.
+var ErrSSOIdentityInUse = errors.New("this identity is already associated with a user")
+
+// SaveSSOAssociation saves the association between an identity at a single sign-on
+// identity provider and a local Matrix user.
+// If the identity is already part of an association, returns ErrSSOIdentityInUse.
+func (d *Database) SaveSSOAssociation(
+	ctx context.Context, idpID, subject string,
+	localpart string, serverName spec.ServerName,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		user, _, err := d.SSOIdentities.SelectLocalpartForSSOIdentity(ctx, txn, idpID, subject)
+		if err != nil {
+			return err
+		}
+		if len(user) > 0 {
+			return ErrSSOIdentityInUse
+		}
+		return d.SSOIdentities.InsertSSOIdentity(ctx, txn, idpID, subject, localpart, serverName)
+	})
+}
+
+// GetLocalpartForSSO looks up the localpart associated with an identity at a single
+// sign-on identity provider.
+// If no association involves the identity, returns an empty string.
+func (d *Database) GetLocalpartForSSO(
+	ctx context.Context, idpID, subject string,
+) (localpart string, serverName spec.ServerName, err error) {
+	return d.SSOIdentities.SelectLocalpartForSSOIdentity(ctx, nil, idpID, subject)
+}
+
+// GetRateLimitOverride returns the rate limits which replace the configured
+// ones for a user, or nil if the configured rate limits apply.
+func (d *Database) GetRateLimitOverride(
+	ctx context.Context, localpart string, serverName spec.ServerName,
+) (*api.RateLimitOverride, error) {
+	threshold, cooloffMS, found, err := d.RateLimitOverrides.SelectRateLimitOverride(ctx, nil, localpart, serverName)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &api.RateLimitOverride{
+		UserID:    userutil.MakeUserID(localpart, serverName),
+		Threshold: threshold,
+		CooloffMS: cooloffMS,
+	}, nil
+}
+
+// SetRateLimitOverride replaces the configured rate limits for a user.
+func (d *Database) SetRateLimitOverride(
+	ctx context.Context, localpart string, serverName spec.ServerName, threshold, cooloffMS int64,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.RateLimitOverrides.UpsertRateLimitOverride(ctx, txn, localpart, serverName, threshold, cooloffMS)
+	})
+}
+
+// DeleteRateLimitOverride removes the rate limit override for a user, so that
+// the configured rate limits apply again.
+func (d *Database) DeleteRateLimitOverride(
+	ctx context.Context, localpart string, serverName spec.ServerName,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.RateLimitOverrides.DeleteRateLimitOverride(ctx, txn, localpart, serverName)
+	})
+}
+
 // CheckAccountAvailability checks if the username/localpart is already present
 // in the database.
 // If the DB returns sql.ErrNoRows the Localpart isn't taken.
@@ -603,7 +680,16 @@ func (d *Database) UpsertBackupKeys(
 func (d *Database) GetDeviceByAccessToken(
 	ctx context.Context, token string,
 ) (*api.Device, error) {
-	return d.Devices.SelectDeviceByToken(ctx, token)
+	dev, hasPreviousRefreshToken, err := d.Devices.SelectDeviceByToken(ctx, token)
+	if err != nil || !hasPreviousRefreshToken {
+		return dev, err
+	}
+	// The client received the refreshed tokens, so the refresh token which was
+	// used to get them isn't needed anymore.
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Devices.DeletePreviousRefreshToken(ctx, txn, token)
+	})
+	return dev, err
 }
 
 // GetDeviceByID returns the device matching the given ID.
@@ -636,8 +722,20 @@ func (d *Database) GetDevicesByID(ctx context.Context, deviceIDs []string) ([]ap
 // Returns the device on success.
 func (d *Database) CreateDevice(
 	ctx context.Context, localpart string, serverName spec.ServerName,
-	deviceID *string, accessToken string, displayName *string, ipAddr, userAgent string,
+	deviceID *string, accessToken, refreshToken string, accessTokenExpiresTS int64,
+	displayName *string, ipAddr, userAgent string,
 ) (dev *api.Device, returnErr error) {
+	insertDevice := func(txn *sql.Tx, id string) (*api.Device, error) {
+		dev, err := d.Devices.InsertDevice(ctx, txn, id, localpart, serverName, accessToken, displayName, ipAddr, userAgent)
+		if err != nil || refreshToken == "" {
+			return dev, err
+		}
+		if err = d.Devices.UpdateDeviceTokens(ctx, txn, localpart, serverName, id, accessToken, refreshToken, "", accessTokenExpiresTS); err != nil {
+			return nil, err
+		}
+		dev.AccessTokenExpiresTS = accessTokenExpiresTS
+		return dev, nil
+	}
 	if deviceID != nil {
 		returnErr = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 			var err error
@@ -646,7 +744,7 @@ func (d *Database) CreateDevice(
 				return err
 			}
 
-			dev, err = d.Devices.InsertDevice(ctx, txn, *deviceID, localpart, serverName, accessToken, displayName, ipAddr, userAgent)
+			dev, err = insertDevice(txn, *deviceID)
 			return err
 		})
 	} else {
@@ -661,7 +759,7 @@ func (d *Database) CreateDevice(
 
 			returnErr = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 				var err error
-				dev, err = d.Devices.InsertDevice(ctx, txn, newDeviceID, localpart, serverName, accessToken, displayName, ipAddr, userAgent)
+				dev, err = insertDevice(txn, newDeviceID)
 				return err
 			})
 			if returnErr == nil {
@@ -672,6 +770,35 @@ func (d *Database) CreateDevice(
 	return dev, returnErr
 }
 
+// RefreshDeviceTokens replaces the tokens of the device with the given refresh token.
+// The refresh token which was used stays valid until the new tokens are used, so that
+// the client can refresh again if it didn't receive them.
+// Returns sql.ErrNoRows if the refresh token isn't valid.
+func (d *Database) RefreshDeviceTokens(
+	ctx context.Context, refreshToken, newAccessToken, newRefreshToken string, accessTokenExpiresTS int64,
+) (dev *api.Device, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		dev, err = d.Devices.SelectDeviceByRefreshToken(ctx, txn, refreshToken)
+		if err != nil {
+			return err
+		}
+		localpart, serverName, err := gomatrixserverlib.SplitID('@', dev.UserID)
+		if err != nil {
+			return err
+		}
+		// If the client used the previous refresh token again, it didn't receive the
+		// tokens we issued last time, so those are replaced and the previous refresh
+		// token stays the same.
+		return d.Devices.UpdateDeviceTokens(ctx, txn, localpart, serverName, dev.ID, newAccessToken, newRefreshToken, refreshToken, accessTokenExpiresTS)
+	})
+	if err != nil {
+		return nil, err
+	}
+	dev.AccessToken = newAccessToken
+	dev.AccessTokenExpiresTS = accessTokenExpiresTS
+	return dev, nil
+}
+
 // generateDeviceID creates a new device id. Returns an error if failed to generate
 // random bytes.
 func generateDeviceID() (string, error) {
@@ -786,8 +913,15 @@ func (d *Database) GetLoginTokenDataByToken(ctx context.Context, token string) (
 }
 
 func (d *Database) InsertNotification(ctx context.Context, localpart string, serverName spec.ServerName, eventID string, pos uint64, tweaks map[string]interface{}, n *api.Notification) error {
+	// Events sent in a thread are counted against the thread root, so that
+	// clients can request unread counts per thread.
+	var threadID string
+	relatesTo := gjson.GetBytes(n.Event.Content, `m\.relates_to`)
+	if relatesTo.Get("rel_type").Str == "m.thread" {
+		threadID = relatesTo.Get("event_id").Str
+	}
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.Notifications.Insert(ctx, txn, localpart, serverName, eventID, pos, pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false), n)
+		return d.Notifications.Insert(ctx, txn, localpart, serverName, eventID, threadID, pos, pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false), n)
 	})
 }
 
@@ -819,6 +953,10 @@ func (d *Database) GetRoomNotificationCounts(ctx context.Context, localpart stri
 	return d.Notifications.SelectRoomCounts(ctx, nil, localpart, serverName, roomID)
 }
 
+func (d *Database) GetRoomThreadNotificationCounts(ctx context.Context, localpart string, serverName spec.ServerName, roomID string) (map[string]api.ThreadNotificationCounts, error) {
+	return d.Notifications.SelectRoomThreadCounts(ctx, nil, localpart, serverName, roomID)
+}
+
 func (d *Database) DeleteOldNotifications(ctx context.Context) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		return d.Notifications.Clean(ctx, txn)
@@ -884,6 +1022,20 @@ func (d *Database) RemovePushers(
 	})
 }
 
+// GetEmailPushers returns the email pushers of all users.
+func (d *Database) GetEmailPushers(ctx context.Context) ([]api.EmailPusher, error) {
+	return d.Pushers.SelectPushersByKind(ctx, nil, api.EmailKind)
+}
+
+// SetPusherLastNotificationID records the last notification which was emailed to an email pusher.
+func (d *Database) SetPusherLastNotificationID(
+	ctx context.Context, appid, pushkey, localpart string, serverName spec.ServerName, id int64,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Pushers.UpdateLastNotificationID(ctx, txn, appid, pushkey, localpart, serverName, id)
+	})
+}
+
 // UserStatistics populates types.UserStatistics, used in reports.
 func (d *Database) UserStatistics(ctx context.Context) (*types.UserStatistics, *types.DatabaseEngine, error) {
 	return d.Stats.UserStatistics(ctx, nil)
@@ -901,6 +1053,32 @@ func (d *Database) DailyRoomsMessages(
 	return d.Stats.DailyRoomsMessages(ctx, nil, serverName)
 }
 
+// QueueEmail stores an email, so that the mailer sends it as soon as possible.
+func (d *Database) QueueEmail(ctx context.Context, recipient string, message []byte) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.EmailQueue.InsertEmail(ctx, txn, recipient, message, spec.AsTimestamp(time.Now()))
+	})
+}
+
+// DueEmails returns up to limit emails which are due to be sent, oldest first.
+func (d *Database) DueEmails(ctx context.Context, limit int) ([]types.QueuedEmail, error) {
+	return d.EmailQueue.SelectDueEmails(ctx, nil, spec.AsTimestamp(time.Now()), limit)
+}
+
+// UpdateEmailAttempts records that sending an email failed, and when to try again.
+func (d *Database) UpdateEmailAttempts(ctx context.Context, id int64, attempts int, nextAttempt time.Time) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.EmailQueue.UpdateEmailAttempts(ctx, txn, id, attempts, spec.AsTimestamp(nextAttempt))
+	})
+}
+
+// RemoveEmail removes an email from the queue, once it has been sent or we gave up on it.
+func (d *Database) RemoveEmail(ctx context.Context, id int64) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.EmailQueue.DeleteEmail(ctx, txn, id)
+	})
+}
+
 //
 
 func (d *KeyDatabase) ExistingOneTimeKeys(ctx context.Context, userID, deviceID string, keyIDsWithAlgorithms []string) (map[string]json.RawMessage, error) {
@@ -915,6 +1093,16 @@ func (d *KeyDatabase) StoreOneTimeKeys(ctx context.Context, keys api.OneTimeKeys
 	return
 }
 
+func (d *KeyDatabase) StoreFallbackKeys(ctx context.Context, keys api.OneTimeKeys) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FallbackKeysTable.InsertFallbackKeys(ctx, txn, keys)
+	})
+}
+
+func (d *KeyDatabase) UnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error) {
+	return d.FallbackKeysTable.SelectUnusedFallbackKeyAlgorithms(ctx, userID, deviceID)
+}
+
 func (d *KeyDatabase) OneTimeKeysCount(ctx context.Context, userID, deviceID string) (*api.OneTimeKeysCount, error) {
 	return d.OneTimeKeysTable.CountOneTimeKeys(ctx, userID, deviceID)
 }
@@ -981,6 +1169,13 @@ func (d *KeyDatabase) ClaimKeys(ctx context.Context, userToDeviceToAlgorithm map
 				if err != nil {
 					return err
 				}
+				if keyJSON == nil {
+					// the device has run out of one-time keys, hand out its fallback key instead
+					keyJSON, err = d.FallbackKeysTable.SelectAndMarkFallbackKeyUsed(ctx, txn, userID, deviceID, algo)
+					if err != nil {
+						return err
+					}
+				}
 				if keyJSON != nil {
 					result = append(result, api.OneTimeKeys{
 						UserID:   userID,
@@ -1034,6 +1229,9 @@ func (d *KeyDatabase) DeleteDeviceKeys(ctx context.Context, userID string, devic
 			if err := d.OneTimeKeysTable.DeleteOneTimeKeys(ctx, txn, userID, string(deviceID)); err != nil && err != sql.ErrNoRows {
 				return fmt.Errorf("d.OneTimeKeysTable.DeleteOneTimeKeys: %w", err)
 			}
+			if err := d.FallbackKeysTable.DeleteFallbackKeys(ctx, txn, userID, string(deviceID)); err != nil && err != sql.ErrNoRows {
+				return fmt.Errorf("d.FallbackKeysTable.DeleteFallbackKeys: %w", err)
+			}
 		}
 		return nil
 	})
@@ -27,6 +27,7 @@ import (
 
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/storage/postgres"
+	"github.com/matrix-org/dendrite/userapi/storage/ql"
 )
 
 // NewUserDatabase opens a new Postgres or Sqlite database (based on dataSourceName scheme)
@@ -42,6 +43,8 @@ func NewUserDatabase(
 	serverNoticesLocalpart string,
 ) (UserDatabase, error) {
 	switch {
+	case dbProperties.ConnectionString.IsFile():
+		return ql.NewDatabase(ctx, conMan, dbProperties, serverName, bcryptCost, openIDTokenLifetimeMS, loginTokenLifetime, serverNoticesLocalpart)
 	case dbProperties.ConnectionString.IsPostgres():
 		return postgres.NewDatabase(ctx, conMan, dbProperties, serverName, bcryptCost, openIDTokenLifetimeMS, loginTokenLifetime, serverNoticesLocalpart)
 	default:
@@ -53,6 +56,8 @@ func NewUserDatabase(
 // and sets postgres connection parameters.
 func NewKeyDatabase(conMan *sqlutil.Connections, dbProperties *config.DatabaseOptions) (KeyDatabase, error) {
 	switch {
+	case dbProperties.ConnectionString.IsFile():
+		return ql.NewKeyDatabase(conMan, dbProperties)
 	case dbProperties.ConnectionString.IsPostgres():
 		return postgres.NewKeyDatabase(conMan, dbProperties)
 	default:
@@ -3,6 +3,7 @@ package storage_test
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -26,6 +27,7 @@ import (
 	"github.com/matrix-org/dendrite/test/testrig"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage"
+	"github.com/matrix-org/dendrite/userapi/storage/shared"
 	"github.com/matrix-org/dendrite/userapi/storage/tables"
 )
 
@@ -37,7 +39,7 @@ var (
 )
 
 func mustCreateUserDatabase(t *testing.T, dbType test.DBType) (storage.UserDatabase, func()) {
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
 	db, err := storage.NewUserDatabase(context.Background(), cm, &config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
@@ -156,6 +158,62 @@ func Test_Accounts(t *testing.T) {
 	})
 }
 
+func Test_RefreshTokens(t *testing.T) {
+	alice := test.NewUser(t)
+	localpart, domain, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+
+		deviceID := util.RandomString(8)
+		expiresTS := time.Now().Add(time.Minute).UnixMilli()
+		dev, err := db.CreateDevice(ctx, localpart, domain, &deviceID, "access1", "refresh1", expiresTS, nil, "", "")
+		assert.NoError(t, err)
+		assert.Equal(t, expiresTS, dev.AccessTokenExpiresTS)
+		gotDev, err := db.GetDeviceByAccessToken(ctx, "access1")
+		assert.NoError(t, err)
+		assert.Equal(t, expiresTS, gotDev.AccessTokenExpiresTS)
+
+		_, err = db.RefreshDeviceTokens(ctx, "unknown", "access2", "refresh2", expiresTS)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		// Refreshing replaces the access token
+		dev, err = db.RefreshDeviceTokens(ctx, "refresh1", "access2", "refresh2", expiresTS+1)
+		assert.NoError(t, err)
+		assert.Equal(t, deviceID, dev.ID)
+		assert.Equal(t, alice.ID, dev.UserID)
+		assert.Equal(t, "access2", dev.AccessToken)
+		_, err = db.GetDeviceByAccessToken(ctx, "access1")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		// The refresh token which was used stays valid until the new tokens are used
+		_, err = db.RefreshDeviceTokens(ctx, "refresh1", "access3", "refresh3", expiresTS)
+		assert.NoError(t, err)
+		_, err = db.RefreshDeviceTokens(ctx, "refresh2", "access4", "refresh4", expiresTS)
+		assert.ErrorIs(t, err, sql.ErrNoRows, "tokens which were never received must be revoked")
+		gotDev, err = db.GetDeviceByAccessToken(ctx, "access3")
+		assert.NoError(t, err)
+		assert.Equal(t, deviceID, gotDev.ID)
+		_, err = db.RefreshDeviceTokens(ctx, "refresh1", "access4", "refresh4", expiresTS)
+		assert.ErrorIs(t, err, sql.ErrNoRows, "refresh token must be revoked once the new access token is used")
+
+		// Using the new refresh token revokes the previous one too
+		_, err = db.RefreshDeviceTokens(ctx, "refresh3", "access4", "refresh4", expiresTS)
+		assert.NoError(t, err)
+		_, err = db.RefreshDeviceTokens(ctx, "refresh4", "access5", "refresh5", expiresTS)
+		assert.NoError(t, err)
+		_, err = db.RefreshDeviceTokens(ctx, "refresh3", "access6", "refresh6", expiresTS)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		// Deleting the device revokes the refresh token
+		assert.NoError(t, db.RemoveDevices(ctx, localpart, domain, []string{deviceID}))
+		_, err = db.RefreshDeviceTokens(ctx, "refresh5", "access6", "refresh6", expiresTS)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
 func Test_Devices(t *testing.T) {
 	alice := test.NewUser(t)
 	localpart, domain, err := gomatrixserverlib.SplitID('@', alice.ID)
@@ -167,7 +225,7 @@ func Test_Devices(t *testing.T) {
 		db, close := mustCreateUserDatabase(t, dbType)
 		defer close()
 
-		deviceWithID, err := db.CreateDevice(ctx, localpart, domain, &deviceID, accessToken, nil, "", "")
+		deviceWithID, err := db.CreateDevice(ctx, localpart, domain, &deviceID, accessToken, "", 0, nil, "", "")
 		assert.NoError(t, err, "unable to create deviceWithoutID")
 
 		gotDevice, err := db.GetDeviceByID(ctx, localpart, domain, deviceID)
@@ -180,7 +238,7 @@ func Test_Devices(t *testing.T) {
 
 		// create a device without existing device ID
 		accessToken = util.RandomString(16)
-		deviceWithoutID, err := db.CreateDevice(ctx, localpart, domain, nil, accessToken, nil, "", "")
+		deviceWithoutID, err := db.CreateDevice(ctx, localpart, domain, nil, accessToken, "", 0, nil, "", "")
 		assert.NoError(t, err, "unable to create deviceWithoutID")
 		gotDeviceWithoutID, err := db.GetDeviceByID(ctx, localpart, domain, deviceWithoutID.ID)
 		assert.NoError(t, err, "unable to get device by id")
@@ -219,7 +277,7 @@ func Test_Devices(t *testing.T) {
 		// create one more device and remove the devices step by step
 		newDeviceID := util.RandomString(16)
 		accessToken = util.RandomString(16)
-		_, err = db.CreateDevice(ctx, localpart, domain, &newDeviceID, accessToken, nil, "", "")
+		_, err = db.CreateDevice(ctx, localpart, domain, &newDeviceID, accessToken, "", 0, nil, "", "")
 		assert.NoError(t, err, "unable to create new device")
 
 		devices, err = db.GetDevicesByLocalpart(ctx, localpart, domain)
@@ -506,6 +564,61 @@ func Test_ThreePID(t *testing.T) {
 	})
 }
 
+func Test_SSO(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceLocalpart, aliceDomain, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+		subject := util.RandomString(8)
+		err = db.SaveSSOAssociation(ctx, "oidc", subject, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err, "unable to save SSO association")
+
+		gotLocalpart, gotDomain, err := db.GetLocalpartForSSO(ctx, "oidc", subject)
+		assert.NoError(t, err, "unable to get localpart for SSO identity")
+		assert.Equal(t, aliceLocalpart, gotLocalpart)
+		assert.Equal(t, aliceDomain, gotDomain)
+
+		// the same subject at a different identity provider is a different identity
+		gotLocalpart, _, err = db.GetLocalpartForSSO(ctx, "other", subject)
+		assert.NoError(t, err, "unable to get localpart for SSO identity")
+		assert.Equal(t, "", gotLocalpart)
+
+		err = db.SaveSSOAssociation(ctx, "oidc", subject, "bob", aliceDomain)
+		assert.ErrorIs(t, err, shared.ErrSSOIdentityInUse)
+	})
+}
+
+func Test_RateLimitOverrides(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceLocalpart, aliceDomain, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+		override, err := db.GetRateLimitOverride(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err, "unable to get rate limit override")
+		assert.Nil(t, override)
+
+		err = db.SetRateLimitOverride(ctx, aliceLocalpart, aliceDomain, 10, 1000)
+		assert.NoError(t, err, "unable to set rate limit override")
+		err = db.SetRateLimitOverride(ctx, aliceLocalpart, aliceDomain, 0, 0)
+		assert.NoError(t, err, "unable to update rate limit override")
+		override, err = db.GetRateLimitOverride(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err, "unable to get rate limit override")
+		assert.Equal(t, &api.RateLimitOverride{UserID: alice.ID}, override)
+
+		err = db.DeleteRateLimitOverride(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err, "unable to delete rate limit override")
+		override, err = db.GetRateLimitOverride(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err, "unable to get rate limit override")
+		assert.Nil(t, override)
+	})
+}
+
 func Test_Notification(t *testing.T) {
 	alice := test.NewUser(t)
 	aliceLocalpart, aliceDomain, err := gomatrixserverlib.SplitID('@', alice.ID)
@@ -525,12 +638,17 @@ func Test_Notification(t *testing.T) {
 				// create some old notifications to test DeleteOldNotifications
 				ts = ts.AddDate(0, -2, 0)
 			}
+			content := spec.RawJSON("{}")
+			if i == 1 || i == 2 {
+				// some notifications are for events in a thread
+				content = spec.RawJSON(`{"m.relates_to":{"rel_type":"m.thread","event_id":"$threadroot"}}`)
+			}
 			notification := &api.Notification{
 				Actions: []*pushrules.Action{
 					{},
 				},
 				Event: synctypes.ClientEvent{
-					Content: spec.RawJSON("{}"),
+					Content: content,
 				},
 				Read:   false,
 				RoomID: roomID,
@@ -552,6 +670,13 @@ func Test_Notification(t *testing.T) {
 		total, _, err := db.GetRoomNotificationCounts(ctx, aliceLocalpart, aliceDomain, room2.ID)
 		assert.NoError(t, err, "unable to get notifications for room")
 		assert.Equal(t, int64(4), total)
+		// ... and for the threads in a room
+		threadCounts, err := db.GetRoomThreadNotificationCounts(ctx, aliceLocalpart, aliceDomain, room.ID)
+		assert.NoError(t, err, "unable to get thread notifications for room")
+		assert.Equal(t, map[string]api.ThreadNotificationCounts{"$threadroot": {Total: 2}}, threadCounts)
+		threadCounts, err = db.GetRoomThreadNotificationCounts(ctx, aliceLocalpart, aliceDomain, room2.ID)
+		assert.NoError(t, err, "unable to get thread notifications for room")
+		assert.Empty(t, threadCounts)
 
 		// mark notification as read
 		affected, err := db.SetNotificationsRead(ctx, aliceLocalpart, aliceDomain, room2.ID, 7, true)
@@ -809,3 +934,87 @@ func TestOneTimeKeys(t *testing.T) {
 		}
 	})
 }
+
+func TestFallbackKeys(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, clean := mustCreateKeyDatabase(t, dbType)
+		defer clean()
+		userID := "@alice:localhost"
+		deviceID := "alice_device"
+		claim := map[string]map[string]string{userID: {deviceID: "signed_curve25519"}}
+		otk := api.OneTimeKeys{
+			UserID:   userID,
+			DeviceID: deviceID,
+			KeyJSON:  map[string]json.RawMessage{"signed_curve25519:OTK1": []byte(`{"key":"otk"}`)},
+		}
+		fallbackKey := api.OneTimeKeys{
+			UserID:   userID,
+			DeviceID: deviceID,
+			KeyJSON:  map[string]json.RawMessage{"signed_curve25519:FALLBACK1": []byte(`{"key":"fallback1","fallback":true}`)},
+		}
+		_, err := db.StoreOneTimeKeys(ctx, otk)
+		MustNotError(t, err)
+		MustNotError(t, db.StoreFallbackKeys(ctx, fallbackKey))
+
+		unused, err := db.UnusedFallbackKeyAlgorithms(ctx, userID, deviceID)
+		MustNotError(t, err)
+		if !reflect.DeepEqual(unused, []string{"signed_curve25519"}) {
+			t.Fatalf("Expected an unused signed_curve25519 fallback key, got %v", unused)
+		}
+
+		// One-time keys are handed out first
+		claimedKeys, err := db.ClaimKeys(ctx, claim)
+		MustNotError(t, err)
+		if len(claimedKeys) != 1 || !reflect.DeepEqual(claimedKeys[0], otk) {
+			t.Fatalf("Expected to claim the one-time key %v. Got %v", otk, claimedKeys)
+		}
+
+		// Once they are exhausted, the fallback key is handed out, as often as needed
+		for i := 0; i < 2; i++ {
+			claimedKeys, err = db.ClaimKeys(ctx, claim)
+			MustNotError(t, err)
+			if len(claimedKeys) != 1 || !reflect.DeepEqual(claimedKeys[0], fallbackKey) {
+				t.Fatalf("Expected to claim the fallback key %v. Got %v", fallbackKey, claimedKeys)
+			}
+		}
+		unused, err = db.UnusedFallbackKeyAlgorithms(ctx, userID, deviceID)
+		MustNotError(t, err)
+		if len(unused) != 0 {
+			t.Fatalf("Expected no unused fallback keys, got %v", unused)
+		}
+
+		// Uploading the same key again doesn't mark it as unused
+		MustNotError(t, db.StoreFallbackKeys(ctx, fallbackKey))
+		unused, err = db.UnusedFallbackKeyAlgorithms(ctx, userID, deviceID)
+		MustNotError(t, err)
+		if len(unused) != 0 {
+			t.Fatalf("Expected no unused fallback keys, got %v", unused)
+		}
+
+		// A new fallback key replaces the old one
+		newFallbackKey := api.OneTimeKeys{
+			UserID:   userID,
+			DeviceID: deviceID,
+			KeyJSON:  map[string]json.RawMessage{"signed_curve25519:FALLBACK2": []byte(`{"key":"fallback2","fallback":true}`)},
+		}
+		MustNotError(t, db.StoreFallbackKeys(ctx, newFallbackKey))
+		unused, err = db.UnusedFallbackKeyAlgorithms(ctx, userID, deviceID)
+		MustNotError(t, err)
+		if !reflect.DeepEqual(unused, []string{"signed_curve25519"}) {
+			t.Fatalf("Expected an unused signed_curve25519 fallback key, got %v", unused)
+		}
+		claimedKeys, err = db.ClaimKeys(ctx, claim)
+		MustNotError(t, err)
+		if len(claimedKeys) != 1 || !reflect.DeepEqual(claimedKeys[0], newFallbackKey) {
+			t.Fatalf("Expected to claim the new fallback key %v. Got %v", newFallbackKey, claimedKeys)
+		}
+
+		// Deleting the device removes its fallback keys
+		MustNotError(t, db.DeleteDeviceKeys(ctx, userID, []gomatrixserverlib.KeyID{gomatrixserverlib.KeyID(deviceID)}))
+		claimedKeys, err = db.ClaimKeys(ctx, claim)
+		MustNotError(t, err)
+		if len(claimedKeys) != 0 {
+			t.Fatalf("Expected no keys to be claimed, got %v", claimedKeys)
+		}
+	})
+}
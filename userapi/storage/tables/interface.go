@@ -61,11 +61,14 @@ type DevicesTable interface {
 	DeleteDevices(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, devices []string) error
 	DeleteDevicesByLocalpart(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, exceptDeviceID string) error
 	UpdateDeviceName(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID string, displayName *string) error
-	SelectDeviceByToken(ctx context.Context, accessToken string) (*api.Device, error)
+	SelectDeviceByToken(ctx context.Context, accessToken string) (dev *api.Device, hasPreviousRefreshToken bool, err error)
+	SelectDeviceByRefreshToken(ctx context.Context, txn *sql.Tx, refreshToken string) (*api.Device, error)
 	SelectDeviceByID(ctx context.Context, localpart string, serverName spec.ServerName, deviceID string) (*api.Device, error)
 	SelectDevicesByLocalpart(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, exceptDeviceID string) ([]api.Device, error)
 	SelectDevicesByID(ctx context.Context, deviceIDs []string) ([]api.Device, error)
 	UpdateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID, ipAddr, userAgent string) error
+	UpdateDeviceTokens(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID, accessToken, refreshToken, previousRefreshToken string, accessTokenExpiresTS int64) error
+	DeletePreviousRefreshToken(ctx context.Context, txn *sql.Tx, accessToken string) error
 }
 
 type KeyBackupTable interface {
@@ -111,21 +114,44 @@ type ThreePIDTable interface {
 	DeleteThreePID(ctx context.Context, txn *sql.Tx, threepid string, medium string) (err error)
 }
 
+type SSOIdentitiesTable interface {
+	SelectLocalpartForSSOIdentity(ctx context.Context, txn *sql.Tx, idpID, subject string) (localpart string, serverName spec.ServerName, err error)
+	InsertSSOIdentity(ctx context.Context, txn *sql.Tx, idpID, subject, localpart string, serverName spec.ServerName) (err error)
+}
+
+type RateLimitOverridesTable interface {
+	SelectRateLimitOverride(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) (threshold, cooloffMS int64, found bool, err error)
+	UpsertRateLimitOverride(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, threshold, cooloffMS int64) error
+	DeleteRateLimitOverride(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) error
+}
+
 type PusherTable interface {
 	InsertPusher(ctx context.Context, txn *sql.Tx, session_id int64, pushkey string, pushkeyTS int64, kind api.PusherKind, appid, appdisplayname, devicedisplayname, profiletag, lang, data, localpart string, serverName spec.ServerName) error
 	SelectPushers(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) ([]api.Pusher, error)
 	DeletePusher(ctx context.Context, txn *sql.Tx, appid, pushkey, localpart string, serverName spec.ServerName) error
 	DeletePushers(ctx context.Context, txn *sql.Tx, appid, pushkey string) error
+	SelectPushersByKind(ctx context.Context, txn *sql.Tx, kind api.PusherKind) ([]api.EmailPusher, error)
+	UpdateLastNotificationID(ctx context.Context, txn *sql.Tx, appid, pushkey, localpart string, serverName spec.ServerName, id int64) error
 }
 
 type NotificationTable interface {
 	Clean(ctx context.Context, txn *sql.Tx) error
-	Insert(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, eventID string, pos uint64, highlight bool, n *api.Notification) error
+	Insert(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, eventID, threadID string, pos uint64, highlight bool, n *api.Notification) error
 	DeleteUpTo(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string, pos uint64) (affected bool, _ error)
 	UpdateRead(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string, pos uint64, v bool) (affected bool, _ error)
 	Select(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, fromID int64, limit int, filter NotificationFilter) ([]*api.Notification, int64, error)
 	SelectCount(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, filter NotificationFilter) (int64, error)
 	SelectRoomCounts(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string) (total int64, highlight int64, _ error)
+	// SelectRoomThreadCounts returns the unread notification counts for each thread in the given room, keyed by thread root event ID.
+	SelectRoomThreadCounts(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string) (map[string]api.ThreadNotificationCounts, error)
+}
+
+type EmailQueueTable interface {
+	InsertEmail(ctx context.Context, txn *sql.Tx, recipient string, message []byte, nextAttemptTS spec.Timestamp) error
+	// SelectDueEmails returns the emails which should be sent at the given time, oldest first.
+	SelectDueEmails(ctx context.Context, txn *sql.Tx, now spec.Timestamp, limit int) ([]types.QueuedEmail, error)
+	UpdateEmailAttempts(ctx context.Context, txn *sql.Tx, id int64, attempts int, nextAttemptTS spec.Timestamp) error
+	DeleteEmail(ctx context.Context, txn *sql.Tx, id int64) error
 }
 
 type StatsTable interface {
@@ -168,6 +194,16 @@ type OneTimeKeys interface {
 	DeleteOneTimeKeys(ctx context.Context, txn *sql.Tx, userID, deviceID string) error
 }
 
+type FallbackKeys interface {
+	// InsertFallbackKeys replaces the fallback key for each algorithm in keys. Replacing a key with a different one marks it as unused.
+	InsertFallbackKeys(ctx context.Context, txn *sql.Tx, keys api.OneTimeKeys) error
+	SelectUnusedFallbackKeyAlgorithms(ctx context.Context, userID, deviceID string) ([]string, error)
+	// SelectAndMarkFallbackKeyUsed selects the fallback key for the user/device/algorithm specified and returns the algo:key_id => JSON.
+	// Unlike one-time keys, fallback keys are kept after being claimed. Returns an empty map if the key does not exist.
+	SelectAndMarkFallbackKeyUsed(ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string) (map[string]json.RawMessage, error)
+	DeleteFallbackKeys(ctx context.Context, txn *sql.Tx, userID, deviceID string) error
+}
+
 type DeviceKeys interface {
 	SelectDeviceKeysJSON(ctx context.Context, keys []api.DeviceMessage) error
 	InsertDeviceKeys(ctx context.Context, txn *sql.Tx, keys []api.DeviceMessage) error
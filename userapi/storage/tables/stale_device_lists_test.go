@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/matrix-org/dendrite/userapi/storage/postgres"
+	"github.com/matrix-org/dendrite/userapi/storage/ql"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -15,7 +16,7 @@ import (
 )
 
 func mustCreateTable(t *testing.T, dbType test.DBType) (tab tables.StaleDeviceLists, close func()) {
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
 	}, nil)
@@ -23,6 +24,8 @@ func mustCreateTable(t *testing.T, dbType test.DBType) (tab tables.StaleDeviceLi
 		t.Fatalf("failed to open database: %s", err)
 	}
 	switch dbType {
+	case test.DBTypeQL:
+		tab, err = ql.NewQLStaleDeviceListsTable(db)
 	case test.DBTypePostgres:
 		tab, err = postgres.NewPostgresStaleDeviceListsTable(db)
 	}
@@ -16,6 +16,7 @@ import (
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/postgres"
+	"github.com/matrix-org/dendrite/userapi/storage/ql"
 	"github.com/matrix-org/dendrite/userapi/storage/tables"
 	"github.com/matrix-org/dendrite/userapi/types"
 )
@@ -32,7 +33,7 @@ func mustMakeDBs(t *testing.T, dbType test.DBType) (
 		err        error
 	)
 
-	connStr, close := test.PrepareDBConnectionString(t)
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
 	db, err := sqlutil.Open(&config.DatabaseOptions{
 		ConnectionString: config.DataSource(connStr),
 	}, nil)
@@ -41,6 +42,19 @@ func mustMakeDBs(t *testing.T, dbType test.DBType) (
 	}
 
 	switch dbType {
+	case test.DBTypeQL:
+		accTable, err = ql.NewQLAccountsTable(db, "localhost")
+		if err != nil {
+			t.Fatalf("unable to create acc db: %v", err)
+		}
+		devTable, err = ql.NewQLDevicesTable(db, "localhost")
+		if err != nil {
+			t.Fatalf("unable to open device db: %v", err)
+		}
+		statsTable, err = ql.NewQLStatsTable(db, "localhost")
+		if err != nil {
+			t.Fatalf("unable to open stats db: %v", err)
+		}
 	case test.DBTypePostgres:
 		accTable, err = postgres.NewPostgresAccountsTable(db, "localhost")
 		if err != nil {
@@ -120,7 +134,7 @@ func Test_UserStatistics(t *testing.T) {
 	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
 		db, accDB, devDB, statsDB, close := mustMakeDBs(t, dbType)
 		defer close()
-		wantType := "SQLite"
+		wantType := "QL"
 		if dbType == test.DBTypePostgres {
 			wantType = "Postgres"
 		}
@@ -50,3 +50,12 @@ type CrossSigningKeyMap map[fclient.CrossSigningKeyPurpose]spec.Base64Bytes
 
 // Map of user ID -> key ID -> signature
 type CrossSigningSigMap map[string]map[gomatrixserverlib.KeyID]spec.Base64Bytes
+
+// QueuedEmail is an email waiting to be sent by the mailer
+type QueuedEmail struct {
+	ID        int64
+	Recipient string
+	// Message is the complete message, including headers
+	Message  []byte
+	Attempts int
+}
@@ -31,6 +31,8 @@ import (
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/consumers"
 	"github.com/matrix-org/dendrite/userapi/internal"
+	"github.com/matrix-org/dendrite/userapi/mailer"
+	"github.com/matrix-org/dendrite/userapi/passwordproviders"
 	"github.com/matrix-org/dendrite/userapi/producers"
 	"github.com/matrix-org/dendrite/userapi/storage"
 	"github.com/matrix-org/dendrite/userapi/util"
@@ -103,6 +105,21 @@ func NewInternalAPI(
 		FedClient:            fedClient,
 	}
 
+	userAPI.PasswordProviders, err = passwordproviders.NewProviders(dendriteCfg.UserAPI.PasswordProviders)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to create password providers")
+	}
+
+	if dendriteCfg.UserAPI.Email.Enabled {
+		m, err := mailer.NewMailer(&dendriteCfg.UserAPI, db, mailer.NewSMTPSender(&dendriteCfg.UserAPI))
+		if err != nil {
+			logrus.WithError(err).Panic("failed to create mailer")
+		}
+		m.Start(processContext)
+		userAPI.Mailer = m
+		internal.NewEmailNotifier(&dendriteCfg.UserAPI, db, rsAPI, m).Start(processContext)
+	}
+
 	updater := internal.NewDeviceListUpdater(processContext, keyDB, userAPI, keyChangeProducer, fedClient, dendriteCfg.UserAPI.WorkerCount, rsAPI, dendriteCfg.Global.ServerName, enableMetrics, blacklistedOrBackingOffFn)
 	userAPI.Updater = updater
 	// Remove users which we don't share a room with anymore
@@ -16,6 +16,8 @@ package userapi_test
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"reflect"
 	"sync"
@@ -37,6 +39,7 @@ import (
 	"github.com/matrix-org/dendrite/test/testrig"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/internal"
+	"github.com/matrix-org/dendrite/userapi/passwordproviders"
 	"github.com/matrix-org/dendrite/userapi/storage"
 )
 
@@ -47,6 +50,7 @@ const (
 type apiTestOpts struct {
 	loginTokenLifetime time.Duration
 	serverName         string
+	passwordProviders  []passwordproviders.Provider
 }
 
 type dummyProducer struct {
@@ -104,6 +108,7 @@ func MustMakeInternalAPI(t *testing.T, opts apiTestOpts, dbType test.DBType, pub
 			Config:            &cfg.UserAPI,
 			SyncProducer:      syncProducer,
 			KeyChangeProducer: keyChangeProducer,
+			PasswordProviders: opts.passwordProviders,
 		}, accountDB, func() {
 			close()
 		}
@@ -200,6 +205,109 @@ func TestPasswordlessLoginFails(t *testing.T) {
 	})
 }
 
+// fakePasswordProvider knows the users in its passwords map.
+type fakePasswordProvider struct {
+	passwords map[string]string
+	err       error
+}
+
+func (p *fakePasswordProvider) CheckPassword(ctx context.Context, localpart string, serverName spec.ServerName, password string) (*passwordproviders.Profile, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if pw, ok := p.passwords[localpart]; !ok || pw != password {
+		return nil, nil
+	}
+	return &passwordproviders.Profile{
+		DisplayName: "Display " + localpart,
+		Emails:      []string{localpart + "@example.com"},
+	}, nil
+}
+
+func TestPasswordProviders(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		provider := &fakePasswordProvider{passwords: map[string]string{"alice": "external", "local": "external"}}
+		userAPI, accountDB, close := MustMakeInternalAPI(t, apiTestOpts{
+			passwordProviders: []passwordproviders.Provider{
+				&fakePasswordProvider{err: errors.New("unavailable")},
+				provider,
+			},
+		}, dbType, nil)
+		defer close()
+		if _, err := accountDB.CreateAccount(ctx, "local", serverName, "localpassword", "", api.AccountTypeUser); err != nil {
+			t.Fatalf("failed to make account: %s", err)
+		}
+
+		login := func(localpart, password string) *api.Account {
+			res := &api.QueryAccountByPasswordResponse{}
+			if err := userAPI.QueryAccountByPassword(ctx, &api.QueryAccountByPasswordRequest{
+				Localpart:         localpart,
+				ServerName:        serverName,
+				PlaintextPassword: password,
+			}, res); err != nil {
+				t.Fatalf("failed to query account by password: %s", err)
+			}
+			if res.Exists != (res.Account != nil) {
+				t.Fatalf("inconsistent response: %+v", res)
+			}
+			return res.Account
+		}
+
+		if acc := login("alice", "wrong"); acc != nil {
+			t.Fatalf("expected a wrong password to be rejected, got %+v", acc)
+		}
+		if _, err := accountDB.GetAccountByLocalpart(ctx, "alice", serverName); err != sql.ErrNoRows {
+			t.Fatalf("expected no account to be created for a failed login, got %v", err)
+		}
+
+		// The account is created on the first login, with the profile of the password provider
+		acc := login("alice", "external")
+		if acc == nil || acc.UserID != "@alice:"+string(serverName) || acc.AccountType != api.AccountTypeUser {
+			t.Fatalf("expected the account to be created, got %+v", acc)
+		}
+		profile, err := accountDB.GetProfileByLocalpart(ctx, "alice", serverName)
+		if err != nil {
+			t.Fatalf("failed to get profile: %s", err)
+		}
+		if profile.DisplayName != "Display alice" {
+			t.Fatalf("expected the display name to be synced, got %q", profile.DisplayName)
+		}
+		localpart, _, err := accountDB.GetLocalpartForThreePID(ctx, "alice@example.com", "email")
+		if err != nil || localpart != "alice" {
+			t.Fatalf("expected the email address to be associated with the account, got %q, %v", localpart, err)
+		}
+		if acc = login("alice", "external"); acc == nil || acc.UserID != "@alice:"+string(serverName) {
+			t.Fatalf("expected the existing account to be returned, got %+v", acc)
+		}
+
+		// Local passwords are still accepted for local accounts
+		if acc = login("local", "localpassword"); acc == nil {
+			t.Fatalf("expected the local password to be accepted")
+		}
+		// Password providers can't log in to accounts they didn't create
+		if acc = login("local", "external"); acc != nil {
+			t.Fatalf("expected the external password to be rejected for a local account, got %+v", acc)
+		}
+		for localpart, accountType := range map[string]api.AccountType{
+			"sso":        api.AccountTypeUser,
+			"appservice": api.AccountTypeAppService,
+		} {
+			if _, err = accountDB.CreateAccount(ctx, localpart, serverName, "", "", accountType); err != nil {
+				t.Fatalf("failed to make account: %s", err)
+			}
+		}
+		provider.passwords["sso"] = "external"
+		provider.passwords["appservice"] = "external"
+		if acc = login("sso", "external"); acc != nil {
+			t.Fatalf("expected the external password to be rejected for a passwordless account, got %+v", acc)
+		}
+		if acc = login("appservice", "external"); acc != nil {
+			t.Fatalf("expected the external password to be rejected for an appservice account, got %+v", acc)
+		}
+	})
+}
+
 func TestLoginToken(t *testing.T) {
 	ctx := context.Background()
 
@@ -49,7 +49,8 @@ func NotifyUserCountsAsync(ctx context.Context, pgClient pushgateway.Client, loc
 		// Sytest requires consumers/roomserver.go to do it
 		// one-by-one, so we do the same here.
 		for _, pusherDevice := range pusherDevices {
-			// TODO: support "email".
+			// Email pushers aren't told about notification counts, as the
+			// EmailNotifier only emails notifications which are still unread.
 			if !strings.HasPrefix(pusherDevice.URL, "http") {
 				continue
 			}